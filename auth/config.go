@@ -10,6 +10,8 @@ const (
 	AuthTypeOIDC
 	// HEART profiled OpenID Connect and OAuth 2.0
 	AuthTypeHEART
+	// SMART on FHIR with JWT access tokens validated locally
+	AuthTypeSMART
 )
 
 // Config represents configuration information necessary to set up authentication
@@ -25,6 +27,9 @@ type Config struct {
 	JWKPath          string
 	OPURL            string
 	SessionSecret    string
+	JWKSURL          string
+	Issuer           string
+	Audience         string
 }
 
 // None provides a server config where no authorization or authentication will
@@ -72,3 +77,17 @@ func HEART(clientID, jwkPath, opURL, sessionSecret string) Config {
 	return Config{Method: AuthTypeHEART, ClientID: clientID, JWKPath: jwkPath,
 		OPURL: opURL, SessionSecret: sessionSecret}
 }
+
+// SMART provides a server configuration that will authorize requests with SMART on
+// FHIR (v1 or v2) scopes, validating JWT access tokens locally rather than by token
+// introspection.
+//
+// jwks is the file or http(s) URL of the JSON Web Key Set of the authorization server,
+//   whose public keys must have signed the tokens
+// issuer and audience are what the tokens' iss and aud claims must be (unchecked if empty)
+// authorizationURL and tokenURL are the authorization server's endpoints advertised in
+//   /.well-known/smart-configuration
+func SMART(jwks, issuer, audience, authorizationURL, tokenURL string) Config {
+	return Config{Method: AuthTypeSMART, JWKSURL: jwks, Issuer: issuer, Audience: audience,
+		AuthorizationURL: authorizationURL, TokenURL: tokenURL}
+}
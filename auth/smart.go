@@ -0,0 +1,420 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// The gin.Context keys set by the SMART on FHIR handlers, in addition to scopes, subject and clientID
+const (
+	// LaunchPatientKey is the id of the patient in the token's launch context, if any
+	LaunchPatientKey = "patient"
+	// PatientCompartmentKey is set (to the id of the launch context's patient) when a request is only
+	// allowed by patient/ scopes, so it must be limited to that patient's compartment
+	PatientCompartmentKey = "patientCompartment"
+)
+
+// the SMART v2 permissions
+const (
+	InteractionCreate = "c"
+	InteractionRead   = "r"
+	InteractionUpdate = "u"
+	InteractionDelete = "d"
+	InteractionSearch = "s"
+)
+
+// SMARTScope is a SMART on FHIR clinical scope (http://hl7.org/fhir/smart-app-launch/scopes-and-launch-context.html),
+// e.g. patient/Observation.read (v1) or user/*.cruds (v2)
+type SMARTScope struct {
+	Context      string // patient, user or system
+	ResourceType string // or * for all resource types
+	Interactions string // the v2 permissions the scope grants
+}
+
+// ParseSMARTScope parses a clinical scope, returning false for other scopes (e.g. launch/patient or openid).
+// Granular v2 scopes (e.g. patient/Observation.rs?category=laboratory) aren't supported so grant nothing.
+func ParseSMARTScope(scope string) (SMARTScope, bool) {
+	slash := strings.Index(scope, "/")
+	dot := strings.LastIndex(scope, ".")
+	if slash < 0 || dot < slash || strings.Contains(scope, "?") {
+		return SMARTScope{}, false
+	}
+	parsed := SMARTScope{Context: scope[:slash], ResourceType: scope[slash+1 : dot]}
+	switch parsed.Context {
+	case "patient", "user", "system":
+	default:
+		return SMARTScope{}, false
+	}
+	if parsed.ResourceType == "" {
+		return SMARTScope{}, false
+	}
+
+	switch permissions := scope[dot+1:]; permissions {
+	case "read":
+		parsed.Interactions = InteractionRead + InteractionSearch
+	case "write":
+		parsed.Interactions = InteractionCreate + InteractionUpdate + InteractionDelete
+	case "*":
+		parsed.Interactions = "cruds"
+	default:
+		// v2 permissions are a subset of cruds in that order
+		if permissions == "" || !isOrderedSubset(permissions, "cruds") {
+			return SMARTScope{}, false
+		}
+		parsed.Interactions = permissions
+	}
+	return parsed, true
+}
+
+func isOrderedSubset(s string, of string) bool {
+	for _, r := range s {
+		i := strings.IndexRune(of, r)
+		if i < 0 {
+			return false
+		}
+		of = of[i+1:]
+	}
+	return true
+}
+
+// Allows returns whether the scope grants all of the interactions on a resource type
+func (s SMARTScope) Allows(resourceType string, interactions string) bool {
+	if s.ResourceType != "*" && s.ResourceType != resourceType {
+		return false
+	}
+	for _, interaction := range interactions {
+		if !strings.ContainsRune(s.Interactions, interaction) {
+			return false
+		}
+	}
+	return true
+}
+
+// JWKS is a JSON Web Key Set from a file or an http(s) URL, whose public keys are used to verify
+// the signatures of access tokens. Keys from URLs are fetched again when a token is signed by an
+// unknown key (at most once a minute), in case they have been rotated.
+type JWKS struct {
+	source string
+
+	lock      sync.Mutex
+	keys      jose.JsonWebKeySet
+	fetchedAt time.Time
+}
+
+const jwksRefetchInterval = time.Minute
+
+// NewJWKS creates a JWKS for the keys in a file or at an http(s) URL, which are loaded when first needed
+func NewJWKS(source string) *JWKS {
+	return &JWKS{source: source}
+}
+
+func (k *JWKS) isURL() bool {
+	return strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://")
+}
+
+func (k *JWKS) load() error {
+	var data []byte
+	var err error
+	if k.isURL() {
+		var resp *http.Response
+		resp, err = http.Get(k.source)
+		if err != nil {
+			return errors.Annotate(err, "Couldn't fetch the JWKS")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("Couldn't fetch the JWKS: HTTP %d", resp.StatusCode)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(k.source)
+	}
+	if err != nil {
+		return errors.Annotate(err, "Couldn't read the JWKS")
+	}
+
+	var keys jose.JsonWebKeySet
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return errors.Annotate(err, "Couldn't decode the JWKS")
+	}
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+// verificationKeys returns the public keys with an id (or all of them if the id is empty)
+func (k *JWKS) verificationKeys(kid string) ([]jose.JsonWebKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	find := func() []jose.JsonWebKey {
+		var keys []jose.JsonWebKey
+		for _, key := range k.keys.Keys {
+			// symmetric keys would allow tokens to be forged by anyone with the JWKS
+			if (kid == "" || key.KeyID == kid) && key.IsPublic() {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	if k.fetchedAt.IsZero() {
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+	}
+	keys := find()
+	if len(keys) == 0 && k.isURL() && time.Since(k.fetchedAt) > jwksRefetchInterval {
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+		keys = find()
+	}
+	return keys, nil
+}
+
+// SMARTClaims are the claims of a SMART on FHIR access token that the server uses
+type SMARTClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	ClientID  string   `json:"client_id"`
+	Scope     string   `json:"scope"`
+	Patient   string   `json:"patient"`
+}
+
+// audience is a string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// ParseSMARTToken verifies the signature of an access token with a JWKS and checks its
+// expiry and (unless they're empty) its issuer and audience
+func ParseSMARTToken(token string, keys *JWKS, issuer string, aud string) (*SMARTClaims, error) {
+	signed, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, errors.Annotate(err, "Invalid token")
+	}
+	if len(signed.Signatures) != 1 {
+		return nil, errors.New("Invalid token: expected one signature")
+	}
+	verificationKeys, err := keys.verificationKeys(signed.Signatures[0].Header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	for _, key := range verificationKeys {
+		if payload, err = signed.Verify(key.Key); err == nil {
+			break
+		}
+	}
+	if payload == nil {
+		return nil, errors.New("Invalid token: the signature couldn't be verified")
+	}
+
+	var claims SMARTClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Annotate(err, "Invalid token claims")
+	}
+	now := time.Now().Unix()
+	if claims.Expiry == 0 || now >= claims.Expiry {
+		return nil, errors.New("The token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("The token isn't valid yet")
+	}
+	if issuer != "" && claims.Issuer != issuer {
+		return nil, errors.Errorf("The token wasn't issued by %s", issuer)
+	}
+	if aud != "" {
+		found := false
+		for _, a := range claims.Audience {
+			found = found || a == aud
+		}
+		if !found {
+			return nil, errors.Errorf("The token isn't for %s", aud)
+		}
+	}
+	return &claims, nil
+}
+
+// SMARTAuthenticationHandler creates a gin.HandlerFunc that validates SMART on FHIR bearer tokens
+// locally: they must be JWTs signed by one of the keys of the JWKS, unexpired and, unless issuer or
+// audience are empty, issued by the issuer for the audience.
+//
+// Requests without a valid token are rejected with 401. For valid tokens, the gin.Context is augmented
+// like OAuthIntrospectionHandler does (scopes, subject and clientID) and with the patient in the
+// token's launch context (LaunchPatientKey). SMARTScopesHandler then checks the scopes.
+func SMARTAuthenticationHandler(keys *JWKS, issuer string, audience string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorization := c.Request.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if authorization == "" || token == authorization {
+			c.Header("WWW-Authenticate", `Bearer realm="FHIR"`)
+			c.String(http.StatusUnauthorized, "A bearer token is required")
+			c.Abort()
+			return
+		}
+		claims, err := ParseSMARTToken(token, keys, issuer, audience)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="FHIR", error="invalid_token"`)
+			c.String(http.StatusUnauthorized, err.Error())
+			c.Abort()
+			return
+		}
+		c.Set("scopes", strings.Fields(claims.Scope))
+		c.Set("subject", claims.Subject)
+		c.Set("clientID", claims.ClientID)
+		if claims.Patient != "" {
+			c.Set(LaunchPatientKey, claims.Patient)
+		}
+	}
+}
+
+// SMARTScopesHandler creates a gin.HandlerFunc that checks that the scopes set by
+// SMARTAuthenticationHandler allow a request to the endpoints of a resource type (or, if
+// resourceName is *, to system-level endpoints such as batches, which need scopes for all
+// resource types).
+//
+// Requests allowed only by patient/ scopes need a patient in the token's launch context, and
+// have it set as PatientCompartmentKey for the server to limit them to its compartment.
+func SMARTScopesHandler(resourceName string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		interactions := requestInteractions(c, resourceName)
+		allowed, patientScoped := scopesAllow(c, resourceName, interactions)
+		if allowed && !patientScoped {
+			return
+		}
+
+		patient, hasPatient := c.Get(LaunchPatientKey)
+		if patientScoped && hasPatient && resourceName != "*" {
+			c.Set(PatientCompartmentKey, patient)
+			return
+		}
+		message := "You do not have permission to modify this resource"
+		if interactions == InteractionRead || interactions == InteractionSearch {
+			message = "You do not have permission to view this resource"
+		}
+		if patientScoped && !hasPatient {
+			message = "The token's patient/ scopes have no patient launch context"
+		}
+		c.String(http.StatusForbidden, message)
+		c.Abort()
+	}
+}
+
+// SMARTReadAccess returns whether the scopes set by SMARTAuthenticationHandler allow reading resources
+// of a type, e.g. ones included in a search of another type. If only patient/ scopes do, patientID is
+// the patient in the token's launch context, whose compartment the resources must be in.
+func SMARTReadAccess(c *gin.Context, resourceName string) (allowed bool, patientID string) {
+	allowed, patientScoped := scopesAllow(c, resourceName, InteractionRead)
+	if !allowed || !patientScoped {
+		return allowed, ""
+	}
+	patient, _ := c.Get(LaunchPatientKey)
+	patientID, _ = patient.(string)
+	return patientID != "", patientID
+}
+
+// scopesAllow returns whether the scopes set by SMARTAuthenticationHandler allow interactions with
+// resources of a type and, if so, whether only patient/ scopes do
+func scopesAllow(c *gin.Context, resourceName string, interactions string) (allowed bool, patientScoped bool) {
+	grantedScopes, _ := c.Get("scopes")
+	scopes, _ := grantedScopes.([]string)
+	for _, scope := range scopes {
+		parsed, ok := ParseSMARTScope(scope)
+		if !ok || !parsed.Allows(resourceName, interactions) {
+			continue
+		}
+		if parsed.Context != "patient" {
+			return true, false
+		}
+		patientScoped = true
+	}
+	return patientScoped, patientScoped
+}
+
+// requestInteractions returns the SMART v2 permissions that a request needs
+func requestInteractions(c *gin.Context, resourceName string) string {
+	if resourceName == "*" {
+		if c.Request.Method == "GET" {
+			return InteractionRead + InteractionSearch
+		}
+		return "cruds"
+	}
+
+	id := c.Param("id")
+	switch c.Request.Method {
+	case "GET":
+		if id == "" || id == "_history" {
+			return InteractionSearch
+		}
+		return InteractionRead
+	case "POST":
+		switch {
+		case id == "":
+			return InteractionCreate
+		case id == "_search":
+			return InteractionSearch
+		default:
+			// operations such as $validate and $expand
+			return InteractionRead
+		}
+	case "PUT", "PATCH":
+		return InteractionUpdate
+	case "DELETE":
+		return InteractionDelete
+	}
+	return "cruds"
+}
+
+// SMARTConfigurationHandler serves the SMART on FHIR discovery document (/.well-known/smart-configuration)
+func SMARTConfigurationHandler(config Config) gin.HandlerFunc {
+	document := gin.H{
+		"authorization_endpoint":           config.AuthorizationURL,
+		"token_endpoint":                   config.TokenURL,
+		"grant_types_supported":            []string{"authorization_code", "client_credentials"},
+		"response_types_supported":         []string{"code"},
+		"code_challenge_methods_supported": []string{"S256"},
+		"scopes_supported": []string{
+			"openid", "fhirUser", "launch", "launch/patient", "offline_access",
+			"patient/*.read", "patient/*.write", "patient/*.cruds",
+			"user/*.read", "user/*.write", "user/*.cruds",
+			"system/*.read", "system/*.write", "system/*.cruds",
+		},
+		"capabilities": []string{
+			"launch-ehr", "launch-standalone", "client-public", "client-confidential-symmetric",
+			"context-standalone-patient", "permission-patient", "permission-user",
+			"permission-v1", "permission-v2",
+		},
+	}
+	if config.Issuer != "" {
+		document["issuer"] = config.Issuer
+	}
+	if jwks := NewJWKS(config.JWKSURL); jwks.isURL() {
+		document["jwks_uri"] = config.JWKSURL
+	}
+	if config.IntrospectionURL != "" {
+		document["introspection_endpoint"] = config.IntrospectionURL
+	}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, document)
+	}
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+	"gopkg.in/square/go-jose.v1"
+)
+
+type SMARTSuite struct {
+	key      *rsa.PrivateKey
+	jwksPath string
+}
+
+var _ = Suite(&SMARTSuite{})
+
+func (s *SMARTSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.jwksPath = writeTestJWKS(c, c.MkDir(), &s.key.PublicKey, "key1")
+}
+
+// writeTestJWKS writes a JWKS with a public key to a directory, returning its path
+func writeTestJWKS(c *C, dir string, key interface{}, kid string) string {
+	jwks, err := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{{Key: key, KeyID: kid, Algorithm: "RS256", Use: "sig"}}})
+	c.Assert(err, IsNil)
+	path := filepath.Join(dir, "jwks.json")
+	c.Assert(ioutil.WriteFile(path, jwks, os.ModePerm), IsNil)
+	return path
+}
+
+// signTestToken signs the claims of an access token
+func signTestToken(c *C, key interface{}, kid string, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.RS256, &jose.JsonWebKey{Key: key, KeyID: kid})
+	c.Assert(err, IsNil)
+	payload, err := json.Marshal(claims)
+	c.Assert(err, IsNil)
+	signed, err := signer.Sign(payload)
+	c.Assert(err, IsNil)
+	token, err := signed.CompactSerialize()
+	c.Assert(err, IsNil)
+	return token
+}
+
+func (s *SMARTSuite) claims(scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":       "https://auth.example.org",
+		"aud":       []string{"https://fhir.example.org"},
+		"sub":       "user1",
+		"client_id": "app1",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"scope":     scope,
+		"patient":   "p1",
+	}
+}
+
+func (s *SMARTSuite) TestParseSMARTScope(c *C) {
+	for scope, expected := range map[string]SMARTScope{
+		"patient/Observation.read": {"patient", "Observation", "rs"},
+		"user/*.write":             {"user", "*", "cud"},
+		"system/*.*":               {"system", "*", "cruds"},
+		"patient/Patient.rs":       {"patient", "Patient", "rs"},
+		"user/Observation.cu":      {"user", "Observation", "cu"},
+	} {
+		parsed, ok := ParseSMARTScope(scope)
+		c.Assert(ok, Equals, true, Commentf(scope))
+		c.Assert(parsed, Equals, expected, Commentf(scope))
+	}
+	for _, scope := range []string{"openid", "launch/patient", "patient/Observation.rs?category=laboratory", "user/Observation.sr", "admin/Patient.read", "user/.read"} {
+		_, ok := ParseSMARTScope(scope)
+		c.Assert(ok, Equals, false, Commentf(scope))
+	}
+
+	scope, _ := ParseSMARTScope("user/Observation.write")
+	c.Assert(scope.Allows("Observation", InteractionCreate), Equals, true)
+	c.Assert(scope.Allows("Observation", InteractionRead), Equals, false)
+	c.Assert(scope.Allows("Patient", InteractionCreate), Equals, false)
+}
+
+func (s *SMARTSuite) TestParseSMARTToken(c *C) {
+	keys := NewJWKS(s.jwksPath)
+	claims, err := ParseSMARTToken(signTestToken(c, s.key, "key1", s.claims("patient/*.read")), keys, "https://auth.example.org", "https://fhir.example.org")
+	c.Assert(err, IsNil)
+	c.Assert(claims.Subject, Equals, "user1")
+	c.Assert(claims.Patient, Equals, "p1")
+	c.Assert(claims.Scope, Equals, "patient/*.read")
+
+	expired := s.claims("patient/*.read")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = ParseSMARTToken(signTestToken(c, s.key, "key1", expired), keys, "", "")
+	c.Assert(err, ErrorMatches, ".*expired.*")
+
+	_, err = ParseSMARTToken(signTestToken(c, s.key, "key1", s.claims("")), keys, "https://other.example.org", "")
+	c.Assert(err, ErrorMatches, ".*issued by.*")
+	_, err = ParseSMARTToken(signTestToken(c, s.key, "key1", s.claims("")), keys, "", "https://other.example.org")
+	c.Assert(err, ErrorMatches, ".*isn't for.*")
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	_, err = ParseSMARTToken(signTestToken(c, other, "key1", s.claims("")), keys, "", "")
+	c.Assert(err, ErrorMatches, ".*signature.*")
+
+	// a token MACed with the public key mustn't be accepted
+	publicJWK, err := json.Marshal(jose.JsonWebKey{Key: &s.key.PublicKey})
+	c.Assert(err, IsNil)
+	signer, err := jose.NewSigner(jose.HS256, publicJWK)
+	c.Assert(err, IsNil)
+	payload, _ := json.Marshal(s.claims(""))
+	signed, err := signer.Sign(payload)
+	c.Assert(err, IsNil)
+	token, _ := signed.CompactSerialize()
+	_, err = ParseSMARTToken(token, keys, "", "")
+	c.Assert(err, NotNil)
+}
+
+func (s *SMARTSuite) request(method string, path string, token string) *httptest.ResponseRecorder {
+	e := gin.New()
+	authentication := SMARTAuthenticationHandler(NewJWKS(s.jwksPath), "https://auth.example.org", "https://fhir.example.org")
+	ok := func(c *gin.Context) {
+		patient, _ := c.Get(PatientCompartmentKey)
+		c.String(http.StatusOK, "ok %v", patient)
+	}
+	e.Any("/Observation", authentication, SMARTScopesHandler("Observation"), ok)
+	e.Any("/Observation/:id", authentication, SMARTScopesHandler("Observation"), ok)
+	e.POST("/", authentication, SMARTScopesHandler("*"), ok)
+
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	return w
+}
+
+func (s *SMARTSuite) TestSMARTScopesHandler(c *C) {
+	w := s.request("GET", "/Observation", "")
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+	c.Assert(w.Header().Get("WWW-Authenticate"), Matches, "Bearer.*")
+	w = s.request("GET", "/Observation", "not-a-jwt")
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	patientRead := signTestToken(c, s.key, "key1", s.claims("launch/patient patient/Observation.read"))
+	w = s.request("GET", "/Observation", patientRead)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "ok p1")
+	w = s.request("GET", "/Observation/123", patientRead)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("POST", "/Observation", patientRead)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("POST", "/", patientRead)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	noLaunchContext := s.claims("patient/Observation.read")
+	delete(noLaunchContext, "patient")
+	w = s.request("GET", "/Observation", signTestToken(c, s.key, "key1", noLaunchContext))
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	c.Assert(w.Body.String(), Matches, ".*launch context.*")
+
+	// user/ and system/ scopes aren't limited to the patient
+	userWrite := signTestToken(c, s.key, "key1", s.claims("patient/Observation.read user/Observation.write"))
+	w = s.request("POST", "/Observation", userWrite)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "ok <nil>")
+	w = s.request("DELETE", "/Observation/123", userWrite)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("GET", "/Observation/123", userWrite)
+	c.Assert(w.Body.String(), Equals, "ok p1")
+
+	system := signTestToken(c, s.key, "key1", s.claims("system/*.cruds"))
+	w = s.request("POST", "/", system)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("PUT", "/Observation/123", system)
+	c.Assert(w.Code, Equals, http.StatusOK)
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/jaeger"
@@ -29,7 +30,9 @@ func main() {
 	port := flag.Int("port", 3001, "Port to listen on")
 	reqLog := flag.Bool("reqlog", false, "Enables request logging -- use with caution in production")
 	mongodbURI := flag.String("mongodbURI", "mongodb://mongo:27017/?replicaSet=rs0", "MongoDB connection URI - a replica set is required for transactions support")
-	databaseName := flag.String("databaseName", "fhir", "MongoDB database name to use by default")
+	databaseBackend := flag.String("databaseBackend", "mongodb", "Database to store resources in: mongodb, postgresql or memory (not persisted - for testing only)")
+	postgresURI := flag.String("postgresURI", "postgres://localhost/fhir?sslmode=disable", "PostgreSQL connection URI (when using -databaseBackend postgresql)")
+	databaseName := flag.String("databaseName", "fhir", "MongoDB database (or PostgreSQL schema) name to use by default")
 	enableMultiDB := flag.Bool("enableMultiDB", false, "Allow request to specify a specific Mongo database instead of the default, e.g. http://fhir-server/db/test4_fhir/Patient?name=alex")
 	enableHistory := flag.Bool("enableHistory", true, "Keep previous versions of every resource")
 	tokenParametersCaseSensitive := flag.Bool("tokenParametersCaseSensitive", false, "Whether token-type search parameters should be case sensitive (faster and R4 leans towards case-sensitive, whereas STU3 text suggests case-insensitive)")
@@ -39,7 +42,27 @@ func main() {
 	disableSearchTotals := flag.Bool("disableSearchTotals", false, "Don't query for all results of a search to return Bundle.total, only do paging")
 	enableXML := flag.Bool("enableXML", false, "Enable support for the FHIR XML encoding")
 	validatorURL := flag.String("validatorURL", "", "A FHIR validation endpoint to proxy validation requests to")
+	validationDefinitions := flag.String("validationDefinitions", "", "Comma-separated JSON files or directories of StructureDefinitions, ValueSets and CodeSystems for the built-in validator (e.g. the specification's profiles-types.json, profiles-resources.json and valuesets.json)")
+	validateWrites := flag.Bool("validateWrites", false, "Reject created and updated resources that the built-in validator finds errors in")
 	failedRequestsDir := flag.String("failedRequestsDir", "", "Directory where to dump failed requests (e.g. with malformed json)")
+	bulkExportDir := flag.String("bulkExportDir", "", "Directory where to write the NDJSON files of Bulk Data $export operations (the operation is disabled if not set)")
+	bulkImportDir := flag.String("bulkImportDir", "", "Directory where to keep the state of Bulk Data $import operations (the operation is disabled if not set; the import subcommand defaults to the current directory)")
+	bulkImportConcurrency := flag.Int("bulkImportConcurrency", 4, "Number of resources to store concurrently during an import")
+	disableSubscriptions := flag.Bool("disableSubscriptions", false, "Don't send the notifications of Subscriptions")
+	subscriptionRetries := flag.Int("subscriptionRetries", 5, "Number of times to retry rest-hook notifications before setting the Subscription's status to error")
+	smartJWKS := flag.String("smartJWKS", "", "File or URL of the JWKS whose keys sign SMART on FHIR access tokens (enables SMART authorization)")
+	smartIssuer := flag.String("smartIssuer", "", "Required iss of SMART on FHIR access tokens")
+	smartAudience := flag.String("smartAudience", "", "Required aud of SMART on FHIR access tokens (e.g. the server's base URL)")
+	smartAuthorizeURL := flag.String("smartAuthorizeURL", "", "Authorization endpoint advertised in /.well-known/smart-configuration")
+	smartTokenURL := flag.String("smartTokenURL", "", "Token endpoint advertised in /.well-known/smart-configuration")
+	auditEvents := flag.Bool("auditEvents", false, "Record an AuditEvent for every RESTful interaction, including the entries of batches and transactions")
+	auditDatabase := flag.String("auditDatabase", "", "Database to write AuditEvents to instead of the database of each request (requires -enableMultiDB)")
+	auditQueueSize := flag.Int("auditQueueSize", 1000, "Number of AuditEvents that can be waiting to be written before new ones are dropped")
+	auditExcludeAuditEventReads := flag.Bool("auditExcludeAuditEventReads", false, "Don't record AuditEvents for reads and searches of AuditEvents")
+	autoProvenance := flag.Bool("autoProvenance", false, "Record a Provenance for every write that doesn't have an X-Provenance header")
+	encryptionPolicy := flag.String("encryptionPolicy", "", "JSON file of the elements of each type of resource to store encrypted, optionally per database (the key is read from -encryptionKeyfile or GOFHIR_ENCRYPTION_KEY_BASE64 and GOFHIR_ENCRYPTION_KEY_ID)")
+	encryptionKeyfile := flag.String("encryptionKeyfile", "", "JSON file of base64-encoded encryption keys by id and the id of the current key used for new writes")
+	rekeyBatchSize := flag.Int("rekeyBatchSize", 100, "Number of resource versions to re-encrypt at a time in the rekey subcommand")
 	requestsDumpDir := flag.String("requestsDumpDir", "", "Directory where to dump all requests and responses")
 	requestsDumpGET := flag.Bool("requestsDumpGET", true, "Whether to dump HTTP GET requests")
 	enableStackdriverTracing := flag.Bool("enableStackdriverTracing", false, "Enable OpenCensus tracing to StackDriver")
@@ -47,12 +70,22 @@ func main() {
 	startMongod := flag.Bool("startMongod", false, "Run mongod (for 'getting started' docker images - development only)")
 
 	onlyInitDB := false
-	if os.Args[1] == "initdb" {
+	onlyImport := false
+	onlyRekey := false
+	if len(os.Args) > 1 && os.Args[1] == "initdb" {
 		// collections are now created automatically using PrecreateCollectionsMiddleware
 		// but this also creates indices and allows for cases when PrecreateCollectionsMiddleware
 		// doesn't have permissions to create collections
 		onlyInitDB = true
 		flag.CommandLine.Parse(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "import" {
+		// fhir-server import [flags] Patient.ndjson Observation.ndjson dir-with-ndjson-files ...
+		onlyImport = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		// fhir-server rekey [flags] [database ...]
+		onlyRekey = true
+		flag.CommandLine.Parse(os.Args[2:])
 	} else {
 		flag.CommandLine.Parse(os.Args[1:])
 	}
@@ -68,7 +101,22 @@ func main() {
 	if gitCommit != "" {
 		fmt.Printf("GoFHIR version %s\n", gitCommit)
 	}
-	glog.Infof("MongoDB URI is %s\n", *mongodbURI)
+
+	var backend server.DatabaseBackend
+	var databaseURI string
+	switch *databaseBackend {
+	case "mongodb":
+		backend = server.DatabaseBackendMongoDB
+		databaseURI = *mongodbURI
+		glog.Infof("MongoDB URI is %s\n", *mongodbURI)
+	case "postgresql":
+		backend = server.DatabaseBackendPostgreSQL
+		databaseURI = *postgresURI
+	case "memory":
+		backend = server.DatabaseBackendMemory
+	default:
+		log.Fatalf("Unknown database backend: %s", *databaseBackend)
+	}
 
 	if *enableStackdriverTracing {
 		gcloudProject := os.Getenv("GCLOUD_PROJECT")
@@ -102,10 +150,20 @@ func main() {
 	tracingEnabled := *enableJaegerTracing || *enableStackdriverTracing
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
+	if *auditDatabase != "" && !*enableMultiDB {
+		log.Fatal("-auditDatabase requires -enableMultiDB")
+	}
+
+	var validationDefinitionPaths []string
+	if *validationDefinitions != "" {
+		validationDefinitionPaths = strings.Split(*validationDefinitions, ",")
+	}
+
 	var MyConfig = server.Config{
 		CreateIndexes:                !*dontCreateIndexes,
 		IndexConfigPath:              "config/indexes.conf",
-		DatabaseURI:                  *mongodbURI,
+		DatabaseBackend:              backend,
+		DatabaseURI:                  databaseURI,
 		DefaultDatabaseName:          *databaseName,
 		EnableMultiDB:                *enableMultiDB,
 		DatabaseSuffix:               *databaseSuffix,
@@ -122,7 +180,25 @@ func main() {
 		BatchConcurrency:             *batchConcurrency,
 		Debug:                        true,
 		ValidatorURL:                 *validatorURL,
+		ValidationDefinitions:        validationDefinitionPaths,
+		ValidateWrites:               *validateWrites,
 		FailedRequestsDir:            *failedRequestsDir,
+		BulkExportDirectory:          *bulkExportDir,
+		BulkImportDirectory:          *bulkImportDir,
+		BulkImportConcurrency:        *bulkImportConcurrency,
+		EnableSubscriptions:          *disableSubscriptions == false,
+		SubscriptionRetries:          *subscriptionRetries,
+		SubscriptionRetryBackoff:     server.DefaultConfig.SubscriptionRetryBackoff,
+		EnableAuditEvents:            *auditEvents,
+		AuditDatabaseName:            *auditDatabase,
+		AuditQueueSize:               *auditQueueSize,
+		AuditExcludeAuditEventReads:  *auditExcludeAuditEventReads,
+		AutoProvenance:               *autoProvenance,
+		EncryptionPolicyFile:         *encryptionPolicy,
+		EncryptionKeyfile:            *encryptionKeyfile,
+	}
+	if *smartJWKS != "" {
+		MyConfig.Auth = auth.SMART(*smartJWKS, *smartIssuer, *smartAudience, *smartAuthorizeURL, *smartTokenURL)
 	}
 	s := server.NewServer(MyConfig)
 	if *reqLog {
@@ -130,17 +206,43 @@ func main() {
 	}
 
 	if onlyInitDB {
-		fmt.Printf("Initialising MongoDB database %s\n", *databaseName)
+		fmt.Printf("Initialising %s database %s\n", *databaseBackend, *databaseName)
 		s.InitDB(*databaseName)
 		return
 	}
 
-	// Mutex middleware to work around the lack of proper transactions in MongoDB
-	// (unless using a MongoDB >= 4.0 replica set)
-	s.Engine.Use(middleware.ClientSpecifiedMutexesMiddleware())
+	if onlyImport {
+		inputs, err := server.ImportInputsFromPaths(flag.Args())
+		if err != nil {
+			log.Fatalf("Import: %v", err)
+		}
+		workDir := *bulkImportDir
+		if workDir == "" {
+			workDir = "."
+		}
+		fmt.Printf("Importing %d files into %s database %s\n", len(inputs), *databaseBackend, *databaseName)
+		if err = s.Import(inputs, workDir); err != nil {
+			log.Fatalf("Import failed: %+v", err)
+		}
+		return
+	}
+
+	if onlyRekey {
+		fmt.Printf("Re-encrypting %s resources with the current key\n", *databaseBackend)
+		if err := s.Rekey(flag.Args(), *rekeyBatchSize); err != nil {
+			log.Fatalf("Rekey failed: %+v", err)
+		}
+		return
+	}
 
-	// Pre-create collections as required by MongoDB transactions
-	s.Engine.Use(middleware.PrecreateCollectionsMiddleware(*mongodbURI))
+	if backend == server.DatabaseBackendMongoDB {
+		// Mutex middleware to work around the lack of proper transactions in MongoDB
+		// (unless using a MongoDB >= 4.0 replica set)
+		s.Engine.Use(middleware.ClientSpecifiedMutexesMiddleware())
+
+		// Pre-create collections as required by MongoDB transactions
+		s.Engine.Use(middleware.PrecreateCollectionsMiddleware(*mongodbURI))
+	}
 
 	s.InitEngine()
 
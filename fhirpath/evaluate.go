@@ -0,0 +1,1210 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Expression is a compiled FHIRPath expression
+type Expression struct {
+	text string
+	root node
+}
+
+// Options are the optional inputs of Evaluate
+type Options struct {
+	// Variables are the values of environment variables (%name) as JSON values (e.g. resources
+	// decoded into maps), *Value or Collection
+	Variables map[string]interface{}
+
+	// Resolve is used by resolve() for references that aren't to contained resources
+	// or other entries of the Bundle that the resource is in
+	Resolve func(reference string) (map[string]interface{}, error)
+
+	// Now is the result of now(), defaulting to the current time
+	Now time.Time
+
+	// Trace receives the values passed to trace()
+	Trace func(name string, values Collection)
+}
+
+// Compile parses an expression, returning a *SyntaxError if it's invalid
+func Compile(expression string) (*Expression, error) {
+	root, err := parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{text: expression, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression is invalid
+func MustCompile(expression string) *Expression {
+	e, err := Compile(expression)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *Expression) String() string {
+	return e.text
+}
+
+// SplitLastElement splits an expression that ends with the name of an element (e.g. Patient.name.given)
+// into the expression for its parent (Patient.name) and the name (given)
+func (e *Expression) SplitLastElement() (parent *Expression, name string, ok bool) {
+	member, isMember := e.root.(*memberNode)
+	if !isMember {
+		return nil, "", false
+	}
+	return &Expression{text: strings.TrimSpace(e.text[:member.dot]), root: member.focus}, member.name, true
+}
+
+// Evaluate evaluates the expression with a resource as its context. The resource should be decoded
+// from JSON, preferably with json.Decoder.UseNumber so that decimals are exact. Elements in the result
+// refer to the resource's objects and lists, so they can be changed with Value.Set and Value.Remove.
+func (e *Expression) Evaluate(resource map[string]interface{}, options *Options) (Collection, error) {
+	return e.EvaluateValue(NewResource(resource), options)
+}
+
+// EvaluateValue evaluates the expression with a value as its context (%context), e.g. an element of a resource
+func (e *Expression) EvaluateValue(context *Value, options *Options) (Collection, error) {
+	ev := &evaluator{context: Collection{context}, resource: context.resource}
+	if options != nil {
+		ev.options = *options
+	}
+	ev.now = ev.options.Now
+	if ev.now.IsZero() {
+		ev.now = time.Now()
+	}
+	ev.zone = ev.now.Location()
+
+	result, err := ev.eval(e.root, &env{focus: ev.context})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to evaluate %s", e.text)
+	}
+	return result, nil
+}
+
+type evaluator struct {
+	options  Options
+	context  Collection
+	resource *Value
+	now      time.Time
+	zone     *time.Location
+}
+
+// env is what an expression is evaluated with: the focus for the identifiers at its start (also $this)
+// and the other variables of iterating functions
+type env struct {
+	focus Collection
+	index Collection
+	total Collection
+}
+
+func (ev *evaluator) eval(n node, e *env) (Collection, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.value, nil
+
+	case *identifierNode:
+		return ev.identifier(e.focus, n.name)
+
+	case *memberNode:
+		focus, err := ev.eval(n.focus, e)
+		if err != nil {
+			return nil, err
+		}
+		return navigate(focus, n.name)
+
+	case *functionNode:
+		input := e.focus
+		if n.focus != nil {
+			var err error
+			if input, err = ev.eval(n.focus, e); err != nil {
+				return nil, err
+			}
+		}
+		return ev.call(n, input, e)
+
+	case *indexerNode:
+		focus, err := ev.eval(n.focus, e)
+		if err != nil {
+			return nil, err
+		}
+		index, empty, err := ev.integerOf(n.index, e, "an indexer")
+		if err != nil || empty {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(focus)) {
+			return nil, nil
+		}
+		return Collection{focus[index]}, nil
+
+	case *variableNode:
+		switch n.name {
+		case "$this":
+			return e.focus, nil
+		case "$index":
+			return e.index, nil
+		default:
+			return e.total, nil
+		}
+
+	case *constantNode:
+		return ev.constant(n.name)
+
+	case *unaryNode:
+		operand, err := ev.eval(n.operand, e)
+		if err != nil {
+			return nil, err
+		}
+		return negate(n.operator, operand)
+
+	case *binaryNode:
+		left, err := ev.eval(n.left, e)
+		if err != nil {
+			return nil, err
+		}
+		right, err := ev.eval(n.right, e)
+		if err != nil {
+			return nil, err
+		}
+		return ev.binary(n.operator, left, right)
+
+	case *typeNode:
+		operand, err := ev.eval(n.operand, e)
+		if err != nil {
+			return nil, err
+		}
+		if n.operator == "as" {
+			return ofType(operand, n.typeName), nil
+		}
+		return isType(operand, n.typeName)
+	}
+	return nil, errors.Errorf("unexpected node %T", n)
+}
+
+// identifier evaluates an identifier at the start of an expression, which is either a type
+// (e.g. Patient.name or Resource.id) or the name of a child of the focus
+func (ev *evaluator) identifier(focus Collection, name string) (Collection, error) {
+	if name[0] >= 'A' && name[0] <= 'Z' {
+		var matches Collection
+		for _, v := range focus {
+			if v.element && typeIs(v, typeSpecifier{namespace: "FHIR", name: name}) {
+				matches = append(matches, v)
+			}
+		}
+		if len(matches) > 0 || isFHIRType(name) {
+			return matches, nil
+		}
+	}
+	return navigate(focus, name)
+}
+
+func (ev *evaluator) constant(name string) (Collection, error) {
+	if value, found := ev.options.Variables[name]; found {
+		return collectionOf(value), nil
+	}
+	switch name {
+	case "context":
+		return ev.context, nil
+	case "resource":
+		if ev.resource == nil {
+			return nil, nil
+		}
+		return Collection{ev.resource}, nil
+	case "rootResource":
+		root := ev.resource
+		for root != nil && root.contains != nil && root.name == "contained" {
+			root = root.contains
+		}
+		if root == nil {
+			return nil, nil
+		}
+		return Collection{root}, nil
+	case "ucum":
+		return Collection{systemValue(ucumSystem)}, nil
+	case "sct":
+		return Collection{systemValue("http://snomed.info/sct")}, nil
+	case "loinc":
+		return Collection{systemValue("http://loinc.org")}, nil
+	}
+	if strings.HasPrefix(name, "vs-") {
+		return Collection{systemValue("http://hl7.org/fhir/ValueSet/" + name[len("vs-"):])}, nil
+	}
+	if strings.HasPrefix(name, "ext-") {
+		return Collection{systemValue("http://hl7.org/fhir/StructureDefinition/" + name[len("ext-"):])}, nil
+	}
+	return nil, errors.Errorf("unknown variable %%%s", name)
+}
+
+// collectionOf converts the value of a variable to a collection
+func collectionOf(value interface{}) Collection {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case Collection:
+		return value
+	case *Value:
+		return Collection{value}
+	case []interface{}:
+		var c Collection
+		for _, item := range value {
+			c = append(c, collectionOf(item)...)
+		}
+		return c
+	case map[string]interface{}:
+		if _, isResource := value["resourceType"].(string); isResource {
+			return Collection{NewResource(value)}
+		}
+		return Collection{{data: value, element: true, index: -1}}
+	case int:
+		return Collection{systemValue(int64(value))}
+	case float64:
+		d, _ := decimalFromFloat(value)
+		return Collection{systemValue(d)}
+	case time.Time:
+		return Collection{systemValue(dateTimeFromTime(value, kindDateTime, precisionMillisecond))}
+	default:
+		// bool, int64, string and json.Number
+		return Collection{(&Value{data: value, element: true, index: -1}).systemOrSelf()}
+	}
+}
+
+// navigate returns the children with a name of the values in a collection. It's an error if none of
+// the values' types have the element, which catches misspelt names, but collections of different
+// types (e.g. from descendants()) only need one of them to have it.
+func navigate(focus Collection, name string) (Collection, error) {
+	var result Collection
+	var firstErr error
+	defined := false
+	for _, v := range focus {
+		children, err := v.children(name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		defined = true
+		result = append(result, children...)
+	}
+	if !defined && firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// children returns the values of the child elements with a name, including all the types of a choice element
+func (v *Value) children(name string) (Collection, error) {
+	if !v.element {
+		return nil, nil
+	}
+	object, isObject := v.data.(map[string]interface{})
+	model := v.model
+	if !isObject {
+		if v.primitiveElement == nil {
+			if isPrimitiveType(v.fhirType) && name != "id" && name != "extension" {
+				return nil, errors.Errorf("%s has no element %s", v.fhirType, name)
+			}
+			return nil, nil
+		}
+		object, model = v.primitiveElement, "Element"
+	}
+
+	if _, known := childDefinitions(model); !known {
+		// without a definition any property can be used
+		if _, exists := object[name]; exists || object["_"+name] != nil {
+			return v.childValues(object, name, "", ""), nil
+		}
+		return nil, nil
+	}
+
+	if definition, found := childDefinition(model, name); found {
+		return v.childValues(object, name, definition.Type, definition.Path), nil
+	}
+	choices := choiceDefinitions(model, name)
+	if len(choices) == 0 {
+		return nil, errors.Errorf("%s has no element %s", model, name)
+	}
+	var result Collection
+	for _, choice := range choices {
+		result = append(result, v.childValues(object, choice.Name, choice.Type, choice.Path)...)
+	}
+	return result, nil
+}
+
+// allChildren returns the values of all the child elements, in the order of their definitions if known
+func (v *Value) allChildren() Collection {
+	if !v.element {
+		return nil
+	}
+	object, isObject := v.data.(map[string]interface{})
+	model := v.model
+	if !isObject {
+		if v.primitiveElement == nil {
+			return nil
+		}
+		object, model = v.primitiveElement, "Element"
+	}
+
+	var result Collection
+	if _, known := childDefinitions(model); known {
+		children, _ := childDefinitions(model)
+		for _, name := range orderedChildDefinitions(model) {
+			if _, exists := object[name]; exists || object["_"+name] != nil {
+				result = append(result, v.childValues(object, name, children[name].Type, children[name].Path)...)
+			}
+		}
+		return result
+	}
+
+	var names []string
+	for name := range object {
+		if !strings.HasPrefix(name, "_") {
+			names = append(names, name)
+		} else if _, exists := object[name[1:]]; !exists {
+			names = append(names, name[1:])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, v.childValues(object, name, "", "")...)
+	}
+	return result
+}
+
+func (v *Value) childValues(object map[string]interface{}, name string, fhirType string, backbonePath string) Collection {
+	data, exists := object[name]
+	primitiveData := object["_"+name]
+	if !exists && primitiveData == nil {
+		return nil
+	}
+
+	list, isList := data.([]interface{})
+	primitiveList, isPrimitiveList := primitiveData.([]interface{})
+	if !isList && !isPrimitiveList {
+		if name == "resourceType" {
+			return nil
+		}
+		primitiveElement, _ := primitiveData.(map[string]interface{})
+		child := v.newChild(data, primitiveElement, fhirType, backbonePath, object, name, -1)
+		if child == nil {
+			return nil
+		}
+		return Collection{child}
+	}
+
+	length := len(list)
+	if len(primitiveList) > length {
+		length = len(primitiveList)
+	}
+	var result Collection
+	for i := 0; i < length; i++ {
+		var item interface{}
+		var primitiveElement map[string]interface{}
+		if i < len(list) {
+			item = list[i]
+		}
+		if i < len(primitiveList) {
+			primitiveElement, _ = primitiveList[i].(map[string]interface{})
+		}
+		if child := v.newChild(item, primitiveElement, fhirType, backbonePath, object, name, i); child != nil {
+			result = append(result, child)
+		}
+	}
+	return result
+}
+
+func (v *Value) newChild(data interface{}, primitiveElement map[string]interface{}, fhirType string, backbonePath string, parent map[string]interface{}, name string, index int) *Value {
+	if data == nil && primitiveElement == nil {
+		return nil
+	}
+	location := v.location + "." + name
+	if index >= 0 {
+		location += "[" + strconv.Itoa(index) + "]"
+	}
+	child := &Value{
+		data:             data,
+		element:          true,
+		fhirType:         fhirType,
+		model:            fhirType,
+		primitiveElement: primitiveElement,
+		parent:           parent,
+		name:             name,
+		index:            index,
+		location:         location,
+		resource:         v.resource,
+	}
+	switch {
+	case backbonePath != "":
+		child.fhirType, child.model = "BackboneElement", backbonePath
+	case fhirType == "Resource":
+		object, _ := data.(map[string]interface{})
+		resourceType, _ := object["resourceType"].(string)
+		child.fhirType, child.model = resourceType, resourceType
+		child.resource = child
+		child.contains = v.resource
+	}
+	return child
+}
+
+// system returns a value of one of the system types, converting primitive elements
+func (v *Value) system() (interface{}, bool) {
+	if !v.element {
+		return v.data, true
+	}
+	if v.fhirType != "" && !isPrimitiveType(v.fhirType) {
+		return nil, false
+	}
+	switch data := v.data.(type) {
+	case bool:
+		return data, true
+	case string:
+		switch v.fhirType {
+		case "date":
+			if d, err := parseFHIRDateTime(data, kindDate); err == nil {
+				return d, true
+			}
+		case "dateTime", "instant":
+			if d, err := parseFHIRDateTime(data, kindDateTime); err == nil {
+				return d, true
+			}
+		case "time":
+			if t, err := parseTime(data); err == nil {
+				return t, true
+			}
+		}
+		return data, true
+	case json.Number:
+		return numberOf(string(data), v.fhirType)
+	case float64:
+		return numberOf(strconv.FormatFloat(data, 'f', -1, 64), v.fhirType)
+	}
+	return nil, false
+}
+
+func numberOf(text string, fhirType string) (interface{}, bool) {
+	if fhirType != "decimal" {
+		if i, isInteger := parseInteger(text); isInteger {
+			return i, true
+		}
+	}
+	if d, isDecimal := parseDecimal(text); isDecimal {
+		return d, true
+	}
+	return nil, false
+}
+
+// systemOrSelf converts primitive elements to system values
+func (v *Value) systemOrSelf() *Value {
+	if system, isSystem := v.system(); isSystem && v.element {
+		return systemValue(system)
+	}
+	return v
+}
+
+// quantityOf returns a system quantity or converts a Quantity element
+func (v *Value) quantityOf() (quantity, bool) {
+	if !v.element {
+		q, isQuantity := v.data.(quantity)
+		return q, isQuantity
+	}
+	object, isObject := v.data.(map[string]interface{})
+	if !isObject || !typeIs(v, typeSpecifier{namespace: "FHIR", name: "Quantity"}) && v.fhirType != "" {
+		return quantity{}, false
+	}
+	value, isNumber := (&Value{data: object["value"], element: true, fhirType: "decimal"}).system()
+	if !isNumber {
+		return quantity{}, false
+	}
+	unit, _ := object["code"].(string)
+	if unit == "" {
+		unit, _ = object["unit"].(string)
+		if calendarUnit := calendarDurations[unit]; calendarUnit != "" {
+			unit = calendarUnit
+		}
+	}
+	if unit == "" {
+		unit = "1"
+	}
+	return quantity{value: value.(decimal), unit: unit}, true
+}
+
+// comparable returns the system value that an item is compared as, or nil for other elements
+func (v *Value) comparable() interface{} {
+	if system, isSystem := v.system(); isSystem {
+		return system
+	}
+	if q, isQuantity := v.quantityOf(); isQuantity {
+		return q
+	}
+	return nil
+}
+
+// the result of comparing values that may not be comparable
+type comparison int
+
+const (
+	unknown comparison = iota
+	isFalse
+	isTrue
+)
+
+func comparisonOf(b bool) comparison {
+	if b {
+		return isTrue
+	}
+	return isFalse
+}
+
+// equal implements = for single values, returning unknown (an empty result) when dates/times
+// have different precisions or quantities have incomparable units
+func (ev *evaluator) equal(a *Value, b *Value) comparison {
+	av, bv := a.comparable(), b.comparable()
+	if av == nil || bv == nil {
+		if av != nil || bv != nil {
+			return isFalse
+		}
+		return comparisonOf(jsonEqual(a.data, b.data) && jsonEqual(a.primitiveElementOrNil(), b.primitiveElementOrNil()))
+	}
+
+	if ad, isNumber := numberValue(av); isNumber {
+		bd, isOtherNumber := numberValue(bv)
+		return comparisonOf(isOtherNumber && ad.Cmp(bd) == 0)
+	}
+	switch x := av.(type) {
+	case bool, string:
+		return comparisonOf(av == bv)
+	case dateTime:
+		y, isDateTime := bv.(dateTime)
+		if !isDateTime || (x.kind == kindTime) != (y.kind == kindTime) {
+			return isFalse
+		}
+		result, known := compareDateTimes(x, y, ev.zone)
+		if !known {
+			return unknown
+		}
+		return comparisonOf(result == 0)
+	case quantity:
+		y, isQuantity := bv.(quantity)
+		if !isQuantity {
+			return isFalse
+		}
+		result, known := compareQuantities(x, y)
+		if !known {
+			return unknown
+		}
+		return comparisonOf(result == 0)
+	}
+	return isFalse
+}
+
+func (v *Value) primitiveElementOrNil() interface{} {
+	if v.primitiveElement == nil {
+		return nil
+	}
+	return v.primitiveElement
+}
+
+// equivalent implements ~ for single values
+func (ev *evaluator) equivalent(a *Value, b *Value) bool {
+	av, bv := a.comparable(), b.comparable()
+	if av == nil || bv == nil {
+		return av == nil && bv == nil && jsonEqual(a.data, b.data)
+	}
+
+	if _, isNumber := numberValue(av); isNumber {
+		if _, isOtherNumber := numberValue(bv); !isOtherNumber {
+			return false
+		}
+		x, y := decimalOf(av), decimalOf(bv)
+		scale := x.scale
+		if y.scale < scale {
+			scale = y.scale
+		}
+		return x.round(scale).value.Cmp(y.round(scale).value) == 0
+	}
+	switch x := av.(type) {
+	case bool:
+		return av == bv
+	case string:
+		y, isString := bv.(string)
+		return isString && normalizeString(x) == normalizeString(y)
+	case dateTime:
+		y, isDateTime := bv.(dateTime)
+		if !isDateTime || (x.kind == kindTime) != (y.kind == kindTime) {
+			return false
+		}
+		result, known := compareDateTimes(x, y, ev.zone)
+		return known && result == 0
+	case quantity:
+		y, isQuantity := bv.(quantity)
+		if !isQuantity {
+			return false
+		}
+		x, y = x.inBaseUnit(), y.inBaseUnit()
+		if x.unit != y.unit {
+			return false
+		}
+		scale := x.value.scale
+		if y.value.scale < scale {
+			scale = y.value.scale
+		}
+		return x.value.round(scale).value.Cmp(y.value.round(scale).value) == 0
+	}
+	return false
+}
+
+func normalizeString(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+func numberValue(x interface{}) (*big.Rat, bool) {
+	switch x := x.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(x), true
+	case decimal:
+		return x.value, true
+	}
+	return nil, false
+}
+
+func decimalOf(x interface{}) decimal {
+	switch x := x.(type) {
+	case int64:
+		return decimalFromInt(x)
+	case decimal:
+		return x
+	}
+	return decimal{value: new(big.Rat)}
+}
+
+// jsonEqual compares JSON values, with numbers compared by their values
+func jsonEqual(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, isObject := b.(map[string]interface{})
+		if !isObject || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			if other, exists := y[key]; !exists || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, isList := b.([]interface{})
+		if !isList || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number, float64:
+		xv, xIsNumber := numberOf(jsonNumberText(a), "")
+		yv, yIsNumber := numberOf(jsonNumberText(b), "")
+		if !xIsNumber || !yIsNumber {
+			return false
+		}
+		xr, _ := numberValue(xv)
+		yr, _ := numberValue(yv)
+		return xr.Cmp(yr) == 0
+	default:
+		return a == b
+	}
+}
+
+func jsonNumberText(x interface{}) string {
+	switch x := x.(type) {
+	case json.Number:
+		return string(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return ""
+}
+
+func (ev *evaluator) collectionsEqual(left Collection, right Collection) Collection {
+	if len(left) == 0 || len(right) == 0 {
+		return nil
+	}
+	if len(left) != len(right) {
+		return Collection{systemValue(false)}
+	}
+	result := isTrue
+	for i := range left {
+		switch ev.equal(left[i], right[i]) {
+		case isFalse:
+			return Collection{systemValue(false)}
+		case unknown:
+			result = unknown
+		}
+	}
+	if result == unknown {
+		return nil
+	}
+	return Collection{systemValue(true)}
+}
+
+// collectionsEquivalent compares collections regardless of their order
+func (ev *evaluator) collectionsEquivalent(left Collection, right Collection) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	matched := make([]bool, len(right))
+	for _, a := range left {
+		found := false
+		for j, b := range right {
+			if !matched[j] && ev.equivalent(a, b) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// contains returns true if a collection has an item equal to a value
+func (ev *evaluator) contains(c Collection, v *Value) bool {
+	for _, item := range c {
+		if ev.equal(item, v) == isTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func (ev *evaluator) distinct(c Collection) Collection {
+	var result Collection
+	for _, v := range c {
+		if !ev.contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// toBoolean evaluates a collection as a boolean: a single value that isn't a boolean is true
+func toBoolean(c Collection) (value bool, empty bool, err error) {
+	switch len(c) {
+	case 0:
+		return false, true, nil
+	case 1:
+		if system, isSystem := c[0].system(); isSystem {
+			if b, isBool := system.(bool); isBool {
+				return b, false, nil
+			}
+		}
+		return true, false, nil
+	default:
+		return false, false, errors.Errorf("expected a single boolean but found %d values", len(c))
+	}
+}
+
+func booleanResult(b bool) Collection {
+	return Collection{systemValue(b)}
+}
+
+func singleton(c Collection, what string) (*Value, error) {
+	if len(c) > 1 {
+		return nil, errors.Errorf("%s should be a single value but found %d", what, len(c))
+	}
+	if len(c) == 0 {
+		return nil, nil
+	}
+	return c[0], nil
+}
+
+func (ev *evaluator) integerOf(n node, e *env, what string) (value int64, empty bool, err error) {
+	c, err := ev.eval(n, e)
+	if err != nil {
+		return 0, false, err
+	}
+	v, err := singleton(c, what)
+	if err != nil || v == nil {
+		return 0, true, err
+	}
+	if system, isSystem := v.system(); isSystem {
+		if i, isInteger := system.(int64); isInteger {
+			return i, false, nil
+		}
+	}
+	return 0, false, errors.Errorf("%s should be an integer", what)
+}
+
+func (ev *evaluator) binary(operator string, left Collection, right Collection) (Collection, error) {
+	switch operator {
+	case "and", "or", "xor", "implies":
+		return logic(operator, left, right)
+
+	case "=", "!=":
+		result := ev.collectionsEqual(left, right)
+		if operator == "!=" && len(result) == 1 {
+			result = booleanResult(!result[0].data.(bool))
+		}
+		return result, nil
+
+	case "~":
+		return booleanResult(ev.collectionsEquivalent(left, right)), nil
+	case "!~":
+		return booleanResult(!ev.collectionsEquivalent(left, right)), nil
+
+	case "<", ">", "<=", ">=":
+		return ev.compare(operator, left, right)
+
+	case "|":
+		return ev.distinct(append(append(Collection{}, left...), right...)), nil
+
+	case "in", "contains":
+		if operator == "contains" {
+			left, right = right, left
+		}
+		v, err := singleton(left, "the left operand of "+operator)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return booleanResult(ev.contains(right, v)), nil
+
+	case "&":
+		var s strings.Builder
+		for _, c := range []Collection{left, right} {
+			v, err := singleton(c, "an operand of &")
+			if err != nil {
+				return nil, err
+			}
+			if v != nil {
+				str, isString := v.comparable().(string)
+				if !isString {
+					return nil, errors.Errorf("the operands of & should be strings")
+				}
+				s.WriteString(str)
+			}
+		}
+		return Collection{systemValue(s.String())}, nil
+
+	default:
+		return ev.arithmetic(operator, left, right)
+	}
+}
+
+// logic implements the boolean operators with three-valued logic
+func logic(operator string, left Collection, right Collection) (Collection, error) {
+	a, aEmpty, err := toBoolean(left)
+	if err != nil {
+		return nil, err
+	}
+	b, bEmpty, err := toBoolean(right)
+	if err != nil {
+		return nil, err
+	}
+	switch operator {
+	case "and":
+		if !aEmpty && !a || !bEmpty && !b {
+			return booleanResult(false), nil
+		}
+		if aEmpty || bEmpty {
+			return nil, nil
+		}
+		return booleanResult(true), nil
+	case "or":
+		if !aEmpty && a || !bEmpty && b {
+			return booleanResult(true), nil
+		}
+		if aEmpty || bEmpty {
+			return nil, nil
+		}
+		return booleanResult(false), nil
+	case "xor":
+		if aEmpty || bEmpty {
+			return nil, nil
+		}
+		return booleanResult(a != b), nil
+	default:
+		if !aEmpty && !a || !bEmpty && b {
+			return booleanResult(true), nil
+		}
+		if aEmpty || bEmpty {
+			return nil, nil
+		}
+		return booleanResult(false), nil
+	}
+}
+
+func (ev *evaluator) compare(operator string, left Collection, right Collection) (Collection, error) {
+	a, err := singleton(left, "the left operand of "+operator)
+	if err != nil {
+		return nil, err
+	}
+	b, err := singleton(right, "the right operand of "+operator)
+	if err != nil || a == nil || b == nil {
+		return nil, err
+	}
+
+	av, bv := a.comparable(), b.comparable()
+	var result int
+	known := true
+	if x, isNumber := numberValue(av); isNumber {
+		y, isOtherNumber := numberValue(bv)
+		if !isOtherNumber {
+			return nil, errors.Errorf("can't compare %s with %s", a.Type(), b.Type())
+		}
+		result = x.Cmp(y)
+	} else {
+		switch x := av.(type) {
+		case string:
+			y, isString := bv.(string)
+			if !isString {
+				return nil, errors.Errorf("can't compare %s with %s", a.Type(), b.Type())
+			}
+			result = strings.Compare(x, y)
+		case dateTime:
+			y, isDateTime := bv.(dateTime)
+			if !isDateTime || (x.kind == kindTime) != (y.kind == kindTime) {
+				return nil, errors.Errorf("can't compare %s with %s", a.Type(), b.Type())
+			}
+			result, known = compareDateTimes(x, y, ev.zone)
+		case quantity:
+			y, isQuantity := bv.(quantity)
+			if !isQuantity {
+				return nil, errors.Errorf("can't compare %s with %s", a.Type(), b.Type())
+			}
+			result, known = compareQuantities(x, y)
+		default:
+			return nil, errors.Errorf("can't compare %s with %s", a.Type(), b.Type())
+		}
+	}
+	if !known {
+		return nil, nil
+	}
+
+	switch operator {
+	case "<":
+		return booleanResult(result < 0), nil
+	case ">":
+		return booleanResult(result > 0), nil
+	case "<=":
+		return booleanResult(result <= 0), nil
+	default:
+		return booleanResult(result >= 0), nil
+	}
+}
+
+func negate(operator string, operand Collection) (Collection, error) {
+	v, err := singleton(operand, "the operand of unary "+operator)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	value := v.comparable()
+	switch x := value.(type) {
+	case int64:
+		if operator == "-" {
+			x = -x
+		}
+		return Collection{systemValue(x)}, nil
+	case decimal:
+		if operator == "-" {
+			x = decimal{value: new(big.Rat).Neg(x.value), scale: x.scale}
+		}
+		return Collection{systemValue(x)}, nil
+	case quantity:
+		if operator == "-" {
+			x.value = decimal{value: new(big.Rat).Neg(x.value.value), scale: x.value.scale}
+		}
+		return Collection{systemValue(x)}, nil
+	}
+	return nil, errors.Errorf("unary %s can't be used with %s", operator, v.Type())
+}
+
+func (ev *evaluator) arithmetic(operator string, left Collection, right Collection) (Collection, error) {
+	a, err := singleton(left, "the left operand of "+operator)
+	if err != nil {
+		return nil, err
+	}
+	b, err := singleton(right, "the right operand of "+operator)
+	if err != nil || a == nil || b == nil {
+		return nil, err
+	}
+	av, bv := a.comparable(), b.comparable()
+	fail := func() (Collection, error) {
+		return nil, errors.Errorf("%s can't be used with %s and %s", operator, a.Type(), b.Type())
+	}
+	result := func(value interface{}) (Collection, error) {
+		return Collection{systemValue(value)}, nil
+	}
+
+	// integers
+	if x, isInteger := av.(int64); isInteger {
+		if y, isInteger := bv.(int64); isInteger {
+			switch operator {
+			case "+":
+				return result(x + y)
+			case "-":
+				return result(x - y)
+			case "*":
+				return result(x * y)
+			case "div", "mod":
+				if y == 0 {
+					return nil, nil
+				}
+				if operator == "div" {
+					return result(x / y)
+				}
+				return result(x % y)
+			}
+		}
+	}
+
+	// decimals
+	if x, isNumber := numberValue(av); isNumber {
+		y, isOtherNumber := numberValue(bv)
+		if !isOtherNumber {
+			if q, isQuantity := bv.(quantity); isQuantity && operator == "*" {
+				return result(multiplyQuantities(quantity{value: decimalOf(av), unit: "1"}, q, operator))
+			}
+			return fail()
+		}
+		xd, yd := decimalOf(av), decimalOf(bv)
+		scale := xd.scale
+		if yd.scale > scale {
+			scale = yd.scale
+		}
+		switch operator {
+		case "+":
+			return result(decimal{value: new(big.Rat).Add(x, y), scale: scale})
+		case "-":
+			return result(decimal{value: new(big.Rat).Sub(x, y), scale: scale})
+		case "*":
+			return result(decimal{value: new(big.Rat).Mul(x, y), scale: xd.scale + yd.scale})
+		case "/", "div", "mod":
+			if y.Sign() == 0 {
+				return nil, nil
+			}
+			quotient := new(big.Rat).Quo(x, y)
+			switch operator {
+			case "/":
+				return result(decimal{value: quotient, scale: 8}.trimmed(8))
+			case "div":
+				return result(new(big.Int).Quo(quotient.Num(), quotient.Denom()).Int64())
+			default:
+				truncated := new(big.Rat).SetInt(new(big.Int).Quo(quotient.Num(), quotient.Denom()))
+				return result(decimal{value: new(big.Rat).Sub(x, new(big.Rat).Mul(y, truncated)), scale: scale})
+			}
+		}
+		return fail()
+	}
+
+	switch x := av.(type) {
+	case string:
+		if y, isString := bv.(string); isString && operator == "+" {
+			return result(x + y)
+		}
+	case dateTime:
+		y, isQuantity := bv.(quantity)
+		if !isQuantity || operator != "+" && operator != "-" {
+			return fail()
+		}
+		d, err := addQuantity(x, y, operator == "-")
+		if err != nil {
+			return nil, err
+		}
+		return result(d)
+	case quantity:
+		if _, isNumber := numberValue(bv); isNumber && (operator == "*" || operator == "/") {
+			return result(multiplyQuantities(x, quantity{value: decimalOf(bv), unit: "1"}, operator))
+		}
+		y, isQuantity := bv.(quantity)
+		if !isQuantity {
+			return fail()
+		}
+		switch operator {
+		case "+", "-":
+			if x.unit != y.unit {
+				x, y = x.inBaseUnit(), y.inBaseUnit()
+				if x.unit != y.unit {
+					return nil, nil
+				}
+			}
+			sum := new(big.Rat)
+			if operator == "+" {
+				sum.Add(x.value.value, y.value.value)
+			} else {
+				sum.Sub(x.value.value, y.value.value)
+			}
+			scale := x.value.scale
+			if y.value.scale > scale {
+				scale = y.value.scale
+			}
+			return result(quantity{value: decimal{value: sum, scale: scale}, unit: x.unit})
+		case "*", "/":
+			if operator == "/" && y.value.value.Sign() == 0 {
+				return nil, nil
+			}
+			return result(multiplyQuantities(x, y, operator))
+		}
+	}
+	return fail()
+}
+
+func multiplyQuantities(x quantity, y quantity, operator string) quantity {
+	if x.unit != y.unit && x.unit != "1" && y.unit != "1" {
+		if xb, yb := x.inBaseUnit(), y.inBaseUnit(); xb.unit == yb.unit {
+			x, y = xb, yb
+		}
+	}
+	if operator == "*" {
+		value := decimal{value: new(big.Rat).Mul(x.value.value, y.value.value), scale: x.value.scale + y.value.scale}
+		switch {
+		case x.unit == "1":
+			return quantity{value: value, unit: y.unit}
+		case y.unit == "1":
+			return quantity{value: value, unit: x.unit}
+		}
+		return quantity{value: value, unit: x.unit + "." + y.unit}
+	}
+	value := decimal{value: new(big.Rat).Quo(x.value.value, y.value.value), scale: 8}.trimmed(8)
+	switch {
+	case x.unit == y.unit:
+		return quantity{value: value, unit: "1"}
+	case y.unit == "1":
+		return quantity{value: value, unit: x.unit}
+	}
+	return quantity{value: value, unit: x.unit + "/" + y.unit}
+}
+
+// the UCUM units of time that can be added to dates and times
+var ucumDurations = map[string]string{
+	"a": "year", "mo": "month", "wk": "week", "d": "day", "h": "hour", "min": "minute", "s": "second", "ms": "millisecond",
+}
+
+func addQuantity(d dateTime, q quantity, subtract bool) (dateTime, error) {
+	unit := q.unit
+	if calendarUnit := ucumDurations[unit]; calendarUnit != "" {
+		unit = calendarUnit
+	}
+	value := q.value.value
+	if subtract {
+		value = new(big.Rat).Neg(value)
+	}
+	if unit == "second" && !value.IsInt() {
+		// keep the milliseconds
+		unit = "millisecond"
+		value = new(big.Rat).Mul(value, big.NewRat(1000, 1))
+	}
+	amount := new(big.Int).Quo(value.Num(), value.Denom()).Int64()
+	return d.addDuration(amount, unit)
+}
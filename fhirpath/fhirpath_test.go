@@ -0,0 +1,250 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the format of the FHIRPath test cases published with the specification
+type testSuite struct {
+	Groups []struct {
+		Name  string `xml:"name,attr"`
+		Tests []struct {
+			Name       string `xml:"name,attr"`
+			InputFile  string `xml:"inputfile,attr"`
+			Predicate  bool   `xml:"predicate,attr"`
+			Expression struct {
+				Text    string `xml:",chardata"`
+				Invalid string `xml:"invalid,attr"`
+			} `xml:"expression"`
+			Outputs []struct {
+				Type  string `xml:"type,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"output"`
+		} `xml:"test"`
+	} `xml:"group"`
+}
+
+func loadResource(t *testing.T, fileName string) map[string]interface{} {
+	data, err := ioutil.ReadFile("testdata/" + strings.TrimSuffix(strings.TrimSuffix(fileName, ".xml"), ".json") + ".json")
+	require.NoError(t, err)
+	resource, err := DecodeResource(data)
+	require.NoError(t, err)
+	return resource
+}
+
+func TestSpecificationCases(t *testing.T) {
+	file, err := os.Open("testdata/tests-fhir-r4.xml")
+	require.NoError(t, err)
+	defer file.Close()
+	var suite testSuite
+	require.NoError(t, xml.NewDecoder(file).Decode(&suite))
+
+	for _, group := range suite.Groups {
+		for _, test := range group.Tests {
+			test := test
+			t.Run(group.Name+"/"+test.Name, func(t *testing.T) {
+				expression, err := Compile(test.Expression.Text)
+				if test.Expression.Invalid == "syntax" {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+
+				result, err := expression.Evaluate(loadResource(t, test.InputFile), nil)
+				if test.Expression.Invalid != "" {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+
+				if test.Predicate {
+					empty := len(result) == 0
+					result = Collection{systemValue(!empty)}
+				}
+				require.Len(t, result, len(test.Outputs), "result: %v", result)
+				for i, expected := range test.Outputs {
+					assertOutput(t, expected.Type, expected.Value, result[i])
+				}
+			})
+		}
+	}
+}
+
+func assertOutput(t *testing.T, expectedType string, expected string, actual *Value) {
+	switch expectedType {
+	case "integer", "decimal":
+		expectedNumber, _ := new(big.Rat).SetString(expected)
+		actualNumber, isNumber := numberValue(actual.systemOrSelf().data)
+		if assert.True(t, isNumber, "%v isn't a number", actual) {
+			assert.Equal(t, expectedNumber.String(), actualNumber.String())
+		}
+	case "date", "dateTime":
+		assert.Equal(t, strings.TrimPrefix(expected, "@"), actual.String())
+	case "time":
+		assert.Equal(t, strings.TrimPrefix(expected, "@T"), actual.String())
+	default:
+		assert.Equal(t, expected, actual.String())
+	}
+}
+
+func evaluate(t *testing.T, expression string, resource map[string]interface{}, options *Options) Collection {
+	result, err := MustCompile(expression).Evaluate(resource, options)
+	require.NoError(t, err)
+	return result
+}
+
+func stringsOf(c Collection) []string {
+	var values []string
+	for _, v := range c {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	_, err := Compile("Patient.name.where(given = 'Jim'")
+	require.Error(t, err)
+	syntaxError, isSyntaxError := err.(*SyntaxError)
+	require.True(t, isSyntaxError, "%T", err)
+	assert.Equal(t, len("Patient.name.where(given = 'Jim'"), syntaxError.Position)
+}
+
+func TestLocationsAndTypes(t *testing.T) {
+	patient := loadResource(t, "patient-example.json")
+	result := evaluate(t, "Patient.name.where(use = 'usual').given | Patient.contact.name.family", patient, nil)
+	require.Len(t, result, 2)
+	assert.Equal(t, "Patient.name[1].given[0]", result[0].Location())
+	assert.Equal(t, "FHIR.string", result[0].Type())
+	assert.Equal(t, "Patient.contact[0].name.family", result[1].Location())
+
+	result = evaluate(t, "Patient.deceased", patient, nil)
+	require.Len(t, result, 1)
+	assert.Equal(t, "Patient.deceasedBoolean", result[0].Location())
+	assert.Equal(t, "FHIR.boolean", result[0].Type())
+
+	result = evaluate(t, "1 + 1", patient, nil)
+	require.Len(t, result, 1)
+	assert.Equal(t, "System.Integer", result[0].Type())
+	assert.Equal(t, "", result[0].Location())
+	assert.Equal(t, json.Number("2"), result[0].JSON())
+}
+
+func TestSetAndRemove(t *testing.T) {
+	patient := loadResource(t, "patient-example.json")
+
+	result := evaluate(t, "Patient.name.where(use = 'usual').given", patient, nil)
+	require.Len(t, result, 1)
+	require.NoError(t, result[0].Set("James"))
+	assert.Equal(t, []string{"James"}, stringsOf(evaluate(t, "Patient.name[1].given", patient, nil)))
+
+	// removing birthDate also removes its extensions
+	result = evaluate(t, "Patient.birthDate", patient, nil)
+	require.Len(t, result, 1)
+	require.NoError(t, result[0].Remove())
+	assert.NotContains(t, patient, "birthDate")
+	assert.NotContains(t, patient, "_birthDate")
+
+	// removing the last item of a list removes the list
+	result = evaluate(t, "Patient.contact.telecom", patient, nil)
+	require.Len(t, result, 1)
+	require.NoError(t, result[0].Remove())
+	assert.Empty(t, evaluate(t, "Patient.contact.telecom", patient, nil))
+	assert.NotContains(t, patient["contact"].([]interface{})[0], "telecom")
+
+	result = evaluate(t, "1 + 1", patient, nil)
+	assert.Error(t, result[0].Set("x"))
+	assert.Error(t, result[0].Remove())
+}
+
+func TestSplitLastElement(t *testing.T) {
+	parent, name, ok := MustCompile("Patient.name.where(use = 'official').given").SplitLastElement()
+	require.True(t, ok)
+	assert.Equal(t, "Patient.name.where(use = 'official')", parent.String())
+	assert.Equal(t, "given", name)
+
+	_, _, ok = MustCompile("Patient.name.first()").SplitLastElement()
+	assert.False(t, ok)
+}
+
+func TestResolve(t *testing.T) {
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry": []interface{}{
+			map[string]interface{}{
+				"fullUrl":  "http://example.org/fhir/Observation/1",
+				"resource": loadResource(t, "observation-example.json"),
+			},
+			map[string]interface{}{
+				"fullUrl": "http://example.org/fhir/Patient/example",
+				"resource": map[string]interface{}{
+					"resourceType": "Patient",
+					"id":           "example",
+					"managingOrganization": map[string]interface{}{
+						"reference": "#org",
+					},
+					"contained": []interface{}{
+						map[string]interface{}{"resourceType": "Organization", "id": "org", "name": "Gastroenterology"},
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, []string{"Gastroenterology"},
+		stringsOf(evaluate(t, "Bundle.entry.resource.ofType(Observation).subject.resolve().managingOrganization.resolve().name", bundle, nil)))
+
+	var resolved []string
+	options := &Options{Resolve: func(reference string) (map[string]interface{}, error) {
+		resolved = append(resolved, reference)
+		return map[string]interface{}{"resourceType": "Patient", "id": "example", "gender": "female"}, nil
+	}}
+	observation := loadResource(t, "observation-example.json")
+	assert.Equal(t, []string{"female"}, stringsOf(evaluate(t, "Observation.subject.resolve().gender", observation, options)))
+	assert.Equal(t, []string{"Patient/example"}, resolved)
+}
+
+func TestRepeatAndDescendants(t *testing.T) {
+	questionnaire := map[string]interface{}{
+		"resourceType": "Questionnaire",
+		"status":       "draft",
+		"item": []interface{}{
+			map[string]interface{}{"linkId": "1", "type": "group", "item": []interface{}{
+				map[string]interface{}{"linkId": "1.1", "type": "string"},
+				map[string]interface{}{"linkId": "1.2", "type": "group", "item": []interface{}{
+					map[string]interface{}{"linkId": "1.2.1", "type": "string"},
+				}},
+			}},
+			map[string]interface{}{"linkId": "2", "type": "string"},
+		},
+	}
+	assert.Equal(t, []string{"1", "2", "1.1", "1.2", "1.2.1"}, stringsOf(evaluate(t, "Questionnaire.repeat(item).linkId", questionnaire, nil)))
+	assert.Equal(t, []string{"5"}, stringsOf(evaluate(t, "Questionnaire.descendants().linkId.count()", questionnaire, nil)))
+}
+
+func TestVariablesAndTrace(t *testing.T) {
+	var traced []string
+	options := &Options{
+		Variables: map[string]interface{}{"threshold": json.Number("180")},
+		Trace: func(name string, values Collection) {
+			traced = append(traced, name)
+		},
+		Now: time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	observation := loadResource(t, "observation-example.json")
+	assert.Equal(t, []string{"true"}, stringsOf(evaluate(t, "Observation.value.value.trace('value') > %threshold", observation, options)))
+	assert.Equal(t, []string{"value"}, traced)
+	assert.Equal(t, []string{"2019-06-01"}, stringsOf(evaluate(t, "today()", observation, options)))
+
+	_, err := MustCompile("%unknown").Evaluate(observation, nil)
+	assert.Error(t, err)
+}
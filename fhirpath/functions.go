@@ -0,0 +1,1023 @@
+package fhirpath
+
+import (
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// a function gets its input and its call so that it can evaluate its arguments as it needs to,
+// e.g. for each item of its input
+type function struct {
+	minArgs, maxArgs int
+	call             func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		// existence
+		"empty": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return booleanResult(len(input) == 0), nil
+		}},
+		"exists": {0, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			if len(n.args) == 1 {
+				matches, err := ev.where(input, n.args[0], e)
+				return booleanResult(len(matches) > 0), err
+			}
+			return booleanResult(len(input) > 0), nil
+		}},
+		"all": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			for i, v := range input {
+				result, err := ev.evalFor(n.args[0], v, i, e)
+				if err != nil {
+					return nil, err
+				}
+				if b, empty, err := toBoolean(result); err != nil || empty || !b {
+					return booleanResult(false), err
+				}
+			}
+			return booleanResult(true), nil
+		}},
+		"allTrue":  {0, 0, booleansFunction(true, true)},
+		"anyTrue":  {0, 0, booleansFunction(false, true)},
+		"allFalse": {0, 0, booleansFunction(true, false)},
+		"anyFalse": {0, 0, booleansFunction(false, false)},
+		"subsetOf": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			return booleanResult(ev.subsetOf(input, other)), err
+		}},
+		"supersetOf": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			return booleanResult(ev.subsetOf(other, input)), err
+		}},
+		"isDistinct": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return booleanResult(len(ev.distinct(input)) == len(input)), nil
+		}},
+		"distinct": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.distinct(input), nil
+		}},
+		"count": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return Collection{systemValue(int64(len(input)))}, nil
+		}},
+
+		// filtering and projection
+		"where": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.where(input, n.args[0], e)
+		}},
+		"select": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			var result Collection
+			for i, v := range input {
+				projection, err := ev.evalFor(n.args[0], v, i, e)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, projection...)
+			}
+			return result, nil
+		}},
+		"repeat": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.repeat(input, func(v *Value, i int) (Collection, error) {
+				return ev.evalFor(n.args[0], v, i, e)
+			})
+		}},
+		"ofType": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ofType(input, *n.typeName), nil
+		}},
+
+		// subsetting
+		"single": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			v, err := singleton(input, "the input of single()")
+			if err != nil || v == nil {
+				return nil, err
+			}
+			return Collection{v}, nil
+		}},
+		"first": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[:1], nil
+		}},
+		"last": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[len(input)-1:], nil
+		}},
+		"tail": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[1:], nil
+		}},
+		"skip": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			count, empty, err := ev.integerOf(n.args[0], e, "the argument of skip()")
+			if err != nil || empty {
+				return nil, err
+			}
+			if count < 0 {
+				return input, nil
+			}
+			if count >= int64(len(input)) {
+				return nil, nil
+			}
+			return input[count:], nil
+		}},
+		"take": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			count, empty, err := ev.integerOf(n.args[0], e, "the argument of take()")
+			if err != nil || empty || count <= 0 {
+				return nil, err
+			}
+			if count >= int64(len(input)) {
+				return input, nil
+			}
+			return input[:count], nil
+		}},
+		"intersect": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			var result Collection
+			for _, v := range ev.distinct(input) {
+				if ev.contains(other, v) {
+					result = append(result, v)
+				}
+			}
+			return result, nil
+		}},
+		"exclude": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			var result Collection
+			for _, v := range input {
+				if !ev.contains(other, v) {
+					result = append(result, v)
+				}
+			}
+			return result, nil
+		}},
+
+		// combining
+		"union": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			return ev.distinct(append(append(Collection{}, input...), other...)), nil
+		}},
+		"combine": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			other, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			return append(append(Collection{}, input...), other...), nil
+		}},
+
+		// conversion
+		"iif": {2, 3, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			criterion, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			b, empty, err := toBoolean(criterion)
+			if err != nil {
+				return nil, err
+			}
+			if !empty && b {
+				return ev.eval(n.args[1], e)
+			}
+			if len(n.args) == 3 {
+				return ev.eval(n.args[2], e)
+			}
+			return nil, nil
+		}},
+		"toBoolean":          conversionFunction(toBooleanValue, false),
+		"convertsToBoolean":  conversionFunction(toBooleanValue, true),
+		"toInteger":          conversionFunction(toIntegerValue, false),
+		"convertsToInteger":  conversionFunction(toIntegerValue, true),
+		"toDecimal":          conversionFunction(toDecimalValue, false),
+		"convertsToDecimal":  conversionFunction(toDecimalValue, true),
+		"toString":           conversionFunction(toStringValue, false),
+		"convertsToString":   conversionFunction(toStringValue, true),
+		"toDate":             conversionFunction(toDateValue, false),
+		"convertsToDate":     conversionFunction(toDateValue, true),
+		"toDateTime":         conversionFunction(toDateTimeValue, false),
+		"convertsToDateTime": conversionFunction(toDateTimeValue, true),
+		"toTime":             conversionFunction(toTimeValue, false),
+		"convertsToTime":     conversionFunction(toTimeValue, true),
+		"toQuantity": {0, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.toQuantity(input, n, e, false)
+		}},
+		"convertsToQuantity": {0, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.toQuantity(input, n, e, true)
+		}},
+
+		// strings
+		"indexOf": stringFunction(1, 1, func(s string, args []interface{}) (interface{}, bool) {
+			index := strings.Index(s, args[0].(string))
+			if index < 0 {
+				return int64(-1), true
+			}
+			return int64(utf8.RuneCountInString(s[:index])), true
+		}, "string"),
+		"substring": stringFunction(1, 2, func(s string, args []interface{}) (interface{}, bool) {
+			runes := []rune(s)
+			start := args[0].(int64)
+			if start < 0 || start >= int64(len(runes)) {
+				return nil, false
+			}
+			end := int64(len(runes))
+			if len(args) == 2 && args[1] != nil && start+args[1].(int64) < end {
+				end = start + args[1].(int64)
+			}
+			if end < start {
+				end = start
+			}
+			return string(runes[start:end]), true
+		}, "integer", "integer"),
+		"startsWith": stringFunction(1, 1, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.HasPrefix(s, args[0].(string)), true
+		}, "string"),
+		"endsWith": stringFunction(1, 1, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.HasSuffix(s, args[0].(string)), true
+		}, "string"),
+		"contains": stringFunction(1, 1, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.Contains(s, args[0].(string)), true
+		}, "string"),
+		"upper": stringFunction(0, 0, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.ToUpper(s), true
+		}),
+		"lower": stringFunction(0, 0, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.ToLower(s), true
+		}),
+		"replace": stringFunction(2, 2, func(s string, args []interface{}) (interface{}, bool) {
+			return strings.Replace(s, args[0].(string), args[1].(string), -1), true
+		}, "string", "string"),
+		"matches": stringFunction(1, 1, func(s string, args []interface{}) (interface{}, bool) {
+			return args[0].(*regexp.Regexp).MatchString(s), true
+		}, "regex"),
+		"replaceMatches": stringFunction(2, 2, func(s string, args []interface{}) (interface{}, bool) {
+			substitution := groupReference.ReplaceAllString(args[1].(string), "$${$1}")
+			return args[0].(*regexp.Regexp).ReplaceAllString(s, substitution), true
+		}, "regex", "string"),
+		"length": stringFunction(0, 0, func(s string, args []interface{}) (interface{}, bool) {
+			return int64(utf8.RuneCountInString(s)), true
+		}),
+		"toChars": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			v, err := singleton(input, "the input of toChars()")
+			if err != nil || v == nil {
+				return nil, err
+			}
+			s, isString := v.comparable().(string)
+			if !isString {
+				return nil, errors.Errorf("toChars() can't be used with %s", v.Type())
+			}
+			var result Collection
+			for _, r := range s {
+				result = append(result, systemValue(string(r)))
+			}
+			return result, nil
+		}},
+
+		// math
+		"abs": mathFunction(0, func(x interface{}, args []interface{}) (interface{}, bool) {
+			switch x := x.(type) {
+			case int64:
+				if x < 0 {
+					x = -x
+				}
+				return x, true
+			case decimal:
+				return decimal{value: new(big.Rat).Abs(x.value), scale: x.scale}, true
+			case quantity:
+				x.value = decimal{value: new(big.Rat).Abs(x.value.value), scale: x.value.scale}
+				return x, true
+			}
+			return nil, false
+		}),
+		"ceiling": mathFunction(0, func(x interface{}, args []interface{}) (interface{}, bool) {
+			return roundToInteger(x, math.Ceil)
+		}),
+		"floor": mathFunction(0, func(x interface{}, args []interface{}) (interface{}, bool) {
+			return roundToInteger(x, math.Floor)
+		}),
+		"truncate": mathFunction(0, func(x interface{}, args []interface{}) (interface{}, bool) {
+			return roundToInteger(x, math.Trunc)
+		}),
+		"exp":  mathFunction(0, floatFunction(math.Exp)),
+		"ln":   mathFunction(0, floatFunction(math.Log)),
+		"sqrt": mathFunction(0, floatFunction(math.Sqrt)),
+		"log": mathFunction(1, func(x interface{}, args []interface{}) (interface{}, bool) {
+			base, isNumber := numberValue(args[0])
+			if !isNumber {
+				return nil, false
+			}
+			b, _ := base.Float64()
+			return floatFunction(func(f float64) float64 { return math.Log(f) / math.Log(b) })(x, nil)
+		}),
+		"power": mathFunction(1, func(x interface{}, args []interface{}) (interface{}, bool) {
+			if base, isInteger := x.(int64); isInteger {
+				if exponent, isInteger := args[0].(int64); isInteger && exponent >= 0 {
+					return new(big.Int).Exp(big.NewInt(base), big.NewInt(exponent), nil).Int64(), true
+				}
+			}
+			exponent, isNumber := numberValue(args[0])
+			if !isNumber {
+				return nil, false
+			}
+			e, _ := exponent.Float64()
+			return floatFunction(func(f float64) float64 { return math.Pow(f, e) })(x, nil)
+		}),
+		"round": mathFunction(-1, func(x interface{}, args []interface{}) (interface{}, bool) {
+			if _, isNumber := numberValue(x); !isNumber {
+				return nil, false
+			}
+			precision := int64(0)
+			if len(args) == 1 {
+				precision, _ = args[0].(int64)
+			}
+			if precision < 0 {
+				return nil, false
+			}
+			return decimalOf(x).round(int(precision)), true
+		}),
+
+		// tree navigation
+		"children": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			var result Collection
+			for _, v := range input {
+				result = append(result, v.allChildren()...)
+			}
+			return result, nil
+		}},
+		"descendants": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ev.repeat(input, func(v *Value, i int) (Collection, error) {
+				return v.allChildren(), nil
+			})
+		}},
+
+		// utility
+		"trace": {1, 2, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			name, err := ev.eval(n.args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			if ev.options.Trace == nil {
+				return input, nil
+			}
+			values := input
+			if len(n.args) == 2 {
+				values = nil
+				for i, v := range input {
+					projection, err := ev.evalFor(n.args[1], v, i, e)
+					if err != nil {
+						return nil, err
+					}
+					values = append(values, projection...)
+				}
+			}
+			label := ""
+			if len(name) == 1 {
+				label = name[0].String()
+			}
+			ev.options.Trace(label, values)
+			return input, nil
+		}},
+		"now": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return Collection{systemValue(dateTimeFromTime(ev.now, kindDateTime, precisionMillisecond))}, nil
+		}},
+		"timeOfDay": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return Collection{systemValue(dateTimeFromTime(ev.now, kindTime, precisionMillisecond))}, nil
+		}},
+		"today": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return Collection{systemValue(dateTimeFromTime(ev.now, kindDate, precisionDay))}, nil
+		}},
+
+		// types
+		"is": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return isType(input, *n.typeName)
+		}},
+		"as": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return ofType(input, *n.typeName), nil
+		}},
+		"type": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			var result Collection
+			for _, v := range input {
+				namespace, name := v.typeName()
+				if name == "" {
+					continue
+				}
+				info := map[string]interface{}{"namespace": namespace, "name": name}
+				result = append(result, &Value{data: info, element: true, index: -1})
+			}
+			return result, nil
+		}},
+
+		"not": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			b, empty, err := toBoolean(input)
+			if err != nil || empty {
+				return nil, err
+			}
+			return booleanResult(!b), nil
+		}},
+
+		"aggregate": {1, 2, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			var total Collection
+			if len(n.args) == 2 {
+				var err error
+				if total, err = ev.eval(n.args[1], e); err != nil {
+					return nil, err
+				}
+			}
+			for i, v := range input {
+				var err error
+				total, err = ev.eval(n.args[0], &env{focus: Collection{v}, index: Collection{systemValue(int64(i))}, total: total})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return total, nil
+		}},
+
+		// FHIR
+		"extension": {1, 1, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			url, empty, err := ev.stringOf(n.args[0], e, "the argument of extension()")
+			if err != nil || empty {
+				return nil, err
+			}
+			extensions, err := navigate(input, "extension")
+			if err != nil {
+				return nil, err
+			}
+			var result Collection
+			for _, extension := range extensions {
+				if object, isObject := extension.data.(map[string]interface{}); isObject && object["url"] == url {
+					result = append(result, extension)
+				}
+			}
+			return result, nil
+		}},
+		"hasValue": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			return booleanResult(len(input) == 1 && input[0].hasValue()), nil
+		}},
+		"getValue": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			if len(input) != 1 || !input[0].hasValue() {
+				return nil, nil
+			}
+			return Collection{input[0].systemOrSelf()}, nil
+		}},
+		"resolve": {0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+			var result Collection
+			for _, v := range input {
+				resolved, err := ev.resolve(v)
+				if err != nil {
+					return nil, err
+				}
+				if resolved != nil {
+					result = append(result, resolved)
+				}
+			}
+			return result, nil
+		}},
+	}
+}
+
+var groupReference = regexp.MustCompile(`\$([0-9]+)`)
+
+func (ev *evaluator) call(n *functionNode, input Collection, e *env) (Collection, error) {
+	f, found := functions[n.name]
+	if !found {
+		return nil, errors.Errorf("unknown function %s()", n.name)
+	}
+	if len(n.args) < f.minArgs || len(n.args) > f.maxArgs {
+		return nil, errors.Errorf("wrong number of arguments for %s()", n.name)
+	}
+	return f.call(ev, input, n, e)
+}
+
+// evalFor evaluates the argument of an iterating function for an item of its input
+func (ev *evaluator) evalFor(arg node, v *Value, index int, e *env) (Collection, error) {
+	return ev.eval(arg, &env{focus: Collection{v}, index: Collection{systemValue(int64(index))}, total: e.total})
+}
+
+func (ev *evaluator) where(input Collection, criteria node, e *env) (Collection, error) {
+	var result Collection
+	for i, v := range input {
+		matches, err := ev.evalFor(criteria, v, i, e)
+		if err != nil {
+			return nil, err
+		}
+		if b, empty, err := toBoolean(matches); err != nil {
+			return nil, err
+		} else if !empty && b {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// repeat applies a projection to the input and then to its results until no new items are found
+func (ev *evaluator) repeat(input Collection, project func(v *Value, i int) (Collection, error)) (Collection, error) {
+	var result Collection
+	queue := input
+	for len(queue) > 0 {
+		var next Collection
+		for i, v := range queue {
+			projection, err := project(v, i)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range projection {
+				if !ev.containsItem(result, item) {
+					result = append(result, item)
+					next = append(next, item)
+				}
+			}
+		}
+		queue = next
+	}
+	return result, nil
+}
+
+// containsItem checks whether a collection has the same element or an equal computed value
+func (ev *evaluator) containsItem(c Collection, v *Value) bool {
+	for _, item := range c {
+		if item == v || v.location != "" && item.location == v.location && item.resource == v.resource {
+			return true
+		}
+		if v.location == "" && item.location == "" && ev.equal(item, v) == isTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func (ev *evaluator) subsetOf(subset Collection, superset Collection) bool {
+	for _, v := range subset {
+		if !ev.contains(superset, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// booleansFunction implements allTrue(), anyTrue(), allFalse() and anyFalse()
+func booleansFunction(all bool, value bool) func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+	return func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+		for _, v := range input {
+			b, isBool := v.comparable().(bool)
+			if !isBool {
+				return nil, errors.Errorf("%s() can't be used with %s", n.name, v.Type())
+			}
+			if all && b != value {
+				return booleanResult(false), nil
+			}
+			if !all && b == value {
+				return booleanResult(true), nil
+			}
+		}
+		return booleanResult(all), nil
+	}
+}
+
+func ofType(input Collection, t typeSpecifier) Collection {
+	var result Collection
+	for _, v := range input {
+		if typeIs(v, t) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func isType(input Collection, t typeSpecifier) (Collection, error) {
+	v, err := singleton(input, "the input of is")
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return booleanResult(typeIs(v, t)), nil
+}
+
+func (ev *evaluator) stringOf(n node, e *env, what string) (value string, empty bool, err error) {
+	c, err := ev.eval(n, e)
+	if err != nil {
+		return "", false, err
+	}
+	v, err := singleton(c, what)
+	if err != nil || v == nil {
+		return "", true, err
+	}
+	s, isString := v.comparable().(string)
+	if !isString {
+		return "", false, errors.Errorf("%s should be a string", what)
+	}
+	return s, false, nil
+}
+
+// stringFunction makes a function of a string whose arguments have the types string, integer or regex
+func stringFunction(minArgs int, maxArgs int, f func(s string, args []interface{}) (interface{}, bool), argTypes ...string) function {
+	return function{minArgs, maxArgs, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+		v, err := singleton(input, "the input of "+n.name+"()")
+		if err != nil || v == nil {
+			return nil, err
+		}
+		s, isString := v.comparable().(string)
+		if !isString {
+			return nil, errors.Errorf("%s() can't be used with %s", n.name, v.Type())
+		}
+
+		args := make([]interface{}, len(n.args))
+		for i, arg := range n.args {
+			what := "the arguments of " + n.name + "()"
+			switch argTypes[i] {
+			case "integer":
+				value, empty, err := ev.integerOf(arg, e, what)
+				if err != nil {
+					return nil, err
+				}
+				if empty {
+					if i == 0 {
+						return nil, nil
+					}
+					continue
+				}
+				args[i] = value
+			default:
+				value, empty, err := ev.stringOf(arg, e, what)
+				if err != nil || empty {
+					return nil, err
+				}
+				if argTypes[i] == "regex" {
+					re, err := regexp.Compile("(?s)" + value)
+					if err != nil {
+						return nil, errors.Wrapf(err, "invalid regular expression in %s()", n.name)
+					}
+					args[i] = re
+				} else {
+					args[i] = value
+				}
+			}
+		}
+
+		result, ok := f(s, args)
+		if !ok {
+			return nil, nil
+		}
+		return Collection{systemValue(result)}, nil
+	}}
+}
+
+// mathFunction makes a function of a number with a number of numeric arguments (-1 for an optional one)
+func mathFunction(numArgs int, f func(x interface{}, args []interface{}) (interface{}, bool)) function {
+	minArgs, maxArgs := numArgs, numArgs
+	if numArgs < 0 {
+		minArgs, maxArgs = 0, 1
+	}
+	return function{minArgs, maxArgs, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+		v, err := singleton(input, "the input of "+n.name+"()")
+		if err != nil || v == nil {
+			return nil, err
+		}
+		x := v.comparable()
+		if _, isNumber := numberValue(x); !isNumber {
+			if _, isQuantity := x.(quantity); !isQuantity || n.name != "abs" {
+				return nil, errors.Errorf("%s() can't be used with %s", n.name, v.Type())
+			}
+		}
+		var args []interface{}
+		for _, arg := range n.args {
+			c, err := ev.eval(arg, e)
+			if err != nil {
+				return nil, err
+			}
+			a, err := singleton(c, "the argument of "+n.name+"()")
+			if err != nil || a == nil {
+				return nil, err
+			}
+			value := a.comparable()
+			if _, isNumber := numberValue(value); !isNumber {
+				return nil, errors.Errorf("the argument of %s() should be a number", n.name)
+			}
+			args = append(args, value)
+		}
+		result, ok := f(x, args)
+		if !ok {
+			return nil, nil
+		}
+		return Collection{systemValue(result)}, nil
+	}}
+}
+
+func roundToInteger(x interface{}, round func(float64) float64) (interface{}, bool) {
+	switch x := x.(type) {
+	case int64:
+		return x, true
+	case decimal:
+		// truncate and then adjust by rounding half of the remainder's sign, keeping large values exact
+		integer := new(big.Int).Quo(x.value.Num(), x.value.Denom())
+		remainder := new(big.Rat).Sub(x.value, new(big.Rat).SetInt(integer))
+		if remainder.Sign() != 0 {
+			if adjusted := round(float64(remainder.Sign()) * 0.5); adjusted != 0 {
+				integer.Add(integer, big.NewInt(int64(adjusted)))
+			}
+		}
+		return integer.Int64(), true
+	}
+	return nil, false
+}
+
+func floatFunction(f func(float64) float64) func(x interface{}, args []interface{}) (interface{}, bool) {
+	return func(x interface{}, args []interface{}) (interface{}, bool) {
+		value, _ := numberValue(x)
+		float, _ := value.Float64()
+		return decimalFromFloat(f(float))
+	}
+}
+
+// conversionFunction makes a toX() or convertsToX() function
+func conversionFunction(convert func(v *Value) (interface{}, bool), test bool) function {
+	return function{0, 0, func(ev *evaluator, input Collection, n *functionNode, e *env) (Collection, error) {
+		v, err := singleton(input, "the input of "+n.name+"()")
+		if err != nil || v == nil {
+			return nil, err
+		}
+		result, ok := convert(v)
+		if test {
+			return booleanResult(ok), nil
+		}
+		if !ok {
+			return nil, nil
+		}
+		return Collection{systemValue(result)}, nil
+	}}
+}
+
+var (
+	integerPattern = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	stringDecimal  = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+)
+
+func toBooleanValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case bool:
+		return x, true
+	case int64:
+		if x == 0 || x == 1 {
+			return x == 1, true
+		}
+	case decimal:
+		if x.value.Cmp(new(big.Rat)) == 0 || x.value.Cmp(big.NewRat(1, 1)) == 0 {
+			return x.value.Sign() != 0, true
+		}
+	case string:
+		switch strings.ToLower(x) {
+		case "true", "t", "yes", "y", "1", "1.0":
+			return true, true
+		case "false", "f", "no", "n", "0", "0.0":
+			return false, true
+		}
+	}
+	return nil, false
+}
+
+func toIntegerValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case int64:
+		return x, true
+	case bool:
+		if x {
+			return int64(1), true
+		}
+		return int64(0), true
+	case string:
+		if integerPattern.MatchString(x) {
+			return parseInteger(strings.TrimPrefix(x, "+"))
+		}
+	}
+	return nil, false
+}
+
+func toDecimalValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case int64:
+		return decimalFromInt(x), true
+	case decimal:
+		return x, true
+	case bool:
+		if x {
+			return decimal{value: big.NewRat(1, 1), scale: 1}, true
+		}
+		return decimal{value: new(big.Rat), scale: 1}, true
+	case string:
+		if stringDecimal.MatchString(x) {
+			return parseDecimal(strings.TrimPrefix(x, "+"))
+		}
+	}
+	return nil, false
+}
+
+func toStringValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case nil:
+		return nil, false
+	case string:
+		return x, true
+	default:
+		return systemValue(x).String(), true
+	}
+}
+
+func toDateValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case dateTime:
+		if x.kind == kindTime {
+			return nil, false
+		}
+		precision := x.precision
+		if precision > precisionDay {
+			precision = precisionDay
+		}
+		x = x.truncate(precision)
+		x.kind = kindDate
+		return x, true
+	case string:
+		if d, err := parseFHIRDateTime(x, kindDate); err == nil {
+			return toDateValue(systemValue(d))
+		}
+	}
+	return nil, false
+}
+
+func toDateTimeValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case dateTime:
+		if x.kind == kindTime {
+			return nil, false
+		}
+		x.kind = kindDateTime
+		return x, true
+	case string:
+		if d, err := parseFHIRDateTime(x, kindDateTime); err == nil {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func toTimeValue(v *Value) (interface{}, bool) {
+	switch x := v.comparable().(type) {
+	case dateTime:
+		if x.kind == kindTime {
+			return x, true
+		}
+	case string:
+		if t, err := parseTime(strings.TrimPrefix(x, "T")); err == nil {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func (ev *evaluator) toQuantity(input Collection, n *functionNode, e *env, test bool) (Collection, error) {
+	v, err := singleton(input, "the input of "+n.name+"()")
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	var q quantity
+	ok := true
+	switch x := v.comparable().(type) {
+	case quantity:
+		q = x
+	case int64, decimal:
+		q = quantity{value: decimalOf(x), unit: "1"}
+	case bool:
+		q = quantity{value: decimal{value: new(big.Rat), scale: 1}, unit: "1"}
+		if x {
+			q.value.value = big.NewRat(1, 1)
+		}
+	case string:
+		q, ok = parseQuantity(x)
+	default:
+		ok = false
+	}
+
+	if ok && len(n.args) == 1 {
+		unit, empty, err := ev.stringOf(n.args[0], e, "the argument of "+n.name+"()")
+		if err != nil {
+			return nil, err
+		}
+		if !empty && unit != q.unit {
+			target := quantity{value: decimalFromInt(1), unit: unit}.inBaseUnit()
+			base := q.inBaseUnit()
+			if ok = base.unit == target.unit; ok {
+				q = quantity{value: decimal{value: new(big.Rat).Quo(base.value.value, target.value.value), scale: q.value.scale}, unit: unit}
+			}
+		}
+	}
+
+	if test {
+		return booleanResult(ok), nil
+	}
+	if !ok {
+		return nil, nil
+	}
+	return Collection{systemValue(q)}, nil
+}
+
+// hasValue returns true for primitive elements that have a value rather than just extensions
+func (v *Value) hasValue() bool {
+	if !v.element || !isPrimitiveType(v.fhirType) {
+		return false
+	}
+	return v.data != nil
+}
+
+// resolve finds the resource that a Reference or a reference string refers to: a contained resource,
+// an entry of the Bundle that the resource is in, or one found with Options.Resolve
+func (ev *evaluator) resolve(v *Value) (*Value, error) {
+	var reference string
+	switch x := v.comparable().(type) {
+	case string:
+		reference = x
+	default:
+		object, isObject := v.data.(map[string]interface{})
+		if !isObject {
+			return nil, nil
+		}
+		reference, _ = object["reference"].(string)
+	}
+	if reference == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(reference, "#") {
+		// contained resources are in the resource that isn't itself contained
+		container := v.resource
+		for container != nil && container.contains != nil && container.name == "contained" {
+			container = container.contains
+		}
+		if container == nil {
+			return nil, nil
+		}
+		contained, err := container.children("contained")
+		if err != nil {
+			return nil, nil
+		}
+		for _, resource := range contained {
+			if object, isObject := resource.data.(map[string]interface{}); isObject && object["id"] == reference[1:] {
+				return resource, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for container := v.resource; container != nil; container = container.contains {
+		if container.fhirType != "Bundle" {
+			continue
+		}
+		entries, err := container.children("entry")
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			object, _ := entry.data.(map[string]interface{})
+			fullURL, _ := object["fullUrl"].(string)
+			resource, _ := object["resource"].(map[string]interface{})
+			if resource == nil {
+				continue
+			}
+			resourceType, _ := resource["resourceType"].(string)
+			id, _ := resource["id"].(string)
+			relative := resourceType + "/" + id
+			if fullURL == reference || id != "" && (reference == relative || strings.HasSuffix(reference, "/"+relative) || strings.HasSuffix(fullURL, "/"+reference)) {
+				resources, err := entry.children("resource")
+				if err != nil || len(resources) == 0 {
+					return nil, err
+				}
+				return resources[0], nil
+			}
+		}
+	}
+
+	if ev.options.Resolve == nil {
+		return nil, nil
+	}
+	resource, err := ev.options.Resolve(reference)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %s", reference)
+	}
+	if resource == nil {
+		return nil, nil
+	}
+	return NewResource(resource), nil
+}
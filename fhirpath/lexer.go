@@ -0,0 +1,224 @@
+package fhirpath
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenDelimitedIdentifier
+	tokenString
+	tokenNumber
+	tokenDateTime
+	tokenVariable // $this, $index and $total
+	tokenConstant // %name or %`name` or %'name'
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string // the identifier, the string without quotes, the number, the operator etc.
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "the end of the expression"
+	case tokenString:
+		return fmt.Sprintf("'%s'", t.text)
+	default:
+		return t.text
+	}
+}
+
+// SyntaxError is returned by Compile for invalid expressions
+type SyntaxError struct {
+	Expression string
+	Position   int
+	Message    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid FHIRPath expression at position %d: %s", e.Position, e.Message)
+}
+
+var (
+	dateTimeLiteral = regexp.MustCompile(`^@[0-9]{4}(-[0-9]{2}(-[0-9]{2})?)?(T([0-9]{2}(:[0-9]{2}(:[0-9]{2}(\.[0-9]+)?)?)?(Z|[+-][0-9]{2}:[0-9]{2})?)?)?`)
+	timeLiteral     = regexp.MustCompile(`^@T[0-9]{2}(:[0-9]{2}(:[0-9]{2}(\.[0-9]+)?)?)?`)
+	numberLiteral   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?`)
+)
+
+// the operators, longest first
+var operators = []string{"<=", ">=", "!=", "!~", ".", "[", "]", "(", ")", "{", "}", ",", "+", "-", "*", "/", "|", "&", "=", "~", "<", ">"}
+
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	fail := func(format string, args ...interface{}) error {
+		return &SyntaxError{Expression: expression, Position: pos, Message: fmt.Sprintf(format, args...)}
+	}
+
+	for pos < len(expression) {
+		rest := expression[pos:]
+		c := rest[0]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			pos += end
+
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return nil, fail("unterminated comment")
+			}
+			pos += end + 4
+
+		case c == '\'' || c == '`':
+			text, length, err := unquote(rest)
+			if err != nil {
+				return nil, fail("%s", err)
+			}
+			kind := tokenString
+			if c == '`' {
+				kind = tokenDelimitedIdentifier
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: pos})
+			pos += length
+
+		case c == '@':
+			literal := timeLiteral.FindString(rest)
+			if literal == "" {
+				literal = dateTimeLiteral.FindString(rest)
+			}
+			if literal == "" {
+				return nil, fail("invalid date/time literal")
+			}
+			tokens = append(tokens, token{kind: tokenDateTime, text: literal, pos: pos})
+			pos += len(literal)
+
+		case c >= '0' && c <= '9':
+			literal := numberLiteral.FindString(rest)
+			tokens = append(tokens, token{kind: tokenNumber, text: literal, pos: pos})
+			pos += len(literal)
+
+		case c == '$':
+			name := identifierPrefix(rest[1:])
+			if name != "this" && name != "index" && name != "total" {
+				return nil, fail("unknown variable $%s", name)
+			}
+			tokens = append(tokens, token{kind: tokenVariable, text: "$" + name, pos: pos})
+			pos += 1 + len(name)
+
+		case c == '%':
+			if len(rest) > 1 && (rest[1] == '`' || rest[1] == '\'') {
+				text, length, err := unquote(rest[1:])
+				if err != nil {
+					return nil, fail("%s", err)
+				}
+				tokens = append(tokens, token{kind: tokenConstant, text: text, pos: pos})
+				pos += 1 + length
+			} else {
+				name := identifierPrefix(rest[1:])
+				if name == "" {
+					return nil, fail("missing name after %%")
+				}
+				tokens = append(tokens, token{kind: tokenConstant, text: name, pos: pos})
+				pos += 1 + len(name)
+			}
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			name := identifierPrefix(rest)
+			tokens = append(tokens, token{kind: tokenIdentifier, text: name, pos: pos})
+			pos += len(name)
+
+		default:
+			found := false
+			for _, operator := range operators {
+				if strings.HasPrefix(rest, operator) {
+					tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+					pos += len(operator)
+					found = true
+					break
+				}
+			}
+			if !found {
+				r, _ := utf8.DecodeRuneInString(rest)
+				return nil, fail("unexpected character %q", r)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: pos}), nil
+}
+
+func identifierPrefix(s string) string {
+	end := 0
+	for end < len(s) {
+		c := s[end]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || end > 0 && c >= '0' && c <= '9' {
+			end++
+		} else {
+			break
+		}
+	}
+	return s[:end]
+}
+
+// unquote reads a string or a delimited identifier, returning its text and length including the quotes
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var text strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return text.String(), i + 1, nil
+		case c == '\\':
+			if i+1 >= len(s) {
+				return "", 0, fmt.Errorf("unterminated escape sequence")
+			}
+			i++
+			switch s[i] {
+			case '\'', '"', '`', '\\', '/':
+				text.WriteByte(s[i])
+			case 'f':
+				text.WriteByte('\f')
+			case 'n':
+				text.WriteByte('\n')
+			case 'r':
+				text.WriteByte('\r')
+			case 't':
+				text.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(s) {
+					return "", 0, fmt.Errorf("invalid unicode escape sequence")
+				}
+				code, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid unicode escape sequence")
+				}
+				text.WriteRune(rune(code))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence \\%c", s[i])
+			}
+		default:
+			text.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,416 @@
+package fhirpath
+
+import (
+	"fmt"
+)
+
+// the nodes of the syntax tree of an expression
+type node interface{}
+
+type literalNode struct {
+	value Collection // empty for {}
+}
+
+// identifierNode is an identifier at the start of an expression or a function parameter,
+// which is either the name of a type (e.g. Patient) or of a child of the focus
+type identifierNode struct {
+	name string
+}
+
+// memberNode is an invocation of a child's name (focus.name)
+type memberNode struct {
+	focus node
+	name  string
+	dot   int // the position of the dot in the expression
+}
+
+type functionNode struct {
+	focus    node // nil for function calls at the start of an expression
+	name     string
+	args     []node
+	typeName *typeSpecifier // for is(), as() and ofType()
+}
+
+type indexerNode struct {
+	focus node
+	index node
+}
+
+// variableNode is $this, $index or $total
+type variableNode struct {
+	name string
+}
+
+// constantNode is an environment variable (e.g. %resource)
+type constantNode struct {
+	name string
+}
+
+type unaryNode struct {
+	operator string
+	operand  node
+}
+
+type binaryNode struct {
+	operator    string
+	left, right node
+}
+
+// typeNode is the is or as operator
+type typeNode struct {
+	operator string
+	operand  node
+	typeName typeSpecifier
+}
+
+type typeSpecifier struct {
+	namespace string // FHIR, System or empty if not specified
+	name      string
+}
+
+func (t typeSpecifier) String() string {
+	if t.namespace == "" {
+		return t.name
+	}
+	return t.namespace + "." + t.name
+}
+
+// the precedence of binary operators, from loosest to tightest
+var binaryPrecedence = map[string]int{
+	"implies": 1,
+	"or":      2, "xor": 2,
+	"and": 3,
+	"in":  4, "contains": 4,
+	"=": 5, "~": 5, "!=": 5, "!~": 5,
+	"<": 6, ">": 6, "<=": 6, ">=": 6,
+	"|":  7,
+	"is": 8, "as": 8,
+	"+": 9, "-": 9, "&": 9,
+	"*": 10, "/": 10, "div": 10, "mod": 10,
+}
+
+// the words that can follow a number in a quantity literal
+var calendarDurations = map[string]string{
+	"year": "year", "years": "year",
+	"month": "month", "months": "month",
+	"week": "week", "weeks": "week",
+	"day": "day", "days": "day",
+	"hour": "hour", "hours": "hour",
+	"minute": "minute", "minutes": "minute",
+	"second": "second", "seconds": "second",
+	"millisecond": "millisecond", "milliseconds": "millisecond",
+}
+
+type parser struct {
+	expression string
+	tokens     []token
+	pos        int
+}
+
+func parse(expression string) (node, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{expression: expression, tokens: tokens}
+	root, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, p.fail(next, "unexpected %s", next)
+	}
+	return root, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) fail(at token, format string, args ...interface{}) error {
+	return &SyntaxError{Expression: p.expression, Position: at.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(operator string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != operator {
+		return p.fail(t, "expected %s but found %s", operator, t)
+	}
+	return nil
+}
+
+// binaryOperator returns the binary operator at the current token, if any
+func (p *parser) binaryOperator() (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator && t.kind != tokenIdentifier {
+		return "", false
+	}
+	_, isOperator := binaryPrecedence[t.text]
+	return t.text, isOperator
+}
+
+func (p *parser) parseExpression(minPrecedence int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, isOperator := p.binaryOperator()
+		if !isOperator || binaryPrecedence[operator] <= minPrecedence {
+			return left, nil
+		}
+		p.next()
+		precedence := binaryPrecedence[operator]
+
+		if operator == "is" || operator == "as" {
+			typeName, err := p.parseTypeSpecifier()
+			if err != nil {
+				return nil, err
+			}
+			left = &typeNode{operator: operator, operand: left, typeName: typeName}
+			continue
+		}
+
+		rightPrecedence := precedence
+		if operator == "implies" {
+			// implies is right associative
+			rightPrecedence = precedence - 1
+		}
+		right, err := p.parseExpression(rightPrecedence)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokenOperator && (t.text == "+" || t.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{operator: t.text, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	focus, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator {
+			return focus, nil
+		}
+		switch t.text {
+		case ".":
+			dot := p.next()
+			name, err := p.parseIdentifier()
+			if err != nil {
+				return nil, err
+			}
+			if next := p.peek(); next.kind == tokenOperator && next.text == "(" {
+				focus, err = p.parseFunction(focus, name)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				focus = &memberNode{focus: focus, name: name, dot: dot.pos}
+			}
+		case "[":
+			p.next()
+			index, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			focus = &indexerNode{focus: focus, index: index}
+		default:
+			return focus, nil
+		}
+	}
+}
+
+// parseIdentifier reads an identifier, which may be a keyword like as, contains, in or is
+func (p *parser) parseIdentifier() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier && t.kind != tokenDelimitedIdentifier {
+		return "", p.fail(t, "expected an identifier but found %s", t)
+	}
+	if t.kind == tokenIdentifier && isReservedWord(t.text) {
+		return "", p.fail(t, "%s can't be used as an identifier without backticks", t.text)
+	}
+	return t.text, nil
+}
+
+func isReservedWord(word string) bool {
+	switch word {
+	case "and", "or", "xor", "implies", "div", "mod", "true", "false":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseTerm() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		return p.parseNumber(t)
+
+	case tokenString:
+		return &literalNode{value: Collection{systemValue(t.text)}}, nil
+
+	case tokenDateTime:
+		value, err := parseDateTimeLiteral(t.text[1:])
+		if err != nil {
+			return nil, p.fail(t, "%s", err)
+		}
+		return &literalNode{value: Collection{systemValue(value)}}, nil
+
+	case tokenVariable:
+		return &variableNode{name: t.text}, nil
+
+	case tokenConstant:
+		return &constantNode{name: t.text}, nil
+
+	case tokenIdentifier, tokenDelimitedIdentifier:
+		if t.kind == tokenIdentifier {
+			switch t.text {
+			case "true", "false":
+				return &literalNode{value: Collection{systemValue(t.text == "true")}}, nil
+			}
+			if isReservedWord(t.text) {
+				return nil, p.fail(t, "unexpected %s", t.text)
+			}
+		}
+		if next := p.peek(); next.kind == tokenOperator && next.text == "(" {
+			return p.parseFunction(nil, t.text)
+		}
+		return &identifierNode{name: t.text}, nil
+
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		case "{":
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			return &literalNode{}, nil
+		}
+	}
+	return nil, p.fail(t, "unexpected %s", t)
+}
+
+func (p *parser) parseNumber(t token) (node, error) {
+	// a quantity has a unit after the number
+	next := p.peek()
+	unit := ""
+	if next.kind == tokenString {
+		unit = next.text
+	} else if next.kind == tokenIdentifier && calendarDurations[next.text] != "" {
+		unit = calendarDurations[next.text]
+	}
+	if unit != "" {
+		p.next()
+		value, _ := parseDecimal(t.text)
+		return &literalNode{value: Collection{systemValue(quantity{value: value, unit: unit})}}, nil
+	}
+
+	if value, isInteger := parseInteger(t.text); isInteger {
+		return &literalNode{value: Collection{systemValue(value)}}, nil
+	}
+	value, isDecimal := parseDecimal(t.text)
+	if !isDecimal {
+		return nil, p.fail(t, "invalid number %s", t.text)
+	}
+	return &literalNode{value: Collection{systemValue(value)}}, nil
+}
+
+func (p *parser) parseFunction(focus node, name string) (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	function := &functionNode{focus: focus, name: name}
+	if next := p.peek(); next.kind == tokenOperator && next.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			function.args = append(function.args, arg)
+			t := p.next()
+			if t.kind == tokenOperator && t.text == ")" {
+				break
+			}
+			if t.kind != tokenOperator || t.text != "," {
+				return nil, p.fail(t, "expected , or ) but found %s", t)
+			}
+		}
+	}
+
+	switch name {
+	case "is", "as", "ofType":
+		if len(function.args) != 1 {
+			return nil, p.fail(p.peek(), "%s() takes a type", name)
+		}
+		typeName, isType := typeSpecifierOf(function.args[0])
+		if !isType {
+			return nil, p.fail(p.peek(), "%s() takes a type", name)
+		}
+		function.typeName = &typeName
+		function.args = nil
+	}
+	return function, nil
+}
+
+func (p *parser) parseTypeSpecifier() (typeSpecifier, error) {
+	first, err := p.parseIdentifier()
+	if err != nil {
+		return typeSpecifier{}, err
+	}
+	if next := p.peek(); next.kind == tokenOperator && next.text == "." {
+		p.next()
+		second, err := p.parseIdentifier()
+		if err != nil {
+			return typeSpecifier{}, err
+		}
+		return typeSpecifier{namespace: first, name: second}, nil
+	}
+	return typeSpecifier{name: first}, nil
+}
+
+// typeSpecifierOf converts the parameter of is(), as() or ofType() to a type
+func typeSpecifierOf(n node) (typeSpecifier, bool) {
+	switch n := n.(type) {
+	case *identifierNode:
+		return typeSpecifier{name: n.name}, true
+	case *memberNode:
+		if namespace, isIdentifier := n.focus.(*identifierNode); isIdentifier {
+			return typeSpecifier{namespace: namespace.name, name: n.name}, true
+		}
+	}
+	return typeSpecifier{}, false
+}
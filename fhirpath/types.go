@@ -0,0 +1,211 @@
+package fhirpath
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// the FHIR primitive types and the system types that they're implicitly converted to
+var fhirPrimitiveTypes = map[string]string{
+	"boolean":      "Boolean",
+	"integer":      "Integer",
+	"unsignedInt":  "Integer",
+	"positiveInt":  "Integer",
+	"decimal":      "Decimal",
+	"string":       "String",
+	"code":         "String",
+	"id":           "String",
+	"markdown":     "String",
+	"uri":          "String",
+	"url":          "String",
+	"canonical":    "String",
+	"oid":          "String",
+	"uuid":         "String",
+	"base64Binary": "String",
+	"xhtml":        "String",
+	"date":         "Date",
+	"dateTime":     "DateTime",
+	"instant":      "DateTime",
+	"time":         "Time",
+}
+
+// the types that FHIR types are derived from, apart from Element and Resource
+var fhirBaseTypes = map[string]string{
+	"code":            "string",
+	"id":              "string",
+	"markdown":        "string",
+	"url":             "uri",
+	"canonical":       "uri",
+	"oid":             "uri",
+	"uuid":            "uri",
+	"unsignedInt":     "integer",
+	"positiveInt":     "integer",
+	"Age":             "Quantity",
+	"Count":           "Quantity",
+	"Distance":        "Quantity",
+	"Duration":        "Quantity",
+	"Money":           "Quantity",
+	"SimpleQuantity":  "Quantity",
+	"DomainResource":  "Resource",
+	"BackboneElement": "Element",
+}
+
+func isPrimitiveType(fhirType string) bool {
+	return fhirPrimitiveTypes[fhirType] != ""
+}
+
+func isResourceType(name string) bool {
+	return name == "Parameters" || models.StructForResourceName(name) != nil
+}
+
+// isFHIRType returns true for the names of FHIR resources and data types
+func isFHIRType(name string) bool {
+	if isPrimitiveType(name) || fhirBaseTypes[name] != "" {
+		return true
+	}
+	switch name {
+	case "Resource", "Element", "BackboneElement":
+		return true
+	}
+	_, found := childDefinitions(name)
+	return found
+}
+
+// baseType returns the type that a FHIR type is derived from, or an empty string for Element and Resource
+func baseType(fhirType string) string {
+	if base := fhirBaseTypes[fhirType]; base != "" {
+		return base
+	}
+	switch fhirType {
+	case "Element", "Resource", "":
+		return ""
+	case "Bundle", "Binary", "Parameters":
+		return "Resource"
+	}
+	if isResourceType(fhirType) {
+		return "DomainResource"
+	}
+	return "Element"
+}
+
+// typeName returns the namespace and name of a value's type
+func (v *Value) typeName() (namespace string, name string) {
+	if v.element {
+		if v.fhirType == "" {
+			if system, isSystem := v.system(); isSystem {
+				return "System", systemTypeName(system)
+			}
+			return "", ""
+		}
+		return "FHIR", v.fhirType
+	}
+	return "System", systemTypeName(v.data)
+}
+
+func systemTypeName(data interface{}) string {
+	switch data := data.(type) {
+	case bool:
+		return "Boolean"
+	case int64:
+		return "Integer"
+	case decimal:
+		return "Decimal"
+	case string:
+		return "String"
+	case dateTime:
+		return data.kind
+	case quantity:
+		return "Quantity"
+	}
+	return ""
+}
+
+// typeIs implements the is operator: unqualified names are FHIR types if there is one with the name,
+// otherwise system types
+func typeIs(v *Value, t typeSpecifier) bool {
+	namespace := t.namespace
+	if namespace == "" {
+		if isFHIRType(t.name) {
+			namespace = "FHIR"
+		} else {
+			namespace = "System"
+		}
+	}
+
+	valueNamespace, valueType := v.typeName()
+	if namespace != valueNamespace {
+		return false
+	}
+	if namespace == "System" {
+		return valueType == t.name
+	}
+	for fhirType := valueType; fhirType != ""; fhirType = baseType(fhirType) {
+		if fhirType == t.name {
+			return true
+		}
+	}
+	return false
+}
+
+// childDefinitions returns the children of a type or backbone element by their names,
+// caching the results of models2.ChildElements
+func childDefinitions(model string) (map[string]models2.ElementInfo, bool) {
+	if cached, found := definitionsCache.Load(model); found {
+		entry := cached.(definitionsCacheEntry)
+		return entry.children, entry.found
+	}
+	entry := definitionsCacheEntry{children: make(map[string]models2.ElementInfo)}
+	var children []models2.ElementInfo
+	if model != "" && !isPrimitiveType(model) {
+		children, entry.found = models2.ChildElements(model)
+	}
+	for i, child := range children {
+		entry.children[child.Name] = child
+		entry.order = append(entry.order, children[i].Name)
+	}
+	definitionsCache.Store(model, entry)
+	return entry.children, entry.found
+}
+
+// orderedChildDefinitions returns the names of the children of a type in the order of their definitions
+func orderedChildDefinitions(model string) []string {
+	childDefinitions(model)
+	cached, _ := definitionsCache.Load(model)
+	return cached.(definitionsCacheEntry).order
+}
+
+type definitionsCacheEntry struct {
+	children map[string]models2.ElementInfo
+	order    []string
+	found    bool
+}
+
+var definitionsCache sync.Map
+
+func childDefinition(model string, name string) (models2.ElementInfo, bool) {
+	children, _ := childDefinitions(model)
+	child, found := children[name]
+	return child, found
+}
+
+// choiceDefinitions returns the definitions of the types of a choice element, e.g. valueQuantity and valueString for value
+func choiceDefinitions(model string, name string) []models2.ElementInfo {
+	var choices []models2.ElementInfo
+	children, _ := childDefinitions(model)
+	for _, childName := range orderedChildDefinitions(model) {
+		if !strings.HasPrefix(childName, name) || len(childName) == len(name) {
+			continue
+		}
+		suffix := childName[len(name):]
+		if suffix[0] < 'A' || suffix[0] > 'Z' {
+			continue
+		}
+		if typeName := children[childName].Type; strings.EqualFold(typeName, suffix) {
+			choices = append(choices, children[childName])
+		}
+	}
+	return choices
+}
@@ -0,0 +1,706 @@
+package fhirpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Value is an item of a Collection: either an element of a resource (including the resource itself)
+// or a value of one of the FHIRPath system types computed by an expression
+type Value struct {
+	// the decoded JSON of elements, otherwise a bool, int64, decimal, string, dateTime or quantity
+	data    interface{}
+	element bool
+
+	// for elements: the FHIR type (e.g. HumanName, string or Patient, and BackboneElement for backbone elements,
+	// or empty if unknown) and the path of its definition, e.g. Patient.contact
+	fhirType string
+	model    string
+
+	// the id and extensions of a primitive element (its _name property)
+	primitiveElement map[string]interface{}
+
+	// where an element is in its resource, for changing it
+	parent map[string]interface{} // nil for resources that aren't contained in others
+	name   string
+	index  int // the index in the parent's list or -1
+
+	location string
+	resource *Value // the resource an element is in (the resource itself for resources)
+	contains *Value // for resources, the resource that contains them (e.g. a Bundle)
+}
+
+// Collection is the result of evaluating an expression
+type Collection []*Value
+
+func systemValue(data interface{}) *Value {
+	return &Value{data: data, index: -1}
+}
+
+// NewResource makes a Value for a resource decoded from JSON (using json.Decoder.UseNumber for numbers),
+// whose elements refer to its objects and lists so that changing them (see Value.Set) changes the resource.
+func NewResource(resource map[string]interface{}) *Value {
+	resourceType, _ := resource["resourceType"].(string)
+	v := &Value{data: resource, element: true, fhirType: resourceType, model: resourceType, index: -1, location: resourceType}
+	v.resource = v
+	return v
+}
+
+// DecodeResource decodes the JSON of a resource (e.g. from models2.Resource.JsonBytes) for Evaluate,
+// keeping numbers as json.Number so that decimals are exact
+func DecodeResource(resourceJSON []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(resourceJSON))
+	decoder.UseNumber()
+	var resource map[string]interface{}
+	if err := decoder.Decode(&resource); err != nil {
+		return nil, errors.Wrap(err, "failed to decode resource")
+	}
+	return resource, nil
+}
+
+// JSON returns the value as JSON, i.e. the element of a resource itself or a system value converted to
+// a bool, json.Number, string or (for quantities) an object. Primitive elements that only have extensions
+// return nil.
+func (v *Value) JSON() interface{} {
+	if v.element {
+		return v.data
+	}
+	switch data := v.data.(type) {
+	case int64:
+		return json.Number(strconv.FormatInt(data, 10))
+	case decimal:
+		return json.Number(data.String())
+	case dateTime:
+		return data.String()
+	case quantity:
+		return data.toJSON()
+	default:
+		return data
+	}
+}
+
+// Type returns the qualified name of the value's type, e.g. FHIR.HumanName or System.Integer,
+// or an empty string for elements of unknown types
+func (v *Value) Type() string {
+	namespace, name := v.typeName()
+	if name == "" {
+		return ""
+	}
+	return namespace + "." + name
+}
+
+// Location is a FHIRPath expression for the element in its resource, e.g. Patient.name[0].given[1],
+// or an empty string for computed values
+func (v *Value) Location() string {
+	return v.location
+}
+
+// IsElement returns true for the elements of resources, as opposed to computed values
+func (v *Value) IsElement() bool {
+	return v.element
+}
+
+// Set replaces the element in its resource
+func (v *Value) Set(value interface{}) error {
+	if !v.element || v.parent == nil {
+		return errors.Errorf("%s can't be replaced", v.describe())
+	}
+	if v.index >= 0 {
+		list, isList := v.parent[v.name].([]interface{})
+		if !isList || v.index >= len(list) {
+			return errors.Errorf("%s is no longer in its resource", v.location)
+		}
+		list[v.index] = value
+	} else {
+		v.parent[v.name] = value
+	}
+	v.data = value
+	return nil
+}
+
+// Remove deletes the element from its resource, along with the id and extensions of primitives
+func (v *Value) Remove() error {
+	if !v.element || v.parent == nil {
+		return errors.Errorf("%s can't be removed", v.describe())
+	}
+	for _, name := range []string{v.name, "_" + v.name} {
+		if v.index < 0 {
+			delete(v.parent, name)
+			continue
+		}
+		list, isList := v.parent[name].([]interface{})
+		if !isList || v.index >= len(list) {
+			continue
+		}
+		list = append(list[:v.index], list[v.index+1:]...)
+		if len(list) > 0 {
+			v.parent[name] = list
+		} else {
+			delete(v.parent, name)
+		}
+	}
+	return nil
+}
+
+// ChildRepeats returns true if the definition of the element says that the named child can repeat
+func (v *Value) ChildRepeats(name string) bool {
+	if child, found := childDefinition(v.model, name); found {
+		return child.Repeating
+	}
+	return false
+}
+
+func (v *Value) describe() string {
+	if v.location != "" {
+		return v.location
+	}
+	return "a computed value"
+}
+
+func (v *Value) String() string {
+	if system, isSystem := v.system(); isSystem {
+		switch data := system.(type) {
+		case string:
+			return data
+		case bool:
+			return strconv.FormatBool(data)
+		case int64:
+			return strconv.FormatInt(data, 10)
+		case decimal:
+			return data.String()
+		case dateTime:
+			return data.String()
+		case quantity:
+			return data.String()
+		}
+	}
+	encoded, _ := json.Marshal(v.data)
+	return string(encoded)
+}
+
+// decimal is an exact decimal number with the number of digits after its decimal point,
+// which is kept for converting it to a string and for equivalence
+type decimal struct {
+	value *big.Rat
+	scale int
+}
+
+func parseDecimal(s string) (decimal, bool) {
+	if !decimalPattern.MatchString(s) {
+		return decimal{}, false
+	}
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return decimal{}, false
+	}
+	scale := 0
+	mantissa := strings.ToLower(s)
+	exponent := 0
+	if e := strings.IndexByte(mantissa, 'e'); e >= 0 {
+		exponent, _ = strconv.Atoi(mantissa[e+1:])
+		mantissa = mantissa[:e]
+	}
+	if dot := strings.IndexByte(mantissa, '.'); dot >= 0 {
+		scale = len(mantissa) - dot - 1
+	}
+	scale -= exponent
+	if scale < 0 {
+		scale = 0
+	}
+	return decimal{value: value, scale: scale}, true
+}
+
+var decimalPattern = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+func parseInteger(s string) (int64, bool) {
+	if strings.ContainsAny(s, ".eE") {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	return value, err == nil
+}
+
+func decimalFromInt(i int64) decimal {
+	return decimal{value: new(big.Rat).SetInt64(i)}
+}
+
+func (d decimal) String() string {
+	return d.value.FloatString(d.scale)
+}
+
+// round rounds to a number of digits after the decimal point, with halves rounded away from zero
+func (d decimal) round(scale int) decimal {
+	rounded, _ := new(big.Rat).SetString(d.value.FloatString(scale))
+	return decimal{value: rounded, scale: scale}
+}
+
+// trimmed removes the trailing zeros of results with many digits, such as those of divisions
+func (d decimal) trimmed(maxScale int) decimal {
+	d = d.round(maxScale)
+	text := d.String()
+	for d.scale > 0 && strings.HasSuffix(text, "0") {
+		text = text[:len(text)-1]
+		d.scale--
+	}
+	return d
+}
+
+func (d decimal) float() float64 {
+	f, _ := d.value.Float64()
+	return f
+}
+
+func decimalFromFloat(f float64) (decimal, bool) {
+	if f != f || f > 1e300 || f < -1e300 {
+		return decimal{}, false
+	}
+	r := new(big.Rat)
+	if r.SetFloat64(f) == nil {
+		return decimal{}, false
+	}
+	return decimal{value: r, scale: 8}.trimmed(8), true
+}
+
+type precision int
+
+const (
+	precisionYear precision = iota
+	precisionMonth
+	precisionDay
+	precisionHour
+	precisionMinute
+	precisionSecond
+	precisionMillisecond
+)
+
+const (
+	kindDate     = "Date"
+	kindDateTime = "DateTime"
+	kindTime     = "Time"
+)
+
+// dateTime is a Date, DateTime or Time with the precision it was given with
+type dateTime struct {
+	kind      string
+	year      int
+	month     int
+	day       int
+	hour      int
+	minute    int
+	second    int
+	nanos     int
+	precision precision
+	// the offset from UTC in minutes, if there is one
+	zone    int
+	hasZone bool
+}
+
+var (
+	datePattern     = regexp.MustCompile(`^([0-9]{4})(-([0-9]{2})(-([0-9]{2}))?)?$`)
+	timePattern     = regexp.MustCompile(`^([0-9]{2})(:([0-9]{2})(:([0-9]{2})(\.([0-9]+))?)?)?$`)
+	timeZonePattern = regexp.MustCompile(`(Z|[+-][0-9]{2}:[0-9]{2})$`)
+)
+
+// parseDateTimeLiteral parses a date, dateTime or time literal (without the @)
+func parseDateTimeLiteral(text string) (dateTime, error) {
+	if strings.HasPrefix(text, "T") {
+		return parseTime(text[1:])
+	}
+	if t := strings.IndexByte(text, 'T'); t >= 0 {
+		return parseDateTime(text[:t], text[t+1:])
+	}
+	return parseDate(text, kindDate)
+}
+
+// parseFHIRDateTime parses the value of a FHIR date, dateTime or instant, in which the T is only present with a time
+func parseFHIRDateTime(text string, kind string) (dateTime, error) {
+	if t := strings.IndexByte(text, 'T'); t >= 0 {
+		return parseDateTime(text[:t], text[t+1:])
+	}
+	return parseDate(text, kind)
+}
+
+func parseDate(text string, kind string) (dateTime, error) {
+	match := datePattern.FindStringSubmatch(text)
+	if match == nil {
+		return dateTime{}, errors.Errorf("invalid date %s", text)
+	}
+	d := dateTime{kind: kind, month: 1, day: 1, precision: precisionYear}
+	d.year, _ = strconv.Atoi(match[1])
+	if match[3] != "" {
+		d.month, _ = strconv.Atoi(match[3])
+		d.precision = precisionMonth
+	}
+	if match[5] != "" {
+		d.day, _ = strconv.Atoi(match[5])
+		d.precision = precisionDay
+	}
+	if d.month < 1 || d.month > 12 || d.day < 1 || d.day > daysIn(d.year, d.month) {
+		return dateTime{}, errors.Errorf("invalid date %s", text)
+	}
+	return d, nil
+}
+
+func parseDateTime(dateText string, timeText string) (dateTime, error) {
+	d, err := parseDate(dateText, kindDateTime)
+	if err != nil {
+		return dateTime{}, err
+	}
+	if timeText == "" {
+		return d, nil
+	}
+	if zone := timeZonePattern.FindString(timeText); zone != "" {
+		timeText = timeText[:len(timeText)-len(zone)]
+		d.hasZone = true
+		if zone != "Z" {
+			hours, _ := strconv.Atoi(zone[1:3])
+			minutes, _ := strconv.Atoi(zone[4:6])
+			d.zone = hours*60 + minutes
+			if zone[0] == '-' {
+				d.zone = -d.zone
+			}
+		}
+	}
+	if timeText == "" {
+		return d, nil
+	}
+	t, err := parseTime(timeText)
+	if err != nil {
+		return dateTime{}, err
+	}
+	d.hour, d.minute, d.second, d.nanos, d.precision = t.hour, t.minute, t.second, t.nanos, t.precision
+	return d, nil
+}
+
+func parseTime(text string) (dateTime, error) {
+	match := timePattern.FindStringSubmatch(text)
+	if match == nil {
+		return dateTime{}, errors.Errorf("invalid time %s", text)
+	}
+	t := dateTime{kind: kindTime, precision: precisionHour}
+	t.hour, _ = strconv.Atoi(match[1])
+	if match[3] != "" {
+		t.minute, _ = strconv.Atoi(match[3])
+		t.precision = precisionMinute
+	}
+	if match[5] != "" {
+		t.second, _ = strconv.Atoi(match[5])
+		t.precision = precisionSecond
+	}
+	if match[7] != "" {
+		fraction := (match[7] + "000000000")[:9]
+		t.nanos, _ = strconv.Atoi(fraction)
+		t.precision = precisionMillisecond
+	}
+	if t.hour > 23 || t.minute > 59 || t.second > 59 {
+		return dateTime{}, errors.Errorf("invalid time %s", text)
+	}
+	return t, nil
+}
+
+func daysIn(year int, month int) int {
+	return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func dateTimeFromTime(t time.Time, kind string, p precision) dateTime {
+	_, offset := t.Zone()
+	d := dateTime{
+		kind:      kind,
+		year:      t.Year(),
+		month:     int(t.Month()),
+		day:       t.Day(),
+		hour:      t.Hour(),
+		minute:    t.Minute(),
+		second:    t.Second(),
+		nanos:     t.Nanosecond() / 1000000 * 1000000,
+		precision: p,
+	}
+	if kind == kindDateTime && p >= precisionHour {
+		d.zone = offset / 60
+		d.hasZone = true
+	}
+	return d.truncate(p)
+}
+
+// truncate clears the fields finer than a precision
+func (d dateTime) truncate(p precision) dateTime {
+	if p < precisionMillisecond {
+		d.nanos = 0
+	}
+	if p < precisionSecond {
+		d.second = 0
+	}
+	if p < precisionMinute {
+		d.minute = 0
+	}
+	if p < precisionHour {
+		d.hour = 0
+		d.hasZone = false
+		d.zone = 0
+	}
+	if p < precisionDay && d.kind != kindTime {
+		d.day = 1
+	}
+	if p < precisionMonth && d.kind != kindTime {
+		d.month = 1
+	}
+	d.precision = p
+	return d
+}
+
+// time converts to a time.Time, using a default time zone if there isn't one
+func (d dateTime) time(defaultZone *time.Location) time.Time {
+	location := defaultZone
+	if d.hasZone {
+		location = time.FixedZone("", d.zone*60)
+	}
+	return time.Date(d.year, time.Month(d.month), d.day, d.hour, d.minute, d.second, d.nanos, location)
+}
+
+func (d dateTime) String() string {
+	var s strings.Builder
+	if d.kind != kindTime {
+		fmt.Fprintf(&s, "%04d", d.year)
+		if d.precision >= precisionMonth {
+			fmt.Fprintf(&s, "-%02d", d.month)
+		}
+		if d.precision >= precisionDay {
+			fmt.Fprintf(&s, "-%02d", d.day)
+		}
+		if d.kind == kindDate || d.precision < precisionHour {
+			return s.String()
+		}
+		s.WriteString("T")
+	}
+	fmt.Fprintf(&s, "%02d", d.hour)
+	if d.precision >= precisionMinute {
+		fmt.Fprintf(&s, ":%02d", d.minute)
+	}
+	if d.precision >= precisionSecond {
+		fmt.Fprintf(&s, ":%02d", d.second)
+	}
+	if d.precision >= precisionMillisecond {
+		fmt.Fprintf(&s, ".%03d", d.nanos/1000000)
+	}
+	if d.hasZone && d.kind == kindDateTime {
+		if d.zone == 0 {
+			s.WriteString("Z")
+		} else {
+			zone := d.zone
+			sign := "+"
+			if zone < 0 {
+				sign, zone = "-", -zone
+			}
+			fmt.Fprintf(&s, "%s%02d:%02d", sign, zone/60, zone%60)
+		}
+	}
+	return s.String()
+}
+
+// fields returns the fields of a date/time in order, with seconds and milliseconds as a single field
+func (d dateTime) fields() []int {
+	return []int{d.year, d.month, d.day, d.hour, d.minute, d.second*1000 + d.nanos/1000000}
+}
+
+func fieldPrecision(p precision) int {
+	if p == precisionMillisecond {
+		return int(precisionSecond)
+	}
+	return int(p)
+}
+
+// compareDateTimes compares two dates/times, returning false if they can't be compared or if
+// the result isn't known because they have different precisions
+func compareDateTimes(a dateTime, b dateTime, defaultZone *time.Location) (int, bool) {
+	if (a.kind == kindTime) != (b.kind == kindTime) {
+		return 0, false
+	}
+	if a.kind != kindTime && a.precision >= precisionHour && b.precision >= precisionHour {
+		// compare in UTC
+		a = dateTimeFromTime(a.time(defaultZone).UTC(), a.kind, a.precision)
+		b = dateTimeFromTime(b.time(defaultZone).UTC(), b.kind, b.precision)
+	}
+	aFields, bFields := a.fields(), b.fields()
+	first := 0
+	if a.kind == kindTime {
+		first = int(precisionHour)
+	}
+	aPrecision, bPrecision := fieldPrecision(a.precision), fieldPrecision(b.precision)
+	for i := first; i <= aPrecision && i <= bPrecision; i++ {
+		if aFields[i] < bFields[i] {
+			return -1, true
+		} else if aFields[i] > bFields[i] {
+			return 1, true
+		}
+	}
+	if aPrecision != bPrecision {
+		return 0, false
+	}
+	return 0, true
+}
+
+// addDuration adds a number of calendar units to a date/time; months and years are added
+// without overflowing into the next month (e.g. @2019-01-31 + 1 month is @2019-02-28)
+func (d dateTime) addDuration(amount int64, unit string) (dateTime, error) {
+	unitPrecision, known := durationPrecisions[unit]
+	if !known {
+		return dateTime{}, errors.Errorf("can't add %s to a date/time", unit)
+	}
+	if d.kind == kindTime && unitPrecision < precisionHour {
+		return dateTime{}, errors.Errorf("can't add %s to a time", unit)
+	}
+
+	// convert the amount to the precision of the value
+	if unitPrecision > d.precision {
+		amount = amount * durationNanos[unit] / durationNanos[precisionUnits[d.precision]]
+		unitPrecision = d.precision
+		unit = precisionUnits[d.precision]
+	}
+
+	t := time.Date(d.year, time.Month(d.month), d.day, d.hour, d.minute, d.second, d.nanos, time.UTC)
+	switch unit {
+	case "year", "month":
+		months := int(amount)
+		if unit == "year" {
+			months *= 12
+		}
+		total := d.year*12 + (d.month - 1) + months
+		year, month := total/12, total%12+1
+		day := d.day
+		if day > daysIn(year, month) {
+			day = daysIn(year, month)
+		}
+		t = time.Date(year, time.Month(month), day, d.hour, d.minute, d.second, d.nanos, time.UTC)
+	case "week":
+		t = t.AddDate(0, 0, int(amount)*7)
+	case "day":
+		t = t.AddDate(0, 0, int(amount))
+	default:
+		t = t.Add(time.Duration(amount * durationNanos[unit]))
+	}
+
+	result := dateTimeFromTime(t, d.kind, d.precision)
+	result.zone, result.hasZone = d.zone, d.hasZone
+	if d.kind == kindTime {
+		result.year, result.month, result.day = 0, 0, 0
+	}
+	return result, nil
+}
+
+var durationPrecisions = map[string]precision{
+	"year": precisionYear, "month": precisionMonth, "week": precisionDay, "day": precisionDay,
+	"hour": precisionHour, "minute": precisionMinute, "second": precisionSecond, "millisecond": precisionMillisecond,
+}
+
+var precisionUnits = map[precision]string{
+	precisionYear: "year", precisionMonth: "month", precisionDay: "day", precisionHour: "hour",
+	precisionMinute: "minute", precisionSecond: "second", precisionMillisecond: "millisecond",
+}
+
+var durationNanos = map[string]int64{
+	"week":        7 * 24 * int64(time.Hour),
+	"day":         24 * int64(time.Hour),
+	"hour":        int64(time.Hour),
+	"minute":      int64(time.Minute),
+	"second":      int64(time.Second),
+	"millisecond": int64(time.Millisecond),
+	// only used when converting to days or coarser precisions
+	"year":  365 * 24 * int64(time.Hour),
+	"month": 30 * 24 * int64(time.Hour),
+}
+
+// quantity is a decimal with a UCUM unit or a calendar duration (e.g. year or day)
+type quantity struct {
+	value decimal
+	unit  string
+}
+
+const ucumSystem = "http://unitsofmeasure.org"
+
+func (q quantity) String() string {
+	if _, isCalendarDuration := durationPrecisions[q.unit]; isCalendarDuration {
+		return q.value.String() + " " + q.unit
+	}
+	return q.value.String() + " '" + q.unit + "'"
+}
+
+func (q quantity) toJSON() map[string]interface{} {
+	object := map[string]interface{}{"value": json.Number(q.value.String())}
+	if _, isCalendarDuration := durationPrecisions[q.unit]; isCalendarDuration {
+		object["unit"] = q.unit
+	} else {
+		object["unit"] = q.unit
+		object["system"] = ucumSystem
+		object["code"] = q.unit
+	}
+	return object
+}
+
+// calendar durations of a week or less are the same as their UCUM units
+var calendarUCUMUnits = map[string]string{
+	"week": "wk", "day": "d", "hour": "h", "minute": "min", "second": "s", "millisecond": "ms",
+}
+
+// UCUM units that quantities can be converted between, in terms of a base unit
+var ucumUnits = map[string]struct {
+	base   string
+	factor string
+}{
+	"wk": {"s", "604800"}, "d": {"s", "86400"}, "h": {"s", "3600"}, "min": {"s", "60"}, "s": {"s", "1"}, "ms": {"s", "0.001"},
+	"kg": {"g", "1000"}, "g": {"g", "1"}, "mg": {"g", "0.001"}, "ug": {"g", "0.000001"}, "ng": {"g", "0.000000001"}, "[lb_av]": {"g", "453.59237"},
+	"km": {"m", "1000"}, "m": {"m", "1"}, "cm": {"m", "0.01"}, "mm": {"m", "0.001"}, "um": {"m", "0.000001"},
+	"L": {"L", "1"}, "dL": {"L", "0.1"}, "mL": {"L", "0.001"}, "uL": {"L", "0.000001"},
+}
+
+// inBaseUnit converts a quantity to a base unit so that it can be compared with others
+func (q quantity) inBaseUnit() quantity {
+	unit := q.unit
+	if ucum, found := calendarUCUMUnits[unit]; found {
+		unit = ucum
+	}
+	if ucum, found := ucumUnits[unit]; found {
+		factor, _ := new(big.Rat).SetString(ucum.factor)
+		return quantity{value: decimal{value: new(big.Rat).Mul(q.value.value, factor), scale: q.value.scale}, unit: ucum.base}
+	}
+	return quantity{value: q.value, unit: unit}
+}
+
+// compareQuantities compares two quantities, returning false if their units can't be compared
+func compareQuantities(a quantity, b quantity) (int, bool) {
+	a, b = a.inBaseUnit(), b.inBaseUnit()
+	if a.unit != b.unit {
+		return 0, false
+	}
+	return a.value.value.Cmp(b.value.value), true
+}
+
+// parseQuantity parses a quantity written as e.g. 4 days or 10.5 'mg'
+var quantityPattern = regexp.MustCompile(`^([+-]?[0-9]+(\.[0-9]+)?)\s*('[^']+'|[a-z]+)?$`)
+
+func parseQuantity(text string) (quantity, bool) {
+	match := quantityPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return quantity{}, false
+	}
+	value, _ := parseDecimal(match[1])
+	unit := match[3]
+	switch {
+	case unit == "":
+		unit = "1"
+	case strings.HasPrefix(unit, "'"):
+		unit = unit[1 : len(unit)-1]
+	default:
+		if unit = calendarDurations[unit]; unit == "" {
+			return quantity{}, false
+		}
+	}
+	return quantity{value: value, unit: unit}, true
+}
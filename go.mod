@@ -12,12 +12,9 @@ require (
 	github.com/buger/jsonparser v0.0.0-20180318095312-2cac668e8456
 	github.com/campoy/embedmd v0.0.0-20181127031020-97c13d6e4160 // indirect
 	github.com/corpix/uarand v0.0.0-20170903190822-2b8494104d86 // indirect
-	github.com/dlclark/regexp2 v1.1.6 // indirect
-	github.com/dop251/goja v0.0.0-20180304123926-9183045acc25
 	github.com/garyburd/redigo v1.6.0 // indirect
 	github.com/gin-gonic/contrib v0.0.0-20180614032058-39cfb9727134
 	github.com/gin-gonic/gin v0.0.0-20181126150151-b97ccf3a43d2
-	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/google/uuid v1.1.0
 	github.com/gorilla/sessions v1.1.1 // indirect
@@ -28,6 +25,7 @@ require (
 	github.com/juju/loggo v0.0.0-20190526231331-6e530bcce5d8 // indirect
 	github.com/juju/testing v0.0.0-20190613124551-e81189438503 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/lib/pq v1.2.0
 	github.com/mattn/go-isatty v0.0.8 // indirect
 	github.com/mitre/heart v0.0.0-20160825192324-0c46b433a490
 	github.com/opencensus-integrations/gomongowrapper v0.0.0-00010101000000-000000000000
@@ -41,7 +39,7 @@ require (
 	go.opencensus.io v0.22.0
 	golang.org/x/crypto v0.0.0-20190621222207-cc06ce4a13d4 // indirect
 	golang.org/x/lint v0.0.0-20190409202823-959b441ac422 // indirect
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/sys v0.0.0-20190626221950-04f50cda93cb
 	golang.org/x/tools v0.0.0-20190628021728-85b1a4bcd4e6 // indirect
@@ -50,7 +48,7 @@ require (
 	google.golang.org/grpc v1.21.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
-	gopkg.in/square/go-jose.v1 v1.1.1 // indirect
+	gopkg.in/square/go-jose.v1 v1.1.1
 	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637 // indirect
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
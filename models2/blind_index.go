@@ -0,0 +1,176 @@
+package models2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Blind indexes are keyed hashes (HMAC-SHA256) of the normalised identifiers and names in the encrypted
+// part of a document. They are stored next to the ciphertext so that exact searches can find encrypted
+// resources without the values being stored in the clear.
+
+// BlindIdentifierField holds the blind indexes of a document's encrypted identifiers
+const BlindIdentifierField = "__gofhirBlindIdentifier"
+
+// BlindNameField holds the blind indexes of the parts of a document's encrypted names
+const BlindNameField = "__gofhirBlindName"
+
+// IsEncryptionField returns whether a field of a stored document was added by encryption
+func IsEncryptionField(key string) bool {
+	switch key {
+	case "__gofhirEncryptedBSON", "__gofhirEncryptionKeyId", BlindIdentifierField, BlindNameField:
+		return true
+	}
+	return false
+}
+
+// blindIndexKey derives the key of the blind indexes of data encrypted with an encryption key
+func blindIndexKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gofhir blind index"))
+	return mac.Sum(nil)
+}
+
+// normaliseBlindValue makes blind indexes case-insensitive and ignore extra whitespace
+func normaliseBlindValue(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// blindIndex hashes normalised values, tagged with what they are (e.g. a family name)
+func blindIndex(key []byte, tag string, values ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tag))
+	for _, value := range values {
+		mac.Write([]byte{0})
+		mac.Write([]byte(normaliseBlindValue(value)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// blindIndexes hashes values under each of the keys of the current keyring so that resources are found
+// whether or not they have been rekeyed. Returns nil if there is no keyring.
+func blindIndexes(tag string, values ...string) []string {
+	keyring, err := CurrentKeyring()
+	if err != nil {
+		return nil
+	}
+	indexes := make([]string, 0, len(keyring.blindKeys))
+	for _, key := range keyring.blindKeys {
+		indexes = append(indexes, blindIndex(key, tag, values...))
+	}
+	sort.Strings(indexes)
+	return indexes
+}
+
+// IdentifierBlindIndexes returns the possible blind indexes of an identifier with the given system and value,
+// or of one with the given value and any system if anySystem is set. Returns nil if there is no keyring.
+func IdentifierBlindIndexes(system string, value string, anySystem bool) []string {
+	if anySystem {
+		return blindIndexes("value", value)
+	}
+	return blindIndexes("system", system, value)
+}
+
+// NameBlindIndexes returns the possible blind indexes of a name part: "family", "given" or "text"
+// (of a HumanName or of a name that is a string). Returns nil if there is no keyring.
+func NameBlindIndexes(part string, value string) []string {
+	return blindIndexes(part, value)
+}
+
+// blindIndexFields returns the blind index fields of the plaintext of an encrypted document
+func blindIndexFields(key []byte, plaintext []bson.E) []bson.E {
+	var identifierIndexes, nameIndexes []string
+	add := func(indexes []string, index string) []string {
+		for _, existing := range indexes {
+			if existing == index {
+				return indexes
+			}
+		}
+		return append(indexes, index)
+	}
+
+	for _, elem := range plaintext {
+		switch elem.Key {
+		case "identifier":
+			for _, identifier := range bsonArray(elem.Value) {
+				fields := bsonFields(identifier)
+				value, _ := fields["value"].(string)
+				if value == "" {
+					continue
+				}
+				system, _ := fields["system"].(string)
+				identifierIndexes = add(identifierIndexes, blindIndex(key, "system", system, value))
+				identifierIndexes = add(identifierIndexes, blindIndex(key, "value", value))
+			}
+
+		case "name":
+			names := bsonArray(elem.Value)
+			if names == nil {
+				names = []interface{}{elem.Value}
+			}
+			for _, name := range names {
+				if text, isString := name.(string); isString {
+					nameIndexes = add(nameIndexes, blindIndex(key, "text", text))
+					continue
+				}
+				fields := bsonFields(name)
+				if family, ok := fields["family"].(string); ok {
+					nameIndexes = add(nameIndexes, blindIndex(key, "family", family))
+				}
+				for _, given := range bsonArray(fields["given"]) {
+					if given, ok := given.(string); ok {
+						nameIndexes = add(nameIndexes, blindIndex(key, "given", given))
+					}
+				}
+				if text, ok := fields["text"].(string); ok {
+					nameIndexes = add(nameIndexes, blindIndex(key, "text", text))
+				}
+			}
+		}
+	}
+
+	var fields []bson.E
+	if len(identifierIndexes) > 0 {
+		fields = append(fields, bson.E{Key: BlindIdentifierField, Value: identifierIndexes})
+	}
+	if len(nameIndexes) > 0 {
+		fields = append(fields, bson.E{Key: BlindNameField, Value: nameIndexes})
+	}
+	return fields
+}
+
+// bsonArray returns the items of an array in a BSON document, which depending on where it
+// came from can be a bson.A or a slice of another type
+func bsonArray(value interface{}) []interface{} {
+	rvalue := reflect.ValueOf(value)
+	if rvalue.Kind() != reflect.Slice || rvalue.Type() == reflect.TypeOf(bson.D{}) || rvalue.Type() == reflect.TypeOf([]bson.E{}) {
+		return nil
+	}
+	items := make([]interface{}, rvalue.Len())
+	for i := range items {
+		items[i] = rvalue.Index(i).Interface()
+	}
+	return items
+}
+
+// bsonFields returns the fields of an embedded BSON document by name
+func bsonFields(value interface{}) map[string]interface{} {
+	var elems []bson.E
+	switch doc := value.(type) {
+	case []bson.E:
+		elems = doc
+	case bson.D:
+		elems = doc
+	}
+	fields := make(map[string]interface{}, len(elems))
+	for _, elem := range elems {
+		fields[elem.Key] = elem.Value
+	}
+	return fields
+}
@@ -2,10 +2,12 @@ package models2
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,7 +33,7 @@ func TestConversion(t *testing.T) {
 
 			if encrypt {
 				for _, field := range bson {
-					if shouldEncrypt, _ := shouldEncryptField(field.Key); shouldEncrypt && field.Key != "identifier" {
+					if PatientDetailsEncryptionPolicy.encryptsElement("Patient", field.Key) {
 						assert.Failf(t, "field should have been encrypted", "field: %s", field.Key)
 					}
 				}
@@ -81,7 +83,7 @@ func TestConversionComplexExtension(t *testing.T) {
 
 			if encrypt {
 				for _, field := range bson {
-					if shouldEncrypt, _ := shouldEncryptField(field.Key); shouldEncrypt && field.Key != "identifier" {
+					if PatientDetailsEncryptionPolicy.encryptsElement("Patient", field.Key) {
 						assert.Failf(t, "field should have been encrypted", "field: %s", field.Key)
 					}
 				}
@@ -130,7 +132,7 @@ func TestEncryptionOfMedicareIdentifier(t *testing.T) {
 			assert.Nil(t, err)
 
 			for _, field := range bsonDoc {
-				if shouldEncrypt, _ := shouldEncryptField(field.Key); shouldEncrypt && field.Key != "identifier" {
+				if PatientDetailsEncryptionPolicy.encryptsElement("Patient", field.Key) {
 					assert.Failf(t, "field should have been encrypted", "field: %s", field.Key)
 				}
 			}
@@ -165,6 +167,203 @@ func TestEncryptionOfMedicareIdentifier(t *testing.T) {
 	}
 }
 
+func TestEncryptionPolicy(t *testing.T) {
+
+	os.Setenv("GOFHIR_ENCRYPTION_KEY_ID", "testKey1")
+	os.Setenv("GOFHIR_ENCRYPTION_KEY_BASE64", "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=")
+
+	policy := &EncryptionPolicy{
+		Paths:             []string{"Observation.value[x]", "Observation.comment"},
+		IdentifierSystems: map[string][]string{"Observation": {"http://example.com/secret"}},
+	}
+	assert.Nil(t, policy.Validate())
+
+	jsonBytes := []byte(`{
+		"resourceType": "Observation",
+		"id": "o1",
+		"identifier": [
+			{ "system": "http://example.com/public", "value": "123" },
+			{ "system": "http://example.com/secret", "value": "987" }
+		],
+		"status": "final",
+		"code": { "text": "diagnosis" },
+		"valueString": "confidential",
+		"comment": "also confidential"
+	}`)
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{Policy: policy}, map[string]string{})
+	assert.Nil(t, err)
+
+	bsonBytes, err := bson.Marshal(&bsonDoc)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(bsonBytes, []byte("123")))
+	assert.True(t, bytes.Contains(bsonBytes, []byte("diagnosis")))
+	assert.False(t, bytes.Contains(bsonBytes, []byte("987")))
+	assert.False(t, bytes.Contains(bsonBytes, []byte("confidential")))
+
+	backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson), "should get back original json")
+
+	// other types of resources aren't encrypted
+	jsonBytes = []byte(`{ "resourceType": "Basic", "id": "b1", "code": { "text": "confidential" } }`)
+	bsonDoc, err = ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{Policy: policy}, map[string]string{})
+	assert.Nil(t, err)
+	bsonBytes, err = bson.Marshal(&bsonDoc)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(bsonBytes, []byte("confidential")))
+	assert.False(t, bytes.Contains(bsonBytes, []byte("__gofhirEncryptedBSON")))
+}
+
+func TestEncryptionPolicyValidate(t *testing.T) {
+	assert.Nil(t, PatientDetailsEncryptionPolicy.Validate())
+	assert.Nil(t, (&EncryptionPolicy{Paths: []string{"RelatedPerson.name", "Observation.valueString", "Patient.deceased[x]"}}).Validate())
+
+	for _, path := range []string{"Patient", "Patient.name.family", "Patient.foo", "Patient.id", "Foo.name", "Patient.name[x]"} {
+		err := (&EncryptionPolicy{Paths: []string{path}}).Validate()
+		assert.NotNil(t, err, path)
+	}
+	err := (&EncryptionPolicy{IdentifierSystems: map[string][]string{"Foo": {"http://example.com"}}}).Validate()
+	assert.NotNil(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer SetKeyring(nil)
+
+	key1, _ := base64.StdEncoding.DecodeString("9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=")
+	key2, _ := base64.StdEncoding.DecodeString("SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E=")
+	keyring1, err := NewKeyring(map[string][]byte{"key1": key1}, "key1")
+	assert.Nil(t, err)
+	SetKeyring(keyring1)
+
+	jsonBytes := []byte(`{ "resourceType": "Patient", "id": "p1", "name": [{ "family": "Smith" }], "birthDate": "1980-01-02" }`)
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{PatientDetails: true}, map[string]string{})
+	assert.Nil(t, err)
+	_, keyId, err := encryptedFields(bsonDoc)
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", keyId)
+
+	// the current key is only used for new data
+	keyring2, err := NewKeyring(map[string][]byte{"key1": key1, "key2": key2}, "key2")
+	assert.Nil(t, err)
+	SetKeyring(keyring2)
+	backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+
+	rekeyed, err := RekeyBSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.True(t, rekeyed)
+	_, keyId, err = encryptedFields(bsonDoc)
+	assert.Nil(t, err)
+	assert.Equal(t, "key2", keyId)
+	rekeyed, err = RekeyBSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.False(t, rekeyed)
+
+	// the old key is no longer needed
+	keyring3, err := NewKeyring(map[string][]byte{"key2": key2}, "key2")
+	assert.Nil(t, err)
+	SetKeyring(keyring3)
+	backToJson, _, err = ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+
+	// but is needed to decrypt data that wasn't rekeyed
+	SetKeyring(keyring1)
+	_, _, err = ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.NotNil(t, err)
+
+	_, err = NewKeyring(map[string][]byte{"key1": key1}, "key2")
+	assert.NotNil(t, err)
+	_, err = NewKeyring(map[string][]byte{"key1": key1[:16]}, "key1")
+	assert.NotNil(t, err)
+}
+
+func TestBlindIndexes(t *testing.T) {
+	defer SetKeyring(nil)
+
+	key1, _ := base64.StdEncoding.DecodeString("9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=")
+	key2, _ := base64.StdEncoding.DecodeString("SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E=")
+	keyring1, err := NewKeyring(map[string][]byte{"key1": key1}, "key1")
+	assert.Nil(t, err)
+	SetKeyring(keyring1)
+
+	jsonBytes := []byte(`{
+		"resourceType": "Patient",
+		"id": "p1",
+		"identifier": [{ "system": "http://ns.electronichealth.net.au/id/hi/mc", "value": "2123456701" }],
+		"name": [{ "family": "Smith", "given": ["Mary  Jane"] }]
+	}`)
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{PatientDetails: true}, map[string]string{})
+	assert.Nil(t, err)
+	blindIndexes := func() (identifiers []string, names []string) {
+		for _, elem := range bsonDoc {
+			switch elem.Key {
+			case BlindIdentifierField:
+				identifiers = elem.Value.([]string)
+			case BlindNameField:
+				names = elem.Value.([]string)
+			}
+		}
+		return
+	}
+
+	// searches are normalised
+	identifiers, names := blindIndexes()
+	assert.Subset(t, identifiers, IdentifierBlindIndexes("http://ns.electronichealth.net.au/id/hi/mc", "2123456701", false))
+	assert.Subset(t, identifiers, IdentifierBlindIndexes("", "2123456701", true))
+	assert.NotContains(t, identifiers, IdentifierBlindIndexes("", "2123456701", false)[0])
+	assert.Subset(t, names, NameBlindIndexes("family", "SMITH"))
+	assert.Subset(t, names, NameBlindIndexes("given", "mary jane"))
+	assert.NotContains(t, names, NameBlindIndexes("given", "Smith")[0])
+
+	// blind indexes aren't returned
+	backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+
+	// rekeyed documents can be found with either key in the keyring
+	keyring2, err := NewKeyring(map[string][]byte{"key1": key1, "key2": key2}, "key2")
+	assert.Nil(t, err)
+	SetKeyring(keyring2)
+	assert.Len(t, NameBlindIndexes("family", "Smith"), 2)
+	rekeyed, err := RekeyBSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.True(t, rekeyed)
+	_, rekeyedNames := blindIndexes()
+	assert.NotEqual(t, names, rekeyedNames)
+	keyring3, err := NewKeyring(map[string][]byte{"key2": key2}, "key2")
+	assert.Nil(t, err)
+	SetKeyring(keyring3)
+	assert.Subset(t, rekeyedNames, NameBlindIndexes("family", "Smith"))
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"current": "key2",
+		"keys": {
+			"key1": "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=",
+			"key2": "SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E="
+		}
+	}`), 0600)
+	assert.Nil(t, err)
+	keyring, err := LoadKeyring(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "key2", keyring.CurrentKeyId())
+	_, err = keyring.cipher("key1")
+	assert.Nil(t, err)
+
+	err = ioutil.WriteFile(path, []byte(`{ "current": "key1", "keys": { "key1": "not base64" } }`), 0600)
+	assert.Nil(t, err)
+	_, err = LoadKeyring(path)
+	assert.NotNil(t, err)
+}
+
 func printBSON(bsonDoc *bson.D) {
 	bsonBytes, err := bson.Marshal(bsonDoc)
 	if err != nil {
@@ -0,0 +1,1841 @@
+package models2
+
+// The minimum cardinalities, isSummary flags and required bindings of the STU3 elements, which fhirTypes
+// doesn't have. They're transcribed from the STU3 specification as its profiles-resources.json and
+// valuesets.json aren't distributed with this repository (those of the data types and of the resources
+// profiled in profiles-others.json come from the bundles in fsharp-fhir-tools/PathsByType/STU3).
+
+type elementDefinition struct {
+	min      int
+	summary  bool
+	valueSet string
+}
+
+// elementDefinitions has the elements with a minimum cardinality of 1, the top-level elements of resources
+// that are flagged isSummary and the code elements with required bindings to the value sets in valueSetCodes.
+// Every choice element is listed (by its path ending in [x]) so that ChildElements can tell its types apart
+// from other elements. The elements of Resource apply to all resources.
+var elementDefinitions = map[string]elementDefinition{
+	"Account.active":                                            {summary: true},
+	"Account.balance":                                           {summary: true},
+	"Account.coverage":                                          {summary: true},
+	"Account.coverage.coverage":                                 {min: 1},
+	"Account.description":                                       {summary: true},
+	"Account.guarantor.party":                                   {min: 1},
+	"Account.identifier":                                        {summary: true},
+	"Account.name":                                              {summary: true},
+	"Account.owner":                                             {summary: true},
+	"Account.period":                                            {summary: true},
+	"Account.status":                                            {summary: true, valueSet: "account-status"},
+	"Account.subject":                                           {summary: true},
+	"Account.type":                                              {summary: true},
+	"ActivityDefinition.code":                                   {summary: true},
+	"ActivityDefinition.date":                                   {summary: true},
+	"ActivityDefinition.effectivePeriod":                        {summary: true},
+	"ActivityDefinition.experimental":                           {summary: true},
+	"ActivityDefinition.identifier":                             {summary: true},
+	"ActivityDefinition.jurisdiction":                           {summary: true},
+	"ActivityDefinition.kind":                                   {summary: true, valueSet: "resource-types"},
+	"ActivityDefinition.name":                                   {summary: true},
+	"ActivityDefinition.participant.type":                       {min: 1, valueSet: "action-participant-type"},
+	"ActivityDefinition.product[x]":                             {},
+	"ActivityDefinition.publisher":                              {summary: true},
+	"ActivityDefinition.status":                                 {min: 1, summary: true, valueSet: "publication-status"},
+	"ActivityDefinition.timing[x]":                              {},
+	"ActivityDefinition.title":                                  {summary: true},
+	"ActivityDefinition.url":                                    {summary: true},
+	"ActivityDefinition.useContext":                             {summary: true},
+	"ActivityDefinition.version":                                {summary: true},
+	"Address.type":                                              {valueSet: "address-type"},
+	"Address.use":                                               {valueSet: "address-use"},
+	"AdverseEvent.category":                                     {summary: true, valueSet: "adverse-event-category"},
+	"AdverseEvent.date":                                         {summary: true},
+	"AdverseEvent.description":                                  {summary: true},
+	"AdverseEvent.eventParticipant":                             {summary: true},
+	"AdverseEvent.identifier":                                   {summary: true},
+	"AdverseEvent.location":                                     {summary: true},
+	"AdverseEvent.outcome":                                      {summary: true},
+	"AdverseEvent.reaction":                                     {summary: true},
+	"AdverseEvent.recorder":                                     {summary: true},
+	"AdverseEvent.referenceDocument":                            {summary: true},
+	"AdverseEvent.seriousness":                                  {summary: true},
+	"AdverseEvent.study":                                        {summary: true},
+	"AdverseEvent.subject":                                      {summary: true},
+	"AdverseEvent.subjectMedicalHistory":                        {summary: true},
+	"AdverseEvent.suspectEntity":                                {summary: true},
+	"AdverseEvent.suspectEntity.causality":                      {valueSet: "adverse-event-causality"},
+	"AdverseEvent.suspectEntity.instance":                       {min: 1},
+	"AdverseEvent.type":                                         {summary: true},
+	"Age.comparator":                                            {valueSet: "quantity-comparator"},
+	"AllergyIntolerance.asserter":                               {summary: true},
+	"AllergyIntolerance.category":                               {summary: true, valueSet: "allergy-intolerance-category"},
+	"AllergyIntolerance.clinicalStatus":                         {summary: true, valueSet: "allergy-clinical-status"},
+	"AllergyIntolerance.code":                                   {summary: true},
+	"AllergyIntolerance.criticality":                            {summary: true, valueSet: "allergy-intolerance-criticality"},
+	"AllergyIntolerance.identifier":                             {summary: true},
+	"AllergyIntolerance.onset[x]":                               {},
+	"AllergyIntolerance.patient":                                {min: 1, summary: true},
+	"AllergyIntolerance.reaction.manifestation":                 {min: 1},
+	"AllergyIntolerance.reaction.severity":                      {valueSet: "reaction-event-severity"},
+	"AllergyIntolerance.type":                                   {summary: true, valueSet: "allergy-intolerance-type"},
+	"AllergyIntolerance.verificationStatus":                     {min: 1, summary: true, valueSet: "allergy-verification-status"},
+	"Annotation.author[x]":                                      {},
+	"Annotation.text":                                           {min: 1},
+	"Appointment.appointmentType":                               {summary: true},
+	"Appointment.end":                                           {summary: true},
+	"Appointment.identifier":                                    {summary: true},
+	"Appointment.participant":                                   {min: 1},
+	"Appointment.participant.required":                          {valueSet: "participantrequired"},
+	"Appointment.participant.status":                            {min: 1, valueSet: "participationstatus"},
+	"Appointment.reason":                                        {summary: true},
+	"Appointment.serviceCategory":                               {summary: true},
+	"Appointment.serviceType":                                   {summary: true},
+	"Appointment.specialty":                                     {summary: true},
+	"Appointment.start":                                         {summary: true},
+	"Appointment.status":                                        {min: 1, summary: true, valueSet: "appointmentstatus"},
+	"AppointmentResponse.actor":                                 {summary: true},
+	"AppointmentResponse.appointment":                           {min: 1, summary: true},
+	"AppointmentResponse.identifier":                            {summary: true},
+	"AppointmentResponse.participantStatus":                     {min: 1, summary: true, valueSet: "participantstatus"},
+	"AppointmentResponse.participantType":                       {summary: true},
+	"AuditEvent.action":                                         {summary: true, valueSet: "audit-event-action"},
+	"AuditEvent.agent":                                          {min: 1},
+	"AuditEvent.agent.network.type":                             {valueSet: "network-type"},
+	"AuditEvent.agent.requestor":                                {min: 1},
+	"AuditEvent.entity.detail.type":                             {min: 1},
+	"AuditEvent.entity.detail.value":                            {min: 1},
+	"AuditEvent.outcome":                                        {summary: true, valueSet: "audit-event-outcome"},
+	"AuditEvent.outcomeDesc":                                    {summary: true},
+	"AuditEvent.purposeOfEvent":                                 {summary: true},
+	"AuditEvent.recorded":                                       {min: 1, summary: true},
+	"AuditEvent.source":                                         {min: 1},
+	"AuditEvent.source.identifier":                              {min: 1},
+	"AuditEvent.subtype":                                        {summary: true},
+	"AuditEvent.type":                                           {min: 1, summary: true},
+	"Basic.author":                                              {summary: true},
+	"Basic.code":                                                {min: 1, summary: true},
+	"Basic.created":                                             {summary: true},
+	"Basic.identifier":                                          {summary: true},
+	"Basic.subject":                                             {summary: true},
+	"Binary.content":                                            {min: 1},
+	"Binary.contentType":                                        {min: 1, summary: true},
+	"Binary.securityContext":                                    {summary: true},
+	"BodySite.active":                                           {summary: true},
+	"BodySite.code":                                             {summary: true},
+	"BodySite.identifier":                                       {summary: true},
+	"BodySite.patient":                                          {min: 1, summary: true},
+	"Bundle.entry":                                              {summary: true},
+	"Bundle.entry.request.method":                               {min: 1, valueSet: "http-verb"},
+	"Bundle.entry.request.url":                                  {min: 1},
+	"Bundle.entry.response.status":                              {min: 1},
+	"Bundle.entry.search.mode":                                  {valueSet: "search-entry-mode"},
+	"Bundle.identifier":                                         {summary: true},
+	"Bundle.link":                                               {summary: true},
+	"Bundle.link.relation":                                      {min: 1},
+	"Bundle.link.url":                                           {min: 1},
+	"Bundle.signature":                                          {summary: true},
+	"Bundle.total":                                              {summary: true},
+	"Bundle.type":                                               {min: 1, summary: true, valueSet: "bundle-type"},
+	"CapabilityStatement.acceptUnknown":                         {min: 1, summary: true, valueSet: "unknown-content-code"},
+	"CapabilityStatement.contact":                               {summary: true},
+	"CapabilityStatement.date":                                  {min: 1, summary: true},
+	"CapabilityStatement.document":                              {summary: true},
+	"CapabilityStatement.document.mode":                         {min: 1, valueSet: "document-mode"},
+	"CapabilityStatement.document.profile":                      {min: 1},
+	"CapabilityStatement.experimental":                          {summary: true},
+	"CapabilityStatement.fhirVersion":                           {min: 1, summary: true},
+	"CapabilityStatement.format":                                {min: 1, summary: true},
+	"CapabilityStatement.implementation":                        {summary: true},
+	"CapabilityStatement.implementation.description":            {min: 1},
+	"CapabilityStatement.implementationGuide":                   {summary: true},
+	"CapabilityStatement.instantiates":                          {summary: true},
+	"CapabilityStatement.jurisdiction":                          {summary: true},
+	"CapabilityStatement.kind":                                  {min: 1, summary: true, valueSet: "capability-statement-kind"},
+	"CapabilityStatement.messaging":                             {summary: true},
+	"CapabilityStatement.messaging.endpoint.address":            {min: 1},
+	"CapabilityStatement.messaging.endpoint.protocol":           {min: 1},
+	"CapabilityStatement.messaging.event.category":              {valueSet: "message-significance-category"},
+	"CapabilityStatement.messaging.event.code":                  {min: 1},
+	"CapabilityStatement.messaging.event.focus":                 {min: 1, valueSet: "resource-types"},
+	"CapabilityStatement.messaging.event.mode":                  {min: 1, valueSet: "event-capability-mode"},
+	"CapabilityStatement.messaging.event.request":               {min: 1},
+	"CapabilityStatement.messaging.event.response":              {min: 1},
+	"CapabilityStatement.messaging.supportedMessage.definition": {min: 1},
+	"CapabilityStatement.messaging.supportedMessage.mode":       {min: 1, valueSet: "event-capability-mode"},
+	"CapabilityStatement.name":                                  {summary: true},
+	"CapabilityStatement.patchFormat":                           {summary: true},
+	"CapabilityStatement.profile":                               {summary: true},
+	"CapabilityStatement.publisher":                             {summary: true},
+	"CapabilityStatement.rest":                                  {summary: true},
+	"CapabilityStatement.rest.interaction.code":                 {min: 1, valueSet: "system-restful-interaction"},
+	"CapabilityStatement.rest.mode":                             {min: 1, valueSet: "restful-capability-mode"},
+	"CapabilityStatement.rest.operation.definition":             {min: 1},
+	"CapabilityStatement.rest.operation.name":                   {min: 1},
+	"CapabilityStatement.rest.resource.conditionalDelete":       {valueSet: "conditional-delete-status"},
+	"CapabilityStatement.rest.resource.conditionalRead":         {valueSet: "conditional-read-status"},
+	"CapabilityStatement.rest.resource.interaction":             {min: 1},
+	"CapabilityStatement.rest.resource.interaction.code":        {min: 1, valueSet: "type-restful-interaction"},
+	"CapabilityStatement.rest.resource.referencePolicy":         {valueSet: "reference-handling-policy"},
+	"CapabilityStatement.rest.resource.searchParam.name":        {min: 1},
+	"CapabilityStatement.rest.resource.searchParam.type":        {min: 1, valueSet: "search-param-type"},
+	"CapabilityStatement.rest.resource.type":                    {min: 1, valueSet: "resource-types"},
+	"CapabilityStatement.rest.resource.versioning":              {valueSet: "versioning-policy"},
+	"CapabilityStatement.software":                              {summary: true},
+	"CapabilityStatement.software.name":                         {min: 1},
+	"CapabilityStatement.status":                                {min: 1, summary: true, valueSet: "publication-status"},
+	"CapabilityStatement.title":                                 {summary: true},
+	"CapabilityStatement.url":                                   {summary: true},
+	"CapabilityStatement.useContext":                            {summary: true},
+	"CapabilityStatement.version":                               {summary: true},
+	"CarePlan.activity.detail.product[x]":                       {},
+	"CarePlan.activity.detail.scheduled[x]":                     {},
+	"CarePlan.activity.detail.status":                           {min: 1, valueSet: "care-plan-activity-status"},
+	"CarePlan.activity.outcome[x]":                              {},
+	"CarePlan.addresses":                                        {summary: true},
+	"CarePlan.author":                                           {summary: true},
+	"CarePlan.basedOn":                                          {summary: true},
+	"CarePlan.category":                                         {summary: true},
+	"CarePlan.context":                                          {summary: true},
+	"CarePlan.definition":                                       {summary: true},
+	"CarePlan.description":                                      {summary: true},
+	"CarePlan.identifier":                                       {summary: true},
+	"CarePlan.intent":                                           {min: 1, summary: true, valueSet: "care-plan-intent"},
+	"CarePlan.partOf":                                           {summary: true},
+	"CarePlan.period":                                           {summary: true},
+	"CarePlan.replaces":                                         {summary: true},
+	"CarePlan.status":                                           {min: 1, summary: true, valueSet: "care-plan-status"},
+	"CarePlan.subject":                                          {min: 1, summary: true},
+	"CarePlan.title":                                            {summary: true},
+	"CareTeam.category":                                         {summary: true},
+	"CareTeam.context":                                          {summary: true},
+	"CareTeam.identifier":                                       {summary: true},
+	"CareTeam.name":                                             {summary: true},
+	"CareTeam.period":                                           {summary: true},
+	"CareTeam.status":                                           {summary: true, valueSet: "care-team-status"},
+	"CareTeam.subject":                                          {summary: true},
+	"ChargeItem.account":                                        {summary: true},
+	"ChargeItem.bodysite":                                       {summary: true},
+	"ChargeItem.code":                                           {min: 1, summary: true},
+	"ChargeItem.context":                                        {summary: true},
+	"ChargeItem.definition":                                     {summary: true},
+	"ChargeItem.enteredDate":                                    {summary: true},
+	"ChargeItem.enterer":                                        {summary: true},
+	"ChargeItem.identifier":                                     {summary: true},
+	"ChargeItem.occurrence[x]":                                  {summary: true},
+	"ChargeItem.participant.actor":                              {min: 1},
+	"ChargeItem.quantity":                                       {summary: true},
+	"ChargeItem.status":                                         {min: 1, summary: true, valueSet: "chargeitem-status"},
+	"ChargeItem.subject":                                        {min: 1, summary: true},
+	"Claim.accident.date":                                       {min: 1},
+	"Claim.accident.location[x]":                                {},
+	"Claim.careTeam.provider":                                   {min: 1},
+	"Claim.careTeam.sequence":                                   {min: 1},
+	"Claim.diagnosis.diagnosis[x]":                              {min: 1},
+	"Claim.diagnosis.sequence":                                  {min: 1},
+	"Claim.information.category":                                {min: 1},
+	"Claim.information.sequence":                                {min: 1},
+	"Claim.information.timing[x]":                               {},
+	"Claim.information.value[x]":                                {},
+	"Claim.insurance.coverage":                                  {min: 1},
+	"Claim.insurance.focal":                                     {min: 1},
+	"Claim.insurance.sequence":                                  {min: 1},
+	"Claim.item.detail.sequence":                                {min: 1},
+	"Claim.item.detail.subDetail.sequence":                      {min: 1},
+	"Claim.item.location[x]":                                    {},
+	"Claim.item.sequence":                                       {min: 1},
+	"Claim.item.serviced[x]":                                    {},
+	"Claim.payee.type":                                          {min: 1},
+	"Claim.procedure.procedure[x]":                              {min: 1},
+	"Claim.procedure.sequence":                                  {min: 1},
+	"Claim.status":                                              {summary: true, valueSet: "fm-status"},
+	"Claim.use":                                                 {valueSet: "claim-use"},
+	"ClaimResponse.error.code":                                  {min: 1},
+	"ClaimResponse.insurance.coverage":                          {min: 1},
+	"ClaimResponse.insurance.focal":                             {min: 1},
+	"ClaimResponse.insurance.sequence":                          {min: 1},
+	"ClaimResponse.item.adjudication.category":                  {min: 1},
+	"ClaimResponse.item.detail.sequenceLinkId":                  {min: 1},
+	"ClaimResponse.item.detail.subDetail.sequenceLinkId":        {min: 1},
+	"ClaimResponse.item.sequenceLinkId":                         {min: 1},
+	"ClaimResponse.status":                                      {summary: true, valueSet: "fm-status"},
+	"ClinicalImpression.assessor":                               {summary: true},
+	"ClinicalImpression.code":                                   {summary: true},
+	"ClinicalImpression.context":                                {summary: true},
+	"ClinicalImpression.date":                                   {summary: true},
+	"ClinicalImpression.description":                            {summary: true},
+	"ClinicalImpression.effective[x]":                           {summary: true},
+	"ClinicalImpression.finding.item[x]":                        {min: 1},
+	"ClinicalImpression.identifier":                             {summary: true},
+	"ClinicalImpression.investigation.code":                     {min: 1},
+	"ClinicalImpression.problem":                                {summary: true},
+	"ClinicalImpression.prognosis[x]":                           {},
+	"ClinicalImpression.status":                                 {min: 1, summary: true, valueSet: "clinical-impression-status"},
+	"ClinicalImpression.subject":                                {min: 1, summary: true},
+	"CodeSystem.caseSensitive":                                  {summary: true},
+	"CodeSystem.compositional":                                  {summary: true},
+	"CodeSystem.concept.code":                                   {min: 1},
+	"CodeSystem.concept.designation.value":                      {min: 1},
+	"CodeSystem.concept.property.code":                          {min: 1},
+	"CodeSystem.concept.property.value[x]":                      {min: 1},
+	"CodeSystem.contact":                                        {summary: true},
+	"CodeSystem.content":                                        {min: 1, summary: true, valueSet: "codesystem-content-mode"},
+	"CodeSystem.count":                                          {summary: true},
+	"CodeSystem.date":                                           {summary: true},
+	"CodeSystem.experimental":                                   {summary: true},
+	"CodeSystem.filter":                                         {summary: true},
+	"CodeSystem.filter.code":                                    {min: 1},
+	"CodeSystem.filter.operator":                                {min: 1, valueSet: "filter-operator"},
+	"CodeSystem.filter.value":                                   {min: 1},
+	"CodeSystem.hierarchyMeaning":                               {summary: true, valueSet: "codesystem-hierarchy-meaning"},
+	"CodeSystem.identifier":                                     {summary: true},
+	"CodeSystem.jurisdiction":                                   {summary: true},
+	"CodeSystem.name":                                           {summary: true},
+	"CodeSystem.property":                                       {summary: true},
+	"CodeSystem.property.code":                                  {min: 1},
+	"CodeSystem.property.type":                                  {min: 1, valueSet: "concept-property-type"},
+	"CodeSystem.publisher":                                      {summary: true},
+	"CodeSystem.status":                                         {min: 1, summary: true, valueSet: "publication-status"},
+	"CodeSystem.title":                                          {summary: true},
+	"CodeSystem.url":                                            {summary: true},
+	"CodeSystem.useContext":                                     {summary: true},
+	"CodeSystem.valueSet":                                       {summary: true},
+	"CodeSystem.version":                                        {summary: true},
+	"CodeSystem.versionNeeded":                                  {summary: true},
+	"Communication.basedOn":                                     {summary: true},
+	"Communication.definition":                                  {summary: true},
+	"Communication.identifier":                                  {summary: true},
+	"Communication.notDone":                                     {summary: true},
+	"Communication.notDoneReason":                               {summary: true},
+	"Communication.partOf":                                      {summary: true},
+	"Communication.payload.content[x]":                          {min: 1},
+	"Communication.reasonCode":                                  {summary: true},
+	"Communication.reasonReference":                             {summary: true},
+	"Communication.status":                                      {min: 1, summary: true, valueSet: "event-status"},
+	"CommunicationRequest.authoredOn":                           {summary: true},
+	"CommunicationRequest.basedOn":                              {summary: true},
+	"CommunicationRequest.groupIdentifier":                      {summary: true},
+	"CommunicationRequest.identifier":                           {summary: true},
+	"CommunicationRequest.occurrence[x]":                        {summary: true},
+	"CommunicationRequest.payload.content[x]":                   {min: 1},
+	"CommunicationRequest.priority":                             {summary: true, valueSet: "request-priority"},
+	"CommunicationRequest.replaces":                             {summary: true},
+	"CommunicationRequest.requester":                            {summary: true},
+	"CommunicationRequest.requester.agent":                      {min: 1},
+	"CommunicationRequest.status":                               {min: 1, summary: true, valueSet: "request-status"},
+	"CompartmentDefinition.code":                                {min: 1, summary: true, valueSet: "compartment-type"},
+	"CompartmentDefinition.contact":                             {summary: true},
+	"CompartmentDefinition.date":                                {summary: true},
+	"CompartmentDefinition.experimental":                        {summary: true},
+	"CompartmentDefinition.jurisdiction":                        {summary: true},
+	"CompartmentDefinition.name":                                {min: 1, summary: true},
+	"CompartmentDefinition.publisher":                           {summary: true},
+	"CompartmentDefinition.resource":                            {summary: true},
+	"CompartmentDefinition.resource.code":                       {min: 1, valueSet: "resource-types"},
+	"CompartmentDefinition.search":                              {min: 1, summary: true},
+	"CompartmentDefinition.status":                              {min: 1, summary: true, valueSet: "publication-status"},
+	"CompartmentDefinition.title":                               {summary: true},
+	"CompartmentDefinition.url":                                 {min: 1, summary: true},
+	"CompartmentDefinition.useContext":                          {summary: true},
+	"Composition.attester":                                      {summary: true},
+	"Composition.attester.mode":                                 {min: 1, valueSet: "composition-attestation-mode"},
+	"Composition.author":                                        {min: 1, summary: true},
+	"Composition.class":                                         {summary: true},
+	"Composition.confidentiality":                               {summary: true, valueSet: "v3-ConfidentialityClassification"},
+	"Composition.custodian":                                     {summary: true},
+	"Composition.date":                                          {min: 1, summary: true},
+	"Composition.encounter":                                     {summary: true},
+	"Composition.event":                                         {summary: true},
+	"Composition.identifier":                                    {summary: true},
+	"Composition.relatesTo":                                     {summary: true},
+	"Composition.relatesTo.code":                                {min: 1, valueSet: "document-relationship-type"},
+	"Composition.relatesTo.target[x]":                           {min: 1},
+	"Composition.section.mode":                                  {valueSet: "list-mode"},
+	"Composition.status":                                        {min: 1, summary: true, valueSet: "composition-status"},
+	"Composition.subject":                                       {min: 1, summary: true},
+	"Composition.title":                                         {min: 1, summary: true},
+	"Composition.type":                                          {min: 1, summary: true},
+	"ConceptMap.contact":                                        {summary: true},
+	"ConceptMap.date":                                           {summary: true},
+	"ConceptMap.experimental":                                   {summary: true},
+	"ConceptMap.group.element":                                  {min: 1},
+	"ConceptMap.group.element.target.dependsOn.code":            {min: 1},
+	"ConceptMap.group.element.target.dependsOn.property":        {min: 1},
+	"ConceptMap.group.element.target.equivalence":               {valueSet: "concept-map-equivalence"},
+	"ConceptMap.group.unmapped.mode":                            {min: 1, valueSet: "conceptmap-unmapped-mode"},
+	"ConceptMap.identifier":                                     {summary: true},
+	"ConceptMap.jurisdiction":                                   {summary: true},
+	"ConceptMap.name":                                           {summary: true},
+	"ConceptMap.publisher":                                      {summary: true},
+	"ConceptMap.source[x]":                                      {summary: true},
+	"ConceptMap.status":                                         {min: 1, summary: true, valueSet: "publication-status"},
+	"ConceptMap.target[x]":                                      {summary: true},
+	"ConceptMap.title":                                          {summary: true},
+	"ConceptMap.url":                                            {summary: true},
+	"ConceptMap.useContext":                                     {summary: true},
+	"ConceptMap.version":                                        {summary: true},
+	"Condition.abatement[x]":                                    {summary: true},
+	"Condition.assertedDate":                                    {summary: true},
+	"Condition.asserter":                                        {summary: true},
+	"Condition.bodySite":                                        {summary: true},
+	"Condition.clinicalStatus":                                  {summary: true, valueSet: "condition-clinical"},
+	"Condition.code":                                            {summary: true},
+	"Condition.context":                                         {summary: true},
+	"Condition.identifier":                                      {summary: true},
+	"Condition.onset[x]":                                        {summary: true},
+	"Condition.subject":                                         {min: 1, summary: true},
+	"Condition.verificationStatus":                              {summary: true, valueSet: "condition-ver-status"},
+	"Consent.action":                                            {summary: true},
+	"Consent.actor":                                             {summary: true},
+	"Consent.actor.reference":                                   {min: 1},
+	"Consent.actor.role":                                        {min: 1},
+	"Consent.category":                                          {summary: true},
+	"Consent.consentingParty":                                   {summary: true},
+	"Consent.data":                                              {summary: true},
+	"Consent.data.meaning":                                      {min: 1, valueSet: "consent-data-meaning"},
+	"Consent.data.reference":                                    {min: 1},
+	"Consent.dataPeriod":                                        {summary: true},
+	"Consent.dateTime":                                          {summary: true},
+	"Consent.except.actor.reference":                            {min: 1},
+	"Consent.except.actor.role":                                 {min: 1},
+	"Consent.except.data.meaning":                               {min: 1, valueSet: "consent-data-meaning"},
+	"Consent.except.data.reference":                             {min: 1},
+	"Consent.except.type":                                       {min: 1, valueSet: "consent-except-type"},
+	"Consent.identifier":                                        {summary: true},
+	"Consent.organization":                                      {summary: true},
+	"Consent.patient":                                           {min: 1, summary: true},
+	"Consent.period":                                            {summary: true},
+	"Consent.policyRule":                                        {summary: true},
+	"Consent.purpose":                                           {summary: true},
+	"Consent.securityLabel":                                     {summary: true},
+	"Consent.source[x]":                                         {summary: true},
+	"Consent.status":                                            {min: 1, summary: true, valueSet: "consent-state-codes"},
+	"ContactPoint.system":                                       {valueSet: "contact-point-system"},
+	"ContactPoint.use":                                          {valueSet: "contact-point-use"},
+	"Contract.agent.actor":                                      {min: 1},
+	"Contract.applies":                                          {summary: true},
+	"Contract.authority":                                        {summary: true},
+	"Contract.binding[x]":                                       {},
+	"Contract.domain":                                           {summary: true},
+	"Contract.friendly.content[x]":                              {min: 1},
+	"Contract.identifier":                                       {summary: true},
+	"Contract.issued":                                           {summary: true},
+	"Contract.legal.content[x]":                                 {min: 1},
+	"Contract.rule.content[x]":                                  {min: 1},
+	"Contract.signer.party":                                     {min: 1},
+	"Contract.signer.signature":                                 {min: 1},
+	"Contract.signer.type":                                      {min: 1},
+	"Contract.status":                                           {summary: true, valueSet: "contract-status"},
+	"Contract.subType":                                          {summary: true},
+	"Contract.subject":                                          {summary: true},
+	"Contract.term.agent.actor":                                 {min: 1},
+	"Contract.term.valuedItem.entity[x]":                        {},
+	"Contract.topic":                                            {summary: true},
+	"Contract.type":                                             {summary: true},
+	"Contract.valuedItem.entity[x]":                             {},
+	"Contributor.name":                                          {min: 1},
+	"Contributor.type":                                          {min: 1, valueSet: "contributor-type"},
+	"Count.comparator":                                          {valueSet: "quantity-comparator"},
+	"Coverage.beneficiary":                                      {summary: true},
+	"Coverage.identifier":                                       {summary: true},
+	"Coverage.payor":                                            {summary: true},
+	"Coverage.period":                                           {summary: true},
+	"Coverage.policyHolder":                                     {summary: true},
+	"Coverage.status":                                           {summary: true, valueSet: "fm-status"},
+	"Coverage.subscriber":                                       {summary: true},
+	"Coverage.subscriberId":                                     {summary: true},
+	"Coverage.type":                                             {summary: true},
+	"DataElement.contact":                                       {summary: true},
+	"DataElement.date":                                          {summary: true},
+	"DataElement.element":                                       {min: 1, summary: true},
+	"DataElement.experimental":                                  {summary: true},
+	"DataElement.identifier":                                    {summary: true},
+	"DataElement.jurisdiction":                                  {summary: true},
+	"DataElement.mapping.identity":                              {min: 1},
+	"DataElement.name":                                          {summary: true},
+	"DataElement.publisher":                                     {summary: true},
+	"DataElement.status":                                        {min: 1, summary: true, valueSet: "publication-status"},
+	"DataElement.stringency":                                    {summary: true, valueSet: "dataelement-stringency"},
+	"DataElement.title":                                         {summary: true},
+	"DataElement.url":                                           {summary: true},
+	"DataElement.useContext":                                    {summary: true},
+	"DataElement.version":                                       {summary: true},
+	"DataRequirement.codeFilter.path":                           {min: 1},
+	"DataRequirement.codeFilter.valueSet[x]":                    {},
+	"DataRequirement.codeFilter.value[x]":                       {},
+	"DataRequirement.dateFilter.path":                           {min: 1},
+	"DataRequirement.dateFilter.value[x]":                       {},
+	"DataRequirement.type":                                      {min: 1},
+	"DetectedIssue.author":                                      {summary: true},
+	"DetectedIssue.category":                                    {summary: true},
+	"DetectedIssue.date":                                        {summary: true},
+	"DetectedIssue.identifier":                                  {summary: true},
+	"DetectedIssue.implicated":                                  {summary: true},
+	"DetectedIssue.mitigation.action":                           {min: 1},
+	"DetectedIssue.patient":                                     {summary: true},
+	"DetectedIssue.severity":                                    {summary: true, valueSet: "detectedissue-severity"},
+	"DetectedIssue.status":                                      {min: 1, summary: true, valueSet: "observation-status"},
+	"Device.status":                                             {summary: true, valueSet: "device-status"},
+	"Device.udi":                                                {summary: true},
+	"Device.udi.entryType":                                      {valueSet: "udi-entry-type"},
+	"DeviceComponent.identifier":                                {min: 1, summary: true},
+	"DeviceComponent.languageCode":                              {summary: true},
+	"DeviceComponent.lastSystemChange":                          {summary: true},
+	"DeviceComponent.measurementPrinciple":                      {summary: true, valueSet: "measurement-principle"},
+	"DeviceComponent.operationalStatus":                         {summary: true},
+	"DeviceComponent.parameterGroup":                            {summary: true},
+	"DeviceComponent.parent":                                    {summary: true},
+	"DeviceComponent.productionSpecification":                   {summary: true},
+	"DeviceComponent.source":                                    {summary: true},
+	"DeviceComponent.type":                                      {min: 1, summary: true},
+	"DeviceMetric.calibration":                                  {summary: true},
+	"DeviceMetric.calibration.state":                            {valueSet: "metric-calibration-state"},
+	"DeviceMetric.calibration.type":                             {valueSet: "metric-calibration-type"},
+	"DeviceMetric.category":                                     {min: 1, summary: true, valueSet: "metric-category"},
+	"DeviceMetric.color":                                        {summary: true, valueSet: "metric-color"},
+	"DeviceMetric.identifier":                                   {min: 1, summary: true},
+	"DeviceMetric.measurementPeriod":                            {summary: true},
+	"DeviceMetric.operationalStatus":                            {summary: true, valueSet: "metric-operational-status"},
+	"DeviceMetric.parent":                                       {summary: true},
+	"DeviceMetric.source":                                       {summary: true},
+	"DeviceMetric.type":                                         {min: 1, summary: true},
+	"DeviceMetric.unit":                                         {summary: true},
+	"DeviceRequest.authoredOn":                                  {summary: true},
+	"DeviceRequest.basedOn":                                     {summary: true},
+	"DeviceRequest.code[x]":                                     {min: 1, summary: true},
+	"DeviceRequest.context":                                     {summary: true},
+	"DeviceRequest.definition":                                  {summary: true},
+	"DeviceRequest.groupIdentifier":                             {summary: true},
+	"DeviceRequest.identifier":                                  {summary: true},
+	"DeviceRequest.intent":                                      {min: 1, summary: true},
+	"DeviceRequest.occurrence[x]":                               {summary: true},
+	"DeviceRequest.performer":                                   {summary: true},
+	"DeviceRequest.performerType":                               {summary: true},
+	"DeviceRequest.priorRequest":                                {summary: true},
+	"DeviceRequest.priority":                                    {summary: true, valueSet: "request-priority"},
+	"DeviceRequest.reasonCode":                                  {summary: true},
+	"DeviceRequest.reasonReference":                             {summary: true},
+	"DeviceRequest.requester":                                   {summary: true},
+	"DeviceRequest.requester.agent":                             {min: 1},
+	"DeviceRequest.status":                                      {summary: true, valueSet: "request-status"},
+	"DeviceRequest.subject":                                     {min: 1, summary: true},
+	"DeviceUseStatement.device":                                 {min: 1},
+	"DeviceUseStatement.status":                                 {min: 1, summary: true, valueSet: "device-statement-status"},
+	"DeviceUseStatement.subject":                                {min: 1},
+	"DeviceUseStatement.timing[x]":                              {},
+	"DiagnosticReport.category":                                 {summary: true},
+	"DiagnosticReport.code":                                     {min: 1, summary: true},
+	"DiagnosticReport.context":                                  {summary: true},
+	"DiagnosticReport.effective[x]":                             {summary: true},
+	"DiagnosticReport.identifier":                               {summary: true},
+	"DiagnosticReport.image":                                    {summary: true},
+	"DiagnosticReport.image.link":                               {min: 1},
+	"DiagnosticReport.issued":                                   {summary: true},
+	"DiagnosticReport.performer":                                {summary: true},
+	"DiagnosticReport.performer.actor":                          {min: 1},
+	"DiagnosticReport.status":                                   {min: 1, summary: true, valueSet: "diagnostic-report-status"},
+	"DiagnosticReport.subject":                                  {summary: true},
+	"Distance.comparator":                                       {valueSet: "quantity-comparator"},
+	"DocumentManifest.author":                                   {summary: true},
+	"DocumentManifest.content":                                  {min: 1, summary: true},
+	"DocumentManifest.content.p[x]":                             {min: 1},
+	"DocumentManifest.created":                                  {summary: true},
+	"DocumentManifest.description":                              {summary: true},
+	"DocumentManifest.identifier":                               {summary: true},
+	"DocumentManifest.masterIdentifier":                         {summary: true},
+	"DocumentManifest.recipient":                                {summary: true},
+	"DocumentManifest.related":                                  {summary: true},
+	"DocumentManifest.source":                                   {summary: true},
+	"DocumentManifest.status":                                   {min: 1, summary: true, valueSet: "document-reference-status"},
+	"DocumentManifest.subject":                                  {summary: true},
+	"DocumentManifest.type":                                     {summary: true},
+	"DocumentReference.authenticator":                           {summary: true},
+	"DocumentReference.author":                                  {summary: true},
+	"DocumentReference.class":                                   {summary: true},
+	"DocumentReference.content":                                 {min: 1, summary: true},
+	"DocumentReference.content.attachment":                      {min: 1},
+	"DocumentReference.context":                                 {summary: true},
+	"DocumentReference.created":                                 {summary: true},
+	"DocumentReference.custodian":                               {summary: true},
+	"DocumentReference.description":                             {summary: true},
+	"DocumentReference.docStatus":                               {summary: true, valueSet: "composition-status"},
+	"DocumentReference.identifier":                              {summary: true},
+	"DocumentReference.indexed":                                 {min: 1, summary: true},
+	"DocumentReference.masterIdentifier":                        {summary: true},
+	"DocumentReference.relatesTo":                               {summary: true},
+	"DocumentReference.relatesTo.code":                          {min: 1, valueSet: "document-relationship-type"},
+	"DocumentReference.relatesTo.target":                        {min: 1},
+	"DocumentReference.securityLabel":                           {summary: true},
+	"DocumentReference.status":                                  {min: 1, summary: true, valueSet: "document-reference-status"},
+	"DocumentReference.subject":                                 {summary: true},
+	"DocumentReference.type":                                    {min: 1, summary: true},
+	"Dosage.asNeeded[x]":                                        {},
+	"Dosage.dose[x]":                                            {},
+	"Dosage.rate[x]":                                            {},
+	"Duration.comparator":                                       {valueSet: "quantity-comparator"},
+	"ElementDefinition.base.max":                                {min: 1},
+	"ElementDefinition.base.min":                                {min: 1},
+	"ElementDefinition.base.path":                               {min: 1},
+	"ElementDefinition.binding.strength":                        {min: 1, valueSet: "binding-strength"},
+	"ElementDefinition.binding.valueSet[x]":                     {},
+	"ElementDefinition.constraint.expression":                   {min: 1},
+	"ElementDefinition.constraint.human":                        {min: 1},
+	"ElementDefinition.constraint.key":                          {min: 1},
+	"ElementDefinition.constraint.severity":                     {min: 1, valueSet: "constraint-severity"},
+	"ElementDefinition.defaultValue[x]":                         {},
+	"ElementDefinition.example.label":                           {min: 1},
+	"ElementDefinition.example.value[x]":                        {min: 1},
+	"ElementDefinition.fixed[x]":                                {},
+	"ElementDefinition.mapping.identity":                        {min: 1},
+	"ElementDefinition.mapping.map":                             {min: 1},
+	"ElementDefinition.maxValue[x]":                             {},
+	"ElementDefinition.minValue[x]":                             {},
+	"ElementDefinition.path":                                    {min: 1},
+	"ElementDefinition.pattern[x]":                              {},
+	"ElementDefinition.representation":                          {valueSet: "property-representation"},
+	"ElementDefinition.slicing.discriminator.path":              {min: 1},
+	"ElementDefinition.slicing.discriminator.type":              {min: 1, valueSet: "discriminator-type"},
+	"ElementDefinition.slicing.rules":                           {min: 1, valueSet: "resource-slicing-rules"},
+	"ElementDefinition.type.aggregation":                        {valueSet: "resource-aggregation-mode"},
+	"ElementDefinition.type.code":                               {min: 1},
+	"ElementDefinition.type.versioning":                         {valueSet: "reference-version-rules"},
+	"EligibilityRequest.serviced[x]":                            {},
+	"EligibilityRequest.status":                                 {summary: true, valueSet: "fm-status"},
+	"EligibilityResponse.error.code":                            {min: 1},
+	"EligibilityResponse.insurance.benefitBalance.category":     {min: 1},
+	"EligibilityResponse.insurance.benefitBalance.financial.allowed[x]": {},
+	"EligibilityResponse.insurance.benefitBalance.financial.type":       {min: 1},
+	"EligibilityResponse.insurance.benefitBalance.financial.used[x]":    {},
+	"EligibilityResponse.status":                                        {summary: true, valueSet: "fm-status"},
+	"Encounter.appointment":                                             {summary: true},
+	"Encounter.class":                                                   {summary: true},
+	"Encounter.classHistory.class":                                      {min: 1},
+	"Encounter.classHistory.period":                                     {min: 1},
+	"Encounter.diagnosis":                                               {summary: true},
+	"Encounter.diagnosis.condition":                                     {min: 1},
+	"Encounter.episodeOfCare":                                           {summary: true},
+	"Encounter.identifier":                                              {summary: true},
+	"Encounter.location.location":                                       {min: 1},
+	"Encounter.location.status":                                         {valueSet: "encounter-location-status"},
+	"Encounter.participant":                                             {summary: true},
+	"Encounter.reason":                                                  {summary: true},
+	"Encounter.status":                                                  {min: 1, summary: true, valueSet: "encounter-status"},
+	"Encounter.statusHistory.period":                                    {min: 1},
+	"Encounter.statusHistory.status":                                    {min: 1, valueSet: "encounter-status"},
+	"Encounter.subject":                                                 {summary: true},
+	"Encounter.type":                                                    {summary: true},
+	"Endpoint.address":                                                  {min: 1, summary: true},
+	"Endpoint.connectionType":                                           {min: 1, summary: true},
+	"Endpoint.identifier":                                               {summary: true},
+	"Endpoint.managingOrganization":                                     {summary: true},
+	"Endpoint.name":                                                     {summary: true},
+	"Endpoint.payloadMimeType":                                          {summary: true},
+	"Endpoint.payloadType":                                              {min: 1, summary: true},
+	"Endpoint.period":                                                   {summary: true},
+	"Endpoint.status":                                                   {min: 1, summary: true, valueSet: "endpoint-status"},
+	"EnrollmentRequest.status":                                          {summary: true, valueSet: "fm-status"},
+	"EnrollmentResponse.status":                                         {summary: true, valueSet: "fm-status"},
+	"EpisodeOfCare.diagnosis":                                           {summary: true},
+	"EpisodeOfCare.diagnosis.condition":                                 {min: 1},
+	"EpisodeOfCare.identifier":                                          {summary: true},
+	"EpisodeOfCare.managingOrganization":                                {summary: true},
+	"EpisodeOfCare.patient":                                             {min: 1, summary: true},
+	"EpisodeOfCare.period":                                              {summary: true},
+	"EpisodeOfCare.status":                                              {min: 1, summary: true, valueSet: "episode-of-care-status"},
+	"EpisodeOfCare.statusHistory.period":                                {min: 1},
+	"EpisodeOfCare.statusHistory.status":                                {min: 1, valueSet: "episode-of-care-status"},
+	"EpisodeOfCare.type":                                                {summary: true},
+	"ExpansionProfile.contact":                                          {summary: true},
+	"ExpansionProfile.date":                                             {summary: true},
+	"ExpansionProfile.excludedSystem.system":                            {min: 1},
+	"ExpansionProfile.experimental":                                     {summary: true},
+	"ExpansionProfile.fixedVersion.mode":                                {min: 1, valueSet: "system-version-processing-mode"},
+	"ExpansionProfile.fixedVersion.system":                              {min: 1},
+	"ExpansionProfile.fixedVersion.version":                             {min: 1},
+	"ExpansionProfile.identifier":                                       {summary: true},
+	"ExpansionProfile.jurisdiction":                                     {summary: true},
+	"ExpansionProfile.name":                                             {summary: true},
+	"ExpansionProfile.publisher":                                        {summary: true},
+	"ExpansionProfile.status":                                           {min: 1, summary: true, valueSet: "publication-status"},
+	"ExpansionProfile.url":                                              {summary: true},
+	"ExpansionProfile.useContext":                                       {summary: true},
+	"ExpansionProfile.version":                                          {summary: true},
+	"ExplanationOfBenefit.accident.location[x]":                         {},
+	"ExplanationOfBenefit.benefitBalance.category":                      {min: 1},
+	"ExplanationOfBenefit.benefitBalance.financial.allowed[x]":          {},
+	"ExplanationOfBenefit.benefitBalance.financial.type":                {min: 1},
+	"ExplanationOfBenefit.benefitBalance.financial.used[x]":             {},
+	"ExplanationOfBenefit.careTeam.provider":                            {min: 1},
+	"ExplanationOfBenefit.careTeam.sequence":                            {min: 1},
+	"ExplanationOfBenefit.diagnosis.diagnosis[x]":                       {min: 1},
+	"ExplanationOfBenefit.diagnosis.sequence":                           {min: 1},
+	"ExplanationOfBenefit.information.category":                         {min: 1},
+	"ExplanationOfBenefit.information.sequence":                         {min: 1},
+	"ExplanationOfBenefit.information.timing[x]":                        {},
+	"ExplanationOfBenefit.information.value[x]":                         {},
+	"ExplanationOfBenefit.item.adjudication.category":                   {min: 1},
+	"ExplanationOfBenefit.item.detail.sequence":                         {min: 1},
+	"ExplanationOfBenefit.item.detail.subDetail.sequence":               {min: 1},
+	"ExplanationOfBenefit.item.detail.subDetail.type":                   {min: 1},
+	"ExplanationOfBenefit.item.detail.type":                             {min: 1},
+	"ExplanationOfBenefit.item.location[x]":                             {},
+	"ExplanationOfBenefit.item.sequence":                                {min: 1},
+	"ExplanationOfBenefit.item.serviced[x]":                             {},
+	"ExplanationOfBenefit.procedure.procedure[x]":                       {min: 1},
+	"ExplanationOfBenefit.procedure.sequence":                           {min: 1},
+	"ExplanationOfBenefit.status":                                       {summary: true, valueSet: "explanationofbenefit-status"},
+	"Extension.url":                                                     {min: 1},
+	"Extension.value[x]":                                                {},
+	"FamilyMemberHistory.age[x]":                                        {summary: true},
+	"FamilyMemberHistory.born[x]":                                       {},
+	"FamilyMemberHistory.condition.code":                                {min: 1},
+	"FamilyMemberHistory.condition.onset[x]":                            {},
+	"FamilyMemberHistory.date":                                          {summary: true},
+	"FamilyMemberHistory.deceased[x]":                                   {summary: true},
+	"FamilyMemberHistory.definition":                                    {summary: true},
+	"FamilyMemberHistory.estimatedAge":                                  {summary: true},
+	"FamilyMemberHistory.gender":                                        {summary: true, valueSet: "administrative-gender"},
+	"FamilyMemberHistory.identifier":                                    {summary: true},
+	"FamilyMemberHistory.name":                                          {summary: true},
+	"FamilyMemberHistory.notDone":                                       {summary: true},
+	"FamilyMemberHistory.notDoneReason":                                 {summary: true},
+	"FamilyMemberHistory.patient":                                       {min: 1, summary: true},
+	"FamilyMemberHistory.reasonCode":                                    {summary: true},
+	"FamilyMemberHistory.reasonReference":                               {summary: true},
+	"FamilyMemberHistory.relationship":                                  {min: 1, summary: true},
+	"FamilyMemberHistory.status":                                        {min: 1, summary: true, valueSet: "history-status"},
+	"Flag.author":                                                       {summary: true},
+	"Flag.category":                                                     {summary: true},
+	"Flag.code":                                                         {min: 1, summary: true},
+	"Flag.encounter":                                                    {summary: true},
+	"Flag.identifier":                                                   {summary: true},
+	"Flag.period":                                                       {summary: true},
+	"Flag.status":                                                       {min: 1, summary: true, valueSet: "flag-status"},
+	"Flag.subject":                                                      {min: 1, summary: true},
+	"Goal.category":                                                     {summary: true},
+	"Goal.description":                                                  {min: 1, summary: true},
+	"Goal.expressedBy":                                                  {summary: true},
+	"Goal.identifier":                                                   {summary: true},
+	"Goal.priority":                                                     {summary: true},
+	"Goal.start[x]":                                                     {summary: true},
+	"Goal.status":                                                       {min: 1, summary: true, valueSet: "goal-status"},
+	"Goal.statusDate":                                                   {summary: true},
+	"Goal.subject":                                                      {summary: true},
+	"Goal.target.detail[x]":                                             {},
+	"Goal.target.due[x]":                                                {},
+	"GraphDefinition.contact":                                           {summary: true},
+	"GraphDefinition.date":                                              {summary: true},
+	"GraphDefinition.experimental":                                      {summary: true},
+	"GraphDefinition.jurisdiction":                                      {summary: true},
+	"GraphDefinition.link.target":                                       {min: 1},
+	"GraphDefinition.link.target.compartment.code":                      {min: 1, valueSet: "compartment-type"},
+	"GraphDefinition.link.target.compartment.rule":                      {min: 1, valueSet: "graph-compartment-rule"},
+	"GraphDefinition.link.target.type":                                  {min: 1, valueSet: "resource-types"},
+	"GraphDefinition.name":                                              {min: 1, summary: true},
+	"GraphDefinition.publisher":                                         {summary: true},
+	"GraphDefinition.start":                                             {min: 1, summary: true, valueSet: "resource-types"},
+	"GraphDefinition.status":                                            {min: 1, summary: true, valueSet: "publication-status"},
+	"GraphDefinition.url":                                               {summary: true},
+	"GraphDefinition.useContext":                                        {summary: true},
+	"GraphDefinition.version":                                           {summary: true},
+	"Group.active":                                                      {summary: true},
+	"Group.actual":                                                      {min: 1, summary: true},
+	"Group.characteristic.code":                                         {min: 1},
+	"Group.characteristic.exclude":                                      {min: 1},
+	"Group.characteristic.value[x]":                                     {min: 1},
+	"Group.code":                                                        {summary: true},
+	"Group.identifier":                                                  {summary: true},
+	"Group.member.entity":                                               {min: 1},
+	"Group.name":                                                        {summary: true},
+	"Group.quantity":                                                    {summary: true},
+	"Group.type":                                                        {min: 1, summary: true, valueSet: "group-type"},
+	"GuidanceResponse.identifier":                                       {summary: true},
+	"GuidanceResponse.module":                                           {min: 1, summary: true},
+	"GuidanceResponse.reason[x]":                                        {},
+	"GuidanceResponse.requestId":                                        {summary: true},
+	"GuidanceResponse.status":                                           {min: 1, summary: true, valueSet: "guidance-response-status"},
+	"HealthcareService.active":                                          {summary: true},
+	"HealthcareService.availableTime.daysOfWeek":                        {valueSet: "days-of-week"},
+	"HealthcareService.category":                                        {summary: true},
+	"HealthcareService.comment":                                         {summary: true},
+	"HealthcareService.identifier":                                      {summary: true},
+	"HealthcareService.location":                                        {summary: true},
+	"HealthcareService.name":                                            {summary: true},
+	"HealthcareService.notAvailable.description":                        {min: 1},
+	"HealthcareService.photo":                                           {summary: true},
+	"HealthcareService.providedBy":                                      {summary: true},
+	"HealthcareService.specialty":                                       {summary: true},
+	"HealthcareService.type":                                            {summary: true},
+	"HumanName.use":                                                     {valueSet: "name-use"},
+	"Identifier.use":                                                    {valueSet: "identifier-use"},
+	"ImagingManifest.author":                                            {summary: true},
+	"ImagingManifest.authoringTime":                                     {summary: true},
+	"ImagingManifest.description":                                       {summary: true},
+	"ImagingManifest.identifier":                                        {summary: true},
+	"ImagingManifest.patient":                                           {min: 1, summary: true},
+	"ImagingManifest.study":                                             {min: 1, summary: true},
+	"ImagingManifest.study.series":                                      {min: 1},
+	"ImagingManifest.study.series.instance":                             {min: 1},
+	"ImagingManifest.study.series.instance.sopClass":                    {min: 1},
+	"ImagingManifest.study.series.instance.uid":                         {min: 1},
+	"ImagingManifest.study.series.uid":                                  {min: 1},
+	"ImagingManifest.study.uid":                                         {min: 1},
+	"ImagingStudy.accession":                                            {summary: true},
+	"ImagingStudy.availability":                                         {summary: true, valueSet: "instance-availability"},
+	"ImagingStudy.basedOn":                                              {summary: true},
+	"ImagingStudy.context":                                              {summary: true},
+	"ImagingStudy.description":                                          {summary: true},
+	"ImagingStudy.endpoint":                                             {summary: true},
+	"ImagingStudy.identifier":                                           {summary: true},
+	"ImagingStudy.interpreter":                                          {summary: true},
+	"ImagingStudy.modalityList":                                         {summary: true},
+	"ImagingStudy.numberOfInstances":                                    {summary: true},
+	"ImagingStudy.numberOfSeries":                                       {summary: true},
+	"ImagingStudy.patient":                                              {min: 1, summary: true},
+	"ImagingStudy.procedureCode":                                        {summary: true},
+	"ImagingStudy.procedureReference":                                   {summary: true},
+	"ImagingStudy.reason":                                               {summary: true},
+	"ImagingStudy.referrer":                                             {summary: true},
+	"ImagingStudy.series":                                               {summary: true},
+	"ImagingStudy.series.availability":                                  {valueSet: "instance-availability"},
+	"ImagingStudy.series.instance.sopClass":                             {min: 1},
+	"ImagingStudy.series.instance.uid":                                  {min: 1},
+	"ImagingStudy.series.modality":                                      {min: 1},
+	"ImagingStudy.series.uid":                                           {min: 1},
+	"ImagingStudy.started":                                              {summary: true},
+	"ImagingStudy.uid":                                                  {min: 1, summary: true},
+	"Immunization.date":                                                 {summary: true},
+	"Immunization.notGiven":                                             {min: 1, summary: true},
+	"Immunization.patient":                                              {min: 1, summary: true},
+	"Immunization.practitioner.actor":                                   {min: 1},
+	"Immunization.primarySource":                                        {min: 1, summary: true},
+	"Immunization.status":                                               {min: 1, summary: true, valueSet: "immunization-status"},
+	"Immunization.vaccinationProtocol.doseStatus":                       {min: 1},
+	"Immunization.vaccinationProtocol.targetDisease":                    {min: 1},
+	"Immunization.vaccineCode":                                          {min: 1, summary: true},
+	"ImmunizationRecommendation.identifier":                             {summary: true},
+	"ImmunizationRecommendation.patient":                                {min: 1, summary: true},
+	"ImmunizationRecommendation.recommendation":                         {min: 1, summary: true},
+	"ImmunizationRecommendation.recommendation.date":                    {min: 1},
+	"ImmunizationRecommendation.recommendation.dateCriterion.code":      {min: 1},
+	"ImmunizationRecommendation.recommendation.dateCriterion.value":     {min: 1},
+	"ImmunizationRecommendation.recommendation.forecastStatus":          {min: 1},
+	"ImplementationGuide.contact":                                       {summary: true},
+	"ImplementationGuide.date":                                          {summary: true},
+	"ImplementationGuide.dependency":                                    {summary: true},
+	"ImplementationGuide.dependency.type":                               {min: 1, valueSet: "guide-dependency-type"},
+	"ImplementationGuide.dependency.uri":                                {min: 1},
+	"ImplementationGuide.experimental":                                  {summary: true},
+	"ImplementationGuide.fhirVersion":                                   {summary: true},
+	"ImplementationGuide.global":                                        {summary: true},
+	"ImplementationGuide.global.profile":                                {min: 1},
+	"ImplementationGuide.global.type":                                   {min: 1, valueSet: "resource-types"},
+	"ImplementationGuide.jurisdiction":                                  {summary: true},
+	"ImplementationGuide.name":                                          {min: 1, summary: true},
+	"ImplementationGuide.package":                                       {summary: true},
+	"ImplementationGuide.package.name":                                  {min: 1},
+	"ImplementationGuide.package.resource":                              {min: 1},
+	"ImplementationGuide.package.resource.example":                      {min: 1},
+	"ImplementationGuide.package.resource.source[x]":                    {min: 1},
+	"ImplementationGuide.page":                                          {summary: true},
+	"ImplementationGuide.page.kind":                                     {min: 1, valueSet: "guide-page-kind"},
+	"ImplementationGuide.page.source":                                   {min: 1},
+	"ImplementationGuide.page.title":                                    {min: 1},
+	"ImplementationGuide.page.type":                                     {valueSet: "resource-types"},
+	"ImplementationGuide.publisher":                                     {summary: true},
+	"ImplementationGuide.status":                                        {min: 1, summary: true, valueSet: "publication-status"},
+	"ImplementationGuide.url":                                           {min: 1, summary: true},
+	"ImplementationGuide.useContext":                                    {summary: true},
+	"ImplementationGuide.version":                                       {summary: true},
+	"Library.date":                                                      {summary: true},
+	"Library.effectivePeriod":                                           {summary: true},
+	"Library.experimental":                                              {summary: true},
+	"Library.identifier":                                                {summary: true},
+	"Library.jurisdiction":                                              {summary: true},
+	"Library.name":                                                      {summary: true},
+	"Library.publisher":                                                 {summary: true},
+	"Library.status":                                                    {min: 1, summary: true, valueSet: "publication-status"},
+	"Library.title":                                                     {summary: true},
+	"Library.type":                                                      {min: 1, summary: true},
+	"Library.url":                                                       {summary: true},
+	"Library.useContext":                                                {summary: true},
+	"Library.version":                                                   {summary: true},
+	"Linkage.active":                                                    {summary: true},
+	"Linkage.author":                                                    {summary: true},
+	"Linkage.item":                                                      {min: 1, summary: true},
+	"Linkage.item.resource":                                             {min: 1},
+	"Linkage.item.type":                                                 {min: 1, valueSet: "linkage-type"},
+	"List.code":                                                         {summary: true},
+	"List.date":                                                         {summary: true},
+	"List.entry.item":                                                   {min: 1},
+	"List.identifier":                                                   {summary: true},
+	"List.mode":                                                         {min: 1, summary: true, valueSet: "list-mode"},
+	"List.source":                                                       {summary: true},
+	"List.status":                                                       {min: 1, summary: true, valueSet: "list-status"},
+	"List.subject":                                                      {summary: true},
+	"List.title":                                                        {summary: true},
+	"Location.description":                                              {summary: true},
+	"Location.identifier":                                               {summary: true},
+	"Location.managingOrganization":                                     {summary: true},
+	"Location.mode":                                                     {summary: true, valueSet: "location-mode"},
+	"Location.name":                                                     {summary: true},
+	"Location.operationalStatus":                                        {summary: true},
+	"Location.physicalType":                                             {summary: true},
+	"Location.position.latitude":                                        {min: 1},
+	"Location.position.longitude":                                       {min: 1},
+	"Location.status":                                                   {summary: true, valueSet: "location-status"},
+	"Location.type":                                                     {summary: true},
+	"Measure.clinicalRecommendationStatement":                           {summary: true},
+	"Measure.compositeScoring":                                          {summary: true},
+	"Measure.date":                                                      {summary: true},
+	"Measure.definition":                                                {summary: true},
+	"Measure.effectivePeriod":                                           {summary: true},
+	"Measure.experimental":                                              {summary: true},
+	"Measure.group.identifier":                                          {min: 1},
+	"Measure.group.population.criteria":                                 {min: 1},
+	"Measure.guidance":                                                  {summary: true},
+	"Measure.identifier":                                                {summary: true},
+	"Measure.improvementNotation":                                       {summary: true},
+	"Measure.jurisdiction":                                              {summary: true},
+	"Measure.name":                                                      {summary: true},
+	"Measure.publisher":                                                 {summary: true},
+	"Measure.rateAggregation":                                           {summary: true},
+	"Measure.rationale":                                                 {summary: true},
+	"Measure.riskAdjustment":                                            {summary: true},
+	"Measure.scoring":                                                   {summary: true},
+	"Measure.set":                                                       {summary: true},
+	"Measure.status":                                                    {min: 1, summary: true, valueSet: "publication-status"},
+	"Measure.title":                                                     {summary: true},
+	"Measure.type":                                                      {summary: true},
+	"Measure.url":                                                       {summary: true},
+	"Measure.useContext":                                                {summary: true},
+	"Measure.version":                                                   {summary: true},
+	"MeasureReport.date":                                                {summary: true},
+	"MeasureReport.group.identifier":                                    {min: 1},
+	"MeasureReport.group.stratifier.stratum.value":                      {min: 1},
+	"MeasureReport.identifier":                                          {summary: true},
+	"MeasureReport.measure":                                             {min: 1, summary: true},
+	"MeasureReport.patient":                                             {summary: true},
+	"MeasureReport.period":                                              {min: 1, summary: true},
+	"MeasureReport.reportingOrganization":                               {summary: true},
+	"MeasureReport.status":                                              {min: 1, summary: true, valueSet: "measure-report-status"},
+	"MeasureReport.type":                                                {min: 1, summary: true, valueSet: "measure-report-type"},
+	"Media.basedOn":                                                     {summary: true},
+	"Media.bodySite":                                                    {summary: true},
+	"Media.content":                                                     {min: 1},
+	"Media.context":                                                     {summary: true},
+	"Media.device":                                                      {summary: true},
+	"Media.duration":                                                    {summary: true},
+	"Media.frames":                                                      {summary: true},
+	"Media.height":                                                      {summary: true},
+	"Media.identifier":                                                  {summary: true},
+	"Media.occurrence[x]":                                               {summary: true},
+	"Media.operator":                                                    {summary: true},
+	"Media.reasonCode":                                                  {summary: true},
+	"Media.subject":                                                     {summary: true},
+	"Media.subtype":                                                     {summary: true},
+	"Media.type":                                                        {min: 1, summary: true, valueSet: "digital-media-type"},
+	"Media.view":                                                        {summary: true},
+	"Media.width":                                                       {summary: true},
+	"Medication.code":                                                   {summary: true},
+	"Medication.ingredient.item[x]":                                     {min: 1},
+	"Medication.isBrand":                                                {summary: true},
+	"Medication.isOverTheCounter":                                       {summary: true},
+	"Medication.manufacturer":                                           {summary: true},
+	"Medication.package.content.item[x]":                                {min: 1},
+	"Medication.status":                                                 {summary: true, valueSet: "medication-status"},
+	"MedicationAdministration.definition":                               {summary: true},
+	"MedicationAdministration.dosage.rate[x]":                           {},
+	"MedicationAdministration.effective[x]":                             {min: 1, summary: true},
+	"MedicationAdministration.medication[x]":                            {min: 1, summary: true},
+	"MedicationAdministration.notGiven":                                 {summary: true},
+	"MedicationAdministration.partOf":                                   {summary: true},
+	"MedicationAdministration.performer":                                {summary: true},
+	"MedicationAdministration.performer.actor":                          {min: 1},
+	"MedicationAdministration.status":                                   {min: 1, summary: true, valueSet: "medication-admin-status"},
+	"MedicationAdministration.subject":                                  {min: 1, summary: true},
+	"MedicationDispense.medication[x]":                                  {min: 1, summary: true},
+	"MedicationDispense.notDoneReason[x]":                               {},
+	"MedicationDispense.performer.actor":                                {min: 1},
+	"MedicationDispense.status":                                         {summary: true, valueSet: "medication-dispense-status"},
+	"MedicationDispense.subject":                                        {summary: true},
+	"MedicationDispense.substitution.wasSubstituted":                    {min: 1},
+	"MedicationDispense.whenPrepared":                                   {summary: true},
+	"MedicationRequest.authoredOn":                                      {summary: true},
+	"MedicationRequest.basedOn":                                         {summary: true},
+	"MedicationRequest.definition":                                      {summary: true},
+	"MedicationRequest.groupIdentifier":                                 {summary: true},
+	"MedicationRequest.intent":                                          {min: 1, summary: true, valueSet: "medication-request-intent"},
+	"MedicationRequest.medication[x]":                                   {min: 1, summary: true},
+	"MedicationRequest.priority":                                        {summary: true, valueSet: "medication-request-priority"},
+	"MedicationRequest.requester":                                       {summary: true},
+	"MedicationRequest.requester.agent":                                 {min: 1},
+	"MedicationRequest.status":                                          {summary: true, valueSet: "medication-request-status"},
+	"MedicationRequest.subject":                                         {min: 1, summary: true},
+	"MedicationRequest.substitution.allowed":                            {min: 1},
+	"MedicationStatement.basedOn":                                       {summary: true},
+	"MedicationStatement.category":                                      {summary: true},
+	"MedicationStatement.context":                                       {summary: true},
+	"MedicationStatement.dateAsserted":                                  {summary: true},
+	"MedicationStatement.effective[x]":                                  {summary: true},
+	"MedicationStatement.identifier":                                    {summary: true},
+	"MedicationStatement.medication[x]":                                 {min: 1, summary: true},
+	"MedicationStatement.partOf":                                        {summary: true},
+	"MedicationStatement.status":                                        {min: 1, summary: true, valueSet: "medication-statement-status"},
+	"MedicationStatement.subject":                                       {min: 1, summary: true},
+	"MedicationStatement.taken":                                         {min: 1, summary: true, valueSet: "medication-statement-taken"},
+	"MessageDefinition.allowedResponse.message":                         {min: 1},
+	"MessageDefinition.base":                                            {summary: true},
+	"MessageDefinition.category":                                        {summary: true, valueSet: "message-significance-category"},
+	"MessageDefinition.contact":                                         {summary: true},
+	"MessageDefinition.date":                                            {min: 1, summary: true},
+	"MessageDefinition.event":                                           {min: 1, summary: true},
+	"MessageDefinition.experimental":                                    {summary: true},
+	"MessageDefinition.focus":                                           {summary: true},
+	"MessageDefinition.focus.code":                                      {min: 1, valueSet: "resource-types"},
+	"MessageDefinition.identifier":                                      {summary: true},
+	"MessageDefinition.jurisdiction":                                    {summary: true},
+	"MessageDefinition.name":                                            {summary: true},
+	"MessageDefinition.parent":                                          {summary: true},
+	"MessageDefinition.publisher":                                       {summary: true},
+	"MessageDefinition.replaces":                                        {summary: true},
+	"MessageDefinition.status":                                          {min: 1, summary: true, valueSet: "publication-status"},
+	"MessageDefinition.title":                                           {summary: true},
+	"MessageDefinition.url":                                             {summary: true},
+	"MessageDefinition.useContext":                                      {summary: true},
+	"MessageDefinition.version":                                         {summary: true},
+	"MessageHeader.author":                                              {summary: true},
+	"MessageHeader.destination":                                         {summary: true},
+	"MessageHeader.destination.endpoint":                                {min: 1},
+	"MessageHeader.enterer":                                             {summary: true},
+	"MessageHeader.event":                                               {min: 1, summary: true},
+	"MessageHeader.focus":                                               {summary: true},
+	"MessageHeader.reason":                                              {summary: true},
+	"MessageHeader.receiver":                                            {summary: true},
+	"MessageHeader.response":                                            {summary: true},
+	"MessageHeader.response.code":                                       {min: 1, valueSet: "response-code"},
+	"MessageHeader.response.identifier":                                 {min: 1},
+	"MessageHeader.responsible":                                         {summary: true},
+	"MessageHeader.sender":                                              {summary: true},
+	"MessageHeader.source":                                              {min: 1, summary: true},
+	"MessageHeader.source.endpoint":                                     {min: 1},
+	"MessageHeader.timestamp":                                           {min: 1, summary: true},
+	"Money.comparator":                                                  {valueSet: "quantity-comparator"},
+	"NamingSystem.contact":                                              {summary: true},
+	"NamingSystem.date":                                                 {min: 1, summary: true},
+	"NamingSystem.jurisdiction":                                         {summary: true},
+	"NamingSystem.kind":                                                 {min: 1, summary: true, valueSet: "namingsystem-type"},
+	"NamingSystem.name":                                                 {min: 1, summary: true},
+	"NamingSystem.publisher":                                            {summary: true},
+	"NamingSystem.responsible":                                          {summary: true},
+	"NamingSystem.status":                                               {min: 1, summary: true, valueSet: "publication-status"},
+	"NamingSystem.uniqueId":                                             {min: 1, summary: true},
+	"NamingSystem.uniqueId.type":                                        {min: 1, valueSet: "namingsystem-identifier-type"},
+	"NamingSystem.uniqueId.value":                                       {min: 1},
+	"NamingSystem.useContext":                                           {summary: true},
+	"Narrative.div":                                                     {min: 1},
+	"Narrative.status":                                                  {min: 1, valueSet: "narrative-status"},
+	"NutritionOrder.dateTime":                                           {min: 1, summary: true},
+	"NutritionOrder.enteralFormula.administration.rate[x]":              {},
+	"NutritionOrder.identifier":                                         {summary: true},
+	"NutritionOrder.orderer":                                            {summary: true},
+	"NutritionOrder.patient":                                            {min: 1, summary: true},
+	"NutritionOrder.status":                                             {summary: true, valueSet: "nutrition-request-status"},
+	"Observation.basedOn":                                               {summary: true},
+	"Observation.code":                                                  {min: 1, summary: true},
+	"Observation.component":                                             {summary: true},
+	"Observation.component.code":                                        {min: 1},
+	"Observation.component.value[x]":                                    {},
+	"Observation.effective[x]":                                          {summary: true},
+	"Observation.identifier":                                            {summary: true},
+	"Observation.issued":                                                {summary: true},
+	"Observation.performer":                                             {summary: true},
+	"Observation.related":                                               {summary: true},
+	"Observation.related.target":                                        {min: 1},
+	"Observation.related.type":                                          {valueSet: "observation-relationshiptypes"},
+	"Observation.status":                                                {min: 1, summary: true, valueSet: "observation-status"},
+	"Observation.subject":                                               {summary: true},
+	"Observation.value[x]":                                              {summary: true},
+	"OperationDefinition.base":                                          {summary: true},
+	"OperationDefinition.code":                                          {min: 1, summary: true},
+	"OperationDefinition.contact":                                       {summary: true},
+	"OperationDefinition.date":                                          {summary: true},
+	"OperationDefinition.experimental":                                  {summary: true},
+	"OperationDefinition.idempotent":                                    {summary: true},
+	"OperationDefinition.instance":                                      {min: 1, summary: true},
+	"OperationDefinition.jurisdiction":                                  {summary: true},
+	"OperationDefinition.kind":                                          {min: 1, summary: true, valueSet: "operation-kind"},
+	"OperationDefinition.name":                                          {min: 1, summary: true},
+	"OperationDefinition.parameter.binding.strength":                    {min: 1, valueSet: "binding-strength"},
+	"OperationDefinition.parameter.binding.valueSet[x]":                 {min: 1},
+	"OperationDefinition.parameter.max":                                 {min: 1},
+	"OperationDefinition.parameter.min":                                 {min: 1},
+	"OperationDefinition.parameter.name":                                {min: 1},
+	"OperationDefinition.parameter.searchType":                          {valueSet: "search-param-type"},
+	"OperationDefinition.parameter.use":                                 {min: 1, valueSet: "operation-parameter-use"},
+	"OperationDefinition.publisher":                                     {summary: true},
+	"OperationDefinition.resource":                                      {summary: true, valueSet: "resource-types"},
+	"OperationDefinition.status":                                        {min: 1, summary: true, valueSet: "publication-status"},
+	"OperationDefinition.system":                                        {min: 1, summary: true},
+	"OperationDefinition.type":                                          {min: 1, summary: true},
+	"OperationDefinition.url":                                           {summary: true},
+	"OperationDefinition.useContext":                                    {summary: true},
+	"OperationDefinition.version":                                       {summary: true},
+	"OperationOutcome.issue":                                            {min: 1, summary: true},
+	"OperationOutcome.issue.code":                                       {min: 1, valueSet: "issue-type"},
+	"OperationOutcome.issue.severity":                                   {min: 1, valueSet: "issue-severity"},
+	"Organization.active":                                               {summary: true},
+	"Organization.identifier":                                           {summary: true},
+	"Organization.name":                                                 {summary: true},
+	"Organization.partOf":                                               {summary: true},
+	"Organization.type":                                                 {summary: true},
+	"ParameterDefinition.type":                                          {min: 1},
+	"ParameterDefinition.use":                                           {min: 1, valueSet: "operation-parameter-use"},
+	"Parameters.parameter.name":                                         {min: 1},
+	"Parameters.parameter.value[x]":                                     {},
+	"Patient.active":                                                    {summary: true},
+	"Patient.address":                                                   {summary: true},
+	"Patient.animal":                                                    {summary: true},
+	"Patient.animal.species":                                            {min: 1},
+	"Patient.birthDate":                                                 {summary: true},
+	"Patient.communication.language":                                    {min: 1},
+	"Patient.contact.gender":                                            {valueSet: "administrative-gender"},
+	"Patient.deceased[x]":                                               {summary: true},
+	"Patient.gender":                                                    {summary: true, valueSet: "administrative-gender"},
+	"Patient.identifier":                                                {summary: true},
+	"Patient.link":                                                      {summary: true},
+	"Patient.link.other":                                                {min: 1},
+	"Patient.link.type":                                                 {min: 1, valueSet: "link-type"},
+	"Patient.managingOrganization":                                      {summary: true},
+	"Patient.multipleBirth[x]":                                          {},
+	"Patient.name":                                                      {summary: true},
+	"Patient.telecom":                                                   {summary: true},
+	"PaymentNotice.status":                                              {summary: true, valueSet: "fm-status"},
+	"PaymentReconciliation.detail.type":                                 {min: 1},
+	"PaymentReconciliation.status":                                      {summary: true, valueSet: "fm-status"},
+	"Person.active":                                                     {summary: true},
+	"Person.birthDate":                                                  {summary: true},
+	"Person.gender":                                                     {summary: true, valueSet: "administrative-gender"},
+	"Person.identifier":                                                 {summary: true},
+	"Person.link.assurance":                                             {valueSet: "identity-assuranceLevel"},
+	"Person.link.target":                                                {min: 1},
+	"Person.managingOrganization":                                       {summary: true},
+	"Person.name":                                                       {summary: true},
+	"Person.telecom":                                                    {summary: true},
+	"PlanDefinition.action.cardinalityBehavior":                         {valueSet: "action-cardinality-behavior"},
+	"PlanDefinition.action.condition.kind":                              {min: 1, valueSet: "action-condition-kind"},
+	"PlanDefinition.action.groupingBehavior":                            {valueSet: "action-grouping-behavior"},
+	"PlanDefinition.action.participant.type":                            {min: 1, valueSet: "action-participant-type"},
+	"PlanDefinition.action.precheckBehavior":                            {valueSet: "action-precheck-behavior"},
+	"PlanDefinition.action.relatedAction.actionId":                      {min: 1},
+	"PlanDefinition.action.relatedAction.offset[x]":                     {},
+	"PlanDefinition.action.relatedAction.relationship":                  {min: 1, valueSet: "action-relationship-type"},
+	"PlanDefinition.action.requiredBehavior":                            {valueSet: "action-required-behavior"},
+	"PlanDefinition.action.selectionBehavior":                           {valueSet: "action-selection-behavior"},
+	"PlanDefinition.action.timing[x]":                                   {},
+	"PlanDefinition.date":                                               {summary: true},
+	"PlanDefinition.effectivePeriod":                                    {summary: true},
+	"PlanDefinition.experimental":                                       {summary: true},
+	"PlanDefinition.goal.description":                                   {min: 1},
+	"PlanDefinition.goal.target.detail[x]":                              {},
+	"PlanDefinition.identifier":                                         {summary: true},
+	"PlanDefinition.jurisdiction":                                       {summary: true},
+	"PlanDefinition.name":                                               {summary: true},
+	"PlanDefinition.publisher":                                          {summary: true},
+	"PlanDefinition.status":                                             {min: 1, summary: true, valueSet: "publication-status"},
+	"PlanDefinition.title":                                              {summary: true},
+	"PlanDefinition.type":                                               {summary: true},
+	"PlanDefinition.url":                                                {summary: true},
+	"PlanDefinition.useContext":                                         {summary: true},
+	"PlanDefinition.version":                                            {summary: true},
+	"Practitioner.active":                                               {summary: true},
+	"Practitioner.address":                                              {summary: true},
+	"Practitioner.birthDate":                                            {summary: true},
+	"Practitioner.gender":                                               {summary: true, valueSet: "administrative-gender"},
+	"Practitioner.identifier":                                           {summary: true},
+	"Practitioner.name":                                                 {summary: true},
+	"Practitioner.qualification.code":                                   {min: 1},
+	"Practitioner.telecom":                                              {summary: true},
+	"PractitionerRole.active":                                           {summary: true},
+	"PractitionerRole.availableTime.daysOfWeek":                         {valueSet: "days-of-week"},
+	"PractitionerRole.code":                                             {summary: true},
+	"PractitionerRole.identifier":                                       {summary: true},
+	"PractitionerRole.location":                                         {summary: true},
+	"PractitionerRole.notAvailable.description":                         {min: 1},
+	"PractitionerRole.organization":                                     {summary: true},
+	"PractitionerRole.period":                                           {summary: true},
+	"PractitionerRole.practitioner":                                     {summary: true},
+	"PractitionerRole.specialty":                                        {summary: true},
+	"PractitionerRole.telecom":                                          {summary: true},
+	"Procedure.basedOn":                                                 {summary: true},
+	"Procedure.bodySite":                                                {summary: true},
+	"Procedure.category":                                                {summary: true},
+	"Procedure.code":                                                    {summary: true},
+	"Procedure.context":                                                 {summary: true},
+	"Procedure.definition":                                              {summary: true},
+	"Procedure.focalDevice.manipulated":                                 {min: 1},
+	"Procedure.identifier":                                              {summary: true},
+	"Procedure.location":                                                {summary: true},
+	"Procedure.notDone":                                                 {summary: true},
+	"Procedure.notDoneReason":                                           {summary: true},
+	"Procedure.outcome":                                                 {summary: true},
+	"Procedure.partOf":                                                  {summary: true},
+	"Procedure.performed[x]":                                            {summary: true},
+	"Procedure.performer":                                               {summary: true},
+	"Procedure.performer.actor":                                         {min: 1},
+	"Procedure.reasonCode":                                              {summary: true},
+	"Procedure.reasonReference":                                         {summary: true},
+	"Procedure.status":                                                  {min: 1, summary: true, valueSet: "event-status"},
+	"Procedure.subject":                                                 {min: 1, summary: true},
+	"ProcedureRequest.asNeeded[x]":                                      {summary: true},
+	"ProcedureRequest.authoredOn":                                       {summary: true},
+	"ProcedureRequest.basedOn":                                          {summary: true},
+	"ProcedureRequest.bodySite":                                         {summary: true},
+	"ProcedureRequest.category":                                         {summary: true},
+	"ProcedureRequest.code":                                             {min: 1, summary: true},
+	"ProcedureRequest.context":                                          {summary: true},
+	"ProcedureRequest.definition":                                       {summary: true},
+	"ProcedureRequest.doNotPerform":                                     {summary: true},
+	"ProcedureRequest.identifier":                                       {summary: true},
+	"ProcedureRequest.intent":                                           {min: 1, summary: true, valueSet: "request-intent"},
+	"ProcedureRequest.occurrence[x]":                                    {summary: true},
+	"ProcedureRequest.performer":                                        {summary: true},
+	"ProcedureRequest.performerType":                                    {summary: true},
+	"ProcedureRequest.priority":                                         {summary: true, valueSet: "request-priority"},
+	"ProcedureRequest.reasonCode":                                       {summary: true},
+	"ProcedureRequest.reasonReference":                                  {summary: true},
+	"ProcedureRequest.replaces":                                         {summary: true},
+	"ProcedureRequest.requester":                                        {summary: true},
+	"ProcedureRequest.requester.agent":                                  {min: 1},
+	"ProcedureRequest.requisition":                                      {summary: true},
+	"ProcedureRequest.specimen":                                         {summary: true},
+	"ProcedureRequest.status":                                           {min: 1, summary: true, valueSet: "request-status"},
+	"ProcedureRequest.subject":                                          {min: 1, summary: true},
+	"ProcessRequest.action":                                             {valueSet: "actionlist"},
+	"ProcessRequest.item.sequenceLinkId":                                {min: 1},
+	"ProcessRequest.status":                                             {summary: true, valueSet: "fm-status"},
+	"ProcessResponse.status":                                            {summary: true, valueSet: "fm-status"},
+	"Provenance.agent":                                                  {min: 1},
+	"Provenance.agent.onBehalfOf[x]":                                    {},
+	"Provenance.agent.who[x]":                                           {min: 1},
+	"Provenance.entity.role":                                            {min: 1, valueSet: "provenance-entity-role"},
+	"Provenance.entity.what[x]":                                         {min: 1},
+	"Provenance.recorded":                                               {min: 1, summary: true},
+	"Provenance.target":                                                 {min: 1, summary: true},
+	"Quantity.comparator":                                               {valueSet: "quantity-comparator"},
+	"Questionnaire.code":                                                {summary: true},
+	"Questionnaire.contact":                                             {summary: true},
+	"Questionnaire.date":                                                {summary: true},
+	"Questionnaire.effectivePeriod":                                     {summary: true},
+	"Questionnaire.experimental":                                        {summary: true},
+	"Questionnaire.identifier":                                          {summary: true},
+	"Questionnaire.item.enableWhen.answer[x]":                           {},
+	"Questionnaire.item.enableWhen.question":                            {min: 1},
+	"Questionnaire.item.initial[x]":                                     {},
+	"Questionnaire.item.linkId":                                         {min: 1},
+	"Questionnaire.item.option.value[x]":                                {min: 1},
+	"Questionnaire.item.type":                                           {min: 1, valueSet: "item-type"},
+	"Questionnaire.jurisdiction":                                        {summary: true},
+	"Questionnaire.name":                                                {summary: true},
+	"Questionnaire.publisher":                                           {summary: true},
+	"Questionnaire.status":                                              {min: 1, summary: true, valueSet: "publication-status"},
+	"Questionnaire.subjectType":                                         {summary: true, valueSet: "resource-types"},
+	"Questionnaire.title":                                               {summary: true},
+	"Questionnaire.url":                                                 {summary: true},
+	"Questionnaire.useContext":                                          {summary: true},
+	"Questionnaire.version":                                             {summary: true},
+	"QuestionnaireResponse.author":                                      {summary: true},
+	"QuestionnaireResponse.authored":                                    {summary: true},
+	"QuestionnaireResponse.basedOn":                                     {summary: true},
+	"QuestionnaireResponse.context":                                     {summary: true},
+	"QuestionnaireResponse.identifier":                                  {summary: true},
+	"QuestionnaireResponse.item.answer.value[x]":                        {},
+	"QuestionnaireResponse.item.linkId":                                 {min: 1},
+	"QuestionnaireResponse.parent":                                      {summary: true},
+	"QuestionnaireResponse.questionnaire":                               {summary: true},
+	"QuestionnaireResponse.source":                                      {summary: true},
+	"QuestionnaireResponse.status":                                      {min: 1, summary: true, valueSet: "questionnaire-answers-status"},
+	"QuestionnaireResponse.subject":                                     {summary: true},
+	"ReferralRequest.authoredOn":                                        {summary: true},
+	"ReferralRequest.basedOn":                                           {summary: true},
+	"ReferralRequest.context":                                           {summary: true},
+	"ReferralRequest.definition":                                        {summary: true},
+	"ReferralRequest.groupIdentifier":                                   {summary: true},
+	"ReferralRequest.identifier":                                        {summary: true},
+	"ReferralRequest.intent":                                            {min: 1, summary: true, valueSet: "request-intent"},
+	"ReferralRequest.occurrence[x]":                                     {summary: true},
+	"ReferralRequest.priority":                                          {summary: true, valueSet: "request-priority"},
+	"ReferralRequest.reasonCode":                                        {summary: true},
+	"ReferralRequest.reasonReference":                                   {summary: true},
+	"ReferralRequest.recipient":                                         {summary: true},
+	"ReferralRequest.replaces":                                          {summary: true},
+	"ReferralRequest.requester":                                         {summary: true},
+	"ReferralRequest.requester.agent":                                   {min: 1},
+	"ReferralRequest.serviceRequested":                                  {summary: true},
+	"ReferralRequest.status":                                            {min: 1, summary: true, valueSet: "request-status"},
+	"ReferralRequest.subject":                                           {min: 1, summary: true},
+	"ReferralRequest.type":                                              {summary: true},
+	"RelatedArtifact.type":                                              {min: 1, valueSet: "related-artifact-type"},
+	"RelatedPerson.active":                                              {summary: true},
+	"RelatedPerson.address":                                             {summary: true},
+	"RelatedPerson.birthDate":                                           {summary: true},
+	"RelatedPerson.gender":                                              {summary: true, valueSet: "administrative-gender"},
+	"RelatedPerson.identifier":                                          {summary: true},
+	"RelatedPerson.name":                                                {summary: true},
+	"RelatedPerson.patient":                                             {min: 1, summary: true},
+	"RelatedPerson.relationship":                                        {summary: true},
+	"RelatedPerson.telecom":                                             {summary: true},
+	"RequestGroup.action.cardinalityBehavior":                           {valueSet: "action-cardinality-behavior"},
+	"RequestGroup.action.condition.kind":                                {min: 1, valueSet: "action-condition-kind"},
+	"RequestGroup.action.groupingBehavior":                              {valueSet: "action-grouping-behavior"},
+	"RequestGroup.action.precheckBehavior":                              {valueSet: "action-precheck-behavior"},
+	"RequestGroup.action.relatedAction.actionId":                        {min: 1},
+	"RequestGroup.action.relatedAction.offset[x]":                       {},
+	"RequestGroup.action.relatedAction.relationship":                    {min: 1, valueSet: "action-relationship-type"},
+	"RequestGroup.action.requiredBehavior":                              {valueSet: "action-required-behavior"},
+	"RequestGroup.action.selectionBehavior":                             {valueSet: "action-selection-behavior"},
+	"RequestGroup.action.timing[x]":                                     {},
+	"RequestGroup.basedOn":                                              {summary: true},
+	"RequestGroup.definition":                                           {summary: true},
+	"RequestGroup.groupIdentifier":                                      {summary: true},
+	"RequestGroup.identifier":                                           {summary: true},
+	"RequestGroup.intent":                                               {min: 1, summary: true, valueSet: "request-intent"},
+	"RequestGroup.priority":                                             {valueSet: "request-priority"},
+	"RequestGroup.reason[x]":                                            {},
+	"RequestGroup.replaces":                                             {summary: true},
+	"RequestGroup.status":                                               {min: 1, summary: true, valueSet: "request-status"},
+	"ResearchStudy.arm.name":                                            {min: 1},
+	"ResearchStudy.category":                                            {summary: true},
+	"ResearchStudy.contact":                                             {summary: true},
+	"ResearchStudy.enrollment":                                          {summary: true},
+	"ResearchStudy.focus":                                               {summary: true},
+	"ResearchStudy.identifier":                                          {summary: true},
+	"ResearchStudy.jurisdiction":                                        {summary: true},
+	"ResearchStudy.keyword":                                             {summary: true},
+	"ResearchStudy.partOf":                                              {summary: true},
+	"ResearchStudy.period":                                              {summary: true},
+	"ResearchStudy.principalInvestigator":                               {summary: true},
+	"ResearchStudy.protocol":                                            {summary: true},
+	"ResearchStudy.reasonStopped":                                       {summary: true},
+	"ResearchStudy.site":                                                {summary: true},
+	"ResearchStudy.sponsor":                                             {summary: true},
+	"ResearchStudy.status":                                              {min: 1, summary: true, valueSet: "research-study-status"},
+	"ResearchStudy.title":                                               {summary: true},
+	"ResearchSubject.identifier":                                        {summary: true},
+	"ResearchSubject.individual":                                        {min: 1, summary: true},
+	"ResearchSubject.period":                                            {summary: true},
+	"ResearchSubject.status":                                            {min: 1, summary: true, valueSet: "research-subject-status"},
+	"ResearchSubject.study":                                             {min: 1, summary: true},
+	"Resource.id":                                                       {summary: true},
+	"Resource.implicitRules":                                            {summary: true},
+	"Resource.meta":                                                     {summary: true},
+	"RiskAssessment.code":                                               {summary: true},
+	"RiskAssessment.condition":                                          {summary: true},
+	"RiskAssessment.context":                                            {summary: true},
+	"RiskAssessment.identifier":                                         {summary: true},
+	"RiskAssessment.method":                                             {summary: true},
+	"RiskAssessment.occurrence[x]":                                      {summary: true},
+	"RiskAssessment.performer":                                          {summary: true},
+	"RiskAssessment.prediction.outcome":                                 {min: 1},
+	"RiskAssessment.prediction.probability[x]":                          {},
+	"RiskAssessment.prediction.when[x]":                                 {},
+	"RiskAssessment.reason[x]":                                          {},
+	"RiskAssessment.status":                                             {min: 1, summary: true, valueSet: "observation-status"},
+	"RiskAssessment.subject":                                            {summary: true},
+	"SampledData.data":                                                  {min: 1},
+	"SampledData.dimensions":                                            {min: 1},
+	"SampledData.origin":                                                {min: 1},
+	"SampledData.period":                                                {min: 1},
+	"Schedule.active":                                                   {summary: true},
+	"Schedule.actor":                                                    {min: 1, summary: true},
+	"Schedule.identifier":                                               {summary: true},
+	"Schedule.planningHorizon":                                          {summary: true},
+	"Schedule.serviceCategory":                                          {summary: true},
+	"Schedule.serviceType":                                              {summary: true},
+	"Schedule.specialty":                                                {summary: true},
+	"SearchParameter.base":                                              {min: 1, summary: true, valueSet: "resource-types"},
+	"SearchParameter.code":                                              {min: 1, summary: true},
+	"SearchParameter.comparator":                                        {valueSet: "search-comparator"},
+	"SearchParameter.component.definition":                              {min: 1},
+	"SearchParameter.component.expression":                              {min: 1},
+	"SearchParameter.contact":                                           {summary: true},
+	"SearchParameter.date":                                              {summary: true},
+	"SearchParameter.description":                                       {min: 1, summary: true},
+	"SearchParameter.experimental":                                      {summary: true},
+	"SearchParameter.jurisdiction":                                      {summary: true},
+	"SearchParameter.modifier":                                          {valueSet: "search-modifier-code"},
+	"SearchParameter.name":                                              {min: 1, summary: true},
+	"SearchParameter.publisher":                                         {summary: true},
+	"SearchParameter.status":                                            {min: 1, summary: true, valueSet: "publication-status"},
+	"SearchParameter.target":                                            {valueSet: "resource-types"},
+	"SearchParameter.type":                                              {min: 1, summary: true, valueSet: "search-param-type"},
+	"SearchParameter.url":                                               {min: 1, summary: true},
+	"SearchParameter.useContext":                                        {summary: true},
+	"SearchParameter.version":                                           {summary: true},
+	"SearchParameter.xpathUsage":                                        {valueSet: "search-xpath-usage"},
+	"Sequence.coordinateSystem":                                         {min: 1, summary: true},
+	"Sequence.device":                                                   {summary: true},
+	"Sequence.identifier":                                               {summary: true},
+	"Sequence.observedSeq":                                              {summary: true},
+	"Sequence.patient":                                                  {summary: true},
+	"Sequence.performer":                                                {summary: true},
+	"Sequence.pointer":                                                  {summary: true},
+	"Sequence.quality":                                                  {summary: true},
+	"Sequence.quality.type":                                             {min: 1, valueSet: "quality-type"},
+	"Sequence.quantity":                                                 {summary: true},
+	"Sequence.readCoverage":                                             {summary: true},
+	"Sequence.referenceSeq":                                             {summary: true},
+	"Sequence.referenceSeq.windowEnd":                                   {min: 1},
+	"Sequence.referenceSeq.windowStart":                                 {min: 1},
+	"Sequence.repository":                                               {summary: true},
+	"Sequence.repository.type":                                          {min: 1, valueSet: "repository-type"},
+	"Sequence.specimen":                                                 {summary: true},
+	"Sequence.type":                                                     {summary: true, valueSet: "sequence-type"},
+	"Sequence.variant":                                                  {summary: true},
+	"ServiceDefinition.date":                                            {summary: true},
+	"ServiceDefinition.effectivePeriod":                                 {summary: true},
+	"ServiceDefinition.experimental":                                    {summary: true},
+	"ServiceDefinition.identifier":                                      {summary: true},
+	"ServiceDefinition.jurisdiction":                                    {summary: true},
+	"ServiceDefinition.name":                                            {summary: true},
+	"ServiceDefinition.publisher":                                       {summary: true},
+	"ServiceDefinition.status":                                          {min: 1, summary: true, valueSet: "publication-status"},
+	"ServiceDefinition.title":                                           {summary: true},
+	"ServiceDefinition.url":                                             {summary: true},
+	"ServiceDefinition.useContext":                                      {summary: true},
+	"ServiceDefinition.version":                                         {summary: true},
+	"Signature.onBehalfOf[x]":                                           {},
+	"Signature.type":                                                    {min: 1},
+	"Signature.when":                                                    {min: 1},
+	"Signature.who[x]":                                                  {min: 1},
+	"Slot.appointmentType":                                              {summary: true},
+	"Slot.end":                                                          {min: 1, summary: true},
+	"Slot.identifier":                                                   {summary: true},
+	"Slot.schedule":                                                     {min: 1, summary: true},
+	"Slot.serviceCategory":                                              {summary: true},
+	"Slot.serviceType":                                                  {summary: true},
+	"Slot.specialty":                                                    {summary: true},
+	"Slot.start":                                                        {min: 1, summary: true},
+	"Slot.status":                                                       {min: 1, summary: true, valueSet: "slotstatus"},
+	"Specimen.accessionIdentifier":                                      {summary: true},
+	"Specimen.collection.collected[x]":                                  {},
+	"Specimen.container.additive[x]":                                    {},
+	"Specimen.identifier":                                               {summary: true},
+	"Specimen.processing.time[x]":                                       {},
+	"Specimen.receivedTime":                                             {summary: true},
+	"Specimen.status":                                                   {summary: true, valueSet: "specimen-status"},
+	"Specimen.subject":                                                  {min: 1, summary: true},
+	"Specimen.type":                                                     {summary: true},
+	"StructureDefinition.abstract":                                      {min: 1, summary: true},
+	"StructureDefinition.baseDefinition":                                {summary: true},
+	"StructureDefinition.contact":                                       {summary: true},
+	"StructureDefinition.context":                                       {summary: true},
+	"StructureDefinition.contextInvariant":                              {summary: true},
+	"StructureDefinition.contextType":                                   {summary: true, valueSet: "extension-context"},
+	"StructureDefinition.date":                                          {summary: true},
+	"StructureDefinition.derivation":                                    {summary: true, valueSet: "type-derivation-rule"},
+	"StructureDefinition.differential.element":                          {min: 1},
+	"StructureDefinition.experimental":                                  {summary: true},
+	"StructureDefinition.fhirVersion":                                   {summary: true},
+	"StructureDefinition.identifier":                                    {summary: true},
+	"StructureDefinition.jurisdiction":                                  {summary: true},
+	"StructureDefinition.keyword":                                       {summary: true},
+	"StructureDefinition.kind":                                          {min: 1, summary: true, valueSet: "structure-definition-kind"},
+	"StructureDefinition.mapping.identity":                              {min: 1},
+	"StructureDefinition.name":                                          {min: 1, summary: true},
+	"StructureDefinition.publisher":                                     {summary: true},
+	"StructureDefinition.snapshot.element":                              {min: 1},
+	"StructureDefinition.status":                                        {min: 1, summary: true, valueSet: "publication-status"},
+	"StructureDefinition.title":                                         {summary: true},
+	"StructureDefinition.type":                                          {min: 1, summary: true},
+	"StructureDefinition.url":                                           {min: 1, summary: true},
+	"StructureDefinition.useContext":                                    {summary: true},
+	"StructureDefinition.version":                                       {summary: true},
+	"StructureMap.contact":                                              {summary: true},
+	"StructureMap.date":                                                 {summary: true},
+	"StructureMap.experimental":                                         {summary: true},
+	"StructureMap.group":                                                {min: 1, summary: true},
+	"StructureMap.group.input":                                          {min: 1},
+	"StructureMap.group.input.mode":                                     {min: 1, valueSet: "map-input-mode"},
+	"StructureMap.group.input.name":                                     {min: 1},
+	"StructureMap.group.name":                                           {min: 1},
+	"StructureMap.group.rule":                                           {min: 1},
+	"StructureMap.group.rule.dependent.name":                            {min: 1},
+	"StructureMap.group.rule.dependent.variable":                        {min: 1},
+	"StructureMap.group.rule.name":                                      {min: 1},
+	"StructureMap.group.rule.source":                                    {min: 1},
+	"StructureMap.group.rule.source.context":                            {min: 1},
+	"StructureMap.group.rule.source.defaultValue[x]":                    {},
+	"StructureMap.group.rule.source.listMode":                           {valueSet: "map-source-list-mode"},
+	"StructureMap.group.rule.target.contextType":                        {valueSet: "map-context-type"},
+	"StructureMap.group.rule.target.listMode":                           {valueSet: "map-target-list-mode"},
+	"StructureMap.group.rule.target.parameter.value[x]":                 {min: 1},
+	"StructureMap.group.rule.target.transform":                          {valueSet: "map-transform"},
+	"StructureMap.group.typeMode":                                       {min: 1, valueSet: "map-group-type-mode"},
+	"StructureMap.identifier":                                           {summary: true},
+	"StructureMap.import":                                               {summary: true},
+	"StructureMap.jurisdiction":                                         {summary: true},
+	"StructureMap.name":                                                 {min: 1, summary: true},
+	"StructureMap.publisher":                                            {summary: true},
+	"StructureMap.status":                                               {min: 1, summary: true, valueSet: "publication-status"},
+	"StructureMap.structure":                                            {summary: true},
+	"StructureMap.structure.mode":                                       {min: 1, valueSet: "map-model-mode"},
+	"StructureMap.structure.url":                                        {min: 1},
+	"StructureMap.title":                                                {summary: true},
+	"StructureMap.url":                                                  {min: 1, summary: true},
+	"StructureMap.useContext":                                           {summary: true},
+	"StructureMap.version":                                              {summary: true},
+	"Subscription.channel":                                              {min: 1, summary: true},
+	"Subscription.channel.type":                                         {min: 1, valueSet: "subscription-channel-type"},
+	"Subscription.contact":                                              {summary: true},
+	"Subscription.criteria":                                             {min: 1, summary: true},
+	"Subscription.end":                                                  {summary: true},
+	"Subscription.error":                                                {summary: true},
+	"Subscription.reason":                                               {min: 1, summary: true},
+	"Subscription.status":                                               {min: 1, summary: true, valueSet: "subscription-status"},
+	"Subscription.tag":                                                  {summary: true},
+	"Substance.category":                                                {summary: true},
+	"Substance.code":                                                    {min: 1, summary: true},
+	"Substance.description":                                             {summary: true},
+	"Substance.identifier":                                              {summary: true},
+	"Substance.ingredient":                                              {summary: true},
+	"Substance.ingredient.substance[x]":                                 {min: 1},
+	"Substance.instance":                                                {summary: true},
+	"Substance.status":                                                  {summary: true, valueSet: "substance-status"},
+	"SupplyDelivery.basedOn":                                            {summary: true},
+	"SupplyDelivery.identifier":                                         {summary: true},
+	"SupplyDelivery.occurrence[x]":                                      {summary: true},
+	"SupplyDelivery.partOf":                                             {summary: true},
+	"SupplyDelivery.status":                                             {summary: true, valueSet: "supplydelivery-status"},
+	"SupplyDelivery.suppliedItem.item[x]":                               {},
+	"SupplyRequest.authoredOn":                                          {summary: true},
+	"SupplyRequest.category":                                            {summary: true},
+	"SupplyRequest.identifier":                                          {summary: true},
+	"SupplyRequest.occurrence[x]":                                       {summary: true},
+	"SupplyRequest.orderedItem":                                         {summary: true},
+	"SupplyRequest.orderedItem.item[x]":                                 {},
+	"SupplyRequest.orderedItem.quantity":                                {min: 1},
+	"SupplyRequest.priority":                                            {summary: true, valueSet: "request-priority"},
+	"SupplyRequest.reason[x]":                                           {},
+	"SupplyRequest.requester":                                           {summary: true},
+	"SupplyRequest.requester.agent":                                     {min: 1},
+	"SupplyRequest.status":                                              {summary: true, valueSet: "supplyrequest-status"},
+	"SupplyRequest.supplier":                                            {summary: true},
+	"Task.basedOn":                                                      {summary: true},
+	"Task.businessStatus":                                               {summary: true},
+	"Task.code":                                                         {summary: true},
+	"Task.context":                                                      {summary: true},
+	"Task.definition[x]":                                                {summary: true},
+	"Task.description":                                                  {summary: true},
+	"Task.executionPeriod":                                              {summary: true},
+	"Task.focus":                                                        {summary: true},
+	"Task.for":                                                          {summary: true},
+	"Task.groupIdentifier":                                              {summary: true},
+	"Task.identifier":                                                   {summary: true},
+	"Task.input.type":                                                   {min: 1},
+	"Task.input.value[x]":                                               {min: 1},
+	"Task.intent":                                                       {min: 1, summary: true, valueSet: "request-intent"},
+	"Task.output.type":                                                  {min: 1},
+	"Task.output.value[x]":                                              {min: 1},
+	"Task.owner":                                                        {summary: true},
+	"Task.partOf":                                                       {summary: true},
+	"Task.priority":                                                     {valueSet: "request-priority"},
+	"Task.requester":                                                    {summary: true},
+	"Task.requester.agent":                                              {min: 1},
+	"Task.status":                                                       {min: 1, summary: true, valueSet: "task-status"},
+	"Task.statusReason":                                                 {summary: true},
+	"TestReport.identifier":                                             {summary: true},
+	"TestReport.issued":                                                 {summary: true},
+	"TestReport.name":                                                   {summary: true},
+	"TestReport.participant.type":                                       {min: 1, valueSet: "report-participant-type"},
+	"TestReport.participant.uri":                                        {min: 1},
+	"TestReport.result":                                                 {min: 1, summary: true, valueSet: "report-result-codes"},
+	"TestReport.score":                                                  {summary: true},
+	"TestReport.setup.action":                                           {min: 1},
+	"TestReport.setup.action.assert.result":                             {min: 1, valueSet: "report-action-result-codes"},
+	"TestReport.setup.action.operation.result":                          {min: 1, valueSet: "report-action-result-codes"},
+	"TestReport.status":                                                 {min: 1, summary: true, valueSet: "report-status-codes"},
+	"TestReport.teardown.action":                                        {min: 1},
+	"TestReport.test.action":                                            {min: 1},
+	"TestReport.testScript":                                             {min: 1, summary: true},
+	"TestReport.tester":                                                 {summary: true},
+	"TestScript.contact":                                                {summary: true},
+	"TestScript.date":                                                   {summary: true},
+	"TestScript.destination.index":                                      {min: 1},
+	"TestScript.destination.profile":                                    {min: 1},
+	"TestScript.experimental":                                           {summary: true},
+	"TestScript.fixture.autocreate":                                     {min: 1},
+	"TestScript.fixture.autodelete":                                     {min: 1},
+	"TestScript.identifier":                                             {summary: true},
+	"TestScript.jurisdiction":                                           {summary: true},
+	"TestScript.metadata.capability":                                    {min: 1},
+	"TestScript.metadata.capability.capabilities":                       {min: 1},
+	"TestScript.metadata.link.url":                                      {min: 1},
+	"TestScript.name":                                                   {min: 1, summary: true},
+	"TestScript.origin.index":                                           {min: 1},
+	"TestScript.origin.profile":                                         {min: 1},
+	"TestScript.publisher":                                              {summary: true},
+	"TestScript.rule.param.name":                                        {min: 1},
+	"TestScript.rule.resource":                                          {min: 1},
+	"TestScript.ruleset.resource":                                       {min: 1},
+	"TestScript.ruleset.rule":                                           {min: 1},
+	"TestScript.ruleset.rule.param.name":                                {min: 1},
+	"TestScript.ruleset.rule.ruleId":                                    {min: 1},
+	"TestScript.setup.action":                                           {min: 1},
+	"TestScript.setup.action.assert.contentType":                        {valueSet: "content-type"},
+	"TestScript.setup.action.assert.direction":                          {valueSet: "assert-direction-codes"},
+	"TestScript.setup.action.assert.operator":                           {valueSet: "assert-operator-codes"},
+	"TestScript.setup.action.assert.requestMethod":                      {valueSet: "http-operations"},
+	"TestScript.setup.action.assert.response":                           {valueSet: "assert-response-code-types"},
+	"TestScript.setup.action.assert.rule.param.name":                    {min: 1},
+	"TestScript.setup.action.assert.rule.param.value":                   {min: 1},
+	"TestScript.setup.action.assert.rule.ruleId":                        {min: 1},
+	"TestScript.setup.action.assert.ruleset.rule.param.name":            {min: 1},
+	"TestScript.setup.action.assert.ruleset.rule.param.value":           {min: 1},
+	"TestScript.setup.action.assert.ruleset.rule.ruleId":                {min: 1},
+	"TestScript.setup.action.assert.ruleset.rulesetId":                  {min: 1},
+	"TestScript.setup.action.operation.accept":                          {valueSet: "content-type"},
+	"TestScript.setup.action.operation.contentType":                     {valueSet: "content-type"},
+	"TestScript.setup.action.operation.requestHeader.field":             {min: 1},
+	"TestScript.setup.action.operation.requestHeader.value":             {min: 1},
+	"TestScript.status":                                                 {min: 1, summary: true, valueSet: "publication-status"},
+	"TestScript.teardown.action":                                        {min: 1},
+	"TestScript.teardown.action.operation":                              {min: 1},
+	"TestScript.test.action":                                            {min: 1},
+	"TestScript.title":                                                  {summary: true},
+	"TestScript.url":                                                    {min: 1, summary: true},
+	"TestScript.useContext":                                             {summary: true},
+	"TestScript.variable.name":                                          {min: 1},
+	"TestScript.version":                                                {summary: true},
+	"Timing.repeat.bounds[x]":                                           {},
+	"Timing.repeat.dayOfWeek":                                           {valueSet: "days-of-week"},
+	"Timing.repeat.durationUnit":                                        {valueSet: "units-of-time"},
+	"Timing.repeat.periodUnit":                                          {valueSet: "units-of-time"},
+	"Timing.repeat.when":                                                {valueSet: "event-timing"},
+	"TriggerDefinition.eventTiming[x]":                                  {},
+	"TriggerDefinition.type":                                            {min: 1, valueSet: "trigger-type"},
+	"UsageContext.code":                                                 {min: 1},
+	"UsageContext.value[x]":                                             {min: 1},
+	"ValueSet.compose.include":                                          {min: 1},
+	"ValueSet.compose.include.concept.code":                             {min: 1},
+	"ValueSet.compose.include.concept.designation.value":                {min: 1},
+	"ValueSet.compose.include.filter.op":                                {min: 1, valueSet: "filter-operator"},
+	"ValueSet.compose.include.filter.property":                          {min: 1},
+	"ValueSet.compose.include.filter.value":                             {min: 1},
+	"ValueSet.contact":                                                  {summary: true},
+	"ValueSet.date":                                                     {summary: true},
+	"ValueSet.expansion.identifier":                                     {min: 1},
+	"ValueSet.expansion.parameter.name":                                 {min: 1},
+	"ValueSet.expansion.parameter.value[x]":                             {},
+	"ValueSet.expansion.timestamp":                                      {min: 1},
+	"ValueSet.experimental":                                             {summary: true},
+	"ValueSet.extensible":                                               {summary: true},
+	"ValueSet.identifier":                                               {summary: true},
+	"ValueSet.immutable":                                                {summary: true},
+	"ValueSet.jurisdiction":                                             {summary: true},
+	"ValueSet.name":                                                     {summary: true},
+	"ValueSet.publisher":                                                {summary: true},
+	"ValueSet.status":                                                   {min: 1, summary: true, valueSet: "publication-status"},
+	"ValueSet.title":                                                    {summary: true},
+	"ValueSet.url":                                                      {summary: true},
+	"ValueSet.useContext":                                               {summary: true},
+	"ValueSet.version":                                                  {summary: true},
+	"VisionPrescription.dispense.base":                                  {valueSet: "vision-base-codes"},
+	"VisionPrescription.dispense.eye":                                   {valueSet: "vision-eye-codes"},
+	"VisionPrescription.reason[x]":                                      {},
+	"VisionPrescription.status":                                         {summary: true, valueSet: "fm-status"},
+}
+
+// valueSetCodes has the codes of the value sets in elementDefinitions, by their id in http://hl7.org/fhir/ValueSet/
+var valueSetCodes = map[string][]string{
+	"account-status":                   {"active", "inactive", "entered-in-error"},
+	"action-cardinality-behavior":      {"single", "multiple"},
+	"action-condition-kind":            {"applicability", "start", "stop"},
+	"action-grouping-behavior":         {"visual-group", "logical-group", "sentence-group"},
+	"action-participant-type":          {"patient", "practitioner", "related-person"},
+	"action-precheck-behavior":         {"yes", "no"},
+	"action-relationship-type":         {"before-start", "before", "before-end", "concurrent-with-start", "concurrent", "concurrent-with-end", "after-start", "after", "after-end"},
+	"action-required-behavior":         {"must", "could", "must-unless-documented"},
+	"action-selection-behavior":        {"any", "all", "all-or-none", "exactly-one", "at-most-one", "one-or-more"},
+	"actionlist":                       {"cancel", "poll", "reprocess", "status"},
+	"address-type":                     {"postal", "physical", "both"},
+	"address-use":                      {"home", "work", "temp", "old"},
+	"administrative-gender":            {"male", "female", "other", "unknown"},
+	"adverse-event-category":           {"AE", "PAE"},
+	"adverse-event-causality":          {"causality1", "causality2"},
+	"allergy-clinical-status":          {"active", "inactive", "resolved"},
+	"allergy-intolerance-category":     {"food", "medication", "environment", "biologic"},
+	"allergy-intolerance-criticality":  {"low", "high", "unable-to-assess"},
+	"allergy-intolerance-type":         {"allergy", "intolerance"},
+	"allergy-verification-status":      {"unconfirmed", "confirmed", "refuted", "entered-in-error"},
+	"appointmentstatus":                {"proposed", "pending", "booked", "arrived", "fulfilled", "cancelled", "noshow", "entered-in-error"},
+	"assert-direction-codes":           {"response", "request"},
+	"assert-operator-codes":            {"equals", "notEquals", "in", "notIn", "greaterThan", "lessThan", "empty", "notEmpty", "contains", "notContains", "eval"},
+	"assert-response-code-types":       {"okay", "created", "noContent", "notModified", "bad", "forbidden", "notFound", "methodNotAllowed", "conflict", "gone", "preconditionFailed", "unprocessable"},
+	"audit-event-action":               {"C", "R", "U", "D", "E"},
+	"audit-event-outcome":              {"0", "4", "8", "12"},
+	"binding-strength":                 {"required", "extensible", "preferred", "example"},
+	"bundle-type":                      {"document", "message", "transaction", "transaction-response", "batch", "batch-response", "history", "searchset", "collection"},
+	"capability-statement-kind":        {"instance", "capability", "requirements"},
+	"care-plan-activity-status":        {"not-started", "scheduled", "in-progress", "on-hold", "completed", "cancelled", "unknown"},
+	"care-plan-intent":                 {"proposal", "plan", "order", "option"},
+	"care-plan-status":                 {"draft", "active", "suspended", "completed", "entered-in-error", "cancelled", "unknown"},
+	"care-team-status":                 {"proposed", "active", "suspended", "inactive", "entered-in-error"},
+	"chargeitem-status":                {"planned", "billable", "not-billable", "aborted", "billed", "entered-in-error", "unknown"},
+	"claim-use":                        {"complete", "proposed", "exploratory", "other"},
+	"clinical-impression-status":       {"draft", "completed", "entered-in-error"},
+	"codesystem-content-mode":          {"not-present", "example", "fragment", "complete"},
+	"codesystem-hierarchy-meaning":     {"grouped-by", "is-a", "part-of", "classified-with"},
+	"compartment-type":                 {"Patient", "Encounter", "RelatedPerson", "Practitioner", "Device"},
+	"composition-attestation-mode":     {"personal", "professional", "legal", "official"},
+	"composition-status":               {"preliminary", "final", "amended", "entered-in-error"},
+	"concept-map-equivalence":          {"relatedto", "equivalent", "equal", "wider", "subsumes", "narrower", "specializes", "inexact", "unmatched", "disjoint"},
+	"concept-property-type":            {"code", "Coding", "string", "integer", "boolean", "dateTime"},
+	"conceptmap-unmapped-mode":         {"provided", "fixed", "other-map"},
+	"condition-clinical":               {"active", "recurrence", "inactive", "remission", "resolved"},
+	"condition-ver-status":             {"provisional", "differential", "confirmed", "refuted", "entered-in-error", "unknown"},
+	"conditional-delete-status":        {"not-supported", "single", "multiple"},
+	"conditional-read-status":          {"not-supported", "modified-since", "not-match", "full-support"},
+	"consent-data-meaning":             {"instance", "related", "dependents", "authoredby"},
+	"consent-except-type":              {"deny", "permit"},
+	"consent-state-codes":              {"draft", "proposed", "active", "rejected", "inactive", "entered-in-error"},
+	"constraint-severity":              {"error", "warning"},
+	"contact-point-system":             {"phone", "fax", "email", "pager", "url", "sms", "other"},
+	"contact-point-use":                {"home", "work", "temp", "old", "mobile"},
+	"content-type":                     {"xml", "json", "ttl", "none"},
+	"contract-status":                  {"amended", "appended", "cancelled", "disputed", "entered-in-error", "executable", "executed", "negotiable", "offered", "policy", "rejected", "renewed", "revoked", "resolved", "terminated"},
+	"contributor-type":                 {"author", "editor", "reviewer", "endorser"},
+	"dataelement-stringency":           {"comparable", "fully-specified", "equivalent", "convertable", "scaleable", "flexible"},
+	"days-of-week":                     {"mon", "tue", "wed", "thu", "fri", "sat", "sun"},
+	"detectedissue-severity":           {"high", "moderate", "low"},
+	"device-statement-status":          {"active", "completed", "entered-in-error", "intended", "stopped", "on-hold"},
+	"device-status":                    {"active", "inactive", "entered-in-error", "unknown"},
+	"diagnostic-report-status":         {"registered", "partial", "preliminary", "final", "amended", "corrected", "appended", "cancelled", "entered-in-error", "unknown"},
+	"digital-media-type":               {"photo", "video", "audio"},
+	"discriminator-type":               {"value", "exists", "pattern", "type", "profile"},
+	"document-mode":                    {"producer", "consumer"},
+	"document-reference-status":        {"current", "superseded", "entered-in-error"},
+	"document-relationship-type":       {"replaces", "transforms", "signs", "appends"},
+	"encounter-location-status":        {"planned", "active", "reserved", "completed"},
+	"encounter-status":                 {"planned", "arrived", "triaged", "in-progress", "onleave", "finished", "cancelled", "entered-in-error", "unknown"},
+	"endpoint-status":                  {"active", "suspended", "error", "off", "entered-in-error", "test"},
+	"episode-of-care-status":           {"planned", "waitlist", "active", "onhold", "finished", "cancelled", "entered-in-error"},
+	"event-capability-mode":            {"sender", "receiver"},
+	"event-status":                     {"preparation", "in-progress", "suspended", "aborted", "completed", "entered-in-error", "unknown"},
+	"event-timing":                     {"MORN", "AFT", "EVE", "NIGHT", "PHS", "HS", "WAKE", "C", "CM", "CD", "CV", "AC", "ACM", "ACD", "ACV", "PC", "PCM", "PCD", "PCV"},
+	"explanationofbenefit-status":      {"active", "cancelled", "draft", "entered-in-error"},
+	"extension-context":                {"resource", "datatype", "extension"},
+	"filter-operator":                  {"=", "is-a", "descendent-of", "is-not-a", "regex", "in", "not-in", "generalizes", "exists"},
+	"flag-status":                      {"active", "inactive", "entered-in-error"},
+	"fm-status":                        {"active", "cancelled", "draft", "entered-in-error"},
+	"goal-status":                      {"proposed", "accepted", "planned", "in-progress", "on-target", "ahead-of-target", "behind-target", "sustaining", "achieved", "on-hold", "cancelled", "entered-in-error", "rejected"},
+	"graph-compartment-rule":           {"identical", "matching", "different", "custom"},
+	"group-type":                       {"person", "animal", "practitioner", "device", "medication", "substance"},
+	"guidance-response-status":         {"success", "data-requested", "data-required", "in-progress", "failure", "entered-in-error"},
+	"guide-dependency-type":            {"reference", "inclusion"},
+	"guide-page-kind":                  {"page", "example", "list", "include", "directory", "dictionary", "toc", "resource"},
+	"history-status":                   {"partial", "completed", "entered-in-error", "health-unknown"},
+	"http-operations":                  {"delete", "get", "options", "patch", "post", "put"},
+	"http-verb":                        {"GET", "POST", "PUT", "DELETE"},
+	"identifier-use":                   {"usual", "official", "temp", "secondary"},
+	"identity-assuranceLevel":          {"level1", "level2", "level3", "level4"},
+	"immunization-status":              {"completed", "entered-in-error"},
+	"instance-availability":            {"ONLINE", "OFFLINE", "NEARLINE", "UNAVAILABLE"},
+	"issue-severity":                   {"fatal", "error", "warning", "information"},
+	"issue-type":                       {"invalid", "structure", "required", "value", "invariant", "security", "login", "unknown", "expired", "forbidden", "suppressed", "processing", "not-supported", "duplicate", "not-found", "too-long", "code-invalid", "extension", "too-costly", "business-rule", "conflict", "incomplete", "transient", "lock-error", "no-store", "exception", "timeout", "throttled", "informational"},
+	"item-type":                        {"group", "display", "boolean", "decimal", "integer", "date", "dateTime", "time", "string", "text", "url", "choice", "open-choice", "attachment", "reference", "quantity"},
+	"link-type":                        {"replaced-by", "replaces", "refer", "seealso"},
+	"linkage-type":                     {"source", "alternate", "historical"},
+	"list-mode":                        {"working", "snapshot", "changes"},
+	"list-status":                      {"current", "retired", "entered-in-error"},
+	"location-mode":                    {"instance", "kind"},
+	"location-status":                  {"active", "suspended", "inactive"},
+	"map-context-type":                 {"type", "variable"},
+	"map-group-type-mode":              {"none", "types", "type-and-types"},
+	"map-input-mode":                   {"source", "target"},
+	"map-model-mode":                   {"source", "queried", "target", "produced"},
+	"map-source-list-mode":             {"first", "not_first", "last", "not_last", "only_one"},
+	"map-target-list-mode":             {"first", "share", "last", "collate"},
+	"map-transform":                    {"create", "copy", "truncate", "escape", "cast", "append", "translate", "reference", "dateOp", "uuid", "pointer", "evaluate", "cc", "c", "qty", "id", "cp"},
+	"measure-report-status":            {"complete", "pending", "error"},
+	"measure-report-type":              {"individual", "patient-list", "summary"},
+	"measurement-principle":            {"other", "chemical", "electrical", "impedance", "nuclear", "optical", "thermal", "biological", "mechanical", "acoustical", "manual"},
+	"medication-admin-status":          {"in-progress", "on-hold", "completed", "entered-in-error", "stopped", "unknown"},
+	"medication-dispense-status":       {"preparation", "in-progress", "on-hold", "completed", "entered-in-error", "stopped"},
+	"medication-request-intent":        {"proposal", "plan", "order", "instance-order"},
+	"medication-request-priority":      {"routine", "urgent", "stat", "asap"},
+	"medication-request-status":        {"active", "on-hold", "cancelled", "completed", "entered-in-error", "stopped", "draft", "unknown"},
+	"medication-statement-status":      {"active", "completed", "entered-in-error", "intended", "stopped", "on-hold"},
+	"medication-statement-taken":       {"y", "n", "unk", "na"},
+	"medication-status":                {"active", "inactive", "entered-in-error"},
+	"message-significance-category":    {"Consequence", "Currency", "Notification"},
+	"metric-calibration-state":         {"not-calibrated", "calibration-required", "calibrated", "unspecified"},
+	"metric-calibration-type":          {"unspecified", "offset", "gain", "two-point"},
+	"metric-category":                  {"measurement", "setting", "calculation", "unspecified"},
+	"metric-color":                     {"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"},
+	"metric-operational-status":        {"on", "off", "standby", "entered-in-error"},
+	"name-use":                         {"usual", "official", "temp", "nickname", "anonymous", "old", "maiden"},
+	"namingsystem-identifier-type":     {"oid", "uuid", "uri", "other"},
+	"namingsystem-type":                {"codesystem", "identifier", "root"},
+	"narrative-status":                 {"generated", "extensions", "additional", "empty"},
+	"network-type":                     {"1", "2", "3", "4", "5"},
+	"nutrition-request-status":         {"proposed", "draft", "planned", "requested", "active", "on-hold", "completed", "cancelled", "entered-in-error"},
+	"observation-relationshiptypes":    {"has-member", "derived-from", "sequel-to", "replaces", "qualified-by", "interfered-by"},
+	"observation-status":               {"registered", "preliminary", "final", "amended", "corrected", "cancelled", "entered-in-error", "unknown"},
+	"operation-kind":                   {"operation", "query"},
+	"operation-parameter-use":          {"in", "out"},
+	"participantrequired":              {"required", "optional", "information-only"},
+	"participantstatus":                {"accepted", "declined", "tentative", "in-process", "completed", "needs-action", "entered-in-error"},
+	"participationstatus":              {"accepted", "declined", "tentative", "needs-action"},
+	"property-representation":          {"xmlAttr", "xmlText", "typeAttr", "cdaText", "xhtml"},
+	"provenance-entity-role":           {"derivation", "revision", "quotation", "source", "removal"},
+	"publication-status":               {"draft", "active", "retired", "unknown"},
+	"quality-type":                     {"indel", "snp", "unknown"},
+	"quantity-comparator":              {"<", "<=", ">=", ">"},
+	"questionnaire-answers-status":     {"in-progress", "completed", "amended", "entered-in-error", "stopped"},
+	"reaction-event-severity":          {"mild", "moderate", "severe"},
+	"reference-handling-policy":        {"literal", "logical", "resolves", "enforced", "local"},
+	"reference-version-rules":          {"either", "independent", "specific"},
+	"related-artifact-type":            {"documentation", "justification", "citation", "predecessor", "successor", "derived-from", "depends-on", "composed-of"},
+	"report-action-result-codes":       {"pass", "skip", "fail", "warning", "error"},
+	"report-participant-type":          {"test-engine", "client", "server"},
+	"report-result-codes":              {"pass", "fail", "pending"},
+	"report-status-codes":              {"completed", "in-progress", "waiting", "stopped", "entered-in-error"},
+	"repository-type":                  {"directlink", "openapi", "login", "oauth", "other"},
+	"request-intent":                   {"proposal", "plan", "order", "original-order", "reflex-order", "filler-order", "instance-order", "option"},
+	"request-priority":                 {"routine", "urgent", "asap", "stat"},
+	"request-status":                   {"draft", "active", "suspended", "cancelled", "completed", "entered-in-error", "unknown"},
+	"research-study-status":            {"draft", "in-progress", "suspended", "stopped", "completed", "entered-in-error"},
+	"research-subject-status":          {"candidate", "enrolled", "active", "suspended", "withdrawn", "completed"},
+	"resource-aggregation-mode":        {"contained", "referenced", "bundled"},
+	"resource-slicing-rules":           {"closed", "open", "openAtEnd"},
+	"resource-types":                   {"Account", "ActivityDefinition", "AdverseEvent", "AllergyIntolerance", "Appointment", "AppointmentResponse", "AuditEvent", "Basic", "Binary", "BodySite", "Bundle", "CapabilityStatement", "CarePlan", "CareTeam", "ChargeItem", "Claim", "ClaimResponse", "ClinicalImpression", "CodeSystem", "Communication", "CommunicationRequest", "CompartmentDefinition", "Composition", "ConceptMap", "Condition", "Consent", "Contract", "Coverage", "DataElement", "DetectedIssue", "Device", "DeviceComponent", "DeviceMetric", "DeviceRequest", "DeviceUseStatement", "DiagnosticReport", "DocumentManifest", "DocumentReference", "DomainResource", "EligibilityRequest", "EligibilityResponse", "Encounter", "Endpoint", "EnrollmentRequest", "EnrollmentResponse", "EpisodeOfCare", "ExpansionProfile", "ExplanationOfBenefit", "FamilyMemberHistory", "Flag", "Goal", "GraphDefinition", "Group", "GuidanceResponse", "HealthcareService", "ImagingManifest", "ImagingStudy", "Immunization", "ImmunizationRecommendation", "ImplementationGuide", "Library", "Linkage", "List", "Location", "Measure", "MeasureReport", "Media", "Medication", "MedicationAdministration", "MedicationDispense", "MedicationRequest", "MedicationStatement", "MessageDefinition", "MessageHeader", "MetadataResource", "NamingSystem", "NutritionOrder", "Observation", "OperationDefinition", "OperationOutcome", "Organization", "Parameters", "Patient", "PaymentNotice", "PaymentReconciliation", "Person", "PlanDefinition", "Practitioner", "PractitionerRole", "Procedure", "ProcedureRequest", "ProcessRequest", "ProcessResponse", "Provenance", "Questionnaire", "QuestionnaireResponse", "ReferralRequest", "RelatedPerson", "RequestGroup", "ResearchStudy", "ResearchSubject", "Resource", "RiskAssessment", "Schedule", "SearchParameter", "Sequence", "ServiceDefinition", "Slot", "Specimen", "StructureDefinition", "StructureMap", "Subscription", "Substance", "SupplyDelivery", "SupplyRequest", "Task", "TestReport", "TestScript", "ValueSet", "VisionPrescription"},
+	"response-code":                    {"ok", "transient-error", "fatal-error"},
+	"restful-capability-mode":          {"client", "server"},
+	"search-comparator":                {"eq", "ne", "gt", "lt", "ge", "le", "sa", "eb", "ap"},
+	"search-entry-mode":                {"match", "include", "outcome"},
+	"search-modifier-code":             {"missing", "exact", "contains", "not", "text", "in", "not-in", "below", "above", "type"},
+	"search-param-type":                {"number", "date", "string", "token", "reference", "composite", "quantity", "uri"},
+	"search-xpath-usage":               {"normal", "phonetic", "nearby", "distance", "other"},
+	"sequence-type":                    {"aa", "dna", "rna"},
+	"slotstatus":                       {"busy", "free", "busy-unavailable", "busy-tentative", "entered-in-error"},
+	"specimen-status":                  {"available", "unavailable", "unsatisfactory", "entered-in-error"},
+	"structure-definition-kind":        {"primitive-type", "complex-type", "resource", "logical"},
+	"subscription-channel-type":        {"rest-hook", "websocket", "email", "sms", "message"},
+	"subscription-status":              {"requested", "active", "error", "off"},
+	"substance-status":                 {"active", "inactive", "entered-in-error"},
+	"supplydelivery-status":            {"in-progress", "completed", "abandoned", "entered-in-error"},
+	"supplyrequest-status":             {"draft", "active", "suspended", "cancelled", "completed", "entered-in-error", "unknown"},
+	"system-restful-interaction":       {"transaction", "batch", "search-system", "history-system"},
+	"system-version-processing-mode":   {"default", "check", "override"},
+	"task-status":                      {"draft", "requested", "received", "accepted", "rejected", "ready", "cancelled", "in-progress", "on-hold", "failed", "completed", "entered-in-error"},
+	"trigger-type":                     {"named-event", "periodic", "data-added", "data-modified", "data-removed", "data-accessed", "data-access-ended"},
+	"type-derivation-rule":             {"specialization", "constraint"},
+	"type-restful-interaction":         {"read", "vread", "update", "patch", "delete", "history-instance", "history-type", "create", "search-type"},
+	"udi-entry-type":                   {"barcode", "rfid", "manual", "card", "self-reported", "unknown"},
+	"units-of-time":                    {"s", "min", "h", "d", "wk", "mo", "a"},
+	"unknown-content-code":             {"no", "extensions", "elements", "both"},
+	"v3-ConfidentialityClassification": {"U", "L", "M", "N", "R", "V"},
+	"versioning-policy":                {"no-version", "versioned", "versioned-update"},
+	"vision-base-codes":                {"up", "down", "in", "out"},
+	"vision-eye-codes":                 {"right", "left"},
+}
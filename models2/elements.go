@@ -0,0 +1,183 @@
+package models2
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/models"
+)
+
+// ElementInfo describes an element using the types in fhirTypes and the structs in the models package,
+// e.g. for validating resources when the StructureDefinitions of the specification aren't available.
+// Its cardinality, summary flag and binding come from elementDefinitions.
+type ElementInfo struct {
+	// name in JSON, with the type appended for choice elements (e.g. deceasedBoolean)
+	Name string
+
+	// FHIR type, e.g. boolean, HumanName or BackboneElement
+	Type string
+
+	Repeating bool
+
+	// for BackboneElement and Element children (including ones defined by a content reference),
+	// the path to pass to ChildElements for their own children (e.g. Patient.contact or Bundle.link)
+	Path string
+
+	// for the types of a choice element, the name of the choice element (e.g. deceased[x] for deceasedBoolean)
+	Choice string
+
+	// the minimum cardinality (of the choice element for its types)
+	Min int
+
+	// whether it's returned for _summary=true (only known for the top-level elements of resources)
+	Summary bool
+
+	// the URL of the value set of a required binding, only for code elements (see ValueSetCodes)
+	ValueSet string
+}
+
+const valueSetPrefix = "http://hl7.org/fhir/ValueSet/"
+
+// ValueSetCodes returns the codes of a value set that an ElementInfo's ValueSet refers to,
+// or nil for other value sets.
+func ValueSetCodes(url string) []string {
+	if !strings.HasPrefix(url, valueSetPrefix) {
+		return nil
+	}
+	return valueSetCodes[url[len(valueSetPrefix):]]
+}
+
+// ChildElements returns the children of a resource, a complex data type or one of their backbone elements,
+// in the order of their definitions. The path is e.g. Patient, HumanName or Patient.contact.
+// found is false if the path is unknown.
+func ChildElements(path string) (children []ElementInfo, found bool) {
+	names := strings.Split(path, ".")
+	position, found := rootPosition(names[0])
+	if !found {
+		return nil, false
+	}
+	for _, name := range names[1:] {
+		child, err := position.child(name, path)
+		if err != nil || child.position.element == "" {
+			return nil, false
+		}
+		position = child.position
+	}
+
+	isResource := len(names) == 1 && (models.StructForResourceName(path) != nil || path == "Parameters")
+	prefix := position.element + "."
+	fields := fieldsOfModel(position.goType)
+	for key := range fhirTypes {
+		if !strings.HasPrefix(key, prefix) || strings.Contains(key[len(prefix):], ".") {
+			continue
+		}
+		child, err := position.child(key[len(prefix):], path)
+		if err != nil {
+			return nil, false
+		}
+		info := ElementInfo{Name: child.name, Type: child.fhirType, Repeating: child.repeating}
+		if child.position.element != "" && (child.position.element != child.fhirType || strings.Contains(child.fhirType, ".")) {
+			// a backbone element or a content reference (e.g. Bundle.entry.link is a Bundle.link)
+			info.Type = "BackboneElement"
+			info.Path = child.position.element
+		}
+		name := child.name
+		if choice := choiceName(prefix, child.name, child.fhirType); choice != "" {
+			info.Choice = choice
+			name = choice
+		}
+		definition, found := elementDefinitions[prefix+name]
+		if !found && isResource {
+			definition = elementDefinitions["Resource."+name]
+		}
+		info.Min = definition.min
+		info.Summary = definition.summary
+		if definition.valueSet != "" {
+			info.ValueSet = valueSetPrefix + definition.valueSet
+		}
+		children = append(children, info)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		positionI, positionJ := fields.position(children[i].Name), fields.position(children[j].Name)
+		if positionI != positionJ {
+			return positionI < positionJ
+		}
+		return children[i].Name < children[j].Name
+	})
+	return children, true
+}
+
+// choiceName returns the name of the choice element that an element is one of the types of, if any
+func choiceName(prefix string, name string, fhirType string) string {
+	if fhirType == "" {
+		return ""
+	}
+	suffix := strings.ToUpper(fhirType[:1]) + fhirType[1:]
+	if !strings.HasSuffix(name, suffix) || len(name) == len(suffix) {
+		return ""
+	}
+	choice := name[:len(name)-len(suffix)] + "[x]"
+	if _, found := elementDefinitions[prefix+choice]; !found {
+		return ""
+	}
+	return choice
+}
+
+// rootPosition returns the position of a resource or a complex data type
+func rootPosition(name string) (xmlPosition, bool) {
+	if _, found := fhirTypes[name+".id"]; !found || name == "_" {
+		return xmlPosition{}, false
+	}
+	if models.StructForResourceName(name) != nil || name == "Parameters" {
+		position, err := resourcePosition(name, name)
+		return position, err == nil
+	}
+	return xmlPosition{element: name, goType: dataTypeModels()[name]}, true
+}
+
+var dataTypeModelsOnce sync.Once
+var dataTypeModelsByName map[string]reflect.Type
+
+// dataTypeModels finds the structs of the complex data types by following the fields of the resources' structs
+func dataTypeModels() map[string]reflect.Type {
+	dataTypeModelsOnce.Do(func() {
+		dataTypeModelsByName = make(map[string]reflect.Type)
+		visited := make(map[string]bool)
+
+		var visit func(position xmlPosition)
+		visit = func(position xmlPosition) {
+			if visited[position.element] || position.goType == nil {
+				return
+			}
+			visited[position.element] = true
+			for name := range fieldsOfModel(position.goType).types {
+				child, err := position.child(name, position.element)
+				if err != nil || child.position.element == "" || child.position.goType == nil {
+					continue
+				}
+				if child.position.element == child.fhirType && !strings.Contains(child.fhirType, ".") {
+					if _, found := dataTypeModelsByName[child.fhirType]; !found {
+						dataTypeModelsByName[child.fhirType] = child.position.goType
+					}
+				}
+				visit(child.position)
+			}
+		}
+
+		for key := range fhirTypes {
+			if !strings.HasSuffix(key, ".id") || strings.Count(key, ".") != 1 {
+				continue
+			}
+			name := strings.TrimSuffix(key, ".id")
+			if models.StructForResourceName(name) == nil {
+				continue
+			}
+			if position, err := resourcePosition(name, name); err == nil {
+				visit(position)
+			}
+		}
+	})
+	return dataTypeModelsByName
+}
@@ -0,0 +1,65 @@
+package models2
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChildElementsDefinitions(t *testing.T) {
+	byName := childElementsByName(t, "Observation")
+	assert.Equal(t, ElementInfo{Name: "status", Type: "code", Min: 1, Summary: true, ValueSet: "http://hl7.org/fhir/ValueSet/observation-status"}, byName["status"])
+	assert.Equal(t, ElementInfo{Name: "valueQuantity", Type: "Quantity", Choice: "value[x]", Summary: true}, byName["valueQuantity"])
+	assert.True(t, byName["id"].Summary)
+	assert.False(t, byName["text"].Summary)
+	assert.False(t, byName["interpretation"].Summary)
+
+	// content references take the definitions of the elements they refer to
+	assert.Equal(t, 1, childElementsByName(t, "Bundle.entry.link")["relation"].Min)
+
+	assert.Contains(t, ValueSetCodes("http://hl7.org/fhir/ValueSet/administrative-gender"), "female")
+	assert.Nil(t, ValueSetCodes("http://example.org/ValueSet/administrative-gender"))
+}
+
+func childElementsByName(t *testing.T, path string) map[string]ElementInfo {
+	children, found := ChildElements(path)
+	assert.True(t, found)
+	byName := make(map[string]ElementInfo)
+	for _, child := range children {
+		byName[child.Name] = child
+	}
+	return byName
+}
+
+func TestElementDefinitionsMatchTypes(t *testing.T) {
+	choices := make(map[string]bool)
+	for path := range fhirTypes {
+		dot := strings.LastIndex(path, ".")
+		if dot < 0 {
+			continue
+		}
+		children, found := ChildElements(path[:dot])
+		if !found {
+			continue
+		}
+		for _, child := range children {
+			if child.Choice != "" {
+				choices[path[:dot]+"."+child.Choice] = true
+			}
+		}
+	}
+
+	for path, definition := range elementDefinitions {
+		if strings.HasSuffix(path, "[x]") {
+			assert.True(t, choices[path], "no types of %s", path)
+		} else {
+			_, found := fhirTypes[path]
+			assert.True(t, found, "unknown element %s", path)
+		}
+		if definition.valueSet != "" {
+			assert.Equal(t, "code", fhirTypes[path], "binding of %s", path)
+			assert.NotEmpty(t, valueSetCodes[definition.valueSet], "codes of %s", definition.valueSet)
+		}
+	}
+}
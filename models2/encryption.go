@@ -5,41 +5,111 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"unicode"
 
+	"github.com/eug48/fhir/models"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-type retainPlaintextField func(interface{}) (bson.E, error)
-
-func shouldEncryptField(name string) (bool, retainPlaintextField) {
-	switch name {
-	case
-		"name",
-		"birthDate",
-		"telecom",
-		"address",
-		"photo",
-		"contact",
-		"communication",
-		"text":
-		return true, nil
-	case "identifier":
-		return true, removeSensitiveIdentifiers
-	default:
-		return false, nil
+// EncryptionPolicy lists the elements of resources that are stored encrypted. Encrypted elements
+// can't be searched.
+type EncryptionPolicy struct {
+	// Top-level elements, e.g. Patient.name or Observation.valueString,
+	// or Observation.value[x] for all the types of a choice element
+	Paths []string `json:"paths"`
+
+	// Systems of the identifiers to encrypt by resource type, e.g. Patient: [http://ns.electronichealth.net.au/id/hi/mc].
+	// A resource's other identifiers remain searchable.
+	IdentifierSystems map[string][]string `json:"identifierSystems"`
+}
+
+// PatientDetailsEncryptionPolicy is applied to Patients written with the X-GoFHIR-Encrypt-Patient-Details header
+var PatientDetailsEncryptionPolicy = &EncryptionPolicy{
+	Paths: []string{
+		"Patient.name",
+		"Patient.birthDate",
+		"Patient.telecom",
+		"Patient.address",
+		"Patient.photo",
+		"Patient.contact",
+		"Patient.communication",
+		"Patient.text",
+	},
+	IdentifierSystems: map[string][]string{
+		/* Encrypt Australian Medicare numbers due to a list of numbers & names having been leaked.. */
+		"Patient": {"http://ns.electronichealth.net.au/id/hi/mc"},
+	},
+}
+
+// Validate checks that the policy's paths are of top-level elements of resources
+func (p *EncryptionPolicy) Validate() error {
+	for _, path := range p.Paths {
+		parts := strings.Split(path, ".")
+		if len(parts) != 2 {
+			return errors.Errorf("encryption policy path %s isn't of a top-level element of a resource", path)
+		}
+		resourceType, element := parts[0], parts[1]
+		if models.StructForResourceName(resourceType) == nil {
+			return errors.Errorf("encryption policy path %s: unknown resource type %s", path, resourceType)
+		}
+		if element == "id" || element == "meta" || element == "resourceType" {
+			return errors.Errorf("encryption policy path %s: %s can't be encrypted", path, element)
+		}
+		children, _ := ChildElements(resourceType)
+		found := false
+		for _, child := range children {
+			if elementMatches(element, child.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("encryption policy path %s: unknown element", path)
+		}
+	}
+	for resourceType := range p.IdentifierSystems {
+		if models.StructForResourceName(resourceType) == nil {
+			return errors.Errorf("encryption policy identifierSystems: unknown resource type %s", resourceType)
+		}
+	}
+	return nil
+}
+
+// encryptsElement returns whether a top-level element of a type of resource is encrypted in full
+func (p *EncryptionPolicy) encryptsElement(resourceType string, name string) bool {
+	for _, path := range p.Paths {
+		if strings.HasPrefix(path, resourceType+".") && elementMatches(path[len(resourceType)+1:], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// elementMatches returns whether the element of a policy path (e.g. valueString or value[x]) matches an element's name
+func elementMatches(element string, name string) bool {
+	if !strings.HasSuffix(element, "[x]") {
+		return element == name
 	}
+	prefix := strings.TrimSuffix(element, "[x]")
+	return len(name) > len(prefix) && strings.HasPrefix(name, prefix) && unicode.IsUpper(rune(name[len(prefix)]))
 }
 
-func removeSensitiveIdentifiers(identifiers interface{}) (bson.E, error) {
+// removeSensitiveIdentifiers returns the identifiers that don't have one of the sensitive systems,
+// and whether any were removed
+func removeSensitiveIdentifiers(identifiers interface{}, sensitiveSystems []string) (bson.E, bool) {
 
-	/* Encrypt Australian Medicare numbers due to a list of numbers & names having been leaked.. */
 	/* Other identifiers remain unencrypted and searchable */
 
 	identifiersToKeepUnencrypted := make([]interface{}, 0, 4)
+	removed := false
 
 	rvalue := reflect.ValueOf(identifiers)
 	for i := 0; i < rvalue.Len(); i++ {
@@ -52,16 +122,20 @@ func removeSensitiveIdentifiers(identifiers interface{}) (bson.E, error) {
 
 			if field.Key == "system" {
 				value, ok := field.Value.(string)
-				if ok && value == "http://ns.electronichealth.net.au/id/hi/mc" {
-					sensitive = true
-					break
-				} else {
-					break
+				if ok {
+					for _, system := range sensitiveSystems {
+						if value == system {
+							sensitive = true
+						}
+					}
 				}
+				break
 			}
 		}
 
-		if !sensitive {
+		if sensitive {
+			removed = true
+		} else {
 			identifiersToKeepUnencrypted = append(identifiersToKeepUnencrypted, identifier)
 		}
 	}
@@ -70,53 +144,230 @@ func removeSensitiveIdentifiers(identifiers interface{}) (bson.E, error) {
 		Key:   "identifier",
 		Value: identifiersToKeepUnencrypted,
 	}
-	return output, nil
+	return output, removed
 
 }
 
 type WhatToEncrypt struct {
 	PatientDetails bool
+
+	// e.g. the policy of the database a resource is written to
+	Policy *EncryptionPolicy
+}
+
+// policies returns the encryption policies that apply to a type of resource
+func (w WhatToEncrypt) policies(resourceType string) []*EncryptionPolicy {
+	var policies []*EncryptionPolicy
+	if w.PatientDetails && resourceType == "Patient" {
+		policies = append(policies, PatientDetailsEncryptionPolicy)
+	}
+	if w.Policy != nil {
+		policies = append(policies, w.Policy)
+	}
+	return policies
+}
+
+// Keyring holds encryption keys by id. New data is encrypted with the current key and
+// stored together with its id, so that it can be decrypted after the current key is rotated.
+type Keyring struct {
+	ciphers      map[string]cipher.Block
+	blindKeys    map[string][]byte
+	currentKeyId string
+}
+
+// NewKeyring creates a keyring from 32-byte AES keys by id
+func NewKeyring(keys map[string][]byte, currentKeyId string) (*Keyring, error) {
+	if _, found := keys[currentKeyId]; !found {
+		return nil, errors.Errorf("NewKeyring: the current key (%s) is missing", currentKeyId)
+	}
+	keyring := &Keyring{
+		ciphers:      make(map[string]cipher.Block, len(keys)),
+		blindKeys:    make(map[string][]byte, len(keys)),
+		currentKeyId: currentKeyId,
+	}
+	for keyId, key := range keys {
+		if keyId == "" {
+			return nil, errors.New("NewKeyring: empty key id")
+		}
+		if len(key) != 32 {
+			return nil, errors.Errorf("NewKeyring: key %s should be 32 bytes", keyId)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewCipher failed")
+		}
+		keyring.ciphers[keyId] = block
+		keyring.blindKeys[keyId] = blindIndexKey(key)
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyfile with base64-encoded keys by id and the id of the current key, e.g.
+//
+//	{
+//	  "current": "key2",
+//	  "keys": {
+//	    "key1": "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=",
+//	    "key2": "SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E="
+//	  }
+//	}
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadKeyring")
+	}
+	var keyfile struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &keyfile); err != nil {
+		return nil, errors.Wrapf(err, "LoadKeyring: failed to parse %s", path)
+	}
+	keys := make(map[string][]byte, len(keyfile.Keys))
+	for keyId, keyB64 := range keyfile.Keys {
+		keys[keyId], err = base64.StdEncoding.DecodeString(keyB64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "LoadKeyring: invalid key %s in %s", keyId, path)
+		}
+	}
+	keyring, err := NewKeyring(keys, keyfile.Current)
+	if err != nil {
+		return nil, errors.Wrapf(err, "LoadKeyring: invalid keyfile %s", path)
+	}
+	return keyring, nil
 }
 
-var _cachedCipher cipher.Block
-var _cachedKeyId string
+// CurrentKeyId returns the id of the key used for new data
+func (k *Keyring) CurrentKeyId() string {
+	return k.currentKeyId
+}
+
+func (k *Keyring) cipher(keyId string) (cipher.Block, error) {
+	block, found := k.ciphers[keyId]
+	if !found {
+		return nil, errors.Errorf("encryption key %s isn't in the keyring", keyId)
+	}
+	return block, nil
+}
+
+var keyringMutex sync.Mutex
+var keyring *Keyring
+
+// SetKeyring sets the keys used to encrypt and decrypt resources. Without a keyring (or after
+// SetKeyring(nil)) a single key is read from environment variables.
+func SetKeyring(k *Keyring) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	keyring = k
+}
 
-func getCipher() (cipher.Block, string, error) {
-	if _cachedCipher != nil && _cachedKeyId != "" {
-		return _cachedCipher, _cachedKeyId, nil
+// CurrentKeyring returns the keyring set with SetKeyring, or one with the key in the
+// GOFHIR_ENCRYPTION_KEY_BASE64 and GOFHIR_ENCRYPTION_KEY_ID environment variables
+func CurrentKeyring() (*Keyring, error) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	if keyring != nil {
+		return keyring, nil
 	}
 
 	// to set in the fish shell
 	// set -x GOFHIR_ENCRYPTION_KEY_BASE64  (dd if=/dev/random bs=32 count=1 | base64)
 	// set -x GOFHIR_ENCRYPTION_KEY_ID testKey
 	keyB64 := os.Getenv("GOFHIR_ENCRYPTION_KEY_BASE64")
-	_cachedKeyId := os.Getenv("GOFHIR_ENCRYPTION_KEY_ID")
+	keyId := os.Getenv("GOFHIR_ENCRYPTION_KEY_ID")
 	if keyB64 == "" {
-		return nil, "", errors.New("missing environment variable: GOFHIR_ENCRYPTION_KEY_BASE64")
+		return nil, errors.New("missing environment variable: GOFHIR_ENCRYPTION_KEY_BASE64")
 	}
-	if _cachedKeyId == "" {
-		return nil, "", errors.New("missing environment variable: GOFHIR_ENCRYPTION_KEY_ID")
+	if keyId == "" {
+		return nil, errors.New("missing environment variable: GOFHIR_ENCRYPTION_KEY_ID")
 	}
 	key, err := base64.StdEncoding.DecodeString(keyB64)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "invalid environment variable: GOFHIR_ENCRYPTION_BASE64")
+		return nil, errors.Wrap(err, "invalid environment variable: GOFHIR_ENCRYPTION_KEY_BASE64")
 	}
 	if len(key) != 32 {
-		return nil, "", errors.New("environment variable should be 32 bytes: GOFHIR_ENCRYPTION_BASE64")
+		return nil, errors.New("environment variable should be 32 bytes: GOFHIR_ENCRYPTION_KEY_BASE64")
+	}
+
+	k, err := NewKeyring(map[string][]byte{keyId: key}, keyId)
+	if err != nil {
+		return nil, err
 	}
+	keyring = k
+	return keyring, nil
+}
 
-	_cachedCipher, err := aes.NewCipher(key)
+// seal encrypts with AES-GCM -- based on https://github.com/gtank/cryptopasta/blob/master/encrypt.go
+func seal(block cipher.Block, plaintext []byte) (string, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", errors.Wrap(err, "NewGCM failed")
+	}
+
+	nonce := make([]byte, gcm.NonceSize()) // random nonce
+	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "NewCipher failed")
+		return "", errors.Wrap(err, "failed to generate random nonce for GCM")
 	}
 
-	return _cachedCipher, _cachedKeyId, nil
+	// output is random nonce | GCM ciphertext | GCM tag
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// open decrypts the output of seal
+func open(block cipher.Block, ciphertextB64 string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextB64)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to base64-decode __gofhirEncryptedBSON")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewGCM failed")
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("failed to decode __gofhirEncryptedBSON: too short")
+	}
+
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt __gofhirEncryptedBSON")
+	}
+	return plaintext, nil
+}
+
+// encryptedFields returns the ciphertext and key id of an encrypted document
+func encryptedFields(bsonRoot []bson.E) (ciphertextB64 string, keyId string, err error) {
+	var ok bool
+	for _, elem := range bsonRoot {
+		switch elem.Key {
+		case "__gofhirEncryptedBSON":
+			ciphertextB64, ok = elem.Value.(string)
+			if !ok {
+				return "", "", errors.New("__gofhirEncryptedBSON not a string")
+			}
+
+		case "__gofhirEncryptionKeyId":
+			keyId, ok = elem.Value.(string)
+			if !ok {
+				return "", "", errors.New("__gofhirEncryptionKeyId not a string")
+			}
+		}
+	}
+	return ciphertextB64, keyId, nil
 }
 
 func encryptBSON(bsonRoot *[]bson.E, resourceType string, whatToEncrypt WhatToEncrypt) error {
-	if whatToEncrypt.PatientDetails == false || resourceType != "Patient" {
+	policies := whatToEncrypt.policies(resourceType)
+	if len(policies) == 0 {
 		return nil
 	}
+	var sensitiveSystems []string
+	for _, policy := range policies {
+		sensitiveSystems = append(sensitiveSystems, policy.IdentifierSystems[resourceType]...)
+	}
 
 	// will be encrypted
 	plaintext := make([]bson.E, 0, 4)
@@ -125,51 +376,56 @@ func encryptBSON(bsonRoot *[]bson.E, resourceType string, whatToEncrypt WhatToEn
 	newBsonRoot := make([]bson.E, 0, len(*bsonRoot))
 
 	for _, elem := range *bsonRoot {
-		if shouldEncrypt, retainPlaintextFunc := shouldEncryptField(elem.Key); shouldEncrypt {
-			plaintext = append(plaintext, elem)
+		encrypt := false
+		for _, policy := range policies {
+			if policy.encryptsElement(resourceType, elem.Key) {
+				encrypt = true
+			}
+		}
 
-			// some fields only partially encrypted (e.g. identifier)
-			if retainPlaintextFunc != nil {
-				retain, err := retainPlaintextFunc(elem.Value)
-				if err != nil {
-					return errors.Wrapf(err, "retainPlaintextFunc failed for field %s", elem.Key)
-				}
-				newBsonRoot = append(newBsonRoot, retain)
+		if encrypt {
+			plaintext = append(plaintext, elem)
+		} else if elem.Key == "identifier" && len(sensitiveSystems) > 0 {
+			// identifiers are only partially encrypted
+			retain, removed := removeSensitiveIdentifiers(elem.Value, sensitiveSystems)
+			if removed {
+				plaintext = append(plaintext, elem)
 			}
+			newBsonRoot = append(newBsonRoot, retain)
 		} else {
 			newBsonRoot = append(newBsonRoot, elem)
 		}
 	}
 
+	if len(plaintext) == 0 {
+		return nil
+	}
+
 	// convert plaintext to bson bytes
 	plaintextBytes, err := bson.Marshal(plaintext)
 	if err != nil {
 		return errors.Wrap(err, "bson.Marshal of plaintext failed")
 	}
 
-	// encrypt -- based on https://github.com/gtank/cryptopasta/blob/master/encrypt.go
-	block, keyId, err := getCipher()
+	// encrypt with the current key
+	keyring, err := CurrentKeyring()
 	if err != nil {
-		return errors.Wrap(err, "getCipher failed")
+		return errors.Wrap(err, "CurrentKeyring failed")
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	block, err := keyring.cipher(keyring.CurrentKeyId())
 	if err != nil {
-		return errors.Wrap(err, "NewGCM failed")
+		return err
 	}
-
-	nonce := make([]byte, gcm.NonceSize()) // random nonce
-	_, err = io.ReadFull(rand.Reader, nonce)
+	ciphertextB64, err := seal(block, plaintextBytes)
 	if err != nil {
-		return errors.Wrap(err, "failed to generate random nonce for GCM")
+		return err
 	}
 
-	// output is random nonce | GCM ciphertext | GCM tag
-	ciphertextBytes := gcm.Seal(nonce, nonce, plaintextBytes, nil)
-	ciphertextB64 := base64.StdEncoding.EncodeToString(ciphertextBytes)
-
 	newBsonRoot = append(newBsonRoot, bson.E{Key: "__gofhirEncryptedBSON", Value: ciphertextB64})
-	newBsonRoot = append(newBsonRoot, bson.E{Key: "__gofhirEncryptionKeyId", Value: keyId})
+	newBsonRoot = append(newBsonRoot, bson.E{Key: "__gofhirEncryptionKeyId", Value: keyring.CurrentKeyId()})
+
+	// so that encrypted identifiers and names can still be found by exact searches
+	newBsonRoot = append(newBsonRoot, blindIndexFields(keyring.blindKeys[keyring.CurrentKeyId()], plaintext)...)
 
 	*bsonRoot = newBsonRoot
 	return nil
@@ -177,59 +433,28 @@ func encryptBSON(bsonRoot *[]bson.E, resourceType string, whatToEncrypt WhatToEn
 
 func decryptBSON(bsonRoot *[]bson.E) error {
 
-	newBsonRoot := make([]bson.E, 0, len(*bsonRoot))
-	var ciphertextB64 string
-	var expectedKeyId string
-	var ok bool
-
-	for _, elem := range *bsonRoot {
-		switch elem.Key {
-		case "__gofhirEncryptedBSON":
-			ciphertextB64, ok = elem.Value.(string)
-			if !ok {
-				return errors.New("__gofhirEncryptedBSON not a string")
-			}
-
-		case "__gofhirEncryptionKeyId":
-			expectedKeyId, ok = elem.Value.(string)
-			if !ok {
-				return errors.New("__gofhirEncryptionKeyId not a string")
-			}
-
-		default:
-			newBsonRoot = append(newBsonRoot, elem)
-		}
+	ciphertextB64, keyId, err := encryptedFields(*bsonRoot)
+	if err != nil {
+		return err
 	}
-
 	if ciphertextB64 == "" {
 		return nil // nothing to decrypt so leave input BSON untouched
 	}
 
-	// decrypt -- based on https://github.com/gtank/cryptopasta/blob/master/encrypt.go
-	block, keyId, err := getCipher()
+	// decrypt with the key the document was encrypted with
+	keyring, err := CurrentKeyring()
 	if err != nil {
-		return errors.Wrap(err, "getCipher failed")
-	}
-	if keyId != expectedKeyId {
-		return errors.Wrapf(err, "encryption keyId (%s) doesn't match expected (%s)", keyId, expectedKeyId)
+		return errors.Wrap(err, "CurrentKeyring failed")
 	}
-
-	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextB64)
+	block, err := keyring.cipher(keyId)
 	if err != nil {
-		return errors.Wrap(err, "failed to base64-decode __gofhirEncryptedBSON")
+		return err
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	plaintextBytes, err := open(block, ciphertextB64)
 	if err != nil {
-		return errors.Wrap(err, "NewGCM failed")
+		return err
 	}
 
-	if len(ciphertext) < gcm.NonceSize() {
-		return errors.New("failed to decode __gofhirEncryptedBSON: too short")
-	}
-
-	plaintextBytes, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
-
 	// convert plaintext to bson
 	var plaintextDoc bson.D
 	err = bson.Unmarshal(plaintextBytes, &plaintextDoc)
@@ -237,6 +462,13 @@ func decryptBSON(bsonRoot *[]bson.E) error {
 		return errors.Wrap(err, "bson.Unmarshal of plaintext failed")
 	}
 
+	newBsonRoot := make([]bson.E, 0, len(*bsonRoot)+len(plaintextDoc))
+	for _, elem := range *bsonRoot {
+		if !IsEncryptionField(elem.Key) {
+			newBsonRoot = append(newBsonRoot, elem)
+		}
+	}
+
 	// add decrypted fields
 	for _, elem := range plaintextDoc {
 
@@ -258,3 +490,59 @@ func decryptBSON(bsonRoot *[]bson.E) error {
 	*bsonRoot = newBsonRoot
 	return nil
 }
+
+// RekeyBSON re-encrypts a stored document in place with the current key if it was encrypted with another one,
+// returning whether the document changed. Only the values of the fields added by encryption (see IsEncryptionField)
+// are replaced.
+func RekeyBSON(bsonRoot []bson.E) (bool, error) {
+	ciphertextB64, keyId, err := encryptedFields(bsonRoot)
+	if err != nil {
+		return false, err
+	}
+	keyring, err := CurrentKeyring()
+	if err != nil {
+		return false, errors.Wrap(err, "CurrentKeyring failed")
+	}
+	if ciphertextB64 == "" || keyId == keyring.CurrentKeyId() {
+		return false, nil
+	}
+
+	oldBlock, err := keyring.cipher(keyId)
+	if err != nil {
+		return false, err
+	}
+	plaintextBytes, err := open(oldBlock, ciphertextB64)
+	if err != nil {
+		return false, err
+	}
+	block, err := keyring.cipher(keyring.CurrentKeyId())
+	if err != nil {
+		return false, err
+	}
+	ciphertextB64, err = seal(block, plaintextBytes)
+	if err != nil {
+		return false, err
+	}
+
+	// the blind indexes are also keyed
+	var plaintextDoc bson.D
+	if err = bson.Unmarshal(plaintextBytes, &plaintextDoc); err != nil {
+		return false, errors.Wrap(err, "bson.Unmarshal of plaintext failed")
+	}
+	blindIndexes := make(map[string]interface{})
+	for _, elem := range blindIndexFields(keyring.blindKeys[keyring.CurrentKeyId()], plaintextDoc) {
+		blindIndexes[elem.Key] = elem.Value
+	}
+
+	for i, elem := range bsonRoot {
+		switch elem.Key {
+		case "__gofhirEncryptedBSON":
+			bsonRoot[i].Value = ciphertextB64
+		case "__gofhirEncryptionKeyId":
+			bsonRoot[i].Value = keyring.CurrentKeyId()
+		case BlindIdentifierField, BlindNameField:
+			bsonRoot[i].Value = blindIndexes[elem.Key]
+		}
+	}
+	return true, nil
+}
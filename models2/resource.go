@@ -1,6 +1,7 @@
 package models2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -97,8 +98,12 @@ func (r *Resource) SetTransformReferencesMap(transformReferencesMap map[string]s
 	r.cachedBson = nil
 }
 
+func (r *Resource) WhatToEncrypt() WhatToEncrypt {
+	return r.whatToEncrypt
+}
 func (r *Resource) SetWhatToEncrypt(whatToEncrypt WhatToEncrypt) {
 	r.whatToEncrypt = whatToEncrypt
+	r.cachedBson = nil
 }
 
 func dumpMalformedJson(jsonBytes []byte, jsonError error, failedRequestsDir string) error {
@@ -396,3 +401,76 @@ func NewResourceFromJsonBytes(jsonBytes []byte) (resource *Resource, err error)
 	}
 	return resource, nil
 }
+
+const subsettedTag = `{"system":"http://hl7.org/fhir/v3/ObservationValue","code":"SUBSETTED","display":"subsetted"}`
+
+// Subset returns a copy of the resource with only the top-level elements for
+// which include returns true, tagged as SUBSETTED in meta.tag.
+func (r *Resource) Subset(include func(element string) bool) (*Resource, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	err := jsonparser.ObjectEach(r.jsonBytes, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		if !include(string(key)) {
+			return nil
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('"')
+		buf.Write(key)
+		buf.WriteString(`":`)
+		if dataType == jsonparser.String {
+			// jsonparser strips the quotes (but leaves escapes as they were)
+			buf.WriteByte('"')
+			buf.Write(value)
+			buf.WriteByte('"')
+		} else {
+			buf.Write(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Subset: jsonparser.ObjectEach failed")
+	}
+	buf.WriteByte('}')
+
+	jsonBytes, err := addSubsettedTag(buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "Subset: addSubsettedTag failed")
+	}
+
+	subset := *r
+	subset.jsonBytes = jsonBytes
+	subset.cachedBson = nil
+	return &subset, nil
+}
+
+func addSubsettedTag(jsonBytes []byte) ([]byte, error) {
+	var tags []json.RawMessage
+	tagsJson, dataType, _, err := jsonparser.Get(jsonBytes, "meta", "tag")
+	if err == nil && dataType == jsonparser.Array {
+		err = json.Unmarshal(tagsJson, &tags)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse meta.tag")
+		}
+	} else if err != nil && err != jsonparser.KeyPathNotFoundError {
+		return nil, errors.Wrap(err, "failed to get meta.tag")
+	}
+
+	for _, tag := range tags {
+		var coding struct {
+			System string `json:"system"`
+			Code   string `json:"code"`
+		}
+		if json.Unmarshal(tag, &coding) == nil && coding.Code == "SUBSETTED" && coding.System == "http://hl7.org/fhir/v3/ObservationValue" {
+			return jsonBytes, nil
+		}
+	}
+
+	tags = append(tags, json.RawMessage(subsettedTag))
+	tagsJson, err = json.Marshal(tags)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal meta.tag")
+	}
+	return jsonparser.Set(jsonBytes, tagsJson, "meta", "tag")
+}
@@ -0,0 +1,44 @@
+package models2
+
+import (
+	"testing"
+
+	"github.com/buger/jsonparser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubset(t *testing.T) {
+	resource, err := NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": { "versionId": "1", "tag": [{ "system": "http://example.org", "code": "test" }] },
+		"text": { "status": "generated", "div": "<div>\"Donald\" Duck</div>" },
+		"gender": "male",
+		"_gender": { "extension": [{ "url": "http://example.org/ext", "valueString": "x" }] }
+	}`))
+	assert.Nil(t, err)
+
+	subset, err := resource.Subset(func(element string) bool {
+		return element != "gender" && element != "_gender"
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "123", subset.Id())
+	assert.Equal(t, "1", subset.VersionId())
+
+	json := subset.JsonBytes()
+	div, err := jsonparser.GetString(json, "text", "div")
+	assert.Nil(t, err)
+	assert.Equal(t, `<div>"Donald" Duck</div>`, div)
+	_, _, _, err = jsonparser.Get(json, "gender")
+	assert.Equal(t, jsonparser.KeyPathNotFoundError, err)
+
+	code, err := jsonparser.GetString(json, "meta", "tag", "[1]", "code")
+	assert.Nil(t, err)
+	assert.Equal(t, "SUBSETTED", code)
+
+	// subsetting again shouldn't add a second tag
+	again, err := subset.Subset(func(string) bool { return true })
+	assert.Nil(t, err)
+	_, _, _, err = jsonparser.Get(again.JsonBytes(), "meta", "tag", "[2]")
+	assert.NotNil(t, err)
+}
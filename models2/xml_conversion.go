@@ -0,0 +1,885 @@
+package models2
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+)
+
+// Conversion between the XML (http://hl7.org/fhir/STU3/xml.html) and
+// JSON (http://hl7.org/fhir/STU3/json.html) representations of resources.
+// The types of elements come from fhirTypes, while whether they repeat and the order
+// in which they must appear in XML come from the structs in the models package.
+
+const fhirNamespace = "http://hl7.org/fhir"
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+var decimalRegex = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+var integerRegex = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+
+// XmlToJson converts a resource from XML to JSON, reading the XML token by token
+func XmlToJson(xmlBytes []byte) ([]byte, error) {
+	converter := xmlToJsonConverter{
+		input:   xmlBytes,
+		decoder: xml.NewDecoder(bytes.NewReader(xmlBytes)),
+	}
+	resource, err := converter.readRoot()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeOrderedJSON(&buf, resource)
+	return buf.Bytes(), nil
+}
+
+// JsonToXml converts a resource from JSON to XML, writing elements in the order of their definitions
+func JsonToXml(jsonBytes []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	value, err := readOrderedJSON(decoder)
+	if err != nil {
+		return nil, errors.Wrap(err, "JsonToXml: failed to parse JSON")
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("JsonToXml: unexpected data after the resource")
+	}
+	resource, isObject := value.(*orderedObject)
+	if !isObject {
+		return nil, errors.New("JsonToXml: resource isn't a JSON object")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	err = writeXmlResource(&buf, resource, true, "")
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xmlPosition is an element whose children are being converted
+type xmlPosition struct {
+	// prefix of the element's children in fhirTypes, e.g. Patient, Patient.contact or HumanName
+	element string
+
+	// struct for the element in the models package
+	goType reflect.Type
+
+	isResource bool
+}
+
+type xmlChild struct {
+	name      string
+	fhirType  string
+	repeating bool
+
+	// for complex children
+	position xmlPosition
+}
+
+func resourcePosition(resourceType string, at string) (xmlPosition, error) {
+	if _, found := fhirTypes[resourceType+".id"]; !found {
+		return xmlPosition{}, FhirSchemaError{at: at, msg: fmt.Sprintf("unknown resource type %s", resourceType)}
+	}
+	goType := reflect.TypeOf(models.StructForResourceName(resourceType))
+	if resourceType == "Parameters" {
+		// isn't stored so isn't known to StructForResourceName
+		goType = reflect.TypeOf(models.Parameters{})
+	}
+	return xmlPosition{
+		element:    resourceType,
+		goType:     modelStructType(goType),
+		isResource: true,
+	}, nil
+}
+
+func (p xmlPosition) child(name string, at string) (xmlChild, error) {
+	key := p.element + "." + name
+	fhirType, found := fhirTypes[key]
+	if !found {
+		return xmlChild{}, FhirSchemaError{at: at, msg: fmt.Sprintf("unknown element %s", key)}
+	}
+
+	child := xmlChild{name: name, fhirType: fhirType}
+	goType, hasField := fieldsOfModel(p.goType).types[name]
+	if hasField {
+		child.repeating = goType.Kind() == reflect.Slice
+	} else {
+		// the Element fields of data types aren't in their structs
+		child.repeating = name == "extension" || name == "modifierExtension"
+	}
+
+	if isPrimitiveType(fhirType) || fhirType == "xhtml" || fhirType == "Resource" {
+		return child, nil
+	}
+
+	child.position.element = fhirType
+	if fhirType == "BackboneElement" || fhirType == "Element" {
+		child.position.element = key
+	}
+	if hasField {
+		child.position.goType = modelStructType(goType)
+	} else if fhirType == "Extension" {
+		child.position.goType = reflect.TypeOf(models.Extension{})
+	}
+	return child, nil
+}
+
+// isAttribute reports whether a child of a complex element is represented by an XML attribute
+func (p xmlPosition) isAttribute(name string) bool {
+	return (name == "id" && !p.isResource) || (name == "url" && p.element == "Extension")
+}
+
+func isPrimitiveType(fhirType string) bool {
+	return fhirType != "" && fhirType != "xhtml" && unicode.IsLower(rune(fhirType[0]))
+}
+
+func isNumberType(fhirType string) bool {
+	return fhirType == "decimal" || fhirType == "integer" || fhirType == "positiveInt" || fhirType == "unsignedInt"
+}
+
+// modelFields are the JSON field names of a struct in the models package, including embedded ones
+type modelFields struct {
+	order map[string]int
+	types map[string]reflect.Type
+}
+
+var modelFieldsCache sync.Map
+
+func fieldsOfModel(t reflect.Type) *modelFields {
+	if t == nil {
+		return &modelFields{}
+	}
+	if cached, found := modelFieldsCache.Load(t); found {
+		return cached.(*modelFields)
+	}
+
+	fields := &modelFields{
+		order: map[string]int{},
+		types: map[string]reflect.Type{},
+	}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous {
+				if embedded := modelStructType(field.Type); embedded != nil {
+					addFields(embedded)
+				}
+				continue
+			}
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if _, duplicate := fields.order[name]; name == "" || name == "-" || duplicate {
+				continue
+			}
+			fields.order[name] = len(fields.order)
+			fields.types[name] = field.Type
+		}
+	}
+	addFields(t)
+
+	modelFieldsCache.Store(t, fields)
+	return fields
+}
+
+// position is used to sort the children of an element into the order of their definitions
+func (f *modelFields) position(name string) int {
+	if position, found := f.order[name]; found {
+		return position
+	}
+	switch name {
+	case "id":
+		return -3
+	case "extension":
+		return -2
+	case "modifierExtension":
+		return -1
+	default:
+		return len(f.order)
+	}
+}
+
+func modelStructType(t reflect.Type) reflect.Type {
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// orderedObject is a JSON object that keeps the order of its keys
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: map[string]interface{}{}}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, exists := o.values[key]; !exists {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// primitiveValues are the occurrences of a primitive element read from XML,
+// which become its values and the ids and extensions of the "_" property in JSON
+type primitiveValues struct {
+	repeating bool
+	values    []interface{}
+	elements  []interface{}
+}
+
+type xmlToJsonConverter struct {
+	input   []byte
+	decoder *xml.Decoder
+}
+
+// token also returns the offset of the start of the token in the input
+func (c *xmlToJsonConverter) token() (xml.Token, int64, error) {
+	offset := c.decoder.InputOffset()
+	token, err := c.decoder.Token()
+	if err != nil && err != io.EOF {
+		err = errors.Wrap(err, "XmlToJson: failed to parse XML")
+	}
+	return token, offset, err
+}
+
+func (c *xmlToJsonConverter) readRoot() (*orderedObject, error) {
+	var resource *orderedObject
+	for {
+		token, _, err := c.token()
+		if err == io.EOF {
+			if resource == nil {
+				return nil, errors.New("XmlToJson: no resource found")
+			}
+			return resource, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if resource != nil {
+				return nil, errors.New("XmlToJson: unexpected element after the resource")
+			}
+			resource, err = c.readResource(t, "")
+			if err != nil {
+				return nil, err
+			}
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("XmlToJson: unexpected text outside the resource")
+			}
+		}
+	}
+}
+
+func (c *xmlToJsonConverter) readResource(start xml.StartElement, at string) (*orderedObject, error) {
+	resourceType := start.Name.Local
+	at = at + "(" + resourceType + ")"
+	if start.Name.Space != fhirNamespace {
+		return nil, FhirSchemaError{at: at, msg: fmt.Sprintf("resource isn't in the %s namespace", fhirNamespace)}
+	}
+	position, err := resourcePosition(resourceType, at)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := newOrderedObject()
+	resource.set("resourceType", resourceType)
+	err = c.readAttributes(start, resource, position, at)
+	if err != nil {
+		return nil, err
+	}
+	return resource, c.readChildren(resource, position, at)
+}
+
+func (c *xmlToJsonConverter) readElement(start xml.StartElement, position xmlPosition, at string) (*orderedObject, error) {
+	element := newOrderedObject()
+	err := c.readAttributes(start, element, position, at)
+	if err != nil {
+		return nil, err
+	}
+	return element, c.readChildren(element, position, at)
+}
+
+func (c *xmlToJsonConverter) readAttributes(start xml.StartElement, element *orderedObject, position xmlPosition, at string) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Space != "" || attr.Name.Local == "xmlns" {
+			// namespace declarations and attributes such as xsi:schemaLocation
+			continue
+		}
+		if !position.isAttribute(attr.Name.Local) {
+			return FhirSchemaError{at: at, msg: fmt.Sprintf("unexpected attribute %s", attr.Name.Local)}
+		}
+		element.set(attr.Name.Local, attr.Value)
+	}
+	return nil
+}
+
+// readChildren reads the content of a complex element up to its end tag
+func (c *xmlToJsonConverter) readChildren(element *orderedObject, position xmlPosition, at string) error {
+	for {
+		token, offset, err := c.token()
+		if err == io.EOF {
+			return errors.New("XmlToJson: unexpected end of XML")
+		} else if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.EndElement:
+			return nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return FhirSchemaError{at: at, msg: "unexpected text"}
+			}
+		case xml.StartElement:
+			name := t.Name.Local
+			childAt := at + "." + name
+			if t.Name.Space != fhirNamespace && name != "div" {
+				return FhirSchemaError{at: childAt, msg: fmt.Sprintf("element isn't in the %s namespace", fhirNamespace)}
+			}
+			child, err := position.child(name, childAt)
+			if err != nil {
+				return err
+			}
+			if position.isAttribute(name) {
+				return FhirSchemaError{at: childAt, msg: "should be an attribute"}
+			}
+
+			if isPrimitiveType(child.fhirType) {
+				err = c.readPrimitive(t, element, child, childAt)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			var value interface{}
+			switch child.fhirType {
+			case "xhtml":
+				value, err = c.readXhtml(t, offset, childAt)
+			case "Resource":
+				value, err = c.readContainedResource(childAt)
+			default:
+				value, err = c.readElement(t, child.position, childAt)
+			}
+			if err != nil {
+				return err
+			}
+
+			existing, exists := element.values[name]
+			if child.repeating {
+				values, _ := existing.([]interface{})
+				element.set(name, append(values, value))
+			} else if exists {
+				return FhirSchemaError{at: childAt, msg: "element doesn't repeat"}
+			} else {
+				element.set(name, value)
+			}
+		}
+	}
+}
+
+func (c *xmlToJsonConverter) readPrimitive(start xml.StartElement, element *orderedObject, child xmlChild, at string) error {
+	var value interface{}
+	var extensions *orderedObject
+	for _, attr := range start.Attr {
+		if attr.Name.Space != "" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		switch attr.Name.Local {
+		case "value":
+			var err error
+			value, err = primitiveJsonValue(child.fhirType, attr.Value, at)
+			if err != nil {
+				return err
+			}
+		case "id":
+			if extensions == nil {
+				extensions = newOrderedObject()
+			}
+			extensions.set("id", attr.Value)
+		default:
+			return FhirSchemaError{at: at, msg: fmt.Sprintf("unexpected attribute %s", attr.Name.Local)}
+		}
+	}
+
+	// a primitive element can only contain extensions
+	primitivePosition := xmlPosition{element: "_"}
+	childExtensions := newOrderedObject()
+	err := c.readChildren(childExtensions, primitivePosition, at)
+	if err != nil {
+		return err
+	}
+	if extensionList, found := childExtensions.values["extension"]; found {
+		if extensions == nil {
+			extensions = newOrderedObject()
+		}
+		extensions.set("extension", extensionList)
+	}
+	if value == nil && extensions == nil {
+		return FhirSchemaError{at: at, msg: "element has neither a value nor extensions"}
+	}
+
+	existing, exists := element.values[child.name]
+	if exists && !child.repeating {
+		return FhirSchemaError{at: at, msg: "element doesn't repeat"}
+	}
+	primitive, _ := existing.(*primitiveValues)
+	if primitive == nil {
+		primitive = &primitiveValues{repeating: child.repeating}
+		element.set(child.name, primitive)
+	}
+	primitive.values = append(primitive.values, value)
+	if extensions != nil {
+		primitive.elements = append(primitive.elements, extensions)
+	} else {
+		primitive.elements = append(primitive.elements, nil)
+	}
+	return nil
+}
+
+func primitiveJsonValue(fhirType string, value string, at string) (interface{}, error) {
+	switch {
+	case fhirType == "boolean":
+		if value != "true" && value != "false" {
+			return nil, FhirSchemaError{at: at, msg: fmt.Sprintf("invalid boolean %q", value)}
+		}
+		return value == "true", nil
+	case isNumberType(fhirType):
+		regex := integerRegex
+		if fhirType == "decimal" {
+			regex = decimalRegex
+		}
+		if !regex.MatchString(value) {
+			return nil, FhirSchemaError{at: at, msg: fmt.Sprintf("invalid %s %q", fhirType, value)}
+		}
+		// kept as text to preserve the precision of decimals
+		return json.Number(value), nil
+	default:
+		return value, nil
+	}
+}
+
+// readXhtml returns a narrative's div as it was written in the XML
+func (c *xmlToJsonConverter) readXhtml(start xml.StartElement, offset int64, at string) (string, error) {
+	if start.Name.Space != xhtmlNamespace || start.Name.Local != "div" {
+		return "", FhirSchemaError{at: at, msg: fmt.Sprintf("narrative should be a div in the %s namespace", xhtmlNamespace)}
+	}
+	err := c.decoder.Skip()
+	if err != nil {
+		return "", errors.Wrap(err, "XmlToJson: failed to parse narrative")
+	}
+	div := string(c.input[offset:c.decoder.InputOffset()])
+	if !strings.HasPrefix(div, "<div") {
+		return "", FhirSchemaError{at: at, msg: "narrative div should use the default namespace"}
+	}
+
+	startTagEnd := strings.IndexByte(div, '>')
+	if !strings.Contains(div[:startTagEnd], "xmlns=") {
+		// declared on an ancestor
+		div = `<div xmlns="` + xhtmlNamespace + `"` + div[len("<div"):]
+	}
+	return div, nil
+}
+
+// readContainedResource reads an element such as contained or Bundle.entry.resource that holds a resource
+func (c *xmlToJsonConverter) readContainedResource(at string) (*orderedObject, error) {
+	var resource *orderedObject
+	for {
+		token, _, err := c.token()
+		if err == io.EOF {
+			return nil, errors.New("XmlToJson: unexpected end of XML")
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.EndElement:
+			if resource == nil {
+				return nil, FhirSchemaError{at: at, msg: "no resource found"}
+			}
+			return resource, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil, FhirSchemaError{at: at, msg: "unexpected text"}
+			}
+		case xml.StartElement:
+			if resource != nil {
+				return nil, FhirSchemaError{at: at, msg: "more than one resource"}
+			}
+			resource, err = c.readResource(t, at)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func writeOrderedJSON(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case *orderedObject:
+		buf.WriteByte('{')
+		first := true
+		for _, key := range v.keys {
+			if primitive, isPrimitive := v.values[key].(*primitiveValues); isPrimitive {
+				if values, any := primitive.jsonValue(primitive.values); any {
+					first = writeJSONKey(buf, key, first)
+					writeOrderedJSON(buf, values)
+				}
+				if elements, any := primitive.jsonValue(primitive.elements); any {
+					first = writeJSONKey(buf, "_"+key, first)
+					writeOrderedJSON(buf, elements)
+				}
+				continue
+			}
+			first = writeJSONKey(buf, key, first)
+			writeOrderedJSON(buf, v.values[key])
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeOrderedJSON(buf, item)
+		}
+		buf.WriteByte(']')
+	case string:
+		writeJSONString(buf, v)
+	case json.Number:
+		buf.WriteString(string(v))
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case nil:
+		buf.WriteString("null")
+	default:
+		panic(fmt.Errorf("writeOrderedJSON: unexpected %T", value))
+	}
+}
+
+// jsonValue returns a single value or a list, depending on whether the element repeats,
+// and whether there are any non-null values at all
+func (p *primitiveValues) jsonValue(values []interface{}) (interface{}, bool) {
+	for _, value := range values {
+		if value != nil {
+			if p.repeating {
+				return values, true
+			}
+			return values[0], true
+		}
+	}
+	return nil, false
+}
+
+func writeJSONKey(buf *bytes.Buffer, key string, first bool) bool {
+	if !first {
+		buf.WriteByte(',')
+	}
+	writeJSONString(buf, key)
+	buf.WriteByte(':')
+	return false
+}
+
+func writeJSONString(buf *bytes.Buffer, value string) {
+	// like CustomFhirRenderer, without escaping <, > and &
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	buf.Truncate(buf.Len() - 1) // newline
+}
+
+// readOrderedJSON reads a JSON value, keeping the order of object keys and the text of numbers
+func readOrderedJSON(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := newOrderedObject()
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object.set(keyToken.(string), value)
+		}
+		_, err = decoder.Token()
+		return object, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := readOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token()
+		return list, err
+	default:
+		return token, nil
+	}
+}
+
+func writeXmlResource(buf *bytes.Buffer, resource *orderedObject, root bool, at string) error {
+	resourceType, _ := resource.values["resourceType"].(string)
+	at = at + "(" + resourceType + ")"
+	position, err := resourcePosition(resourceType, at)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString("<" + resourceType)
+	if root {
+		buf.WriteString(` xmlns="` + fhirNamespace + `"`)
+	}
+	buf.WriteByte('>')
+	err = writeXmlChildren(buf, resource, position, at)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("</" + resourceType + ">")
+	return nil
+}
+
+func writeXmlElement(buf *bytes.Buffer, name string, value interface{}, position xmlPosition, at string) error {
+	element, isObject := value.(*orderedObject)
+	if !isObject {
+		return FhirSchemaError{at: at, msg: "should be a JSON object"}
+	}
+
+	buf.WriteString("<" + name)
+	for _, attribute := range []string{"id", "url"} {
+		if value, found := element.values[attribute]; found && position.isAttribute(attribute) {
+			err := writeXmlAttribute(buf, attribute, value, at)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	buf.WriteByte('>')
+	err := writeXmlChildren(buf, element, position, at)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+func writeXmlChildren(buf *bytes.Buffer, element *orderedObject, position xmlPosition, at string) error {
+	// a primitive's id and extensions in "_name" go with its value in "name"
+	var names []string
+	seen := map[string]bool{}
+	for _, key := range element.keys {
+		name := strings.TrimPrefix(key, "_")
+		if key == "resourceType" || position.isAttribute(key) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	fields := fieldsOfModel(position.goType)
+	sort.SliceStable(names, func(i, j int) bool {
+		return fields.position(names[i]) < fields.position(names[j])
+	})
+
+	for _, name := range names {
+		childAt := at + "." + name
+		child, err := position.child(name, childAt)
+		if err != nil {
+			return err
+		}
+		values := element.values[name]
+
+		if isPrimitiveType(child.fhirType) {
+			err = writeXmlPrimitive(buf, child, values, element.values["_"+name], childAt)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, hasExtensions := element.values["_"+name]; hasExtensions {
+			return FhirSchemaError{at: childAt, msg: "only primitive elements can have a _" + name}
+		}
+
+		list, isList := values.([]interface{})
+		if isList != child.repeating {
+			return FhirSchemaError{at: childAt, msg: fmt.Sprintf("element should be a list: %t", child.repeating)}
+		}
+		if !isList {
+			list = []interface{}{values}
+		}
+		for _, value := range list {
+			switch child.fhirType {
+			case "xhtml":
+				err = writeXhtml(buf, value, childAt)
+			case "Resource":
+				resource, isObject := value.(*orderedObject)
+				if !isObject {
+					return FhirSchemaError{at: childAt, msg: "should be a resource"}
+				}
+				buf.WriteString("<" + name + ">")
+				err = writeXmlResource(buf, resource, false, childAt)
+				buf.WriteString("</" + name + ">")
+			default:
+				err = writeXmlElement(buf, name, value, child.position, childAt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeXmlPrimitive(buf *bytes.Buffer, child xmlChild, values interface{}, extensions interface{}, at string) error {
+	valueList, isList := values.([]interface{})
+	extensionList, extensionsAreList := extensions.([]interface{})
+	if (values != nil && isList != child.repeating) || (extensions != nil && extensionsAreList != child.repeating) {
+		return FhirSchemaError{at: at, msg: fmt.Sprintf("element should be a list: %t", child.repeating)}
+	}
+	if !child.repeating {
+		valueList = []interface{}{values}
+		extensionList = []interface{}{extensions}
+	}
+	if values != nil && extensions != nil && len(valueList) != len(extensionList) {
+		return FhirSchemaError{at: at, msg: "values and _" + child.name + " have different lengths"}
+	}
+
+	count := len(valueList)
+	if len(extensionList) > count {
+		count = len(extensionList)
+	}
+	for i := 0; i < count; i++ {
+		var value, extension interface{}
+		if i < len(valueList) {
+			value = valueList[i]
+		}
+		if i < len(extensionList) {
+			extension = extensionList[i]
+		}
+		if value == nil && extension == nil {
+			continue
+		}
+
+		buf.WriteString("<" + child.name)
+		var extensionElement *orderedObject
+		if extension != nil {
+			var isObject bool
+			extensionElement, isObject = extension.(*orderedObject)
+			if !isObject {
+				return FhirSchemaError{at: at, msg: "_" + child.name + " should be a JSON object"}
+			}
+			for _, key := range extensionElement.keys {
+				if key != "id" && key != "extension" {
+					return FhirSchemaError{at: at, msg: fmt.Sprintf("unexpected %s in _%s", key, child.name)}
+				}
+			}
+			if id, found := extensionElement.values["id"]; found {
+				err := writeXmlAttribute(buf, "id", id, at)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if value != nil {
+			err := writeXmlAttribute(buf, "value", value, at)
+			if err != nil {
+				return err
+			}
+		}
+
+		if extensionElement == nil || extensionElement.values["extension"] == nil {
+			buf.WriteString("/>")
+			continue
+		}
+		buf.WriteByte('>')
+		primitivePosition := xmlPosition{element: "_"}
+		extensionOnly := newOrderedObject()
+		extensionOnly.set("extension", extensionElement.values["extension"])
+		err := writeXmlChildren(buf, extensionOnly, primitivePosition, at)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("</" + child.name + ">")
+	}
+	return nil
+}
+
+func writeXmlAttribute(buf *bytes.Buffer, name string, value interface{}, at string) error {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case json.Number:
+		text = string(v)
+	case bool:
+		text = fmt.Sprintf("%t", v)
+	default:
+		return FhirSchemaError{at: at, msg: fmt.Sprintf("%s should be a JSON string, number or boolean", name)}
+	}
+	buf.WriteString(" " + name + `="`)
+	xml.EscapeText(buf, []byte(text))
+	buf.WriteByte('"')
+	return nil
+}
+
+func writeXhtml(buf *bytes.Buffer, value interface{}, at string) error {
+	div, isString := value.(string)
+	if !isString {
+		return FhirSchemaError{at: at, msg: "narrative should be a JSON string"}
+	}
+
+	// the div is written as is, so make sure that it won't break the document
+	decoder := xml.NewDecoder(strings.NewReader(div))
+	token, err := decoder.Token()
+	start, isStart := token.(xml.StartElement)
+	if err == nil && isStart && start.Name.Space == "" && strings.HasPrefix(div, "<div") {
+		// commonly left out in JSON
+		div = `<div xmlns="` + xhtmlNamespace + `"` + div[len("<div"):]
+		start.Name.Space = xhtmlNamespace
+	}
+	if err != nil || !isStart || start.Name.Space != xhtmlNamespace || start.Name.Local != "div" {
+		return FhirSchemaError{at: at, msg: fmt.Sprintf("narrative should be a div in the %s namespace", xhtmlNamespace)}
+	}
+	err = decoder.Skip()
+	if err == nil {
+		_, err = decoder.Token()
+	}
+	if err != io.EOF {
+		return FhirSchemaError{at: at, msg: "narrative isn't a single well-formed div"}
+	}
+
+	buf.WriteString(div)
+	return nil
+}
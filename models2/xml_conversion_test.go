@@ -0,0 +1,185 @@
+package models2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertEqualJSON(t *testing.T, expected string, actual string) {
+	var expectedValue, actualValue interface{}
+	assert.Nil(t, json.Unmarshal([]byte(expected), &expectedValue))
+	assert.Nil(t, json.Unmarshal([]byte(actual), &actualValue), actual)
+	assert.Equal(t, expectedValue, actualValue)
+}
+
+func TestXmlConversionRoundTrip(t *testing.T) {
+	fixtures := []string{
+		"bundle-transaction.json",
+		"capability-statement-smile-cdr-smarthealthit.json",
+		"condition_with_contained_patient.json",
+		"search_response.json",
+		"synthea_bundle.json",
+	}
+	for _, fixture := range fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			jsonBytes, err := ioutil.ReadFile("../fixtures/" + fixture)
+			assert.Nil(t, err)
+
+			xmlBytes, err := JsonToXml(jsonBytes)
+			assert.Nil(t, err)
+			backToJson, err := XmlToJson(xmlBytes)
+			assert.Nil(t, err)
+			assertEqualJSON(t, string(jsonBytes), string(backToJson))
+		})
+	}
+}
+
+func TestXmlConversionPrimitiveExtensions(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+		<Patient xmlns="http://hl7.org/fhir" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://hl7.org/fhir patient.xsd">
+			<id value="pat1"/>
+			<name id="n1">
+				<extension url="http://example.org/name-ext">
+					<valueBoolean value="true"/>
+				</extension>
+				<given value="Peter"/>
+				<given id="g2">
+					<extension url="http://hl7.org/fhir/StructureDefinition/data-absent-reason">
+						<valueCode value="unknown"/>
+					</extension>
+				</given>
+				<given value="James"/>
+			</name>
+			<gender value="male">
+				<extension url="http://example.org/gender-ext">
+					<valueString value="m"/>
+				</extension>
+			</gender>
+			<birthDate id="bd" value="1974-12-25"/>
+		</Patient>`
+	expected := `{
+		"resourceType": "Patient",
+		"id": "pat1",
+		"name": [{
+			"id": "n1",
+			"extension": [{"url": "http://example.org/name-ext", "valueBoolean": true}],
+			"given": ["Peter", null, "James"],
+			"_given": [null, {
+				"id": "g2",
+				"extension": [{"url": "http://hl7.org/fhir/StructureDefinition/data-absent-reason", "valueCode": "unknown"}]
+			}, null]
+		}],
+		"gender": "male",
+		"_gender": {"extension": [{"url": "http://example.org/gender-ext", "valueString": "m"}]},
+		"birthDate": "1974-12-25",
+		"_birthDate": {"id": "bd"}
+	}`
+
+	jsonBytes, err := XmlToJson([]byte(xml))
+	assert.Nil(t, err)
+	assertEqualJSON(t, expected, string(jsonBytes))
+
+	xmlBytes, err := JsonToXml([]byte(expected))
+	assert.Nil(t, err)
+	assert.Contains(t, string(xmlBytes), `<given id="g2"><extension url="http://hl7.org/fhir/StructureDefinition/data-absent-reason"><valueCode value="unknown"/></extension></given>`)
+	assert.Contains(t, string(xmlBytes), `<birthDate id="bd" value="1974-12-25"/>`)
+	jsonBytes, err = XmlToJson(xmlBytes)
+	assert.Nil(t, err)
+	assertEqualJSON(t, expected, string(jsonBytes))
+}
+
+func TestXmlConversionOrderAndValues(t *testing.T) {
+	// keys out of order, with a decimal that a float64 can't represent
+	observation := `{
+		"valueQuantity": {"unit": "kg", "value": 1.00065022141624642},
+		"status": "final",
+		"code": {"text": "weight & <height>"},
+		"meta": {"versionId": "1"},
+		"id": "o1",
+		"resourceType": "Observation"
+	}`
+	xmlBytes, err := JsonToXml([]byte(observation))
+	assert.Nil(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<Observation xmlns="http://hl7.org/fhir"><id value="o1"/><meta><versionId value="1"/></meta>`+
+		`<status value="final"/><code><text value="weight &amp; &lt;height&gt;"/></code>`+
+		`<valueQuantity><value value="1.00065022141624642"/><unit value="kg"/></valueQuantity></Observation>`, string(xmlBytes))
+
+	jsonBytes, err := XmlToJson(xmlBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"resourceType":"Observation","id":"o1","meta":{"versionId":"1"},"status":"final",`+
+		`"code":{"text":"weight & <height>"},"valueQuantity":{"value":1.00065022141624642,"unit":"kg"}}`, string(jsonBytes))
+}
+
+func TestXmlConversionNarrativeAndContained(t *testing.T) {
+	div := `<div xmlns="http://www.w3.org/1999/xhtml"><p class="x">A &amp; B<br/></p><!-- note --></div>`
+	xml := `<Condition xmlns="http://hl7.org/fhir">
+		<text><status value="generated"/>` + div + `</text>
+		<contained>
+			<Patient><id value="p1"/><text><status value="generated"/><div xmlns="http://www.w3.org/1999/xhtml">P</div></text></Patient>
+		</contained>
+		<subject><reference value="#p1"/></subject>
+	</Condition>`
+	jsonBytes, err := XmlToJson([]byte(xml))
+	assert.Nil(t, err)
+	assertEqualJSON(t, `{
+		"resourceType": "Condition",
+		"text": {"status": "generated", "div": `+jsonString(div)+`},
+		"contained": [{
+			"resourceType": "Patient",
+			"id": "p1",
+			"text": {"status": "generated", "div": "<div xmlns=\"http://www.w3.org/1999/xhtml\">P</div>"}
+		}],
+		"subject": {"reference": "#p1"}
+	}`, string(jsonBytes))
+
+	xmlBytes, err := JsonToXml(jsonBytes)
+	assert.Nil(t, err)
+	assert.Contains(t, string(xmlBytes), div)
+	assert.Contains(t, string(xmlBytes), `<contained><Patient><id value="p1"/>`)
+
+	// a div without its namespace is accepted
+	xmlBytes, err = JsonToXml([]byte(`{"resourceType": "Patient", "text": {"status": "generated", "div": "<div><p>P</p></div>"}}`))
+	assert.Nil(t, err)
+	assert.Contains(t, string(xmlBytes), `<div xmlns="http://www.w3.org/1999/xhtml"><p>P</p></div>`)
+}
+
+func TestXmlConversionErrors(t *testing.T) {
+	for _, xml := range []string{
+		`<Patient xmlns="http://hl7.org/fhir"><foo value="bar"/></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><gender value="male"/><gender value="female"/></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><active value="yes"/></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><multipleBirthInteger value="1.5"/></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><name foo="bar"/></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><text><div>no namespace</div></text></Patient>`,
+		`<Patient xmlns="http://hl7.org/fhir"><gender>male</gender></Patient>`,
+		`<Patient><gender value="male"/></Patient>`,
+		`<Unknown xmlns="http://hl7.org/fhir"/>`,
+		`<Patient xmlns="http://hl7.org/fhir"><gender value="male"/>`,
+	} {
+		_, err := XmlToJson([]byte(xml))
+		assert.NotNil(t, err, xml)
+	}
+
+	for _, json := range []string{
+		`{"resourceType": "Patient", "foo": "bar"}`,
+		`{"resourceType": "Patient", "gender": ["male"]}`,
+		`{"resourceType": "Patient", "name": {"family": "Duck"}}`,
+		`{"resourceType": "Patient", "text": {"div": "<div xmlns=\"http://www.w3.org/1999/xhtml\">unclosed"}}`,
+		`{"resourceType": "Patient", "text": {"div": "<div xmlns=\"http://www.w3.org/1999/xhtml\"></div><div xmlns=\"http://www.w3.org/1999/xhtml\"></div>"}}`,
+		`{"resourceType": "Patient", "_gender": {"foo": "bar"}}`,
+		`{"resourceType": "Unknown"}`,
+		`[]`,
+	} {
+		_, err := JsonToXml([]byte(json))
+		assert.NotNil(t, err, json)
+	}
+}
+
+func jsonString(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,321 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PatientCompartment maps the resource types in the STU3 Patient compartment
+// (http://hl7.org/fhir/STU3/compartmentdefinition-patient.html) to the search
+// parameters that link them to a patient. Parameters with chained paths
+// (e.g. Provenance target.subject), and those that can't reference patients
+// (e.g. ReferralRequest recipient), are left out.
+var PatientCompartment = map[string][]string{
+	"Account":                    {"subject"},
+	"AdverseEvent":               {"subject"},
+	"AllergyIntolerance":         {"patient", "recorder", "asserter"},
+	"Appointment":                {"actor"},
+	"AppointmentResponse":        {"actor"},
+	"AuditEvent":                 {"patient"},
+	"Basic":                      {"patient", "author"},
+	"BodySite":                   {"patient"},
+	"CarePlan":                   {"patient", "performer"},
+	"CareTeam":                   {"patient", "participant"},
+	"ChargeItem":                 {"subject"},
+	"Claim":                      {"patient", "payee"},
+	"ClaimResponse":              {"patient"},
+	"ClinicalImpression":         {"subject"},
+	"Communication":              {"subject", "sender", "recipient"},
+	"CommunicationRequest":       {"subject", "sender", "recipient", "requester"},
+	"Composition":                {"subject", "author", "attester"},
+	"Condition":                  {"patient", "asserter"},
+	"Consent":                    {"patient"},
+	"Coverage":                   {"policy-holder", "subscriber", "beneficiary", "payor"},
+	"DetectedIssue":              {"patient"},
+	"DeviceRequest":              {"subject", "performer"},
+	"DeviceUseStatement":         {"subject"},
+	"DiagnosticReport":           {"subject"},
+	"DocumentManifest":           {"subject", "author", "recipient"},
+	"DocumentReference":          {"subject", "author"},
+	"EligibilityRequest":         {"patient"},
+	"Encounter":                  {"patient"},
+	"EnrollmentRequest":          {"subject"},
+	"EpisodeOfCare":              {"patient"},
+	"ExplanationOfBenefit":       {"patient", "payee"},
+	"FamilyMemberHistory":        {"patient"},
+	"Flag":                       {"patient"},
+	"Goal":                       {"patient"},
+	"Group":                      {"member"},
+	"ImagingManifest":            {"patient", "author"},
+	"ImagingStudy":               {"patient"},
+	"Immunization":               {"patient"},
+	"ImmunizationRecommendation": {"patient"},
+	"List":                       {"subject", "source"},
+	"MeasureReport":              {"patient"},
+	"Media":                      {"subject"},
+	"MedicationAdministration":   {"patient", "performer", "subject"},
+	"MedicationDispense":         {"subject", "patient", "receiver"},
+	"MedicationRequest":          {"subject"},
+	"MedicationStatement":        {"subject"},
+	"NutritionOrder":             {"patient"},
+	"Observation":                {"subject", "performer"},
+	"Patient":                    {"link"},
+	"Person":                     {"patient"},
+	"Procedure":                  {"patient", "performer"},
+	"ProcedureRequest":           {"subject", "performer"},
+	"Provenance":                 {"patient"},
+	"QuestionnaireResponse":      {"subject", "author"},
+	"ReferralRequest":            {"patient", "requester"},
+	"RelatedPerson":              {"patient"},
+	"RequestGroup":               {"subject", "participant"},
+	"ResearchSubject":            {"individual"},
+	"RiskAssessment":             {"subject"},
+	"Schedule":                   {"actor"},
+	"Sequence":                   {"patient"},
+	"Specimen":                   {"subject"},
+	"SupplyDelivery":             {"patient"},
+	"SupplyRequest":              {"requester"},
+	"VisionPrescription":         {"patient"},
+}
+
+// EncounterCompartment maps the resource types in the STU3 Encounter compartment
+// (http://hl7.org/fhir/STU3/compartmentdefinition-encounter.html) to the search parameters
+// that link them to an encounter.
+var EncounterCompartment = map[string][]string{
+	"CarePlan":                 {"context"},
+	"CareTeam":                 {"context"},
+	"ChargeItem":               {"context"},
+	"Claim":                    {"encounter"},
+	"ClinicalImpression":       {"context"},
+	"Communication":            {"context"},
+	"CommunicationRequest":     {"context"},
+	"Composition":              {"encounter"},
+	"Condition":                {"context"},
+	"DeviceRequest":            {"encounter"},
+	"DiagnosticReport":         {"context"},
+	"DocumentManifest":         {"related-ref"},
+	"DocumentReference":        {"encounter"},
+	"ExplanationOfBenefit":     {"encounter"},
+	"List":                     {"encounter"},
+	"Media":                    {"context"},
+	"MedicationAdministration": {"context"},
+	"MedicationRequest":        {"context"},
+	"NutritionOrder":           {"encounter"},
+	"Observation":              {"context"},
+	"Procedure":                {"context"},
+	"ProcedureRequest":         {"context"},
+	"QuestionnaireResponse":    {"context"},
+	"ReferralRequest":          {"context"},
+	"RiskAssessment":           {"encounter"},
+	"VisionPrescription":       {"encounter"},
+}
+
+// PractitionerCompartment maps the resource types in the STU3 Practitioner compartment
+// (http://hl7.org/fhir/STU3/compartmentdefinition-practitioner.html) to the search parameters
+// that link them to a practitioner.
+var PractitionerCompartment = map[string][]string{
+	"Account":                  {"subject"},
+	"AdverseEvent":             {"recorder"},
+	"AllergyIntolerance":       {"recorder", "asserter"},
+	"Appointment":              {"actor"},
+	"AppointmentResponse":      {"actor"},
+	"AuditEvent":               {"agent"},
+	"Basic":                    {"author"},
+	"CarePlan":                 {"performer"},
+	"CareTeam":                 {"participant"},
+	"ChargeItem":               {"enterer", "participant-actor"},
+	"Claim":                    {"enterer", "provider", "payee", "care-team"},
+	"ClaimResponse":            {"request-provider"},
+	"ClinicalImpression":       {"assessor"},
+	"Communication":            {"sender", "recipient"},
+	"CommunicationRequest":     {"sender", "recipient", "requester"},
+	"Composition":              {"subject", "author", "attester"},
+	"Condition":                {"asserter"},
+	"DetectedIssue":            {"author"},
+	"DeviceRequest":            {"requester", "performer"},
+	"DiagnosticReport":         {"performer"},
+	"DocumentManifest":         {"subject", "author", "recipient"},
+	"DocumentReference":        {"subject", "author", "authenticator"},
+	"EligibilityRequest":       {"enterer", "provider"},
+	"EligibilityResponse":      {"request-provider"},
+	"Encounter":                {"practitioner", "participant"},
+	"EpisodeOfCare":            {"care-manager"},
+	"ExplanationOfBenefit":     {"enterer", "provider", "payee", "care-team"},
+	"Flag":                     {"author"},
+	"Group":                    {"member"},
+	"ImagingManifest":          {"author"},
+	"Immunization":             {"practitioner"},
+	"Linkage":                  {"author"},
+	"List":                     {"source"},
+	"Media":                    {"subject", "operator"},
+	"MedicationAdministration": {"performer"},
+	"MedicationDispense":       {"performer", "receiver"},
+	"MedicationRequest":        {"requester"},
+	"MedicationStatement":      {"source"},
+	"Observation":              {"performer"},
+	"Patient":                  {"general-practitioner"},
+	"PaymentNotice":            {"provider"},
+	"PaymentReconciliation":    {"request-provider"},
+	"Person":                   {"practitioner"},
+	"PractitionerRole":         {"practitioner"},
+	"Procedure":                {"performer"},
+	"ProcedureRequest":         {"performer", "requester"},
+	"Provenance":               {"agent"},
+	"QuestionnaireResponse":    {"author", "source"},
+	"ReferralRequest":          {"requester", "recipient"},
+	"RiskAssessment":           {"performer"},
+	"Schedule":                 {"actor"},
+	"Specimen":                 {"collector"},
+	"SupplyDelivery":           {"supplier", "receiver"},
+	"SupplyRequest":            {"requester"},
+	"VisionPrescription":       {"prescriber"},
+}
+
+// RelatedPersonCompartment maps the resource types in the STU3 RelatedPerson compartment
+// (http://hl7.org/fhir/STU3/compartmentdefinition-relatedperson.html) to the search parameters
+// that link them to a related person. Group member can't reference related persons so is left out.
+var RelatedPersonCompartment = map[string][]string{
+	"AdverseEvent":          {"recorder"},
+	"AllergyIntolerance":    {"asserter"},
+	"Appointment":           {"actor"},
+	"AppointmentResponse":   {"actor"},
+	"Basic":                 {"author"},
+	"CarePlan":              {"performer"},
+	"CareTeam":              {"participant"},
+	"ChargeItem":            {"enterer", "participant-actor"},
+	"Claim":                 {"payee"},
+	"Communication":         {"sender", "recipient"},
+	"CommunicationRequest":  {"sender", "recipient", "requester"},
+	"Composition":           {"author"},
+	"Condition":             {"asserter"},
+	"DocumentManifest":      {"author", "recipient"},
+	"DocumentReference":     {"author"},
+	"Encounter":             {"participant"},
+	"ExplanationOfBenefit":  {"payee"},
+	"Observation":           {"performer"},
+	"Patient":               {"link"},
+	"Person":                {"link"},
+	"Procedure":             {"performer"},
+	"ProcedureRequest":      {"performer"},
+	"Provenance":            {"agent"},
+	"QuestionnaireResponse": {"author", "source"},
+	"ReferralRequest":       {"requester"},
+	"Schedule":              {"actor"},
+	"SupplyRequest":         {"requester"},
+}
+
+// DeviceCompartment maps the resource types in the STU3 Device compartment
+// (http://hl7.org/fhir/STU3/compartmentdefinition-device.html) to the search parameters
+// that link them to a device.
+var DeviceCompartment = map[string][]string{
+	"Account":                  {"subject"},
+	"Appointment":              {"actor"},
+	"AppointmentResponse":      {"actor"},
+	"AuditEvent":               {"agent"},
+	"ChargeItem":               {"enterer", "participant-actor"},
+	"Communication":            {"sender", "recipient"},
+	"CommunicationRequest":     {"sender", "recipient"},
+	"Composition":              {"author"},
+	"DetectedIssue":            {"author"},
+	"DeviceComponent":          {"source"},
+	"DeviceMetric":             {"source"},
+	"DeviceRequest":            {"device", "subject", "requester", "performer"},
+	"DeviceUseStatement":       {"device"},
+	"DiagnosticReport":         {"subject"},
+	"DocumentManifest":         {"subject", "author"},
+	"DocumentReference":        {"subject", "author"},
+	"Flag":                     {"author"},
+	"Group":                    {"member"},
+	"ImagingManifest":          {"author"},
+	"List":                     {"subject", "source"},
+	"Media":                    {"subject"},
+	"MedicationAdministration": {"device"},
+	"Observation":              {"subject", "device"},
+	"ProcedureRequest":         {"performer"},
+	"Provenance":               {"agent"},
+	"QuestionnaireResponse":    {"author"},
+	"RequestGroup":             {"author"},
+	"RiskAssessment":           {"performer"},
+	"Schedule":                 {"actor"},
+	"Specimen":                 {"subject"},
+	"SupplyRequest":            {"requester"},
+}
+
+// Compartments maps the types of the resources that have compartments to the resource
+// types in their compartments and the search parameters that link them.
+var Compartments = map[string]map[string][]string{
+	"Patient":       PatientCompartment,
+	"Encounter":     EncounterCompartment,
+	"Practitioner":  PractitionerCompartment,
+	"RelatedPerson": RelatedPersonCompartment,
+	"Device":        DeviceCompartment,
+}
+
+// InCompartment returns whether a resource type can be in the compartments of a type of resource.
+// A resource is in its own compartment.
+func InCompartment(compartmentType string, resourceType string) bool {
+	_, inCompartment := Compartments[compartmentType][resourceType]
+	return inCompartment || compartmentType == resourceType
+}
+
+// parseCompartmentParam parses a _compartment parameter (e.g. _compartment=Patient/123), which limits
+// a search to a compartment, into an OrParam of the parameters that link the resource type to it
+func parseCompartmentParam(resourceType string, value string) *OrParam {
+	slash := strings.Index(value, "/")
+	if slash < 0 || strings.Contains(value[slash+1:], "/") {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", CompartmentParam)))
+	}
+	compartmentType, id := value[:slash], value[slash+1:]
+	if _, known := Compartments[compartmentType]; !known {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": there are no %s compartments", CompartmentParam, compartmentType)))
+	}
+	if !InCompartment(compartmentType, resourceType) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": %s resources aren't in %s compartments", CompartmentParam, resourceType, compartmentType)))
+	}
+
+	or := &OrParam{SearchParamInfo: SearchParamInfo{Name: CompartmentParam, Type: "or"}, compartment: value}
+	if resourceType == compartmentType {
+		or.Items = append(or.Items, SearchParameterDictionary[resourceType][IDParam].CreateSearchParam(id))
+	}
+	for _, name := range Compartments[compartmentType][resourceType] {
+		info := SearchParameterDictionary[resourceType][name]
+		or.Items = append(or.Items, info.CreateSearchParam(value))
+	}
+	return or
+}
+
+// PatientCompartmentMembers returns the ids of the patients in whose compartments a resource
+// (in the GoFHIR BSON representation produced by models2.Resource.GetBSON) is.
+// A patient is in its own compartment.
+func PatientCompartmentMembers(resourceType string, id string, doc []bson.E) []string {
+	var patientIDs []string
+	seen := make(map[string]bool)
+	add := func(patientID string) {
+		if !seen[patientID] {
+			seen[patientID] = true
+			patientIDs = append(patientIDs, patientID)
+		}
+	}
+
+	if resourceType == "Patient" {
+		add(id)
+	}
+	for _, name := range PatientCompartment[resourceType] {
+		info, known := SearchParameterDictionary[resourceType][name]
+		if !known {
+			continue
+		}
+		for _, path := range info.Paths {
+			for _, value := range bsonValuesAtPath(doc, path.Path) {
+				for _, row := range indexRowsForValue(info, path, value) {
+					if row.RefType != nil && *row.RefType == "Patient" && row.RefID != nil {
+						add(*row.RefID)
+					}
+				}
+			}
+		}
+	}
+	return patientIDs
+}
@@ -0,0 +1,87 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models2"
+	"go.mongodb.org/mongo-driver/bson"
+	. "gopkg.in/check.v1"
+)
+
+type CompartmentSuite struct{}
+
+var _ = Suite(&CompartmentSuite{})
+
+func (s *CompartmentSuite) TestCompartmentParameters(c *C) {
+	for compartmentType, compartment := range Compartments {
+		for resourceType, names := range compartment {
+			for _, name := range names {
+				info, known := SearchParameterDictionary[resourceType][name]
+				c.Assert(known, Equals, true, Commentf("%s: %s.%s", compartmentType, resourceType, name))
+				c.Assert(info.Type, Equals, "reference", Commentf("%s: %s.%s", compartmentType, resourceType, name))
+				targetsCompartment := false
+				for _, target := range info.Targets {
+					targetsCompartment = targetsCompartment || target == compartmentType || target == "Any"
+				}
+				c.Assert(targetsCompartment, Equals, true, Commentf("%s: %s.%s", compartmentType, resourceType, name))
+			}
+		}
+	}
+}
+
+func (s *CompartmentSuite) TestCompartmentParam(c *C) {
+	q := Query{Resource: "Observation", Query: "code=1234&_compartment=Patient/p1"}
+	params := q.Params()
+	c.Assert(params, HasLen, 2)
+	or, ok := params[1].(*OrParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(or.Items, HasLen, 2)
+	for _, item := range or.Items {
+		ref := item.(*ReferenceParam)
+		c.Assert(ref.Reference, DeepEquals, LocalReference{Type: "Patient", ID: "p1"})
+	}
+	urlParams := q.URLQueryParameters(false)
+	c.Assert(urlParams.Encode(), Equals, "code=1234&_compartment=Patient%2Fp1")
+
+	// a resource is in its own compartment
+	q = Query{Resource: "Patient", Query: "_compartment=Patient/p1"}
+	or = q.Params()[0].(*OrParam)
+	c.Assert(or.Items[0].(*TokenParam).Code, Equals, "p1")
+
+	for _, query := range []string{"_compartment=Patient", "_compartment=Organization/o1", "_compartment=Encounter/e1"} {
+		q = Query{Resource: "Patient", Query: query}
+		c.Assert(func() { q.Params() }, PanicMatches, ".*_compartment.*", Commentf(query))
+	}
+}
+
+func (s *CompartmentSuite) members(c *C, json string) []string {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	c.Assert(err, IsNil)
+	doc, err := resource.GetBSON()
+	c.Assert(err, IsNil)
+	return PatientCompartmentMembers(resource.ResourceType(), resource.Id(), doc.([]bson.E))
+}
+
+func (s *CompartmentSuite) TestPatientCompartmentMembers(c *C) {
+	c.Assert(s.members(c, `{
+		"resourceType": "Observation",
+		"id": "o1",
+		"subject": {"reference": "Patient/p1"},
+		"performer": [{"reference": "Practitioner/d1"}, {"reference": "Patient/p2"}, {"reference": "Patient/p1"}]
+	}`), DeepEquals, []string{"p1", "p2"})
+
+	c.Assert(s.members(c, `{
+		"resourceType": "Patient",
+		"id": "p1",
+		"link": [{"other": {"reference": "Patient/p3"}, "type": "seealso"}]
+	}`), DeepEquals, []string{"p1", "p3"})
+
+	c.Assert(s.members(c, `{
+		"resourceType": "Observation",
+		"id": "o2",
+		"subject": {"reference": "Group/g1"}
+	}`), HasLen, 0)
+
+	c.Assert(s.members(c, `{
+		"resourceType": "Organization",
+		"id": "org1"
+	}`), HasLen, 0)
+}
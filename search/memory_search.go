@@ -0,0 +1,592 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryResource is the current version of a resource held by an in-memory
+// database, together with the same search index rows as the PostgreSQL backend
+type MemoryResource struct {
+	ID          string
+	LastUpdated time.Time
+	Blob        []byte // GoFHIR BSON so that callers can't modify stored resources
+	Index       []PostgresIndexRow
+}
+
+// NewMemoryResource encodes a resource for storage in an in-memory database
+func NewMemoryResource(resource *models2.Resource) (*MemoryResource, error) {
+	doc, err := resource.GetBSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "NewMemoryResource: GetBSON failed")
+	}
+	blob, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewMemoryResource: bson.Marshal failed")
+	}
+	return &MemoryResource{
+		ID:          resource.Id(),
+		LastUpdated: resource.LastUpdatedTime(),
+		Blob:        blob,
+		Index:       ExtractPostgresIndexRows(resource.ResourceType(), doc.([]bson.E)),
+	}, nil
+}
+
+// Resource decodes the stored resource
+func (m *MemoryResource) Resource() (*models2.Resource, error) {
+	return DecodePostgresResource(m.Blob)
+}
+
+// MemoryCollections holds the current resources of an in-memory database by resource type and id
+type MemoryCollections map[string]map[string]*MemoryResource
+
+// MemorySearcher implements FHIR searches over resources held in memory.
+// Callers are responsible for preventing concurrent modification of the collections.
+type MemorySearcher struct {
+	collections                  MemoryCollections
+	enableCISearches             bool
+	tokenParametersCaseSensitive bool
+}
+
+// NewMemorySearcher creates a new instance of a MemorySearcher
+func NewMemorySearcher(collections MemoryCollections, enableCISearches, tokenParametersCaseSensitive bool) *MemorySearcher {
+	return &MemorySearcher{
+		collections:                  collections,
+		enableCISearches:             enableCISearches,
+		tokenParametersCaseSensitive: tokenParametersCaseSensitive,
+	}
+}
+
+// Search takes a Query and returns the matching resources, any resources
+// included via _include or _revinclude and the total number of matches.
+func (m *MemorySearcher) Search(query Query) (resources []*models2.Resource, included []*models2.Resource, total uint32, err error) {
+	options := query.Options()
+	matches := m.filter(query.Resource, query.Params())
+	total = uint32(len(matches))
+
+	// If the search was for _summary=count, just return the total.
+	if options.Summary == "count" {
+		return nil, nil, total, nil
+	}
+
+	m.sort(matches, options.Sort)
+
+	start := options.Offset
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + options.Count
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	resources, err = decodeMemoryResources(matches[start:end])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(options.Include) > 0 || len(options.RevInclude) > 0 {
+		included, err = m.loadIncludes(query.Resource, matches[start:end], options)
+		if err != nil {
+			return nil, nil, 0, errors.Wrap(err, "Search includes error")
+		}
+	}
+
+	return resources, included, total, nil
+}
+
+func decodeMemoryResources(stored []*MemoryResource) ([]*models2.Resource, error) {
+	resources := make([]*models2.Resource, len(stored))
+	for i, s := range stored {
+		resource, err := s.Resource()
+		if err != nil {
+			return nil, errors.Wrap(err, "Search result decoding error")
+		}
+		resources[i] = resource
+	}
+	return resources, nil
+}
+
+// filter returns the resources of a type matching all the parameters
+func (m *MemorySearcher) filter(resourceType string, params []SearchParam) []*MemoryResource {
+	m.panicOnUnsupportedFeatures(params)
+	var matches []*MemoryResource
+	for _, resource := range m.collections[resourceType] {
+		if m.matchesAll(resourceType, resource, params) {
+			matches = append(matches, resource)
+		}
+	}
+	return matches
+}
+
+// panicOnUnsupportedFeatures checks the parameters before any resources are matched,
+// so that unsupported searches (and unknown value sets) fail even when there's nothing to match
+func (m *MemorySearcher) panicOnUnsupportedFeatures(params []SearchParam) {
+	for _, param := range params {
+		switch p := param.(type) {
+		case *OrParam:
+			m.panicOnUnsupportedFeatures(p.Items)
+		case *TokenParam:
+			if p.Modifier == TextModifier {
+				tokenTextPaths(p)
+			} else if isTerminologyModifier(p.Modifier) {
+				tokenCodePaths(p)
+				m.expandTokenParam(p)
+			}
+		case *CompositeParam:
+			// the index rows don't record which element a value came from, so components can't be matched together
+			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\": composite searches are only supported with MongoDB", p.Name)))
+		}
+	}
+}
+
+func (m *MemorySearcher) matchesAll(resourceType string, resource *MemoryResource, params []SearchParam) bool {
+	for _, param := range params {
+		if !m.matches(resourceType, resource, param) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemorySearcher) matches(resourceType string, resource *MemoryResource, param SearchParam) bool {
+	panicOnUnsupportedFeatures(param)
+
+	switch p := param.(type) {
+	case *OrParam:
+		for _, item := range p.Items {
+			if m.matches(resourceType, resource, item) {
+				return true
+			}
+		}
+		return false
+	case *ReferenceParam:
+		if ref, ok := p.Reference.(ReverseChainedQueryReference); ok {
+			return m.matchesReverseChained(resourceType, resource, ref)
+		}
+	case *MissingParam:
+		if p.Name == IDParam || p.Name == LastUpdatedParam {
+			// always present
+			return !p.Missing
+		}
+	case *TokenParam:
+		if p.Name == IDParam {
+			return (resource.ID == p.Code) != (p.Modifier == NotModifier)
+		}
+	case *StringParam:
+		if p.Name == IDParam {
+			return resource.ID == p.String
+		}
+	case *DateParam:
+		if p.Name == LastUpdatedParam {
+			return matchesInstant(resource.LastUpdated, p)
+		}
+	}
+
+	name := param.getInfo().Name
+	for i := range resource.Index {
+		row := &resource.Index[i]
+		if row.Param == name && m.matchesRow(row, param) {
+			return !isNegated(param)
+		}
+	}
+	return isNegated(param)
+}
+
+func (m *MemorySearcher) matchesReverseChained(resourceType string, resource *MemoryResource, ref ReverseChainedQueryReference) bool {
+	for _, other := range m.filter(ref.Type, ref.Query.Params()) {
+		for _, row := range other.Index {
+			if row.Param == ref.ReferenceName && equalPtr(row.RefType, resourceType) && equalPtr(row.RefID, resource.ID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesRow evaluates a parameter against a single index row
+func (m *MemorySearcher) matchesRow(row *PostgresIndexRow, param SearchParam) bool {
+	switch p := param.(type) {
+	case *MissingParam:
+		// any value
+		return true
+	case *TokenParam:
+		return m.matchesToken(row, p)
+	case *StringParam:
+		switch p.Modifier {
+		case ExactModifier:
+			return equalPtr(row.ValueString, p.String)
+		case ContainsModifier:
+			return m.cicontains(row.ValueString, p.String)
+		}
+		return m.cisw(row.ValueString, p.String)
+	case *URIParam:
+		switch p.Modifier {
+		case BelowModifier:
+			return row.ValueString != nil && strings.HasPrefix(*row.ValueString, p.URI)
+		case AboveModifier:
+			return row.ValueString != nil && contains(p.Ancestors(), *row.ValueString)
+		}
+		return equalPtr(row.ValueString, p.URI)
+	case *ReferenceParam:
+		return m.matchesReference(row, p)
+	case *DateParam:
+		return matchesDate(row, p)
+	case *NumberParam:
+		return matchesNumber(row, p.Name, p.Prefix, p.Number, false)
+	case *QuantityParam:
+		return matchesNumber(row, p.Name, p.Prefix, p.Number, true) &&
+			(p.System == "" || m.ciToken(row.System, p.System)) &&
+			(p.Code == "" || m.ciToken(row.Code, p.Code))
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param.getInfo().Name)))
+}
+
+func (m *MemorySearcher) matchesToken(row *PostgresIndexRow, t *TokenParam) bool {
+	if t.Modifier == TextModifier {
+		return m.textMatch(row.ValueString, t.Code)
+	}
+	if isTerminologyModifier(t.Modifier) {
+		return m.expandTokenParam(t).contains(row.System, row.Code)
+	}
+	for _, path := range t.Paths {
+		if path.Type == "boolean" && t.Code != "true" && t.Code != "false" {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", t.Name)))
+		}
+	}
+
+	if t.Code == "" {
+		// [parameter]=[system]|
+		return m.ciToken(row.System, t.System)
+	} else if t.System == "" {
+		if t.AnySystem {
+			// [parameter]=[code]
+			return m.ciToken(row.Code, t.Code)
+		}
+		// [parameter]=|[code]
+		return m.ciToken(row.Code, t.Code) && row.System == nil
+	}
+	// [parameter]=[system]|[code]
+	return m.ciToken(row.Code, t.Code) && m.ciToken(row.System, t.System)
+}
+
+func (m *MemorySearcher) expandTokenParam(t *TokenParam) *tokenCodes {
+	// the map's address identifies the database
+	namespace := fmt.Sprintf("memory %p", m.collections)
+	return expandTokenParam(t, namespace, terminologySource(func(query Query) ([]*models2.Resource, error) {
+		resources, _, _, err := m.Search(query)
+		return resources, err
+	}))
+}
+
+func (m *MemorySearcher) matchesReference(row *PostgresIndexRow, r *ReferenceParam) bool {
+	switch ref := r.Reference.(type) {
+	case LocalReference:
+		return equalPtr(row.RefID, ref.ID) && (ref.Type == "" || equalPtr(row.RefType, ref.Type))
+	case ExternalReference:
+		return m.ci(row.ValueString, ref.URL)
+	case ChainedQueryReference:
+		if r.referenceIsInternal() {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": chained search on contained resources is not supported", r.Name)))
+		}
+		if !equalPtr(row.RefType, ref.Type) || row.RefID == nil {
+			return false
+		}
+		target, found := m.collections[ref.Type][*row.RefID]
+		return found && m.matchesAll(ref.Type, target, ref.ChainedQuery.Params())
+	}
+	panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
+}
+
+// matchesDate has the same semantics as postgresQueryBuilder.dateCondition
+func matchesDate(row *PostgresIndexRow, d *DateParam) bool {
+	// open-ended periods are indexed with nil boundaries
+	from, to := minTime, maxTime
+	if row.DateFrom != nil {
+		from = *row.DateFrom
+	}
+	if row.DateTo != nil {
+		to = *row.DateTo
+	}
+	low, high := d.Date.RangeLowIncl(), d.Date.RangeHighExcl()
+
+	switch d.Prefix {
+	case EQ:
+		return !from.Before(low) && !to.After(high)
+	case GT:
+		return to.After(high)
+	case LT:
+		return from.Before(low)
+	case GE:
+		return !to.Before(high) || !from.Before(low)
+	case LE:
+		return !from.After(low) || !to.After(high)
+	case SA:
+		return from.After(high)
+	case EB:
+		return to.Before(low)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+var (
+	minTime = time.Unix(-1<<62, 0)
+	maxTime = time.Unix(1<<62, 0)
+)
+
+// matchesInstant has the same semantics as postgresQueryBuilder.instantCondition
+func matchesInstant(t time.Time, d *DateParam) bool {
+	low, high := d.Date.RangeLowIncl(), d.Date.RangeHighExcl()
+	switch d.Prefix {
+	case EQ:
+		return !t.Before(low) && t.Before(high)
+	case GT:
+		return t.After(low)
+	case GE:
+		return !t.Before(low)
+	case SA:
+		return t.After(high)
+	case LT, EB:
+		return t.Before(low)
+	case LE:
+		return t.Before(high)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+// matchesNumber has the same semantics as postgresQueryBuilder.numberCondition
+func matchesNumber(row *PostgresIndexRow, name string, prefix Prefix, number *utils.Number, isQuantity bool) bool {
+	l, _ := number.RangeLowIncl().Float64()
+	h, _ := number.RangeHighExcl().Float64()
+	exact, _ := number.Value.Float64()
+
+	if prefix == SA || prefix == EB || (prefix == NE && isQuantity) {
+		// SA, EB are not supported for Number or Quantity queries
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", name)))
+	}
+	if row.NumFrom == nil || row.NumTo == nil {
+		return false
+	}
+	from, to := *row.NumFrom, *row.NumTo
+
+	switch prefix {
+	case EQ:
+		return from >= l && to <= h
+	case LT:
+		return from < exact
+	case GT:
+		return to > exact
+	case GE:
+		return to >= h || from >= l
+	case LE:
+		return from <= l || to <= h
+	case NE:
+		return from < l || from >= h
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", name)))
+}
+
+func equalPtr(s *string, value string) bool {
+	return s != nil && *s == value
+}
+
+// Case-insensitive match
+func (m *MemorySearcher) ci(s *string, value string) bool {
+	if m.enableCISearches {
+		return s != nil && strings.EqualFold(*s, value)
+	}
+	return equalPtr(s, value)
+}
+
+// Case-insensitive match for token-type search parameters
+func (m *MemorySearcher) ciToken(s *string, value string) bool {
+	if !m.tokenParametersCaseSensitive && m.enableCISearches {
+		return s != nil && strings.EqualFold(*s, value)
+	}
+	return equalPtr(s, value)
+}
+
+// Case-insensitive contains
+func (m *MemorySearcher) cicontains(s *string, value string) bool {
+	if m.enableCISearches {
+		return s != nil && strings.Contains(strings.ToLower(*s), strings.ToLower(value))
+	}
+	return s != nil && strings.Contains(*s, value)
+}
+
+// Case-insensitive starts-with
+func (m *MemorySearcher) cisw(s *string, value string) bool {
+	if m.enableCISearches {
+		return s != nil && strings.HasPrefix(strings.ToLower(*s), strings.ToLower(value))
+	}
+	return equalPtr(s, value)
+}
+
+// Starts-with match for the :text modifier, which is case-insensitive if enabled
+// but unlike cisw never an exact match
+func (m *MemorySearcher) textMatch(s *string, value string) bool {
+	if m.enableCISearches {
+		return m.cisw(s, value)
+	}
+	return s != nil && strings.HasPrefix(*s, value)
+}
+
+// sort orders resources in the same way as postgresQueryBuilder.orderBy,
+// with resources lacking a value sorted last when ascending and first when descending
+func (m *MemorySearcher) sort(resources []*MemoryResource, sorts []SortOption) {
+	type sortKey struct {
+		present bool
+		value   interface{}
+	}
+	keys := make(map[*MemoryResource][]sortKey, len(resources))
+	for _, resource := range resources {
+		resourceKeys := make([]sortKey, len(sorts))
+		for i, sort := range sorts {
+			switch sort.Parameter.Name {
+			case IDParam:
+				resourceKeys[i] = sortKey{true, resource.ID}
+				continue
+			case LastUpdatedParam:
+				resourceKeys[i] = sortKey{true, resource.LastUpdated}
+				continue
+			}
+			for _, row := range resource.Index {
+				if row.Param != sort.Parameter.Name {
+					continue
+				}
+				value := sortValue(&row, sort.Parameter.Type)
+				if value == nil {
+					continue
+				}
+				if !resourceKeys[i].present || lessSortValue(value, resourceKeys[i].value) != sort.Descending {
+					resourceKeys[i] = sortKey{true, value}
+				}
+			}
+		}
+		keys[resource] = resourceKeys
+	}
+
+	sort.SliceStable(resources, func(a, b int) bool {
+		keysA, keysB := keys[resources[a]], keys[resources[b]]
+		for i, sort := range sorts {
+			ka, kb := keysA[i], keysB[i]
+			if ka.present != kb.present {
+				// like PostgreSQL, missing values are larger than any other
+				return ka.present != sort.Descending
+			}
+			if !ka.present {
+				continue
+			}
+			if lessSortValue(ka.value, kb.value) {
+				return !sort.Descending
+			}
+			if lessSortValue(kb.value, ka.value) {
+				return sort.Descending
+			}
+		}
+		// a stable order is needed for paging
+		return resources[a].ID < resources[b].ID
+	})
+}
+
+func sortValue(row *PostgresIndexRow, paramType string) interface{} {
+	switch paramType {
+	case "date":
+		if row.DateFrom != nil {
+			return *row.DateFrom
+		}
+	case "number", "quantity":
+		if row.NumFrom != nil {
+			return *row.NumFrom
+		}
+	case "string", "uri":
+		if row.ValueString != nil {
+			return strings.ToLower(*row.ValueString)
+		}
+	case "reference":
+		if row.RefID != nil {
+			return *row.RefID
+		}
+	default:
+		if row.Code != nil {
+			return *row.Code
+		}
+	}
+	return nil
+}
+
+func lessSortValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case time.Time:
+		return a.Before(b.(time.Time))
+	case float64:
+		return a < b.(float64)
+	case string:
+		return a < b.(string)
+	}
+	return false
+}
+
+// loadIncludes retrieves the resources referenced by (_include) or referencing (_revinclude) the matches
+func (m *MemorySearcher) loadIncludes(resourceType string, resources []*MemoryResource, o *QueryOptions) ([]*models2.Resource, error) {
+	seen := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, resource := range resources {
+		ids[resource.ID] = true
+		seen[resourceType+"/"+resource.ID] = true
+	}
+
+	var toLoad []string
+	want := func(typ, id string) {
+		if _, found := m.collections[typ][id]; !found || seen[typ+"/"+id] {
+			return
+		}
+		seen[typ+"/"+id] = true
+		toLoad = append(toLoad, typ+"/"+id)
+	}
+
+	for _, incl := range o.Include {
+		for _, resource := range resources {
+			for _, row := range resource.Index {
+				if row.Param == incl.Parameter.Name && row.RefType != nil && row.RefID != nil && isValidTarget(*row.RefType, incl.Parameter) {
+					want(*row.RefType, *row.RefID)
+				}
+			}
+		}
+	}
+
+	for _, incl := range o.RevInclude {
+		if !isValidTarget(resourceType, incl.Parameter) {
+			continue
+		}
+		for id, other := range m.collections[incl.Parameter.Resource] {
+			for _, row := range other.Index {
+				if row.Param == incl.Parameter.Name && equalPtr(row.RefType, resourceType) && row.RefID != nil && ids[*row.RefID] {
+					want(incl.Parameter.Resource, id)
+					break
+				}
+			}
+		}
+	}
+
+	// same order as the PostgreSQL backend: by type and then id
+	sort.Strings(toLoad)
+	included := make([]*models2.Resource, len(toLoad))
+	for i, key := range toLoad {
+		parts := strings.SplitN(key, "/", 2)
+		resource, err := m.collections[parts[0]][parts[1]].Resource()
+		if err != nil {
+			return nil, err
+		}
+		included[i] = resource
+	}
+	return included, nil
+}
@@ -395,6 +395,9 @@ func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, d
 			optionsBundle = optionsBundle.SetSkip(int64(queryOptions.Offset))
 		}
 		optionsBundle = optionsBundle.SetLimit(int64(queryOptions.Count))
+		if projection := subsetProjection(bsonQuery.Resource, queryOptions); projection != nil {
+			optionsBundle = optionsBundle.SetProjection(projection)
+		}
 	}
 
 	searchCursor, err := c.Find(m.ctx, bsonQuery.Query, optionsBundle)
@@ -404,6 +407,50 @@ func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, d
 	return searchCursor, total, nil
 }
 
+// subsetProjection returns a projection that only fetches the elements needed
+// for _summary and _elements, or nil if whole resources are needed. The
+// server still trims the results since the projection is only approximate
+// (e.g. for encrypted fields) and isn't applied to aggregation pipelines.
+func subsetProjection(resource string, o *QueryOptions) bson.M {
+	if !o.IsSubsetted() {
+		return nil
+	}
+
+	checkSummarySupported(resource, o.Summary)
+	var elements []string
+	switch o.Summary {
+	case "data":
+		return bson.M{"text": 0, "_text": 0}
+	case "true":
+		for element := range SummaryElements(resource) {
+			elements = append(elements, element)
+		}
+	case "text":
+		elements = []string{"text"}
+		for element := range requiredElements(resource) {
+			elements = append(elements, element)
+		}
+	default:
+		elements = o.Elements
+	}
+
+	projection := bson.M{
+		"_id":                     1,
+		"resourceType":            1,
+		"meta":                    1,
+		"__gofhirEncryptedBSON":   1,
+		"__gofhirEncryptionKeyId": 1,
+	}
+	for _, element := range elements {
+		if element == "id" {
+			continue
+		}
+		projection[element] = 1
+		projection["_"+element] = 1
+	}
+	return projection
+}
+
 func (m *MongoSearcher) convertToBSON(query Query) *BSONQuery {
 	bsonQuery := NewBSONQuery(query.Resource)
 
@@ -432,6 +479,8 @@ func (m *MongoSearcher) createParamObjects(params []SearchParam) []bson.M {
 	for i, p := range params {
 		panicOnUnsupportedFeatures(p)
 		switch p := p.(type) {
+		case *MissingParam:
+			results[i] = m.createMissingQueryObject(p)
 		case *CompositeParam:
 			results[i] = m.createCompositeQueryObject(p)
 		case *DateParam:
@@ -819,18 +868,69 @@ func panicOnUnsupportedFeatures(p SearchParam) {
 		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.getInfo().Name)))
 	}
 
-	// No modifiers are supported except for resource types in reference parameters
-	_, isRef := p.(*ReferenceParam)
+	// Modifiers depend on the type of the parameter
 	modifier := p.getInfo().Modifier
-	if modifier != "" {
-		if _, ok := SearchParameterDictionary[modifier]; !isRef || !ok {
-			panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", p.getInfo().Name)))
-		}
+	if modifier != "" && !isSupportedModifier(p, modifier) {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", p.getInfo().Name)))
 	}
 }
 
+func isSupportedModifier(p SearchParam, modifier string) bool {
+	switch p := p.(type) {
+	case *MissingParam:
+		// parameters without paths, e.g. Location's near, have no elements to check
+		return p.Type != "composite" && len(p.Paths) > 0
+	case *StringParam:
+		return modifier == ExactModifier || modifier == ContainsModifier
+	case *TokenParam:
+		return modifier == NotModifier || modifier == TextModifier || isTerminologyModifier(modifier)
+	case *URIParam:
+		return modifier == BelowModifier || modifier == AboveModifier
+	case *ReferenceParam:
+		if _, isReverseChained := p.Reference.(ReverseChainedQueryReference); isReverseChained {
+			// for _has the "modifier" names the referring resource type and parameter
+			return true
+		}
+		// resource types
+		_, ok := SearchParameterDictionary[modifier]
+		return ok
+	}
+	return false
+}
+
+func (m *MongoSearcher) createMissingQueryObject(p *MissingParam) bson.M {
+	criteria := make([]bson.M, len(p.Paths))
+	for i, path := range p.Paths {
+		criteria[i] = bson.M{convertSearchPathToMongoField(path.Path): bson.M{"$exists": !p.Missing}}
+	}
+
+	if len(criteria) == 1 {
+		return criteria[0]
+	} else if p.Missing {
+		// none of the paths can have a value
+		return bson.M{"$and": criteria}
+	}
+	return bson.M{"$or": criteria}
+}
+
 func (m *MongoSearcher) createCompositeQueryObject(c *CompositeParam) bson.M {
-	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	var alternatives []bson.M
+	for _, context := range c.Contexts() {
+		criteria := m.createQueryObjectFromParams(context.Components)
+		if context.Path == "" {
+			alternatives = append(alternatives, criteria)
+		} else {
+			// all components need to match the same array element
+			alternatives = append(alternatives, bson.M{
+				convertSearchPathToMongoField(context.Path): bson.M{"$elemMatch": criteria},
+			})
+		}
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	return bson.M{"$or": alternatives}
 }
 
 func (m *MongoSearcher) createDateQueryObject(d *DateParam) bson.M {
@@ -1196,7 +1296,10 @@ func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
 		}
 
-		if q.System == "" {
+		if q.System != "" {
+			criteria["code"] = m.ciToken(q.Code)
+			criteria["system"] = m.ciToken(q.System)
+		} else if q.Code != "" {
 
 			// FIXME: need to search by both the 'units' and 'code' field...............
 			// (http://build.fhir.org/search.html#quantity)
@@ -1217,11 +1320,8 @@ func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 			// } else {
 			// 	criteria["$or"] = orClause
 			// }
-
-		} else {
-			criteria["code"] = m.ciToken(q.Code)
-			criteria["system"] = m.ciToken(q.System)
 		}
+		// otherwise only the value is being searched for
 		return buildBSON(p.Path, criteria)
 	}
 
@@ -1277,25 +1377,27 @@ func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p S
 }
 
 func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
-	single := func(p SearchParamPath) bson.M {
+	match := func(p SearchParamPath) bson.M {
 		switch p.Type {
 		case "HumanName":
+			match := m.stringMatch(s, m.cisw)
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"family": m.cisw(s.String)},
-					bson.M{"given": m.cisw(s.String)},
+					bson.M{"text": match},
+					bson.M{"family": match},
+					bson.M{"given": match},
 				},
 			})
 		case "Address":
+			match := m.stringMatch(s, m.cisw)
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"line": m.cisw(s.String)},
-					bson.M{"city": m.cisw(s.String)},
-					bson.M{"state": m.cisw(s.String)},
-					bson.M{"postalCode": m.cisw(s.String)},
-					bson.M{"country": m.cisw(s.String)},
+					bson.M{"text": match},
+					bson.M{"line": match},
+					bson.M{"city": match},
+					bson.M{"state": match},
+					bson.M{"postalCode": match},
+					bson.M{"country": match},
 				},
 			})
 		default:
@@ -1303,14 +1405,60 @@ func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
 				return buildBSON(p.Path, s.String)
 			}
 
-			return buildBSON(p.Path, m.ci(s.String))
+			return buildBSON(p.Path, m.stringMatch(s, m.ci))
 		}
 	}
+	single := func(p SearchParamPath) bson.M {
+		return withBlindIndexes(match(p), models2.BlindNameField, blindNameIndexes(s, p))
+	}
 
 	return orPaths(single, s.Paths)
 }
 
+// blindNameIndexes returns the blind indexes that encrypted names matching a string search would have.
+// Only whole names ignoring case can be matched, so searches with the :contains modifier and the
+// case-sensitive :exact modifier can't use them.
+func blindNameIndexes(s *StringParam, p SearchParamPath) []string {
+	if s.Modifier == ContainsModifier || s.Modifier == ExactModifier {
+		return nil
+	}
+	switch strings.Replace(p.Path, "[]", "", -1) {
+	case "name":
+		if p.Type != "HumanName" {
+			return models2.NameBlindIndexes("text", s.String)
+		}
+		var indexes []string
+		for _, part := range []string{"family", "given", "text"} {
+			indexes = append(indexes, models2.NameBlindIndexes(part, s.String)...)
+		}
+		return indexes
+	case "name.family":
+		return models2.NameBlindIndexes("family", s.String)
+	case "name.given":
+		return models2.NameBlindIndexes("given", s.String)
+	}
+	return nil
+}
+
+// stringMatch returns the criteria for the :exact and :contains modifiers,
+// or those of defaultMatch when there is no modifier
+func (m *MongoSearcher) stringMatch(s *StringParam, defaultMatch func(string) interface{}) interface{} {
+	switch s.Modifier {
+	case ExactModifier:
+		return s.String
+	case ContainsModifier:
+		return m.cicontains(s.String)
+	}
+	return defaultMatch(s.String)
+}
+
 func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
+	if t.Modifier == TextModifier {
+		return m.createTokenTextQueryObject(t)
+	}
+	if isTerminologyModifier(t.Modifier) {
+		return m.createTokenTerminologyQueryObject(t)
+	}
 
 	var systemCriteria interface{}
 	var codeCriteria interface{}
@@ -1361,6 +1509,11 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 			if codeCriteria != nil {
 				criteria["value"] = codeCriteria
 			}
+			if codeCriteria != nil && strings.Replace(p.Path, "[]", "", -1) == "identifier" {
+				// encrypted identifiers
+				indexes := models2.IdentifierBlindIndexes(t.System, t.Code, t.AnySystem)
+				return withBlindIndexes(buildBSON(p.Path, criteria), models2.BlindIdentifierField, indexes)
+			}
 		case "ContactPoint":
 			criteria["value"] = m.ci(t.Code)
 			if !t.AnySystem {
@@ -1387,12 +1540,106 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 		return buildBSON(p.Path, criteria)
 	}
 
-	return orPaths(single, t.Paths)
+	result := orPaths(single, t.Paths)
+	if t.Modifier == NotModifier {
+		// this also matches resources without the element
+		return bson.M{"$nor": []bson.M{result}}
+	}
+	return result
+}
+
+// createTokenTextQueryObject searches the text associated with codes and
+// identifiers, i.e. CodeableConcept.text, Coding.display and Identifier.type.text
+// tokenTextPaths returns the paths of a token parameter that have text for the :text modifier
+func tokenTextPaths(t *TokenParam) []SearchParamPath {
+	var paths []SearchParamPath
+	for _, p := range t.Paths {
+		switch p.Type {
+		case "CodeableConcept", "Coding", "Identifier":
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", t.Name)))
+	}
+	return paths
+}
+
+func (m *MongoSearcher) createTokenTextQueryObject(t *TokenParam) bson.M {
+	paths := tokenTextPaths(t)
+	match := m.textMatch(t.Code)
+
+	single := func(p SearchParamPath) bson.M {
+		switch p.Type {
+		case "CodeableConcept":
+			return buildBSON(p.Path, bson.M{
+				"$or": []bson.M{
+					bson.M{"text": match},
+					bson.M{"coding.display": match},
+				},
+			})
+		case "Coding":
+			return buildBSON(p.Path, bson.M{"display": match})
+		default:
+			return buildBSON(p.Path, bson.M{"type.text": match})
+		}
+	}
+
+	return orPaths(single, paths)
+}
+
+// createTokenTerminologyQueryObject matches the codes in a value set (:in and :not-in) or above or below a code
+// in its code system (:above and :below)
+func (m *MongoSearcher) createTokenTerminologyQueryObject(t *TokenParam) bson.M {
+	paths := tokenCodePaths(t)
+	codes := expandTokenParam(t, "mongo "+m.db.Name(), terminologySource(func(query Query) ([]*models2.Resource, error) {
+		resources, _, err := m.Search(query)
+		return resources, err
+	}))
+
+	single := func(p SearchParamPath) bson.M {
+		if p.Type == "code" {
+			return buildBSON(p.Path, bson.M{"$in": codes.all()})
+		}
+		var alternatives []bson.M
+		for _, system := range codes.systems {
+			criteria := bson.M{"system": system, "code": bson.M{"$in": codes.bySystem[system]}}
+			if p.Type == "CodeableConcept" {
+				criteria = bson.M{"coding": bson.M{"$elemMatch": criteria}}
+			}
+			alternatives = append(alternatives, buildBSON(p.Path, criteria))
+		}
+		switch len(alternatives) {
+		case 0:
+			// an empty value set matches nothing
+			return bson.M{"_id": bson.M{"$exists": false}}
+		case 1:
+			return alternatives[0]
+		}
+		return bson.M{"$or": alternatives}
+	}
+
+	result := orPaths(single, paths)
+	if t.Modifier == NotInModifier {
+		// this also matches resources without the element
+		return bson.M{"$nor": []bson.M{result}}
+	}
+	return result
 }
 
 func (m *MongoSearcher) createURIQueryObject(u *URIParam) bson.M {
+	var criteria interface{}
+	switch u.Modifier {
+	case BelowModifier:
+		criteria = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(u.URI)}
+	case AboveModifier:
+		criteria = bson.M{"$in": u.Ancestors()}
+	default:
+		criteria = u.URI
+	}
+
 	single := func(p SearchParamPath) bson.M {
-		return buildBSON(p.Path, u.URI)
+		return buildBSON(p.Path, criteria)
 	}
 
 	return orPaths(single, u.Paths)
@@ -1601,6 +1848,14 @@ func (m *MongoSearcher) ciToken(s string) interface{} {
 	return s
 }
 
+// Case-insensitive contains
+func (m *MongoSearcher) cicontains(s string) interface{} {
+	if m.enableCISearches {
+		return primitive.Regex{Pattern: regexp.QuoteMeta(s), Options: "i"}
+	}
+	return primitive.Regex{Pattern: regexp.QuoteMeta(s)}
+}
+
 // Case-insensitive starts-with
 // TODO: consider case-insensitive indexes in MongoDB 3.4 (https://docs.mongodb.com/manual/core/index-case-insensitive/)
 func (m *MongoSearcher) cisw(s string) interface{} {
@@ -1610,6 +1865,29 @@ func (m *MongoSearcher) cisw(s string) interface{} {
 	return s
 }
 
+// Starts-with match for the :text modifier, which is case-insensitive if enabled
+// but unlike cisw never an exact match
+func (m *MongoSearcher) textMatch(s string) interface{} {
+	if m.enableCISearches {
+		return m.cisw(s)
+	}
+	return primitive.Regex{Pattern: fmt.Sprintf("^%s", regexp.QuoteMeta(s))}
+}
+
+// withBlindIndexes extends a query to also match encrypted resources that have one of the
+// given blind indexes (see models2.BlindIdentifierField)
+func withBlindIndexes(query bson.M, field string, indexes []string) bson.M {
+	if len(indexes) == 0 {
+		return query
+	}
+	return bson.M{
+		"$or": []bson.M{
+			query,
+			bson.M{field: bson.M{"$in": indexes}},
+		},
+	}
+}
+
 // When multiple paths are present, they should be represented as an OR.
 // objFunc is a function that generates a single query for a path
 func orPaths(objFunc func(SearchParamPath) bson.M, paths []SearchParamPath) bson.M {
@@ -1,6 +1,7 @@
 package search
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
 	"github.com/pebbe/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -1596,6 +1598,86 @@ func (m *MongoSearchSuite) TestNonMatchingPatientNameStringQuery(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
+// Test searches of encrypted identifiers and names using blind indexes
+
+func (m *MongoSearchSuite) TestPatientQueryObjectsWithBlindIndexes(c *C) {
+	keyring, err := models2.NewKeyring(map[string][]byte{"key1": make([]byte, 32)}, "key1")
+	util.CheckErr(err)
+	models2.SetKeyring(keyring)
+	defer models2.SetKeyring(nil)
+
+	q := Query{"Patient", "identifier=http://acme.com|1234"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				"identifier": bson.M{
+					"$elemMatch": bson.M{
+						"system": primitive.Regex{Pattern: "^http://acme\\.com$", Options: "i"},
+						"value":  primitive.Regex{Pattern: "^1234$", Options: "i"},
+					},
+				},
+			},
+			bson.M{models2.BlindIdentifierField: bson.M{"$in": models2.IdentifierBlindIndexes("http://acme.com", "1234", false)}},
+		},
+	})
+
+	q = Query{"Patient", "family=Peters"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"name.family": primitive.Regex{Pattern: "^Peters$", Options: "i"}},
+			bson.M{models2.BlindNameField: bson.M{"$in": models2.NameBlindIndexes("family", "Peters")}},
+		},
+	})
+
+	// only whole names ignoring case can be matched
+	q = Query{"Patient", "name:contains=Pete"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o["$or"], HasLen, 3)
+	q = Query{"Patient", "family:exact=Peters"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": "Peters"})
+}
+
+func (m *MongoSearchSuite) TestEncryptedPatientQueriesWithBlindIndexes(c *C) {
+	keyring, err := models2.NewKeyring(map[string][]byte{"key1": make([]byte, 32)}, "key1")
+	util.CheckErr(err)
+	models2.SetKeyring(keyring)
+	defer models2.SetKeyring(nil)
+
+	doc, err := models2.ConvertJsonToGoFhirBSON([]byte(`{
+		"resourceType": "Patient",
+		"id": "encrypted1",
+		"identifier": [{ "system": "http://ns.electronichealth.net.au/id/hi/mc", "value": "2123456701" }],
+		"name": [{ "family": "Zyxwv", "given": ["Alice"] }]
+	}`), models2.WhatToEncrypt{PatientDetails: true}, map[string]string{})
+	util.CheckErr(err)
+	collection := m.MongoSearcher.GetDB().Collection("patients")
+	_, err = collection.InsertOne(context.Background(), doc)
+	util.CheckErr(err)
+	defer collection.DeleteOne(context.Background(), bson.M{"_id": "encrypted1"})
+
+	queries := []string{
+		"identifier=http://ns.electronichealth.net.au/id/hi/mc|2123456701",
+		"identifier=2123456701",
+		"name=zyxwv",
+		"family=Zyxwv",
+		"given=ALICE",
+	}
+	for _, query := range queries {
+		results, _, err := m.MongoSearcher.Search(Query{"Patient", query})
+		util.CheckErr(err)
+		c.Assert(results, HasLen, 1, Commentf(query))
+	}
+
+	for _, query := range []string{"name=Zyx", "family:exact=zyxwv"} {
+		results, _, err := m.MongoSearcher.Search(Query{"Patient", query})
+		util.CheckErr(err)
+		c.Assert(results, HasLen, 0, Commentf(query))
+	}
+}
+
 func (m *MongoSearchSuite) TestPatientSortByNameAscending(c *C) {
 	q := Query{"Patient", "_sort=name"}
 
@@ -1752,6 +1834,27 @@ func (m *MongoSearchSuite) TestValueQuantityQueryByValueAndWrongUnit(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
+func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValue(c *C) {
+	q := Query{"Observation", "value-quantity=185"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"valueQuantity.value.__from": bson.M{"$gte": 184.5},
+		"valueQuantity.value.__to":   bson.M{"$lte": 185.5},
+	})
+}
+
+func (m *MongoSearchSuite) TestValueQuantityQueryByValue(c *C) {
+	q := Query{"Observation", "value-quantity=185"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Observation", "value-quantity=186"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
 func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueAndSystemAndCode(c *C) {
 	q := Query{"Observation", "value-quantity=185|http://unitsofmeasure.org|[lb_av]"}
 	o := m.MongoSearcher.createQueryObject(q)
@@ -2004,6 +2107,298 @@ func getQuantityComparisonValue(q *models.Quantity) string {
 
 // TODO: Test quantity searches on Money, SimpleQuantity, Duration, Count, Distance, and Age
 
+// Test composite searches
+
+func (m *MongoSearchSuite) TestObservationCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt184"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"code.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": primitive.Regex{Pattern: "^http://loinc\\.org$", Options: "i"},
+				"code":   primitive.Regex{Pattern: "^3141-9$", Options: "i"},
+			},
+		},
+		"valueQuantity.value.__to": bson.M{"$gt": float64(184)},
+	})
+}
+
+func (m *MongoSearchSuite) TestObservationCodeValueQuantityQuery(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt184"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Observation", "code-value-quantity=http://loinc.org|3141-9$gt186"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	// the HbA1c observation has a lower value
+	q = Query{"Observation", "code-value-quantity=http://loinc.org|17856-6$gt184"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestObservationComponentCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "component-code-value-quantity=http://loinc.org|8480-6$lt60"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"component": bson.M{
+			"$elemMatch": bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": primitive.Regex{Pattern: "^http://loinc\\.org$", Options: "i"},
+						"code":   primitive.Regex{Pattern: "^8480-6$", Options: "i"},
+					},
+				},
+				"valueQuantity.value.__from": bson.M{"$lt": float64(60)},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestObservationComboCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "combo-code-value-quantity=http://loinc.org|8480-6$gt100"}
+	o := m.MongoSearcher.createQueryObject(q)
+	code := bson.M{
+		"$elemMatch": bson.M{
+			"system": primitive.Regex{Pattern: "^http://loinc\\.org$", Options: "i"},
+			"code":   primitive.Regex{Pattern: "^8480-6$", Options: "i"},
+		},
+	}
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				"component": bson.M{
+					"$elemMatch": bson.M{
+						"code.coding":              code,
+						"valueQuantity.value.__to": bson.M{"$gt": float64(100)},
+					},
+				},
+			},
+			bson.M{
+				"code.coding":              code,
+				"valueQuantity.value.__to": bson.M{"$gt": float64(100)},
+			},
+		},
+	})
+}
+
+// Test search modifiers
+
+func (m *MongoSearchSuite) TestMissingModifierQueryObject(c *C) {
+	q := Query{"Patient", "gender:missing=true"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"gender": bson.M{"$exists": false}})
+
+	q = Query{"Observation", "value-date:missing=false"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"valueDateTime": bson.M{"$exists": true}},
+			bson.M{"valuePeriod": bson.M{"$exists": true}},
+		},
+	})
+
+	q = Query{"Observation", "value-date:missing=true"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$and": []bson.M{
+			bson.M{"valueDateTime": bson.M{"$exists": false}},
+			bson.M{"valuePeriod": bson.M{"$exists": false}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestMissingModifierQuery(c *C) {
+	q := Query{"Patient", "gender:missing=false"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	q = Query{"Patient", "gender:missing=true"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	q = Query{"Condition", "asserter:missing=true"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 4)
+}
+
+func (m *MongoSearchSuite) TestExactModifierQueryObject(c *C) {
+	q := Query{"Patient", "family:exact=Peters"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": "Peters"})
+}
+
+func (m *MongoSearchSuite) TestExactModifierQuery(c *C) {
+	q := Query{"Patient", "family:exact=Peters"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	// :exact is always case-sensitive
+	q = Query{"Patient", "family:exact=peters"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	q = Query{"Patient", "family:exact=Pete"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestContainsModifierQueryObject(c *C) {
+	q := Query{"Patient", "family:contains=ete"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": primitive.Regex{Pattern: "ete", Options: "i"}})
+
+	searcher := NewMongoSearcher(nil, nil, true, false, false, false) // enableCISearches = false
+	o = searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"name.family": primitive.Regex{Pattern: "ete"}})
+}
+
+func (m *MongoSearchSuite) TestContainsModifierQuery(c *C) {
+	q := Query{"Patient", "name:contains=ALL"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "name:contains=eter"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+}
+
+func (m *MongoSearchSuite) TestNotModifierQueryObject(c *C) {
+	q := Query{"Condition", "code:not=http://snomed.info/sct|123641001"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$nor": []bson.M{
+			bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": primitive.Regex{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+						"code":   primitive.Regex{Pattern: "^123641001$", Options: "i"},
+					},
+				},
+			},
+		},
+	})
+
+	searcher := NewMongoSearcher(nil, nil, true, true, true, false) // tokenParametersCaseSensitive = true
+	o = searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$nor": []bson.M{
+			bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": "http://snomed.info/sct",
+						"code":   "123641001",
+					},
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestNotModifierQuery(c *C) {
+	q := Query{"Condition", "code:not=http://snomed.info/sct|123641001"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 4)
+}
+
+func (m *MongoSearchSuite) TestTextModifierQueryObject(c *C) {
+	q := Query{"Condition", "code:text=pertussis"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"code.text": primitive.Regex{Pattern: "^pertussis", Options: "i"}},
+			bson.M{"code.coding.display": primitive.Regex{Pattern: "^pertussis", Options: "i"}},
+		},
+	})
+
+	q = Query{"Patient", "identifier:text=MRN"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"identifier.type.text": primitive.Regex{Pattern: "^MRN", Options: "i"}})
+
+	// still a starts-with match without case-insensitive searches
+	searcher := NewMongoSearcher(nil, nil, true, false, false, false) // enableCISearches = false
+	o = searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"identifier.type.text": primitive.Regex{Pattern: "^MRN"}})
+}
+
+func (m *MongoSearchSuite) TestMissingModifierWithoutPaths(c *C) {
+	q := Query{"Location", "near:missing=true"}
+	c.Assert(func() { m.MongoSearcher.createQueryObject(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"near\" modifier is invalid"))
+}
+
+func (m *MongoSearchSuite) TestTextModifierQuery(c *C) {
+	q := Query{"Condition", "code:text=pertussis"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Condition", "code:text=diagnosis"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+}
+
+func (m *MongoSearchSuite) TestBelowModifierQueryObject(c *C) {
+	q := Query{"Subscription", "url:below=https://biliwatch.com/customers/"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"channel.endpoint": primitive.Regex{Pattern: "^https://biliwatch\\.com/customers/"},
+	})
+}
+
+func (m *MongoSearchSuite) TestBelowModifierQuery(c *C) {
+	q := Query{"Subscription", "url:below=https://biliwatch.com/customers/"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Subscription", "url:below=https://biliwatch.com/others/"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestAboveModifierQueryObject(c *C) {
+	q := Query{"Subscription", "url:above=https://biliwatch.com/customers/mount-auburn-miu/on-result/123"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"channel.endpoint": bson.M{
+			"$in": []string{
+				"https://biliwatch.com/customers/mount-auburn-miu/on-result/123",
+				"https://biliwatch.com/customers/mount-auburn-miu/on-result",
+				"https://biliwatch.com/customers/mount-auburn-miu",
+				"https://biliwatch.com/customers",
+				"https://biliwatch.com",
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestAboveModifierQuery(c *C) {
+	q := Query{"Subscription", "url:above=https://biliwatch.com/customers/mount-auburn-miu/on-result/123"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Subscription", "url:above=https://biliwatch.com/customers/mount-auburn-miu"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
 // Test URI searches on URI
 
 func (m *MongoSearchSuite) TestSubscriptionURLQueryObject(c *C) {
@@ -2736,9 +3131,9 @@ func (m *MongoSearchSuite) TestInvalidSearchParameterPanics(c *C) {
 }
 
 // Test that unimplemented features PANIC (to ensure people know they are broken)
-func (m *MongoSearchSuite) TestCompositeSearchPanics(c *C) {
-	q := Query{"Group", "characteristic-value=gender$male"}
-	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("SEARCH_NONE", "Error: no processable search found for Group search parameters \"characteristic-value\""))
+func (m *MongoSearchSuite) TestCompositeSearchPanicsForWrongNumberOfValues(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|3141-9"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"code-value-quantity\" content is invalid"))
 }
 
 func (m *MongoSearchSuite) TestPrefixedDateSearchPanicsForUnsupportedPrefix(c *C) {
@@ -2760,8 +3155,17 @@ func (m *MongoSearchSuite) TestPrefixedQuantitySearchPanicsForUnsupportedPrefix(
 }
 
 func (m *MongoSearchSuite) TestModifierSearchPanics(c *C) {
-	q := Query{"Condition", "code:text=headache"}
+	q := Query{"Condition", "code:exact=headache"}
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code\" modifier is invalid"))
+	q = Query{"Patient", "name:below=Peters"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"name\" modifier is invalid"))
+	q = Query{"Patient", "gender:text=male"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"gender\" modifier is invalid"))
+}
+
+func (m *MongoSearchSuite) TestMissingModifierSearchPanicsForInvalidValue(c *C) {
+	q := Query{"Patient", "gender:missing=maybe"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"gender\" content is invalid"))
 }
 
 func (m *MongoSearchSuite) TestUnsupportedSearchResultParameterPanics(c *C) {
@@ -2868,6 +3272,46 @@ func (m *MongoSearchSuite) TestSummaryCountWithCountsDisabled(c *C) {
 	c.Assert(total, Equals, uint32(2))
 }
 
+func (m *MongoSearchSuite) TestSummaryProjection(c *C) {
+	q := Query{"Patient", "_elements=gender"}
+	c.Assert(subsetProjection(q.Resource, q.Options()), DeepEquals, bson.M{
+		"_id": 1, "resourceType": 1, "meta": 1,
+		"__gofhirEncryptedBSON": 1, "__gofhirEncryptionKeyId": 1,
+		"gender": 1, "_gender": 1,
+	})
+
+	q = Query{"Patient", "_summary=data"}
+	c.Assert(subsetProjection(q.Resource, q.Options()), DeepEquals, bson.M{"text": 0, "_text": 0})
+
+	q = Query{"Observation", "_summary=true"}
+	projection := subsetProjection(q.Resource, q.Options())
+	c.Assert(projection["status"], Equals, 1)
+	c.Assert(projection["valueQuantity"], Equals, 1)
+	c.Assert(projection["text"], IsNil)
+	c.Assert(projection["comment"], IsNil)
+
+	q = Query{"Observation", "_summary=text"}
+	projection = subsetProjection(q.Resource, q.Options())
+	c.Assert(projection["text"], Equals, 1)
+	c.Assert(projection["status"], Equals, 1)
+	c.Assert(projection["code"], Equals, 1)
+	c.Assert(projection["subject"], IsNil)
+
+	q = Query{"Patient", "_summary=false"}
+	c.Assert(subsetProjection(q.Resource, q.Options()), IsNil)
+}
+
+func (m *MongoSearchSuite) TestElementsSearch(c *C) {
+	q := Query{"Patient", "_elements=gender"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(results, HasLen, 2)
+	for _, result := range results {
+		c.Assert(result.Id(), Not(Equals), "")
+		c.Assert(strings.Contains(string(result.JsonBytes()), `"name"`), Equals, false)
+	}
+}
+
 // Test internally used functions
 
 func (m *MongoSearchSuite) TestBuildBsonForCompositeCriteriaAndPathWithArrayAncestor(c *C) {
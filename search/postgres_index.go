@@ -0,0 +1,325 @@
+package search
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PostgresIndexRow is a single row of a resource type's search index table.
+// A resource gets one row for every value reachable through the paths of
+// each of its search parameters. Only the columns relevant to the parameter's
+// type are set; the rest are left NULL.
+type PostgresIndexRow struct {
+	Param       string
+	System      *string
+	Code        *string
+	ValueString *string
+	DateFrom    *time.Time
+	DateTo      *time.Time
+	NumFrom     *float64
+	NumTo       *float64
+	RefType     *string
+	RefID       *string
+}
+
+// ExtractPostgresIndexRows walks a resource (in the GoFHIR BSON representation produced
+// by models2.Resource.GetBSON) along the paths in the SearchParameterDictionary and returns
+// the rows that should be stored in its search index table.
+//
+// _id and _lastUpdated are not extracted as they are stored as columns of the resource table.
+func ExtractPostgresIndexRows(resourceType string, doc []bson.E) []PostgresIndexRow {
+	var rows []PostgresIndexRow
+	for name, info := range SearchParameterDictionary[resourceType] {
+		if name == IDParam || name == LastUpdatedParam {
+			continue
+		}
+		for _, path := range info.Paths {
+			for _, value := range bsonValuesAtPath(doc, path.Path) {
+				rows = append(rows, indexRowsForValue(info, path, value)...)
+			}
+		}
+	}
+	return rows
+}
+
+func indexRowsForValue(info SearchParamInfo, path SearchParamPath, value interface{}) []PostgresIndexRow {
+	var rows []PostgresIndexRow
+	add := func(row PostgresIndexRow) {
+		row.Param = info.Name
+		rows = append(rows, row)
+	}
+
+	switch info.Type {
+	case "token":
+		switch path.Type {
+		// ValueString holds the text searched by the :text modifier
+		case "Coding":
+			add(PostgresIndexRow{System: bsonStringAt(value, "system"), Code: bsonStringAt(value, "code"), ValueString: bsonStringAt(value, "display")})
+		case "CodeableConcept":
+			for _, coding := range bsonValuesAtPath(value, "[]coding") {
+				add(PostgresIndexRow{System: bsonStringAt(coding, "system"), Code: bsonStringAt(coding, "code"), ValueString: bsonStringAt(coding, "display")})
+			}
+			if text := bsonStringAt(value, "text"); text != nil {
+				add(PostgresIndexRow{ValueString: text})
+			}
+		case "Identifier":
+			row := PostgresIndexRow{System: bsonStringAt(value, "system"), Code: bsonStringAt(value, "value")}
+			if identifierType, found := bsonLookup(value, "type"); found {
+				row.ValueString = bsonStringAt(identifierType, "text")
+			}
+			add(row)
+		case "ContactPoint":
+			add(PostgresIndexRow{System: bsonStringAt(value, "use"), Code: bsonStringAt(value, "value")})
+		case "boolean":
+			if b, ok := value.(bool); ok {
+				add(PostgresIndexRow{Code: stringPtr(strconv.FormatBool(b))})
+			}
+		default:
+			if s, ok := value.(string); ok {
+				add(PostgresIndexRow{Code: stringPtr(s)})
+			}
+		}
+
+	case "string":
+		var strs []interface{}
+		switch path.Type {
+		case "HumanName":
+			for _, field := range []string{"text", "[]family", "[]given"} {
+				strs = append(strs, bsonValuesAtPath(value, field)...)
+			}
+		case "Address":
+			for _, field := range []string{"text", "[]line", "city", "state", "postalCode", "country"} {
+				strs = append(strs, bsonValuesAtPath(value, field)...)
+			}
+		default:
+			strs = []interface{}{value}
+		}
+		for _, str := range strs {
+			if s, ok := str.(string); ok {
+				add(PostgresIndexRow{ValueString: stringPtr(s)})
+			}
+		}
+
+	case "uri":
+		if s, ok := value.(string); ok {
+			add(PostgresIndexRow{ValueString: stringPtr(s)})
+		}
+
+	case "reference":
+		if path.Type == "Resource" {
+			// inlined resources (e.g. Bundle.entry.resource) are referenced by their type and id
+			add(PostgresIndexRow{RefType: bsonStringAt(value, "resourceType"), RefID: bsonStringAt(value, "_id")})
+		} else {
+			row := PostgresIndexRow{
+				RefType:     bsonStringAt(value, "reference__type"),
+				RefID:       bsonStringAt(value, "reference__id"),
+				ValueString: bsonStringAt(value, "reference"),
+			}
+			if row.RefID != nil || row.ValueString != nil {
+				add(row)
+			}
+		}
+
+	case "date":
+		switch path.Type {
+		case "Period":
+			row := PostgresIndexRow{
+				DateFrom: bsonTimeAt(value, "start", models2.Gofhir__from),
+				DateTo:   bsonTimeAt(value, "end", models2.Gofhir__to),
+			}
+			if row.DateFrom != nil || row.DateTo != nil || bsonDocument(value) != nil {
+				add(row)
+			}
+		case "Timing":
+			for _, event := range bsonValuesAtPath(value, "[]event") {
+				if from, to := bsonDateRange(event); from != nil {
+					add(PostgresIndexRow{DateFrom: from, DateTo: to})
+				}
+			}
+		default:
+			if from, to := bsonDateRange(value); from != nil {
+				add(PostgresIndexRow{DateFrom: from, DateTo: to})
+			}
+		}
+
+	case "number":
+		if from, to := bsonNumberRange(value); from != nil {
+			add(PostgresIndexRow{NumFrom: from, NumTo: to})
+		}
+
+	case "quantity":
+		var from, to *float64
+		if values := bsonValuesAtPath(value, "value"); len(values) > 0 {
+			from, to = bsonNumberRange(values[0])
+		}
+		add(PostgresIndexRow{
+			NumFrom: from,
+			NumTo:   to,
+			System:  bsonStringAt(value, "system"),
+			Code:    bsonStringAt(value, "code"),
+		})
+	}
+
+	return rows
+}
+
+var bsonPathIndexRegex = regexp.MustCompile("^\\[(\\d+)\\](.*)$")
+
+// bsonValuesAtPath returns all the values found by following a search path
+// (e.g. "[]name.[]given" or "[0]entry.resource") from a BSON document.
+// Arrays encountered along the way are flattened.
+func bsonValuesAtPath(doc interface{}, path string) []interface{} {
+	current := []interface{}{doc}
+	for _, segment := range strings.Split(path, ".") {
+		index := -1
+		if strings.HasPrefix(segment, "[]") {
+			segment = segment[2:]
+		} else if m := bsonPathIndexRegex.FindStringSubmatch(segment); m != nil {
+			index, _ = strconv.Atoi(m[1])
+			segment = m[2]
+		}
+
+		var next []interface{}
+		for _, item := range current {
+			value, found := bsonLookup(item, segment)
+			if !found || value == nil {
+				continue
+			}
+			if array, isArray := bsonArray(value); isArray {
+				if index >= 0 {
+					if index < len(array) {
+						next = append(next, array[index])
+					}
+				} else {
+					next = append(next, array...)
+				}
+			} else {
+				next = append(next, value)
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+func bsonDocument(value interface{}) []bson.E {
+	switch v := value.(type) {
+	case []bson.E:
+		return v
+	case *[]bson.E:
+		return *v
+	case bson.D:
+		return v
+	}
+	return nil
+}
+
+func bsonArray(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+	case primitive.A:
+		return v, true
+	}
+	return nil, false
+}
+
+func bsonLookup(value interface{}, key string) (interface{}, bool) {
+	for _, elem := range bsonDocument(value) {
+		if elem.Key == key {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+func bsonStringAt(value interface{}, key string) *string {
+	v, _ := bsonLookup(value, key)
+	if s, ok := v.(string); ok {
+		return &s
+	}
+	return nil
+}
+
+// bsonTimeAt returns a date's range boundary (e.g. "__from") from a sub-document
+func bsonTimeAt(value interface{}, key string, boundary string) *time.Time {
+	v, found := bsonLookup(value, key)
+	if !found {
+		return nil
+	}
+	from, to := bsonDateRange(v)
+	if boundary == models2.Gofhir__from {
+		return from
+	}
+	return to
+}
+
+// bsonDateRange converts a GoFHIR date ({__from, __to, __strDate}) or an instant into a time range
+func bsonDateRange(value interface{}) (from *time.Time, to *time.Time) {
+	if t, ok := bsonTime(value); ok {
+		return &t, &t
+	}
+	fromValue, _ := bsonLookup(value, models2.Gofhir__from)
+	toValue, _ := bsonLookup(value, models2.Gofhir__to)
+	if t, ok := bsonTime(fromValue); ok {
+		from = &t
+	}
+	if t, ok := bsonTime(toValue); ok {
+		to = &t
+	}
+	return
+}
+
+func bsonTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case primitive.DateTime:
+		return time.Unix(int64(v)/1000, int64(v)%1000*int64(time.Millisecond)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// bsonNumberRange converts a GoFHIR decimal ({__from, __to, __num, __strNum}) or an integer into a range
+func bsonNumberRange(value interface{}) (from *float64, to *float64) {
+	if f, ok := bsonNumber(value); ok {
+		return &f, &f
+	}
+	fromValue, _ := bsonLookup(value, models2.Gofhir__from)
+	toValue, _ := bsonLookup(value, models2.Gofhir__to)
+	if f, ok := bsonNumber(fromValue); ok {
+		from = &f
+	}
+	if f, ok := bsonNumber(toValue); ok {
+		to = &f
+	}
+	return
+}
+
+func bsonNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int32:
+		return float64(v), true
+	case *int32:
+		return float64(*v), true
+	case int64:
+		return float64(v), true
+	case *int64:
+		return float64(*v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
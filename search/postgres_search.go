@@ -0,0 +1,615 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PostgresQuerier is implemented by both *sql.DB and *sql.Tx so searches can
+// run inside or outside of a transaction.
+type PostgresQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// PostgresSearcher implements FHIR searches using the per-resource-type search
+// index tables of a PostgreSQL schema.
+type PostgresSearcher struct {
+	db                           PostgresQuerier
+	ctx                          context.Context
+	schema                       string
+	countTotalResults            bool
+	enableCISearches             bool
+	tokenParametersCaseSensitive bool
+}
+
+// NewPostgresSearcher creates a new instance of a PostgresSearcher for a schema
+func NewPostgresSearcher(db PostgresQuerier, ctx context.Context, schema string, countTotalResults, enableCISearches, tokenParametersCaseSensitive bool) *PostgresSearcher {
+	return &PostgresSearcher{
+		db:                           db,
+		ctx:                          ctx,
+		schema:                       schema,
+		countTotalResults:            countTotalResults,
+		enableCISearches:             enableCISearches,
+		tokenParametersCaseSensitive: tokenParametersCaseSensitive,
+	}
+}
+
+// PostgresResourceTable returns the quoted name of the table holding the current versions of a resource type
+func PostgresResourceTable(schema, resourceType string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(models.PluralizeLowerResourceName(resourceType))
+}
+
+// PostgresIndexTable returns the quoted name of the search index table of a resource type
+func PostgresIndexTable(schema, resourceType string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(models.PluralizeLowerResourceName(resourceType)+"_search")
+}
+
+// PostgresHistoryTable returns the quoted name of the table holding every version of every resource
+func PostgresHistoryTable(schema string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier("history")
+}
+
+// DecodePostgresResource converts a stored resource blob (GoFHIR BSON) back into a resource
+func DecodePostgresResource(blob []byte) (*models2.Resource, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(blob, &doc); err != nil {
+		return nil, errors.Wrap(err, "DecodePostgresResource: bson.Unmarshal failed")
+	}
+	return models2.NewResourceFromBSON(doc)
+}
+
+// Search takes a Query and returns the matching resources, any resources
+// included via _include or _revinclude and the total number of matches.
+func (p *PostgresSearcher) Search(query Query) (resources []*models2.Resource, included []*models2.Resource, total uint32, err error) {
+	options := query.Options()
+	b := &postgresQueryBuilder{searcher: p}
+	where := b.whereClause(query.Resource, "r", query.Params())
+	whereArgs := len(b.args)
+	table := PostgresResourceTable(p.schema, query.Resource)
+
+	if p.countTotalResults || options.Summary == "count" {
+		countSQL := fmt.Sprintf("SELECT count(*) FROM %s r WHERE %s", table, where)
+		glog.V(5).Infof("postgres count: %s %v", countSQL, b.args)
+		err = p.db.QueryRowContext(p.ctx, countSQL, b.args[:whereArgs]...).Scan(&total)
+		if err != nil {
+			return nil, nil, 0, errors.Wrap(err, "Search count error")
+		}
+	}
+
+	// If the search was for _summary=count, just return the total.
+	if options.Summary == "count" {
+		return nil, nil, total, nil
+	}
+
+	orderBy := b.orderBy(query.Resource, "r", options.Sort)
+	searchSQL := fmt.Sprintf("SELECT r.resource FROM %s r WHERE %s ORDER BY %s LIMIT %d OFFSET %d", table, where, orderBy, options.Count, options.Offset)
+	glog.V(5).Infof("postgres search: %s %v", searchSQL, b.args)
+	rows, err := p.db.QueryContext(p.ctx, searchSQL, b.args...)
+	if err != nil {
+		return nil, nil, 0, errors.Wrap(err, "Search error")
+	}
+	resources, err = scanPostgresResources(rows)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(options.Include) > 0 || len(options.RevInclude) > 0 {
+		included, err = p.loadIncludes(query.Resource, resources, options)
+		if err != nil {
+			return nil, nil, 0, errors.Wrap(err, "Search includes error")
+		}
+	}
+
+	return resources, included, total, nil
+}
+
+// loadIncludes retrieves the resources referenced by (_include) or referencing (_revinclude) the matches
+func (p *PostgresSearcher) loadIncludes(resourceType string, resources []*models2.Resource, o *QueryOptions) ([]*models2.Resource, error) {
+	if len(resources) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	ids := make([]string, len(resources))
+	for i, resource := range resources {
+		ids[i] = resource.Id()
+		seen[resourceType+"/"+resource.Id()] = true
+	}
+
+	toLoad := make(map[string][]string)
+	want := func(typ, id string) {
+		if _, known := SearchParameterDictionary[typ]; !known || seen[typ+"/"+id] {
+			return
+		}
+		seen[typ+"/"+id] = true
+		toLoad[typ] = append(toLoad[typ], id)
+	}
+
+	for _, incl := range o.Include {
+		rows, err := p.db.QueryContext(p.ctx,
+			"SELECT DISTINCT s.ref_type, s.ref_id FROM "+PostgresIndexTable(p.schema, resourceType)+
+				" s WHERE s.param = $1 AND s.id = ANY($2) AND s.ref_type IS NOT NULL AND s.ref_id IS NOT NULL",
+			incl.Parameter.Name, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var typ, id string
+			if err := rows.Scan(&typ, &id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if isValidTarget(typ, incl.Parameter) {
+				want(typ, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, incl := range o.RevInclude {
+		if !isValidTarget(resourceType, incl.Parameter) {
+			continue
+		}
+		rows, err := p.db.QueryContext(p.ctx,
+			"SELECT DISTINCT s.id FROM "+PostgresIndexTable(p.schema, incl.Parameter.Resource)+
+				" s WHERE s.param = $1 AND s.ref_type = $2 AND s.ref_id = ANY($3)",
+			incl.Parameter.Name, resourceType, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			want(incl.Parameter.Resource, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	types := make([]string, 0, len(toLoad))
+	for typ := range toLoad {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var included []*models2.Resource
+	for _, typ := range types {
+		rows, err := p.db.QueryContext(p.ctx,
+			"SELECT resource FROM "+PostgresResourceTable(p.schema, typ)+" WHERE id = ANY($1) ORDER BY id",
+			pq.Array(toLoad[typ]))
+		if err != nil {
+			return nil, err
+		}
+		resources, err := scanPostgresResources(rows)
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, resources...)
+	}
+	return included, nil
+}
+
+func scanPostgresResources(rows *sql.Rows) (resources []*models2.Resource, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, errors.Wrap(err, "Search result scan error")
+		}
+		resource, err := DecodePostgresResource(blob)
+		if err != nil {
+			return nil, errors.Wrap(err, "Search result decoding error")
+		}
+		resources = append(resources, resource)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Search rows error")
+	}
+	return resources, nil
+}
+
+// postgresQueryBuilder accumulates the SQL arguments for a single query
+type postgresQueryBuilder struct {
+	searcher *PostgresSearcher
+	args     []interface{}
+	aliases  int
+}
+
+// arg adds an argument and returns its placeholder
+func (b *postgresQueryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// alias returns a table alias that is unique within the query
+func (b *postgresQueryBuilder) alias(prefix string) string {
+	b.aliases++
+	return prefix + strconv.Itoa(b.aliases)
+}
+
+func (b *postgresQueryBuilder) whereClause(resourceType string, alias string, params []SearchParam) string {
+	if len(params) == 0 {
+		return "TRUE"
+	}
+	conditions := make([]string, len(params))
+	for i, param := range params {
+		conditions[i] = b.paramCondition(resourceType, alias, param)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func (b *postgresQueryBuilder) paramCondition(resourceType string, alias string, param SearchParam) string {
+	panicOnUnsupportedFeatures(param)
+
+	switch p := param.(type) {
+	case *OrParam:
+		conditions := make([]string, len(p.Items))
+		for i, item := range p.Items {
+			conditions[i] = b.paramCondition(resourceType, alias, item)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	case *CompositeParam:
+		// the index rows don't record which element a value came from, so components can't be matched together
+		panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\": composite searches are only supported with MongoDB", p.Name)))
+	case *ReferenceParam:
+		if ref, ok := p.Reference.(ReverseChainedQueryReference); ok {
+			return b.reverseChainedCondition(resourceType, alias, ref)
+		}
+	case *MissingParam:
+		if p.Name == IDParam || p.Name == LastUpdatedParam {
+			// stored as columns, so always present
+			return strings.ToUpper(strconv.FormatBool(!p.Missing))
+		}
+	case *TokenParam:
+		if p.Modifier == TextModifier {
+			tokenTextPaths(p)
+		} else if isTerminologyModifier(p.Modifier) {
+			tokenCodePaths(p)
+		}
+		if p.Name == IDParam {
+			if p.Modifier == NotModifier {
+				return fmt.Sprintf("%s.id <> %s", alias, b.arg(p.Code))
+			}
+			return fmt.Sprintf("%s.id = %s", alias, b.arg(p.Code))
+		}
+	case *StringParam:
+		if p.Name == IDParam {
+			return fmt.Sprintf("%s.id = %s", alias, b.arg(p.String))
+		}
+	case *DateParam:
+		if p.Name == LastUpdatedParam {
+			return b.instantCondition(alias+".last_updated", p)
+		}
+	}
+
+	s := b.alias("s")
+	exists := fmt.Sprintf("EXISTS (SELECT 1 FROM %s %s WHERE %s.id = %s.id AND %s.param = %s AND %s)",
+		PostgresIndexTable(b.searcher.schema, resourceType), s, s, alias, s, b.arg(param.getInfo().Name), b.indexCondition(s, param))
+	if isNegated(param) {
+		return "NOT " + exists
+	}
+	return exists
+}
+
+// isNegated returns whether a parameter matches the resources without any
+// matching index rows
+func isNegated(param SearchParam) bool {
+	switch p := param.(type) {
+	case *MissingParam:
+		return p.Missing
+	case *TokenParam:
+		return p.Modifier == NotModifier || p.Modifier == NotInModifier
+	}
+	return false
+}
+
+// indexCondition returns the condition on a single index row (with alias s)
+func (b *postgresQueryBuilder) indexCondition(s string, param SearchParam) string {
+	switch p := param.(type) {
+	case *MissingParam:
+		// any value
+		return "TRUE"
+	case *TokenParam:
+		return b.tokenCondition(s, p)
+	case *StringParam:
+		switch p.Modifier {
+		case ExactModifier:
+			return fmt.Sprintf("%s.value_string = %s", s, b.arg(p.String))
+		case ContainsModifier:
+			return b.cicontains(s+".value_string", p.String)
+		}
+		return b.cisw(s+".value_string", p.String)
+	case *URIParam:
+		switch p.Modifier {
+		case BelowModifier:
+			return fmt.Sprintf("%s.value_string LIKE %s", s, b.arg(escapeLike(p.URI)+"%"))
+		case AboveModifier:
+			return fmt.Sprintf("%s.value_string = ANY(%s)", s, b.arg(pq.Array(p.Ancestors())))
+		}
+		return fmt.Sprintf("%s.value_string = %s", s, b.arg(p.URI))
+	case *ReferenceParam:
+		return b.referenceCondition(s, p)
+	case *DateParam:
+		return b.dateCondition(s, p)
+	case *NumberParam:
+		return b.numberCondition(s, p.Name, p.Prefix, p.Number, false)
+	case *QuantityParam:
+		condition := b.numberCondition(s, p.Name, p.Prefix, p.Number, true)
+		if p.System != "" {
+			condition += " AND " + b.ciToken(s+".system", p.System)
+		}
+		if p.Code != "" {
+			condition += " AND " + b.ciToken(s+".code", p.Code)
+		}
+		return condition
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param.getInfo().Name)))
+}
+
+func (b *postgresQueryBuilder) tokenCondition(s string, t *TokenParam) string {
+	if t.Modifier == TextModifier {
+		return b.textMatch(s+".value_string", t.Code)
+	}
+	if isTerminologyModifier(t.Modifier) {
+		return b.tokenTerminologyCondition(s, t)
+	}
+	for _, path := range t.Paths {
+		if path.Type == "boolean" && t.Code != "true" && t.Code != "false" {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", t.Name)))
+		}
+	}
+
+	if t.Code == "" {
+		// [parameter]=[system]|
+		return b.ciToken(s+".system", t.System)
+	} else if t.System == "" {
+		if t.AnySystem {
+			// [parameter]=[code]
+			return b.ciToken(s+".code", t.Code)
+		}
+		// [parameter]=|[code]
+		return b.ciToken(s+".code", t.Code) + " AND " + s + ".system IS NULL"
+	}
+	// [parameter]=[system]|[code]
+	return b.ciToken(s+".code", t.Code) + " AND " + b.ciToken(s+".system", t.System)
+}
+
+// tokenTerminologyCondition matches the codes in a value set (:in and :not-in, which is negated by isNegated)
+// or above or below a code in its code system (:above and :below)
+func (b *postgresQueryBuilder) tokenTerminologyCondition(s string, t *TokenParam) string {
+	p := b.searcher
+	codes := expandTokenParam(t, "postgres "+p.schema, terminologySource(func(query Query) ([]*models2.Resource, error) {
+		resources, _, _, err := p.Search(query)
+		return resources, err
+	}))
+	if len(codes.systems) == 0 {
+		// an empty value set matches nothing
+		return "FALSE"
+	}
+
+	var conditions []string
+	for _, system := range codes.systems {
+		conditions = append(conditions, fmt.Sprintf("(%s.system = %s AND %s.code = ANY(%s))", s, b.arg(system), s, b.arg(pq.Array(codes.bySystem[system]))))
+	}
+	// code elements have no system
+	conditions = append(conditions, fmt.Sprintf("(%s.system IS NULL AND %s.code = ANY(%s))", s, s, b.arg(pq.Array(codes.all()))))
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+func (b *postgresQueryBuilder) referenceCondition(s string, r *ReferenceParam) string {
+	switch ref := r.Reference.(type) {
+	case LocalReference:
+		condition := fmt.Sprintf("%s.ref_id = %s", s, b.arg(ref.ID))
+		if ref.Type != "" {
+			condition += fmt.Sprintf(" AND %s.ref_type = %s", s, b.arg(ref.Type))
+		}
+		return condition
+	case ExternalReference:
+		return b.ci(s+".value_string", ref.URL)
+	case ChainedQueryReference:
+		if r.referenceIsInternal() {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": chained search on contained resources is not supported", r.Name)))
+		}
+		c := b.alias("c")
+		return fmt.Sprintf("%s.ref_type = %s AND %s.ref_id IN (SELECT %s.id FROM %s %s WHERE %s)",
+			s, b.arg(ref.Type), s, c, PostgresResourceTable(b.searcher.schema, ref.Type), c,
+			b.whereClause(ref.Type, c, ref.ChainedQuery.Params()))
+	}
+	panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
+}
+
+func (b *postgresQueryBuilder) reverseChainedCondition(resourceType string, alias string, ref ReverseChainedQueryReference) string {
+	s := b.alias("s")
+	h := b.alias("h")
+	return fmt.Sprintf("%s.id IN (SELECT %s.ref_id FROM %s %s WHERE %s.param = %s AND %s.ref_type = %s AND %s.id IN (SELECT %s.id FROM %s %s WHERE %s))",
+		alias, s, PostgresIndexTable(b.searcher.schema, ref.Type), s, s, b.arg(ref.ReferenceName), s, b.arg(resourceType),
+		s, h, PostgresResourceTable(b.searcher.schema, ref.Type), h, b.whereClause(ref.Type, h, ref.Query.Params()))
+}
+
+func (b *postgresQueryBuilder) dateCondition(s string, d *DateParam) string {
+	// open-ended periods are stored with NULL boundaries
+	from := fmt.Sprintf("COALESCE(%s.date_from, '-infinity')", s)
+	to := fmt.Sprintf("COALESCE(%s.date_to, 'infinity')", s)
+	low := b.arg(d.Date.RangeLowIncl())
+	high := b.arg(d.Date.RangeHighExcl())
+
+	switch d.Prefix {
+	case EQ:
+		// "the range of the search value fully contains the range of the target value"
+		return fmt.Sprintf("%s >= %s AND %s <= %s", from, low, to, high)
+	case GT:
+		// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
+		return fmt.Sprintf("%s > %s", to, high)
+	case LT:
+		// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
+		return fmt.Sprintf("%s < %s", from, low)
+	case GE:
+		return fmt.Sprintf("(%s >= %s OR %s >= %s)", to, high, from, low)
+	case LE:
+		return fmt.Sprintf("(%s <= %s OR %s <= %s)", from, low, to, high)
+	case SA:
+		// "the range of the search value does not overlap with the range of the target value,
+		//  and the range above the search value contains the range of the target value"
+		return fmt.Sprintf("%s > %s", from, high)
+	case EB:
+		// "the range of the search value does overlap not with the range of the target value,
+		//  and the range below the search value contains the range of the target value"
+		return fmt.Sprintf("%s < %s", to, low)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+// instantCondition compares a timestamp column in the same way as the MongoDB instantSelector
+func (b *postgresQueryBuilder) instantCondition(column string, d *DateParam) string {
+	low, high := d.Date.RangeLowIncl(), d.Date.RangeHighExcl()
+	switch d.Prefix {
+	case EQ:
+		return fmt.Sprintf("%s >= %s AND %s < %s", column, b.arg(low), column, b.arg(high))
+	case GT:
+		return fmt.Sprintf("%s > %s", column, b.arg(low))
+	case GE:
+		return fmt.Sprintf("%s >= %s", column, b.arg(low))
+	case SA:
+		return fmt.Sprintf("%s > %s", column, b.arg(high))
+	case LT, EB:
+		return fmt.Sprintf("%s < %s", column, b.arg(low))
+	case LE:
+		return fmt.Sprintf("%s < %s", column, b.arg(high))
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+func (b *postgresQueryBuilder) numberCondition(s string, name string, prefix Prefix, number *utils.Number, isQuantity bool) string {
+	l, _ := number.RangeLowIncl().Float64()
+	h, _ := number.RangeHighExcl().Float64()
+	exact, _ := number.Value.Float64()
+	from := s + ".num_from"
+	to := s + ".num_to"
+
+	switch prefix {
+	case EQ:
+		return fmt.Sprintf("%s >= %s AND %s <= %s", from, b.arg(l), to, b.arg(h))
+	case LT:
+		return fmt.Sprintf("%s < %s", from, b.arg(exact))
+	case GT:
+		return fmt.Sprintf("%s > %s", to, b.arg(exact))
+	case GE:
+		return fmt.Sprintf("(%s >= %s OR %s >= %s)", to, b.arg(h), from, b.arg(l))
+	case LE:
+		return fmt.Sprintf("(%s <= %s OR %s <= %s)", from, b.arg(l), to, b.arg(h))
+	case NE:
+		if !isQuantity {
+			return fmt.Sprintf("(%s < %s OR %s >= %s)", from, b.arg(l), from, b.arg(h))
+		}
+	}
+	// SA, EB are not supported for Number or Quantity queries
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", name)))
+}
+
+// Case-insensitive match
+func (b *postgresQueryBuilder) ci(column string, value string) string {
+	if b.searcher.enableCISearches {
+		return fmt.Sprintf("lower(%s) = lower(%s)", column, b.arg(value))
+	}
+	return fmt.Sprintf("%s = %s", column, b.arg(value))
+}
+
+// Case-insensitive match for token-type search parameters
+func (b *postgresQueryBuilder) ciToken(column string, value string) string {
+	if !b.searcher.tokenParametersCaseSensitive && b.searcher.enableCISearches {
+		return fmt.Sprintf("lower(%s) = lower(%s)", column, b.arg(value))
+	}
+	return fmt.Sprintf("%s = %s", column, b.arg(value))
+}
+
+// Case-insensitive starts-with
+func (b *postgresQueryBuilder) cisw(column string, value string) string {
+	if b.searcher.enableCISearches {
+		return fmt.Sprintf("lower(%s) LIKE %s", column, b.arg(escapeLike(strings.ToLower(value))+"%"))
+	}
+	return fmt.Sprintf("%s = %s", column, b.arg(value))
+}
+
+// Starts-with match for the :text modifier, which is case-insensitive if enabled
+// but unlike cisw never an exact match
+func (b *postgresQueryBuilder) textMatch(column string, value string) string {
+	if b.searcher.enableCISearches {
+		return b.cisw(column, value)
+	}
+	return fmt.Sprintf("%s LIKE %s", column, b.arg(escapeLike(value)+"%"))
+}
+
+// Case-insensitive contains
+func (b *postgresQueryBuilder) cicontains(column string, value string) string {
+	if b.searcher.enableCISearches {
+		return fmt.Sprintf("lower(%s) LIKE %s", column, b.arg("%"+escapeLike(strings.ToLower(value))+"%"))
+	}
+	return fmt.Sprintf("%s LIKE %s", column, b.arg("%"+escapeLike(value)+"%"))
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// orderBy converts the _sort options into an ORDER BY clause. Like MongoDB, parameters
+// with several values sort by their smallest value when ascending and largest when descending.
+func (b *postgresQueryBuilder) orderBy(resourceType string, alias string, sorts []SortOption) string {
+	terms := make([]string, 0, len(sorts)+1)
+	for _, sort := range sorts {
+		direction, aggregate := "ASC", "min"
+		if sort.Descending {
+			direction, aggregate = "DESC", "max"
+		}
+
+		var expr string
+		switch sort.Parameter.Name {
+		case IDParam:
+			expr = alias + ".id"
+		case LastUpdatedParam:
+			expr = alias + ".last_updated"
+		default:
+			s := b.alias("s")
+			var column string
+			switch sort.Parameter.Type {
+			case "date":
+				column = s + ".date_from"
+			case "number", "quantity":
+				column = s + ".num_from"
+			case "string", "uri":
+				column = "lower(" + s + ".value_string)"
+			case "reference":
+				column = s + ".ref_id"
+			default:
+				column = s + ".code"
+			}
+			expr = fmt.Sprintf("(SELECT %s(%s) FROM %s %s WHERE %s.id = %s.id AND %s.param = %s)",
+				aggregate, column, PostgresIndexTable(b.searcher.schema, resourceType), s, s, alias, s, b.arg(sort.Parameter.Name))
+		}
+		terms = append(terms, expr+" "+direction)
+	}
+	// a stable order is needed for paging
+	terms = append(terms, alias+".id")
+	return strings.Join(terms, ", ")
+}
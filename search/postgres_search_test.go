@@ -0,0 +1,221 @@
+package search
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"go.mongodb.org/mongo-driver/bson"
+	. "gopkg.in/check.v1"
+)
+
+type PostgresSearchSuite struct {
+	Searcher *PostgresSearcher
+}
+
+var _ = Suite(&PostgresSearchSuite{})
+
+func (s *PostgresSearchSuite) SetUpSuite(c *C) {
+	// the query builder doesn't need a database connection
+	s.Searcher = NewPostgresSearcher(nil, nil, "fhir", true, true, false)
+}
+
+func (s *PostgresSearchSuite) whereClause(resourceType string, query string) (string, []interface{}) {
+	q := Query{Resource: resourceType, Query: query}
+	b := &postgresQueryBuilder{searcher: s.Searcher}
+	return b.whereClause(resourceType, "r", q.Params()), b.args
+}
+
+func (s *PostgresSearchSuite) extract(c *C, json string) []PostgresIndexRow {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	c.Assert(err, IsNil)
+	doc, err := resource.GetBSON()
+	c.Assert(err, IsNil)
+	return ExtractPostgresIndexRows(resource.ResourceType(), doc.([]bson.E))
+}
+
+func findIndexRows(rows []PostgresIndexRow, param string) []PostgresIndexRow {
+	var found []PostgresIndexRow
+	for _, row := range rows {
+		if row.Param == param {
+			found = append(found, row)
+		}
+	}
+	return found
+}
+
+func (s *PostgresSearchSuite) TestExtractTokenRows(c *C) {
+	rows := s.extract(c, `{
+		"resourceType": "Condition",
+		"id": "c1",
+		"code": { "coding": [
+			{ "system": "http://snomed.info/sct", "code": "123" },
+			{ "system": "http://hl7.org/fhir/sid/icd-9", "code": "428.0" }
+		]}
+	}`)
+	codes := findIndexRows(rows, "code")
+	c.Assert(codes, HasLen, 2)
+	c.Assert(*codes[0].System, Equals, "http://snomed.info/sct")
+	c.Assert(*codes[0].Code, Equals, "123")
+	c.Assert(*codes[1].Code, Equals, "428.0")
+}
+
+func (s *PostgresSearchSuite) TestExtractStringAndDateRows(c *C) {
+	rows := s.extract(c, `{
+		"resourceType": "Patient",
+		"id": "p1",
+		"name": [{ "family": "Donald", "given": ["Duck", "D"] }],
+		"birthDate": "1934-06-09"
+	}`)
+	given := findIndexRows(rows, "given")
+	c.Assert(given, HasLen, 2)
+	c.Assert(*given[0].ValueString, Equals, "Duck")
+
+	birthdates := findIndexRows(rows, "birthdate")
+	c.Assert(birthdates, HasLen, 1)
+	c.Assert(birthdates[0].DateFrom, NotNil)
+	c.Assert(birthdates[0].DateTo, NotNil)
+	c.Assert(birthdates[0].DateTo.Sub(*birthdates[0].DateFrom).Hours(), Equals, 24.0)
+}
+
+func (s *PostgresSearchSuite) TestExtractReferenceRows(c *C) {
+	rows := s.extract(c, `{
+		"resourceType": "Condition",
+		"id": "c1",
+		"subject": { "reference": "Patient/p1" }
+	}`)
+	subjects := findIndexRows(rows, "subject")
+	c.Assert(subjects, Not(HasLen), 0)
+	c.Assert(*subjects[0].RefType, Equals, "Patient")
+	c.Assert(*subjects[0].RefID, Equals, "p1")
+}
+
+func (s *PostgresSearchSuite) TestTokenCondition(c *C) {
+	where, args := s.whereClause("Condition", "code=http://snomed.info/sct|123")
+	c.Assert(strings.HasPrefix(where, `EXISTS (SELECT 1 FROM "fhir"."conditions_search" s1 WHERE s1.id = r.id`), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"code", "123", "http://snomed.info/sct"})
+}
+
+func (s *PostgresSearchSuite) TestOrCondition(c *C) {
+	where, args := s.whereClause("Patient", "gender=male,female")
+	c.Assert(strings.HasPrefix(where, "(EXISTS"), Equals, true)
+	c.Assert(strings.Contains(where, " OR EXISTS"), Equals, true)
+	c.Assert(args, HasLen, 4)
+}
+
+func (s *PostgresSearchSuite) TestIDCondition(c *C) {
+	where, args := s.whereClause("Patient", "_id=abc")
+	c.Assert(where, Equals, "r.id = $1")
+	c.Assert(args, DeepEquals, []interface{}{"abc"})
+}
+
+func (s *PostgresSearchSuite) TestMissingCondition(c *C) {
+	where, args := s.whereClause("Patient", "gender:missing=true")
+	c.Assert(strings.HasPrefix(where, "NOT EXISTS (SELECT 1"), Equals, true)
+	c.Assert(strings.HasSuffix(where, "AND TRUE)"), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"gender"})
+
+	where, _ = s.whereClause("Patient", "_id:missing=false")
+	c.Assert(where, Equals, "TRUE")
+}
+
+func (s *PostgresSearchSuite) TestNotCondition(c *C) {
+	where, args := s.whereClause("Condition", "code:not=http://snomed.info/sct|123")
+	c.Assert(strings.HasPrefix(where, "NOT EXISTS (SELECT 1"), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"code", "123", "http://snomed.info/sct"})
+}
+
+func (s *PostgresSearchSuite) TestStringModifierConditions(c *C) {
+	where, args := s.whereClause("Patient", "family:exact=Peters")
+	c.Assert(strings.HasSuffix(where, "s1.value_string = $2)"), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"family", "Peters"})
+
+	where, args = s.whereClause("Patient", "family:contains=E_t")
+	c.Assert(strings.HasSuffix(where, "lower(s1.value_string) LIKE $2)"), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"family", `%e\_t%`})
+}
+
+func (s *PostgresSearchSuite) TestURIModifierConditions(c *C) {
+	where, args := s.whereClause("ValueSet", "url:below=http://acme.org/fhir/")
+	c.Assert(strings.HasSuffix(where, "s1.value_string LIKE $2)"), Equals, true)
+	c.Assert(args, DeepEquals, []interface{}{"url", "http://acme.org/fhir/%"})
+
+	where, _ = s.whereClause("ValueSet", "url:above=http://acme.org/fhir/ValueSet/1")
+	c.Assert(strings.HasSuffix(where, "s1.value_string = ANY($2))"), Equals, true)
+}
+
+func (s *PostgresSearchSuite) TestReverseChainedCondition(c *C) {
+	where, args := s.whereClause("Patient", "_has:Observation:patient:code=8302-2")
+	c.Assert(strings.HasPrefix(where, `r.id IN (SELECT s1.ref_id FROM "fhir"."observations_search" s1 WHERE s1.param = $1 AND s1.ref_type = $2`), Equals, true)
+	c.Assert(args[:2], DeepEquals, []interface{}{"patient", "Patient"})
+}
+
+func (s *PostgresSearchSuite) TestOrderByUsesUniqueAliases(c *C) {
+	q := Query{Resource: "Patient", Query: "gender=male&_sort=family,-birthdate"}
+	b := &postgresQueryBuilder{searcher: s.Searcher}
+	b.whereClause(q.Resource, "r", q.Params())
+	orderBy := b.orderBy(q.Resource, "r", q.Options().Sort)
+	c.Assert(orderBy, Equals, `(SELECT min(lower(s2.value_string)) FROM "fhir"."patients_search" s2 WHERE s2.id = r.id AND s2.param = $3) ASC, `+
+		`(SELECT max(s3.date_from) FROM "fhir"."patients_search" s3 WHERE s3.id = r.id AND s3.param = $4) DESC, r.id`)
+	c.Assert(b.args[2:], DeepEquals, []interface{}{"family", "birthdate"})
+}
+
+func (s *PostgresSearchSuite) TestTextModifier(c *C) {
+	where, args := s.whereClause("Condition", "code:text=headache")
+	c.Assert(where, Equals, `EXISTS (SELECT 1 FROM "fhir"."conditions_search" s1 WHERE s1.id = r.id AND s1.param = $1 AND lower(s1.value_string) LIKE $2)`)
+	c.Assert(args, DeepEquals, []interface{}{"code", "headache%"})
+
+	// still a starts-with match without case-insensitive searches
+	b := &postgresQueryBuilder{searcher: NewPostgresSearcher(nil, nil, "fhir", true, false, false)}
+	q := Query{Resource: "Condition", Query: "code:text=Head"}
+	where = b.whereClause("Condition", "r", q.Params())
+	c.Assert(where, Equals, `EXISTS (SELECT 1 FROM "fhir"."conditions_search" s1 WHERE s1.id = r.id AND s1.param = $1 AND s1.value_string LIKE $2)`)
+	c.Assert(b.args, DeepEquals, []interface{}{"code", "Head%"})
+}
+
+func (s *PostgresSearchSuite) TestTextModifierOnUncodedToken(c *C) {
+	defer func() {
+		searchErr, ok := recover().(*Error)
+		c.Assert(ok, Equals, true)
+		c.Assert(searchErr.HTTPStatus, Equals, http.StatusNotImplemented)
+	}()
+	s.whereClause("Patient", "gender:text=male")
+	c.Fatal("expected a panic")
+}
+
+func (s *PostgresSearchSuite) TestExtractTokenTextRows(c *C) {
+	rows := s.extract(c, `{
+		"resourceType": "Condition",
+		"id": "c1",
+		"code": {
+			"coding": [{ "system": "http://snomed.info/sct", "code": "25064002", "display": "Headache" }],
+			"text": "Bad headache"
+		}
+	}`)
+	codes := findIndexRows(rows, "code")
+	c.Assert(codes, HasLen, 2)
+	c.Assert(*codes[0].Code, Equals, "25064002")
+	c.Assert(*codes[0].ValueString, Equals, "Headache")
+	c.Assert(codes[1].Code, IsNil)
+	c.Assert(*codes[1].ValueString, Equals, "Bad headache")
+}
+
+func (s *PostgresSearchSuite) TestMissingWithoutPathsIsUnsupported(c *C) {
+	defer func() {
+		searchErr, ok := recover().(*Error)
+		c.Assert(ok, Equals, true)
+		c.Assert(searchErr.HTTPStatus, Equals, http.StatusNotImplemented)
+	}()
+	s.whereClause("Location", "near:missing=true")
+	c.Fatal("expected a panic")
+}
+
+func (s *PostgresSearchSuite) TestCompositeIsUnsupported(c *C) {
+	defer func() {
+		searchErr, ok := recover().(*Error)
+		c.Assert(ok, Equals, true)
+		c.Assert(searchErr.HTTPStatus, Equals, http.StatusNotImplemented)
+	}()
+	s.whereClause("Observation", "code-value-quantity=http://loinc.org|8480-6$gt100")
+	c.Fatal("expected a panic")
+}
@@ -21,6 +21,7 @@ const (
 	ListParam          = "_list"
 	QueryParam         = "_query"
 	HasParam           = "_has"
+	CompartmentParam   = "_compartment" // Custom param, not in FHIR spec
 	SortParam          = "_sort"
 	CountParam         = "_count"
 	IncludeParam       = "_include"
@@ -31,11 +32,27 @@ const (
 	ContainedTypeParam = "_containedType"
 	OffsetParam        = "_offset" // Custom param, not in FHIR spec
 	FormatParam        = "_format"
+	SinceParam         = "_since" // Only for history interactions
+	AtParam            = "_at"    // Only for history interactions
+)
+
+// Search modifiers that are supported in addition to resource types on
+// reference parameters
+const (
+	MissingModifier  = "missing"  // any type
+	ExactModifier    = "exact"    // string
+	ContainsModifier = "contains" // string
+	NotModifier      = "not"      // token
+	TextModifier     = "text"     // token
+	BelowModifier    = "below"    // uri, token
+	AboveModifier    = "above"    // uri, token
+	InModifier       = "in"       // token
+	NotInModifier    = "not-in"   // token
 )
 
 var globalSearchParams = map[string]bool{IDParam: true, LastUpdatedParam: true, TagParam: true,
 	ProfileParam: true, SecurityParam: true, TextParam: true, ContentParam: true, ListParam: true,
-	QueryParam: true, HasParam: true}
+	QueryParam: true, HasParam: true, CompartmentParam: true}
 
 func isGlobalSearchParam(param string) bool {
 	_, found := globalSearchParams[param]
@@ -44,7 +61,7 @@ func isGlobalSearchParam(param string) bool {
 
 var searchResultParams = map[string]bool{SortParam: true, CountParam: true, IncludeParam: true,
 	RevIncludeParam: true, SummaryParam: true, ElementsParam: true, ContainedParam: true,
-	ContainedTypeParam: true, OffsetParam: true, FormatParam: true}
+	ContainedTypeParam: true, OffsetParam: true, FormatParam: true, SinceParam: true, AtParam: true}
 
 func isSearchResultParam(param string) bool {
 	_, found := searchResultParams[param]
@@ -76,7 +93,10 @@ func (q *Query) Params() []SearchParam {
 		var info SearchParamInfo
 		ok := true
 
-		if param == "_has" {
+		if param == CompartmentParam {
+			results = append(results, parseCompartmentParam(q.Resource, queryParam.Value))
+			continue
+		} else if param == "_has" {
 			// Reverse chained search params are not found in the SearchParameterDictionary.
 			// Instead they are a ReferenceParam of type ReverseChainedQueryReference constructed
 			// from SearchParamInfo found in a different resource than the one being searched.
@@ -103,6 +123,22 @@ func (q *Query) Params() []SearchParam {
 	return results
 }
 
+// WithoutUnknownParameters returns a copy of the query without the parameters that aren't known for
+// its resource, rather than Params and Options panicking on them, as for the Prefer: handling=lenient
+// header. Parameters with invalid values are kept.
+func (q *Query) WithoutUnknownParameters() Query {
+	queryParams, _ := ParseQuery(q.Query)
+	var known URLQueryParameters
+	for _, queryParam := range queryParams.All() {
+		param, _, _ := ParseParamNameModifierAndPostFix(queryParam.Key)
+		_, inDictionary := SearchParameterDictionary[q.Resource][param]
+		if isSearchResultParam(param) || param == HasParam || param == CompartmentParam || inDictionary {
+			known.Add(queryParam.Key, queryParam.Value)
+		}
+	}
+	return Query{Resource: q.Resource, Query: known.Encode()}
+}
+
 // Options parses the query string and returns the QueryOptions.
 func (q *Query) Options() *QueryOptions {
 	options := NewQueryOptions()
@@ -228,13 +264,41 @@ func (q *Query) Options() *QueryOptions {
 				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_format\" content is invalid"))
 			}
 
+		case SinceParam:
+			since, err := utils.ParseDate(queryParam.Value)
+			if err != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_since\" content is invalid"))
+			}
+			options.Since = since
+
+		case AtParam:
+			at, err := utils.ParseDate(queryParam.Value)
+			if err != nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_at\" content is invalid"))
+			}
+			options.At = at
+
 		case SummaryParam:
-			if queryParam.Value != "count" && queryParam.Value != "false" {
-				// We only support "count", and the default (implicit) setting is "false".
-				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+			switch queryParam.Value {
+			case "true", "text", "data", "count", "false":
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+			}
+			if q.Resource != "" {
+				checkSummarySupported(q.Resource, queryParam.Value)
 			}
 			options.Summary = queryParam.Value
 
+		case ElementsParam:
+			for _, element := range strings.Split(queryParam.Value, ",") {
+				// elements may be given either as "name" or "Patient.name"
+				element = strings.TrimPrefix(strings.TrimSpace(element), q.Resource+".")
+				if element == "" || strings.Contains(element, ".") {
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" content is invalid"))
+				}
+				options.Elements = append(options.Elements, element)
+			}
+
 		default:
 			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param)))
 		}
@@ -264,6 +328,40 @@ func (q *Query) Options() *QueryOptions {
 	return options
 }
 
+// HistoryOptions parses the query string of a history interaction, which only
+// supports options such as _since, _at, _count, _summary and _elements.
+func (q *Query) HistoryOptions() *QueryOptions {
+	queryParams, _ := ParseQuery(q.Query)
+	for _, queryParam := range queryParams.All() {
+		param, _, _ := ParseParamNameModifierAndPostFix(queryParam.Key)
+		switch param {
+		case SinceParam, AtParam, CountParam, OffsetParam, FormatParam, SummaryParam, ElementsParam:
+		default:
+			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param)))
+		}
+	}
+	options := q.Options()
+	if options.Summary == "count" {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\": count is not supported for history"))
+	}
+	return options
+}
+
+// ReadOptions parses the query string of a read interaction, where only the
+// _summary and _elements options are applied and other parameters are ignored.
+func (q *Query) ReadOptions() *QueryOptions {
+	queryParams, _ := ParseQuery(q.Query)
+	var readParams URLQueryParameters
+	for _, queryParam := range queryParams.All() {
+		switch queryParam.Key {
+		case SummaryParam, ElementsParam:
+			readParams.Add(queryParam.Key, queryParam.Value)
+		}
+	}
+	readQuery := Query{Resource: q.Resource, Query: readParams.Encode()}
+	return readQuery.Options()
+}
+
 // UsesIncludes returns true if the query has any _includes options
 func (q *Query) UsesIncludes() bool {
 	return len(q.Options().Include) > 0
@@ -390,6 +488,9 @@ type QueryOptions struct {
 	IsIncludeAll    bool
 	IsRevincludeAll bool
 	Summary         string
+	Elements        []string
+	Since           *utils.Date // _since (history only)
+	At              *utils.Date // _at (history only)
 }
 
 // NewQueryOptions constructs a new QueryOptions with default values (offset = 0, Count = 100)
@@ -427,6 +528,18 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 	for _, incl := range o.RevInclude {
 		queryParams.Add(RevIncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
 	}
+	if o.Summary != "" {
+		queryParams.Set(SummaryParam, o.Summary)
+	}
+	if len(o.Elements) > 0 {
+		queryParams.Set(ElementsParam, strings.Join(o.Elements, ","))
+	}
+	if o.Since != nil {
+		queryParams.Set(SinceParam, o.Since.String())
+	}
+	if o.At != nil {
+		queryParams.Set(AtParam, o.At.String())
+	}
 	return queryParams
 }
 
@@ -568,6 +681,10 @@ func (s SearchParamInfo) CreateSearchParam(paramStr string) SearchParam {
 		return ParseOrParam(ors, s)
 	}
 
+	if s.Modifier == MissingModifier {
+		return ParseMissingParam(paramStr, s)
+	}
+
 	switch s.Type {
 	case "composite":
 		return ParseCompositeParam(paramStr, s)
@@ -614,6 +731,41 @@ type SearchParamPath struct {
 	Type string
 }
 
+// MissingParam represents a search parameter of any type with the :missing
+// modifier.  The following description is from the FHIR STU3 specification:
+//
+// For all parameters (except combination), searching with the :missing
+// modifier set to true returns all resources that don't have a value for the
+// element, and false returns all resources that do.
+type MissingParam struct {
+	SearchParamInfo
+	Missing bool
+}
+
+func (m *MissingParam) getInfo() SearchParamInfo {
+	return m.SearchParamInfo
+}
+
+func (m *MissingParam) setInfo(info SearchParamInfo) {
+	m.SearchParamInfo = info
+}
+
+func (m *MissingParam) getQueryParamAndValue() (string, string) {
+	return queryParamAndValue(m.SearchParamInfo, strconv.FormatBool(m.Missing))
+}
+
+// ParseMissingParam parses the value of a parameter with the :missing
+// modifier and returns a pointer to a MissingParam.
+func ParseMissingParam(paramStr string, info SearchParamInfo) *MissingParam {
+	switch paramStr {
+	case "true":
+		return &MissingParam{info, true}
+	case "false":
+		return &MissingParam{info, false}
+	}
+	panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", info.Name)))
+}
+
 // CompositeParam represents a composite-flavored search parameter.  The
 // following description is from the FHIR DSTU2 specification:
 //
@@ -649,6 +801,76 @@ func ParseCompositeParam(paramString string, info SearchParamInfo) *CompositePar
 	return &CompositeParam{info, escapeFriendlySplit(paramString, '$')}
 }
 
+// CompositeContext is an element that all the components of a composite
+// search must be found on, e.g. an Observation.component for the
+// component-code-value-quantity parameter.  An empty Path means the resource
+// itself.  The paths of the Components are relative to the context.
+type CompositeContext struct {
+	Path       string
+	Components []SearchParam
+}
+
+// Contexts parses the composite values using the definitions of the component
+// parameters and groups them by the elements they need to be found on.
+// Each context is an alternative, e.g. combo-code-value-quantity can match the
+// Observation itself or one of its components.
+func (c *CompositeParam) Contexts() []CompositeContext {
+	if len(c.CompositeValues) != len(c.Composites) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", c.Name)))
+	}
+
+	componentInfos := make([]SearchParamInfo, len(c.Composites))
+	var contextPaths []string
+	for i, name := range c.Composites {
+		info, ok := SearchParameterDictionary[c.Resource][name]
+		if !ok {
+			panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" has an unknown component \"%s\"", c.Name, name)))
+		}
+		componentInfos[i] = info
+		for _, path := range info.Paths {
+			contextPath, _ := splitCompositePath(path.Path)
+			if !contains(contextPaths, contextPath) {
+				contextPaths = append(contextPaths, contextPath)
+			}
+		}
+	}
+
+	var contexts []CompositeContext
+nextContext:
+	for _, contextPath := range contextPaths {
+		context := CompositeContext{Path: contextPath}
+		for i, info := range componentInfos {
+			componentInfo := info.clone()
+			componentInfo.Paths = nil
+			for _, path := range info.Paths {
+				if pathContext, relativePath := splitCompositePath(path.Path); pathContext == contextPath {
+					componentInfo.Paths = append(componentInfo.Paths, SearchParamPath{Path: relativePath, Type: path.Type})
+				}
+			}
+			if len(componentInfo.Paths) == 0 {
+				// not all components can be found on this element
+				continue nextContext
+			}
+			context.Components = append(context.Components, componentInfo.CreateSearchParam(c.CompositeValues[i]))
+		}
+		contexts = append(contexts, context)
+	}
+	return contexts
+}
+
+// splitCompositePath splits a path (e.g. "[]component.valueQuantity") at its
+// first array element, which is where the components of a composite must be
+// found together.  Paths without arrays are relative to the resource itself.
+func splitCompositePath(path string) (contextPath string, relativePath string) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "[]") {
+			return strings.Join(parts[:i+1], "."), strings.Join(parts[i+1:], ".")
+		}
+	}
+	return "", path
+}
+
 // DateParam represents a date-flavored search parameter.  The following
 // description is from the FHIR DSTU2 specification:
 //
@@ -1019,6 +1241,13 @@ func ParseTokenParam(paramString string, info SearchParamInfo) *TokenParam {
 
 	t := &TokenParam{SearchParamInfo: info}
 
+	if info.Modifier == TextModifier || info.Modifier == InModifier || info.Modifier == NotInModifier {
+		// the value is text or the URL of a value set rather than a system and code
+		t.AnySystem = true
+		t.Code = unescape(paramString)
+		return t
+	}
+
 	splitCode := escapeFriendlySplit(paramString, '|')
 	if len(splitCode) == 2 {
 		t.System = unescape(splitCode[0])
@@ -1064,6 +1293,28 @@ func ParseURIParam(paramStr string, info SearchParamInfo) *URIParam {
 	return &URIParam{info, unescape(paramStr)}
 }
 
+// Ancestors returns the URIs that match the URI with the :above modifier, i.e.
+// the URI itself and the URIs formed by removing its trailing path segments.
+// For example "http://acme.org/fhir/ValueSet/123" gives
+// "http://acme.org/fhir/ValueSet/123", "http://acme.org/fhir/ValueSet",
+// "http://acme.org/fhir" and "http://acme.org".
+func (u *URIParam) Ancestors() []string {
+	uri := strings.TrimSuffix(u.URI, "/")
+	ancestors := []string{uri}
+
+	// don't split the scheme and authority
+	start := 0
+	if i := strings.Index(uri, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	for i := len(uri) - 1; i > start; i-- {
+		if uri[i] == '/' {
+			ancestors = append(ancestors, uri[:i])
+		}
+	}
+	return ancestors
+}
+
 // OrParam represents a search parameter that has multiple OR values.  The
 // following description is from the FHIR DSTU2 specification:
 //
@@ -1075,6 +1326,8 @@ func ParseURIParam(paramStr string, info SearchParamInfo) *URIParam {
 type OrParam struct {
 	SearchParamInfo
 	Items []SearchParam
+
+	compartment string // the value of a _compartment parameter, which is an OR of the parameters linking to it
 }
 
 func (o *OrParam) setInfo(info SearchParamInfo) {
@@ -1086,6 +1339,9 @@ func (o *OrParam) getInfo() SearchParamInfo {
 }
 
 func (o *OrParam) getQueryParamAndValue() (string, string) {
+	if o.Name == CompartmentParam {
+		return CompartmentParam, o.compartment
+	}
 	if len(o.Items) == 0 {
 		panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", o.Name)))
 	}
@@ -1105,7 +1361,7 @@ func ParseOrParam(paramStr []string, info SearchParamInfo) *OrParam {
 	for i := range paramStr {
 		ors[i] = info.CreateSearchParam(paramStr[i])
 	}
-	return &OrParam{SearchParamInfo{Name: info.Name, Type: "or"}, ors}
+	return &OrParam{SearchParamInfo: SearchParamInfo{Name: info.Name, Type: "or"}, Items: ors}
 }
 
 // ParseParamNameModifierAndPostFix parses a full parameter key and returns the parameter name,
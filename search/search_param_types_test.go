@@ -3,7 +3,11 @@ package search
 import (
 	"github.com/eug48/fhir/utils"
 	. "github.com/eug48/fhir/utils"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -89,6 +93,108 @@ func (s *SearchPTSuite) TestCompositeParamWithTokenAndQuantity(c *C) {
 	c.Assert(t.CompositeValues, DeepEquals, []string{"http://hl7.org/fhir/v2/0001|M", "5.4|http://unitsofmeasure.org|mg"})
 }
 
+func (s *SearchPTSuite) TestCompositeParamContexts(c *C) {
+	info := SearchParameterDictionary["Observation"]["combo-code-value-quantity"]
+	t := ParseCompositeParam("http://loinc.org|8480-6$gt100|http://unitsofmeasure.org|mm[Hg]", info)
+	contexts := t.Contexts()
+	c.Assert(contexts, HasLen, 2)
+
+	c.Assert(contexts[0].Path, Equals, "[]component")
+	c.Assert(contexts[0].Components, HasLen, 2)
+	code, ok := contexts[0].Components[0].(*TokenParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(code.Name, Equals, "combo-code")
+	c.Assert(code.Paths, DeepEquals, []SearchParamPath{{Path: "code", Type: "CodeableConcept"}})
+	c.Assert(code.System, Equals, "http://loinc.org")
+	c.Assert(code.Code, Equals, "8480-6")
+	value, ok := contexts[0].Components[1].(*QuantityParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(value.Paths, DeepEquals, []SearchParamPath{{Path: "valueQuantity", Type: "Quantity"}})
+	c.Assert(value.Prefix, Equals, GT)
+	c.Assert(value.Code, Equals, "mm[Hg]")
+
+	c.Assert(contexts[1].Path, Equals, "")
+	c.Assert(contexts[1].Components, HasLen, 2)
+	code = contexts[1].Components[0].(*TokenParam)
+	c.Assert(code.Paths, DeepEquals, []SearchParamPath{{Path: "code", Type: "CodeableConcept"}})
+}
+
+func (s *SearchPTSuite) TestCompositeParamContextsWithWrongNumberOfValues(c *C) {
+	info := SearchParameterDictionary["Observation"]["code-value-quantity"]
+	t := ParseCompositeParam("http://loinc.org|8480-6", info)
+	defer func() {
+		searchErr, ok := recover().(*Error)
+		c.Assert(ok, Equals, true)
+		c.Assert(searchErr.HTTPStatus, Equals, http.StatusBadRequest)
+	}()
+	t.Contexts()
+	c.Fatal("expected a panic")
+}
+
+func (s *SearchPTSuite) TestSplitCompositePath(c *C) {
+	context, relative := splitCompositePath("[]component.valueQuantity")
+	c.Assert(context, Equals, "[]component")
+	c.Assert(relative, Equals, "valueQuantity")
+
+	context, relative = splitCompositePath("referenceSeq.windowStart")
+	c.Assert(context, Equals, "")
+	c.Assert(relative, Equals, "referenceSeq.windowStart")
+}
+
+func (s *SearchPTSuite) TestCompositeComponentsAreDefined(c *C) {
+	for resource, params := range SearchParameterDictionary {
+		for name, info := range params {
+			if info.Type != "composite" {
+				continue
+			}
+			c.Assert(info.Composites, Not(HasLen), 0, Commentf("%s.%s", resource, name))
+			for _, component := range info.Composites {
+				_, ok := params[component]
+				c.Assert(ok, Equals, true, Commentf("%s.%s component %s", resource, name, component))
+			}
+		}
+	}
+}
+
+func (s *SearchPTSuite) TestCompositesMatchSpec(c *C) {
+	data, err := ioutil.ReadFile("../fsharp-fhir-tools/PathsByType/STU3/search-parameters.json")
+	c.Assert(err, IsNil)
+	var bundle struct {
+		Entry []struct {
+			Resource struct {
+				Code      string
+				Type      string
+				Base      []string
+				Component []struct {
+					Definition struct {
+						Reference string
+					}
+				}
+			}
+		}
+	}
+	c.Assert(json.Unmarshal(data, &bundle), IsNil)
+
+	found := 0
+	for _, entry := range bundle.Entry {
+		param := entry.Resource
+		if param.Type != "composite" {
+			continue
+		}
+		for _, base := range param.Base {
+			var components []string
+			for _, component := range param.Component {
+				// e.g. http://hl7.org/fhir/SearchParameter/Observation-code
+				prefix := "http://hl7.org/fhir/SearchParameter/" + base + "-"
+				components = append(components, strings.TrimPrefix(component.Definition.Reference, prefix))
+			}
+			c.Assert(SearchParameterDictionary[base][param.Code].Composites, DeepEquals, components, Commentf("%s.%s", base, param.Code))
+			found++
+		}
+	}
+	c.Assert(found > 0, Equals, true)
+}
+
 func (s *SearchPTSuite) TestCompositeParamReconstitution(c *C) {
 	t := ParseCompositeParam("abc$123", compositeParamInfo)
 	p, v := t.getQueryParamAndValue()
@@ -1410,6 +1516,27 @@ func (s *SearchPTSuite) TestTokenParamsWithEscapedPipesAndSlashes(c *C) {
 	c.Assert(t.System, Equals, "foo|bar")
 }
 
+func (s *SearchPTSuite) TestTokenParamValueSet(c *C) {
+	inInfo := tokenParamInfo
+	inInfo.Modifier = InModifier
+	t := ParseTokenParam("http://example.org/ValueSet/diabetes|1.0", inInfo)
+
+	c.Assert(t.Modifier, Equals, "in")
+	c.Assert(t.AnySystem, Equals, true)
+	c.Assert(t.Code, Equals, "http://example.org/ValueSet/diabetes|1.0")
+	c.Assert(t.System, Equals, "")
+
+	p, v := t.getQueryParamAndValue()
+	c.Assert(p, Equals, "foo:in")
+	c.Assert(v, Equals, "http://example.org/ValueSet/diabetes\\|1.0")
+
+	belowInfo := tokenParamInfo
+	belowInfo.Modifier = BelowModifier
+	t = ParseTokenParam("http://snomed.info/sct|73211009", belowInfo)
+	c.Assert(t.System, Equals, "http://snomed.info/sct")
+	c.Assert(t.Code, Equals, "73211009")
+}
+
 func (s *SearchPTSuite) TestTokenParamReconstitution(c *C) {
 	t := ParseTokenParam("http://hl7.org/fhir/v2/0001|M", tokenParamInfo)
 	p, v := t.getQueryParamAndValue()
@@ -1877,6 +2004,141 @@ func (s *SearchPTSuite) TestQueryOptionsInvalidFormatParam(c *C) {
 	q.Options()
 }
 
+func (s *SearchPTSuite) TestQueryOptionsSummaryAndElements(c *C) {
+	q := Query{Resource: "Observation", Query: "_summary=text"}
+	o := q.Options()
+	c.Assert(o.Summary, Equals, "text")
+	c.Assert(o.IsSubsetted(), Equals, true)
+
+	q = Query{Resource: "Patient", Query: "_elements=identifier,Patient.active"}
+	o = q.Options()
+	c.Assert(o.Elements, DeepEquals, []string{"identifier", "active"})
+	c.Assert(o.IsSubsetted(), Equals, true)
+
+	q = Query{Resource: "Patient", Query: "_summary=count"}
+	c.Assert(q.Options().IsSubsetted(), Equals, false)
+
+	q = Query{Resource: "Patient", Query: "gender=male&_summary=data&_elements=gender"}
+	params := q.URLQueryParameters(true)
+	c.Assert(params.Get("_summary"), Equals, "data")
+	c.Assert(params.Get("_elements"), Equals, "gender")
+}
+
+func (s *SearchPTSuite) TestQueryOptionsInvalidSummaryParam(c *C) {
+	q := Query{Resource: "Patient", Query: "_summary=foo"}
+	defer func() {
+		searchErr, ok := recover().(*Error)
+		c.Assert(ok, Equals, true)
+		c.Assert(searchErr.HTTPStatus, Equals, http.StatusBadRequest)
+	}()
+	q.Options()
+	c.Fatal("expected a panic")
+}
+
+func (s *SearchPTSuite) TestQueryOptionsIncludesElement(c *C) {
+	q := Query{Resource: "Observation", Query: "_summary=true"}
+	o := q.Options()
+	c.Assert(o.IncludesElement("Observation", "id"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "meta"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "status"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "_status"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "effectiveDateTime"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "valueQuantity"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "text"), Equals, false)
+	c.Assert(o.IncludesElement("Observation", "interpretation"), Equals, false)
+	c.Assert(o.IncludesElement("Observation", "comment"), Equals, false)
+
+	q = Query{Resource: "Observation", Query: "_summary=text"}
+	o = q.Options()
+	c.Assert(o.IncludesElement("Observation", "text"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "status"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "code"), Equals, true)
+	c.Assert(o.IncludesElement("Observation", "subject"), Equals, false)
+	c.Assert(o.IncludesElement("Observation", "valueQuantity"), Equals, false)
+
+	q = Query{Resource: "Patient", Query: "_summary=data"}
+	o = q.Options()
+	c.Assert(o.IncludesElement("Patient", "text"), Equals, false)
+	c.Assert(o.IncludesElement("Patient", "contact"), Equals, true)
+
+	q = Query{Resource: "Patient", Query: "_elements=gender"}
+	o = q.Options()
+	c.Assert(o.IncludesElement("Patient", "resourceType"), Equals, true)
+	c.Assert(o.IncludesElement("Patient", "gender"), Equals, true)
+	c.Assert(o.IncludesElement("Patient", "name"), Equals, false)
+}
+
+func (s *SearchPTSuite) TestSummaryElementsMatchSpec(c *C) {
+	// from the isSummary flags of http://hl7.org/fhir/STU3/observation.html
+	c.Assert(SummaryElements("Observation"), DeepEquals, map[string]bool{
+		"id": true, "meta": true, "implicitRules": true,
+		"identifier": true, "basedOn": true, "status": true, "code": true, "subject": true,
+		"effectiveDateTime": true, "effectivePeriod": true, "issued": true, "performer": true,
+		"valueQuantity": true, "valueCodeableConcept": true, "valueString": true, "valueBoolean": true,
+		"valueRange": true, "valueRatio": true, "valueSampledData": true, "valueAttachment": true,
+		"valueTime": true, "valueDateTime": true, "valuePeriod": true,
+		"related": true, "component": true,
+	})
+}
+
+func (s *SearchPTSuite) TestSummaryElementsOfPatient(c *C) {
+	// from the isSummary flags of http://hl7.org/fhir/STU3/patient.html
+	c.Assert(SummaryElements("Patient"), DeepEquals, map[string]bool{
+		"id": true, "meta": true, "implicitRules": true,
+		"identifier": true, "active": true, "name": true, "telecom": true, "gender": true, "birthDate": true,
+		"deceasedBoolean": true, "deceasedDateTime": true, "address": true, "animal": true,
+		"managingOrganization": true, "link": true,
+	})
+
+	q := Query{Resource: "Patient", Query: "_summary=text"}
+	o := q.Options()
+	c.Assert(o.IncludesElement("Patient", "text"), Equals, true)
+	c.Assert(o.IncludesElement("Patient", "id"), Equals, true)
+	c.Assert(o.IncludesElement("Patient", "name"), Equals, false)
+}
+
+func (s *SearchPTSuite) TestSummaryUnsupportedForUnknownTypes(c *C) {
+	for _, summary := range []string{"true", "text"} {
+		func() {
+			defer func() {
+				searchErr, ok := recover().(*Error)
+				c.Assert(ok, Equals, true, Commentf(summary))
+				c.Assert(searchErr.HTTPStatus, Equals, http.StatusNotImplemented)
+			}()
+			q := Query{Resource: "Foo", Query: "_summary=" + summary}
+			q.Options()
+			c.Fatal("expected a panic")
+		}()
+	}
+
+	// _summary=data and _elements don't need the definitions
+	q := Query{Resource: "Foo", Query: "_summary=data"}
+	c.Assert(q.Options().Summary, Equals, "data")
+	q = Query{Resource: "Foo", Query: "_elements=gender"}
+	c.Assert(q.Options().Elements, DeepEquals, []string{"gender"})
+}
+
+func (s *SearchPTSuite) TestWithoutUnknownParameters(c *C) {
+	q := Query{Resource: "Patient", Query: "foo=bar&gender=male&_pretty=true&name:exact=Donald+Duck&_text=duck&_has:Observation:subject:code=1234-5&_count=10"}
+	known := q.WithoutUnknownParameters()
+	c.Assert(known.Resource, Equals, "Patient")
+	c.Assert(known.Query, Equals, "gender=male&name%3Aexact=Donald+Duck&_has%3AObservation%3Asubject%3Acode=1234-5&_count=10")
+	c.Assert(known.Params(), HasLen, 3)
+	c.Assert(known.Options().Count, Equals, 10)
+
+	// invalid values are still errors
+	q = Query{Resource: "Patient", Query: "_count=foo"}
+	known = q.WithoutUnknownParameters()
+	c.Assert(known.Query, Equals, "_count=foo")
+}
+
+func (s *SearchPTSuite) TestReadOptions(c *C) {
+	q := Query{Resource: "Observation", Query: "_summary=true&_pretty=true&foo=bar"}
+	o := q.ReadOptions()
+	c.Assert(o.Summary, Equals, "true")
+	c.Assert(o.Elements, HasLen, 0)
+}
+
 func (s *SearchPTSuite) TestReconstructQueryWithPassedInOptions(c *C) {
 	q := Query{Resource: "Patient", Query: "name%3Aexact=Robert+Smith&gender=male&_sort=family&_sort%3Adesc=given&_sort%3Aasc=birthdate&_offset=20&_count=10&_include=Patient%3Ageneral-practitioner&_include=Patient%3Aorganization&_revinclude=Condition%3Asubject&_revinclude=Encounter%3Apatient"}
 	params := q.URLQueryParameters(true)
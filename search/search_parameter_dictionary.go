@@ -6096,6 +6096,12 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "[]relatesTo.code", Type: "code"},
 			},
 		},
+		"relationship": SearchParamInfo{
+			Resource:   "DocumentReference",
+			Name:       "relationship",
+			Type:       "composite",
+			Composites: []string{"relatesto", "relation"},
+		},
 		"securitylabel": SearchParamInfo{
 			Resource: "DocumentReference",
 			Name:     "securitylabel",
@@ -7793,6 +7799,12 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "[]characteristic.code", Type: "CodeableConcept"},
 			},
 		},
+		"characteristic-value": SearchParamInfo{
+			Resource:   "Group",
+			Name:       "characteristic-value",
+			Type:       "composite",
+			Composites: []string{"characteristic", "value"},
+		},
 		"code": SearchParamInfo{
 			Resource: "Group",
 			Name:     "code",
@@ -11377,6 +11389,30 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "code", Type: "CodeableConcept"},
 			},
 		},
+		"code-value-concept": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "code-value-concept",
+			Type:       "composite",
+			Composites: []string{"code", "value-concept"},
+		},
+		"code-value-date": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "code-value-date",
+			Type:       "composite",
+			Composites: []string{"code", "value-date"},
+		},
+		"code-value-quantity": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "code-value-quantity",
+			Type:       "composite",
+			Composites: []string{"code", "value-quantity"},
+		},
+		"code-value-string": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "code-value-string",
+			Type:       "composite",
+			Composites: []string{"code", "value-string"},
+		},
 		"combo-code": SearchParamInfo{
 			Resource: "Observation",
 			Name:     "combo-code",
@@ -11386,6 +11422,18 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "code", Type: "CodeableConcept"},
 			},
 		},
+		"combo-code-value-concept": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "combo-code-value-concept",
+			Type:       "composite",
+			Composites: []string{"combo-code", "combo-value-concept"},
+		},
+		"combo-code-value-quantity": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "combo-code-value-quantity",
+			Type:       "composite",
+			Composites: []string{"combo-code", "combo-value-quantity"},
+		},
 		"combo-data-absent-reason": SearchParamInfo{
 			Resource: "Observation",
 			Name:     "combo-data-absent-reason",
@@ -11421,6 +11469,18 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "[]component.code", Type: "CodeableConcept"},
 			},
 		},
+		"component-code-value-concept": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "component-code-value-concept",
+			Type:       "composite",
+			Composites: []string{"component-code", "component-value-concept"},
+		},
+		"component-code-value-quantity": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "component-code-value-quantity",
+			Type:       "composite",
+			Composites: []string{"component-code", "component-value-quantity"},
+		},
 		"component-data-absent-reason": SearchParamInfo{
 			Resource: "Observation",
 			Name:     "component-data-absent-reason",
@@ -11538,6 +11598,12 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				"RelatedPerson",
 			},
 		},
+		"related": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "related",
+			Type:       "composite",
+			Composites: []string{"related-target", "related-type"},
+		},
 		"related-target": SearchParamInfo{
 			Resource: "Observation",
 			Name:     "related-target",
@@ -15472,6 +15538,12 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "referenceSeq.chromosome", Type: "CodeableConcept"},
 			},
 		},
+		"coordinate": SearchParamInfo{
+			Resource:   "Sequence",
+			Name:       "coordinate",
+			Type:       "composite",
+			Composites: []string{"chromosome", "start", "end"},
+		},
 		"end": SearchParamInfo{
 			Resource: "Sequence",
 			Name:     "end",
@@ -0,0 +1,112 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// Elements that are always returned, whatever the _summary and _elements options.
+var mandatoryElements = map[string]bool{"resourceType": true, "id": true, "meta": true}
+
+// summaryElementSets are the top-level elements of a resource returned for _summary=true
+// and the mandatory (min >= 1) ones returned for _summary=text
+type summaryElementSets struct {
+	summary  map[string]bool
+	required map[string]bool
+}
+
+// summaryElementSetsByResource caches the results of elementSetsForSummary
+var summaryElementSetsByResource sync.Map
+
+// elementSetsForSummary returns the summary elements of a resource from the STU3 element definitions
+// in models2, or nil if the resource type is unknown
+func elementSetsForSummary(resource string) *summaryElementSets {
+	if cached, found := summaryElementSetsByResource.Load(resource); found {
+		return cached.(*summaryElementSets)
+	}
+
+	var sets *summaryElementSets
+	if children, found := models2.ChildElements(resource); found && models.StructForResourceName(resource) != nil {
+		sets = &summaryElementSets{summary: make(map[string]bool), required: make(map[string]bool)}
+		for _, child := range children {
+			if child.Summary {
+				sets.summary[child.Name] = true
+			}
+			if child.Min > 0 {
+				sets.required[child.Name] = true
+			}
+		}
+	}
+	summaryElementSetsByResource.Store(resource, sets)
+	return sets
+}
+
+// SummaryElements returns the top-level elements of a resource that are
+// returned for _summary=true, i.e. those flagged isSummary in its STU3
+// StructureDefinition (with each type of choice elements, e.g. valueQuantity).
+func SummaryElements(resource string) map[string]bool {
+	checkSummarySupported(resource, "true")
+	return elementSetsForSummary(resource).summary
+}
+
+// requiredElements returns the top-level elements of a resource with a
+// minimum cardinality of at least 1 (all the types of required choice elements).
+func requiredElements(resource string) map[string]bool {
+	checkSummarySupported(resource, "text")
+	return elementSetsForSummary(resource).required
+}
+
+// checkSummarySupported panics if the elements needed for a _summary option
+// aren't known for a resource, i.e. if it isn't an STU3 resource type.
+func checkSummarySupported(resource string, summary string) {
+	switch summary {
+	case "true", "text":
+		if elementSetsForSummary(resource) == nil {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"_summary\": %s is not supported for %s resources", summary, resource)))
+		}
+	}
+}
+
+// IsSubsetted returns true if the _summary or _elements options mean that only
+// some elements of each resource will be returned.
+func (o *QueryOptions) IsSubsetted() bool {
+	switch o.Summary {
+	case "true", "text", "data":
+		return true
+	case "count":
+		return false
+	}
+	return len(o.Elements) > 0
+}
+
+// IncludesElement returns true if the given top-level element of a resource
+// should be returned under the _summary and _elements options.
+func (o *QueryOptions) IncludesElement(resource string, element string) bool {
+	// primitive extensions (e.g. _birthDate) go along with their element
+	if strings.HasPrefix(element, "_") {
+		element = element[1:]
+	}
+	if mandatoryElements[element] {
+		return true
+	}
+
+	checkSummarySupported(resource, o.Summary)
+	switch o.Summary {
+	case "true":
+		return SummaryElements(resource)[element]
+	case "text":
+		// the narrative along with the mandatory (min >= 1) elements
+		return element == "text" || requiredElements(resource)[element]
+	case "data":
+		return element != "text"
+	}
+
+	if len(o.Elements) > 0 {
+		return contains(o.Elements, element)
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package search
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/terminology"
+)
+
+// The :in, :not-in, :above and :below modifiers of token parameters are evaluated by expanding
+// the stored ValueSets and CodeSystems (see the terminology package) into lists of codes, which the
+// searchers then match exactly (i.e. case-sensitively, as codes from code systems are).
+
+// ExpansionCacheTTL is how long the codes of searches with the terminology modifiers are cached.
+// Writes of ValueSets and CodeSystems by this server clear the cache (see InvalidateExpansionCache)
+// but changes made by other servers using the same database are only seen once entries expire.
+var ExpansionCacheTTL = 5 * time.Minute
+
+// the cache is cleared rather than growing beyond this number of entries
+const expansionCacheSize = 1000
+
+type cachedExpansion struct {
+	codes   *tokenCodes
+	expires time.Time
+}
+
+var expansionCache = struct {
+	sync.Mutex
+	entries map[string]cachedExpansion
+}{entries: make(map[string]cachedExpansion)}
+
+// InvalidateExpansionCache forgets the cached codes of searches with the terminology modifiers,
+// for when a ValueSet or CodeSystem changes
+func InvalidateExpansionCache() {
+	expansionCache.Lock()
+	defer expansionCache.Unlock()
+	expansionCache.entries = make(map[string]cachedExpansion)
+}
+
+func isTerminologyModifier(modifier string) bool {
+	switch modifier {
+	case InModifier, NotInModifier, AboveModifier, BelowModifier:
+		return true
+	}
+	return false
+}
+
+// tokenCodes are the codes matched by a token parameter with a terminology modifier
+type tokenCodes struct {
+	systems  []string // sorted, so that queries are deterministic
+	bySystem map[string][]string
+}
+
+// all returns the codes of every system, for elements that are only codes
+func (c *tokenCodes) all() []string {
+	codes := []string{}
+	seen := make(map[string]bool)
+	for _, system := range c.systems {
+		for _, code := range c.bySystem[system] {
+			if !seen[code] {
+				seen[code] = true
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes
+}
+
+func (c *tokenCodes) contains(system *string, code *string) bool {
+	if code == nil {
+		return false
+	}
+	if system == nil {
+		// e.g. a code element, which matches the codes of any system
+		for _, codes := range c.bySystem {
+			if containsString(codes, *code) {
+				return true
+			}
+		}
+		return false
+	}
+	return containsString(c.bySystem[*system], *code)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenCodePaths returns the paths of a token parameter that have codes for the terminology modifiers
+func tokenCodePaths(t *TokenParam) []SearchParamPath {
+	var paths []SearchParamPath
+	for _, p := range t.Paths {
+		switch p.Type {
+		case "CodeableConcept", "Coding", "code":
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", t.Name)))
+	}
+	return paths
+}
+
+// terminologySource finds stored ValueSets and CodeSystems by their canonical URLs with a searcher's Search
+type terminologySource func(query Query) ([]*models2.Resource, error)
+
+func (search terminologySource) Find(resourceType string, canonicalURL string) ([]byte, error) {
+	resources, err := search(Query{Resource: resourceType, Query: "url=" + url.QueryEscape(escape(canonicalURL)) + "&_count=1"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to search for %s %s", resourceType, canonicalURL)
+	}
+	if len(resources) == 0 {
+		return nil, nil
+	}
+	return resources[0].JsonBytes(), nil
+}
+
+// expandTokenParam returns the codes matched by a token parameter with a terminology modifier: those
+// in the value set with the URL of an :in or :not-in parameter, or the code of an :above or :below parameter
+// and its ancestors or descendants in its code system. Expansions are cached by the namespace (i.e. the
+// database) and the parameter's value.
+func expandTokenParam(t *TokenParam, namespace string, source terminology.Source) *tokenCodes {
+	key := namespace + " " + t.Modifier + " " + t.System + "|" + t.Code
+	expansionCache.Lock()
+	cached, found := expansionCache.entries[key]
+	expansionCache.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.codes
+	}
+
+	service := terminology.NewService(source)
+	var valueSet map[string]interface{}
+	switch t.Modifier {
+	case InModifier, NotInModifier:
+		var err error
+		valueSet, err = service.FindValueSet(t.Code)
+		if err != nil {
+			panic(terminologySearchError(t, err))
+		}
+	default:
+		if t.System == "" || t.Code == "" {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\": the :%s modifier requires a system and a code", t.Name, t.Modifier)))
+		}
+		op := "is-a"
+		if t.Modifier == AboveModifier {
+			op = "generalizes"
+		}
+		valueSet = map[string]interface{}{
+			"compose": map[string]interface{}{
+				"include": []interface{}{
+					map[string]interface{}{
+						"system": t.System,
+						"filter": []interface{}{
+							map[string]interface{}{"property": "concept", "op": op, "value": t.Code},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	expansion, err := service.Expand(valueSet, terminology.ExpandOptions{})
+	if err != nil {
+		panic(terminologySearchError(t, err))
+	}
+	codes := &tokenCodes{bySystem: make(map[string][]string)}
+	for _, concept := range expansion.Contains {
+		if _, found := codes.bySystem[concept.System]; !found {
+			codes.systems = append(codes.systems, concept.System)
+		}
+		codes.bySystem[concept.System] = append(codes.bySystem[concept.System], concept.Code)
+	}
+	sort.Strings(codes.systems)
+
+	expansionCache.Lock()
+	if len(expansionCache.entries) >= expansionCacheSize {
+		expansionCache.entries = make(map[string]cachedExpansion)
+	}
+	expansionCache.entries[key] = cachedExpansion{codes: codes, expires: time.Now().Add(ExpansionCacheTTL)}
+	expansionCache.Unlock()
+	return codes
+}
+
+// terminologySearchError converts the errors of expansions to search errors
+func terminologySearchError(t *TokenParam, err error) error {
+	terminologyError, isTerminologyError := errors.Cause(err).(*terminology.Error)
+	if !isTerminologyError {
+		return errors.Wrapf(err, "failed to expand the :%s parameter %s", t.Modifier, t.Name)
+	}
+	message := fmt.Sprintf("Parameter \"%s\": %s", t.Name, terminologyError.Message)
+	if terminologyError.Code == "not-supported" {
+		return createUnsupportedSearchError("MSG_PARAM_INVALID", message)
+	}
+	return createInvalidSearchError("MSG_PARAM_INVALID", message)
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/mitre/heart"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// AuditLogger records an AuditEvent for every RESTful interaction handled by the ResourceControllers
+// (see Handler) and for every entry of batches and transactions (see BatchEntries). The AuditEvents are
+// written in the background so that requests aren't slowed down by them; they're dropped (and logged)
+// when too many are waiting to be written.
+type AuditLogger struct {
+	dal    DataAccessLayer
+	config Config
+	queue  chan auditRecord
+}
+
+type auditRecord struct {
+	db    string
+	event *models.AuditEvent
+}
+
+// auditedInteraction describes an interaction being audited
+type auditedInteraction struct {
+	interaction  string // code from http://hl7.org/fhir/restful-interaction
+	bundleType   string // batch or transaction for the entries of Bundles
+	resourceType string
+	id           string
+	versionID    string
+	query        string
+	status       int
+	matches      []string // references of the resources matched by a search
+}
+
+// NewAuditLogger creates an AuditLogger that writes AuditEvents to a DataAccessLayer
+func NewAuditLogger(dal DataAccessLayer, config Config) *AuditLogger {
+	a := &AuditLogger{
+		dal:    dal,
+		config: config,
+		queue:  make(chan auditRecord, config.AuditQueueSize),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AuditLogger) run() {
+	for record := range a.queue {
+		if err := a.write(record); err != nil {
+			glog.Errorf("AuditLogger: failed to write AuditEvent: %+v", err)
+		}
+	}
+}
+
+func (a *AuditLogger) write(record auditRecord) (err error) {
+	defer func() {
+		// StartSession panics on invalid database names
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+	}()
+
+	json, err := record.event.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "MarshalJSON failed")
+	}
+	resource, err := models2.NewResourceFromJsonBytes(json)
+	if err != nil {
+		return errors.Wrap(err, "NewResourceFromJsonBytes failed")
+	}
+	session := a.dal.StartSession(context.Background(), record.db)
+	defer session.Finish()
+	_, err = session.Post(resource)
+	return errors.Wrap(err, "Post failed")
+}
+
+// Handler records an AuditEvent for the request once it's been handled
+func (a *AuditLogger) Handler(c *gin.Context) {
+	c.Next()
+	a.recordRequest(c)
+}
+
+// Rejected records an AuditEvent for a request rejected by the authentication middleware, which runs before Handler
+func (a *AuditLogger) Rejected(c *gin.Context) {
+	a.recordRequest(c)
+}
+
+func (a *AuditLogger) recordRequest(c *gin.Context) {
+	interaction, resourceType, id, versionID := restInteraction(c.Request.Method, c.Request.URL.Path)
+	if interaction == "" || models.StructForResourceName(resourceType) == nil {
+		return
+	}
+	audited := auditedInteraction{
+		interaction:  interaction,
+		resourceType: resourceType,
+		id:           id,
+		versionID:    versionID,
+		query:        c.Request.URL.RawQuery,
+		status:       c.Writer.Status(),
+	}
+
+	switch interaction {
+	case "read":
+		audited.versionID = strings.Trim(strings.TrimPrefix(c.Writer.Header().Get("ETag"), "W/"), `"`)
+	case "create", "update", "patch":
+		if location := c.Writer.Header().Get("Location"); location != "" {
+			audited.id, audited.versionID = parseLocation(location, resourceType)
+		}
+		if interaction == "create" {
+			audited.query = c.GetHeader("If-None-Exist")
+		}
+	case "search-type":
+		// the self link has the parameters of searches POSTed to _search, and those added to compartment searches
+		if value, exists := c.Get("bundle"); exists {
+			bundle := value.(*models2.ShallowBundle)
+			for _, link := range bundle.Link {
+				if link.Relation != "self" {
+					continue
+				}
+				if self, err := url.Parse(link.Url); err == nil {
+					audited.query = self.RawQuery
+				}
+			}
+			for _, entry := range bundle.Entry {
+				if entry.Resource != nil && entry.Search != nil && entry.Search.Mode == "match" {
+					audited.matches = append(audited.matches, entry.Resource.ResourceType()+"/"+entry.Resource.Id())
+				}
+			}
+		}
+	}
+
+	a.record(c, audited)
+}
+
+// BatchEntries records an AuditEvent for every entry of a batch or transaction. requests are the
+// entries' requests, as the entries of the Bundle are modified while it's processed.
+func (a *AuditLogger) BatchEntries(c *gin.Context, bundleType string, requests []*models.BundleEntryRequestComponent, response *response) {
+	if response == nil {
+		return
+	}
+	reply, succeeded := response.reply.(*models2.ShallowBundle)
+	for i, request := range requests {
+		if request == nil {
+			continue
+		}
+		path, query := request.Url, ""
+		if q := strings.Index(path, "?"); q >= 0 {
+			path, query = path[:q], path[q+1:]
+		}
+		interaction, resourceType, id, versionID := restInteraction(request.Method, path)
+		if interaction == "" {
+			continue
+		}
+		audited := auditedInteraction{
+			interaction:  interaction,
+			bundleType:   bundleType,
+			resourceType: resourceType,
+			id:           id,
+			versionID:    versionID,
+			query:        query,
+			status:       response.httpStatus,
+		}
+		if interaction == "create" {
+			audited.query = request.IfNoneExist
+		}
+		if succeeded && i < len(reply.Entry) && reply.Entry[i].Response != nil {
+			entryResponse := reply.Entry[i].Response
+			// e.g. "201" or "201 Created"
+			if status, err := strconv.Atoi(strings.Fields(entryResponse.Status + " ")[0]); err == nil {
+				audited.status = status
+			}
+			if entryResponse.Location != "" {
+				audited.id, audited.versionID = parseLocation(entryResponse.Location, resourceType)
+			}
+		}
+		a.record(c, audited)
+	}
+}
+
+// record queues the AuditEvent of an interaction
+func (a *AuditLogger) record(c *gin.Context, audited auditedInteraction) {
+	action := auditAction(audited.interaction)
+	if a.config.AuditExcludeAuditEventReads && audited.resourceType == "AuditEvent" && (action == "R" || action == "E") {
+		return
+	}
+
+	db := a.config.AuditDatabaseName
+	if db == "" {
+		db = c.GetHeader("Db")
+	}
+	select {
+	case a.queue <- auditRecord{db, a.event(c, audited, action)}:
+	default:
+		glog.Errorf("AuditLogger: queue is full, dropping the AuditEvent of %s %s/%s (HTTP %d)",
+			audited.interaction, audited.resourceType, audited.id, audited.status)
+	}
+}
+
+func (a *AuditLogger) event(c *gin.Context, audited auditedInteraction, action string) *models.AuditEvent {
+	event := &models.AuditEvent{
+		Type: &models.Coding{System: "http://hl7.org/fhir/audit-event-type", Code: "rest", Display: "RESTful Operation"},
+		Subtype: []models.Coding{
+			{System: "http://hl7.org/fhir/restful-interaction", Code: audited.interaction},
+		},
+		Action:      action,
+		Recorded:    &models.FHIRDateTime{Time: time.Now(), Precision: models.Timestamp},
+		Outcome:     "0",
+		OutcomeDesc: fmt.Sprintf("HTTP %d %s", audited.status, http.StatusText(audited.status)),
+	}
+	if audited.bundleType != "" {
+		event.Subtype = append(event.Subtype, models.Coding{System: "http://hl7.org/fhir/restful-interaction", Code: audited.bundleType})
+	}
+	if audited.status >= 500 {
+		event.Outcome = "8" // serious failure
+	} else if audited.status >= 400 {
+		event.Outcome = "4" // minor failure
+	}
+
+	// the authenticated principal, from the auth middleware
+	requestor := true
+	agent := models.AuditEventAgentComponent{
+		Requestor: &requestor,
+		Network:   &models.AuditEventAgentNetworkComponent{Address: c.ClientIP(), Type: "2"}, // IP address
+	}
+	subject, name := requestPrincipal(c)
+	agent.Name = name
+	if subject != "" {
+		agent.UserId = &models.Identifier{Value: subject}
+	}
+	agent.AltId = c.GetString("clientID")
+	event.Agent = []models.AuditEventAgentComponent{agent}
+
+	event.Source = &models.AuditEventSourceComponent{
+		Identifier: &models.Identifier{Value: a.config.serverIdentifier()},
+		Type:       []models.Coding{{System: "http://hl7.org/fhir/security-source-type", Code: "3", Display: "Web Server"}},
+	}
+
+	resourceType := &models.Coding{System: "http://hl7.org/fhir/resource-types", Code: audited.resourceType}
+	domainResource := &models.Coding{System: "http://hl7.org/fhir/object-role", Code: "4", Display: "Domain Resource"}
+	if audited.id != "" {
+		reference := audited.resourceType + "/" + audited.id
+		if audited.versionID != "" {
+			reference += "/_history/" + audited.versionID
+		}
+		event.Entity = append(event.Entity, models.AuditEventEntityComponent{
+			Reference: &models.Reference{Reference: reference},
+			Type:      resourceType,
+			Role:      domainResource,
+		})
+	}
+	if audited.query != "" || audited.id == "" {
+		// type-level interactions are recorded even without a query
+		var query string
+		if audited.query != "" {
+			query = base64.StdEncoding.EncodeToString([]byte(audited.query))
+		}
+		event.Entity = append(event.Entity, models.AuditEventEntityComponent{
+			Type:  resourceType,
+			Role:  &models.Coding{System: "http://hl7.org/fhir/object-role", Code: "24", Display: "Query"},
+			Query: query,
+		})
+	}
+	for _, match := range audited.matches {
+		event.Entity = append(event.Entity, models.AuditEventEntityComponent{
+			Reference: &models.Reference{Reference: match},
+			Type:      &models.Coding{System: "http://hl7.org/fhir/resource-types", Code: strings.SplitN(match, "/", 2)[0]},
+			Role:      domainResource,
+		})
+	}
+	return event
+}
+
+// restInteraction returns the RESTful interaction (http://hl7.org/fhir/restful-interaction) of a request
+// for a path relative to the server's root (e.g. Patient/123/_history/2), the type of resource it's for,
+// and the id and version of the resource if it's for an instance. Compartment searches are searches of
+// the type of resources in the compartment. Operations other than $everything aren't audited so have no
+// interaction.
+func restInteraction(method string, path string) (interaction, resourceType, id, versionID string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	resourceType = parts[0]
+	methodInteractions := map[string]string{
+		"GET":    "read",
+		"POST":   "create",
+		"PUT":    "update",
+		"PATCH":  "patch",
+		"DELETE": "delete",
+	}
+
+	switch {
+	case len(parts) == 1:
+		interaction = methodInteractions[method]
+		if method == "GET" {
+			interaction = "search-type"
+		}
+	case len(parts) == 2 && parts[1] == "_search" && method == "POST":
+		interaction = "search-type"
+	case len(parts) == 2 && parts[1] == "_history" && method == "GET":
+		interaction = "history-type"
+	case strings.HasPrefix(parts[1], "$") || strings.HasPrefix(parts[1], "_"):
+		// type-level operations
+	case len(parts) == 2:
+		id = parts[1]
+		if method != "POST" {
+			interaction = methodInteractions[method]
+		}
+	case len(parts) == 3 && parts[2] == "_history" && method == "GET":
+		interaction, id = "history-instance", parts[1]
+	case len(parts) == 4 && parts[2] == "_history" && method == "GET":
+		interaction, id, versionID = "vread", parts[1], parts[3]
+	case len(parts) == 3 && parts[2] == "$everything" && method == "GET":
+		interaction, id = "operation", parts[1]
+	case len(parts) == 3 && method == "GET" && !strings.HasPrefix(parts[2], "$"):
+		// e.g. Patient/123/Observation
+		interaction, resourceType = "search-type", parts[2]
+	}
+	return
+}
+
+// auditAction returns the AuditEvent action code (http://hl7.org/fhir/audit-event-action) of an interaction
+func auditAction(interaction string) string {
+	switch interaction {
+	case "create":
+		return "C"
+	case "update", "patch":
+		return "U"
+	case "delete":
+		return "D"
+	case "search-type", "operation":
+		return "E"
+	default:
+		return "R"
+	}
+}
+
+// parseLocation returns the id and version in a Location header (e.g. http://server/Patient/123/_history/2)
+func parseLocation(location string, resourceType string) (id string, versionID string) {
+	start := strings.LastIndex(location, resourceType+"/")
+	if start < 0 {
+		return "", ""
+	}
+	parts := strings.Split(location[start+len(resourceType)+1:], "/")
+	id = parts[0]
+	if len(parts) == 3 && parts[1] == "_history" {
+		versionID = parts[2]
+	}
+	return
+}
+
+// requestPrincipal returns the subject and name of the principal authenticated by the auth middleware
+func requestPrincipal(c *gin.Context) (subject string, name string) {
+	subject = c.GetString("subject")
+	if value, exists := c.Get("UserInfo"); exists {
+		if userInfo, ok := value.(*heart.UserInfo); ok {
+			subject = userInfo.SUB
+			name = userInfo.Name
+		}
+	}
+	return subject, name
+}
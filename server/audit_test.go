@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+)
+
+type AuditSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&AuditSuite{})
+
+type auditEventJSON struct {
+	Subtype []struct {
+		Code string `json:"code"`
+	} `json:"subtype"`
+	Action      string `json:"action"`
+	Outcome     string `json:"outcome"`
+	OutcomeDesc string `json:"outcomeDesc"`
+	Agent       []struct {
+		UserID struct {
+			Value string `json:"value"`
+		} `json:"userId"`
+		AltID   string `json:"altId"`
+		Network struct {
+			Address string `json:"address"`
+		} `json:"network"`
+	} `json:"agent"`
+	Entity []struct {
+		Reference struct {
+			Reference string `json:"reference"`
+		} `json:"reference"`
+		Type struct {
+			Code string `json:"code"`
+		} `json:"type"`
+		Query string `json:"query"`
+	} `json:"entity"`
+}
+
+func (e auditEventJSON) references() []string {
+	var references []string
+	for _, entity := range e.Entity {
+		if entity.Reference.Reference != "" {
+			references = append(references, entity.Reference.Reference)
+		}
+	}
+	return references
+}
+
+func (e auditEventJSON) query(c *C) string {
+	for _, entity := range e.Entity {
+		if entity.Query != "" {
+			query, err := base64.StdEncoding.DecodeString(entity.Query)
+			c.Assert(err, IsNil)
+			return string(query)
+		}
+	}
+	return ""
+}
+
+func (s *AuditSuite) setUp(excludeAuditEventReads bool) {
+	configure := func(config *Config) {
+		config.EnableAuditEvents = true
+		config.AuditExcludeAuditEventReads = excludeAuditEventReads
+	}
+	// like the auth middleware
+	s.server = newMemoryTestServer(configure, func(c *gin.Context) {
+		c.Set("subject", "user1")
+		c.Set("clientID", "app1")
+	})
+}
+
+// auditEvents waits for at least count AuditEvents to be written, returning them
+func (s *AuditSuite) auditEvents(c *C, count int) []auditEventJSON {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := serve(s.server, "GET", "/AuditEvent?_count=100", "")
+		c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+		var bundle struct {
+			Entry []struct {
+				Resource auditEventJSON `json:"resource"`
+			} `json:"entry"`
+		}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+		if len(bundle.Entry) >= count {
+			var events []auditEventJSON
+			for _, entry := range bundle.Entry {
+				events = append(events, entry.Resource)
+			}
+			return events
+		}
+		c.Assert(time.Now().Before(deadline), Equals, true, Commentf("only %d AuditEvents were written", len(bundle.Entry)))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *AuditSuite) TestInteractions(c *C) {
+	s.setUp(true)
+
+	w := serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "GET", "/Patient/p1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "GET", "/Patient/p2", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	w = serve(s.server, "GET", "/Patient?_id=p1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p1"}}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	observationID, _ := parseLocation(w.Header().Get("Location"), "Observation")
+	w = serve(s.server, "GET", "/Patient/p1/_history/1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "GET", "/Patient/p1/_history", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "DELETE", "/Observation/"+observationID, "")
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{ "request": { "method": "GET", "url": "Observation/`+observationID+`" } },
+			{ "resource": { "resourceType": "Patient" }, "request": { "method": "POST", "url": "Patient" } }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	// AuditEvent reads aren't audited
+	w = serve(s.server, "GET", "/AuditEvent", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	events := s.auditEvents(c, 10)
+	c.Assert(events, HasLen, 10)
+	byInteraction := make(map[string][]auditEventJSON)
+	for _, event := range events {
+		c.Assert(event.Agent, HasLen, 1)
+		c.Assert(event.Agent[0].UserID.Value, Equals, "user1")
+		c.Assert(event.Agent[0].AltID, Equals, "app1")
+		c.Assert(event.Agent[0].Network.Address, Equals, "192.0.2.1")
+		key := event.Subtype[0].Code
+		if len(event.Subtype) > 1 {
+			key += " " + event.Subtype[1].Code
+		}
+		byInteraction[key] = append(byInteraction[key], event)
+	}
+
+	update := byInteraction["update"]
+	c.Assert(update, HasLen, 1)
+	c.Assert(update[0].Action, Equals, "U")
+	c.Assert(update[0].references(), DeepEquals, []string{"Patient/p1/_history/1"})
+
+	reads := byInteraction["read"]
+	c.Assert(reads, HasLen, 2)
+	for _, read := range reads {
+		c.Assert(read.Action, Equals, "R")
+		if read.Outcome == "0" {
+			c.Assert(read.references(), DeepEquals, []string{"Patient/p1/_history/1"})
+		} else {
+			c.Assert(read.Outcome, Equals, "4")
+			c.Assert(read.OutcomeDesc, Equals, "HTTP 404 Not Found")
+			c.Assert(read.references(), DeepEquals, []string{"Patient/p2"})
+		}
+	}
+
+	search := byInteraction["search-type"]
+	c.Assert(search, HasLen, 1)
+	c.Assert(search[0].Action, Equals, "E")
+	c.Assert(search[0].query(c), Matches, "_id=p1.*")
+	c.Assert(search[0].references(), DeepEquals, []string{"Patient/p1"})
+
+	create := byInteraction["create"]
+	c.Assert(create, HasLen, 1)
+	c.Assert(create[0].Action, Equals, "C")
+	c.Assert(create[0].references(), DeepEquals, []string{"Observation/" + observationID + "/_history/1"})
+
+	c.Assert(byInteraction["vread"], HasLen, 1)
+	c.Assert(byInteraction["vread"][0].references(), DeepEquals, []string{"Patient/p1/_history/1"})
+	c.Assert(byInteraction["history-instance"], HasLen, 1)
+	c.Assert(byInteraction["delete"], HasLen, 1)
+	c.Assert(byInteraction["delete"][0].Action, Equals, "D")
+	c.Assert(byInteraction["delete"][0].references(), DeepEquals, []string{"Observation/" + observationID})
+
+	// batch entries
+	batchRead := byInteraction["read batch"]
+	c.Assert(batchRead, HasLen, 1)
+	c.Assert(batchRead[0].Outcome, Equals, "4")
+	c.Assert(batchRead[0].OutcomeDesc, Equals, "HTTP 410 Gone")
+	batchCreate := byInteraction["create batch"]
+	c.Assert(batchCreate, HasLen, 1)
+	c.Assert(batchCreate[0].Outcome, Equals, "0")
+	c.Assert(batchCreate[0].references(), HasLen, 1)
+	c.Assert(batchCreate[0].references()[0], Matches, "Patient/[^/]+(/_history/1)?")
+}
+
+func (s *AuditSuite) TestAuditEventReads(c *C) {
+	s.setUp(false)
+
+	w := serve(s.server, "GET", "/Patient", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	// the first search of AuditEvents is audited too
+	events := s.auditEvents(c, 2)
+	types := make(map[string]bool)
+	for _, event := range events {
+		types[event.Entity[0].Type.Code] = true
+	}
+	c.Assert(types["Patient"], Equals, true)
+	c.Assert(types["AuditEvent"], Equals, true)
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"net/http"
@@ -13,7 +12,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/eug48/fhir/utils"
 	"github.com/pkg/errors"
 
@@ -31,6 +29,7 @@ import (
 type BatchController struct {
 	DAL    DataAccessLayer
 	Config Config
+	Audit  *AuditLogger // nil if AuditEvents are disabled
 }
 
 // NewBatchController creates a new BatchController based on the passed in DAL
@@ -101,8 +100,8 @@ func (b *BatchController) Post(c *gin.Context) {
 	// Load FHIR request resource (should be a Bundle)
 	bundleResource, err := FHIRBind(c, b.Config.ValidatorURL)
 	if err != nil {
-		response := badStructure(err)
-		c.AbortWithStatusJSON(response.httpStatus, response.errOutcome)
+		statusCode, outcome := bindFailure(err)
+		c.AbortWithStatusJSON(statusCode, outcome)
 		return
 	}
 
@@ -120,6 +119,20 @@ func (b *BatchController) Post(c *gin.Context) {
 	}
 
 	var response *response
+	if b.Audit != nil {
+		// entry requests are cleared once processed
+		bundleType := bundle.Type
+		requests := make([]*models.BundleEntryRequestComponent, len(bundle.Entry))
+		for i, entry := range bundle.Entry {
+			if entry.Request != nil {
+				request := *entry.Request
+				requests[i] = &request
+			}
+		}
+		defer func() {
+			b.Audit.BatchEntries(c, bundleType, requests, response)
+		}()
+	}
 	for attemptsLeft > 0 {
 		glog.Infof("FHIR POST: attempts left: %d", attemptsLeft)
 		attemptsLeft -= 1
@@ -172,6 +185,14 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 		return response
 	}
 
+	// entry requests are cleared once processed
+	methods := make([]string, len(entries))
+	urls := make([]string, len(entries))
+	for i, entry := range entries {
+		methods[i] = entry.Request.Method
+		urls[i] = entry.Request.Url
+	}
+
 	// start DB session +- transaction
 	session := b.DAL.StartSession(ctx, customDbName)
 	defer session.Finish()
@@ -478,7 +499,7 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 			}
 		}
 
-		response = b.processProvenanceHeader(provenanceHeader, c, entries, session)
+		response = b.recordProvenance(provenanceHeader, c, entries, methods, urls, session)
 		if response != nil {
 			return response
 		}
@@ -488,13 +509,28 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 			start = time.Now()
 			glog.V(4).Infof("    starting transaction commit")
 		}
-		session.CommmitIfTransaction()
+		if err := session.CommmitIfTransaction(); err != nil {
+			return internalError(errors.Wrap(err, "failed to commit the transaction"))
+		}
 		if glog.V(4) {
 			glog.V(4).Infof("    finished transaction commit in %v", time.Since(start))
 		}
+	} else {
+		response = b.recordProvenance("", c, entries, methods, urls, session)
+		if response != nil {
+			return response
+		}
 	}
 
 	if proceed {
+		prefs := requestPreferences(c)
+		for i, entry := range entries {
+			switch methods[i] {
+			case "POST", "PUT", "PATCH":
+				applyReturnPreference(prefs, methods[i], entry)
+			}
+		}
+
 		total := uint32(len(entries))
 		bundle.Total = &total
 		bundle.Type = fmt.Sprintf("%s-response", bundle.Type)
@@ -552,6 +588,7 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 
 	switch entry.Request.Method {
 	case "DELETE":
+		var etag string
 		if !isConditional(entry) {
 			// It's a normal DELETE
 			parts := strings.SplitN(entry.Request.Url, "/", 2)
@@ -559,9 +596,13 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 				return fmt.Errorf("Couldn't identify resource and id to delete from %s", entry.Request.Url)
 			}
 			glog.V(3).Infof("    normal delete")
-			if _, err := session.Delete(parts[1], parts[0]); err != nil && err != ErrNotFound {
+			newVersionId, err := session.Delete(parts[1], parts[0])
+			if err != nil && err != ErrNotFound {
 				return errors.Wrapf(err, "failed to delete %s", entry.Request.Url)
 			}
+			if newVersionId != "" {
+				etag = "W/\"" + newVersionId + "\""
+			}
 		} else {
 			// It's a conditional (query-based) delete
 			parts := strings.SplitN(entry.Request.Url, "?", 2)
@@ -575,6 +616,7 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 		entry.Request = nil
 		entry.Response = &models.BundleEntryResponseComponent{
 			Status: "204",
+			Etag:   etag,
 		}
 	case "POST":
 
@@ -631,6 +673,59 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 			entry.Response.Status = "200"
 		}
 		updateEntryMeta(entry)
+	case "PATCH":
+		var resourceType, id string
+		if strings.Contains(entry.Request.Url, "?") {
+			// It's a conditional (query-based) patch
+			parts := strings.SplitN(entry.Request.Url, "?", 2)
+			query := search.Query{Resource: parts[0], Query: parts[1]}
+			IDs, err := session.FindIDs(query)
+			if err != nil {
+				return errors.Wrapf(err, "failed to find the resource to patch for %s", entry.Request.Url)
+			}
+			switch len(IDs) {
+			case 0:
+				return errors.Wrapf(ErrNotFound, "no matches for conditional patch of %s", entry.Request.Url)
+			case 1:
+				resourceType, id = parts[0], IDs[0]
+			default:
+				return ErrMultipleMatches{msg: fmt.Sprintf("Multiple matches for %s (%v)", entry.Request.Url, IDs)}
+			}
+		} else {
+			parts := strings.SplitN(entry.Request.Url, "/", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Couldn't identify resource and id to patch from %s", entry.Request.Url)
+			}
+			resourceType, id = parts[0], parts[1]
+		}
+
+		patch, err := newPatchFromResource(entry.Resource)
+		if err != nil {
+			return err
+		}
+		conditionalVersionId := ""
+		if entry.Request.IfMatch != "" {
+			conditionalVersionId, err = utils.ETagToVersionId(entry.Request.IfMatch)
+			if err != nil {
+				return ErrInvalidPatch{msg: fmt.Sprintf("Couldn't parse If-Match: %s", entry.Request.IfMatch)}
+			}
+		}
+
+		// Write
+		resource, err := patchResource(session, resourceType, id, conditionalVersionId, patch, entry.Resource.WhatToEncrypt())
+		if err != nil {
+			return errors.Wrapf(err, "failed to patch %s", entry.Request.Url)
+		}
+
+		// Response
+		entry.Resource = resource
+		entry.FullUrl = b.Config.responseURL(req, resourceType, id).String()
+		entry.Request = nil
+		entry.Response = &models.BundleEntryResponseComponent{
+			Status:   "200",
+			Location: entry.FullUrl,
+		}
+		updateEntryMeta(entry)
 	case "GET":
 		/*
 			examples
@@ -686,8 +781,9 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 		}
 
 		if historyRequest {
-			baseURL := b.Config.responseURL(req, resourceType)
-			bundle, err := session.History(*baseURL, resourceType, id)
+			historyQuery := search.Query{Resource: resourceType, Query: queryString}
+			baseURL := b.Config.responseURL(req)
+			bundle, err := session.History(*baseURL, historyQuery, id)
 			glog.V(3).Infof("  history request (%s/%s) --> err %+v", resourceType, id, err)
 			if err != nil && err != ErrNotFound {
 				return errors.Wrapf(err, "History request failed: %s", entry.Request.Url)
@@ -720,6 +816,7 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 
 			switch err {
 			case nil:
+				entry.Response.Status = "200"
 				lastUpdated := entry.Resource.LastUpdated()
 				if lastUpdated != "" {
 					// entry.Response.LastModified = entry.Resource.LastUpdatedTime().UTC().Format(http.TimeFormat)
@@ -732,6 +829,10 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 				if versionId != "" {
 					entry.Response.Etag = "W/\"" + versionId + "\""
 				}
+				if entryNotModified(entry) {
+					entry.Response.Status = "304"
+					entry.Resource = nil
+				}
 			case ErrNotFound:
 				entry.Response.Status = "404"
 			case ErrDeleted:
@@ -753,10 +854,15 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 			}
 			entry.Response = &models.BundleEntryResponseComponent{
 				Status: "200",
+				Etag:   bundleETag(bundle),
 			}
-			entry.Resource, err = bundle.ToResource()
-			if err != nil {
-				return errors.Wrapf(err, "bundle.ToResource failed for request: %s", entry.Request.Url)
+			if entryNotModified(entry) {
+				entry.Response.Status = "304"
+			} else {
+				entry.Resource, err = bundle.ToResource()
+				if err != nil {
+					return errors.Wrapf(err, "bundle.ToResource failed for request: %s", entry.Request.Url)
+				}
 			}
 		}
 		entry.Request = nil
@@ -817,99 +923,96 @@ func (b *BatchController) resolveConditionalPut(request *http.Request, session D
 	return nil
 }
 
-func (b *BatchController) processProvenanceHeader(provenanceHeader string, c *gin.Context, entries []*models2.ShallowBundleEntryComponent, session DataAccessSession) *response {
-	// spec: http://www.hl7.org/fhir/provenance.html#header
-
-	if provenanceHeader != "" {
-		headerBytes := []byte(provenanceHeader)
-
-		// check resourceType
-		resourceType, dataType, _, err := jsonparser.Get(headerBytes, "resourceType")
-		if err != nil {
-			err = errors.Wrap(err, "error parsing X-Provenance header resourceType")
-			return badValue(err)
-		}
-		if string(resourceType) != "Provenance" {
-			err = errors.Errorf("error parsing X-Provenance header: invalid resourceType")
-			return badValue(err)
-		}
-
-		// make sure "target" is not set
-		_, dataType, _, err = jsonparser.Get(headerBytes, "target")
-		if dataType == jsonparser.NotExist {
-		} else if err != nil {
-			err = errors.Wrap(err, "error parsing X-Provenance header")
-			return badValue(err)
-		} else {
-			err = errors.Errorf("error parsing X-Provenance header: target should not be set")
-			return badValue(err)
-		}
-
-		if headerBytes[len(headerBytes)-1] != '}' {
-			err = errors.Errorf("error parsing X-Provenance header: doesn't end with }")
-			return badValue(err)
+// writtenEntries returns the actions and versioned targets of the entries that wrote resources.
+// Conditional deletes aren't included as they don't report which resources they deleted.
+func (b *BatchController) writtenEntries(entries []*models2.ShallowBundleEntryComponent, methods []string, urls []string) (actions []string, targets []models.Reference, err error) {
+	for i, entry := range entries {
+		if entry.Response == nil || entry.Response.Outcome != nil {
+			continue
 		}
 
-		// generate targets field
-		var sb bytes.Buffer
-		sb.Write(headerBytes[:len(headerBytes)-1]) // remove final '{'}
-		sb.WriteString(", \"target\": [")
-		addComma := false
-		for _, entry := range entries {
-			if entry.Resource == nil {
+		var action string
+		switch {
+		case methods[i] == "POST" && entry.Response.Status == "201":
+			action = "create"
+		case methods[i] == "PUT" && entry.Response.Status == "201":
+			action = "create"
+		case methods[i] == "PUT" && entry.Response.Status == "200":
+			action = "update"
+		case methods[i] == "PATCH" && entry.Response.Status == "200":
+			action = "update"
+		case methods[i] == "DELETE" && !strings.Contains(urls[i], "?"):
+			parts := strings.SplitN(strings.TrimPrefix(urls[i], "/"), "/", 2)
+			var versionId string
+			if entry.Response.Etag != "" {
+				versionId, err = utils.ETagToVersionId(entry.Response.Etag)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "writtenEntries: bad etag for %s", urls[i])
+				}
+			} else if b.Config.EnableHistory {
+				// nothing was deleted
 				continue
 			}
-			if addComma {
-				sb.WriteString(", ")
-			}
-			addComma = true
-
-			if entry.Resource.ResourceType() == "" {
-				err = errors.Errorf("processProvenanceHeader: missing resourceType for %s", entry.FullUrl)
-				return internalError(err)
-			}
-			if entry.Resource.Id() == "" {
-				err = errors.Errorf("processProvenanceHeader: missing id for %s", entry.FullUrl)
-				return internalError(err)
-			}
-			if b.Config.EnableHistory && entry.Resource.VersionId() == "" {
-				err = errors.Errorf("processProvenanceHeader: missing versionId for %s", entry.FullUrl)
-				return internalError(err)
-			}
+			actions = append(actions, "delete")
+			targets = append(targets, b.Config.provenanceTarget(parts[0], parts[1], versionId))
+			continue
+		default:
+			continue
+		}
 
-			sb.WriteString("{ \"reference\": \"")
-			sb.WriteString(entry.Resource.ResourceType())
-			sb.WriteString("/")
-			sb.WriteString(entry.Resource.Id())
-			if b.Config.EnableHistory {
-				sb.WriteString("/_history/")
-				sb.WriteString(entry.Resource.VersionId())
-			}
-			sb.WriteString("\" }")
+		if entry.Resource.ResourceType() == "" {
+			return nil, nil, errors.Errorf("writtenEntries: missing resourceType for %s", entry.FullUrl)
+		}
+		if entry.Resource.Id() == "" {
+			return nil, nil, errors.Errorf("writtenEntries: missing id for %s", entry.FullUrl)
+		}
+		if b.Config.EnableHistory && entry.Resource.VersionId() == "" {
+			return nil, nil, errors.Errorf("writtenEntries: missing versionId for %s", entry.FullUrl)
 		}
+		actions = append(actions, action)
+		targets = append(targets, b.Config.provenanceTarget(entry.Resource.ResourceType(), entry.Resource.Id(), entry.Resource.VersionId()))
+	}
+	return actions, targets, nil
+}
 
-		sb.WriteString("] }")
+// recordProvenance stores the Provenance of an X-Provenance header targeting all of the bundle's writes or,
+// when AutoProvenance is enabled and there's no header, a Provenance for each write
+func (b *BatchController) recordProvenance(provenanceHeader string, c *gin.Context, entries []*models2.ShallowBundleEntryComponent, methods []string, urls []string, session DataAccessSession) *response {
+	if provenanceHeader == "" && !b.Config.AutoProvenance {
+		return nil
+	}
 
-		if glog.V(8) {
-			glog.V(8).Info("  saving X-Provenance ", sb.String())
-		}
+	actions, targets, err := b.writtenEntries(entries, methods, urls)
+	if err != nil {
+		return internalError(err)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
 
-		// load resource with target
-		provenanceResource, err := models2.NewResourceFromJsonBytes(sb.Bytes())
-		if err != nil {
-			err = errors.Wrap(err, "error loading X-Provenance header")
+	var provenances []*models2.Resource
+	if provenanceHeader != "" {
+		provenance, err := headerProvenance(provenanceHeader, targets)
+		if _, isInvalid := err.(ErrInvalidProvenance); isInvalid {
 			return badValue(err)
+		} else if err != nil {
+			return internalError(err)
+		}
+		provenances = append(provenances, provenance)
+	} else {
+		for i, target := range targets {
+			provenance, err := autoProvenance(c, &b.Config, actions[i], []models.Reference{target})
+			if err != nil {
+				return internalError(err)
+			}
+			provenances = append(provenances, provenance)
 		}
+	}
 
-		// save
-		newId := bson.NewObjectId().Hex()
-		err = session.PostWithID(newId, provenanceResource)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to create provenanceResource")
+	for _, provenance := range provenances {
+		if err := storeProvenance(c, session, provenance); err != nil {
 			return internalError(err)
 		}
-
-		c.Header("X-GoFHIR-Provenance-Location", "Provenance/"+newId)
 	}
 	return nil
 }
@@ -965,6 +1068,13 @@ func sortBundleEntries(bundle *models2.ShallowBundle) ([]*models2.ShallowBundleE
 			if !strings.Contains(bundle.Entry[i].Request.Url, "/") && !strings.Contains(bundle.Entry[i].Request.Url, "?") {
 				return nil, brokenInvariant(errors.New("Batch PUT URL must have an id or a condition"))
 			}
+		case "PATCH":
+			if bundle.Entry[i].Resource == nil {
+				return nil, brokenInvariant(errors.New("Batch PATCH must have a Binary or Parameters resource body"))
+			}
+			if !strings.Contains(bundle.Entry[i].Request.Url, "/") && !strings.Contains(bundle.Entry[i].Request.Url, "?") {
+				return nil, brokenInvariant(errors.New("Batch PATCH URL must have an id or a condition"))
+			}
 		case "GET":
 			if bundle.Entry[i].Request.Url == "" {
 				return nil, brokenInvariant(errors.New("Batch GET must have a URL"))
@@ -989,6 +1099,6 @@ func (e byRequestMethod) Swap(i, j int) {
 	e[i], e[j] = e[j], e[i]
 }
 func (e byRequestMethod) Less(i, j int) bool {
-	methodMap := map[string]int{"DELETE": 0, "POST": 1, "PUT": 2, "GET": 3}
+	methodMap := map[string]int{"DELETE": 0, "POST": 1, "PUT": 2, "PATCH": 2, "GET": 3}
 	return methodMap[e[i].Request.Method] < methodMap[e[j].Request.Method]
 }
@@ -43,12 +43,24 @@ func FHIRBind(c *gin.Context, validatorURL string) (resource *models2.Resource,
 	// validate
 	if validatorURL != "" {
 		if c.Request.Body != nil {
-			bodyBuffer := bytes.NewBuffer(bodyBytes)
-			resp, err := validatorHttpClient.Post(validatorURL, contentType, ioutil.NopCloser(bodyBuffer))
+			req, err := http.NewRequest("POST", validatorURL, bytes.NewReader(bodyBytes))
+			if err != nil {
+				return nil, errors.Wrapf(err, "FHIRBind: invalid validator URL (%s)", validatorURL)
+			}
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Accept", "application/fhir+json")
+			resp, err := validatorHttpClient.Do(req)
 			if err != nil {
 				return nil, errors.Wrapf(err, "FHIRBind: error calling validator (%s)", validatorURL)
 			}
-			resp.Location()
+			respBody, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "FHIRBind: error reading validator response (%s)", validatorURL)
+			}
+			if err = validatorResponseFailure(resp.StatusCode, respBody); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BulkExportController implements the Bulk Data $export operation
+// (https://hl7.org/fhir/uv/bulkdata/export/index.html). Each export runs in the
+// background and writes an NDJSON file for every resource type into its own
+// sub-directory of Config.BulkExportDirectory. Clients poll the status URL
+// returned in Content-Location and then download the files from the server.
+//
+// Jobs are only kept in memory so are forgotten when the server restarts.
+type BulkExportController struct {
+	DAL    DataAccessLayer
+	Config Config
+
+	lock sync.Mutex
+	jobs map[string]*exportJob
+}
+
+type exportJob struct {
+	id              string
+	db              string
+	request         string
+	statusURL       string
+	transactionTime time.Time
+	resourceTypes   []string
+	since           time.Time
+	// whether only resources in patient compartments are exported and, if patientIDs isn't nil,
+	// only those in the compartments of these patients (i.e. the members of a group)
+	patientCompartments bool
+	patientIDs          map[string]bool
+	cancel              context.CancelFunc
+
+	// protected by the controller's lock
+	done      bool
+	cancelled bool
+	progress  string
+	output    []exportOutput
+	err       error
+}
+
+type exportOutput struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// the response to a status request of a completed export
+type exportManifest struct {
+	TransactionTime     string         `json:"transactionTime"`
+	Request             string         `json:"request"`
+	RequiresAccessToken bool           `json:"requiresAccessToken"`
+	Output              []exportOutput `json:"output"`
+	Error               []exportOutput `json:"error"`
+}
+
+// NewBulkExportController creates a new BulkExportController based on the passed in DAL
+func NewBulkExportController(dal DataAccessLayer, config Config) *BulkExportController {
+	return &BulkExportController{
+		DAL:    dal,
+		Config: config,
+		jobs:   make(map[string]*exportJob),
+	}
+}
+
+// SystemExportHandler handles requests to export all resources (GET /$export)
+func (ec *BulkExportController) SystemExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+	ec.kickOff(c, &exportJob{})
+}
+
+// PatientExportHandler handles requests to export the resources in all patient compartments (GET /Patient/$export)
+func (ec *BulkExportController) PatientExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+	ec.kickOff(c, &exportJob{patientCompartments: true})
+}
+
+// GroupExportHandler handles requests to export the resources in the compartments of a group's
+// member patients (GET /Group/:id/$export)
+func (ec *BulkExportController) GroupExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	session := ec.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	group, err := session.Get(c.Param("id"), "Group")
+	session.Finish()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to get group"))
+	}
+	doc, err := group.GetBSON()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to convert group"))
+	}
+
+	// members are in the group's Patient compartment
+	job := &exportJob{patientCompartments: true, patientIDs: make(map[string]bool)}
+	for _, patientID := range search.PatientCompartmentMembers("Group", group.Id(), doc.([]bson.E)) {
+		job.patientIDs[patientID] = true
+	}
+	ec.kickOff(c, job)
+}
+
+// kickOff validates an export request and starts the job in the background
+func (ec *BulkExportController) kickOff(c *gin.Context, job *exportJob) {
+	if !requestPreferences(c).RespondAsync {
+		badExportRequest(c, "$export requires the Prefer: respond-async header")
+		return
+	}
+
+	switch c.Query("_outputFormat") {
+	case "", "ndjson", "application/ndjson", "application/fhir+ndjson":
+	default:
+		badExportRequest(c, "unsupported _outputFormat (only application/fhir+ndjson is supported)")
+		return
+	}
+
+	if since := c.Query("_since"); since != "" {
+		var err error
+		job.since, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			badExportRequest(c, "_since must be a FHIR instant: "+since)
+			return
+		}
+	}
+
+	if types := c.Query("_type"); types != "" {
+		for _, resourceType := range strings.Split(types, ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if _, known := search.SearchParameterDictionary[resourceType]; !known {
+				badExportRequest(c, "unknown resource type in _type: "+resourceType)
+				return
+			}
+			job.resourceTypes = append(job.resourceTypes, resourceType)
+		}
+	} else if job.patientCompartments {
+		for resourceType := range search.PatientCompartment {
+			job.resourceTypes = append(job.resourceTypes, resourceType)
+		}
+		sort.Strings(job.resourceTypes)
+	} else {
+		for resourceType := range search.SearchParameterDictionary {
+			job.resourceTypes = append(job.resourceTypes, resourceType)
+		}
+		sort.Strings(job.resourceTypes)
+	}
+
+	job.request = kickOffRequestURL(c, ec.Config)
+	job.id = primitive.NewObjectID().Hex()
+	job.db = c.GetHeader("Db")
+	job.transactionTime = time.Now().UTC()
+	job.progress = "queued"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+
+	ec.lock.Lock()
+	ec.jobs[job.id] = job
+	ec.lock.Unlock()
+
+	job.statusURL = ec.Config.responseURL(c.Request, "_export", job.id).String()
+
+	glog.Infof("starting $export %s (%s)", job.id, job.request)
+	go ec.run(ctx, job)
+
+	c.Header("Content-Location", job.statusURL)
+	c.Status(http.StatusAccepted)
+}
+
+// kickOffRequestURL returns the URL of a request that started a bulk data operation
+func kickOffRequestURL(c *gin.Context, config Config) string {
+	requestURL := config.responseURL(c.Request, strings.TrimPrefix(c.Request.URL.Path, "/"))
+	requestURL.RawQuery = c.Request.URL.RawQuery
+	return requestURL.String()
+}
+
+func badExportRequest(c *gin.Context, message string) {
+	outcome := models.NewOperationOutcome("fatal", "invalid", message)
+	c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+}
+
+// run exports the job's resources one type at a time
+func (ec *BulkExportController) run(ctx context.Context, job *exportJob) {
+	dir := filepath.Join(ec.Config.BulkExportDirectory, job.id)
+	err := os.MkdirAll(dir, 0700)
+
+	session := ec.DAL.StartSession(ctx, job.db)
+	defer session.Finish()
+
+	for i, resourceType := range job.resourceTypes {
+		if err != nil {
+			break
+		}
+		ec.lock.Lock()
+		job.progress = fmt.Sprintf("exporting %s (%d of %d resource types)", resourceType, i+1, len(job.resourceTypes))
+		ec.lock.Unlock()
+
+		var count int
+		fileName := resourceType + ".ndjson"
+		count, err = ec.exportResourceType(ctx, session, job, resourceType, filepath.Join(dir, fileName))
+		if err == nil && count > 0 {
+			ec.lock.Lock()
+			job.output = append(job.output, exportOutput{Type: resourceType, URL: job.statusURL + "/" + fileName, Count: count})
+			ec.lock.Unlock()
+		}
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	job.done = true
+	job.cancel()
+	if job.cancelled {
+		glog.Infof("$export %s cancelled", job.id)
+		os.RemoveAll(dir)
+	} else if err != nil {
+		glog.Errorf("$export %s failed: %+v", job.id, err)
+		job.err = err
+	} else {
+		glog.Infof("$export %s complete", job.id)
+	}
+}
+
+// exportResourceType writes the resources of a type to an NDJSON file, which is removed if there are none
+func (ec *BulkExportController) exportResourceType(ctx context.Context, session DataAccessSession, job *exportJob, resourceType string, path string) (count int, err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create export file")
+	}
+	writer := bufio.NewWriter(file)
+
+	err = session.Export(resourceType, job.since, func(resource *models2.Resource) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if job.patientCompartments {
+			doc, err := resource.GetBSON()
+			if err != nil {
+				return errors.Wrapf(err, "failed to convert %s/%s", resourceType, resource.Id())
+			}
+			if !job.inPatientCompartments(search.PatientCompartmentMembers(resourceType, resource.Id(), doc.([]bson.E))) {
+				return nil
+			}
+		}
+
+		count++
+		writer.Write(resource.JsonBytes())
+		return writer.WriteByte('\n')
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || count == 0 {
+		os.Remove(path)
+	}
+	return count, errors.Wrapf(err, "failed to export %s", resourceType)
+}
+
+func (job *exportJob) inPatientCompartments(patientIDs []string) bool {
+	if job.patientIDs == nil {
+		return len(patientIDs) > 0
+	}
+	for _, patientID := range patientIDs {
+		if job.patientIDs[patientID] {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJob finds the job of a status or download request, which has to be for the same database
+func (ec *BulkExportController) lookupJob(c *gin.Context) *exportJob {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	job := ec.jobs[c.Param("job")]
+	if job == nil || job.db != c.GetHeader("Db") {
+		return nil
+	}
+	return job
+}
+
+// StatusHandler handles requests for the status of an export (GET /_export/:job)
+func (ec *BulkExportController) StatusHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ec.lookupJob(c)
+	if job == nil {
+		panic(ErrNotFound)
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if !job.done {
+		c.Header("X-Progress", job.progress)
+		c.Header("Retry-After", "5")
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if job.err != nil {
+		outcome := models.NewOperationOutcome("fatal", "exception", job.err.Error())
+		c.Render(http.StatusInternalServerError, CustomFhirRenderer{outcome, c})
+		return
+	}
+
+	manifest := exportManifest{
+		TransactionTime:     job.transactionTime.Format(time.RFC3339Nano),
+		Request:             job.request,
+		RequiresAccessToken: ec.Config.Auth.Method != auth.AuthTypeNone,
+		Output:              job.output,
+		Error:               []exportOutput{},
+	}
+	if manifest.Output == nil {
+		manifest.Output = []exportOutput{}
+	}
+	c.JSON(http.StatusOK, manifest)
+}
+
+// DeleteHandler handles requests to cancel an export or to delete its files (DELETE /_export/:job)
+func (ec *BulkExportController) DeleteHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ec.lookupJob(c)
+	if job == nil {
+		panic(ErrNotFound)
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	delete(ec.jobs, job.id)
+	if job.done {
+		os.RemoveAll(filepath.Join(ec.Config.BulkExportDirectory, job.id))
+	} else {
+		// the files are removed once the job stops
+		job.cancelled = true
+		job.cancel()
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// FileHandler handles requests to download an exported file (GET /_export/:job/:file)
+func (ec *BulkExportController) FileHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ec.lookupJob(c)
+	if job == nil {
+		panic(ErrNotFound)
+	}
+
+	// the output list is only complete (and returned by StatusHandler) once the job is done
+	ec.lock.Lock()
+	found := false
+	for _, output := range job.output {
+		if job.done && output.Type+".ndjson" == c.Param("file") {
+			found = true
+		}
+	}
+	ec.lock.Unlock()
+	if !found {
+		panic(ErrNotFound)
+	}
+
+	c.Header("Content-Type", "application/fhir+ndjson")
+	c.File(filepath.Join(ec.Config.BulkExportDirectory, job.id, c.Param("file")))
+}
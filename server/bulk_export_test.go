@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BulkExportSuite struct {
+	server *FHIRServer
+	dir    string
+}
+
+var _ = Suite(&BulkExportSuite{})
+
+func (s *BulkExportSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.server = newMemoryTestServer(func(config *Config) {
+		config.BulkExportDirectory = s.dir
+	})
+
+	for _, resource := range []string{
+		`{"resourceType": "Patient", "id": "p1"}`,
+		`{"resourceType": "Patient", "id": "p2"}`,
+		`{"resourceType": "Patient", "id": "p3"}`,
+		`{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "b"}, "subject": {"reference": "Patient/p2"}}`,
+		`{"resourceType": "Observation", "id": "o3", "status": "final", "code": {"text": "c"}}`,
+		`{"resourceType": "Organization", "id": "org1"}`,
+		`{"resourceType": "Group", "id": "g1", "type": "person", "actual": true, "member": [{"entity": {"reference": "Patient/p1"}}]}`,
+	} {
+		var parsed struct{ ResourceType, Id string }
+		c.Assert(json.Unmarshal([]byte(resource), &parsed), IsNil)
+		w := serve(s.server, "PUT", "/"+parsed.ResourceType+"/"+parsed.Id, resource)
+		c.Assert(w.Code, Equals, http.StatusCreated)
+	}
+}
+
+// export kicks off an export and polls its status until it is complete
+func (s *BulkExportSuite) export(c *C, path string) (statusPath string, manifest exportManifest) {
+	w := serve(s.server, "GET", path, "", "Prefer", "respond-async", "Accept", "application/fhir+json")
+	c.Assert(w.Code, Equals, http.StatusAccepted, Commentf("%s", w.Body.String()))
+	statusURL, err := url.Parse(w.Header().Get("Content-Location"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(statusURL.Path, "/_export/"), Equals, true)
+
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		w = serve(s.server, "GET", statusURL.Path, "")
+		if w.Code == http.StatusOK {
+			c.Assert(json.Unmarshal(w.Body.Bytes(), &manifest), IsNil)
+			return statusURL.Path, manifest
+		}
+		c.Assert(w.Code, Equals, http.StatusAccepted)
+		c.Assert(w.Header().Get("X-Progress"), Not(Equals), "")
+	}
+	c.Fatal("export did not complete")
+	return
+}
+
+// download returns the ids in an exported file
+func (s *BulkExportSuite) download(c *C, fileURL string) []string {
+	parsed, err := url.Parse(fileURL)
+	c.Assert(err, IsNil)
+	w := serve(s.server, "GET", parsed.Path, "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/fhir+ndjson")
+
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		var resource struct{ Id string }
+		c.Assert(json.Unmarshal([]byte(line), &resource), IsNil, Commentf("%s", line))
+		ids = append(ids, resource.Id)
+	}
+	return ids
+}
+
+func outputCounts(manifest exportManifest) map[string]int {
+	counts := make(map[string]int)
+	for _, output := range manifest.Output {
+		counts[output.Type] = output.Count
+	}
+	return counts
+}
+
+func (s *BulkExportSuite) TestKickOffValidation(c *C) {
+	w := serve(s.server, "GET", "/$export", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(strings.Contains(w.Body.String(), "respond-async"), Equals, true)
+
+	for _, path := range []string{
+		"/$export?_outputFormat=application/fhir+json",
+		"/$export?_type=Patient,Unknown",
+		"/$export?_since=yesterday",
+		"/Patient/$export?_since=2019-01-01",
+	} {
+		w = serve(s.server, "GET", path, "", "Prefer", "respond-async")
+		c.Assert(w.Code, Equals, http.StatusBadRequest, Commentf(path))
+	}
+
+	w = serve(s.server, "GET", "/Group/unknown/$export", "", "Prefer", "respond-async")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	w = serve(s.server, "GET", "/_export/unknown", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// reads still work
+	w = serve(s.server, "GET", "/Patient/p1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+}
+
+func (s *BulkExportSuite) TestSystemExport(c *C) {
+	_, manifest := s.export(c, "/$export?_outputFormat=application/fhir%2Bndjson")
+	c.Assert(manifest.Request, Equals, "http://example.com/$export?_outputFormat=application/fhir%2Bndjson")
+	c.Assert(manifest.RequiresAccessToken, Equals, false)
+	c.Assert(manifest.Error, HasLen, 0)
+	c.Assert(outputCounts(manifest), DeepEquals, map[string]int{"Group": 1, "Observation": 3, "Organization": 1, "Patient": 3})
+	_, err := time.Parse(time.RFC3339Nano, manifest.TransactionTime)
+	c.Assert(err, IsNil)
+
+	for _, output := range manifest.Output {
+		if output.Type == "Observation" {
+			c.Assert(s.download(c, output.URL), DeepEquals, []string{"o1", "o2", "o3"})
+		}
+	}
+
+	_, manifest = s.export(c, "/$export?_type=Patient,Organization")
+	c.Assert(outputCounts(manifest), DeepEquals, map[string]int{"Organization": 1, "Patient": 3})
+
+	_, manifest = s.export(c, "/$export?_since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	c.Assert(manifest.Output, HasLen, 0)
+}
+
+func (s *BulkExportSuite) TestPatientAndGroupExport(c *C) {
+	_, manifest := s.export(c, "/Patient/$export")
+	c.Assert(outputCounts(manifest), DeepEquals, map[string]int{"Group": 1, "Observation": 2, "Patient": 3})
+
+	_, manifest = s.export(c, "/Group/g1/$export?_type=Patient,Observation")
+	c.Assert(outputCounts(manifest), DeepEquals, map[string]int{"Observation": 1, "Patient": 1})
+	for _, output := range manifest.Output {
+		switch output.Type {
+		case "Patient":
+			c.Assert(s.download(c, output.URL), DeepEquals, []string{"p1"})
+		case "Observation":
+			c.Assert(s.download(c, output.URL), DeepEquals, []string{"o1"})
+		}
+	}
+}
+
+func (s *BulkExportSuite) TestDeleteExport(c *C) {
+	statusPath, manifest := s.export(c, "/$export?_type=Patient")
+	c.Assert(manifest.Output, HasLen, 1)
+	jobDir := filepath.Join(s.dir, strings.TrimPrefix(statusPath, "/_export/"))
+	_, err := os.Stat(filepath.Join(jobDir, "Patient.ndjson"))
+	c.Assert(err, IsNil)
+
+	// only files listed in the manifest can be downloaded
+	w := serve(s.server, "GET", statusPath+"/Observation.ndjson", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	w = serve(s.server, "GET", statusPath+"/..%2F..%2Fetc%2Fpasswd", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	w = serve(s.server, "DELETE", statusPath, "")
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	w = serve(s.server, "GET", statusPath, "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	files, _ := ioutil.ReadDir(s.dir)
+	c.Assert(files, HasLen, 0)
+}
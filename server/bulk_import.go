@@ -0,0 +1,765 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ImportInput is an NDJSON file of resources of one type to import, either a local file or an http(s) URL
+type ImportInput struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// files in an import's work directory
+const (
+	importStateFile  = "import-state.json"
+	importErrorsFile = "errors.ndjson"
+	importJobFile    = "job.json"
+)
+
+// bulkImport stores the resources in NDJSON inputs with their ids (so previous versions are
+// kept in the history), using up to concurrency sessions at a time. The lines of a resource
+// are stored in the order of the input. The lines that fail are reported as OperationOutcomes
+// in an NDJSON file in workDir. The import's progress is saved there every second so that
+// running it again with the same workDir resumes it.
+type bulkImport struct {
+	dal         DataAccessLayer
+	db          string
+	workDir     string
+	concurrency int
+	inputs      []ImportInput
+
+	lock       sync.Mutex
+	state      importState
+	errorsFile *os.File
+	lastSaved  time.Time
+	// the first error writing the errors file or saving the state
+	writeErr error
+}
+
+type importState struct {
+	// by input URL: the number of lines that have been processed, which are the first
+	// lines of the input (later lines that have been processed aren't counted until
+	// the ones before them have been, so that no lines are skipped when resuming)
+	Lines    map[string]int `json:"lines"`
+	Imported map[string]int `json:"imported"`
+	Failed   map[string]int `json:"failed"`
+	// by input URL: the last line that may have been started. When resuming, the lines after
+	// the processed ones up to this one aren't stored again if the stored resource is the same
+	Started map[string]int `json:"started"`
+	// the size of the errors file, which is truncated to it when resuming so that the failed
+	// lines that are processed again aren't reported twice
+	ErrorsSize int64 `json:"errorsSize"`
+	// the inputs that have been imported completely, which are skipped if the import is run again
+	Complete map[string]bool `json:"complete"`
+}
+
+// importStartedLines is how many lines are started between the saves of importState.Started
+const importStartedLines = 1000
+
+func newBulkImport(dal DataAccessLayer, db string, workDir string, concurrency int, inputs []ImportInput) *bulkImport {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &bulkImport{
+		dal:         dal,
+		db:          db,
+		workDir:     workDir,
+		concurrency: concurrency,
+		inputs:      inputs,
+		state: importState{
+			Lines:    make(map[string]int),
+			Imported: make(map[string]int),
+			Failed:   make(map[string]int),
+			Started:  make(map[string]int),
+			Complete: make(map[string]bool),
+		},
+	}
+}
+
+// loadState loads the progress saved by a previous run, if there is any
+func (imp *bulkImport) loadState() error {
+	data, err := ioutil.ReadFile(filepath.Join(imp.workDir, importStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read import state")
+	}
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+	if err = json.Unmarshal(data, &imp.state); err != nil {
+		return errors.Wrap(err, "failed to parse import state")
+	}
+	if imp.state.Started == nil {
+		// saved before lines were marked as started
+		imp.state.Started = make(map[string]int)
+	}
+	return nil
+}
+
+// saveState writes the progress to a temporary file that then replaces the previous one,
+// so a crash doesn't leave a partially written state. The lock must be held.
+func (imp *bulkImport) saveState() error {
+	if imp.errorsFile != nil {
+		// the failed lines that have been counted must have been written
+		if err := imp.errorsFile.Sync(); err != nil {
+			return errors.Wrap(err, "failed to sync import errors")
+		}
+		info, err := imp.errorsFile.Stat()
+		if err != nil {
+			return errors.Wrap(err, "failed to get the size of import errors")
+		}
+		imp.state.ErrorsSize = info.Size()
+	}
+	data, err := json.Marshal(imp.state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal import state")
+	}
+	path := filepath.Join(imp.workDir, importStateFile)
+	if err = ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write import state")
+	}
+	imp.lastSaved = time.Now()
+	return errors.Wrap(os.Rename(path+".tmp", path), "failed to replace import state")
+}
+
+// progress returns the numbers of lines imported and failed so far
+func (imp *bulkImport) progress() (imported int, failed int) {
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+	for _, count := range imp.state.Imported {
+		imported += count
+	}
+	for _, count := range imp.state.Failed {
+		failed += count
+	}
+	return imported, failed
+}
+
+func (imp *bulkImport) run(ctx context.Context) (err error) {
+	if err = os.MkdirAll(imp.workDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create import directory")
+	}
+	if err = imp.loadState(); err != nil {
+		return err
+	}
+
+	imp.errorsFile, err = os.OpenFile(filepath.Join(imp.workDir, importErrorsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open import errors file")
+	}
+	defer imp.errorsFile.Close()
+	// lines that failed after the state was saved are reported again
+	info, err := imp.errorsFile.Stat()
+	if err == nil && info.Size() > imp.state.ErrorsSize {
+		err = imp.errorsFile.Truncate(imp.state.ErrorsSize)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to truncate import errors file")
+	}
+
+	for _, input := range imp.inputs {
+		imp.lock.Lock()
+		complete := imp.state.Complete[input.URL]
+		imp.lock.Unlock()
+		if complete {
+			glog.Infof("skipping %s as it has already been imported", input.URL)
+			continue
+		}
+
+		err = imp.importInput(ctx, input)
+
+		imp.lock.Lock()
+		imp.state.Complete[input.URL] = err == nil
+		saveErr := imp.saveState()
+		imp.lock.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "failed to import %s", input.URL)
+		} else if saveErr != nil {
+			return saveErr
+		}
+	}
+	return nil
+}
+
+type importLine struct {
+	number  int
+	outcome *models.OperationOutcome
+	blank   bool
+}
+
+func (imp *bulkImport) importInput(ctx context.Context, input ImportInput) error {
+	reader, err := openImportInput(ctx, input.URL)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	imp.lock.Lock()
+	skip := imp.state.Lines[input.URL]
+	resumed := imp.state.Started[input.URL]
+	imp.lock.Unlock()
+
+	type line struct {
+		number int
+		data   []byte
+	}
+	processed := make(map[int]importLine)
+
+	// the lines with the same id go to the same worker so that the versions of a resource are stored in order
+	workers := make([]chan line, imp.concurrency)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan line)
+		wg.Add(1)
+		go func(lines chan line) {
+			defer wg.Done()
+			session := imp.dal.StartSession(ctx, imp.db)
+			defer session.Finish()
+			for l := range lines {
+				if ctx.Err() != nil {
+					// cancelled so not processed
+					continue
+				}
+				outcome := importResource(session, input.Type, l.data, l.number <= resumed)
+				imp.lineProcessed(input, processed, importLine{number: l.number, outcome: outcome})
+			}
+		}(workers[i])
+	}
+
+	// lines can be longer than a bufio.Scanner allows
+	buffered := bufio.NewReader(reader)
+	number := 0
+	for ctx.Err() == nil {
+		data, readErr := buffered.ReadBytes('\n')
+		if len(data) > 0 {
+			number++
+			if number <= skip {
+				// processed before resuming
+			} else if len(bytes.TrimSpace(data)) == 0 {
+				imp.lineProcessed(input, processed, importLine{number: number, blank: true})
+			} else {
+				imp.lineStarted(input, number)
+				id, _ := jsonparser.GetString(data, "id")
+				hash := fnv.New32a()
+				hash.Write([]byte(id))
+				workers[hash.Sum32()%uint32(len(workers))] <- line{number, data}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			err = errors.Wrap(readErr, "failed to read input")
+			break
+		}
+	}
+	for _, lines := range workers {
+		close(lines)
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	imp.lock.Lock()
+	err = imp.writeErr
+	imp.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// lineStarted records that a line is about to be stored. Before the lines after the ones that
+// may have been started, the state is saved with the next importStartedLines lines as started.
+func (imp *bulkImport) lineStarted(input ImportInput, number int) {
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+	if number <= imp.state.Started[input.URL] {
+		return
+	}
+	imp.state.Started[input.URL] = number + importStartedLines - 1
+	if err := imp.saveState(); err != nil && imp.writeErr == nil {
+		imp.writeErr = err
+	}
+}
+
+// lineProcessed records that a line has been processed. The lines that now follow the lines
+// processed before are counted (and written to the errors file if they failed).
+func (imp *bulkImport) lineProcessed(input ImportInput, processed map[int]importLine, l importLine) {
+	imp.lock.Lock()
+	defer imp.lock.Unlock()
+
+	processed[l.number] = l
+	for {
+		next, found := processed[imp.state.Lines[input.URL]+1]
+		if !found {
+			break
+		}
+		delete(processed, next.number)
+		imp.state.Lines[input.URL] = next.number
+
+		if next.outcome != nil {
+			for i := range next.outcome.Issue {
+				next.outcome.Issue[i].Diagnostics = fmt.Sprintf("%s line %d: %s", input.URL, next.number, next.outcome.Issue[i].Diagnostics)
+			}
+			data, err := json.Marshal(next.outcome)
+			if err == nil {
+				_, err = imp.errorsFile.Write(append(data, '\n'))
+			}
+			if err != nil && imp.writeErr == nil {
+				imp.writeErr = errors.Wrap(err, "failed to write import error")
+			}
+			imp.state.Failed[input.URL]++
+		} else if !next.blank {
+			imp.state.Imported[input.URL]++
+		}
+	}
+
+	if time.Since(imp.lastSaved) > time.Second {
+		if err := imp.saveState(); err != nil && imp.writeErr == nil {
+			imp.writeErr = err
+		}
+	}
+}
+
+// importResource stores the resource in an NDJSON line, returning an OperationOutcome if this fails.
+// Lines that may have been stored before an import was resumed aren't stored again if the stored
+// resource is the same (though a resource with several versions in them is).
+func importResource(session DataAccessSession, resourceType string, data []byte, resumed bool) (outcome *models.OperationOutcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcome = importErrorOutcome(r)
+		}
+	}()
+
+	if !json.Valid(data) {
+		return models.NewOperationOutcome("error", "structure", "invalid JSON")
+	}
+	resource, err := models2.NewResourceFromJsonBytes(data)
+	if err != nil {
+		return models.NewOperationOutcome("error", "structure", "invalid JSON: "+err.Error())
+	}
+	if resource.ResourceType() != resourceType {
+		return models.NewOperationOutcome("error", "invalid", fmt.Sprintf("expected a %s but found a %s", resourceType, resource.ResourceType()))
+	}
+	if resource.Id() == "" {
+		// resources without ids would be duplicated when an import is resumed
+		return models.NewOperationOutcome("error", "required", "resources must have an id")
+	}
+	if resumed {
+		stored, err := session.Get(resource.Id(), resourceType)
+		if err == nil && sameContent(stored.JsonBytes(), data) {
+			return nil
+		}
+	}
+
+	if _, err = session.Put(resource.Id(), "", resource); err != nil {
+		return importErrorOutcome(err)
+	}
+	return nil
+}
+
+// sameContent returns whether two versions of a resource in JSON are the same apart from their
+// meta.versionId and meta.lastUpdated
+func sameContent(a []byte, b []byte) bool {
+	var objects [2]map[string]interface{}
+	for i, data := range [][]byte{a, b} {
+		if err := decodeJSONWithNumbers(data, &objects[i]); err != nil {
+			return false
+		}
+		if meta, isObject := objects[i]["meta"].(map[string]interface{}); isObject {
+			delete(meta, "versionId")
+			delete(meta, "lastUpdated")
+			if len(meta) == 0 {
+				delete(objects[i], "meta")
+			}
+		}
+	}
+	return reflect.DeepEqual(objects[0], objects[1])
+}
+
+func importErrorOutcome(err interface{}) *models.OperationOutcome {
+	statusCode, outcome := ErrorToOpOutcome(err)
+	if statusCode >= http.StatusInternalServerError {
+		// without the stack trace
+		return models.NewOperationOutcome("error", "exception", fmt.Sprint(err))
+	}
+	return outcome
+}
+
+func openImportInput(ctx context.Context, url string) (io.ReadCloser, error) {
+	if !isHTTPURL(url) {
+		file, err := os.Open(url)
+		return file, errors.Wrap(err, "failed to open input")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid input URL")
+	}
+	req.Header.Set("Accept", "application/fhir+ndjson")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download input")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("failed to download input: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func isHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// ImportInputsFromPaths lists the NDJSON files to import given a list of files and directories.
+// The resource type of a file is the start of its name (e.g. Patient.ndjson or Patient.2.ndjson,
+// as written by $export) or can be given before an equals sign (e.g. Patient=patients.txt).
+// Directories are replaced by the .ndjson files in them.
+func ImportInputsFromPaths(paths []string) ([]ImportInput, error) {
+	var inputs []ImportInput
+	for _, path := range paths {
+		resourceType := ""
+		if equals := strings.Index(path, "="); equals > 0 {
+			resourceType = path[:equals]
+			path = path[equals+1:]
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid input")
+		}
+		files := []string{path}
+		if info.IsDir() {
+			files, err = filepath.Glob(filepath.Join(path, "*.ndjson"))
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to list input directory")
+			}
+		}
+
+		for _, file := range files {
+			fileType := resourceType
+			if fileType == "" {
+				fileType = strings.SplitN(filepath.Base(file), ".", 2)[0]
+			}
+			if _, known := search.SearchParameterDictionary[fileType]; !known {
+				return nil, errors.Errorf("unknown resource type %s for %s", fileType, file)
+			}
+			absolute, err := filepath.Abs(file)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid input")
+			}
+			inputs = append(inputs, ImportInput{Type: fileType, URL: absolute})
+		}
+	}
+	return inputs, nil
+}
+
+// BulkImportController implements a Bulk Data $import operation that accepts a Parameters
+// resource listing NDJSON files by type and http(s) URL (like the output of $export):
+//
+//	{"resourceType": "Parameters", "parameter": [
+//	  {"name": "inputFormat", "valueCode": "application/fhir+ndjson"},
+//	  {"name": "input", "part": [
+//	    {"name": "type", "valueCode": "Patient"},
+//	    {"name": "url", "valueUri": "https://example.org/Patient.ndjson"}]}]}
+//
+// Each import runs in the background, keeping its state in a sub-directory of
+// Config.BulkImportDirectory so that imports interrupted by a restart are resumed.
+// Clients poll the status URL returned in Content-Location.
+type BulkImportController struct {
+	DAL    DataAccessLayer
+	Config Config
+
+	lock sync.Mutex
+	jobs map[string]*importJob
+}
+
+type importJob struct {
+	ID              string        `json:"id"`
+	Db              string        `json:"db"`
+	Request         string        `json:"request"`
+	StatusURL       string        `json:"statusURL"`
+	TransactionTime time.Time     `json:"transactionTime"`
+	Inputs          []ImportInput `json:"inputs"`
+
+	imp    *bulkImport
+	cancel context.CancelFunc
+
+	// protected by the controller's lock
+	done bool
+	err  error
+}
+
+// the response to a status request of a completed import
+type importManifest struct {
+	TransactionTime     string         `json:"transactionTime"`
+	Request             string         `json:"request"`
+	RequiresAccessToken bool           `json:"requiresAccessToken"`
+	Output              []importOutput `json:"output"`
+	Error               []importOutput `json:"error"`
+}
+
+type importOutput struct {
+	Type     string `json:"type"`
+	InputURL string `json:"inputUrl,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Count    int    `json:"count"`
+}
+
+// NewBulkImportController creates a new BulkImportController based on the passed in DAL
+// and resumes the imports that were interrupted
+func NewBulkImportController(dal DataAccessLayer, config Config) *BulkImportController {
+	ic := &BulkImportController{
+		DAL:    dal,
+		Config: config,
+		jobs:   make(map[string]*importJob),
+	}
+
+	jobFiles, _ := filepath.Glob(filepath.Join(config.BulkImportDirectory, "*", importJobFile))
+	for _, jobFile := range jobFiles {
+		var job importJob
+		data, err := ioutil.ReadFile(jobFile)
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err != nil {
+			glog.Errorf("failed to load $import job %s: %+v", jobFile, err)
+			continue
+		}
+		glog.Infof("resuming $import %s", job.ID)
+		ic.start(&job)
+	}
+	return ic
+}
+
+// ImportHandler handles requests to import NDJSON files (POST /$import)
+func (ic *BulkImportController) ImportHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	if !requestPreferences(c).RespondAsync {
+		badImportRequest(c, "$import requires the Prefer: respond-async header")
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to read request"))
+	}
+	var parameters models.Parameters
+	if err = json.Unmarshal(body, &parameters); err != nil || parameters.ResourceType != "Parameters" {
+		badImportRequest(c, "$import requires a Parameters resource")
+		return
+	}
+
+	job := &importJob{}
+	for _, parameter := range parameters.Parameter {
+		switch parameter.Name {
+		case "inputFormat":
+			switch parameter.ValueCode + parameter.ValueString {
+			case "ndjson", "application/ndjson", "application/fhir+ndjson":
+			default:
+				badImportRequest(c, "unsupported inputFormat (only application/fhir+ndjson is supported)")
+				return
+			}
+		case "input":
+			var input ImportInput
+			for _, part := range parameter.Part {
+				switch part.Name {
+				case "type":
+					input.Type = part.ValueCode + part.ValueString
+				case "url":
+					input.URL = part.ValueUri + part.ValueString
+				}
+			}
+			if _, known := search.SearchParameterDictionary[input.Type]; !known {
+				badImportRequest(c, "unknown resource type in input: "+input.Type)
+				return
+			}
+			// local files can only be imported with the command-line tool
+			if !isHTTPURL(input.URL) {
+				badImportRequest(c, "input urls must be http or https URLs: "+input.URL)
+				return
+			}
+			job.Inputs = append(job.Inputs, input)
+		}
+	}
+	if len(job.Inputs) == 0 {
+		badImportRequest(c, "$import requires at least one input")
+		return
+	}
+
+	job.ID = primitive.NewObjectID().Hex()
+	job.Db = c.GetHeader("Db")
+	job.Request = kickOffRequestURL(c, ic.Config)
+	job.StatusURL = ic.Config.responseURL(c.Request, "_import", job.ID).String()
+	job.TransactionTime = time.Now().UTC()
+
+	// saved so that the import is resumed after a restart
+	dir := filepath.Join(ic.Config.BulkImportDirectory, job.ID)
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, importJobFile), data, 0600)
+	}
+	if err != nil {
+		panic(errors.Wrap(err, "failed to save $import job"))
+	}
+
+	glog.Infof("starting $import %s", job.ID)
+	ic.start(job)
+
+	c.Header("Content-Location", job.StatusURL)
+	c.Status(http.StatusAccepted)
+}
+
+func badImportRequest(c *gin.Context, message string) {
+	outcome := models.NewOperationOutcome("fatal", "invalid", message)
+	c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+}
+
+// start runs a job in the background
+func (ic *BulkImportController) start(job *importJob) {
+	dir := filepath.Join(ic.Config.BulkImportDirectory, job.ID)
+	job.imp = newBulkImport(ic.DAL, job.Db, dir, ic.Config.BulkImportConcurrency, job.Inputs)
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+
+	ic.lock.Lock()
+	ic.jobs[job.ID] = job
+	ic.lock.Unlock()
+
+	go func() {
+		err := job.imp.run(ctx)
+		cancel()
+
+		ic.lock.Lock()
+		defer ic.lock.Unlock()
+		job.done = true
+		if ic.jobs[job.ID] != job {
+			glog.Infof("$import %s cancelled", job.ID)
+			os.RemoveAll(dir)
+		} else if err != nil {
+			glog.Errorf("$import %s failed: %+v", job.ID, err)
+			job.err = err
+		} else {
+			imported, failed := job.imp.progress()
+			glog.Infof("$import %s complete: %d imported, %d failed", job.ID, imported, failed)
+		}
+	}()
+}
+
+// lookupJob finds the job of a status or download request, which has to be for the same database
+func (ic *BulkImportController) lookupJob(c *gin.Context) *importJob {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	job := ic.jobs[c.Param("job")]
+	if job == nil || job.Db != c.GetHeader("Db") {
+		return nil
+	}
+	return job
+}
+
+// StatusHandler handles requests for the status of an import (GET /_import/:job)
+func (ic *BulkImportController) StatusHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ic.lookupJob(c)
+	if job == nil {
+		panic(ErrNotFound)
+	}
+
+	ic.lock.Lock()
+	done, err := job.done, job.err
+	ic.lock.Unlock()
+	imported, failed := job.imp.progress()
+	if !done {
+		c.Header("X-Progress", fmt.Sprintf("%d resources imported, %d failed", imported, failed))
+		c.Header("Retry-After", "5")
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		outcome := models.NewOperationOutcome("fatal", "exception", err.Error())
+		c.Render(http.StatusInternalServerError, CustomFhirRenderer{outcome, c})
+		return
+	}
+
+	manifest := importManifest{
+		TransactionTime:     job.TransactionTime.Format(time.RFC3339Nano),
+		Request:             job.Request,
+		RequiresAccessToken: ic.Config.Auth.Method != auth.AuthTypeNone,
+		Output:              []importOutput{},
+		Error:               []importOutput{},
+	}
+	job.imp.lock.Lock()
+	for _, input := range job.Inputs {
+		manifest.Output = append(manifest.Output, importOutput{Type: input.Type, InputURL: input.URL, Count: job.imp.state.Imported[input.URL]})
+	}
+	job.imp.lock.Unlock()
+	if failed > 0 {
+		manifest.Error = append(manifest.Error, importOutput{Type: "OperationOutcome", URL: job.StatusURL + "/" + importErrorsFile, Count: failed})
+	}
+	c.JSON(http.StatusOK, manifest)
+}
+
+// DeleteHandler handles requests to cancel an import or to delete its state (DELETE /_import/:job).
+// Resources that have already been imported are kept.
+func (ic *BulkImportController) DeleteHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ic.lookupJob(c)
+	if job == nil {
+		panic(ErrNotFound)
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	delete(ic.jobs, job.ID)
+	if job.done {
+		os.RemoveAll(filepath.Join(ic.Config.BulkImportDirectory, job.ID))
+	} else {
+		// the state is removed once the job stops
+		job.cancel()
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// ErrorsHandler handles requests to download the OperationOutcomes of the lines that
+// failed to be imported (GET /_import/:job/errors.ndjson)
+func (ic *BulkImportController) ErrorsHandler(c *gin.Context) {
+	defer handlePanics(c)
+	job := ic.lookupJob(c)
+	if job == nil || c.Param("file") != importErrorsFile {
+		panic(ErrNotFound)
+	}
+
+	c.Header("Content-Type", "application/fhir+ndjson")
+	c.File(filepath.Join(ic.Config.BulkImportDirectory, job.ID, importErrorsFile))
+}
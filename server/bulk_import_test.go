@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/eug48/fhir/models2"
+)
+
+type BulkImportSuite struct {
+	server *FHIRServer
+	dir    string
+	files  *httptest.Server
+}
+
+var _ = Suite(&BulkImportSuite{})
+
+const importPatients = `{"resourceType": "Patient", "id": "p1", "gender": "male"}
+{"resourceType": "Patient", "id": "p2", "gender": "female"}
+
+{"resourceType": "Patient", "id": "p3", "gender": "
+{"resourceType": "Patient", "gender": "other"}
+{"resourceType": "Observation", "id": "o9"}
+{"resourceType": "Patient", "id": "p4", "foo": "bar"}
+{"resourceType": "Patient", "id": "p1", "gender": "other"}
+`
+
+const importObservations = `{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/p1"}}
+{"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "b"}, "subject": {"reference": "Patient/p2"}}`
+
+func (s *BulkImportSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.server = newMemoryTestServer(func(config *Config) {
+		config.BulkImportDirectory = s.dir
+	})
+
+	s.files = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/Patient.ndjson":
+			w.Write([]byte(importPatients))
+		case "/Observation.ndjson":
+			w.Write([]byte(importObservations))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (s *BulkImportSuite) TearDownTest(c *C) {
+	s.files.Close()
+}
+
+func importParameters(inputs ...ImportInput) string {
+	var parts []string
+	for _, input := range inputs {
+		parts = append(parts, `{"name": "input", "part": [{"name": "type", "valueCode": `+jsonString(input.Type)+`}, {"name": "url", "valueUri": `+jsonString(input.URL)+`}]}`)
+	}
+	return `{"resourceType": "Parameters", "parameter": [{"name": "inputFormat", "valueCode": "application/fhir+ndjson"}, ` + strings.Join(parts, ", ") + `]}`
+}
+
+// waitForImport polls the status of an import until it is complete
+func (s *BulkImportSuite) waitForImport(c *C, statusPath string) (manifest importManifest) {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		w := serve(s.server, "GET", statusPath, "")
+		if w.Code == http.StatusOK {
+			c.Assert(json.Unmarshal(w.Body.Bytes(), &manifest), IsNil)
+			return manifest
+		}
+		c.Assert(w.Code, Equals, http.StatusAccepted, Commentf("%s", w.Body.String()))
+		c.Assert(w.Header().Get("X-Progress"), Not(Equals), "")
+	}
+	c.Fatal("import did not complete")
+	return
+}
+
+func (s *BulkImportSuite) TestKickOffValidation(c *C) {
+	valid := importParameters(ImportInput{"Patient", s.files.URL + "/Patient.ndjson"})
+	w := serve(s.server, "POST", "/$import", valid)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(strings.Contains(w.Body.String(), "respond-async"), Equals, true)
+
+	for _, body := range []string{
+		`{"resourceType": "Patient"}`,
+		`{"resourceType": "Parameters"}`,
+		importParameters(ImportInput{"Unknown", s.files.URL + "/Patient.ndjson"}),
+		importParameters(ImportInput{"Patient", "/etc/passwd"}),
+		importParameters(ImportInput{"Patient", "file:///etc/passwd"}),
+		strings.Replace(valid, "application/fhir+ndjson", "application/fhir+json", 1),
+	} {
+		w = serve(s.server, "POST", "/$import", body, "Prefer", "respond-async")
+		c.Assert(w.Code, Equals, http.StatusBadRequest, Commentf(body))
+	}
+
+	w = serve(s.server, "GET", "/_import/unknown", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *BulkImportSuite) TestImport(c *C) {
+	w := serve(s.server, "POST", "/$import", importParameters(
+		ImportInput{"Patient", s.files.URL + "/Patient.ndjson"},
+		ImportInput{"Observation", s.files.URL + "/Observation.ndjson"},
+	), "Prefer", "respond-async")
+	c.Assert(w.Code, Equals, http.StatusAccepted, Commentf("%s", w.Body.String()))
+	statusURL, err := url.Parse(w.Header().Get("Content-Location"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(statusURL.Path, "/_import/"), Equals, true)
+
+	manifest := s.waitForImport(c, statusURL.Path)
+	c.Assert(manifest.Request, Equals, "http://example.com/$import")
+	c.Assert(manifest.Output, DeepEquals, []importOutput{
+		{Type: "Patient", InputURL: s.files.URL + "/Patient.ndjson", Count: 3},
+		{Type: "Observation", InputURL: s.files.URL + "/Observation.ndjson", Count: 2},
+	})
+	c.Assert(manifest.Error, HasLen, 1)
+	c.Assert(manifest.Error[0].Count, Equals, 4)
+
+	// the ids are preserved and the resources have histories
+	w = serve(s.server, "GET", "/Observation/o2", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "GET", "/Patient/p1/_history", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"total":2`), Equals, true)
+	w = serve(s.server, "GET", "/Patient/p1", "")
+	c.Assert(strings.Contains(w.Body.String(), `"gender":"other"`), Equals, true)
+
+	// one OperationOutcome per failed line
+	errorsURL, err := url.Parse(manifest.Error[0].URL)
+	c.Assert(err, IsNil)
+	w = serve(s.server, "GET", errorsURL.Path, "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/fhir+ndjson")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	c.Assert(lines, HasLen, 4)
+	for i, number := range []string{"4", "5", "6", "7"} {
+		var outcome struct {
+			ResourceType string
+			Issue        []struct{ Diagnostics string }
+		}
+		c.Assert(json.Unmarshal([]byte(lines[i]), &outcome), IsNil)
+		c.Assert(outcome.ResourceType, Equals, "OperationOutcome")
+		c.Assert(strings.HasPrefix(outcome.Issue[0].Diagnostics, s.files.URL+"/Patient.ndjson line "+number+": "), Equals, true, Commentf(lines[i]))
+	}
+
+	w = serve(s.server, "DELETE", statusURL.Path, "")
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	w = serve(s.server, "GET", statusURL.Path, "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	files, _ := ioutil.ReadDir(s.dir)
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *BulkImportSuite) TestImportFailure(c *C) {
+	w := serve(s.server, "POST", "/$import", importParameters(ImportInput{"Patient", s.files.URL + "/missing.ndjson"}), "Prefer", "respond-async")
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	statusURL, _ := url.Parse(w.Header().Get("Content-Location"))
+
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		w = serve(s.server, "GET", statusURL.Path, "")
+		if w.Code != http.StatusAccepted {
+			break
+		}
+	}
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+	c.Assert(strings.Contains(w.Body.String(), "404 Not Found"), Equals, true)
+}
+
+func (s *BulkImportSuite) TestResume(c *C) {
+	inputDir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(inputDir, "Patient.ndjson"), []byte(importPatients), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(inputDir, "Observation.ndjson"), []byte(importObservations), 0600), IsNil)
+	inputs, err := ImportInputsFromPaths([]string{inputDir})
+	c.Assert(err, IsNil)
+	c.Assert(inputs, DeepEquals, []ImportInput{
+		{Type: "Observation", URL: filepath.Join(inputDir, "Observation.ndjson")},
+		{Type: "Patient", URL: filepath.Join(inputDir, "Patient.ndjson")},
+	})
+
+	// as if an import had crashed after the first Observation and before the Patients
+	workDir := c.MkDir()
+	state := importState{
+		Lines:    map[string]int{inputs[0].URL: 1},
+		Imported: map[string]int{inputs[0].URL: 1},
+		Failed:   map[string]int{},
+		Complete: map[string]bool{},
+	}
+	data, _ := json.Marshal(state)
+	c.Assert(ioutil.WriteFile(filepath.Join(workDir, importStateFile), data, 0600), IsNil)
+
+	dal := NewMemoryDataAccessLayer("fhir", false, "", nil, DefaultConfig)
+	imp := newBulkImport(dal, "", workDir, 2, inputs)
+	c.Assert(imp.run(context.Background()), IsNil)
+	imported, failed := imp.progress()
+	c.Assert(imported, Equals, 5)
+	c.Assert(failed, Equals, 4)
+
+	session := dal.StartSession(context.Background(), "")
+	defer session.Finish()
+	_, err = session.Get("o1", "Observation")
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = session.Get("o2", "Observation")
+	c.Assert(err, IsNil)
+	_, err = session.Get("p2", "Patient")
+	c.Assert(err, IsNil)
+
+	// running it again does nothing
+	imp = newBulkImport(dal, "", workDir, 2, inputs)
+	c.Assert(imp.run(context.Background()), IsNil)
+	imported, failed = imp.progress()
+	c.Assert(imported, Equals, 5)
+	c.Assert(failed, Equals, 4)
+	errorLines, err := ioutil.ReadFile(filepath.Join(workDir, importErrorsFile))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(errorLines), "\n"), Equals, 4)
+}
+
+func (s *BulkImportSuite) TestResumeDoesntRepeatWrites(c *C) {
+	input := ImportInput{Type: "Patient", URL: filepath.Join(c.MkDir(), "Patient.ndjson")}
+	c.Assert(ioutil.WriteFile(input.URL, []byte(importPatients), 0600), IsNil)
+
+	// as if an import had crashed after storing p1 and reporting a failed line, but before saving the state
+	workDir := c.MkDir()
+	state := importState{
+		Lines:    map[string]int{},
+		Imported: map[string]int{},
+		Failed:   map[string]int{},
+		Started:  map[string]int{input.URL: importStartedLines},
+		Complete: map[string]bool{},
+	}
+	data, _ := json.Marshal(state)
+	c.Assert(ioutil.WriteFile(filepath.Join(workDir, importStateFile), data, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(workDir, importErrorsFile), []byte("{}\n"), 0600), IsNil)
+
+	dal := NewMemoryDataAccessLayer("fhir", false, "", nil, DefaultConfig)
+	session := dal.StartSession(context.Background(), "")
+	p1, err := models2.NewResourceFromJsonBytes([]byte(strings.SplitN(importPatients, "\n", 2)[0]))
+	c.Assert(err, IsNil)
+	_, err = session.Put("p1", "", p1)
+	c.Assert(err, IsNil)
+	session.Finish()
+
+	imp := newBulkImport(dal, "", workDir, 2, []ImportInput{input})
+	c.Assert(imp.run(context.Background()), IsNil)
+	imported, failed := imp.progress()
+	c.Assert(imported, Equals, 3)
+	c.Assert(failed, Equals, 4)
+
+	// p1 was only stored again for its second version
+	session = dal.StartSession(context.Background(), "")
+	defer session.Finish()
+	p1, err = session.Get("p1", "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(p1.VersionId(), Equals, "2")
+	errorLines, err := ioutil.ReadFile(filepath.Join(workDir, importErrorsFile))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(errorLines), "\n"), Equals, 4)
+}
+
+func (s *BulkImportSuite) TestResumeAfterRestart(c *C) {
+	// a job saved by a server that stopped before starting it
+	job := importJob{
+		ID:        "job1",
+		Request:   "http://example.com/$import",
+		StatusURL: "http://example.com/_import/job1",
+		Inputs:    []ImportInput{{"Observation", s.files.URL + "/Observation.ndjson"}},
+	}
+	data, _ := json.Marshal(job)
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "job1"), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "job1", importJobFile), data, 0600), IsNil)
+
+	s.server = NewServer(s.server.Config)
+	s.server.InitEngine()
+	manifest := s.waitForImport(c, "/_import/job1")
+	c.Assert(manifest.Output, HasLen, 1)
+	c.Assert(manifest.Output[0].Count, Equals, 2)
+	w := serve(s.server, "GET", "/Observation/o1", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+}
+
+func (s *BulkImportSuite) TestImportInputsFromPaths(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "Patient.2.ndjson"), nil, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "patients.txt"), nil, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "Unknown.ndjson"), nil, 0600), IsNil)
+
+	inputs, err := ImportInputsFromPaths([]string{filepath.Join(dir, "Patient.2.ndjson"), "Person=" + filepath.Join(dir, "patients.txt")})
+	c.Assert(err, IsNil)
+	c.Assert(inputs, DeepEquals, []ImportInput{
+		{Type: "Patient", URL: filepath.Join(dir, "Patient.2.ndjson")},
+		{Type: "Person", URL: filepath.Join(dir, "patients.txt")},
+	})
+
+	_, err = ImportInputsFromPaths([]string{dir})
+	c.Assert(err, ErrorMatches, "unknown resource type Unknown .*")
+	_, err = ImportInputsFromPaths([]string{filepath.Join(dir, "missing.ndjson")})
+	c.Assert(err, NotNil)
+}
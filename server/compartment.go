@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+type patientCompartmentKey struct{}
+
+// LimitToPatientCompartment limits the data access sessions started for the rest of a request to the
+// compartment of a patient (see compartmentDataAccessLayer). It's the authorization hook for handlers that
+// have established that a request may only access one patient's data, e.g. PatientCompartmentHandler.
+func LimitToPatientCompartment(c *gin.Context, patientID string) {
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), patientCompartmentKey{}, patientID))
+}
+
+// limitedToPatient returns the id of the patient that a context is limited to by LimitToPatientCompartment
+func limitedToPatient(ctx context.Context) (patientID string, limited bool) {
+	patientID, limited = ctx.Value(patientCompartmentKey{}).(string)
+	return
+}
+
+// compartmentDataAccessLayer limits the sessions started with contexts from LimitToPatientCompartment to the
+// patient's compartment: searches only match resources in it, included resources and reads of resources in
+// other compartments are left out or forbidden, and only resources in the compartment can be written.
+// Resource types that aren't in the Patient compartment (e.g. Medication) can be read but not written.
+// Sessions started with contexts from SMARTReadAccessHandler also leave resources that the scopes don't
+// allow reading out of search results (see scopedDataAccessSession).
+type compartmentDataAccessLayer struct {
+	DataAccessLayer
+}
+
+func newCompartmentDataAccessLayer(dal DataAccessLayer) DataAccessLayer {
+	return &compartmentDataAccessLayer{DataAccessLayer: dal}
+}
+
+func (dal *compartmentDataAccessLayer) StartSession(ctx context.Context, dbname string) DataAccessSession {
+	session := dal.DataAccessLayer.StartSession(ctx, dbname)
+	if access, scoped := readAccess(ctx); scoped {
+		session = &scopedDataAccessSession{DataAccessSession: session, access: access}
+	}
+	patientID, limited := limitedToPatient(ctx)
+	if !limited {
+		return session
+	}
+	return &compartmentDataAccessSession{DataAccessSession: session, patientID: patientID}
+}
+
+type compartmentDataAccessSession struct {
+	DataAccessSession
+	patientID string
+}
+
+// readable returns whether a resource is in the patient's compartment or is of a type outside the compartment
+func (s *compartmentDataAccessSession) readable(resource *models2.Resource) (bool, error) {
+	if !search.InCompartment("Patient", resource.ResourceType()) {
+		return true, nil
+	}
+	return inPatientCompartment(resource, s.patientID)
+}
+
+// writable returns an error unless a resource being written is in the patient's compartment
+func (s *compartmentDataAccessSession) writable(resource *models2.Resource) error {
+	if !search.InCompartment("Patient", resource.ResourceType()) {
+		return ErrForbidden
+	}
+	inCompartment, err := inPatientCompartment(resource, s.patientID)
+	if err != nil {
+		return err
+	}
+	if !inCompartment {
+		if resource.ResourceType() == "Provenance" {
+			return s.provenanceWritable(resource)
+		}
+		return ErrForbidden
+	}
+	return nil
+}
+
+// provenanceWritable returns an error unless all of a Provenance's targets are writable,
+// so that the Provenance of a write in the patient's compartment can be recorded
+func (s *compartmentDataAccessSession) provenanceWritable(provenance *models2.Resource) error {
+	var targets [][]string
+	_, err := jsonparser.ArrayEach(provenance.JsonBytes(), func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		reference, _ := jsonparser.GetString(value, "reference")
+		targets = append(targets, strings.Split(reference, "/"))
+	}, "target")
+	if err != nil && err != jsonparser.KeyPathNotFoundError {
+		return errors.Wrap(err, "provenanceWritable: failed to parse targets")
+	}
+	if len(targets) == 0 {
+		return ErrForbidden
+	}
+	for _, target := range targets {
+		// Type/id or Type/id/_history/vid
+		if len(target) != 2 && !(len(target) == 4 && target[2] == "_history") {
+			return ErrForbidden
+		}
+		if err := s.existingWritable(target[1], target[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingWritable returns an error unless a resource is in the patient's compartment or doesn't exist
+func (s *compartmentDataAccessSession) existingWritable(id string, resourceType string) error {
+	if !search.InCompartment("Patient", resourceType) {
+		return ErrForbidden
+	}
+	existing, err := s.DataAccessSession.Get(id, resourceType)
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.writable(existing)
+}
+
+// restrict adds a _compartment parameter to queries for types of resources in the Patient compartment
+func (s *compartmentDataAccessSession) restrict(query search.Query) search.Query {
+	if !search.InCompartment("Patient", query.Resource) {
+		return query
+	}
+	restriction := search.CompartmentParam + "=" + url.QueryEscape("Patient/"+s.patientID)
+	if query.Query == "" {
+		return search.Query{Resource: query.Resource, Query: restriction}
+	}
+	return search.Query{Resource: query.Resource, Query: query.Query + "&" + restriction}
+}
+
+func (s *compartmentDataAccessSession) checkRead(resource *models2.Resource, err error) (*models2.Resource, error) {
+	if err != nil {
+		return nil, err
+	}
+	readable, err := s.readable(resource)
+	if err != nil {
+		return nil, err
+	}
+	if !readable {
+		return nil, ErrForbidden
+	}
+	return resource, nil
+}
+
+func (s *compartmentDataAccessSession) Get(id, resourceType string) (*models2.Resource, error) {
+	return s.checkRead(s.DataAccessSession.Get(id, resourceType))
+}
+
+func (s *compartmentDataAccessSession) GetVersion(id, versionId, resourceType string) (*models2.Resource, error) {
+	return s.checkRead(s.DataAccessSession.GetVersion(id, versionId, resourceType))
+}
+
+func (s *compartmentDataAccessSession) Post(resource *models2.Resource) (id string, err error) {
+	if err = s.writable(resource); err != nil {
+		return "", err
+	}
+	return s.DataAccessSession.Post(resource)
+}
+
+func (s *compartmentDataAccessSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	if err = s.writable(resource); err != nil {
+		return 0, "", nil, err
+	}
+	return s.DataAccessSession.ConditionalPost(s.restrict(query), resource)
+}
+
+func (s *compartmentDataAccessSession) PostWithID(id string, resource *models2.Resource) error {
+	if err := s.existingWritable(id, resource.ResourceType()); err != nil {
+		return err
+	}
+	resource.SetId(id)
+	if err := s.writable(resource); err != nil {
+		return err
+	}
+	return s.DataAccessSession.PostWithID(id, resource)
+}
+
+func (s *compartmentDataAccessSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	if err = s.existingWritable(id, resource.ResourceType()); err != nil {
+		return false, err
+	}
+	// a patient is in its own compartment, so needs its id
+	resource.SetId(id)
+	if err = s.writable(resource); err != nil {
+		return false, err
+	}
+	return s.DataAccessSession.Put(id, conditionalVersionId, resource)
+}
+
+func (s *compartmentDataAccessSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	if err = s.writable(resource); err != nil {
+		return "", false, err
+	}
+	return s.DataAccessSession.ConditionalPut(s.restrict(query), conditionalVersionId, resource)
+}
+
+func (s *compartmentDataAccessSession) Delete(id, resourceType string) (newVersionId string, err error) {
+	if err = s.existingWritable(id, resourceType); err != nil {
+		return "", err
+	}
+	return s.DataAccessSession.Delete(id, resourceType)
+}
+
+func (s *compartmentDataAccessSession) ConditionalDelete(query search.Query) (count int64, err error) {
+	if !search.InCompartment("Patient", query.Resource) {
+		return 0, ErrForbidden
+	}
+	return s.DataAccessSession.ConditionalDelete(s.restrict(query))
+}
+
+func (s *compartmentDataAccessSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+	bundle, err := s.DataAccessSession.Search(baseURL, s.restrict(searchQuery))
+	if err != nil {
+		return nil, err
+	}
+	// matches are in the compartment, but resources included by _include and _revinclude mightn't be
+	entries := bundle.Entry[:0]
+	for _, entry := range bundle.Entry {
+		if entry.Resource != nil {
+			readable, err := s.readable(entry.Resource)
+			if err != nil {
+				return nil, err
+			}
+			if !readable {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	bundle.Entry = entries
+	return bundle, nil
+}
+
+func (s *compartmentDataAccessSession) FindIDs(searchQuery search.Query) ([]string, error) {
+	return s.DataAccessSession.FindIDs(s.restrict(searchQuery))
+}
+
+func (s *compartmentDataAccessSession) History(baseURL url.URL, historyQuery search.Query, id string) (*models2.ShallowBundle, error) {
+	bundle, err := s.DataAccessSession.History(baseURL, historyQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	// every version must be readable, as resources can be moved between compartments
+	for _, entry := range bundle.Entry {
+		if entry.Resource == nil {
+			continue
+		}
+		readable, err := s.readable(entry.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if !readable {
+			return nil, ErrForbidden
+		}
+	}
+	return bundle, nil
+}
+
+func (s *compartmentDataAccessSession) HistoryAll(baseURL url.URL, historyQuery search.Query) (*models2.ShallowBundle, error) {
+	// deletions of resources in other compartments can't be told apart
+	if historyQuery.Resource == "" || search.InCompartment("Patient", historyQuery.Resource) {
+		return nil, ErrForbidden
+	}
+	return s.DataAccessSession.HistoryAll(baseURL, historyQuery)
+}
+
+func (s *compartmentDataAccessSession) Export(resourceType string, since time.Time, handler func(resource *models2.Resource) error) error {
+	return s.DataAccessSession.Export(resourceType, since, func(resource *models2.Resource) error {
+		readable, err := s.readable(resource)
+		if err != nil {
+			return err
+		}
+		if !readable {
+			return nil
+		}
+		return handler(resource)
+	})
+}
+
+// inPatientCompartment returns whether a resource is in the compartment of a patient
+func inPatientCompartment(resource *models2.Resource, patientID string) (bool, error) {
+	doc, err := resource.GetBSON()
+	if err != nil {
+		return false, errors.Wrap(err, "inPatientCompartment: GetBSON failed")
+	}
+	for _, member := range search.PatientCompartmentMembers(resource.ResourceType(), resource.Id(), doc.([]bson.E)) {
+		if member == patientID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CompartmentSearchHandler handles searches of the resources of a type in the compartment of one of the
+// controller's resources (e.g. GET /Patient/123/Observation?code=...), which are searches of that type
+// with a _compartment parameter (e.g. GET /Observation?code=...&_compartment=Patient/123).
+func (rc *ResourceController) CompartmentSearchHandler(c *gin.Context) {
+	resourceType := c.Param("type")
+	if !search.InCompartment(rc.Name, resourceType) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if rc.Config.Auth.Method == auth.AuthTypeSMART {
+		// the scopes for the compartment's resource were checked by the route's handlers
+		auth.SMARTScopesHandler(resourceType)(c)
+		if c.IsAborted() {
+			return
+		}
+		PatientCompartmentHandler(c)
+	}
+
+	restriction := search.CompartmentParam + "=" + url.QueryEscape(rc.Name+"/"+c.Param("id"))
+	if c.Request.URL.RawQuery != "" {
+		c.Request.URL.RawQuery += "&"
+	}
+	c.Request.URL.RawQuery += restriction
+	NewResourceController(resourceType, rc.DAL, rc.Config).IndexHandler(c)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+)
+
+type CompartmentSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&CompartmentSuite{})
+
+func (s *CompartmentSuite) SetUpTest(c *C) {
+	// requests for a patient are limited to the patient's compartment, like with SMART patient/ scopes
+	s.server = newMemoryTestServer(nil, func(c *gin.Context) {
+		if patientID := c.GetHeader("X-Patient"); patientID != "" {
+			LimitToPatientCompartment(c, patientID)
+		}
+	})
+
+	for _, resource := range []string{
+		`{"resourceType": "Patient", "id": "p1"}`,
+		`{"resourceType": "Patient", "id": "p2"}`,
+		`{"resourceType": "Practitioner", "id": "d1"}`,
+		`{"resourceType": "Medication", "id": "m1"}`,
+		`{"resourceType": "Encounter", "id": "e1", "status": "finished", "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p1"}, "performer": [{"reference": "Practitioner/d1"}]}`,
+		`{"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p2"}, "performer": [{"reference": "Patient/p1"}]}`,
+		`{"resourceType": "Observation", "id": "o3", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p2"}, "context": {"reference": "Encounter/e1"}}`,
+		`{"resourceType": "MedicationRequest", "id": "mr1", "intent": "order", "subject": {"reference": "Patient/p1"}, "medicationReference": {"reference": "Medication/m1"}}`,
+	} {
+		var header struct{ ResourceType, ID string }
+		c.Assert(json.Unmarshal([]byte(resource), &header), IsNil)
+		w := s.request("PUT", "/"+header.ResourceType+"/"+header.ID, resource, "")
+		c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	}
+}
+
+func (s *CompartmentSuite) request(method string, path string, body string, patientID string) *httptest.ResponseRecorder {
+	if patientID == "" {
+		return serve(s.server, method, path, body)
+	}
+	return serve(s.server, method, path, body, "X-Patient", patientID)
+}
+
+// searchIDs returns the sorted types and ids of the resources in a search's bundle
+func (s *CompartmentSuite) searchIDs(c *C, path string, patientID string) []string {
+	w := s.request("GET", path, "", patientID)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var bundle struct {
+		Entry []struct {
+			Resource struct {
+				ResourceType string `json:"resourceType"`
+				ID           string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+	ids := []string{}
+	for _, entry := range bundle.Entry {
+		ids = append(ids, entry.Resource.ResourceType+"/"+entry.Resource.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *CompartmentSuite) TestCompartmentSearch(c *C) {
+	// o2 is in p1's compartment as p1 performed it
+	c.Assert(s.searchIDs(c, "/Patient/p1/Observation", ""), DeepEquals, []string{"Observation/o1", "Observation/o2"})
+	c.Assert(s.searchIDs(c, "/Patient/p1/Observation?code:text=weight&subject=Patient/p1", ""), DeepEquals, []string{"Observation/o1"})
+	c.Assert(s.searchIDs(c, "/Patient/p2/Observation", ""), DeepEquals, []string{"Observation/o2", "Observation/o3"})
+	c.Assert(s.searchIDs(c, "/Patient/p1/Encounter", ""), DeepEquals, []string{"Encounter/e1"})
+	c.Assert(s.searchIDs(c, "/Encounter/e1/Observation", ""), DeepEquals, []string{"Observation/o3"})
+	c.Assert(s.searchIDs(c, "/Practitioner/d1/Observation", ""), DeepEquals, []string{"Observation/o1"})
+	c.Assert(s.searchIDs(c, "/Observation?_compartment=Patient/p2", ""), DeepEquals, []string{"Observation/o2", "Observation/o3"})
+
+	// Medication isn't in the Patient compartment
+	w := s.request("GET", "/Patient/p1/Medication", "", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// the other routes of patients still work
+	w = s.request("GET", "/Patient/p1/_history", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("GET", "/Patient/p1/_history/1", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("GET", "/Patient/p1/$fhirpath?expression=id", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+}
+
+func (s *CompartmentSuite) TestEverything(c *C) {
+	c.Assert(s.searchIDs(c, "/Patient/p1/$everything", ""), DeepEquals, []string{
+		"Encounter/e1",
+		"Medication/m1",
+		"MedicationRequest/mr1",
+		"Observation/o1",
+		"Observation/o2",
+		"Patient/p1",
+		"Patient/p2",
+		"Practitioner/d1",
+	})
+	c.Assert(s.searchIDs(c, "/Encounter/e1/$everything", ""), DeepEquals, []string{
+		"Encounter/e1",
+		"Observation/o3",
+		"Patient/p1",
+		"Patient/p2",
+	})
+	w := s.request("GET", "/Patient/p3/$everything", "", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *CompartmentSuite) TestLimitedToPatientCompartment(c *C) {
+	c.Assert(s.searchIDs(c, "/Observation", "p1"), DeepEquals, []string{"Observation/o1", "Observation/o2"})
+	c.Assert(s.searchIDs(c, "/Patient", "p1"), DeepEquals, []string{"Patient/p1"})
+	c.Assert(s.searchIDs(c, "/Patient/p2/Observation", "p1"), DeepEquals, []string{"Observation/o2"})
+	// resources outside the Patient compartment can be searched
+	c.Assert(s.searchIDs(c, "/Medication", "p1"), DeepEquals, []string{"Medication/m1"})
+
+	// included resources in other compartments are left out
+	c.Assert(s.searchIDs(c, "/Observation?_id=o2&_include=Observation:subject", "p1"), DeepEquals, []string{"Observation/o2"})
+	c.Assert(s.searchIDs(c, "/Observation?_id=o2&_include=Observation:subject", ""), DeepEquals, []string{"Observation/o2", "Patient/p2"})
+	c.Assert(s.searchIDs(c, "/Patient?_revinclude=Observation:subject", "p1"), DeepEquals, []string{"Observation/o1", "Patient/p1"})
+
+	// $everything only has the patient's resources, and not other patients
+	c.Assert(s.searchIDs(c, "/Patient/p1/$everything", "p1"), DeepEquals, []string{
+		"Encounter/e1",
+		"Medication/m1",
+		"MedicationRequest/mr1",
+		"Observation/o1",
+		"Observation/o2",
+		"Patient/p1",
+		"Practitioner/d1",
+	})
+	w := s.request("GET", "/Patient/p2/$everything", "", "p1")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	for path, expected := range map[string]int{
+		"/Observation/o1":          http.StatusOK,
+		"/Observation/o3":          http.StatusForbidden,
+		"/Patient/p2":              http.StatusForbidden,
+		"/Medication/m1":           http.StatusOK,
+		"/Observation/o1/_history": http.StatusOK,
+		"/Observation/o3/_history": http.StatusForbidden,
+		"/Observation/_history":    http.StatusForbidden,
+		"/Medication/_history":     http.StatusOK,
+	} {
+		w := s.request("GET", path, "", "p1")
+		c.Assert(w.Code, Equals, expected, Commentf("%s: %s", path, w.Body.String()))
+	}
+
+	w = s.request("POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p1"}}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = s.request("POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p2"}}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("PUT", "/Observation/o3", `{"resourceType": "Observation", "id": "o3", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p1"}}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1", "active": true}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	w = s.request("PUT", "/Medication/m1", `{"resourceType": "Medication", "id": "m1"}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("DELETE", "/Observation?code:text=height", "", "p1")
+	c.Assert(w.Code, Equals, http.StatusNoContent, Commentf("%s", w.Body.String()))
+	w = s.request("DELETE", "/Observation/o3", "", "p1")
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// only p1's height was deleted
+	c.Assert(s.searchIDs(c, "/Observation?code:text=height", ""), DeepEquals, []string{"Observation/o3"})
+
+	// batches are limited too
+	w = s.request("POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{ "request": { "method": "GET", "url": "Observation/o1" } },
+			{ "request": { "method": "GET", "url": "Observation/o3" } }
+		]
+	}`, "p1")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var batch struct {
+		Entry []struct {
+			Response struct {
+				Status string `json:"status"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &batch), IsNil)
+	c.Assert(batch.Entry, HasLen, 2)
+	c.Assert(batch.Entry[0].Response.Status, Matches, "200.*")
+	c.Assert(batch.Entry[1].Response.Status, Matches, "403.*")
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models2"
+)
+
+// notModified reports whether a conditional read (https://tools.ietf.org/html/rfc7232#section-3)
+// can be answered with 304 Not Modified. ETags are compared weakly and If-Modified-Since is
+// only considered when there is no If-None-Match. A zero ifModifiedSince means it was not given.
+func notModified(ifNoneMatch string, ifModifiedSince time.Time, etag string, lastModified time.Time) bool {
+	if ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagsMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince.IsZero() || lastModified.IsZero() {
+		return false
+	}
+	// HTTP dates only have a resolution of seconds
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+func weakETagsMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// requestNotModified checks the If-None-Match and If-Modified-Since headers of a request
+// against the ETag and Last-Modified headers already set for the response
+func requestNotModified(c *gin.Context) bool {
+	var ifModifiedSince time.Time
+	if header := c.GetHeader("If-Modified-Since"); header != "" {
+		// invalid dates are ignored (https://tools.ietf.org/html/rfc7232#section-3.3)
+		ifModifiedSince, _ = http.ParseTime(header)
+	}
+	var lastModified time.Time
+	if header := c.Writer.Header().Get("Last-Modified"); header != "" {
+		lastModified, _ = http.ParseTime(header)
+	}
+	return notModified(c.GetHeader("If-None-Match"), ifModifiedSince, c.Writer.Header().Get("ETag"), lastModified)
+}
+
+// entryNotModified checks the ifNoneMatch and ifModifiedSince of a batch or transaction GET entry
+// against the etag and lastModified already set for its response
+func entryNotModified(entry *models2.ShallowBundleEntryComponent) bool {
+	var ifModifiedSince, lastModified time.Time
+	if entry.Request.IfModifiedSince != nil {
+		ifModifiedSince = entry.Request.IfModifiedSince.Time
+	}
+	if entry.Response.LastModified != nil {
+		lastModified = entry.Response.LastModified.Time
+	}
+	return notModified(entry.Request.IfNoneMatch, ifModifiedSince, entry.Response.Etag, lastModified)
+}
+
+// bundleETag computes a weak ETag for a search result bundle from its total and the ids and
+// versions of its entries, so that it changes whenever the results do
+func bundleETag(bundle *models2.ShallowBundle) string {
+	hash := sha1.New()
+	if bundle.Total != nil {
+		fmt.Fprintf(hash, "total %d\n", *bundle.Total)
+	}
+	for _, entry := range bundle.Entry {
+		mode := ""
+		if entry.Search != nil {
+			mode = entry.Search.Mode
+		}
+		reference := entry.FullUrl
+		if entry.Resource != nil {
+			reference = entry.Resource.ResourceType() + "/" + entry.Resource.Id() + "/_history/" + entry.Resource.VersionId()
+		}
+		fmt.Fprintf(hash, "%s %s\n", mode, reference)
+	}
+	return "W/\"" + hex.EncodeToString(hash.Sum(nil)) + "\""
+}
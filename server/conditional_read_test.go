@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConditionalReadSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&ConditionalReadSuite{})
+
+func (s *ConditionalReadSuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(nil)
+}
+
+func (s *ConditionalReadSuite) TestNotModified(c *C) {
+	lastModified := time.Date(2019, 3, 4, 10, 20, 30, 500000000, time.UTC)
+	before := lastModified.Add(-time.Minute)
+	sameSecond := lastModified.Truncate(time.Second)
+	var absent time.Time
+
+	c.Assert(notModified("", absent, `W/"2"`, lastModified), Equals, false)
+	c.Assert(notModified(`W/"2"`, absent, `W/"2"`, lastModified), Equals, true)
+	c.Assert(notModified(`"2"`, absent, `W/"2"`, lastModified), Equals, true)
+	c.Assert(notModified(`W/"1", W/"2"`, absent, `W/"2"`, lastModified), Equals, true)
+	c.Assert(notModified(`*`, absent, `W/"2"`, lastModified), Equals, true)
+	c.Assert(notModified(`W/"1"`, absent, `W/"2"`, lastModified), Equals, false)
+	c.Assert(notModified(`W/"1"`, absent, "", lastModified), Equals, false)
+
+	c.Assert(notModified("", sameSecond, `W/"2"`, lastModified), Equals, true)
+	c.Assert(notModified("", before, `W/"2"`, lastModified), Equals, false)
+	c.Assert(notModified("", sameSecond, `W/"2"`, absent), Equals, false)
+	// If-None-Match takes precedence
+	c.Assert(notModified(`W/"1"`, sameSecond, `W/"2"`, lastModified), Equals, false)
+}
+
+func (s *ConditionalReadSuite) TestConditionalReads(c *C) {
+	w := serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "gender": "male"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	w = serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "gender": "female"}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = serve(s.server, "GET", "/Patient/123", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"2"`)
+	lastModified := w.Header().Get("Last-Modified")
+	c.Assert(lastModified, Not(Equals), "")
+
+	w = serve(s.server, "GET", "/Patient/123", "", "If-None-Match", `W/"2"`)
+	c.Assert(w.Code, Equals, http.StatusNotModified)
+	c.Assert(w.Body.Len(), Equals, 0)
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"2"`)
+
+	w = serve(s.server, "GET", "/Patient/123", "", "If-None-Match", `W/"1"`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"gender":"female"`), Equals, true)
+
+	w = serve(s.server, "GET", "/Patient/123", "", "If-Modified-Since", lastModified)
+	c.Assert(w.Code, Equals, http.StatusNotModified)
+
+	w = serve(s.server, "GET", "/Patient/123", "", "If-Modified-Since", "Tue, 01 Jan 2019 00:00:00 GMT")
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = serve(s.server, "GET", "/Patient/123", "", "If-Modified-Since", "not a date")
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = serve(s.server, "GET", "/Patient/123/_history/1", "", "If-None-Match", `W/"1"`)
+	c.Assert(w.Code, Equals, http.StatusNotModified)
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"1"`)
+
+	w = serve(s.server, "GET", "/Patient/124", "", "If-None-Match", `*`)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ConditionalReadSuite) TestSearchBundleETags(c *C) {
+	w := serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "gender": "male"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	w = serve(s.server, "GET", "/Patient?gender=male", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	c.Assert(strings.HasPrefix(etag, `W/"`), Equals, true)
+
+	w = serve(s.server, "GET", "/Patient?gender=male", "", "If-None-Match", etag)
+	c.Assert(w.Code, Equals, http.StatusNotModified)
+	c.Assert(w.Body.Len(), Equals, 0)
+
+	// the ETag depends on the results rather than the query
+	w = serve(s.server, "GET", "/Patient?_id=123&_elements=gender", "")
+	c.Assert(w.Header().Get("ETag"), Equals, etag)
+	w = serve(s.server, "GET", "/Patient?gender=female", "")
+	c.Assert(w.Header().Get("ETag"), Not(Equals), etag)
+
+	// a new version changes it
+	w = serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "gender": "male", "active": true}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve(s.server, "GET", "/Patient?gender=male", "", "If-None-Match", etag)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	newETag := w.Header().Get("ETag")
+	c.Assert(newETag, Not(Equals), etag)
+
+	// and so does a new result
+	w = serve(s.server, "POST", "/Patient", `{"resourceType": "Patient", "gender": "male"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	w = serve(s.server, "GET", "/Patient?gender=male", "", "If-None-Match", newETag)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("ETag"), Not(Equals), newETag)
+}
+
+func (s *ConditionalReadSuite) TestConditionalReadsInBatches(c *C) {
+	w := serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "gender": "male"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	w = serve(s.server, "GET", "/Patient?gender=male", "")
+	searchETag := w.Header().Get("ETag")
+
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{"request": {"method": "GET", "url": "Patient/123", "ifNoneMatch": "W/\"1\""}},
+			{"request": {"method": "GET", "url": "Patient/123", "ifNoneMatch": "W/\"0\""}},
+			{"request": {"method": "GET", "url": "Patient/123", "ifModifiedSince": "2019-01-01T00:00:00Z"}},
+			{"request": {"method": "GET", "url": "Patient?gender=male", "ifNoneMatch": `+jsonString(searchETag)+`}}
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var response struct {
+		Entry []struct {
+			Resource *struct{} `json:"resource"`
+			Response struct {
+				Status string `json:"status"`
+				Etag   string `json:"etag"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Entry, HasLen, 4)
+	c.Assert(response.Entry[0].Response.Status, Equals, "304")
+	c.Assert(response.Entry[0].Resource, IsNil)
+	c.Assert(response.Entry[1].Response.Status, Equals, "200")
+	c.Assert(response.Entry[1].Resource, NotNil)
+	c.Assert(response.Entry[2].Response.Status, Equals, "200")
+	c.Assert(response.Entry[3].Response.Status, Equals, "304")
+	c.Assert(response.Entry[3].Response.Etag, Equals, searchETag)
+	c.Assert(response.Entry[3].Resource, IsNil)
+}
+
+func jsonString(s string) string {
+	bytes, _ := json.Marshal(s)
+	return string(bytes)
+}
@@ -0,0 +1,569 @@
+// Package daltest provides a behavioural test suite for implementations of server.DataAccessLayer.
+//
+// An implementation proves its compatibility with the MongoDB backend by running:
+//
+//	func TestConformance(t *testing.T) {
+//		daltest.Run(t, func() server.DataAccessLayer {
+//			return newEmptyDataAccessLayer()
+//		})
+//	}
+//
+// The constructor is called before every test and must return a layer whose default
+// database is empty, with version histories enabled and search totals counted.
+package daltest
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/server"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Run runs the conformance suite against the layers returned by newDAL
+func Run(t *testing.T, newDAL func() server.DataAccessLayer) {
+	suite.Run(t, &DALSuite{NewDAL: newDAL})
+}
+
+// DALSuite is the conformance suite. Use Run unless it needs to be embedded into another suite.
+type DALSuite struct {
+	suite.Suite
+	NewDAL func() server.DataAccessLayer
+
+	session server.DataAccessSession
+}
+
+func (s *DALSuite) SetupTest() {
+	s.session = s.NewDAL().StartSession(context.Background(), "")
+}
+
+func (s *DALSuite) TearDownTest() {
+	s.session.Finish()
+}
+
+// newID returns an id acceptable to all backends (the MongoDB one requires ObjectIds)
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+func (s *DALSuite) patient(family string, gender string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"name": [{ "family": "` + family + `" }],
+		"gender": "` + gender + `"
+	}`))
+	s.Require().NoError(err)
+	return resource
+}
+
+func (s *DALSuite) family(resource *models2.Resource) string {
+	var patient struct {
+		Name []struct{ Family string }
+	}
+	s.Require().NoError(resource.Unmarshal(&patient))
+	s.Require().Len(patient.Name, 1)
+	return patient.Name[0].Family
+}
+
+func (s *DALSuite) assertConflict(err error) {
+	s.Require().Error(err)
+	_, isConflict := errors.Cause(err).(server.ErrConflict)
+	s.True(isConflict, "expected an ErrConflict but got %+v", err)
+}
+
+func (s *DALSuite) assertMultipleMatches(err error) {
+	s.Require().Error(err)
+	_, isValue := errors.Cause(err).(server.ErrMultipleMatches)
+	_, isPointer := errors.Cause(err).(*server.ErrMultipleMatches)
+	s.True(isValue || isPointer, "expected an ErrMultipleMatches but got %+v", err)
+}
+
+func (s *DALSuite) TestGetNotFound() {
+	_, err := s.session.Get(newID(), "Patient")
+	s.Equal(server.ErrNotFound, errors.Cause(err))
+}
+
+func (s *DALSuite) TestPostAndGet() {
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.NotEmpty(id)
+
+	resource, err := s.session.Get(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal("Patient", resource.ResourceType())
+	s.Equal(id, resource.Id())
+	s.Equal("1", resource.VersionId())
+	s.False(resource.LastUpdatedTime().IsZero())
+	s.Equal("Duck", s.family(resource))
+}
+
+func (s *DALSuite) TestPostWithID() {
+	id := newID()
+	s.Require().NoError(s.session.PostWithID(id, s.patient("Duck", "male")))
+
+	resource, err := s.session.Get(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal(id, resource.Id())
+	s.Equal("1", resource.VersionId())
+}
+
+func (s *DALSuite) TestPutCreatesThenUpdates() {
+	id := newID()
+	createdNew, err := s.session.Put(id, "", s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.True(createdNew)
+
+	createdNew, err = s.session.Put(id, "", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	s.False(createdNew)
+
+	resource, err := s.session.Get(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal("2", resource.VersionId())
+	s.Equal("Mouse", s.family(resource))
+}
+
+func (s *DALSuite) TestPutIfMatch() {
+	id := newID()
+	_, err := s.session.Put(id, "1", s.patient("Duck", "male"))
+	s.assertConflict(err)
+
+	_, err = s.session.Put(id, "", s.patient("Duck", "male"))
+	s.Require().NoError(err)
+
+	_, err = s.session.Put(id, "2", s.patient("Mouse", "male"))
+	s.assertConflict(err)
+
+	createdNew, err := s.session.Put(id, "1", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	s.False(createdNew)
+
+	resource, err := s.session.Get(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal("2", resource.VersionId())
+	s.Equal("Mouse", s.family(resource))
+}
+
+func (s *DALSuite) TestGetVersion() {
+	id := newID()
+	_, err := s.session.Put(id, "", s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	_, err = s.session.Put(id, "", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+
+	v1, err := s.session.GetVersion(id, "1", "Patient")
+	s.Require().NoError(err)
+	s.Equal("1", v1.VersionId())
+	s.Equal("Duck", s.family(v1))
+
+	v2, err := s.session.GetVersion(id, "2", "Patient")
+	s.Require().NoError(err)
+	s.Equal("2", v2.VersionId())
+	s.Equal("Mouse", s.family(v2))
+
+	_, err = s.session.GetVersion(id, "3", "Patient")
+	s.Equal(server.ErrNotFound, errors.Cause(err))
+}
+
+func (s *DALSuite) TestDeletedVersusNotFound() {
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+
+	newVersionId, err := s.session.Delete(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal("2", newVersionId)
+
+	_, err = s.session.Get(id, "Patient")
+	s.Equal(server.ErrDeleted, errors.Cause(err))
+	_, err = s.session.GetVersion(id, "2", "Patient")
+	s.Equal(server.ErrDeleted, errors.Cause(err))
+	_, err = s.session.GetVersion(id, "1", "Patient")
+	s.NoError(err)
+
+	_, err = s.session.Delete(newID(), "Patient")
+	s.Equal(server.ErrNotFound, errors.Cause(err))
+
+	// re-creating continues the version numbering
+	createdNew, err := s.session.Put(id, "", s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.True(createdNew)
+	resource, err := s.session.Get(id, "Patient")
+	s.Require().NoError(err)
+	s.Equal("3", resource.VersionId())
+}
+
+func (s *DALSuite) TestConditionalPut() {
+	query := search.Query{Resource: "Patient", Query: "family=Duck"}
+
+	id, createdNew, err := s.session.ConditionalPut(query, "", s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.True(createdNew)
+
+	id2, createdNew, err := s.session.ConditionalPut(query, "", s.patient("Duck", "female"))
+	s.Require().NoError(err)
+	s.False(createdNew)
+	s.Equal(id, id2)
+
+	_, err = s.session.Post(s.patient("Duck", "other"))
+	s.Require().NoError(err)
+
+	_, _, err = s.session.ConditionalPut(query, "", s.patient("Duck", "unknown"))
+	s.assertMultipleMatches(err)
+}
+
+func (s *DALSuite) TestConditionalPost() {
+	query := search.Query{Resource: "Patient", Query: "family=Duck"}
+
+	status, id, _, err := s.session.ConditionalPost(query, s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.Equal(201, status)
+
+	status, id2, existing, err := s.session.ConditionalPost(query, s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.Equal(200, status)
+	s.Equal(id, id2)
+	s.Equal(id, existing.Id())
+
+	_, err = s.session.Post(s.patient("Duck", "female"))
+	s.Require().NoError(err)
+
+	status, _, _, err = s.session.ConditionalPost(query, s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.Equal(412, status)
+}
+
+func (s *DALSuite) TestConditionalDelete() {
+	duck1, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	duck2, err := s.session.Post(s.patient("Duck", "female"))
+	s.Require().NoError(err)
+	mouse, err := s.session.Post(s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+
+	// unlike ConditionalPut, deleting multiple matches is allowed
+	count, err := s.session.ConditionalDelete(search.Query{Resource: "Patient", Query: "family=Duck"})
+	s.Require().NoError(err)
+	s.Equal(int64(2), count)
+
+	for _, id := range []string{duck1, duck2} {
+		_, err = s.session.Get(id, "Patient")
+		s.Equal(server.ErrDeleted, errors.Cause(err))
+	}
+	_, err = s.session.Get(mouse, "Patient")
+	s.NoError(err)
+
+	count, err = s.session.ConditionalDelete(search.Query{Resource: "Patient", Query: "family=Duck"})
+	s.Require().NoError(err)
+	s.Equal(int64(0), count)
+}
+
+func (s *DALSuite) TestHistoryOrdering() {
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	_, err = s.session.Put(id, "", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	_, err = s.session.Delete(id, "Patient")
+	s.Require().NoError(err)
+
+	baseURL, _ := url.Parse("http://localhost/")
+	bundle, err := s.session.History(*baseURL, search.Query{Resource: "Patient"}, id)
+	s.Require().NoError(err)
+	s.Require().Len(bundle.Entry, 3)
+	s.Require().NotNil(bundle.Total)
+	s.Equal(uint32(3), *bundle.Total)
+
+	// newest first
+	s.Equal("DELETE", bundle.Entry[0].Request.Method)
+	s.Nil(bundle.Entry[0].Resource)
+	s.Equal("PUT", bundle.Entry[1].Request.Method)
+	s.Equal("2", bundle.Entry[1].Resource.VersionId())
+	s.Equal("POST", bundle.Entry[2].Request.Method)
+	s.Equal("1", bundle.Entry[2].Resource.VersionId())
+	s.Equal("http://localhost/Patient/"+id, bundle.Entry[0].FullUrl)
+
+	_, err = s.session.History(*baseURL, search.Query{Resource: "Patient"}, newID())
+	s.Equal(server.ErrNotFound, errors.Cause(err))
+}
+
+func (s *DALSuite) TestHistoryPaging() {
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	// meta.lastUpdated only has a precision of seconds
+	between := url.QueryEscape(waitForNextSecond().UTC().Format(time.RFC3339))
+	waitForNextSecond()
+	_, err = s.session.Put(id, "", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	_, err = s.session.Put(id, "", s.patient("Mouse", "female"))
+	s.Require().NoError(err)
+
+	baseURL, _ := url.Parse("http://localhost/")
+	history := func(query string) (versions []string, links map[string]string) {
+		bundle, err := s.session.History(*baseURL, search.Query{Resource: "Patient", Query: query}, id)
+		s.Require().NoError(err, query)
+		for _, entry := range bundle.Entry {
+			versions = append(versions, entry.Request.Method+" "+entry.Resource.VersionId())
+		}
+		links = make(map[string]string)
+		for _, link := range bundle.Link {
+			links[link.Relation] = link.Url
+		}
+		return
+	}
+
+	versions, links := history("_count=2")
+	s.Equal([]string{"PUT 3", "PUT 2"}, versions)
+	s.Contains(links["next"], "http://localhost/Patient/"+id+"/_history?")
+	s.Contains(links["next"], "_offset=2")
+
+	versions, links = history("_count=2&_offset=2")
+	s.Equal([]string{"POST 1"}, versions)
+	s.NotContains(links, "next")
+
+	versions, _ = history("_since=" + between)
+	s.Equal([]string{"PUT 3", "PUT 2"}, versions)
+
+	versions, _ = history("_at=" + between)
+	s.Equal([]string{"POST 1"}, versions)
+
+	// a resource without versions in the time range still exists
+	bundle, err := s.session.History(*baseURL, search.Query{Resource: "Patient", Query: "_since=2100-01-01"}, id)
+	s.Require().NoError(err)
+	s.Empty(bundle.Entry)
+}
+
+// waitForNextSecond sleeps until the start of the next second and returns it
+func waitForNextSecond() time.Time {
+	next := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(next) + 10*time.Millisecond)
+	return next
+}
+
+func (s *DALSuite) TestHistoryAll() {
+	patientID, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	// meta.lastUpdated only has a precision of seconds
+	between := url.QueryEscape(waitForNextSecond().UTC().Format(time.RFC3339))
+	waitForNextSecond()
+	_, err = s.session.Put(patientID, "", s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	organization, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Organization", "name": "Acme"}`))
+	s.Require().NoError(err)
+	organizationID, err := s.session.Post(organization)
+	s.Require().NoError(err)
+
+	baseURL, _ := url.Parse("http://localhost/")
+	requests := func(bundle *models2.ShallowBundle) []string {
+		var requests []string
+		for _, entry := range bundle.Entry {
+			requests = append(requests, entry.Request.Method+" "+entry.Request.Url)
+		}
+		return requests
+	}
+
+	bundle, err := s.session.HistoryAll(*baseURL, search.Query{Resource: "Patient"})
+	s.Require().NoError(err)
+	s.Equal("history", bundle.Type)
+	s.Equal([]string{"PUT Patient/" + patientID, "POST Patient"}, requests(bundle))
+	s.Equal("http://localhost/Patient/"+patientID, bundle.Entry[0].FullUrl)
+
+	// newest first across resource types
+	bundle, err = s.session.HistoryAll(*baseURL, search.Query{})
+	s.Require().NoError(err)
+	s.Equal([]string{"POST Organization", "PUT Patient/" + patientID, "POST Patient"}, requests(bundle))
+	s.Equal(organizationID, bundle.Entry[0].Resource.Id())
+
+	bundle, err = s.session.HistoryAll(*baseURL, search.Query{Query: "_since=" + between})
+	s.Require().NoError(err)
+	s.Equal([]string{"POST Organization", "PUT Patient/" + patientID}, requests(bundle))
+
+	bundle, err = s.session.HistoryAll(*baseURL, search.Query{Query: "_at=" + between})
+	s.Require().NoError(err)
+	s.Equal([]string{"POST Patient"}, requests(bundle))
+	s.Equal("1", bundle.Entry[0].Resource.VersionId())
+
+	bundle, err = s.session.HistoryAll(*baseURL, search.Query{Query: "_count=2&_offset=2"})
+	s.Require().NoError(err)
+	s.Equal([]string{"POST Patient"}, requests(bundle))
+	s.Require().NotNil(bundle.Total)
+	s.Equal(uint32(3), *bundle.Total)
+	links := make(map[string]string)
+	for _, link := range bundle.Link {
+		links[link.Relation] = link.Url
+	}
+	s.Contains(links["previous"], "http://localhost/_history?")
+	s.Contains(links["previous"], "_offset=0")
+	s.NotContains(links, "next")
+}
+
+func (s *DALSuite) TestFindIDsIgnoresOptions() {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id := newID()
+		s.Require().NoError(s.session.PostWithID(id, s.patient("Duck", "male")))
+		ids = append(ids, id)
+	}
+	_, err := s.session.Post(s.patient("Mouse", "male"))
+	s.Require().NoError(err)
+	sort.Strings(ids)
+
+	// conditional operations need to see every match
+	for _, query := range []string{
+		"family=Duck&_count=2",
+		"family=Duck&_count=2&_offset=4&_sort=_id",
+		"family=Duck&_include=Patient:organization&_summary=count",
+	} {
+		found, err := s.session.FindIDs(search.Query{Resource: "Patient", Query: query})
+		s.Require().NoError(err)
+		sort.Strings(found)
+		s.Equal(ids, found, query)
+	}
+
+	_, _, err = s.session.ConditionalPut(search.Query{Resource: "Patient", Query: "family=Duck&_count=1"}, "", s.patient("Duck", "female"))
+	s.assertMultipleMatches(err)
+}
+
+func (s *DALSuite) TestSearchBundle() {
+	for i := 0; i < 3; i++ {
+		_, err := s.session.Post(s.patient("Duck", "male"))
+		s.Require().NoError(err)
+	}
+
+	baseURL, _ := url.Parse("http://localhost/Patient")
+	bundle, err := s.session.Search(*baseURL, search.Query{Resource: "Patient", Query: "family=Duck&_count=2"})
+	s.Require().NoError(err)
+	s.Equal("searchset", bundle.Type)
+	s.Require().NotNil(bundle.Total)
+	s.Equal(uint32(3), *bundle.Total)
+	s.Len(bundle.Entry, 2)
+	for _, entry := range bundle.Entry {
+		s.Equal("match", entry.Search.Mode)
+	}
+}
+
+// resource creates a resource with the given id
+func (s *DALSuite) resource(id string, json string) {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	s.Require().NoError(err)
+	s.Require().NoError(s.session.PostWithID(id, resource))
+}
+
+// searchIDs runs a search and returns the ids of its matches and its included resources
+func (s *DALSuite) searchIDs(resourceType string, query string) (matches []string, included []string) {
+	baseURL, _ := url.Parse("http://localhost/" + resourceType)
+	bundle, err := s.session.Search(*baseURL, search.Query{Resource: resourceType, Query: query})
+	s.Require().NoError(err, "%s?%s", resourceType, query)
+	for _, entry := range bundle.Entry {
+		if entry.Search.Mode == "match" {
+			matches = append(matches, entry.Resource.Id())
+		} else {
+			included = append(included, entry.Resource.ResourceType()+"/"+entry.Resource.Id())
+		}
+	}
+	return
+}
+
+func (s *DALSuite) TestSearchParameters() {
+	duck, mouse := newID(), newID()
+	weight, height := newID(), newID()
+	s.resource(duck, `{
+		"resourceType": "Patient",
+		"identifier": [{ "system": "http://acme.org/mrn", "value": "1001" }],
+		"active": true,
+		"name": [{ "family": "Duck", "given": ["Donald"] }],
+		"gender": "male",
+		"birthDate": "1980-05-01"
+	}`)
+	s.resource(mouse, `{
+		"resourceType": "Patient",
+		"name": [{ "family": "Mouse", "given": ["Minnie"] }],
+		"gender": "female",
+		"birthDate": "1990-01-01"
+	}`)
+	s.resource(weight, `{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": { "coding": [{ "system": "http://loinc.org", "code": "29463-7", "display": "Body weight" }] },
+		"subject": { "reference": "Patient/`+duck+`" },
+		"effectiveDateTime": "2018-01-01T10:00:00Z",
+		"valueQuantity": { "value": 90, "unit": "kg", "system": "http://unitsofmeasure.org", "code": "kg" }
+	}`)
+	s.resource(height, `{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": { "coding": [{ "system": "http://loinc.org", "code": "8302-2" }], "text": "Body height" },
+		"subject": { "reference": "Patient/`+mouse+`" },
+		"effectiveDateTime": "2018-06-01T10:00:00Z",
+		"valueQuantity": { "value": 170, "unit": "cm", "system": "http://unitsofmeasure.org", "code": "cm" }
+	}`)
+
+	tests := []struct {
+		resourceType string
+		query        string
+		expected     []string
+	}{
+		{"Patient", "family=duck", []string{duck}},
+		{"Patient", "name=Minn", []string{mouse}},
+		{"Patient", "family:exact=Duck", []string{duck}},
+		{"Patient", "family:exact=duck", nil},
+		{"Patient", "family:contains=ous", []string{mouse}},
+		{"Patient", "gender=female", []string{mouse}},
+		{"Patient", "gender:not=male", []string{mouse}},
+		{"Patient", "active:missing=true", []string{mouse}},
+		{"Patient", "identifier=http://acme.org/mrn|1001", []string{duck}},
+		{"Patient", "birthdate=lt1985", []string{duck}},
+		{"Patient", "birthdate=ge1990-01-01", []string{mouse}},
+		{"Patient", "_id=" + mouse, []string{mouse}},
+		{"Patient", "_has:Observation:patient:code=8302-2", []string{mouse}},
+		{"Observation", "code=http://loinc.org|29463-7", []string{weight}},
+		{"Observation", "code:text=body", []string{weight, height}},
+		{"Observation", "code:text=body h", []string{height}},
+		{"Observation", "code:text=weight", nil},
+		{"Observation", "subject=Patient/" + duck, []string{weight}},
+		{"Observation", "patient.family=Mouse", []string{height}},
+		{"Observation", "date=ge2018-03-01", []string{height}},
+		{"Observation", "value-quantity=gt70|http://unitsofmeasure.org|kg", []string{weight}},
+		{"Observation", "value-quantity=90", []string{weight}},
+		{"Observation", "value-quantity=gt100", []string{height}},
+		{"Observation", "_sort=date", []string{weight, height}},
+		{"Observation", "_sort=-date", []string{height, weight}},
+	}
+	for _, test := range tests {
+		matches, _ := s.searchIDs(test.resourceType, test.query)
+		s.Equal(test.expected, matches, "%s?%s", test.resourceType, test.query)
+	}
+
+	matches, included := s.searchIDs("Observation", "code=8302-2&_include=Observation:patient")
+	s.Equal([]string{height}, matches)
+	s.Equal([]string{"Patient/" + mouse}, included)
+
+	matches, included = s.searchIDs("Patient", "_id="+duck+"&_revinclude=Observation:patient")
+	s.Equal([]string{duck}, matches)
+	s.Equal([]string{"Observation/" + weight}, included)
+}
+
+func (s *DALSuite) TestTransactionRollback() {
+	s.Require().NoError(s.session.StartTransaction())
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.session.Finish()
+
+	_, err = s.session.Get(id, "Patient")
+	s.Equal(server.ErrNotFound, errors.Cause(err))
+}
+
+func (s *DALSuite) TestTransactionCommit() {
+	s.Require().NoError(s.session.StartTransaction())
+	id, err := s.session.Post(s.patient("Duck", "male"))
+	s.Require().NoError(err)
+	s.Require().NoError(s.session.CommmitIfTransaction())
+
+	_, err = s.session.Get(id, "Patient")
+	s.NoError(err)
+}
@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eug48/fhir/server"
+	"github.com/eug48/fhir/server/daltest"
+	"github.com/lib/pq"
+	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryDALConformance(t *testing.T) {
+	daltest.Run(t, func() server.DataAccessLayer {
+		return server.NewMemoryDataAccessLayer("fhir", false, "", make(map[string]server.InterceptorList), server.DefaultConfig)
+	})
+}
+
+func TestMongoDALConformance(t *testing.T) {
+	client, err := mongowrapper.Connect(context.Background(), options.Client().ApplyURI(server.DefaultConfig.DatabaseURI))
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %+v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Skipf("MongoDB not available: %+v", err)
+	}
+
+	const dbName = "fhir-conformance-test"
+	db := client.Database(dbName)
+	defer db.Drop(context.Background())
+
+	daltest.Run(t, func() server.DataAccessLayer {
+		if err := db.Drop(context.Background()); err != nil {
+			t.Fatalf("dropping %s: %+v", dbName, err)
+		}
+		server.CreateCollections(db)
+		return server.NewMongoDataAccessLayer(client, dbName, false, "", make(map[string]server.InterceptorList), server.DefaultConfig)
+	})
+}
+
+func TestPostgresDALConformance(t *testing.T) {
+	postgresURL := os.Getenv("POSTGRES_URL")
+	if postgresURL == "" {
+		t.Skip("POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		t.Fatalf("connecting to PostgreSQL: %+v", err)
+	}
+	defer db.Close()
+
+	const schema = "fhir_conformance_test"
+	dropSchema := func() {
+		if _, err := db.Exec("DROP SCHEMA IF EXISTS " + pq.QuoteIdentifier(schema) + " CASCADE"); err != nil {
+			t.Fatalf("dropping %s: %+v", schema, err)
+		}
+	}
+	dropSchema()
+	defer dropSchema()
+	if err := server.CreatePostgresSchema(context.Background(), db, schema); err != nil {
+		t.Fatalf("creating %s: %+v", schema, err)
+	}
+
+	// emptying the tables is much faster than re-creating them for every test
+	var tables string
+	err = db.QueryRow("SELECT string_agg(quote_ident(schemaname) || '.' || quote_ident(tablename), ', ') FROM pg_tables WHERE schemaname = $1", schema).Scan(&tables)
+	if err != nil {
+		t.Fatalf("listing tables of %s: %+v", schema, err)
+	}
+
+	daltest.Run(t, func() server.DataAccessLayer {
+		if _, err := db.Exec("TRUNCATE " + tables); err != nil {
+			t.Fatalf("emptying %s: %+v", schema, err)
+		}
+		return server.NewPostgresDataAccessLayer(db, schema, false, "", make(map[string]server.InterceptorList), server.DefaultConfig)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/url"
+	"time"
 
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
@@ -46,11 +47,23 @@ type DataAccessSession interface {
 	// Search executes a search given the baseURL and searchQuery.
 	Search(baseURL url.URL, searchQuery search.Query) (bundle *models2.ShallowBundle, err error)
 	// FindIDs executes a search given the searchQuery and returns only the matching IDs.  This function ignores
-	// search options that don't make sense in this context: _include, _revinclude, _summary, _elements, _contained,
-	// and _containedType.  It honors search options such as _count, _sort, and _offset.
+	// all search options, including _count, _sort and _offset, so that they can't hide multiple matches from
+	// conditional operations.  At most the default page size of IDs is returned.
 	FindIDs(searchQuery search.Query) (result []string, err error)
-	// History executes the history operation (partial support)
-	History(baseURL url.URL, resoureType string, id string) (bundle *models2.ShallowBundle, err error)
+	// History executes the history operation on the resource with the given id and type historyQuery.Resource.
+	// baseURL is the root of the server. Supports the _since, _at, _count and _offset options.
+	History(baseURL url.URL, historyQuery search.Query, id string) (bundle *models2.ShallowBundle, err error)
+	// HistoryAll executes the type-level history operation, or the system-level one if historyQuery.Resource
+	// is empty. baseURL is the root of the server. Supports the _since, _at, _count and _offset options.
+	HistoryAll(baseURL url.URL, historyQuery search.Query) (bundle *models2.ShallowBundle, err error)
+	// Export calls handler with the current version of every resource of the given type, or only of those
+	// last updated at or after since if it isn't zero. Resources are read one at a time so that whole
+	// collections aren't loaded into memory. Stops and returns the error if handler returns one.
+	Export(resourceType string, since time.Time, handler func(resource *models2.Resource) error) error
+	// Rekey re-encrypts the current and previous versions of resources of the given type that were encrypted
+	// with another key than the keyring's current key (see models2.SetKeyring), returning how many versions
+	// were re-encrypted. Versions are processed batchSize at a time so that the database remains available.
+	Rekey(resourceType string, batchSize int) (count int, err error)
 }
 
 // ErrNotFound indicates that the resource was not found (HTTP 404)
@@ -59,6 +72,9 @@ var ErrNotFound = errors.New("Resource Not Found")
 // ErrDeleted indicates that the resource has been deleted (HTTP 410)
 var ErrDeleted = errors.New("Resource deleted")
 
+// ErrForbidden indicates that the session isn't allowed to access the resource (HTTP 403)
+var ErrForbidden = errors.New("Access to the resource is forbidden")
+
 // ErrMultipleMatches indicates that the conditional update query returned multiple matches
 type ErrMultipleMatches struct {
 	msg string
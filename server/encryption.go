@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// encryptionPolicies are the field-level encryption policies in Config.EncryptionPolicyFile: a default policy
+// and, with EnableMultiDB, policies that replace it for particular databases (tenants), e.g.
+//
+//	{
+//	  "paths": ["Patient.name", "Patient.birthDate", "Observation.value[x]", "RelatedPerson.name"],
+//	  "identifierSystems": { "Patient": ["http://ns.electronichealth.net.au/id/hi/mc"] },
+//	  "databases": {
+//	    "tenant1_fhir": { "paths": ["Patient.name"] }
+//	  }
+//	}
+type encryptionPolicies struct {
+	models2.EncryptionPolicy
+	Databases map[string]*models2.EncryptionPolicy `json:"databases"`
+}
+
+// loadEncryptionPolicies reads and validates an encryption policy file
+func loadEncryptionPolicies(path string) (*encryptionPolicies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "loadEncryptionPolicies")
+	}
+	var policies encryptionPolicies
+	if err = json.Unmarshal(data, &policies); err != nil {
+		return nil, errors.Wrapf(err, "loadEncryptionPolicies: failed to parse %s", path)
+	}
+	if err = policies.EncryptionPolicy.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "loadEncryptionPolicies: invalid default policy in %s", path)
+	}
+	for dbName, policy := range policies.Databases {
+		if policy == nil {
+			return nil, errors.Errorf("loadEncryptionPolicies: missing policy for database %s in %s", dbName, path)
+		}
+		if err = policy.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "loadEncryptionPolicies: invalid policy for database %s in %s", dbName, path)
+		}
+	}
+	return &policies, nil
+}
+
+// encryptingDataAccessLayer applies the encryption policy of each database to the resources written to it
+type encryptingDataAccessLayer struct {
+	DataAccessLayer
+	policies      *encryptionPolicies
+	defaultDbName string
+	enableMultiDB bool
+}
+
+func newEncryptingDataAccessLayer(dal DataAccessLayer, policies *encryptionPolicies, config Config) DataAccessLayer {
+	return &encryptingDataAccessLayer{
+		DataAccessLayer: dal,
+		policies:        policies,
+		defaultDbName:   config.DefaultDatabaseName,
+		enableMultiDB:   config.EnableMultiDB,
+	}
+}
+
+func (dal *encryptingDataAccessLayer) StartSession(ctx context.Context, dbname string) DataAccessSession {
+	session := dal.DataAccessLayer.StartSession(ctx, dbname)
+	if !dal.enableMultiDB || dbname == "" {
+		dbname = dal.defaultDbName
+	}
+	policy, found := dal.policies.Databases[dbname]
+	if !found {
+		policy = &dal.policies.EncryptionPolicy
+	}
+	return &encryptingDataAccessSession{DataAccessSession: session, policy: policy}
+}
+
+type encryptingDataAccessSession struct {
+	DataAccessSession
+	policy *models2.EncryptionPolicy
+}
+
+func (s *encryptingDataAccessSession) encrypt(resource *models2.Resource) {
+	whatToEncrypt := resource.WhatToEncrypt()
+	whatToEncrypt.Policy = s.policy
+	resource.SetWhatToEncrypt(whatToEncrypt)
+}
+
+func (s *encryptingDataAccessSession) Post(resource *models2.Resource) (id string, err error) {
+	s.encrypt(resource)
+	return s.DataAccessSession.Post(resource)
+}
+
+func (s *encryptingDataAccessSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	s.encrypt(resource)
+	return s.DataAccessSession.ConditionalPost(query, resource)
+}
+
+func (s *encryptingDataAccessSession) PostWithID(id string, resource *models2.Resource) error {
+	s.encrypt(resource)
+	return s.DataAccessSession.PostWithID(id, resource)
+}
+
+func (s *encryptingDataAccessSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	s.encrypt(resource)
+	return s.DataAccessSession.Put(id, conditionalVersionId, resource)
+}
+
+func (s *encryptingDataAccessSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	s.encrypt(resource)
+	return s.DataAccessSession.ConditionalPut(query, conditionalVersionId, resource)
+}
+
+// rekeyBlob re-encrypts a resource stored as GoFHIR BSON with the current key,
+// returning nil if it wasn't encrypted with another key
+func rekeyBlob(blob []byte) ([]byte, error) {
+	if !bytes.Contains(blob, []byte("__gofhirEncryptionKeyId")) {
+		return nil, nil
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(blob, &doc); err != nil {
+		return nil, errors.Wrap(err, "rekeyBlob: bson.Unmarshal failed")
+	}
+	rekeyed, err := models2.RekeyBSON(doc)
+	if err != nil || !rekeyed {
+		return nil, err
+	}
+	newBlob, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "rekeyBlob: bson.Marshal failed")
+	}
+	return newBlob, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+)
+
+type EncryptionSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&EncryptionSuite{})
+
+func (s *EncryptionSuite) SetUpTest(c *C) {
+	os.Setenv("GOFHIR_ENCRYPTION_KEY_ID", "testKey1")
+	os.Setenv("GOFHIR_ENCRYPTION_KEY_BASE64", "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=")
+
+	policyFile := filepath.Join(c.MkDir(), "encryption.json")
+	err := ioutil.WriteFile(policyFile, []byte(`{
+		"paths": ["Observation.value[x]", "RelatedPerson.name"],
+		"identifierSystems": { "Patient": ["http://example.com/secret"] },
+		"databases": {
+			"tenant1_fhir": { "paths": ["Observation.code"] }
+		}
+	}`), 0600)
+	c.Assert(err, IsNil)
+
+	s.server = newMemoryTestServer(func(config *Config) {
+		config.EnableMultiDB = true
+		config.EncryptionPolicyFile = policyFile
+	})
+}
+
+// total returns the number of matches of a search
+func (s *EncryptionSuite) total(c *C, path string) int {
+	w := serve(s.server, "GET", path, "")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var bundle struct {
+		Total int `json:"total"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+	return bundle.Total
+}
+
+func (s *EncryptionSuite) TestPolicies(c *C) {
+	observation := `{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "weight"}, "valueString": "heavy"}`
+	for _, base := range []string{"", "/db/tenant1_fhir"} {
+		w := serve(s.server, "PUT", base+"/Observation/o1", observation)
+		c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+
+		// encrypted elements are returned but can't be searched
+		w = serve(s.server, "GET", base+"/Observation/o1", "")
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Body.String(), Matches, `(?s).*"valueString": ?"heavy".*`)
+		c.Assert(w.Body.String(), Matches, `(?s).*"text": ?"weight".*`)
+	}
+
+	// the default policy
+	c.Assert(s.total(c, "/Observation?value-string=heavy"), Equals, 0)
+	c.Assert(s.total(c, "/Observation?code:text=weight"), Equals, 1)
+	// the tenant's policy
+	c.Assert(s.total(c, "/db/tenant1_fhir/Observation?value-string=heavy"), Equals, 1)
+	c.Assert(s.total(c, "/db/tenant1_fhir/Observation?code:text=weight"), Equals, 0)
+
+	// identifiers with the policy's systems
+	w := serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1", "identifier": [
+		{"system": "http://example.com/public", "value": "123"},
+		{"system": "http://example.com/secret", "value": "987"}
+	]}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	c.Assert(s.total(c, "/Patient?identifier=http://example.com/public|123"), Equals, 1)
+	c.Assert(s.total(c, "/Patient?identifier=http://example.com/secret|987"), Equals, 0)
+	w = serve(s.server, "GET", "/Patient/p1", "")
+	c.Assert(w.Body.String(), Matches, `(?s).*"987".*`)
+
+	// batch entries and patches are encrypted too
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{ "resource": { "resourceType": "RelatedPerson", "id": "r1", "patient": { "reference": "Patient/p1" }, "name": [{ "family": "Smith" }] }, "request": { "method": "PUT", "url": "RelatedPerson/r1" } }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	c.Assert(s.total(c, "/RelatedPerson?name=Smith"), Equals, 0)
+	w = serve(s.server, "PATCH", "/Observation/o1", `[{"op": "replace", "path": "/valueString", "value": "light"}]`, "Content-Type", "application/json-patch+json")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	c.Assert(s.total(c, "/Observation?value-string=light"), Equals, 0)
+}
+
+func (s *EncryptionSuite) TestInvalidPolicy(c *C) {
+	policyFile := filepath.Join(c.MkDir(), "encryption.json")
+	c.Assert(ioutil.WriteFile(policyFile, []byte(`{"paths": ["Observation.value.code"]}`), 0600), IsNil)
+	_, err := loadEncryptionPolicies(policyFile)
+	c.Assert(err, ErrorMatches, ".*isn't of a top-level element.*")
+
+	c.Assert(ioutil.WriteFile(policyFile, []byte(`{"databases": {"tenant1_fhir": {"paths": ["Observation.foo"]}}}`), 0600), IsNil)
+	_, err = loadEncryptionPolicies(policyFile)
+	c.Assert(err, ErrorMatches, ".*tenant1.*unknown element.*")
+}
+
+func (s *EncryptionSuite) TestRekey(c *C) {
+	defer models2.SetKeyring(nil)
+
+	keyfile := filepath.Join(c.MkDir(), "keys.json")
+	writeKeyfile := func(keys string) {
+		c.Assert(ioutil.WriteFile(keyfile, []byte(keys), 0600), IsNil)
+		keyring, err := models2.LoadKeyring(keyfile)
+		c.Assert(err, IsNil)
+		models2.SetKeyring(keyring)
+	}
+	c.Assert(ioutil.WriteFile(keyfile, []byte(`{"current": "key1", "keys": {"key1": "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k="}}`), 0600), IsNil)
+
+	config := s.server.Config
+	config.EncryptionKeyfile = keyfile
+	dal := NewServer(config).initDAL()
+	session := dal.StartSession(context.Background(), "")
+	defer session.Finish()
+
+	for _, value := range []string{"heavy", "light"} {
+		observation, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "weight"}, "valueString": "` + value + `"}`))
+		c.Assert(err, IsNil)
+		_, err = session.Put("o1", "", observation)
+		c.Assert(err, IsNil)
+	}
+
+	// resources encrypted with key1 can still be read after key2 becomes the current key
+	writeKeyfile(`{"current": "key2", "keys": {
+		"key1": "9PM6OC+IlpvbIaS7VSxk1Q4kwe3RH4p5XertTYej46k=",
+		"key2": "SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E="
+	}}`)
+	_, err := session.GetVersion("o1", "1", "Observation")
+	c.Assert(err, IsNil)
+
+	// the current version is also stored in the history
+	count, err := session.Rekey("Observation", 1)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 3)
+	count, err = session.Rekey("Observation", 1)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+
+	// key1 is no longer needed
+	writeKeyfile(`{"current": "key2", "keys": {"key2": "SpVPcKb1n4JH4Gm1FV1OJ0A1V9H1hFlbxh9EMQMyD7E="}}`)
+	resource, err := session.Get("o1", "Observation")
+	c.Assert(err, IsNil)
+	c.Assert(string(resource.JsonBytes()), Matches, `(?s).*"light".*`)
+	resource, err = session.GetVersion("o1", "1", "Observation")
+	c.Assert(err, IsNil)
+	c.Assert(string(resource.JsonBytes()), Matches, `(?s).*"heavy".*`)
+
+	c.Assert(NewServer(config).Rekey(nil, 0), ErrorMatches, ".*invalid batch size.*")
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/terminology"
 	"github.com/pkg/errors"
 )
 
@@ -21,12 +22,52 @@ func ErrorToOpOutcome(err interface{}) (statusCode int, outcome *models.Operatio
 		cause := errors.Cause(x)
 		_, isSchemaError := cause.(models2.FhirSchemaError)
 		_, isVersionConflict := cause.(ErrConflict)
+		_, isInvalidPatch := cause.(ErrInvalidPatch)
+		_, isInvalidProvenance := cause.(ErrInvalidProvenance)
+		_, isPatchFailure := cause.(ErrPatchFailed)
+		_, isMultipleMatches1 := cause.(ErrMultipleMatches)
+		_, isMultipleMatches2 := cause.(*ErrMultipleMatches)
+		validationFailure, isValidationFailure := cause.(ErrValidationFailed)
+		terminologyError, isTerminologyError := cause.(*terminology.Error)
 		if isSchemaError {
 			outcome := models.NewOperationOutcome("fatal", "structure", cause.Error())
 			return http.StatusBadRequest, outcome
 		} else if isVersionConflict {
 			outcome := models.NewOperationOutcome("error", "conflict", cause.Error())
 			return http.StatusConflict, outcome // TODO (FHIR R4): changed to 412
+		} else if isInvalidPatch {
+			outcome := models.NewOperationOutcome("error", "invalid", cause.Error())
+			return http.StatusBadRequest, outcome
+		} else if isInvalidProvenance {
+			outcome := models.NewOperationOutcome("fatal", "value", cause.Error())
+			return http.StatusBadRequest, outcome
+		} else if isPatchFailure {
+			outcome := models.NewOperationOutcome("error", "processing", cause.Error())
+			return http.StatusUnprocessableEntity, outcome
+		} else if isValidationFailure {
+			return http.StatusUnprocessableEntity, validationFailure.Outcome
+		} else if isTerminologyError {
+			outcome := models.NewOperationOutcome("error", terminologyError.Code, terminologyError.Message)
+			switch terminologyError.Code {
+			case "not-found":
+				return http.StatusNotFound, outcome
+			case "invalid":
+				return http.StatusBadRequest, outcome
+			default:
+				return http.StatusUnprocessableEntity, outcome
+			}
+		} else if isMultipleMatches1 || isMultipleMatches2 {
+			outcome := models.NewOperationOutcome("error", "multiple-matches", cause.Error())
+			return http.StatusPreconditionFailed, outcome
+		} else if cause == ErrNotFound {
+			outcome := models.NewOperationOutcome("error", "not-found", cause.Error())
+			return http.StatusNotFound, outcome
+		} else if cause == ErrDeleted {
+			outcome := models.NewOperationOutcome("error", "deleted", cause.Error())
+			return http.StatusGone, outcome
+		} else if cause == ErrForbidden {
+			outcome := models.NewOperationOutcome("error", "forbidden", cause.Error())
+			return http.StatusForbidden, outcome
 		} else {
 			stacktrace := string(runtime_debug.Stack())
 			glog.Errorf("ErrorToOpOutcome: %+v\n%s", x, stacktrace)
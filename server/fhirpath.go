@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/fhirpath"
+	"github.com/eug48/fhir/models"
+)
+
+// FHIRPathHandler handles the $fhirpath debugging operation (POST /$fhirpath), which evaluates the
+// expression parameter against the resource parameter. References are resolved to the resources stored in the server.
+func FHIRPathHandler(dal DataAccessLayer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+		defer session.Finish()
+
+		body, err := FHIRBind(c, "")
+		if err != nil {
+			statusCode, oo := bindFailure(err)
+			c.Render(statusCode, CustomFhirRenderer{oo, c})
+			return
+		}
+		if body.ResourceType() != "Parameters" {
+			badFHIRPathRequest(c, "invalid", "$fhirpath requires a Parameters resource")
+			return
+		}
+		var parameters fhirpathParameters
+		if err = json.Unmarshal(body.JsonBytes(), &parameters); err != nil {
+			badFHIRPathRequest(c, "structure", "invalid Parameters: "+err.Error())
+			return
+		}
+
+		var expression string
+		var resourceJSON []byte
+		for _, parameter := range parameters.Parameter {
+			switch parameter.Name {
+			case "expression":
+				expression = parameter.ValueString
+			case "resource":
+				resourceJSON = parameter.Resource
+			}
+		}
+		if resourceJSON == nil {
+			badFHIRPathRequest(c, "required", "$fhirpath requires a resource parameter")
+			return
+		}
+		evaluateFHIRPath(c, session, expression, resourceJSON)
+	}
+}
+
+// FHIRPathInstanceHandler handles $fhirpath for a stored resource (GET /Patient/123/$fhirpath?expression=name.given)
+func (rc *ResourceController) FHIRPathInstanceHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	resource, err := session.Get(c.Param("id"), rc.Name)
+	if err != nil {
+		panic(errors.Wrap(err, "$fhirpath: Get failed"))
+	}
+	evaluateFHIRPath(c, session, c.Query("expression"), resource.JsonBytes())
+}
+
+// fhirpathParameters are the parameters of the $fhirpath operation
+type fhirpathParameters struct {
+	Parameter []struct {
+		Name        string          `json:"name"`
+		ValueString string          `json:"valueString"`
+		Resource    json.RawMessage `json:"resource"`
+	} `json:"parameter"`
+}
+
+func badFHIRPathRequest(c *gin.Context, code string, message string) {
+	oo := models.NewOperationOutcome("error", code, message)
+	c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+}
+
+// evaluateFHIRPath responds with a Parameters resource with the expression and a result parameter for each value
+func evaluateFHIRPath(c *gin.Context, session DataAccessSession, expressionText string, resourceJSON []byte) {
+	if strings.TrimSpace(expressionText) == "" {
+		badFHIRPathRequest(c, "required", "$fhirpath requires an expression")
+		return
+	}
+	expression, err := fhirpath.Compile(expressionText)
+	if err != nil {
+		badFHIRPathRequest(c, "invalid", err.Error())
+		return
+	}
+
+	resource, err := fhirpath.DecodeResource(resourceJSON)
+	if err != nil {
+		badFHIRPathRequest(c, "structure", err.Error())
+		return
+	}
+	options := &fhirpath.Options{Resolve: func(reference string) (map[string]interface{}, error) {
+		return resolveReference(session, reference)
+	}}
+	result, err := expression.Evaluate(resource, options)
+	if err != nil {
+		badFHIRPathRequest(c, "processing", errors.Cause(err).Error())
+		return
+	}
+
+	parameters := []interface{}{
+		map[string]interface{}{"name": "expression", "valueString": expressionText},
+	}
+	for _, value := range result {
+		parameters = append(parameters, fhirpathResultParameter(value))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{map[string]interface{}{
+		"resourceType": "Parameters",
+		"parameter":    parameters,
+	}, c})
+}
+
+// resolveReference returns a stored resource for a relative reference (e.g. Patient/123) or nil if there isn't one
+func resolveReference(session DataAccessSession, reference string) (map[string]interface{}, error) {
+	parts := strings.Split(reference, "/")
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	resource, err := session.Get(parts[1], parts[0])
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %s", reference)
+	}
+	return fhirpath.DecodeResource(resource.JsonBytes())
+}
+
+// fhirpathResultParameter describes a value with the parts type, location (for elements of the resource)
+// and value[x] (or resource for resources)
+func fhirpathResultParameter(value *fhirpath.Value) map[string]interface{} {
+	typeName := value.Type()
+	parts := []interface{}{
+		map[string]interface{}{"name": "type", "valueString": typeName},
+	}
+	if location := value.Location(); location != "" {
+		parts = append(parts, map[string]interface{}{"name": "location", "valueString": location})
+	}
+
+	data := value.JSON()
+	if data != nil {
+		name := typeName[strings.Index(typeName, ".")+1:]
+		if object, isObject := data.(map[string]interface{}); isObject && object["resourceType"] != nil {
+			parts = append(parts, map[string]interface{}{"name": "resource", "resource": object})
+		} else if valueName := valueXName(typeName, name); valueName != "" {
+			parts = append(parts, map[string]interface{}{"name": "value", valueName: data})
+		} else {
+			// backbone elements and elements of unknown types
+			encoded, _ := json.Marshal(data)
+			parts = append(parts, map[string]interface{}{"name": "value", "valueString": string(encoded)})
+		}
+	}
+	return map[string]interface{}{"name": "result", "part": parts}
+}
+
+// valueXName returns the name of the value[x] property for a type, e.g. valueHumanName for FHIR.HumanName
+// and valueInteger for System.Integer
+func valueXName(typeName string, name string) string {
+	if name == "" || name == "BackboneElement" || name == "Element" {
+		return ""
+	}
+	if strings.HasPrefix(typeName, "System.") {
+		switch name {
+		case "Boolean", "Integer", "Decimal", "String", "Date", "DateTime", "Time", "Quantity":
+			return "value" + name
+		}
+		return ""
+	}
+	return "value" + strings.ToUpper(name[:1]) + name[1:]
+}
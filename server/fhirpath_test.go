@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+type FHIRPathSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&FHIRPathSuite{})
+
+func (s *FHIRPathSuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(nil)
+}
+
+type fhirpathResponse struct {
+	ResourceType string `json:"resourceType"`
+	Parameter    []struct {
+		Name        string `json:"name"`
+		ValueString string `json:"valueString"`
+		Part        []map[string]interface{}
+	} `json:"parameter"`
+}
+
+func fhirpathResponseOf(c *C, w *httptest.ResponseRecorder) fhirpathResponse {
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var response fhirpathResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &response), IsNil)
+	c.Assert(response.ResourceType, Equals, "Parameters")
+	return response
+}
+
+func (s *FHIRPathSuite) TestSystemLevel(c *C) {
+	w := serve(s.server, "POST", "/$fhirpath", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{ "name": "expression", "valueString": "name.where(use = 'official') | birthDate | 1 + 1" },
+			{ "name": "resource", "resource": {
+				"resourceType": "Patient",
+				"name": [ { "use": "usual", "given": ["Jim"] }, { "use": "official", "family": "Chalmers" } ],
+				"birthDate": "1974-12-25"
+			} }
+		]
+	}`)
+	response := fhirpathResponseOf(c, w)
+	c.Assert(response.Parameter, HasLen, 4)
+	c.Assert(response.Parameter[0].Name, Equals, "expression")
+	c.Assert(response.Parameter[0].ValueString, Equals, "name.where(use = 'official') | birthDate | 1 + 1")
+
+	name := response.Parameter[1]
+	c.Assert(name.Name, Equals, "result")
+	c.Assert(name.Part, HasLen, 3)
+	c.Assert(name.Part[0]["valueString"], Equals, "FHIR.HumanName")
+	c.Assert(name.Part[1]["valueString"], Equals, "Patient.name[1]")
+	c.Assert(name.Part[2]["valueHumanName"], DeepEquals, map[string]interface{}{"use": "official", "family": "Chalmers"})
+
+	birthDate := response.Parameter[2]
+	c.Assert(birthDate.Part[0]["valueString"], Equals, "FHIR.date")
+	c.Assert(birthDate.Part[1]["valueString"], Equals, "Patient.birthDate")
+	c.Assert(birthDate.Part[2]["valueDate"], Equals, "1974-12-25")
+
+	sum := response.Parameter[3]
+	c.Assert(sum.Part, HasLen, 2)
+	c.Assert(sum.Part[0]["valueString"], Equals, "System.Integer")
+	c.Assert(sum.Part[1]["valueInteger"], Equals, float64(2))
+}
+
+func (s *FHIRPathSuite) TestInstanceLevel(c *C) {
+	w := serve(s.server, "PUT", "/Organization/org1", `{"resourceType": "Organization", "id": "org1", "name": "Gastroenterology"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1", "managingOrganization": {"reference": "Organization/org1"}}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+
+	w = serve(s.server, "GET", "/Patient/p1/$fhirpath?expression="+url.QueryEscape("managingOrganization.resolve()"), "")
+	response := fhirpathResponseOf(c, w)
+	c.Assert(response.Parameter, HasLen, 2)
+	resource := response.Parameter[1].Part[2]
+	c.Assert(resource["name"], Equals, "resource")
+	c.Assert(resource["resource"].(map[string]interface{})["name"], Equals, "Gastroenterology")
+
+	w = serve(s.server, "GET", "/Patient/p1/$fhirpath?expression="+url.QueryEscape("managingOrganization.resolve().name = 'Other'"), "")
+	response = fhirpathResponseOf(c, w)
+	c.Assert(response.Parameter[1].Part[1]["valueBoolean"], Equals, false)
+
+	w = serve(s.server, "GET", "/Patient/p2/$fhirpath?expression=id", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *FHIRPathSuite) TestInvalidExpressions(c *C) {
+	w := serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1", "name": [{"given": ["Jim"]}]}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	w = serve(s.server, "GET", "/Patient/p1/$fhirpath?expression="+url.QueryEscape("name.where(given = 'Jim'"), "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	outcome := outcomeOf(c, w)
+	c.Assert(outcome.Issue[0].Code, Equals, "invalid")
+
+	w = serve(s.server, "GET", "/Patient/p1/$fhirpath?expression=name.given1", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	outcome = outcomeOf(c, w)
+	c.Assert(outcome.Issue[0].Code, Equals, "processing")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "HumanName has no element given1")
+
+	w = serve(s.server, "GET", "/Patient/p1/$fhirpath", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	w = serve(s.server, "POST", "/$fhirpath", `{"resourceType": "Patient"}`)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
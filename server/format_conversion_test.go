@@ -6,6 +6,10 @@ import (
 	"io/ioutil"
 	"encoding/json"
 	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"github.com/gin-gonic/gin"
 	. "gopkg.in/check.v1"
 	"github.com/eug48/fhir/models"
 )
@@ -128,3 +132,40 @@ func areEqualXML(s1, s2 string) (bool, error) {
 
 	return reflect.DeepEqual(o1, o2), nil
 }
+
+func (s *FormatConversionSuite) TestXMLRequests(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	config := DefaultConfig
+	config.DatabaseBackend = DatabaseBackendMemory
+	config.DefaultDatabaseName = "fhir"
+	config.EnableXML = true
+	server := NewServer(config)
+	server.InitEngine()
+
+	body := `<Patient xmlns="http://hl7.org/fhir"><id value="123"/><name><given value="Peter"/><given id="g2"><extension url="http://example.org/ext"><valueCode value="unknown"/></extension></given></name><gender value="male"/></Patient>`
+	req := httptest.NewRequest("PUT", "/Patient/123", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/fhir+xml")
+	w := httptest.NewRecorder()
+	server.Engine.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	req = httptest.NewRequest("GET", "/Patient/123?_format=json", nil)
+	w = httptest.NewRecorder()
+	server.Engine.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"given":["Peter",null]`), Equals, true, Commentf(w.Body.String()))
+
+	req = httptest.NewRequest("GET", "/Patient/123", nil)
+	req.Header.Set("Accept", "application/fhir+xml")
+	w = httptest.NewRecorder()
+	server.Engine.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/fhir+xml; charset=utf-8")
+	c.Assert(strings.Contains(w.Body.String(), `<name><given value="Peter"/><given id="g2"><extension url="http://example.org/ext"><valueCode value="unknown"/></extension></given></name><gender value="male"/>`), Equals, true, Commentf(w.Body.String()))
+
+	req = httptest.NewRequest("POST", "/Patient", strings.NewReader(`<Patient xmlns="http://hl7.org/fhir"><foo value="bar"/></Patient>`))
+	req.Header.Set("Content-Type", "application/fhir+xml")
+	w = httptest.NewRecorder()
+	server.Engine.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SystemHistoryHandler handles requests for the history of all resources (GET /_history)
+func SystemHistoryHandler(dal DataAccessLayer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		historyAllHandler(c, dal, config, "")
+	}
+}
+
+// TypeHistoryHandler handles requests for the history of all resources of a type (GET /Patient/_history)
+func (rc *ResourceController) TypeHistoryHandler(c *gin.Context) {
+	c.Set("Resource", rc.Name)
+	historyAllHandler(c, rc.DAL, rc.Config, rc.Name)
+}
+
+func historyAllHandler(c *gin.Context, dal DataAccessLayer, config Config, resourceType string) {
+	defer handlePanics(c)
+	session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	c.Set("Action", "history")
+
+	historyQuery := search.Query{Resource: resourceType, Query: c.Request.URL.RawQuery}
+	baseURL := config.responseURL(c.Request)
+	bundle, err := session.HistoryAll(*baseURL, historyQuery)
+	if err == ErrNotFound {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(errors.Wrap(err, "History request failed"))
+	}
+
+	err = subsetBundle(bundle, historyQuery.HistoryOptions())
+	if err != nil {
+		panic(errors.Wrap(err, "subsetBundle failed"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// historyVersion is one version of a resource in a type or system-level history.
+// Backends first list versions without their content and then load the resources of a single page.
+type historyVersion struct {
+	resourceType string
+	id           string
+	versionId    int
+	lastUpdated  time.Time
+	deleted      bool
+	resource     *models2.Resource
+}
+
+// historyTimeRange returns the lastUpdated times of the versions that backends need to list for
+// the _since and _at options. A zero time means there is no bound.
+func historyTimeRange(options *search.QueryOptions) (from time.Time, to time.Time) {
+	if options.Since != nil {
+		from = options.Since.RangeLowIncl()
+	}
+	if options.At != nil {
+		// versions created after the _at period can't have been current during it
+		to = options.At.RangeHighExcl()
+	}
+	return
+}
+
+// selectHistoryVersions applies the _at option to the listed versions and sorts them newest first
+func selectHistoryVersions(versions []historyVersion, options *search.QueryOptions) []historyVersion {
+	if options.At != nil {
+		// a version was current until the next version of the resource was created
+		sort.Slice(versions, func(i, j int) bool {
+			a, b := versions[i], versions[j]
+			if a.resourceType != b.resourceType {
+				return a.resourceType < b.resourceType
+			}
+			if a.id != b.id {
+				return a.id < b.id
+			}
+			return a.versionId < b.versionId
+		})
+
+		atStart := options.At.RangeLowIncl()
+		selected := versions[:0]
+		for i, version := range versions {
+			hasNext := i+1 < len(versions) && versions[i+1].resourceType == version.resourceType && versions[i+1].id == version.id
+			if !hasNext || versions[i+1].lastUpdated.After(atStart) {
+				selected = append(selected, version)
+			}
+		}
+		versions = selected
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if !a.lastUpdated.Equal(b.lastUpdated) {
+			return a.lastUpdated.After(b.lastUpdated)
+		}
+		if a.resourceType != b.resourceType {
+			return a.resourceType < b.resourceType
+		}
+		if a.id != b.id {
+			return a.id < b.id
+		}
+		return a.versionId > b.versionId
+	})
+	return versions
+}
+
+// filterHistoryVersions applies the _since and _at options to listed versions and sorts them newest first.
+// It's used by backends that list every version of a resource, e.g. for the history of a single resource.
+func filterHistoryVersions(versions []historyVersion, options *search.QueryOptions) []historyVersion {
+	from, to := historyTimeRange(options)
+	inRange := versions[:0]
+	for _, version := range versions {
+		if (from.IsZero() || !version.lastUpdated.Before(from)) && (to.IsZero() || version.lastUpdated.Before(to)) {
+			inRange = append(inRange, version)
+		}
+	}
+	return selectHistoryVersions(inRange, options)
+}
+
+// historyPage returns the versions selected by the _offset and _count options
+func historyPage(versions []historyVersion, options *search.QueryOptions) []historyVersion {
+	start := options.Offset
+	if start > len(versions) {
+		start = len(versions)
+	}
+	end := start + options.Count
+	if end > len(versions) {
+		end = len(versions)
+	}
+	return versions[start:end]
+}
+
+// historyBundle builds the Bundle for a page of an instance, type or system-level history.
+// baseURL is the root of the server, i.e. without the resource type, and id is empty unless this
+// is the history of a single resource.
+func historyBundle(baseURL url.URL, historyQuery search.Query, id string, page []historyVersion, total uint32, countTotalResults bool) *models2.ShallowBundle {
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	entryList := make([]models2.ShallowBundleEntryComponent, len(page))
+	for i, version := range page {
+		entry := &entryList[i]
+		entry.FullUrl = baseURLstr + version.resourceType + "/" + version.id
+		entry.Request = &models.BundleEntryRequestComponent{
+			Url:    version.resourceType + "/" + version.id,
+			Method: "PUT",
+		}
+		if version.deleted {
+			entry.Request.Method = "DELETE"
+		} else {
+			entry.Resource = version.resource
+			if version.versionId == 1 {
+				entry.Request.Method = "POST"
+				entry.Request.Url = version.resourceType
+			}
+		}
+	}
+
+	bundle := &models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "history",
+		Entry: entryList,
+	}
+	if countTotalResults {
+		bundle.Total = &total
+	}
+
+	linksURL := baseURL
+	linksURL.Path = strings.TrimSuffix(linksURL.Path, "/") + "/"
+	if historyQuery.Resource != "" {
+		linksURL.Path += historyQuery.Resource + "/"
+		if id != "" {
+			linksURL.Path += id + "/"
+		}
+	}
+	linksURL.Path += "_history"
+	bundle.Link = generatePagingLinks(linksURL, historyQuery, total, uint32(len(page)), countTotalResults)
+
+	return bundle
+}
+
+// historyResourceTypes returns the resource types covered by a type or system-level history
+func historyResourceTypes(historyQuery search.Query) []string {
+	if historyQuery.Resource != "" {
+		return []string{historyQuery.Resource}
+	}
+	var resourceTypes []string
+	for resourceType := range search.SearchParameterDictionary {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
@@ -0,0 +1,770 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The in-memory backend keeps everything in Go maps and is intended for unit tests
+// and embedded use. Searches use the same index rows as the PostgreSQL backend.
+// A transaction holds its database's lock until it is committed or aborted,
+// so transactions are serialised and their changes can be undone on abort.
+
+type memoryDataAccessLayer struct {
+	defaultDbName                string
+	enableMultiDB                bool
+	dbSuffix                     string
+	Interceptors                 map[string]InterceptorList
+	countTotalResults            bool
+	enableCISearches             bool
+	tokenParametersCaseSensitive bool
+	enableHistory                bool
+
+	databasesLock sync.Mutex
+	databases     map[string]*memoryDatabase
+}
+
+type memoryDatabase struct {
+	lock    sync.Mutex
+	current search.MemoryCollections
+	// resource type -> id -> all versions (including the current one), oldest first
+	history map[string]map[string][]memoryVersion
+}
+
+type memoryVersion struct {
+	versionId   int
+	lastUpdated time.Time
+	deleted     bool
+	blob        []byte
+}
+
+type memorySession struct {
+	dal *memoryDataAccessLayer
+	db  *memoryDatabase
+
+	inTransaction bool
+	undo          []func()
+}
+
+// NewMemoryDataAccessLayer returns an implementation of DataAccessLayer that keeps all resources in memory
+func NewMemoryDataAccessLayer(defaultDbName string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
+	return &memoryDataAccessLayer{
+		defaultDbName:                defaultDbName,
+		enableMultiDB:                enableMultiDB,
+		dbSuffix:                     dbSuffix,
+		Interceptors:                 interceptors,
+		countTotalResults:            config.CountTotalResults,
+		enableCISearches:             config.EnableCISearches,
+		tokenParametersCaseSensitive: config.TokenParametersCaseSensitive,
+		enableHistory:                config.EnableHistory,
+		databases:                    make(map[string]*memoryDatabase),
+	}
+}
+
+func (dal *memoryDataAccessLayer) StartSession(ctx context.Context, customDbName string) DataAccessSession {
+	var dbName string
+	if dal.enableMultiDB && customDbName != "" {
+		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
+			panic(errors.Errorf("database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
+		}
+		dbName = customDbName
+	} else {
+		dbName = dal.defaultDbName
+	}
+
+	dal.databasesLock.Lock()
+	defer dal.databasesLock.Unlock()
+	db, exists := dal.databases[dbName]
+	if !exists {
+		db = &memoryDatabase{
+			current: make(search.MemoryCollections),
+			history: make(map[string]map[string][]memoryVersion),
+		}
+		dal.databases[dbName] = db
+	}
+
+	return &memorySession{
+		dal: dal,
+		db:  db,
+	}
+}
+
+func (ms *memorySession) StartTransaction() error {
+	if ms.inTransaction {
+		// sucess if already in a transaction
+		return nil
+	}
+	glog.V(3).Infof("StartTransaction")
+	ms.db.lock.Lock()
+	ms.inTransaction = true
+	return nil
+}
+
+func (ms *memorySession) CommmitIfTransaction() error {
+	if !ms.inTransaction {
+		return nil
+	}
+	glog.V(3).Infof("CommmitTransaction")
+	ms.undo = nil
+	ms.inTransaction = false
+	ms.db.lock.Unlock()
+	return nil
+}
+
+func (ms *memorySession) Finish() {
+	if ms.inTransaction {
+		glog.Warningf("Rollback called from memorySession.Finish")
+		for i := len(ms.undo) - 1; i >= 0; i-- {
+			ms.undo[i]()
+		}
+		ms.undo = nil
+		ms.inTransaction = false
+		ms.db.lock.Unlock()
+	}
+}
+
+// lock acquires the database lock unless the session's transaction already holds it
+func (ms *memorySession) lock() func() {
+	if ms.inTransaction {
+		return func() {}
+	}
+	ms.db.lock.Lock()
+	return ms.db.lock.Unlock
+}
+
+// write runs fn, undoing its changes if it fails or if the session's transaction is aborted
+func (ms *memorySession) write(fn func() error) error {
+	unlock := ms.lock()
+	defer unlock()
+
+	undoStart := len(ms.undo)
+	err := fn()
+	if err != nil {
+		for i := len(ms.undo) - 1; i >= undoStart; i-- {
+			ms.undo[i]()
+		}
+		ms.undo = ms.undo[:undoStart]
+	} else if !ms.inTransaction {
+		ms.undo = nil
+	}
+	return err
+}
+
+func (ms *memorySession) lookup(resourceType, id string) *search.MemoryResource {
+	return ms.db.current[resourceType][id]
+}
+
+func (ms *memorySession) versions(resourceType, id string) []memoryVersion {
+	return ms.db.history[resourceType][id]
+}
+
+// setCurrent stores (or deletes if nil) the current version of a resource
+func (ms *memorySession) setCurrent(resourceType, id string, stored *search.MemoryResource) {
+	collection, exists := ms.db.current[resourceType]
+	if !exists {
+		collection = make(map[string]*search.MemoryResource)
+		ms.db.current[resourceType] = collection
+	}
+
+	previous, hadPrevious := collection[id]
+	ms.undo = append(ms.undo, func() {
+		if hadPrevious {
+			collection[id] = previous
+		} else {
+			delete(collection, id)
+		}
+	})
+
+	if stored == nil {
+		delete(collection, id)
+	} else {
+		collection[id] = stored
+	}
+}
+
+func (ms *memorySession) addVersion(resourceType, id string, version memoryVersion) {
+	collection, exists := ms.db.history[resourceType]
+	if !exists {
+		collection = make(map[string][]memoryVersion)
+		ms.db.history[resourceType] = collection
+	}
+
+	previous, hadPrevious := collection[id]
+	ms.undo = append(ms.undo, func() {
+		if hadPrevious {
+			collection[id] = previous
+		} else {
+			delete(collection, id)
+		}
+	})
+
+	// copy so that the undo function's slice isn't modified
+	versions := make([]memoryVersion, len(previous), len(previous)+1)
+	copy(versions, previous)
+	collection[id] = append(versions, version)
+}
+
+func (ms *memorySession) Get(id, resourceType string) (resource *models2.Resource, err error) {
+	unlock := ms.lock()
+	defer unlock()
+
+	if stored := ms.lookup(resourceType, id); stored != nil {
+		return stored.Resource()
+	}
+
+	// check whether this is a deleted record
+	versions := ms.versions(resourceType, id)
+	if len(versions) > 0 && versions[len(versions)-1].deleted {
+		return nil, ErrDeleted
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *memorySession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
+	versionIdInt, err := strconv.Atoi(versionIdStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert versionId to an integer (%s)", versionIdStr)
+	}
+
+	unlock := ms.lock()
+	defer unlock()
+
+	// First assume versionId is for the current version
+	if stored := ms.lookup(resourceType, id); stored != nil {
+		resource, err = stored.Resource()
+		if err != nil || resource.VersionId() == versionIdStr {
+			return resource, err
+		}
+	}
+
+	// try to search for previous versions
+	for _, version := range ms.versions(resourceType, id) {
+		if version.versionId == versionIdInt {
+			if version.deleted {
+				return nil, ErrDeleted
+			}
+			return search.DecodePostgresResource(version.blob)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *memorySession) Post(resource *models2.Resource) (id string, err error) {
+	id = primitive.NewObjectID().Hex()
+	err = ms.PostWithID(id, resource)
+	return
+}
+
+func (ms *memorySession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	existingIds, err := ms.FindIDs(query)
+	if err != nil {
+		return
+	}
+
+	if len(existingIds) == 0 {
+		httpStatus = 201
+		id = primitive.NewObjectID().Hex()
+		err = ms.PostWithID(id, resource)
+		if err == nil {
+			outputResource = resource
+		}
+
+	} else if len(existingIds) == 1 {
+		httpStatus = 200
+		id = existingIds[0]
+		outputResource, err = ms.Get(id, query.Resource)
+
+	} else if len(existingIds) > 1 {
+		httpStatus = 412
+	}
+
+	return
+}
+
+func (ms *memorySession) PostWithID(id string, resource *models2.Resource) error {
+	resource.SetId(id)
+	updateResourceMeta(resource, 1)
+	resourceType := resource.ResourceType()
+
+	invokeInterceptorsBefore(ms.dal.Interceptors, "Create", resourceType, resource)
+
+	glog.V(3).Infof("PostWithID: inserting %s/%s", resourceType, id)
+	err := ms.write(func() error {
+		if ms.lookup(resourceType, id) != nil {
+			return ErrConflict{msg: fmt.Sprintf("duplicate key: %s/%s already exists", resourceType, id)}
+		}
+		return ms.writeResource(resource, 1)
+	})
+
+	if err == nil {
+		invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
+	} else {
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Create", resourceType, err, resource)
+	}
+
+	return err
+}
+
+func (ms *memorySession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	resourceType := resource.ResourceType()
+	resource.SetId(id)
+	if conditionalVersionId != "" {
+		glog.V(3).Infof("PUT %s/%s (If-Match %s)", resourceType, id, conditionalVersionId)
+	} else {
+		glog.V(3).Infof("PUT %s/%s", resourceType, id)
+	}
+
+	if !ms.dal.enableHistory && conditionalVersionId != "" {
+		return false, errors.Errorf("If-Match specified for a conditional put, but version histories are disabled")
+	}
+
+	err = ms.write(func() error {
+		var curVersionId int
+		current := ms.lookup(resourceType, id)
+		if current == nil {
+			if conditionalVersionId != "" {
+				return ErrConflict{msg: "If-Match specified for a resource that doesn't exist"}
+			}
+			createdNew = true
+			// continue the numbering of any deleted versions
+			if versions := ms.versions(resourceType, id); len(versions) > 0 {
+				curVersionId = versions[len(versions)-1].versionId
+			}
+		} else {
+			currentResource, err := current.Resource()
+			if err != nil {
+				return errors.Wrap(err, "Put: error decoding current version")
+			}
+			curVersionId, err = strconv.Atoi(currentResource.VersionId())
+			if err != nil {
+				return errors.Wrapf(err, "Put: current versionId is not an integer (%s)", currentResource.VersionId())
+			}
+			if conditionalVersionId != "" && conditionalVersionId != currentResource.VersionId() {
+				return ErrConflict{msg: "If-Match doesn't match current versionId"}
+			}
+			if hasInterceptorsForOpAndType(ms.dal.Interceptors, "Update", resourceType) {
+				invokeInterceptorsBefore(ms.dal.Interceptors, "Update", resourceType, currentResource)
+			}
+		}
+
+		newVersionId := curVersionId + 1
+		glog.V(3).Infof("  versionIds: current %d; new %d", curVersionId, newVersionId)
+		updateResourceMeta(resource, newVersionId)
+		return ms.writeResource(resource, newVersionId)
+	})
+
+	if err == nil {
+		if createdNew {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
+		} else {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Update", resourceType, resource)
+		}
+	} else {
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Update", resourceType, err, resource)
+	}
+
+	return createdNew, err
+}
+
+// writeResource stores a new current version of a resource (the database lock must be held)
+func (ms *memorySession) writeResource(resource *models2.Resource, versionId int) error {
+	resourceType := resource.ResourceType()
+	id := resource.Id()
+
+	stored, err := search.NewMemoryResource(resource)
+	if err != nil {
+		return errors.Wrapf(err, "writeResource: failed to encode %s/%s", resourceType, id)
+	}
+	ms.setCurrent(resourceType, id, stored)
+
+	if ms.dal.enableHistory {
+		ms.addVersion(resourceType, id, memoryVersion{
+			versionId:   versionId,
+			lastUpdated: stored.LastUpdated,
+			blob:        stored.Blob,
+		})
+	}
+	return nil
+}
+
+func (ms *memorySession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	if IDs, err := ms.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = primitive.NewObjectID().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, &ErrMultipleMatches{msg: fmt.Sprintf("Multiple matches for %s?%s", query.Resource, query.Query)}
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = ms.Put(id, conditionalVersionId, resource)
+	return id, createdNew, err
+}
+
+func (ms *memorySession) Delete(id, resourceType string) (newVersionId string, err error) {
+	var resource interface{}
+	var getError error
+	hasInterceptor := hasInterceptorsForOpAndType(ms.dal.Interceptors, "Delete", resourceType)
+	if hasInterceptor {
+		// Although this is a delete operation we need to get the resource first so we can
+		// run any interceptors on the resource before it's deleted.
+		resource, getError = ms.Get(id, resourceType)
+		invokeInterceptorsBefore(ms.dal.Interceptors, "Delete", resourceType, resource)
+	}
+
+	err = ms.write(func() error {
+		current := ms.lookup(resourceType, id)
+		if current == nil {
+			return ErrNotFound
+		}
+		currentResource, err := current.Resource()
+		if err != nil {
+			return errors.Wrap(err, "Delete: error decoding current version")
+		}
+		curVersionId, err := strconv.Atoi(currentResource.VersionId())
+		if err != nil {
+			return errors.Wrapf(err, "Delete: current versionId is not an integer (%s)", currentResource.VersionId())
+		}
+
+		ms.setCurrent(resourceType, id, nil)
+		glog.V(3).Infof("   deleted %s/%s (version %d)", resourceType, id, curVersionId)
+
+		if ms.dal.enableHistory {
+			// create a deletion record
+			ms.addVersion(resourceType, id, memoryVersion{
+				versionId:   curVersionId + 1,
+				lastUpdated: time.Now(),
+				deleted:     true,
+			})
+			newVersionId = strconv.Itoa(curVersionId + 1)
+		}
+		return nil
+	})
+
+	if hasInterceptor {
+		if err == nil && getError == nil {
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Delete", resourceType, resource)
+		} else {
+			invokeInterceptorsOnError(ms.dal.Interceptors, "Delete", resourceType, err, resource)
+		}
+	}
+
+	return newVersionId, err
+}
+
+func (ms *memorySession) ConditionalDelete(query search.Query) (count int64, err error) {
+	IDsToDelete, err := ms.FindIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	// run the individual deletions in a single transaction
+	ownTransaction := !ms.inTransaction
+	if ownTransaction {
+		ms.StartTransaction()
+		defer ms.Finish()
+	}
+
+	for _, id := range IDsToDelete {
+		if _, err := ms.Delete(id, query.Resource); err != nil {
+			return 0, errors.Wrapf(err, "ConditionalDelete: failed to delete %s/%s", query.Resource, id)
+		}
+		count++
+	}
+
+	if ownTransaction {
+		ms.CommmitIfTransaction()
+	}
+	return count, nil
+}
+
+func (ms *memorySession) History(baseURL url.URL, historyQuery search.Query, id string) (bundle *models2.ShallowBundle, err error) {
+	resourceType := historyQuery.Resource
+	options := historyQuery.HistoryOptions()
+
+	unlock := ms.lock()
+	defer unlock()
+
+	var versions []historyVersion
+	blobs := make(map[int][]byte)
+	if ms.dal.enableHistory {
+		for _, v := range ms.versions(resourceType, id) {
+			versions = append(versions, historyVersion{resourceType: resourceType, id: id, versionId: v.versionId, lastUpdated: v.lastUpdated, deleted: v.deleted})
+			blobs[v.versionId] = v.blob
+		}
+	} else if stored := ms.lookup(resourceType, id); stored != nil {
+		resource, err := stored.Resource()
+		if err != nil {
+			return nil, errors.Wrap(err, "History: failed to decode current version")
+		}
+		versionId, _ := strconv.Atoi(resource.VersionId())
+		versions = append(versions, historyVersion{resourceType: resourceType, id: id, versionId: versionId, lastUpdated: stored.LastUpdated})
+		blobs[versionId] = stored.Blob
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	versions = filterHistoryVersions(versions, options)
+	page := historyPage(versions, options)
+	for i := range page {
+		if !page[i].deleted {
+			page[i].resource, err = search.DecodePostgresResource(blobs[page[i].versionId])
+			if err != nil {
+				return nil, errors.Wrap(err, "History: failed to decode version")
+			}
+		}
+	}
+
+	return historyBundle(baseURL, historyQuery, id, page, uint32(len(versions)), true), nil
+}
+
+func (ms *memorySession) HistoryAll(baseURL url.URL, historyQuery search.Query) (bundle *models2.ShallowBundle, err error) {
+	options := historyQuery.HistoryOptions()
+	from, to := historyTimeRange(options)
+	inRange := func(lastUpdated time.Time) bool {
+		return (from.IsZero() || !lastUpdated.Before(from)) && (to.IsZero() || lastUpdated.Before(to))
+	}
+
+	unlock := ms.lock()
+	defer unlock()
+
+	// resources can only be decoded from blobs once the page is known
+	var versions []historyVersion
+	blobs := make(map[string][]byte)
+	key := func(v historyVersion) string {
+		return v.resourceType + "/" + v.id + "/" + strconv.Itoa(v.versionId)
+	}
+	for _, resourceType := range historyResourceTypes(historyQuery) {
+		if ms.dal.enableHistory {
+			for id, resourceVersions := range ms.db.history[resourceType] {
+				for _, v := range resourceVersions {
+					if inRange(v.lastUpdated) {
+						version := historyVersion{resourceType: resourceType, id: id, versionId: v.versionId, lastUpdated: v.lastUpdated, deleted: v.deleted}
+						versions = append(versions, version)
+						blobs[key(version)] = v.blob
+					}
+				}
+			}
+		} else {
+			for id, stored := range ms.db.current[resourceType] {
+				if inRange(stored.LastUpdated) {
+					resource, err := stored.Resource()
+					if err != nil {
+						return nil, errors.Wrap(err, "HistoryAll: failed to decode current version")
+					}
+					versionId, _ := strconv.Atoi(resource.VersionId())
+					version := historyVersion{resourceType: resourceType, id: id, versionId: versionId, lastUpdated: stored.LastUpdated}
+					versions = append(versions, version)
+					blobs[key(version)] = stored.Blob
+				}
+			}
+		}
+	}
+
+	versions = selectHistoryVersions(versions, options)
+	page := historyPage(versions, options)
+	for i := range page {
+		if !page[i].deleted {
+			page[i].resource, err = search.DecodePostgresResource(blobs[key(page[i])])
+			if err != nil {
+				return nil, errors.Wrap(err, "HistoryAll: failed to decode version")
+			}
+		}
+	}
+
+	return historyBundle(baseURL, historyQuery, "", page, uint32(len(versions)), ms.dal.countTotalResults), nil
+}
+
+func (ms *memorySession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+	unlock := ms.lock()
+	defer unlock()
+
+	searcher := search.NewMemorySearcher(ms.db.current, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive)
+	resources, included, total, err := searcher.Search(searchQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var entryList []models2.ShallowBundleEntryComponent
+	numResults := len(resources)
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	for _, resource := range resources {
+		var entry models2.ShallowBundleEntryComponent
+		entry.Resource = resource
+		entry.FullUrl = baseURLstr + resource.Id()
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
+		entryList = append(entryList, entry)
+	}
+
+	for _, resource := range included {
+		var entry models2.ShallowBundleEntryComponent
+		entry.Resource = resource
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
+		entryList = append(entryList, entry)
+	}
+
+	bundle := models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "searchset",
+		Entry: entryList,
+	}
+
+	// Only include the total if counts are enabled, or if _summary=count was applied.
+	if ms.dal.countTotalResults || searchQuery.Options().Summary == "count" {
+		bundle.Total = &total
+	}
+
+	bundle.Link = generatePagingLinks(baseURL, searchQuery, total, uint32(numResults), ms.dal.countTotalResults)
+
+	return &bundle, nil
+}
+
+func (ms *memorySession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	unlock := ms.lock()
+	defer unlock()
+
+	searcher := search.NewMemorySearcher(ms.db.current, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive)
+	results, _, _, err := searcher.Search(findIDsQuery(searchQuery))
+	if err != nil {
+		return nil, err
+	}
+
+	IDs = make([]string, len(results))
+	for i, result := range results {
+		IDs[i] = result.Id()
+	}
+	return IDs, nil
+}
+
+func (ms *memorySession) Export(resourceType string, since time.Time, handler func(resource *models2.Resource) error) error {
+	// the stored resources are immutable so can be decoded after the lock is released
+	unlock := ms.lock()
+	var stored []*search.MemoryResource
+	for _, resource := range ms.db.current[resourceType] {
+		if since.IsZero() || !resource.LastUpdated.Before(since) {
+			stored = append(stored, resource)
+		}
+	}
+	unlock()
+
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	for _, s := range stored {
+		resource, err := s.Resource()
+		if err != nil {
+			return errors.Wrap(err, "Export: failed to decode resource")
+		}
+		if err = handler(resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memorySession) Rekey(resourceType string, batchSize int) (count int, err error) {
+	unlock := ms.lock()
+	idSet := make(map[string]bool)
+	for id := range ms.db.current[resourceType] {
+		idSet[id] = true
+	}
+	for id := range ms.db.history[resourceType] {
+		idSet[id] = true
+	}
+	unlock()
+
+	ids := make([]string, 0, len(idSet))
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// the lock is released between batches so that other sessions aren't blocked
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batchCount := 0
+		err = ms.write(func() error {
+			for _, id := range ids[start:end] {
+				rekeyed, err := ms.rekeyResource(resourceType, id)
+				if err != nil {
+					return err
+				}
+				batchCount += rekeyed
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += batchCount
+	}
+	return count, nil
+}
+
+// rekeyResource re-encrypts the versions of a resource (the database lock must be held)
+func (ms *memorySession) rekeyResource(resourceType, id string) (count int, err error) {
+	if stored := ms.lookup(resourceType, id); stored != nil {
+		blob, err := rekeyBlob(stored.Blob)
+		if err != nil {
+			return count, errors.Wrapf(err, "Rekey: failed to re-encrypt %s/%s", resourceType, id)
+		}
+		if blob != nil {
+			// stored resources are immutable
+			rekeyed := *stored
+			rekeyed.Blob = blob
+			ms.setCurrent(resourceType, id, &rekeyed)
+			count++
+		}
+	}
+
+	previous := ms.versions(resourceType, id)
+	var versions []memoryVersion
+	for i, version := range previous {
+		blob, err := rekeyBlob(version.blob)
+		if err != nil {
+			return count, errors.Wrapf(err, "Rekey: failed to re-encrypt version %d of %s/%s", version.versionId, resourceType, id)
+		}
+		if blob == nil {
+			continue
+		}
+		if versions == nil {
+			// copy so that the undo function's slice isn't modified
+			versions = make([]memoryVersion, len(previous))
+			copy(versions, previous)
+		}
+		versions[i].blob = blob
+		count++
+	}
+	if versions != nil {
+		collection := ms.db.history[resourceType]
+		ms.undo = append(ms.undo, func() {
+			collection[id] = previous
+		})
+		collection[id] = versions
+	}
+	return count, nil
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	. "gopkg.in/check.v1"
+)
+
+type MemoryDALSuite struct {
+	DAL DataAccessLayer
+}
+
+var _ = Suite(&MemoryDALSuite{})
+
+func (s *MemoryDALSuite) SetUpTest(c *C) {
+	s.DAL = NewMemoryDataAccessLayer("fhir", false, "", make(map[string]InterceptorList), DefaultConfig)
+}
+
+func memoryTestPatient(c *C, family string, gender string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"name": [{ "family": "` + family + `" }],
+		"gender": "` + gender + `"
+	}`))
+	c.Assert(err, IsNil)
+	return resource
+}
+
+func (s *MemoryDALSuite) TestTransactionRollback(c *C) {
+	session := s.DAL.StartSession(context.Background(), "")
+	c.Assert(session.StartTransaction(), IsNil)
+	id, err := session.Post(memoryTestPatient(c, "Duck", "male"))
+	c.Assert(err, IsNil)
+	_, err = session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	session.Finish()
+
+	session = s.DAL.StartSession(context.Background(), "")
+	defer session.Finish()
+	_, err = session.Get(id, "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (s *MemoryDALSuite) TestTransactionCommit(c *C) {
+	session := s.DAL.StartSession(context.Background(), "")
+	c.Assert(session.StartTransaction(), IsNil)
+	id, err := session.Post(memoryTestPatient(c, "Duck", "male"))
+	c.Assert(err, IsNil)
+	c.Assert(session.CommmitIfTransaction(), IsNil)
+	session.Finish()
+
+	session = s.DAL.StartSession(context.Background(), "")
+	defer session.Finish()
+	resource, err := session.Get(id, "Patient")
+	c.Assert(err, IsNil)
+	c.Assert(resource.VersionId(), Equals, "1")
+}
+
+func (s *MemoryDALSuite) TestSearch(c *C) {
+	session := s.DAL.StartSession(context.Background(), "")
+	defer session.Finish()
+	for _, p := range []*models2.Resource{
+		memoryTestPatient(c, "Duck", "male"),
+		memoryTestPatient(c, "Mouse", "female"),
+		memoryTestPatient(c, "Duckworth", "female"),
+	} {
+		_, err := session.Post(p)
+		c.Assert(err, IsNil)
+	}
+
+	baseURL, _ := url.Parse("http://localhost/Patient")
+	bundle, err := session.Search(*baseURL, search.Query{Resource: "Patient", Query: "family=duck&_sort=-family"})
+	c.Assert(err, IsNil)
+	c.Assert(*bundle.Total, Equals, uint32(2))
+	c.Assert(bundle.Entry, HasLen, 2)
+
+	var families []string
+	for _, entry := range bundle.Entry {
+		var patient struct {
+			Name []struct{ Family string }
+		}
+		c.Assert(entry.Resource.Unmarshal(&patient), IsNil)
+		families = append(families, patient.Name[0].Family)
+	}
+	c.Assert(families, DeepEquals, []string{"Duckworth", "Duck"})
+
+	ids, err := session.FindIDs(search.Query{Resource: "Patient", Query: "gender=female"})
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 2)
+}
+
+func (s *MemoryDALSuite) TestSortWithMissingValues(c *C) {
+	session := s.DAL.StartSession(context.Background(), "")
+	defer session.Finish()
+	for _, body := range []string{
+		`{"resourceType": "Patient", "name": [{ "family": "a1" }], "birthDate": "1981-01-01"}`,
+		`{"resourceType": "Patient", "name": [{ "family": "b2" }]}`,
+		`{"resourceType": "Patient", "name": [{ "family": "c3" }], "birthDate": "1983-01-01"}`,
+	} {
+		p, err := models2.NewResourceFromJsonBytes([]byte(body))
+		c.Assert(err, IsNil)
+		_, err = session.Post(p)
+		c.Assert(err, IsNil)
+	}
+
+	baseURL, _ := url.Parse("http://localhost/Patient")
+	for query, expected := range map[string][]string{
+		// like PostgreSQL, missing values are larger than any other
+		"_sort=birthdate":  {"a1", "c3", "b2"},
+		"_sort=-birthdate": {"b2", "c3", "a1"},
+	} {
+		bundle, err := session.Search(*baseURL, search.Query{Resource: "Patient", Query: query})
+		c.Assert(err, IsNil)
+
+		var families []string
+		for _, entry := range bundle.Entry {
+			var patient struct {
+				Name []struct{ Family string }
+			}
+			c.Assert(entry.Resource.Unmarshal(&patient), IsNil)
+			families = append(families, patient.Name[0].Family)
+		}
+		c.Assert(families, DeepEquals, expected, Commentf(query))
+	}
+}
+
+func (s *MemoryDALSuite) TestSearchModifiers(c *C) {
+	session := s.DAL.StartSession(context.Background(), "")
+	defer session.Finish()
+	for _, p := range []*models2.Resource{
+		memoryTestPatient(c, "Duck", "male"),
+		memoryTestPatient(c, "Mouse", "female"),
+		memoryTestPatient(c, "Duckworth", "female"),
+	} {
+		_, err := session.Post(p)
+		c.Assert(err, IsNil)
+	}
+	noGender, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Patient"}`))
+	c.Assert(err, IsNil)
+	_, err = session.Post(noGender)
+	c.Assert(err, IsNil)
+
+	for query, expected := range map[string]int{
+		"family:exact=Duck":     1,
+		"family:exact=duck":     0,
+		"family:contains=WORTH": 1,
+		"family:contains=ou":    1,
+		"gender:missing=true":   1,
+		"gender:missing=false":  3,
+		"gender:not=female":     2,
+		"_id:missing=false":     4,
+	} {
+		ids, err := session.FindIDs(search.Query{Resource: "Patient", Query: query})
+		c.Assert(err, IsNil)
+		c.Assert(ids, HasLen, expected, Commentf(query))
+	}
+}
+
+func (s *MemoryDALSuite) TestCompositeSearchIsUnsupported(c *C) {
+	server := newMemoryTestServer(nil)
+	w := serve(server, "GET", "/Observation?code-value-quantity="+url.QueryEscape("http://loinc.org|8480-6$gt100"), "")
+	c.Assert(w.Code, Equals, http.StatusNotImplemented)
+	c.Assert(w.Body.String(), Matches, `(?s).*composite searches are only supported with MongoDB.*`)
+}
+
+func (s *MemoryDALSuite) TestServerWithoutDatabase(c *C) {
+	server := newMemoryTestServer(nil)
+
+	body := `{"resourceType": "Patient", "gender": "male"}`
+	w := serve(server, "POST", "/Patient", body)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	location := w.Header().Get("Location")
+	c.Assert(location, Not(Equals), "")
+	locationURL, err := url.Parse(location)
+	c.Assert(err, IsNil)
+
+	w = serve(server, "GET", locationURL.Path, "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"gender":"male"`), Equals, true)
+}
+
+func (s *MemoryDALSuite) TestHistoryRoutes(c *C) {
+	server := newMemoryTestServer(nil)
+
+	body := `{"resourceType": "Patient", "gender": "male"}`
+	w := serve(server, "POST", "/Patient", body)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	for _, path := range []string{"/Patient/_history", "/_history?_count=10"} {
+		w = serve(server, "GET", path, "")
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(strings.Contains(w.Body.String(), `"type":"history"`), Equals, true)
+		c.Assert(strings.Contains(w.Body.String(), `"gender":"male"`), Equals, true)
+	}
+
+	w = serve(server, "GET", "/_history?gender=male", "")
+	c.Assert(w.Code, Equals, http.StatusNotImplemented)
+}
+
+func (s *MemoryDALSuite) TestSummaryAndElements(c *C) {
+	server := newMemoryTestServer(nil)
+
+	body := `{
+		"resourceType": "Observation",
+		"text": { "status": "generated", "div": "<div>Body weight</div>" },
+		"status": "final",
+		"code": { "text": "Body weight" },
+		"subject": { "reference": "Patient/123" },
+		"valueQuantity": { "value": 90, "unit": "kg" },
+		"comment": "After breakfast"
+	}`
+	w := serve(server, "POST", "/Observation", body)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	locationURL, err := url.Parse(w.Header().Get("Location"))
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		query    string
+		included []string
+		excluded []string
+	}{
+		{"_summary=true", []string{`"status"`, `"subject"`, `"valueQuantity"`}, []string{`"div"`, `"comment"`}},
+		// the mandatory elements (status and code) are returned along with the narrative
+		{"_summary=text", []string{`"div"`, `"status":"final"`, `"code"`}, []string{`"subject"`, `"valueQuantity"`, `"comment"`}},
+		{"_summary=data", []string{`"subject"`, `"comment"`}, []string{`"div"`}},
+		{"_elements=subject,comment", []string{`"subject"`, `"comment"`}, []string{`"valueQuantity"`, `"div"`}},
+		{"_summary=false", []string{`"div"`, `"comment"`}, []string{`"SUBSETTED"`}},
+	}
+	for _, test := range tests {
+		paths := []string{
+			"/Observation?" + test.query,
+			locationURL.Path + "?" + test.query,
+			// history bundles are subsetted too
+			strings.Split(locationURL.Path, "/_history/")[0] + "/_history?" + test.query,
+			"/Observation/_history?" + test.query,
+			"/_history?" + test.query,
+		}
+		for _, path := range paths {
+			w = serve(server, "GET", path, "")
+			c.Assert(w.Code, Equals, http.StatusOK, Commentf(path))
+			response := w.Body.String()
+			c.Assert(strings.Contains(response, `"id"`), Equals, true, Commentf(path))
+			for _, element := range test.included {
+				c.Assert(strings.Contains(response, element), Equals, true, Commentf("%s should include %s", path, element))
+			}
+			for _, element := range test.excluded {
+				c.Assert(strings.Contains(response, element), Equals, false, Commentf("%s should exclude %s", path, element))
+			}
+			if test.query != "_summary=false" {
+				c.Assert(strings.Contains(response, `"code":"SUBSETTED"`), Equals, true, Commentf(path))
+			}
+		}
+	}
+
+	w = serve(server, "GET", "/Observation/_history?_summary=count", "")
+	c.Assert(w.Code, Equals, http.StatusNotImplemented)
+
+	// every resource type has its summary elements
+	body = `{
+		"resourceType": "Patient",
+		"name": [{ "family": "Duck", "given": ["Donald"] }],
+		"gender": "male",
+		"birthDate": "1934-06-09",
+		"maritalStatus": { "text": "Single" },
+		"contact": [{ "name": { "family": "Duck", "given": ["Daisy"] } }]
+	}`
+	w = serve(server, "POST", "/Patient", body)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	w = serve(server, "GET", "/Patient?_summary=true", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	response := w.Body.String()
+	for _, element := range []string{`"Donald"`, `"gender"`, `"birthDate"`} {
+		c.Assert(strings.Contains(response, element), Equals, true, Commentf("should include %s", element))
+	}
+	for _, element := range []string{`"maritalStatus"`, `"contact"`, `"Daisy"`} {
+		c.Assert(strings.Contains(response, element), Equals, false, Commentf("should exclude %s", element))
+	}
+
+	w = serve(server, "GET", "/Patient?_summary=foo", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
@@ -186,9 +186,9 @@ type InterceptorHandler interface {
 
 // invokeInterceptorsBefore invokes the interceptor list for the given resource type before a database
 // operation occurs.
-func (ms *mongoSession) invokeInterceptorsBefore(op, resourceType string, resource interface{}) {
+func invokeInterceptorsBefore(interceptors map[string]InterceptorList, op, resourceType string, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.Before(resource)
 		}
@@ -197,9 +197,9 @@ func (ms *mongoSession) invokeInterceptorsBefore(op, resourceType string, resour
 
 // invokeInterceptorsAfter invokes the interceptor list for the given resource type after a database
 // operation occurs and succeeds.
-func (ms *mongoSession) invokeInterceptorsAfter(op, resourceType string, resource interface{}) {
+func invokeInterceptorsAfter(interceptors map[string]InterceptorList, op, resourceType string, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.After(resource)
 		}
@@ -208,9 +208,9 @@ func (ms *mongoSession) invokeInterceptorsAfter(op, resourceType string, resourc
 
 // invokeInterceptorsOnError invokes the interceptor list for the given resource type after a database
 // operation occurs and fails.
-func (ms *mongoSession) invokeInterceptorsOnError(op, resourceType string, err error, resource interface{}) {
+func invokeInterceptorsOnError(interceptors map[string]InterceptorList, op, resourceType string, err error, resource interface{}) {
 
-	for _, interceptor := range ms.dal.Interceptors[op] {
+	for _, interceptor := range interceptors[op] {
 		if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 			interceptor.Handler.OnError(err, resource)
 		}
@@ -218,10 +218,10 @@ func (ms *mongoSession) invokeInterceptorsOnError(op, resourceType string, err e
 }
 
 // hasInterceptorsForOpAndType checks if any interceptors are registered for a particular database operation AND resource type
-func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) bool {
+func hasInterceptorsForOpAndType(interceptors map[string]InterceptorList, op, resourceType string) bool {
 
-	if len(ms.dal.Interceptors[op]) > 0 {
-		for _, interceptor := range ms.dal.Interceptors[op] {
+	if len(interceptors[op]) > 0 {
+		for _, interceptor := range interceptors[op] {
 			if interceptor.ResourceType == resourceType || interceptor.ResourceType == "*" {
 				// At least 1 interceptor is registered for this database operation and resource type
 				return true
@@ -442,15 +442,15 @@ func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) error
 	resourceType := resource.ResourceType()
 	curCollection := ms.CurrentVersionCollection(resourceType)
 
-	ms.invokeInterceptorsBefore("Create", resourceType, resource)
+	invokeInterceptorsBefore(ms.dal.Interceptors, "Create", resourceType, resource)
 
 	glog.V(3).Infof("PostWithID: inserting %s/%s", resourceType, id)
 	_, err = curCollection.InsertOne(ms.context, resource)
 
 	if err == nil {
-		ms.invokeInterceptorsAfter("Create", resourceType, resource)
+		invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
 	} else {
-		ms.invokeInterceptorsOnError("Create", resourceType, err, resource)
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Create", resourceType, err, resource)
 	}
 
 	return convertMongoErr(err)
@@ -550,10 +550,10 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 
 	updateResourceMeta(resource, newVersionId)
 
-	if ms.hasInterceptorsForOpAndType("Update", resourceType) {
+	if hasInterceptorsForOpAndType(ms.dal.Interceptors, "Update", resourceType) {
 		oldResource, getError := ms.Get(id, resourceType)
 		if getError == nil {
-			ms.invokeInterceptorsBefore("Update", resourceType, oldResource)
+			invokeInterceptorsBefore(ms.dal.Interceptors, "Update", resourceType, oldResource)
 		}
 	}
 
@@ -611,12 +611,12 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	if err == nil {
 		createdNew = (updated == 0)
 		if createdNew {
-			ms.invokeInterceptorsAfter("Create", resourceType, resource)
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Create", resourceType, resource)
 		} else {
-			ms.invokeInterceptorsAfter("Update", resourceType, resource)
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Update", resourceType, resource)
 		}
 	} else {
-		ms.invokeInterceptorsOnError("Update", resourceType, err, resource)
+		invokeInterceptorsOnError(ms.dal.Interceptors, "Update", resourceType, err, resource)
 	}
 
 	return createdNew, convertMongoErr(err)
@@ -697,12 +697,12 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 
 	var resource interface{}
 	var getError error
-	hasInterceptor := ms.hasInterceptorsForOpAndType("Delete", resourceType)
+	hasInterceptor := hasInterceptorsForOpAndType(ms.dal.Interceptors, "Delete", resourceType)
 	if hasInterceptor {
 		// Although this is a delete operation we need to get the resource first so we can
 		// run any interceptors on the resource before it's deleted.
 		resource, getError = ms.Get(id, resourceType)
-		ms.invokeInterceptorsBefore("Delete", resourceType, resource)
+		invokeInterceptorsBefore(ms.dal.Interceptors, "Delete", resourceType, resource)
 	}
 
 	filter := bson.D{{"_id", bsonID.Hex()}}
@@ -714,9 +714,9 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 
 	if hasInterceptor {
 		if err == nil && getError == nil {
-			ms.invokeInterceptorsAfter("Delete", resourceType, resource)
+			invokeInterceptorsAfter(ms.dal.Interceptors, "Delete", resourceType, resource)
 		} else {
-			ms.invokeInterceptorsOnError("Delete", resourceType, err, resource)
+			invokeInterceptorsOnError(ms.dal.Interceptors, "Delete", resourceType, err, resource)
 		}
 	}
 
@@ -826,7 +826,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 	curCollection := ms.CurrentVersionCollection(resourceType)
 	prevCollection := ms.PreviousVersionsCollection(resourceType)
 
-	hasInterceptors := ms.hasInterceptorsForOpAndType("Delete", resourceType)
+	hasInterceptors := hasInterceptorsForOpAndType(ms.dal.Interceptors, "Delete", resourceType)
 
 	if hasInterceptors || ms.dal.enableHistory {
 		/* Interceptors for a conditional delete are tricky since an interceptor is only run
@@ -843,7 +843,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 		if err == nil {
 			for _, elem := range bundle.Entry {
 				if hasInterceptors {
-					ms.invokeInterceptorsBefore("Delete", resourceType, elem.Resource)
+					invokeInterceptorsBefore(ms.dal.Interceptors, "Delete", resourceType, elem.Resource)
 				}
 			}
 
@@ -867,7 +867,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 			if err != nil {
 				if hasInterceptors {
 					for _, elem := range bundle.Entry {
-						ms.invokeInterceptorsOnError("Delete", resourceType, err, elem.Resource)
+						invokeInterceptorsOnError(ms.dal.Interceptors, "Delete", resourceType, err, elem.Resource)
 					}
 				}
 				return count, convertMongoErr(err)
@@ -894,11 +894,11 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 
 					if elementInSlice(id, deletedIds) {
 						// This resource was confirmed deleted
-						ms.invokeInterceptorsAfter("Delete", resourceType, elem.Resource)
+						invokeInterceptorsAfter(ms.dal.Interceptors, "Delete", resourceType, elem.Resource)
 					} else {
 						// This resource was not confirmed deleted, which is an error
 						resourceErr := fmt.Errorf("ConditionalDelete: failed to delete resource %s with ID %s", resourceType, id)
-						ms.invokeInterceptorsOnError("Delete", resourceType, resourceErr, elem.Resource)
+						invokeInterceptorsOnError(ms.dal.Interceptors, "Delete", resourceType, resourceErr, elem.Resource)
 					}
 				}
 			}
@@ -914,106 +914,229 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 	}
 }
 
-func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string) (bundle *models2.ShallowBundle, err error) {
+func (ms *mongoSession) History(baseURL url.URL, historyQuery search.Query, id string) (bundle *models2.ShallowBundle, err error) {
 
 	// check id
 	_, err = convertIDToBsonID(id)
 	if err != nil {
 		return nil, ErrNotFound
 	}
+	resourceType := historyQuery.Resource
+	options := historyQuery.HistoryOptions()
 
-	baseURLstr := baseURL.String()
-	if !strings.HasSuffix(baseURLstr, "/") {
-		baseURLstr = baseURLstr + "/"
+	// a single resource doesn't have many versions so they're all listed without their content
+	versions, err := ms.listHistoryVersions(resourceType, id, bson.D{}, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "History: failed to list versions of %s/%s", resourceType, id)
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
 	}
-	fullUrl := baseURLstr + id
 
-	curCollection := ms.CurrentVersionCollection(resourceType)
-	prevCollection := ms.PreviousVersionsCollection(resourceType)
+	versions = filterHistoryVersions(versions, options)
+	page := historyPage(versions, options)
+	if err = ms.loadHistoryPage(page); err != nil {
+		return nil, errors.Wrap(err, "History")
+	}
 
-	var entryList []models2.ShallowBundleEntryComponent
-	makeEntryRequest := func(method string) *models.BundleEntryRequestComponent {
-		return &models.BundleEntryRequestComponent{
-			Url:    resourceType + "/" + id,
-			Method: method,
-		}
+	return historyBundle(baseURL, historyQuery, id, page, uint32(len(versions)), true), nil
+}
+
+func (ms *mongoSession) HistoryAll(baseURL url.URL, historyQuery search.Query) (bundle *models2.ShallowBundle, err error) {
+	options := historyQuery.HistoryOptions()
+	from, to := historyTimeRange(options)
+
+	lastUpdatedFilter := bson.D{}
+	if !from.IsZero() {
+		lastUpdatedFilter = append(lastUpdatedFilter, bson.E{"$gte", from})
+	}
+	if !to.IsZero() {
+		lastUpdatedFilter = append(lastUpdatedFilter, bson.E{"$lt", to})
+	}
+	filter := bson.D{}
+	if len(lastUpdatedFilter) > 0 {
+		filter = bson.D{{"meta.lastUpdated", lastUpdatedFilter}}
 	}
 
-	// add current version
-	var curDoc bson.D
-	curDocQuery := bson.D{{"_id", id}}
-	err = curCollection.FindOne(ms.context, curDocQuery).Decode(&curDoc)
-	if err == nil {
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
-		entry.Resource, err = models2.NewResourceFromBSON(curDoc)
+	// Without _at the newest offset+count versions of each collection include the page, so only
+	// those are listed and merged. With _at whether a version is selected depends on when the next
+	// version was created, which isn't stored with it, so every version in the time range is listed.
+	limit := int64(options.Offset + options.Count)
+	if options.At != nil {
+		limit = 0
+	}
+
+	// first list the versions without their content
+	var versions []historyVersion
+	var total int64
+	for _, resourceType := range historyResourceTypes(historyQuery) {
+		listed, err := ms.listHistoryVersions(resourceType, "", filter, limit)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: NewResourceFromBSON failed")
+			return nil, errors.Wrapf(err, "HistoryAll: failed to list versions of %s", resourceType)
+		}
+		versions = append(versions, listed...)
+
+		if limit > 0 && ms.dal.countTotalResults {
+			count, err := ms.countHistoryVersions(resourceType, filter)
+			if err != nil {
+				return nil, errors.Wrapf(err, "HistoryAll: failed to count versions of %s", resourceType)
+			}
+			total += count
 		}
-		entry.Request = makeEntryRequest("PUT")
-		entryList = append(entryList, entry)
-	} else if err != mongo.ErrNoDocuments {
-		return nil, err
 	}
 
-	// sort - oldest versions last
-	prevDocsQuery := bson.D{{"_id._id", id}}
-	prevDocsSort := options.Find().SetSort(bson.D{{"_id._version", -1}})
-	cursor, err := prevCollection.Find(ms.context, prevDocsQuery, prevDocsSort)
-	if err != nil {
-		return nil, errors.Wrap(err, "History: prevCollection.Find failed")
+	versions = selectHistoryVersions(versions, options)
+	if limit == 0 {
+		total = int64(len(versions))
+	}
+	page := historyPage(versions, options)
+	if err = ms.loadHistoryPage(page); err != nil {
+		return nil, errors.Wrap(err, "HistoryAll")
 	}
 
-	for cursor.Next(ms.context) {
+	return historyBundle(baseURL, historyQuery, "", page, uint32(total), ms.dal.countTotalResults), nil
+}
 
-		var prevDocBson bson.Raw
-		err = cursor.Decode(&prevDocBson)
-		glog.V(8).Infof("History: decoded prev document: %s", prevDocBson.String())
+// loadHistoryPage loads the resources of the versions in a page of history
+func (ms *mongoSession) loadHistoryPage(page []historyVersion) (err error) {
+	for i := range page {
+		version := &page[i]
+		if version.deleted {
+			continue
+		}
+		version.resource, err = ms.loadHistoryVersion(version)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: cursor.Decode failed")
+			return errors.Wrapf(err, "failed to load %s/%s/_history/%d", version.resourceType, version.id, version.versionId)
 		}
+	}
+	return nil
+}
 
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
+// countHistoryVersions counts the current and previous versions of a resource type that match a filter
+func (ms *mongoSession) countHistoryVersions(resourceType string, filter bson.D) (int64, error) {
+	current, err := ms.CurrentVersionCollection(resourceType).CountDocuments(ms.context, filter)
+	if err != nil {
+		return 0, errors.Wrap(convertMongoErr(err), "CountDocuments on current versions failed")
+	}
+	previous, err := ms.PreviousVersionsCollection(resourceType).CountDocuments(ms.context, filter)
+	if err != nil {
+		return 0, errors.Wrap(convertMongoErr(err), "CountDocuments on previous versions failed")
+	}
+	return current + previous, nil
+}
 
-		deleted, resource, err := unmarshalPreviousVersion(&prevDocBson)
-		if err != nil {
-			return nil, errors.Wrap(err, "History: unmarshalPreviousVersion failed")
+// listHistoryVersions lists the current and previous versions of a resource type without their content.
+// If id isn't empty only the versions of that resource are listed. If limit isn't zero only the newest
+// limit versions in each collection are listed, in the order used by selectHistoryVersions.
+func (ms *mongoSession) listHistoryVersions(resourceType string, id string, filter bson.D, limit int64) (versions []historyVersion, err error) {
+	projection := bson.D{{"_id", 1}, {"meta.versionId", 1}, {"meta.lastUpdated", 1}}
+
+	curFilter := filter
+	curOptions := options.Find().SetProjection(projection)
+	if id != "" {
+		curFilter = append(bson.D{{"_id", id}}, filter...)
+	}
+	if limit > 0 {
+		curOptions.SetSort(bson.D{{"meta.lastUpdated", -1}, {"_id", 1}}).SetLimit(limit)
+	}
+
+	cursor, err := ms.CurrentVersionCollection(resourceType).Find(ms.context, curFilter, curOptions)
+	if err != nil {
+		return nil, errors.Wrap(convertMongoErr(err), "Find on current versions failed")
+	}
+	defer cursor.Close(ms.context)
+	for cursor.Next(ms.context) {
+		doc := cursor.Current
+		id, _ := doc.Lookup("_id").StringValueOK()
+		version := historyVersion{
+			resourceType: resourceType,
+			id:           id,
+			versionId:    1,
 		}
-		if deleted {
-			entry.Request = makeEntryRequest("DELETE")
-		} else {
-			entry.Resource = resource
-			entry.Request = makeEntryRequest("PUT")
+		if versionIdStr, ok := doc.Lookup("meta", "versionId").StringValueOK(); ok {
+			version.versionId, _ = strconv.Atoi(versionIdStr)
 		}
-
-		entryList = append(entryList, entry)
+		if lastUpdated, ok := doc.Lookup("meta", "lastUpdated").TimeOK(); ok {
+			version.lastUpdated = lastUpdated
+		}
+		versions = append(versions, version)
 	}
 	if err := cursor.Err(); err != nil {
-		return nil, errors.Wrap(err, "History: MongoDB query for previous versions failed")
+		return nil, errors.Wrap(convertMongoErr(err), "cursor on current versions failed")
 	}
 
-	totalDocs := uint32(len(entryList))
-	if totalDocs == 0 {
-		return nil, ErrNotFound
+	prevFilter := filter
+	prevOptions := options.Find().SetProjection(projection)
+	if id != "" {
+		prevFilter = append(bson.D{{"_id._id", id}}, filter...)
+	}
+	if limit > 0 {
+		prevOptions.SetSort(bson.D{{"meta.lastUpdated", -1}, {"_id._id", 1}, {"_id._version", -1}}).SetLimit(limit)
 	}
 
-	// last entry should be a POST
-	entryList[len(entryList)-1].Request.Method = "POST"
-	entryList[len(entryList)-1].Request.Url = resourceType
+	prevCursor, err := ms.PreviousVersionsCollection(resourceType).Find(ms.context, prevFilter, prevOptions)
+	if err != nil {
+		return nil, errors.Wrap(convertMongoErr(err), "Find on previous versions failed")
+	}
+	defer prevCursor.Close(ms.context)
+	for prevCursor.Next(ms.context) {
+		// vermongo-style ids, e.g. { "_id" : "4c78da...", "_version" : 2, "_deleted": 1 }
+		doc := prevCursor.Current
+		id, _ := doc.Lookup("_id", "_id").StringValueOK()
+		versionId := rawValueToInt(doc.Lookup("_id", "_version"))
+		deleted := rawValueToInt(doc.Lookup("_id", "_deleted"))
+		version := historyVersion{
+			resourceType: resourceType,
+			id:           id,
+			versionId:    versionId,
+			deleted:      deleted > 0,
+		}
+		if lastUpdated, ok := doc.Lookup("meta", "lastUpdated").TimeOK(); ok {
+			version.lastUpdated = lastUpdated
+		}
+		versions = append(versions, version)
+	}
+	if err := prevCursor.Err(); err != nil {
+		return nil, errors.Wrap(convertMongoErr(err), "cursor on previous versions failed")
+	}
 
-	// output a Bundle
-	bundle = &models2.ShallowBundle{
-		Id:    primitive.NewObjectID().Hex(),
-		Type:  "history",
-		Entry: entryList,
-		Total: &totalDocs,
+	return versions, nil
+}
+
+func rawValueToInt(value bson.RawValue) int {
+	if i, ok := value.Int32OK(); ok {
+		return int(i)
+	}
+	if i, ok := value.Int64OK(); ok {
+		return int(i)
 	}
+	return 0
+}
 
-	// TODO: use paging
-	// bundle.Link = dal.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+// loadHistoryVersion loads a version listed by listHistoryVersions
+func (ms *mongoSession) loadHistoryVersion(version *historyVersion) (*models2.Resource, error) {
+	var doc bson.D
+	err := ms.CurrentVersionCollection(version.resourceType).FindOne(ms.context, bson.D{
+		{"_id", version.id},
+		{"meta.versionId", strconv.Itoa(version.versionId)},
+	}).Decode(&doc)
+	if err == nil {
+		return models2.NewResourceFromBSON(doc)
+	} else if err != mongo.ErrNoDocuments {
+		return nil, convertMongoErr(err)
+	}
 
-	return bundle, nil
+	// the version might have been replaced since it was listed
+	var prevDocRaw bson.Raw
+	err = ms.PreviousVersionsCollection(version.resourceType).FindOne(ms.context, bson.D{
+		{"_id._id", version.id},
+		{"_id._version", int32(version.versionId)},
+	}).Decode(&prevDocRaw)
+	if err != nil {
+		return nil, convertMongoErr(err)
+	}
+	_, resource, err := unmarshalPreviousVersion(&prevDocRaw)
+	return resource, err
 }
 
 func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
@@ -1070,7 +1193,7 @@ func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*mode
 		bundle.Total = &total
 	}
 
-	bundle.Link = ms.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+	bundle.Link = generatePagingLinks(baseURL, searchQuery, total, uint32(numResults), ms.dal.countTotalResults)
 
 	return &bundle, nil
 }
@@ -1078,18 +1201,7 @@ func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*mode
 func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
 
 	// First create a new query with the unsupported query options filtered out
-	oldParams := searchQuery.URLQueryParameters(false)
-	newParams := search.URLQueryParameters{}
-	for _, param := range oldParams.All() {
-		switch param.Key {
-		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
-			search.RevIncludeParam, search.SummaryParam:
-			continue
-		default:
-			newParams.Add(param.Key, param.Value)
-		}
-	}
-	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+	newQuery := findIDsQuery(searchQuery)
 
 	// Now search on that query, unmarshaling to a temporary struct and converting results to []string
 	searcher := search.NewMongoSearcher(ms.db, ms.context, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive, ms.dal.readonly)
@@ -1106,7 +1218,24 @@ func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err err
 	return IDs, nil
 }
 
-func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query, total uint32, numResults uint32) []models.BundleLinkComponent {
+// findIDsQuery returns a copy of the query without the options that FindIDs ignores.
+// Options such as _count aren't applied so that conditional operations see all matches.
+func findIDsQuery(searchQuery search.Query) search.Query {
+	oldParams := searchQuery.URLQueryParameters(false)
+	newParams := search.URLQueryParameters{}
+	for _, param := range oldParams.All() {
+		switch param.Key {
+		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
+			search.RevIncludeParam, search.SummaryParam:
+			continue
+		default:
+			newParams.Add(param.Key, param.Value)
+		}
+	}
+	return search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+}
+
+func generatePagingLinks(baseURL url.URL, query search.Query, total uint32, numResults uint32, countTotalResults bool) []models.BundleLinkComponent {
 
 	links := make([]models.BundleLinkComponent, 0, 5)
 	params := query.URLQueryParameters(true)
@@ -1149,7 +1278,7 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 	}
 
 	// If counts are enabled, the total is accurate and can be used to compute the links.
-	if ms.dal.countTotalResults {
+	if countTotalResults {
 		// Next Link
 		if total > uint32(offset+count) {
 			nextOffset := offset + count
@@ -1271,3 +1400,105 @@ func elementInSlice(element string, slice []string) bool {
 	}
 	return false
 }
+
+func (ms *mongoSession) Export(resourceType string, since time.Time, handler func(resource *models2.Resource) error) error {
+	filter := bson.D{}
+	if !since.IsZero() {
+		filter = bson.D{{"meta.lastUpdated", bson.D{{"$gte", since}}}}
+	}
+
+	cursor, err := ms.CurrentVersionCollection(resourceType).Find(ms.context, filter)
+	if err != nil {
+		return errors.Wrap(convertMongoErr(err), "Export: Find failed")
+	}
+	defer cursor.Close(ms.context)
+	for cursor.Next(ms.context) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			return errors.Wrap(err, "Export: Decode failed")
+		}
+		resource, err := models2.NewResourceFromBSON(doc)
+		if err != nil {
+			return errors.Wrap(err, "Export: NewResourceFromBSON failed")
+		}
+		if err = handler(resource); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(convertMongoErr(err), "Export: cursor failed")
+	}
+	return nil
+}
+
+func (ms *mongoSession) Rekey(resourceType string, batchSize int) (count int, err error) {
+	keyring, err := models2.CurrentKeyring()
+	if err != nil {
+		return 0, errors.Wrap(err, "Rekey: CurrentKeyring failed")
+	}
+	filter := bson.D{{"__gofhirEncryptionKeyId", bson.D{{"$exists", true}, {"$ne", keyring.CurrentKeyId()}}}}
+
+	for _, collection := range []*mongowrapper.WrappedCollection{ms.CurrentVersionCollection(resourceType), ms.PreviousVersionsCollection(resourceType)} {
+		for {
+			found, rekeyed, err := ms.rekeyBatch(collection, filter, batchSize)
+			count += rekeyed
+			if err != nil {
+				return count, err
+			}
+			if found == 0 {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+// rekeyBatch re-encrypts up to batchSize documents matching filter. Documents are only updated if
+// they haven't been changed since they were read, so it's safe to run while the server is in use.
+func (ms *mongoSession) rekeyBatch(collection *mongowrapper.WrappedCollection, filter bson.D, batchSize int) (found int, rekeyed int, err error) {
+	cursor, err := collection.Find(ms.context, filter, options.Find().SetLimit(int64(batchSize)))
+	if err != nil {
+		return 0, 0, errors.Wrapf(convertMongoErr(err), "Rekey: Find in %s failed", collection.Name())
+	}
+	var docs []bson.D
+	for cursor.Next(ms.context) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			cursor.Close(ms.context)
+			return 0, 0, errors.Wrap(err, "Rekey: Decode failed")
+		}
+		docs = append(docs, doc)
+	}
+	err = cursor.Err()
+	cursor.Close(ms.context)
+	if err != nil {
+		return 0, 0, errors.Wrapf(convertMongoErr(err), "Rekey: cursor of %s failed", collection.Name())
+	}
+
+	for _, doc := range docs {
+		id := doc.Map()["_id"]
+		oldCiphertext := doc.Map()["__gofhirEncryptedBSON"]
+		changed, err := models2.RekeyBSON(doc)
+		if err != nil {
+			return len(docs), rekeyed, errors.Wrapf(err, "Rekey: failed to re-encrypt %v in %s", id, collection.Name())
+		}
+		if !changed {
+			continue
+		}
+
+		var fields bson.D
+		for _, elem := range doc {
+			if models2.IsEncryptionField(elem.Key) {
+				fields = append(fields, elem)
+			}
+		}
+		update := bson.D{{"$set", fields}}
+		result, err := collection.UpdateOne(ms.context, bson.D{{"_id", id}, {"__gofhirEncryptedBSON", oldCiphertext}}, update)
+		if err != nil {
+			return len(docs), rekeyed, errors.Wrapf(convertMongoErr(err), "Rekey: failed to update %v in %s", id, collection.Name())
+		}
+		// documents updated in the meantime were encrypted with the current key
+		rekeyed += int(result.ModifiedCount)
+	}
+	return len(docs), rekeyed, nil
+}
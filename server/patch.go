@@ -0,0 +1,750 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/fhirpath"
+	"github.com/eug48/fhir/models2"
+)
+
+// ErrInvalidPatch indicates that a PATCH body isn't a valid JSON Patch or FHIRPath Patch (HTTP 400)
+type ErrInvalidPatch struct {
+	msg string
+}
+
+func (e ErrInvalidPatch) Error() string {
+	return e.msg
+}
+
+// ErrPatchFailed indicates that a patch couldn't be applied to a resource,
+// e.g. because a JSON Patch test operation failed (HTTP 422)
+type ErrPatchFailed struct {
+	msg string
+}
+
+func (e ErrPatchFailed) Error() string {
+	return e.msg
+}
+
+// resourcePatch is either a JSON Patch document or a FHIRPath Patch Parameters resource
+type resourcePatch struct {
+	jsonPatch     []byte
+	fhirPathPatch []byte
+}
+
+// bindPatch reads the body of a PATCH request
+func bindPatch(c *gin.Context, validatorURL string) (*resourcePatch, error) {
+	if strings.Contains(c.ContentType(), "json-patch") {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "bindPatch: failed to read request body")
+		}
+		return &resourcePatch{jsonPatch: body}, nil
+	}
+
+	resource, err := FHIRBind(c, validatorURL)
+	if err != nil {
+		return nil, err
+	}
+	return newPatchFromResource(resource)
+}
+
+// newPatchFromResource returns the patch in a Parameters resource (a FHIRPath Patch)
+// or a Binary one with a JSON Patch, as used in the entries of batches and transactions.
+func newPatchFromResource(resource *models2.Resource) (*resourcePatch, error) {
+	switch resource.ResourceType() {
+	case "Parameters":
+		// references to resources created in a transaction are updated when converting to JSON
+		parametersJson, err := resource.MarshalJSON()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to convert Parameters to JSON")
+		}
+		return &resourcePatch{fhirPathPatch: parametersJson}, nil
+	case "Binary":
+		var binary struct {
+			ContentType string `json:"contentType"`
+			Content     string `json:"content"`
+		}
+		err := json.Unmarshal(resource.JsonBytes(), &binary)
+		if err != nil {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("failed to parse Binary resource: %s", err)}
+		}
+		if !strings.Contains(binary.ContentType, "json-patch") {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("unsupported patch content type: %s", binary.ContentType)}
+		}
+		content, err := base64.StdEncoding.DecodeString(binary.Content)
+		if err != nil {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("failed to decode Binary content: %s", err)}
+		}
+		return &resourcePatch{jsonPatch: content}, nil
+	default:
+		return nil, ErrInvalidPatch{msg: "a patch must be a JSON Patch or a FHIRPath Patch Parameters resource, not " + resource.ResourceType()}
+	}
+}
+
+// patchAttempts is how many times a patch without If-Match is applied when the resource
+// keeps being updated by other requests between reading and storing it
+const patchAttempts = 3
+
+// patchResource applies a patch to the current version of a resource and stores the result
+// as a new version. ErrNotFound and ErrDeleted are returned as they are.
+//
+// The result is only stored if the resource hasn't changed since it was read, so concurrent
+// updates aren't lost: without If-Match the patch is applied again to the new version, and
+// ErrConflict is returned if that keeps failing.
+func patchResource(session DataAccessSession, resourceType string, id string, conditionalVersionId string, patch *resourcePatch, whatToEncrypt models2.WhatToEncrypt) (*models2.Resource, error) {
+	for attempt := 1; ; attempt++ {
+		resource, err := patchCurrentVersion(session, resourceType, id, conditionalVersionId, patch, whatToEncrypt)
+		if _, isConflict := errors.Cause(err).(ErrConflict); isConflict && conditionalVersionId == "" && attempt < patchAttempts {
+			continue
+		}
+		return resource, err
+	}
+}
+
+func patchCurrentVersion(session DataAccessSession, resourceType string, id string, conditionalVersionId string, patch *resourcePatch, whatToEncrypt models2.WhatToEncrypt) (*models2.Resource, error) {
+	current, err := session.Get(id, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	if conditionalVersionId != "" && conditionalVersionId != current.VersionId() {
+		return nil, ErrConflict{msg: "If-Match doesn't match current versionId"}
+	}
+
+	currentJson, err := current.MarshalJSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "patchResource: failed to get current resource's JSON")
+	}
+	patchedJson, err := patch.apply(resourceType, currentJson)
+	if err != nil {
+		return nil, err
+	}
+
+	resource, err := models2.NewResourceFromJsonBytes(patchedJson)
+	if err != nil {
+		return nil, ErrPatchFailed{msg: fmt.Sprintf("patched resource is invalid: %s", err)}
+	}
+	if resource.ResourceType() != resourceType || resource.Id() != id {
+		return nil, ErrPatchFailed{msg: "a patch can't change the resourceType or id of a resource"}
+	}
+	resource.SetWhatToEncrypt(whatToEncrypt)
+	if err = checkPatchedResource(resource); err != nil {
+		return nil, err
+	}
+
+	_, err = session.Put(id, current.VersionId(), resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to store patched %s/%s", resourceType, id)
+	}
+	return resource, nil
+}
+
+// checkPatchedResource returns ErrPatchFailed if a patched resource doesn't match the FHIR schema
+func checkPatchedResource(resource *models2.Resource) (err error) {
+	defer func() {
+		// schema errors are raised as panics during the conversion to BSON
+		if r := recover(); r != nil {
+			schemaError, isSchemaError := r.(models2.FhirSchemaError)
+			if !isSchemaError {
+				panic(r)
+			}
+			err = ErrPatchFailed{msg: fmt.Sprintf("patched resource is invalid: %s", schemaError)}
+		}
+	}()
+
+	_, err = resource.GetBSON()
+	if _, isSchemaError := errors.Cause(err).(models2.FhirSchemaError); isSchemaError {
+		return ErrPatchFailed{msg: fmt.Sprintf("patched resource is invalid: %s", errors.Cause(err))}
+	}
+	return errors.Wrap(err, "checkPatchedResource: GetBSON failed")
+}
+
+func (p *resourcePatch) apply(resourceType string, resourceJson []byte) ([]byte, error) {
+	var doc interface{}
+	err := decodeJSONWithNumbers(resourceJson, &doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse resource")
+	}
+
+	if p.jsonPatch != nil {
+		doc, err = applyJSONPatch(doc, p.jsonPatch)
+	} else {
+		err = applyFHIRPathPatch(resourceType, doc, p.fhirPathPatch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, isObject := doc.(map[string]interface{}); !isObject {
+		return nil, ErrPatchFailed{msg: "patched resource is not a JSON object"}
+	}
+	return json.Marshal(doc)
+}
+
+func decodeJSONWithNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// JSON Patch (https://tools.ietf.org/html/rfc6902)
+
+type jsonPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func applyJSONPatch(doc interface{}, patchJson []byte) (interface{}, error) {
+	var operations []jsonPatchOperation
+	if err := json.Unmarshal(patchJson, &operations); err != nil {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("failed to parse JSON Patch: %s", err)}
+	}
+
+	for i, op := range operations {
+		if op.Path == nil {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d has no path", i)}
+		}
+		path, err := parseJSONPointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d (%s) has no value", i, op.Op)}
+			}
+			if err = decodeJSONWithNumbers(*op.Value, &value); err != nil {
+				return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d has an invalid value: %s", i, err)}
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d (%s) has no from", i, op.Op)}
+			}
+			from, err := parseJSONPointer(*op.From)
+			if err != nil {
+				return nil, err
+			}
+			if value, err = getJSONValue(doc, from); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+					return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d moves %s into one of its children", i, *op.From)}
+				}
+				if doc, err = removeJSONValue(doc, from); err != nil {
+					return nil, err
+				}
+			} else {
+				value = copyJSONValue(value)
+			}
+		case "remove":
+		default:
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("JSON Patch operation %d has an invalid op: %s", i, op.Op)}
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = addJSONValue(doc, path, value)
+		case "remove":
+			doc, err = removeJSONValue(doc, path)
+		case "replace":
+			if len(path) == 0 {
+				doc = value
+			} else if _, err = getJSONValue(doc, path); err == nil {
+				doc, err = updateJSONValue(doc, path, func(parent interface{}, key string) (interface{}, error) {
+					return setJSONChild(parent, key, value)
+				})
+			}
+		case "test":
+			var current interface{}
+			if current, err = getJSONValue(doc, path); err == nil && !jsonValuesEqual(current, value) {
+				err = ErrPatchFailed{msg: fmt.Sprintf("JSON Patch test failed for %s", *op.Path)}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("invalid JSON pointer: %s", pointer)}
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getJSONValue(doc interface{}, path []string) (interface{}, error) {
+	var err error
+	for _, token := range path {
+		if doc, err = getJSONChild(doc, token); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func getJSONChild(node interface{}, key string) (interface{}, error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[key]
+		if !exists {
+			return nil, ErrPatchFailed{msg: fmt.Sprintf("element %s doesn't exist", key)}
+		}
+		return child, nil
+	case []interface{}:
+		index, err := parseJSONArrayIndex(key, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		return n[index], nil
+	default:
+		return nil, ErrPatchFailed{msg: fmt.Sprintf("element %s doesn't exist", key)}
+	}
+}
+
+func setJSONChild(node interface{}, key string, value interface{}) (interface{}, error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		n[key] = value
+		return n, nil
+	case []interface{}:
+		index, err := parseJSONArrayIndex(key, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		n[index] = value
+		return n, nil
+	default:
+		return nil, ErrPatchFailed{msg: fmt.Sprintf("element %s doesn't exist", key)}
+	}
+}
+
+func parseJSONArrayIndex(key string, max int) (int, error) {
+	index, err := strconv.Atoi(key)
+	if err != nil || index < 0 || index > max || strconv.Itoa(index) != key {
+		return 0, ErrPatchFailed{msg: fmt.Sprintf("invalid array index: %s", key)}
+	}
+	return index, nil
+}
+
+// updateJSONValue calls update with the parent of the value at path and returns the updated document,
+// since updates of arrays can replace them
+func updateJSONValue(doc interface{}, path []string, update func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+	child, err := getJSONChild(doc, path[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateJSONValue(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+	return setJSONChild(doc, path[0], child)
+}
+
+func addJSONValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateJSONValue(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = value
+			return p, nil
+		case []interface{}:
+			index := len(p)
+			if key != "-" {
+				var err error
+				if index, err = parseJSONArrayIndex(key, len(p)); err != nil {
+					return nil, err
+				}
+			}
+			p = append(p, nil)
+			copy(p[index+1:], p[index:])
+			p[index] = value
+			return p, nil
+		default:
+			return nil, ErrPatchFailed{msg: fmt.Sprintf("can't add %s to a primitive value", key)}
+		}
+	})
+}
+
+func removeJSONValue(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, ErrPatchFailed{msg: "can't remove the whole resource"}
+	}
+	return updateJSONValue(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		if _, err := getJSONChild(parent, key); err != nil {
+			return nil, err
+		}
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			delete(p, key)
+			return p, nil
+		default:
+			a := p.([]interface{})
+			index, _ := strconv.Atoi(key)
+			return append(a[:index], a[index+1:]...), nil
+		}
+	})
+}
+
+func copyJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			c[key] = copyJSONValue(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, child := range v {
+			c[i] = copyJSONValue(child)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+func jsonValuesEqual(a interface{}, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, isNumber := b.(json.Number)
+		if !isNumber {
+			return false
+		}
+		af, err1 := av.Float64()
+		bf, err2 := bv.Float64()
+		return err1 == nil && err2 == nil && af == bf
+	case map[string]interface{}:
+		bv, isObject := b.(map[string]interface{})
+		if !isObject || len(av) != len(bv) {
+			return false
+		}
+		for key, child := range av {
+			if other, exists := bv[key]; !exists || !jsonValuesEqual(child, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, isArray := b.([]interface{})
+		if !isArray || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonValuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// FHIRPath Patch (http://hl7.org/fhir/fhirpatch.html)
+
+// fhirPathPatchOperation is an operation parameter of a FHIRPath Patch
+type fhirPathPatchOperation struct {
+	Type        string
+	Path        string
+	Name        string
+	Value       interface{}
+	HasValue    bool
+	Index       *int
+	Source      *int
+	Destination *int
+}
+
+func applyFHIRPathPatch(resourceType string, doc interface{}, parametersJson []byte) error {
+	operations, err := parseFHIRPathPatch(parametersJson)
+	if err != nil {
+		return err
+	}
+
+	root := doc.(map[string]interface{})
+	for _, op := range operations {
+		switch op.Type {
+		case "add":
+			if op.Name == "" || !op.HasValue {
+				return ErrInvalidPatch{msg: "FHIRPath Patch add operations need a name and a value"}
+			}
+			element, err := evaluateSinglePatchPath(resourceType, root, op.Path)
+			if err != nil {
+				return err
+			}
+			object, isObject := element.JSON().(map[string]interface{})
+			if !isObject {
+				return ErrPatchFailed{msg: fmt.Sprintf("can't add %s to the primitive value at %s", op.Name, op.Path)}
+			}
+			existing, exists := object[op.Name]
+			if list, isList := existing.([]interface{}); isList {
+				object[op.Name] = append(list, op.Value)
+			} else if exists {
+				return ErrPatchFailed{msg: fmt.Sprintf("%s.%s already has a value", op.Path, op.Name)}
+			} else if element.ChildRepeats(op.Name) {
+				object[op.Name] = []interface{}{op.Value}
+			} else {
+				object[op.Name] = op.Value
+			}
+
+		case "insert", "move":
+			parent, name, err := evaluatePatchListPath(resourceType, root, op.Path)
+			if err != nil {
+				return err
+			}
+			list, _ := parent[name].([]interface{})
+			if op.Type == "insert" {
+				if op.Index == nil || !op.HasValue {
+					return ErrInvalidPatch{msg: "FHIRPath Patch insert operations need an index and a value"}
+				}
+				if *op.Index < 0 || *op.Index > len(list) {
+					return ErrPatchFailed{msg: fmt.Sprintf("index %d is out of range for %s", *op.Index, op.Path)}
+				}
+				list = append(list, nil)
+				copy(list[*op.Index+1:], list[*op.Index:])
+				list[*op.Index] = op.Value
+			} else {
+				if op.Source == nil || op.Destination == nil {
+					return ErrInvalidPatch{msg: "FHIRPath Patch move operations need a source and a destination"}
+				}
+				if *op.Source < 0 || *op.Source >= len(list) || *op.Destination < 0 || *op.Destination >= len(list) {
+					return ErrPatchFailed{msg: fmt.Sprintf("move from %d to %d is out of range for %s", *op.Source, *op.Destination, op.Path)}
+				}
+				value := list[*op.Source]
+				list = append(list[:*op.Source], list[*op.Source+1:]...)
+				list = append(list, nil)
+				copy(list[*op.Destination+1:], list[*op.Destination:])
+				list[*op.Destination] = value
+			}
+			parent[name] = list
+
+		case "delete":
+			elements, err := evaluatePatchPath(resourceType, root, op.Path)
+			if err != nil {
+				return err
+			}
+			if len(elements) > 1 {
+				return ErrPatchFailed{msg: fmt.Sprintf("%s matches more than one element", op.Path)}
+			}
+			if len(elements) == 1 {
+				if elements[0].Location() == resourceType {
+					return ErrPatchFailed{msg: "can't delete the whole resource"}
+				}
+				if err = elements[0].Remove(); err != nil {
+					return ErrPatchFailed{msg: err.Error()}
+				}
+			}
+
+		case "replace":
+			if !op.HasValue {
+				return ErrInvalidPatch{msg: "FHIRPath Patch replace operations need a value"}
+			}
+			element, err := evaluateSinglePatchPath(resourceType, root, op.Path)
+			if err != nil {
+				return err
+			}
+			if element.Location() == resourceType {
+				return ErrPatchFailed{msg: "can't replace the whole resource"}
+			}
+			if err = element.Set(op.Value); err != nil {
+				return ErrPatchFailed{msg: err.Error()}
+			}
+
+		default:
+			return ErrInvalidPatch{msg: fmt.Sprintf("unknown FHIRPath Patch operation type: %s", op.Type)}
+		}
+	}
+	return nil
+}
+
+func parseFHIRPathPatch(parametersJson []byte) ([]fhirPathPatchOperation, error) {
+	var parameters struct {
+		Parameter []map[string]interface{} `json:"parameter"`
+	}
+	if err := decodeJSONWithNumbers(parametersJson, &parameters); err != nil {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("failed to parse FHIRPath Patch: %s", err)}
+	}
+
+	var operations []fhirPathPatchOperation
+	for _, parameter := range parameters.Parameter {
+		if parameter["name"] != "operation" {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("unexpected FHIRPath Patch parameter: %v", parameter["name"])}
+		}
+		var op fhirPathPatchOperation
+		parts, _ := parameter["part"].([]interface{})
+		for _, p := range parts {
+			part, _ := p.(map[string]interface{})
+			name, _ := part["name"].(string)
+			value, hasValue := parameterValue(part)
+			if !hasValue {
+				return nil, ErrInvalidPatch{msg: fmt.Sprintf("FHIRPath Patch part %s has no value", name)}
+			}
+			switch name {
+			case "type", "path", "name":
+				str, isString := value.(string)
+				if !isString {
+					return nil, ErrInvalidPatch{msg: fmt.Sprintf("FHIRPath Patch part %s should be a string", name)}
+				}
+				switch name {
+				case "type":
+					op.Type = str
+				case "path":
+					op.Path = str
+				case "name":
+					op.Name = str
+				}
+			case "index", "source", "destination":
+				number, isNumber := value.(json.Number)
+				i, err := number.Int64()
+				if !isNumber || err != nil {
+					return nil, ErrInvalidPatch{msg: fmt.Sprintf("FHIRPath Patch part %s should be an integer", name)}
+				}
+				index := int(i)
+				switch name {
+				case "index":
+					op.Index = &index
+				case "source":
+					op.Source = &index
+				case "destination":
+					op.Destination = &index
+				}
+			case "value":
+				op.Value, op.HasValue = value, true
+			default:
+				return nil, ErrInvalidPatch{msg: fmt.Sprintf("unexpected FHIRPath Patch part: %s", name)}
+			}
+		}
+		if op.Type == "" || op.Path == "" {
+			return nil, ErrInvalidPatch{msg: "FHIRPath Patch operations need a type and a path"}
+		}
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// parameterValue returns the value[x] of a parameter or, for complex values
+// given as parts, an object made from the parts
+func parameterValue(parameter map[string]interface{}) (interface{}, bool) {
+	for key, value := range parameter {
+		if strings.HasPrefix(key, "value") && len(key) > len("value") {
+			return value, true
+		}
+	}
+	parts, hasParts := parameter["part"].([]interface{})
+	if !hasParts {
+		return nil, false
+	}
+	object := make(map[string]interface{})
+	for _, p := range parts {
+		part, _ := p.(map[string]interface{})
+		name, _ := part["name"].(string)
+		value, hasValue := parameterValue(part)
+		if name == "" || !hasValue {
+			return nil, false
+		}
+		if existing, exists := object[name]; exists {
+			list, isList := existing.([]interface{})
+			if !isList {
+				list = []interface{}{existing}
+			}
+			object[name] = append(list, value)
+		} else {
+			object[name] = value
+		}
+	}
+	return object, true
+}
+
+func evaluateSinglePatchPath(resourceType string, root map[string]interface{}, path string) (*fhirpath.Value, error) {
+	elements, err := evaluatePatchPath(resourceType, root, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) != 1 {
+		return nil, ErrPatchFailed{msg: fmt.Sprintf("%s matches %d elements rather than one", path, len(elements))}
+	}
+	return elements[0], nil
+}
+
+// evaluatePatchListPath returns the parent and name of the list selected by a path
+// that ends with an element name, since the list may be empty
+func evaluatePatchListPath(resourceType string, root map[string]interface{}, path string) (map[string]interface{}, string, error) {
+	expression, err := compilePatchPath(resourceType, path)
+	if err != nil {
+		return nil, "", err
+	}
+	parentExpression, name, endsWithName := expression.SplitLastElement()
+	if !endsWithName {
+		return nil, "", ErrInvalidPatch{msg: fmt.Sprintf("%s should end with the name of a list element", path)}
+	}
+	element, err := evaluateSinglePatchPath(resourceType, root, parentExpression.String())
+	if err != nil {
+		return nil, "", err
+	}
+	parent, isObject := element.JSON().(map[string]interface{})
+	if !isObject {
+		return nil, "", ErrPatchFailed{msg: fmt.Sprintf("%s isn't a list", path)}
+	}
+	if _, isList := parent[name].([]interface{}); parent[name] != nil && !isList {
+		return nil, "", ErrPatchFailed{msg: fmt.Sprintf("%s isn't a list", path)}
+	}
+	return parent, name, nil
+}
+
+// evaluatePatchPath evaluates a FHIRPath expression that selects elements of the resource,
+// e.g. Patient.identifier.where(system='urn:oid:1.2.3').value or Patient.name[0].given
+func evaluatePatchPath(resourceType string, root map[string]interface{}, path string) (fhirpath.Collection, error) {
+	expression, err := compilePatchPath(resourceType, path)
+	if err != nil {
+		return nil, err
+	}
+	result, err := expression.Evaluate(root, nil)
+	if err != nil {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("invalid patch path %s: %s", path, errors.Cause(err))}
+	}
+	for _, value := range result {
+		if !value.IsElement() {
+			return nil, ErrInvalidPatch{msg: fmt.Sprintf("patch path %s should select elements of the resource rather than computed values", path)}
+		}
+	}
+	return result, nil
+}
+
+func compilePatchPath(resourceType string, path string) (*fhirpath.Expression, error) {
+	if path != resourceType && !strings.HasPrefix(path, resourceType+".") && !strings.HasPrefix(path, resourceType+"[") {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("%s should start with %s", path, resourceType)}
+	}
+	expression, err := fhirpath.Compile(path)
+	if err != nil {
+		return nil, ErrInvalidPatch{msg: fmt.Sprintf("invalid patch path: %s", err)}
+	}
+	return expression, nil
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/eug48/fhir/models2"
+)
+
+type PatchSuite struct {
+}
+
+var _ = Suite(&PatchSuite{})
+
+const patchTestPatient = `{
+	"resourceType": "Patient",
+	"id": "123",
+	"active": true,
+	"name": [{ "family": "Duck", "given": ["Donald"] }, { "family": "Mouse" }],
+	"identifier": [
+		{ "system": "urn:oid:1.2.3", "value": "abc" },
+		{ "system": "urn:oid:4.5.6", "value": "def" }
+	]
+}`
+
+func applyTestPatch(c *C, patch *resourcePatch) (map[string]interface{}, error) {
+	patched, err := patch.apply("Patient", []byte(patchTestPatient))
+	if err != nil {
+		return nil, err
+	}
+	var resource map[string]interface{}
+	c.Assert(json.Unmarshal(patched, &resource), IsNil)
+	return resource, nil
+}
+
+func (s *PatchSuite) TestJSONPatch(c *C) {
+	patch := &resourcePatch{jsonPatch: []byte(`[
+		{ "op": "test", "path": "/active", "value": true },
+		{ "op": "replace", "path": "/active", "value": false },
+		{ "op": "add", "path": "/birthDate", "value": "1934-06-09" },
+		{ "op": "add", "path": "/name/0/given/-", "value": "Fauntleroy" },
+		{ "op": "remove", "path": "/identifier/1" },
+		{ "op": "copy", "from": "/name/1/family", "path": "/name/0/suffix" },
+		{ "op": "move", "from": "/name/1", "path": "/name/0" }
+	]`)}
+	resource, err := applyTestPatch(c, patch)
+	c.Assert(err, IsNil)
+	c.Assert(resource["active"], Equals, false)
+	c.Assert(resource["birthDate"], Equals, "1934-06-09")
+	c.Assert(resource["identifier"], HasLen, 1)
+	names := resource["name"].([]interface{})
+	c.Assert(names, HasLen, 2)
+	c.Assert(names[0].(map[string]interface{})["family"], Equals, "Mouse")
+	c.Assert(names[1].(map[string]interface{})["given"], DeepEquals, []interface{}{"Donald", "Fauntleroy"})
+	c.Assert(names[1].(map[string]interface{})["suffix"], Equals, "Mouse")
+}
+
+func (s *PatchSuite) TestJSONPatchErrors(c *C) {
+	_, err := applyTestPatch(c, &resourcePatch{jsonPatch: []byte(`[{ "op": "test", "path": "/active", "value": false }]`)})
+	c.Assert(err, FitsTypeOf, ErrPatchFailed{})
+
+	_, err = applyTestPatch(c, &resourcePatch{jsonPatch: []byte(`[{ "op": "remove", "path": "/gender" }]`)})
+	c.Assert(err, FitsTypeOf, ErrPatchFailed{})
+
+	_, err = applyTestPatch(c, &resourcePatch{jsonPatch: []byte(`[{ "op": "replace", "path": "/name/2", "value": {} }]`)})
+	c.Assert(err, FitsTypeOf, ErrPatchFailed{})
+
+	_, err = applyTestPatch(c, &resourcePatch{jsonPatch: []byte(`[{ "op": "frobnicate", "path": "/active" }]`)})
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+
+	_, err = applyTestPatch(c, &resourcePatch{jsonPatch: []byte(`{ "op": "remove", "path": "/active" }`)})
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+}
+
+func testFHIRPathPatch(parts string) *resourcePatch {
+	return &resourcePatch{fhirPathPatch: []byte(`{
+		"resourceType": "Parameters",
+		"parameter": [{ "name": "operation", "part": [` + parts + `] }]
+	}`)}
+}
+
+func (s *PatchSuite) TestFHIRPathPatch(c *C) {
+	resource, err := applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.identifier.where(system='urn:oid:4.5.6').value" },
+		{ "name": "value", "valueString": "xyz" }`))
+	c.Assert(err, IsNil)
+	identifiers := resource["identifier"].([]interface{})
+	c.Assert(identifiers[0].(map[string]interface{})["value"], Equals, "abc")
+	c.Assert(identifiers[1].(map[string]interface{})["value"], Equals, "xyz")
+
+	// gender isn't a list but telecom is
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "add" },
+		{ "name": "path", "valueString": "Patient" },
+		{ "name": "name", "valueString": "gender" },
+		{ "name": "value", "valueCode": "male" }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["gender"], Equals, "male")
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "add" },
+		{ "name": "path", "valueString": "Patient" },
+		{ "name": "name", "valueString": "telecom" },
+		{ "name": "value", "part": [
+			{ "name": "system", "valueCode": "phone" },
+			{ "name": "value", "valueString": "555-1234" }
+		] }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["telecom"], DeepEquals, []interface{}{map[string]interface{}{"system": "phone", "value": "555-1234"}})
+
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "insert" },
+		{ "name": "path", "valueString": "Patient.name[0].given" },
+		{ "name": "index", "valueInteger": 0 },
+		{ "name": "value", "valueString": "Sir" }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["name"].([]interface{})[0].(map[string]interface{})["given"], DeepEquals, []interface{}{"Sir", "Donald"})
+
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "move" },
+		{ "name": "path", "valueString": "Patient.name" },
+		{ "name": "source", "valueInteger": 1 },
+		{ "name": "destination", "valueInteger": 0 }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["name"].([]interface{})[0].(map[string]interface{})["family"], Equals, "Mouse")
+
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "delete" },
+		{ "name": "path", "valueString": "Patient.name.where(family='Mouse')" }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["name"], HasLen, 1)
+
+	// paths can use any FHIRPath that selects elements
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.name.where(given.exists().not()).select(family)" },
+		{ "name": "value", "valueString": "Duck" }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["name"].([]interface{})[1].(map[string]interface{})["family"], Equals, "Duck")
+
+	// deleting nothing isn't an error
+	resource, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "delete" },
+		{ "name": "path", "valueString": "Patient.birthDate" }`))
+	c.Assert(err, IsNil)
+	c.Assert(resource["name"], HasLen, 2)
+}
+
+func (s *PatchSuite) TestFHIRPathPatchErrors(c *C) {
+	_, err := applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.identifier.value" },
+		{ "name": "value", "valueString": "xyz" }`))
+	c.Assert(err, FitsTypeOf, ErrPatchFailed{})
+
+	_, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "add" },
+		{ "name": "path", "valueString": "Patient" },
+		{ "name": "name", "valueString": "active" },
+		{ "name": "value", "valueBoolean": false }`))
+	c.Assert(err, FitsTypeOf, ErrPatchFailed{})
+
+	_, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Observation.status" },
+		{ "name": "value", "valueCode": "final" }`))
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+
+	_, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.name.where(family = 'Duck'" },
+		{ "name": "value", "valueString": "Duck" }`))
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+
+	_, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.name.count()" },
+		{ "name": "value", "valueInteger": 3 }`))
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+
+	_, err = applyTestPatch(c, testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "replace" },
+		{ "name": "path", "valueString": "Patient.nickname" },
+		{ "name": "value", "valueString": "Duck" }`))
+	c.Assert(err, FitsTypeOf, ErrInvalidPatch{})
+}
+
+// concurrentlyUpdatedSession updates a resource as if by another request after each of the first updates Gets read it
+type concurrentlyUpdatedSession struct {
+	DataAccessSession
+	updates int
+}
+
+func (s *concurrentlyUpdatedSession) Get(id, resourceType string) (*models2.Resource, error) {
+	resource, err := s.DataAccessSession.Get(id, resourceType)
+	if err == nil && s.updates > 0 {
+		s.updates--
+		concurrent, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Patient", "id": "123", "gender": "female"}`))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = s.DataAccessSession.Put(id, "", concurrent); err != nil {
+			return nil, err
+		}
+	}
+	return resource, err
+}
+
+func (s *PatchSuite) TestConcurrentPatch(c *C) {
+	dal := NewMemoryDataAccessLayer("fhir", false, "", make(map[string]InterceptorList), DefaultConfig)
+	session := dal.StartSession(context.Background(), "")
+	defer session.Finish()
+	patient, err := models2.NewResourceFromJsonBytes([]byte(patchTestPatient))
+	c.Assert(err, IsNil)
+	_, err = session.Put("123", "", patient)
+	c.Assert(err, IsNil)
+
+	// the patch is applied again to the concurrent update rather than overwriting it
+	patch := &resourcePatch{jsonPatch: []byte(`[{ "op": "add", "path": "/birthDate", "value": "1934-06-09" }]`)}
+	concurrent := &concurrentlyUpdatedSession{DataAccessSession: session, updates: 1}
+	patched, err := patchResource(concurrent, "Patient", "123", "", patch, models2.WhatToEncrypt{})
+	c.Assert(err, IsNil)
+	c.Assert(patched.VersionId(), Equals, "3")
+	stored, err := session.Get("123", "Patient")
+	c.Assert(err, IsNil)
+	var storedPatient struct{ Gender, BirthDate string }
+	c.Assert(json.Unmarshal(stored.JsonBytes(), &storedPatient), IsNil)
+	c.Assert(storedPatient.Gender, Equals, "female")
+	c.Assert(storedPatient.BirthDate, Equals, "1934-06-09")
+
+	// it's a conflict if the resource keeps being updated
+	concurrent.updates = patchAttempts
+	_, err = patchResource(concurrent, "Patient", "123", "", patch, models2.WhatToEncrypt{})
+	c.Assert(errors.Cause(err), FitsTypeOf, ErrConflict{})
+}
+
+func (s *PatchSuite) TestPatchRoutes(c *C) {
+	server := newMemoryTestServer(nil)
+	request := func(method string, path string, contentType string, body string, headers ...string) *httptest.ResponseRecorder {
+		return serve(server, method, path, body, append([]string{"Content-Type", contentType}, headers...)...)
+	}
+
+	w := request("PUT", "/Patient/123", "application/fhir+json", patchTestPatient)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `[{ "op": "replace", "path": "/active", "value": false }]`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf(w.Body.String()))
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"2"`)
+	c.Assert(strings.Contains(w.Body.String(), `"active":false`), Equals, true)
+
+	// If-Match
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `[{ "op": "replace", "path": "/active", "value": true }]`, "If-Match", `W/"1"`)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+
+	// FHIRPath Patch with a conditional PATCH
+	w = request("PATCH", "/Patient?identifier=urn:oid:1.2.3|abc", "application/fhir+json", string(testFHIRPathPatch(`
+		{ "name": "type", "valueCode": "add" },
+		{ "name": "path", "valueString": "Patient" },
+		{ "name": "name", "valueString": "gender" },
+		{ "name": "value", "valueCode": "male" }`).fhirPathPatch), "If-Match", `W/"2"`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf(w.Body.String()))
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"3"`)
+
+	w = request("PATCH", "/Patient?identifier=urn:oid:1.2.3|nothing", "application/json-patch+json", `[]`)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	w = request("PATCH", "/Patient/456", "application/json-patch+json", `[]`)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// failed and invalid patches
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `[{ "op": "test", "path": "/active", "value": true }]`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `[{ "op": "replace", "path": "/id", "value": "456" }]`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `[{ "op": "add", "path": "/foo", "value": 1 }]`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity, Commentf(w.Body.String()))
+	w = request("PATCH", "/Patient/123", "application/json-patch+json", `not json`)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	w = request("PATCH", "/Patient/123", "application/fhir+json", patchTestPatient)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	// patches in a transaction
+	jsonPatch := base64.StdEncoding.EncodeToString([]byte(`[{ "op": "add", "path": "/birthDate", "value": "1934-06-09" }]`))
+	w = request("POST", "/", "application/fhir+json", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"resource": { "resourceType": "Binary", "contentType": "application/json-patch+json", "content": "`+jsonPatch+`" },
+			"request": { "method": "PATCH", "url": "Patient/123", "ifMatch": "W/\"3\"" }
+		}, {
+			"resource": `+string(testFHIRPathPatch(`
+				{ "name": "type", "valueCode": "delete" },
+				{ "name": "path", "valueString": "Patient.name.where(family='Mouse')" }`).fhirPathPatch)+`,
+			"request": { "method": "PATCH", "url": "Patient?identifier=urn:oid:4.5.6|def" }
+		}]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf(w.Body.String()))
+	c.Assert(strings.Contains(w.Body.String(), `"status":"200"`), Equals, true)
+
+	w = request("GET", "/Patient/123", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"birthDate":"1934-06-09"`), Equals, true)
+	c.Assert(strings.Contains(w.Body.String(), `"Mouse"`), Equals, false)
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"5"`)
+
+	// every patch is a new version
+	w = request("GET", "/Patient/123/_history", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var history struct {
+		Total int `json:"total"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &history), IsNil)
+	c.Assert(history.Total, Equals, 5)
+
+	// a failed patch aborts a transaction
+	w = request("POST", "/", "application/fhir+json", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"resource": { "resourceType": "Patient", "id": "123", "active": true },
+			"request": { "method": "PUT", "url": "Patient/123" }
+		}, {
+			"resource": { "resourceType": "Binary", "contentType": "application/json-patch+json", "content": "`+base64.StdEncoding.EncodeToString([]byte(`[{ "op": "remove", "path": "/deceasedBoolean" }]`))+`" },
+			"request": { "method": "PATCH", "url": "Patient/123" }
+		}]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity, Commentf(w.Body.String()))
+	w = request("GET", "/Patient/123", "", "")
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"5"`)
+}
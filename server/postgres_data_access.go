@@ -0,0 +1,972 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The PostgreSQL backend is described in docs/PostgreSQL_ideas.md ("Current implementation"):
+//   - every resource type has a table holding its current versions and a _search table
+//     with one row per indexed search parameter value (rather than a column per parameter)
+//   - resources are stored as immutable blobs identified by (id, version_id). The blobs are
+//     the same GoFHIR BSON documents stored in MongoDB so encryption and decimal precision
+//     are handled identically by both backends
+//   - a single history table holds all versions (including current ones) of all resources
+//     and its last_updated index can be used for whole-system history queries
+//   - each database (see Config.EnableMultiDB) is a PostgreSQL schema
+
+type postgresDataAccessLayer struct {
+	db                           *sql.DB
+	defaultSchema                string
+	enableMultiDB                bool
+	dbSuffix                     string
+	Interceptors                 map[string]InterceptorList
+	countTotalResults            bool
+	enableCISearches             bool
+	tokenParametersCaseSensitive bool
+	enableHistory                bool
+	createdSchemas               sync.Map
+}
+
+type postgresSession struct {
+	ctx    context.Context
+	dal    *postgresDataAccessLayer
+	schema string
+	tx     *sql.Tx
+}
+
+// NewPostgresDataAccessLayer returns an implementation of DataAccessLayer that is backed by a PostgreSQL database
+func NewPostgresDataAccessLayer(db *sql.DB, defaultSchema string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
+	return &postgresDataAccessLayer{
+		db:                           db,
+		defaultSchema:                defaultSchema,
+		enableMultiDB:                enableMultiDB,
+		dbSuffix:                     dbSuffix,
+		Interceptors:                 interceptors,
+		countTotalResults:            config.CountTotalResults,
+		enableCISearches:             config.EnableCISearches,
+		tokenParametersCaseSensitive: config.TokenParametersCaseSensitive,
+		enableHistory:                config.EnableHistory,
+	}
+}
+
+func (dal *postgresDataAccessLayer) StartSession(ctx context.Context, customDbName string) DataAccessSession {
+	var schema string
+	if dal.enableMultiDB && customDbName != "" {
+		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
+			panic(errors.Errorf("database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
+		}
+		schema = customDbName
+	} else {
+		schema = dal.defaultSchema
+	}
+
+	// like MongoDB collections, schemas are created on first use
+	if _, created := dal.createdSchemas.Load(schema); !created {
+		if err := CreatePostgresSchema(ctx, dal.db, schema); err != nil {
+			panic(errors.Wrapf(err, "failed to create PostgreSQL schema %s", schema))
+		}
+		dal.createdSchemas.Store(schema, true)
+	}
+
+	return &postgresSession{
+		ctx:    ctx,
+		dal:    dal,
+		schema: schema,
+	}
+}
+
+// CreatePostgresSchema creates the schema and its tables if they don't already exist
+func CreatePostgresSchema(ctx context.Context, db *sql.DB, schema string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "CreatePostgresSchema: BeginTx failed")
+	}
+	defer tx.Rollback()
+
+	// serialise concurrent attempts as CREATE ... IF NOT EXISTS isn't safe against them
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", schema); err != nil {
+		return errors.Wrap(err, "CreatePostgresSchema: pg_advisory_xact_lock failed")
+	}
+
+	quotedSchema := pq.QuoteIdentifier(schema)
+	history := search.PostgresHistoryTable(schema)
+	statements := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + quotedSchema,
+		"CREATE TABLE IF NOT EXISTS " + history + ` (
+			resource_type text NOT NULL,
+			id text NOT NULL,
+			version_id integer NOT NULL,
+			last_updated timestamptz NOT NULL,
+			deleted boolean NOT NULL DEFAULT false,
+			resource bytea,
+			PRIMARY KEY (resource_type, id, version_id))`,
+		"CREATE INDEX IF NOT EXISTS history_last_updated ON " + history + " (last_updated)",
+	}
+	if _, err = tx.ExecContext(ctx, strings.Join(statements, ";\n")); err != nil {
+		return errors.Wrap(err, "CreatePostgresSchema: failed to create history table")
+	}
+
+	for _, name := range models2.AllFhirResourceCollectionNames() {
+		table := quotedSchema + "." + pq.QuoteIdentifier(name)
+		index := quotedSchema + "." + pq.QuoteIdentifier(name+"_search")
+		statements := []string{
+			"CREATE TABLE IF NOT EXISTS " + table + ` (
+				id text PRIMARY KEY,
+				version_id integer NOT NULL,
+				last_updated timestamptz NOT NULL,
+				resource bytea NOT NULL)`,
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (last_updated)", pq.QuoteIdentifier(name+"_last_updated"), table),
+			"CREATE TABLE IF NOT EXISTS " + index + ` (
+				id text NOT NULL REFERENCES ` + table + ` (id) ON DELETE CASCADE,
+				param text NOT NULL,
+				system text,
+				code text,
+				value_string text,
+				date_from timestamptz,
+				date_to timestamptz,
+				num_from double precision,
+				num_to double precision,
+				ref_type text,
+				ref_id text)`,
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (id)", pq.QuoteIdentifier(name+"_search_id"), index),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (param, lower(code))", pq.QuoteIdentifier(name+"_search_code"), index),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (param, lower(value_string) text_pattern_ops)", pq.QuoteIdentifier(name+"_search_string"), index),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (param, date_from, date_to)", pq.QuoteIdentifier(name+"_search_date"), index),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (param, num_from, num_to)", pq.QuoteIdentifier(name+"_search_num"), index),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (param, ref_id)", pq.QuoteIdentifier(name+"_search_ref"), index),
+		}
+		if _, err = tx.ExecContext(ctx, strings.Join(statements, ";\n")); err != nil {
+			return errors.Wrapf(err, "CreatePostgresSchema: failed to create tables for %s", name)
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "CreatePostgresSchema: Commit failed")
+}
+
+func (ps *postgresSession) StartTransaction() error {
+	if ps.tx != nil {
+		// sucess if already in a transaction
+		return nil
+	}
+
+	tx, err := ps.dal.db.BeginTx(ps.ctx, nil)
+	glog.V(3).Infof("StartTransaction")
+	if err == nil {
+		ps.tx = tx
+	}
+	return errors.Wrap(err, "postgresSession.StartTransaction")
+}
+
+func (ps *postgresSession) CommmitIfTransaction() error {
+	if ps.tx == nil {
+		return nil
+	}
+	glog.V(3).Infof("CommmitTransaction")
+	err := ps.tx.Commit()
+	ps.tx = nil
+	return errors.Wrap(convertPostgresErr(err), "postgresSession.CommmitIfTransaction")
+}
+
+func (ps *postgresSession) Finish() {
+	if ps.tx != nil {
+		glog.Warningf("Rollback called from postgresSession.Finish")
+		if err := ps.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			glog.Errorf("Rollback in postgresSession.Finish failed: %v", err)
+		}
+		ps.tx = nil
+	}
+}
+
+// querier returns the transaction if one is running so that reads see its writes
+func (ps *postgresSession) querier() search.PostgresQuerier {
+	if ps.tx != nil {
+		return ps.tx
+	}
+	return ps.dal.db
+}
+
+// withTx runs fn in the session's transaction or, if there isn't one,
+// in a transaction of its own so multi-statement writes are atomic
+func (ps *postgresSession) withTx(fn func(tx *sql.Tx) error) error {
+	if ps.tx != nil {
+		return fn(ps.tx)
+	}
+
+	tx, err := ps.dal.db.BeginTx(ps.ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "BeginTx failed")
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(convertPostgresErr(tx.Commit()), "Commit failed")
+}
+
+var validPostgresIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+func checkPostgresID(id string) error {
+	if validPostgresIDRegex.MatchString(id) {
+		return nil
+	}
+	return models.NewOperationOutcome("fatal", "exception", "Id must be a valid FHIR id")
+}
+
+func knownResourceType(resourceType string) bool {
+	_, known := search.SearchParameterDictionary[resourceType]
+	return known
+}
+
+func (ps *postgresSession) Get(id, resourceType string) (resource *models2.Resource, err error) {
+	if checkPostgresID(id) != nil || !knownResourceType(resourceType) {
+		return nil, ErrNotFound
+	}
+
+	var blob []byte
+	err = ps.querier().QueryRowContext(ps.ctx,
+		"SELECT resource FROM "+search.PostgresResourceTable(ps.schema, resourceType)+" WHERE id = $1", id).Scan(&blob)
+	glog.V(3).Infof("Get %s/%s --> %d bytes (err %+v)", resourceType, id, len(blob), err)
+
+	if err == sql.ErrNoRows && ps.dal.enableHistory {
+		// check whether this is a deleted record
+		var deleted bool
+		err = ps.querier().QueryRowContext(ps.ctx,
+			"SELECT EXISTS (SELECT 1 FROM "+search.PostgresHistoryTable(ps.schema)+" WHERE resource_type = $1 AND id = $2 AND deleted)",
+			resourceType, id).Scan(&deleted)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get --> history query")
+		}
+		if deleted {
+			return nil, ErrDeleted
+		}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	return search.DecodePostgresResource(blob)
+}
+
+func (ps *postgresSession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
+	if checkPostgresID(id) != nil || !knownResourceType(resourceType) {
+		return nil, ErrNotFound
+	}
+
+	versionIdInt, err := strconv.Atoi(versionIdStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert versionId to an integer (%s)", versionIdStr)
+	}
+
+	// First assume versionId is for the current version
+	var blob []byte
+	err = ps.querier().QueryRowContext(ps.ctx,
+		"SELECT resource FROM "+search.PostgresResourceTable(ps.schema, resourceType)+" WHERE id = $1 AND version_id = $2",
+		id, versionIdInt).Scan(&blob)
+	if err == nil {
+		return search.DecodePostgresResource(blob)
+	} else if err != sql.ErrNoRows {
+		return nil, errors.Wrap(convertPostgresErr(err), "failed to search for current version")
+	}
+
+	// try to search for previous versions
+	var deleted bool
+	err = ps.querier().QueryRowContext(ps.ctx,
+		"SELECT deleted, resource FROM "+search.PostgresHistoryTable(ps.schema)+" WHERE resource_type = $1 AND id = $2 AND version_id = $3",
+		resourceType, id, versionIdInt).Scan(&deleted, &blob)
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+	if deleted {
+		return nil, ErrDeleted
+	}
+	return search.DecodePostgresResource(blob)
+}
+
+func (ps *postgresSession) Post(resource *models2.Resource) (id string, err error) {
+	id = primitive.NewObjectID().Hex()
+	err = ps.PostWithID(id, resource)
+	return
+}
+
+func (ps *postgresSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	existingIds, err := ps.FindIDs(query)
+	if err != nil {
+		return
+	}
+
+	if len(existingIds) == 0 {
+		httpStatus = 201
+		id = primitive.NewObjectID().Hex()
+		err = ps.PostWithID(id, resource)
+		if err == nil {
+			outputResource = resource
+		}
+
+	} else if len(existingIds) == 1 {
+		httpStatus = 200
+		id = existingIds[0]
+		outputResource, err = ps.Get(id, query.Resource)
+
+	} else if len(existingIds) > 1 {
+		httpStatus = 412
+	}
+
+	return
+}
+
+func (ps *postgresSession) PostWithID(id string, resource *models2.Resource) error {
+	if err := checkPostgresID(id); err != nil {
+		return err
+	}
+
+	resource.SetId(id)
+	updateResourceMeta(resource, 1)
+	resourceType := resource.ResourceType()
+	if !knownResourceType(resourceType) {
+		return errors.Errorf("unknown resource type: %s", resourceType)
+	}
+
+	invokeInterceptorsBefore(ps.dal.Interceptors, "Create", resourceType, resource)
+
+	glog.V(3).Infof("PostWithID: inserting %s/%s", resourceType, id)
+	err := ps.withTx(func(tx *sql.Tx) error {
+		return ps.writeResource(tx, resource, 1, true)
+	})
+
+	if err == nil {
+		invokeInterceptorsAfter(ps.dal.Interceptors, "Create", resourceType, resource)
+	} else {
+		invokeInterceptorsOnError(ps.dal.Interceptors, "Create", resourceType, err, resource)
+	}
+
+	return err
+}
+
+func (ps *postgresSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	if err := checkPostgresID(id); err != nil {
+		return false, err
+	}
+
+	resourceType := resource.ResourceType()
+	if !knownResourceType(resourceType) {
+		return false, errors.Errorf("unknown resource type: %s", resourceType)
+	}
+	resource.SetId(id)
+	if conditionalVersionId != "" {
+		glog.V(3).Infof("PUT %s/%s (If-Match %s)", resourceType, id, conditionalVersionId)
+	} else {
+		glog.V(3).Infof("PUT %s/%s", resourceType, id)
+	}
+
+	if !ps.dal.enableHistory && conditionalVersionId != "" {
+		return false, errors.Errorf("If-Match specified for a conditional put, but version histories are disabled")
+	}
+
+	hasUpdateInterceptors := hasInterceptorsForOpAndType(ps.dal.Interceptors, "Update", resourceType)
+
+	err = ps.withTx(func(tx *sql.Tx) error {
+		// the current version is locked (and read for any interceptors) by the writing transaction
+		resourceColumn := "NULL"
+		if hasUpdateInterceptors {
+			resourceColumn = "resource"
+		}
+		var curVersionId int
+		var curBlob []byte
+		err := tx.QueryRowContext(ps.ctx,
+			"SELECT version_id, "+resourceColumn+" FROM "+search.PostgresResourceTable(ps.schema, resourceType)+" WHERE id = $1 FOR UPDATE",
+			id).Scan(&curVersionId, &curBlob)
+
+		if err == sql.ErrNoRows {
+			if conditionalVersionId != "" {
+				return ErrConflict{msg: "If-Match specified for a resource that doesn't exist"}
+			}
+			createdNew = true
+			// continue the numbering of any deleted versions
+			err = tx.QueryRowContext(ps.ctx,
+				"SELECT COALESCE(max(version_id), 0) FROM "+search.PostgresHistoryTable(ps.schema)+" WHERE resource_type = $1 AND id = $2",
+				resourceType, id).Scan(&curVersionId)
+			if err != nil {
+				return errors.Wrap(err, "Put: error retrieving previous versionId")
+			}
+		} else if err != nil {
+			return errors.Wrap(convertPostgresErr(err), "Put: error retrieving current version")
+		} else if conditionalVersionId != "" && conditionalVersionId != strconv.Itoa(curVersionId) {
+			return ErrConflict{msg: "If-Match doesn't match current versionId"}
+		}
+
+		newVersionId := curVersionId + 1
+		glog.V(3).Infof("  versionIds: current %d; new %d", curVersionId, newVersionId)
+		updateResourceMeta(resource, newVersionId)
+
+		if !createdNew && hasUpdateInterceptors {
+			oldResource, decodeError := search.DecodePostgresResource(curBlob)
+			if decodeError == nil {
+				invokeInterceptorsBefore(ps.dal.Interceptors, "Update", resourceType, oldResource)
+			}
+		}
+
+		return ps.writeResource(tx, resource, newVersionId, createdNew)
+	})
+
+	if err == nil {
+		if createdNew {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Create", resourceType, resource)
+		} else {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Update", resourceType, resource)
+		}
+	} else {
+		invokeInterceptorsOnError(ps.dal.Interceptors, "Update", resourceType, err, resource)
+	}
+
+	return createdNew, err
+}
+
+// writeResource stores a new current version of a resource together with its search index rows
+func (ps *postgresSession) writeResource(tx *sql.Tx, resource *models2.Resource, versionId int, isNew bool) error {
+	resourceType := resource.ResourceType()
+	id := resource.Id()
+	table := search.PostgresResourceTable(ps.schema, resourceType)
+	indexTable := search.PostgresIndexTable(ps.schema, resourceType)
+
+	doc, err := resource.GetBSON()
+	if err != nil {
+		return errors.Wrap(err, "writeResource: GetBSON failed")
+	}
+	blob, err := bson.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "writeResource: bson.Marshal failed")
+	}
+	lastUpdated := resource.LastUpdatedTime()
+
+	if isNew {
+		_, err = tx.ExecContext(ps.ctx, "INSERT INTO "+table+" (id, version_id, last_updated, resource) VALUES ($1, $2, $3, $4)",
+			id, versionId, lastUpdated, blob)
+	} else {
+		_, err = tx.ExecContext(ps.ctx, "UPDATE "+table+" SET version_id = $2, last_updated = $3, resource = $4 WHERE id = $1",
+			id, versionId, lastUpdated, blob)
+		if err == nil {
+			_, err = tx.ExecContext(ps.ctx, "DELETE FROM "+indexTable+" WHERE id = $1", id)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(convertPostgresErr(err), "writeResource: failed to store %s/%s", resourceType, id)
+	}
+
+	rows := search.ExtractPostgresIndexRows(resourceType, doc.([]bson.E))
+	if err = ps.insertIndexRows(tx, indexTable, id, rows); err != nil {
+		return errors.Wrapf(err, "writeResource: failed to index %s/%s", resourceType, id)
+	}
+
+	if ps.dal.enableHistory {
+		_, err = tx.ExecContext(ps.ctx,
+			"INSERT INTO "+search.PostgresHistoryTable(ps.schema)+" (resource_type, id, version_id, last_updated, resource) VALUES ($1, $2, $3, $4, $5)",
+			resourceType, id, versionId, lastUpdated, blob)
+		if err != nil {
+			return errors.Wrapf(convertPostgresErr(err), "writeResource: failed to store version %d of %s/%s in history", versionId, resourceType, id)
+		}
+	}
+	return nil
+}
+
+// insertIndexRows inserts search index rows using multi-row INSERTs
+func (ps *postgresSession) insertIndexRows(tx *sql.Tx, indexTable string, id string, rows []search.PostgresIndexRow) error {
+	const columns = 11
+	const rowsPerStatement = 500 // stays well under PostgreSQL's limit of 65535 parameters
+
+	for start := 0; start < len(rows); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var sqlStr strings.Builder
+		sqlStr.WriteString("INSERT INTO " + indexTable + " (id, param, system, code, value_string, date_from, date_to, num_from, num_to, ref_type, ref_id) VALUES ")
+		args := make([]interface{}, 0, (end-start)*columns)
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sqlStr.WriteString(", ")
+			}
+			sqlStr.WriteString("(")
+			for c := 1; c <= columns; c++ {
+				if c > 1 {
+					sqlStr.WriteString(", ")
+				}
+				sqlStr.WriteString("$" + strconv.Itoa(i*columns+c))
+			}
+			sqlStr.WriteString(")")
+			args = append(args, id, row.Param, row.System, row.Code, row.ValueString, row.DateFrom, row.DateTo, row.NumFrom, row.NumTo, row.RefType, row.RefID)
+		}
+
+		if _, err := tx.ExecContext(ps.ctx, sqlStr.String(), args...); err != nil {
+			return convertPostgresErr(err)
+		}
+	}
+	return nil
+}
+
+func (ps *postgresSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	if IDs, err := ps.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = primitive.NewObjectID().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, &ErrMultipleMatches{msg: fmt.Sprintf("Multiple matches for %s?%s", query.Resource, query.Query)}
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = ps.Put(id, conditionalVersionId, resource)
+	return id, createdNew, err
+}
+
+func (ps *postgresSession) Delete(id, resourceType string) (newVersionId string, err error) {
+	if checkPostgresID(id) != nil || !knownResourceType(resourceType) {
+		return "", ErrNotFound
+	}
+
+	var resource interface{}
+	var getError error
+	hasInterceptor := hasInterceptorsForOpAndType(ps.dal.Interceptors, "Delete", resourceType)
+	if hasInterceptor {
+		// Although this is a delete operation we need to get the resource first so we can
+		// run any interceptors on the resource before it's deleted.
+		resource, getError = ps.Get(id, resourceType)
+		invokeInterceptorsBefore(ps.dal.Interceptors, "Delete", resourceType, resource)
+	}
+
+	err = ps.withTx(func(tx *sql.Tx) error {
+		var curVersionId int
+		err := tx.QueryRowContext(ps.ctx,
+			"DELETE FROM "+search.PostgresResourceTable(ps.schema, resourceType)+" WHERE id = $1 RETURNING version_id",
+			id).Scan(&curVersionId)
+		if err != nil {
+			return convertPostgresErr(err)
+		}
+		glog.V(3).Infof("   deleted %s/%s (version %d)", resourceType, id, curVersionId)
+
+		if ps.dal.enableHistory {
+			// create a deletion record
+			_, err = tx.ExecContext(ps.ctx,
+				"INSERT INTO "+search.PostgresHistoryTable(ps.schema)+" (resource_type, id, version_id, last_updated, deleted) VALUES ($1, $2, $3, $4, true)",
+				resourceType, id, curVersionId+1, time.Now())
+			if err != nil {
+				return errors.Wrap(convertPostgresErr(err), "Delete: failed to store deletion marker")
+			}
+			newVersionId = strconv.Itoa(curVersionId + 1)
+		}
+		return nil
+	})
+
+	if hasInterceptor {
+		if err == nil && getError == nil {
+			invokeInterceptorsAfter(ps.dal.Interceptors, "Delete", resourceType, resource)
+		} else {
+			invokeInterceptorsOnError(ps.dal.Interceptors, "Delete", resourceType, err, resource)
+		}
+	}
+
+	return newVersionId, err
+}
+
+func (ps *postgresSession) ConditionalDelete(query search.Query) (count int64, err error) {
+	IDsToDelete, err := ps.FindIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ps.withTx(func(tx *sql.Tx) error {
+		// run the individual deletions in a single transaction
+		outerTx := ps.tx
+		ps.tx = tx
+		defer func() { ps.tx = outerTx }()
+
+		for _, id := range IDsToDelete {
+			if _, err := ps.Delete(id, query.Resource); err != nil {
+				return errors.Wrapf(err, "ConditionalDelete: failed to delete %s/%s", query.Resource, id)
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (ps *postgresSession) History(baseURL url.URL, historyQuery search.Query, id string) (bundle *models2.ShallowBundle, err error) {
+	resourceType := historyQuery.Resource
+	if checkPostgresID(id) != nil || !knownResourceType(resourceType) {
+		return nil, ErrNotFound
+	}
+	options := historyQuery.HistoryOptions()
+
+	// without the history table only the current version is listed
+	versionsTable := search.PostgresHistoryTable(ps.schema)
+	if !ps.dal.enableHistory {
+		versionsTable = "(SELECT " + pq.QuoteLiteral(resourceType) + " AS resource_type, id, version_id, last_updated, false AS deleted, resource FROM " +
+			search.PostgresResourceTable(ps.schema, resourceType) + ") AS current_versions"
+	}
+
+	var exists bool
+	err = ps.querier().QueryRowContext(ps.ctx,
+		"SELECT EXISTS (SELECT 1 FROM "+versionsTable+" WHERE resource_type = $1 AND id = $2)",
+		resourceType, id).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrap(convertPostgresErr(err), "History: query failed")
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	page, total, err := ps.historyVersions(versionsTable, historyQuery, id, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "History")
+	}
+	return historyBundle(baseURL, historyQuery, id, page, total, true), nil
+}
+
+func (ps *postgresSession) HistoryAll(baseURL url.URL, historyQuery search.Query) (bundle *models2.ShallowBundle, err error) {
+	options := historyQuery.HistoryOptions()
+	if historyQuery.Resource != "" && !knownResourceType(historyQuery.Resource) {
+		return nil, ErrNotFound
+	}
+	if !ps.dal.enableHistory {
+		// Without the history table this would need a query across every resource table.
+		// The history routes aren't registered in this case.
+		return nil, ErrNotFound
+	}
+
+	page, total, err := ps.historyVersions(search.PostgresHistoryTable(ps.schema), historyQuery, "", options)
+	if err != nil {
+		return nil, errors.Wrap(err, "HistoryAll")
+	}
+	return historyBundle(baseURL, historyQuery, "", page, total, ps.dal.countTotalResults), nil
+}
+
+// historyVersions loads the page of versions selected by a history query from a table with the
+// columns of the history table, and counts the selected versions. If id isn't empty only the
+// versions of that resource are selected.
+func (ps *postgresSession) historyVersions(versionsTable string, historyQuery search.Query, id string, options *search.QueryOptions) (page []historyVersion, total uint32, err error) {
+	from, to := historyTimeRange(options)
+
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// the versions in the time range
+	var conditions []string
+	if !from.IsZero() {
+		conditions = append(conditions, "last_updated >= "+arg(from))
+	}
+	if !to.IsZero() {
+		conditions = append(conditions, "last_updated < "+arg(to))
+	}
+	if historyQuery.Resource != "" {
+		conditions = append(conditions, "resource_type = "+arg(historyQuery.Resource))
+	}
+	if id != "" {
+		conditions = append(conditions, "id = "+arg(id))
+	}
+	where := "TRUE"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	// a version was current until the next version of the resource was created
+	nextUpdated := "NULL"
+	selected := "TRUE"
+	if options.At != nil {
+		nextUpdated = "lead(last_updated) OVER (PARTITION BY resource_type, id ORDER BY version_id)"
+		selected = "(next_updated IS NULL OR next_updated > " + arg(options.At.RangeLowIncl()) + ")"
+	}
+	versionsSQL := fmt.Sprintf("WITH v AS (SELECT resource_type, id, version_id, last_updated, deleted, resource, %s AS next_updated FROM %s WHERE %s) ",
+		nextUpdated, versionsTable, where)
+
+	err = ps.querier().QueryRowContext(ps.ctx, versionsSQL+"SELECT count(*) FROM v WHERE "+selected, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.Wrap(convertPostgresErr(err), "count query failed")
+	}
+
+	rows, err := ps.querier().QueryContext(ps.ctx,
+		versionsSQL+fmt.Sprintf("SELECT resource_type, id, version_id, last_updated, deleted, resource FROM v WHERE %s ORDER BY last_updated DESC, resource_type, id, version_id DESC LIMIT %d OFFSET %d",
+			selected, options.Count, options.Offset),
+		args...)
+	if err != nil {
+		return nil, 0, errors.Wrap(convertPostgresErr(err), "query failed")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version historyVersion
+		var blob []byte
+		if err = rows.Scan(&version.resourceType, &version.id, &version.versionId, &version.lastUpdated, &version.deleted, &blob); err != nil {
+			return nil, 0, errors.Wrap(err, "rows.Scan failed")
+		}
+		if !version.deleted {
+			version.resource, err = search.DecodePostgresResource(blob)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "DecodePostgresResource failed")
+			}
+		}
+		page = append(page, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "PostgreSQL query for versions failed")
+	}
+
+	return page, total, nil
+}
+
+func (ps *postgresSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+	searcher := search.NewPostgresSearcher(ps.querier(), ps.ctx, ps.schema, ps.dal.countTotalResults, ps.dal.enableCISearches, ps.dal.tokenParametersCaseSensitive)
+
+	resources, included, total, err := searcher.Search(searchQuery)
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	var entryList []models2.ShallowBundleEntryComponent
+	numResults := len(resources)
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	for _, resource := range resources {
+		var entry models2.ShallowBundleEntryComponent
+		entry.Resource = resource
+		entry.FullUrl = baseURLstr + resource.Id()
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
+		entryList = append(entryList, entry)
+	}
+
+	for _, resource := range included {
+		var entry models2.ShallowBundleEntryComponent
+		entry.Resource = resource
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
+		entryList = append(entryList, entry)
+	}
+
+	bundle := models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "searchset",
+		Entry: entryList,
+	}
+
+	// Only include the total if counts are enabled, or if _summary=count was applied.
+	if ps.dal.countTotalResults || searchQuery.Options().Summary == "count" {
+		bundle.Total = &total
+	}
+
+	bundle.Link = generatePagingLinks(baseURL, searchQuery, total, uint32(numResults), ps.dal.countTotalResults)
+
+	return &bundle, nil
+}
+
+func (ps *postgresSession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	searcher := search.NewPostgresSearcher(ps.querier(), ps.ctx, ps.schema, ps.dal.countTotalResults, ps.dal.enableCISearches, ps.dal.tokenParametersCaseSensitive)
+	results, _, _, err := searcher.Search(findIDsQuery(searchQuery))
+	if err != nil {
+		return nil, convertPostgresErr(err)
+	}
+
+	IDs = make([]string, len(results))
+	for i, result := range results {
+		IDs[i] = result.Id()
+	}
+	return IDs, nil
+}
+
+// convertPostgresErr maps PostgreSQL errors onto the errors of the DataAccessSession interface
+func convertPostgresErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return ErrConflict{msg: fmt.Sprintf("duplicate key: %s", pqErr.Message)}
+		case "serialization_failure", "deadlock_detected":
+			// the batch controller retries transactions failing with a WriteConflict
+			return ErrConflict{msg: fmt.Sprintf("PostgreSQL WriteConflict: %s", pqErr.Message)}
+		case "query_canceled":
+			return ErrOpInterrupted
+		}
+	}
+	return errors.Wrap(err, "PostgreSQL operation error")
+}
+
+func (ps *postgresSession) Export(resourceType string, since time.Time, handler func(resource *models2.Resource) error) error {
+	if !knownResourceType(resourceType) {
+		return nil
+	}
+
+	rows, err := ps.querier().QueryContext(ps.ctx,
+		"SELECT resource FROM "+search.PostgresResourceTable(ps.schema, resourceType)+" WHERE last_updated >= $1 ORDER BY id", since)
+	if err != nil {
+		return errors.Wrap(convertPostgresErr(err), "Export: query failed")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blob []byte
+		if err = rows.Scan(&blob); err != nil {
+			return errors.Wrap(err, "Export: rows.Scan failed")
+		}
+		resource, err := search.DecodePostgresResource(blob)
+		if err != nil {
+			return errors.Wrap(err, "Export: DecodePostgresResource failed")
+		}
+		if err = handler(resource); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "Export: PostgreSQL query failed")
+}
+
+// postgresStoredVersion is a version of a resource read from a resource table or the history table
+type postgresStoredVersion struct {
+	id        string
+	versionId int
+	blob      []byte
+}
+
+func (ps *postgresSession) Rekey(resourceType string, batchSize int) (count int, err error) {
+	if !knownResourceType(resourceType) {
+		return 0, nil
+	}
+	// the key ids are inside the BSON blobs so only the rows of encrypted resources are read
+	encrypted := []byte("__gofhirEncryptionKeyId")
+
+	// current versions
+	table := search.PostgresResourceTable(ps.schema, resourceType)
+	last := postgresStoredVersion{}
+	for {
+		batch, err := ps.readVersions(
+			"SELECT id, version_id, resource FROM "+table+" WHERE id > $1 AND position($2::bytea IN resource) > 0 ORDER BY id LIMIT $3",
+			last.id, encrypted, batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		last = batch[len(batch)-1]
+
+		rekeyed, err := ps.rekeyVersions(batch, func(tx *sql.Tx, version postgresStoredVersion, blob []byte) (sql.Result, error) {
+			return tx.ExecContext(ps.ctx, "UPDATE "+table+" SET resource = $3 WHERE id = $1 AND resource = $2",
+				version.id, version.blob, blob)
+		})
+		count += rekeyed
+		if err != nil {
+			return count, err
+		}
+		if len(batch) < batchSize {
+			break
+		}
+	}
+
+	// all versions in the history table
+	history := search.PostgresHistoryTable(ps.schema)
+	last = postgresStoredVersion{}
+	for {
+		batch, err := ps.readVersions(
+			"SELECT id, version_id, resource FROM "+history+" WHERE resource_type = $1 AND (id, version_id) > ($2, $3)"+
+				" AND NOT deleted AND position($4::bytea IN resource) > 0 ORDER BY id, version_id LIMIT $5",
+			resourceType, last.id, last.versionId, encrypted, batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		last = batch[len(batch)-1]
+
+		rekeyed, err := ps.rekeyVersions(batch, func(tx *sql.Tx, version postgresStoredVersion, blob []byte) (sql.Result, error) {
+			return tx.ExecContext(ps.ctx, "UPDATE "+history+" SET resource = $5 WHERE resource_type = $1 AND id = $2 AND version_id = $3 AND resource = $4",
+				resourceType, version.id, version.versionId, version.blob, blob)
+		})
+		count += rekeyed
+		if err != nil {
+			return count, err
+		}
+		if len(batch) < batchSize {
+			break
+		}
+	}
+	return count, nil
+}
+
+// readVersions reads a batch of stored versions
+func (ps *postgresSession) readVersions(query string, args ...interface{}) (versions []postgresStoredVersion, err error) {
+	rows, err := ps.querier().QueryContext(ps.ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(convertPostgresErr(err), "Rekey: query failed")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version postgresStoredVersion
+		if err = rows.Scan(&version.id, &version.versionId, &version.blob); err != nil {
+			return nil, errors.Wrap(err, "Rekey: rows.Scan failed")
+		}
+		versions = append(versions, version)
+	}
+	return versions, errors.Wrap(rows.Err(), "Rekey: PostgreSQL query failed")
+}
+
+// rekeyVersions re-encrypts a batch of stored versions in a short transaction. Versions are only updated
+// if they haven't been changed since they were read, so it's safe to run while the server is in use.
+func (ps *postgresSession) rekeyVersions(versions []postgresStoredVersion, update func(tx *sql.Tx, version postgresStoredVersion, blob []byte) (sql.Result, error)) (count int, err error) {
+	err = ps.withTx(func(tx *sql.Tx) error {
+		count = 0
+		for _, version := range versions {
+			blob, err := rekeyBlob(version.blob)
+			if err != nil {
+				return errors.Wrapf(err, "Rekey: failed to re-encrypt version %d of %s", version.versionId, version.id)
+			}
+			if blob == nil {
+				continue
+			}
+			result, err := update(tx, version, blob)
+			if err != nil {
+				return errors.Wrapf(convertPostgresErr(err), "Rekey: failed to update version %d of %s", version.versionId, version.id)
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return errors.Wrap(err, "Rekey: RowsAffected failed")
+			}
+			count += int(updated)
+		}
+		return nil
+	})
+	return count, err
+}
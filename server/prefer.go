@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// preferences are the values of a request's Prefer headers (https://tools.ietf.org/html/rfc7240)
+// that are used by FHIR (http://hl7.org/fhir/STU3/http.html#2.21.0.5.2)
+type preferences struct {
+	// Return is minimal, representation or OperationOutcome
+	Return string
+	// Handling is strict or lenient
+	Handling string
+	// RespondAsync is set by respond-async, which is required by asynchronous operations like $export
+	RespondAsync bool
+}
+
+func parsePreferHeaders(headers []string) preferences {
+	var prefs preferences
+	for _, header := range headers {
+		for _, preference := range strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ';' }) {
+			nameAndValue := strings.SplitN(preference, "=", 2)
+			name := strings.ToLower(strings.TrimSpace(nameAndValue[0]))
+			if len(nameAndValue) != 2 {
+				if name == "respond-async" {
+					prefs.RespondAsync = true
+				}
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(nameAndValue[1]), `"`)
+			switch name {
+			case "return":
+				prefs.Return = value
+			case "handling":
+				prefs.Handling = value
+			}
+		}
+	}
+	return prefs
+}
+
+func requestPreferences(c *gin.Context) preferences {
+	return parsePreferHeaders(c.Request.Header["Prefer"])
+}
+
+// renderWriteResponse sends the response to a create or update (whose headers have already been set)
+// with the body that the client prefers: the resource, nothing or an OperationOutcome
+func renderWriteResponse(c *gin.Context, httpStatus int, resource *models2.Resource) {
+	switch requestPreferences(c).Return {
+	case "minimal":
+		c.Status(httpStatus)
+	case "OperationOutcome":
+		outcome := writeOutcome(c.Request.Method, httpStatus, resource)
+		c.Render(httpStatus, CustomFhirRenderer{outcome, c})
+	default:
+		c.Render(httpStatus, CustomFhirRenderer{resource, c})
+	}
+}
+
+// applyReturnPreference applies the return preference to an entry of a batch or transaction
+// response for a POST, PUT or PATCH request
+func applyReturnPreference(prefs preferences, method string, entry *models2.ShallowBundleEntryComponent) {
+	if entry.Response == nil || entry.Response.Outcome != nil || entry.Resource == nil {
+		return
+	}
+	switch prefs.Return {
+	case "minimal":
+		entry.Resource = nil
+	case "OperationOutcome":
+		httpStatus, _ := strconv.Atoi(entry.Response.Status)
+		entry.Response.Outcome = writeOutcome(method, httpStatus, entry.Resource)
+		entry.Resource = nil
+	}
+}
+
+func writeOutcome(method string, httpStatus int, resource *models2.Resource) *models.OperationOutcome {
+	reference := resource.ResourceType() + "/" + resource.Id()
+	var message string
+	switch {
+	case httpStatus == http.StatusCreated:
+		message = "Created " + reference
+	case method == "POST":
+		// a conditional create that matched an existing resource
+		message = "Found existing " + reference
+	default:
+		message = "Updated " + reference
+	}
+	return models.NewOperationOutcome("information", "informational", message)
+}
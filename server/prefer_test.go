@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type PreferSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&PreferSuite{})
+
+func (s *PreferSuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(nil)
+}
+
+func (s *PreferSuite) request(method string, path string, body string, prefer string) *httptest.ResponseRecorder {
+	if prefer == "" {
+		return serve(s.server, method, path, body)
+	}
+	return serve(s.server, method, path, body, "Prefer", prefer)
+}
+
+func (s *PreferSuite) TestParsePreferHeaders(c *C) {
+	c.Assert(parsePreferHeaders(nil), Equals, preferences{})
+	c.Assert(parsePreferHeaders([]string{"return=minimal"}), Equals, preferences{Return: "minimal"})
+	c.Assert(parsePreferHeaders([]string{`return="OperationOutcome", handling=lenient`}), Equals, preferences{Return: "OperationOutcome", Handling: "lenient"})
+	c.Assert(parsePreferHeaders([]string{"respond-async", "handling=strict; return=representation"}), Equals, preferences{Return: "representation", Handling: "strict", RespondAsync: true})
+}
+
+func (s *PreferSuite) TestReturnPreference(c *C) {
+	body := `{"resourceType": "Patient", "gender": "male"}`
+
+	w := s.request("POST", "/Patient", body, "return=minimal")
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(w.Body.Len(), Equals, 0)
+	location := w.Header().Get("Location")
+	c.Assert(location, Not(Equals), "")
+	c.Assert(w.Header().Get("ETag"), Equals, `W/"1"`)
+
+	w = s.request("PUT", "/Patient/123", body, "return=OperationOutcome")
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(strings.Contains(w.Body.String(), `"resourceType":"OperationOutcome"`), Equals, true)
+	c.Assert(strings.Contains(w.Body.String(), `"diagnostics":"Created Patient/123"`), Equals, true)
+
+	w = s.request("PUT", "/Patient?gender=male&_id=123", body, "return=OperationOutcome")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"diagnostics":"Updated Patient/123"`), Equals, true)
+
+	w = s.request("PATCH", "/Patient/123", `{"resourceType": "Parameters", "parameter": [{"name": "operation", "part": [
+		{"name": "type", "valueCode": "replace"},
+		{"name": "path", "valueString": "Patient.gender"},
+		{"name": "value", "valueCode": "female"}
+	]}]}`, "return=minimal")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.Len(), Equals, 0)
+
+	for _, prefer := range []string{"", "return=representation"} {
+		w = s.request("PUT", "/Patient/123", body, prefer)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(strings.Contains(w.Body.String(), `"resourceType":"Patient"`), Equals, true)
+	}
+}
+
+func (s *PreferSuite) TestReturnPreferenceInBatches(c *C) {
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [{
+			"resource": {"resourceType": "Patient", "gender": "male"},
+			"request": {"method": "POST", "url": "Patient"}
+		}, {
+			"resource": {"resourceType": "Patient", "id": "123", "gender": "female"},
+			"request": {"method": "PUT", "url": "Patient/123"}
+		}, {
+			"request": {"method": "GET", "url": "Patient/123"}
+		}]
+	}`
+	type responseBundle struct {
+		Entry []struct {
+			Resource *struct {
+				ResourceType string `json:"resourceType"`
+			} `json:"resource"`
+			Response struct {
+				Status   string `json:"status"`
+				Location string `json:"location"`
+				Outcome  *struct {
+					Issue []struct {
+						Diagnostics string `json:"diagnostics"`
+					} `json:"issue"`
+				} `json:"outcome"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+
+	w := s.request("POST", "/", bundle, "return=minimal")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var response responseBundle
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Entry, HasLen, 3)
+	c.Assert(response.Entry[0].Resource, IsNil)
+	c.Assert(response.Entry[0].Response.Status, Equals, "201")
+	c.Assert(response.Entry[0].Response.Location, Not(Equals), "")
+	c.Assert(response.Entry[1].Resource, IsNil)
+	c.Assert(response.Entry[1].Response.Status, Equals, "201")
+	// reads still return resources
+	c.Assert(response.Entry[2].Resource, NotNil)
+
+	w = s.request("POST", "/", bundle, "return=OperationOutcome")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	response = responseBundle{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Entry[0].Resource, IsNil)
+	c.Assert(response.Entry[0].Response.Outcome, NotNil)
+	c.Assert(strings.HasPrefix(response.Entry[0].Response.Outcome.Issue[0].Diagnostics, "Created Patient/"), Equals, true)
+	c.Assert(response.Entry[1].Response.Outcome.Issue[0].Diagnostics, Equals, "Updated Patient/123")
+	c.Assert(response.Entry[2].Resource, NotNil)
+
+	w = s.request("POST", "/", strings.Replace(bundle, `"batch"`, `"transaction"`, 1), "return=minimal")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	response = responseBundle{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Entry[0].Resource, IsNil)
+	c.Assert(response.Entry[1].Resource, IsNil)
+	c.Assert(response.Entry[1].Response.Status, Equals, "200")
+}
+
+func (s *PreferSuite) TestHandlingPreference(c *C) {
+	w := s.request("POST", "/Patient", `{"resourceType": "Patient", "gender": "male"}`, "")
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	for _, prefer := range []string{"", "handling=strict"} {
+		w = s.request("GET", "/Patient?gender=male&foo=bar", "", prefer)
+		c.Assert(w.Code, Equals, http.StatusBadRequest, Commentf(prefer))
+		w = s.request("GET", "/Patient?gender=male&_text=duck", "", prefer)
+		c.Assert(w.Code, Equals, http.StatusNotImplemented, Commentf(prefer))
+	}
+
+	w = s.request("GET", "/Patient?gender=male&foo=bar&_text=duck&_pretty=true", "", "handling=lenient")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"total":1`), Equals, true)
+	// the self link shows the parameters that were used
+	c.Assert(strings.Contains(w.Body.String(), "foo"), Equals, false)
+	c.Assert(strings.Contains(w.Body.String(), "gender=male"), Equals, true)
+
+	// invalid values of known parameters are still errors
+	w = s.request("GET", "/Patient?_count=foo&foo=bar", "", "handling=lenient")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
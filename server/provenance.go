@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrInvalidProvenance indicates that an X-Provenance header couldn't be used
+type ErrInvalidProvenance struct {
+	msg string
+}
+
+func (e ErrInvalidProvenance) Error() string {
+	return e.msg
+}
+
+// provenanceTarget returns a reference to the version of a resource that was written
+func (config *Config) provenanceTarget(resourceType string, id string, versionId string) models.Reference {
+	reference := resourceType + "/" + id
+	if config.EnableHistory && versionId != "" {
+		reference += "/_history/" + versionId
+	}
+	return models.Reference{Reference: reference}
+}
+
+// headerProvenance loads the Provenance of an X-Provenance header, adding the targets of the write
+// (spec: http://www.hl7.org/fhir/provenance.html#header)
+func headerProvenance(header string, targets []models.Reference) (*models2.Resource, error) {
+	headerBytes := []byte(header)
+
+	// check resourceType
+	resourceType, _, _, err := jsonparser.Get(headerBytes, "resourceType")
+	if err != nil {
+		return nil, ErrInvalidProvenance{msg: "error parsing X-Provenance header resourceType: " + err.Error()}
+	}
+	if string(resourceType) != "Provenance" {
+		return nil, ErrInvalidProvenance{msg: "error parsing X-Provenance header: invalid resourceType"}
+	}
+
+	// make sure "target" is not set
+	_, dataType, _, err := jsonparser.Get(headerBytes, "target")
+	if dataType == jsonparser.NotExist {
+	} else if err != nil {
+		return nil, ErrInvalidProvenance{msg: "error parsing X-Provenance header: " + err.Error()}
+	} else {
+		return nil, ErrInvalidProvenance{msg: "error parsing X-Provenance header: target should not be set"}
+	}
+
+	if headerBytes[len(headerBytes)-1] != '}' {
+		return nil, ErrInvalidProvenance{msg: "error parsing X-Provenance header: doesn't end with }"}
+	}
+
+	// generate targets field
+	targetsJSON, err := json.Marshal(targets)
+	if err != nil {
+		return nil, errors.Wrap(err, "headerProvenance: failed to marshal targets")
+	}
+	var sb bytes.Buffer
+	sb.Write(headerBytes[:len(headerBytes)-1]) // remove final '}'
+	sb.WriteString(", \"target\": ")
+	sb.Write(targetsJSON)
+	sb.WriteString(" }")
+
+	if glog.V(8) {
+		glog.V(8).Info("  saving X-Provenance ", sb.String())
+	}
+
+	provenance, err := models2.NewResourceFromJsonBytes(sb.Bytes())
+	if err != nil {
+		return nil, ErrInvalidProvenance{msg: "error loading X-Provenance header: " + err.Error()}
+	}
+	return provenance, nil
+}
+
+// autoProvenance builds the Provenance of a write without an X-Provenance header, attributing it to
+// the principal and client authenticated by the auth middleware, or to the server itself
+func autoProvenance(c *gin.Context, config *Config, action string, targets []models.Reference) (*models2.Resource, error) {
+	provenance := &models.Provenance{
+		Target:   targets,
+		Recorded: &models.FHIRDateTime{Time: time.Now(), Precision: models.Timestamp},
+		Activity: &models.Coding{System: "http://hl7.org/fhir/v3/DataOperation", Code: strings.ToUpper(action)},
+	}
+
+	subject, name := requestPrincipal(c)
+	var user *models.Reference
+	if subject != "" {
+		user = &models.Reference{Identifier: &models.Identifier{Value: subject}, Display: name}
+		provenance.Agent = append(provenance.Agent, models.ProvenanceAgentComponent{
+			Role:         []models.CodeableConcept{participationType("ENT", "data entry person")},
+			WhoReference: user,
+		})
+	}
+	if clientID := c.GetString("clientID"); clientID != "" {
+		provenance.Agent = append(provenance.Agent, models.ProvenanceAgentComponent{
+			Role:                []models.CodeableConcept{participationType("DEV", "device")},
+			WhoReference:        &models.Reference{Identifier: &models.Identifier{Value: clientID}},
+			OnBehalfOfReference: user,
+		})
+	}
+	if len(provenance.Agent) == 0 {
+		// unauthenticated writes
+		provenance.Agent = append(provenance.Agent, models.ProvenanceAgentComponent{
+			Role:         []models.CodeableConcept{participationType("DEV", "device")},
+			WhoReference: &models.Reference{Identifier: &models.Identifier{Value: config.serverIdentifier()}},
+		})
+	}
+
+	json, err := provenance.MarshalJSON()
+	if err != nil {
+		return nil, errors.Wrap(err, "autoProvenance: MarshalJSON failed")
+	}
+	return models2.NewResourceFromJsonBytes(json)
+}
+
+func participationType(code string, display string) models.CodeableConcept {
+	return models.CodeableConcept{
+		Coding: []models.Coding{{System: "http://hl7.org/fhir/v3/ParticipationType", Code: code, Display: display}},
+	}
+}
+
+// storeProvenance saves a Provenance, adding its location to the response's headers
+func storeProvenance(c *gin.Context, session DataAccessSession, provenance *models2.Resource) error {
+	id := bson.NewObjectId().Hex()
+	if err := session.PostWithID(id, provenance); err != nil {
+		return errors.Wrap(err, "failed to create Provenance")
+	}
+	c.Writer.Header().Add("X-GoFHIR-Provenance-Location", "Provenance/"+id)
+	return nil
+}
+
+// startProvenance returns a write's X-Provenance header and whether a Provenance should be recorded for it,
+// starting a transaction so that the Provenance is stored together with the write
+func (rc *ResourceController) startProvenance(c *gin.Context, session DataAccessSession) (header string, record bool) {
+	header = strings.TrimSpace(c.GetHeader("X-Provenance"))
+	if header == "" && !rc.Config.AutoProvenance {
+		return "", false
+	}
+	if err := session.StartTransaction(); err != nil {
+		panic(errors.Wrap(err, "startProvenance: StartTransaction failed"))
+	}
+	return header, true
+}
+
+// recordProvenance stores the Provenance of a write and commits the write's transaction
+func (rc *ResourceController) recordProvenance(c *gin.Context, session DataAccessSession, header string, targets []models.Reference) {
+	var provenance *models2.Resource
+	var err error
+	if header != "" {
+		provenance, err = headerProvenance(header, targets)
+	} else {
+		provenance, err = autoProvenance(c, &rc.Config, c.GetString("Action"), targets)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if err = storeProvenance(c, session, provenance); err != nil {
+		panic(err)
+	}
+	if err = session.CommmitIfTransaction(); err != nil {
+		panic(errors.Wrap(err, "recordProvenance: failed to commit the transaction"))
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+)
+
+type ProvenanceSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&ProvenanceSuite{})
+
+type provenanceJSON struct {
+	Target []struct {
+		Reference string `json:"reference"`
+	} `json:"target"`
+	Activity struct {
+		Code string `json:"code"`
+	} `json:"activity"`
+	Agent []struct {
+		Role []struct {
+			Coding []struct {
+				Code string `json:"code"`
+			} `json:"coding"`
+		} `json:"role"`
+		WhoReference struct {
+			Identifier struct {
+				Value string `json:"value"`
+			} `json:"identifier"`
+		} `json:"whoReference"`
+		OnBehalfOfReference struct {
+			Identifier struct {
+				Value string `json:"value"`
+			} `json:"identifier"`
+		} `json:"onBehalfOfReference"`
+	} `json:"agent"`
+}
+
+func (p provenanceJSON) targets() []string {
+	var targets []string
+	for _, target := range p.Target {
+		targets = append(targets, target.Reference)
+	}
+	return targets
+}
+
+func (s *ProvenanceSuite) setUp(autoProvenance bool) {
+	configure := func(config *Config) {
+		config.AutoProvenance = autoProvenance
+	}
+	// like the auth middleware
+	s.server = newMemoryTestServer(configure, func(c *gin.Context) {
+		if subject := c.GetHeader("X-Subject"); subject != "" {
+			c.Set("subject", subject)
+			c.Set("clientID", "app1")
+		}
+		if patientID := c.GetHeader("X-Patient"); patientID != "" {
+			LimitToPatientCompartment(c, patientID)
+		}
+	})
+}
+
+// provenances returns the Provenances whose locations are in a response's headers
+func (s *ProvenanceSuite) provenances(c *C, w *httptest.ResponseRecorder) []provenanceJSON {
+	var provenances []provenanceJSON
+	for _, location := range w.Header()["X-Gofhir-Provenance-Location"] {
+		r := serve(s.server, "GET", "/"+location, "")
+		c.Assert(r.Code, Equals, http.StatusOK, Commentf("%s", r.Body.String()))
+		var provenance provenanceJSON
+		c.Assert(json.Unmarshal(r.Body.Bytes(), &provenance), IsNil)
+		provenances = append(provenances, provenance)
+	}
+	return provenances
+}
+
+func (s *ProvenanceSuite) TestHeader(c *C) {
+	s.setUp(false)
+	header := `{"resourceType": "Provenance", "recorded": "2019-01-01T00:00:00Z", "agent": [{"whoUri": "http://example.com/device"}]}`
+
+	w := serve(s.server, "POST", "/Patient", `{"resourceType": "Patient"}`, "X-Provenance", header)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	id, _ := parseLocation(w.Header().Get("Location"), "Patient")
+	provenances := s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/" + id + "/_history/1"})
+
+	w = serve(s.server, "PUT", "/Patient/"+id, `{"resourceType": "Patient", "id": "`+id+`", "active": true}`, "X-Provenance", header)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/" + id + "/_history/2"})
+
+	w = serve(s.server, "PATCH", "/Patient/"+id, `[{"op": "replace", "path": "/active", "value": false}]`, "Content-Type", "application/json-patch+json", "X-Provenance", header)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/" + id + "/_history/3"})
+
+	w = serve(s.server, "DELETE", "/Patient/"+id, "", "X-Provenance", header)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/" + id + "/_history/4"})
+
+	// writes are rolled back when the header is invalid
+	w = serve(s.server, "PUT", "/Patient/p2", `{"resourceType": "Patient", "id": "p2"}`, "X-Provenance", `{"resourceType": "Patient"}`)
+	c.Assert(w.Code, Equals, http.StatusBadRequest, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "GET", "/Patient/p2", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// writes without the header don't have a Provenance
+	w = serve(s.server, "PUT", "/Patient/p2", `{"resourceType": "Patient", "id": "p2"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	c.Assert(s.provenances(c, w), HasLen, 0)
+}
+
+func (s *ProvenanceSuite) TestAutoProvenance(c *C) {
+	s.setUp(true)
+
+	w := serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1"}`, "X-Subject", "user1")
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	provenances := s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/p1/_history/1"})
+	c.Assert(provenances[0].Activity.Code, Equals, "CREATE")
+	c.Assert(provenances[0].Agent, HasLen, 2)
+	c.Assert(provenances[0].Agent[0].WhoReference.Identifier.Value, Equals, "user1")
+	c.Assert(provenances[0].Agent[0].Role[0].Coding[0].Code, Equals, "ENT")
+	c.Assert(provenances[0].Agent[1].WhoReference.Identifier.Value, Equals, "app1")
+	c.Assert(provenances[0].Agent[1].OnBehalfOfReference.Identifier.Value, Equals, "user1")
+
+	// unauthenticated writes are attributed to the server
+	w = serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1", "active": true}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].Activity.Code, Equals, "UPDATE")
+	c.Assert(provenances[0].Agent, HasLen, 1)
+	c.Assert(provenances[0].Agent[0].WhoReference.Identifier.Value, Equals, "fhir-server")
+
+	// an X-Provenance header is used instead
+	w = serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1"}`, "X-Provenance", `{"resourceType": "Provenance", "recorded": "2019-01-01T00:00:00Z", "agent": [{"whoUri": "http://example.com/device"}]}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].Activity.Code, Equals, "")
+
+	// conditional deletes target each deleted resource
+	for _, id := range []string{"o1", "o2"} {
+		w = serve(s.server, "PUT", "/Observation/"+id, `{"resourceType": "Observation", "id": "`+id+`", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p1"}}`)
+		c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	}
+	w = serve(s.server, "DELETE", "/Observation?subject=Patient/p1", "")
+	c.Assert(w.Code, Equals, http.StatusNoContent, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].Activity.Code, Equals, "DELETE")
+	c.Assert(provenances[0].targets(), HasLen, 2)
+	for _, target := range provenances[0].targets() {
+		c.Assert(target, Matches, "Observation/o[12]/_history/2")
+	}
+
+	// writes in a patient's compartment
+	w = serve(s.server, "POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p1"}}`, "X-Patient", "p1")
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	c.Assert(s.provenances(c, w), HasLen, 1)
+	w = serve(s.server, "POST", "/Provenance", `{"resourceType": "Provenance", "recorded": "2019-01-01T00:00:00Z", "agent": [{"whoUri": "http://example.com/device"}], "target": [{"reference": "Observation/o3"}]}`, "X-Patient", "p1")
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "PUT", "/Observation/o4", `{"resourceType": "Observation", "id": "o4", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p2"}}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "POST", "/Provenance", `{"resourceType": "Provenance", "recorded": "2019-01-01T00:00:00Z", "agent": [{"whoUri": "http://example.com/device"}], "target": [{"reference": "Observation/o4"}]}`, "X-Patient", "p1")
+	c.Assert(w.Code, Equals, http.StatusForbidden, Commentf("%s", w.Body.String()))
+}
+
+func (s *ProvenanceSuite) TestBundles(c *C) {
+	s.setUp(true)
+
+	w := serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{ "fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a", "resource": { "resourceType": "Patient" }, "request": { "method": "POST", "url": "Patient" } },
+			{ "resource": { "resourceType": "Patient", "id": "p1" }, "request": { "method": "PUT", "url": "Patient/p1" } }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances := s.provenances(c, w)
+	c.Assert(provenances, HasLen, 2)
+	activities := map[string]bool{}
+	for _, provenance := range provenances {
+		c.Assert(provenance.targets(), HasLen, 1)
+		c.Assert(provenance.targets()[0], Matches, "Patient/.+/_history/1")
+		activities[provenance.Activity.Code] = true
+	}
+	c.Assert(activities, DeepEquals, map[string]bool{"CREATE": true})
+
+	// one Provenance from the header for all the writes of a transaction
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{ "resource": { "resourceType": "Patient", "id": "p1", "active": true }, "request": { "method": "PUT", "url": "Patient/p1" } },
+			{ "resource": { "resourceType": "Patient", "id": "p2" }, "request": { "method": "PUT", "url": "Patient/p2" } },
+			{ "request": { "method": "GET", "url": "Patient/p1" } }
+		]
+	}`, "X-Provenance", `{"resourceType": "Provenance", "recorded": "2019-01-01T00:00:00Z", "agent": [{"whoUri": "http://example.com/device"}]}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/p1/_history/2", "Patient/p2/_history/1"})
+
+	// a Provenance for each successful write of a batch
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{ "request": { "method": "DELETE", "url": "Patient/p2" } },
+			{ "resource": { "resourceType": "Patient", "id": "p3" }, "request": { "method": "PUT", "url": "Patient/p3", "ifMatch": "W/\"1\"" } },
+			{ "request": { "method": "GET", "url": "Patient/p1" } }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	provenances = s.provenances(c, w)
+	c.Assert(provenances, HasLen, 1)
+	c.Assert(provenances[0].Activity.Code, Equals, "DELETE")
+	c.Assert(provenances[0].targets(), DeepEquals, []string{"Patient/p2/_history/2"})
+}
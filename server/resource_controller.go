@@ -7,10 +7,14 @@ import (
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/eug48/fhir/utils"
 
+	"github.com/eug48/fhir/auth"
 	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
@@ -20,9 +24,10 @@ import (
 
 // ResourceController provides the necessary CRUD handlers for a given resource.
 type ResourceController struct {
-	Name   string
-	DAL    DataAccessLayer
-	Config Config
+	Name      string
+	DAL       DataAccessLayer
+	Config    Config
+	Validator *ResourceValidator
 }
 
 // NewResourceController creates a new resource controller for the passed in resource name and the passed in
@@ -75,12 +80,28 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 	defer session.Finish()
 
 	searchQuery := search.Query{Resource: rc.Name, Query: rawQuery}
+	if requestPreferences(c).Handling == "lenient" {
+		// unknown parameters are ignored (and left out of the self link) rather than rejected
+		searchQuery = searchQuery.WithoutUnknownParameters()
+	}
 	baseURL := rc.Config.responseURL(c.Request, rc.Name)
 	bundle, err := session.Search(*baseURL, searchQuery)
 	if err != nil {
 		panic(errors.Wrap(err, "Search failed"))
 	}
 
+	// computed before subsetting as _elements may remove the versionIds
+	c.Header("ETag", bundleETag(bundle))
+	if requestNotModified(c) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	err = subsetBundle(bundle, searchQuery.Options())
+	if err != nil {
+		panic(errors.Wrap(err, "subsetBundle failed"))
+	}
+
 	c.Set("bundle", bundle)
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "search")
@@ -121,6 +142,17 @@ func (rc *ResourceController) ShowHandler(c *gin.Context) {
 			err = errors.Wrap(err, "ShowHandler setHeaders failed")
 		}
 	}
+	if err == nil && requestNotModified(c) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if err == nil {
+		readQuery := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
+		resource, err = subsetResource(resource, readQuery.ReadOptions())
+		if err != nil {
+			err = errors.Wrap(err, "ShowHandler subsetResource failed")
+		}
+	}
 
 	switch err {
 	case nil:
@@ -134,6 +166,37 @@ func (rc *ResourceController) ShowHandler(c *gin.Context) {
 	}
 }
 
+// subsetResource applies the _summary and _elements options to a resource.
+func subsetResource(resource *models2.Resource, options *search.QueryOptions) (*models2.Resource, error) {
+	if !options.IsSubsetted() {
+		return resource, nil
+	}
+	return resource.Subset(func(element string) bool {
+		return options.IncludesElement(resource.ResourceType(), element)
+	})
+}
+
+// subsetBundle applies the _summary and _elements options to the matches of a
+// search (but not to included resources) or to every version in a history.
+func subsetBundle(bundle *models2.ShallowBundle, options *search.QueryOptions) error {
+	if !options.IsSubsetted() {
+		return nil
+	}
+	for i := range bundle.Entry {
+		entry := &bundle.Entry[i]
+		// history entries have no search mode
+		if entry.Resource == nil || (entry.Search != nil && entry.Search.Mode != "match") {
+			continue
+		}
+		subset, err := subsetResource(entry.Resource, options)
+		if err != nil {
+			return errors.Wrapf(err, "failed to subset %s/%s", entry.Resource.ResourceType(), entry.Resource.Id())
+		}
+		entry.Resource = subset
+	}
+	return nil
+}
+
 func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 	defer handlePanics(c)
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
@@ -141,9 +204,10 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 
 	c.Set("Action", "history")
 
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
+	historyQuery := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
+	baseURL := rc.Config.responseURL(c.Request)
 	resourceId := c.Param("id")
-	bundle, err := session.History(*baseURL, rc.Name, resourceId)
+	bundle, err := session.History(*baseURL, historyQuery, resourceId)
 	if err != nil && err != ErrNotFound {
 		panic(errors.Wrap(err, "History request failed"))
 	}
@@ -152,30 +216,97 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 		c.Status(http.StatusNotFound)
 		return
 	}
+
+	err = subsetBundle(bundle, historyQuery.HistoryOptions())
+	if err != nil {
+		panic(errors.Wrap(err, "subsetBundle failed"))
+	}
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
-// EverythingHandler handles requests for everything related to a Patient or Encounter resource.
+// everythingPageSize is the page size of the compartment searches that make up $everything
+const everythingPageSize = 100
+
+// EverythingHandler handles requests for everything related to a Patient or Encounter resource:
+// the resource, the resources in its compartment, and the resources that any of these reference.
+// The results aren't paged.
 func (rc *ResourceController) EverythingHandler(c *gin.Context) {
 	defer handlePanics(c)
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
 	defer session.Finish()
 
-	// For now we interpret $everything as the union of _include and _revinclude
-	query := fmt.Sprintf("_id=%s&_include=*&_revinclude=*", c.Param("id"))
+	id := c.Param("id")
+	baseURL := rc.Config.responseURL(c.Request)
+	root := strings.TrimSuffix(baseURL.String(), "/")
+	everything := &models2.ShallowBundle{Type: "searchset"}
+	seen := make(map[string]bool)
+	add := func(bundle *models2.ShallowBundle) (matches int) {
+		for _, entry := range bundle.Entry {
+			if entry.Search != nil && entry.Search.Mode == "match" {
+				matches++
+			}
+			if entry.Resource == nil {
+				continue
+			}
+			key := entry.Resource.ResourceType() + "/" + entry.Resource.Id()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			entry.FullUrl = root + "/" + key
+			everything.Entry = append(everything.Entry, entry)
+		}
+		return
+	}
 
-	searchQuery := search.Query{Resource: rc.Name, Query: query}
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
-	bundle, err := session.Search(*baseURL, searchQuery)
+	query := search.Query{Resource: rc.Name, Query: "_id=" + url.QueryEscape(id) + "&_include=*"}
+	bundle, err := session.Search(*baseURL, query)
 	if err != nil {
 		panic(errors.Wrap(err, "Search (everything) failed"))
 	}
+	if add(bundle) == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
 
-	c.Set("bundle", bundle)
+	var types []string
+	for resourceType := range search.Compartments[rc.Name] {
+		types = append(types, resourceType)
+	}
+	sort.Strings(types)
+	compartment := url.QueryEscape(rc.Name + "/" + id)
+	for _, resourceType := range types {
+		if rc.Config.Auth.Method == auth.AuthTypeSMART {
+			// like CompartmentSearchHandler, only types that the scopes allow reading are searched,
+			// and resources included from other types are left out by the session (see SMARTReadAccessHandler)
+			if allowed, _ := auth.SMARTReadAccess(c, resourceType); !allowed {
+				continue
+			}
+		}
+		for offset := 0; ; offset += everythingPageSize {
+			query := search.Query{
+				Resource: resourceType,
+				Query: fmt.Sprintf("%s=%s&_include=*&_count=%d&_offset=%d",
+					search.CompartmentParam, compartment, everythingPageSize, offset),
+			}
+			bundle, err := session.Search(*baseURL, query)
+			if err != nil {
+				panic(errors.Wrapf(err, "Search (everything) of %s failed", resourceType))
+			}
+			if add(bundle) < everythingPageSize {
+				break
+			}
+		}
+	}
+
+	total := uint32(len(everything.Entry))
+	everything.Total = &total
+
+	c.Set("bundle", everything)
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "search")
 
-	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+	c.Render(http.StatusOK, CustomFhirRenderer{everything, c})
 }
 
 // CreateHandler handles requests to create a new resource instance, assigning it a new ID.
@@ -186,11 +317,13 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
-		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		statusCode, oo := bindFailure(err)
+		c.Render(statusCode, CustomFhirRenderer{oo, c})
 		return
 	}
 
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
+
 	// check for conditional create
 	ifNoneExist := c.GetHeader("If-None-Exist")
 	var httpStatus int
@@ -210,14 +343,21 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "create")
 
-	if resource != nil { // nil when e.g. HTTP status from ConditionalPost 412
-		err = setHeaders(c, rc, true, resource, resourceId)
-		if err != nil {
-			panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
-		}
+	if resource == nil { // nil when e.g. HTTP status from ConditionalPost 412
+		c.Render(httpStatus, CustomFhirRenderer{resource, c})
+		return
 	}
 
-	c.Render(httpStatus, CustomFhirRenderer{resource, c})
+	if recordProvenance && httpStatus == http.StatusCreated {
+		targets := []models.Reference{rc.Config.provenanceTarget(rc.Name, resourceId, resource.VersionId())}
+		rc.recordProvenance(c, session, provenanceHeader, targets)
+	}
+
+	err = setHeaders(c, rc, true, resource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
+	}
+	renderWriteResponse(c, httpStatus, resource)
 }
 
 // UpdateHandler handles requests to update a resource having a given ID.  If the resource with that ID does not
@@ -229,8 +369,8 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
-		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		statusCode, oo := bindFailure(err)
+		c.Render(statusCode, CustomFhirRenderer{oo, c})
 		return
 	}
 
@@ -246,6 +386,8 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 		}
 	}
 
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
+
 	// Perform update
 	resourceId := c.Param("id")
 	createdNew, err := session.Put(resourceId, conditionalVersionId, resource)
@@ -255,17 +397,25 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 
 	c.Set(rc.Name, resource)
 	c.Set("Resource", rc.Name)
+	if createdNew {
+		c.Set("Action", "create")
+	} else {
+		c.Set("Action", "update")
+	}
+
+	if recordProvenance {
+		targets := []models.Reference{rc.Config.provenanceTarget(rc.Name, resourceId, resource.VersionId())}
+		rc.recordProvenance(c, session, provenanceHeader, targets)
+	}
 
 	// spec implies location header only set when createdNew
 	setLocationHeader := createdNew
 	err = setHeaders(c, rc, setLocationHeader, resource, resourceId)
 
 	if createdNew {
-		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		renderWriteResponse(c, http.StatusCreated, resource)
 	} else {
-		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		renderWriteResponse(c, http.StatusOK, resource)
 	}
 }
 
@@ -280,8 +430,8 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
-		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		statusCode, oo := bindFailure(err)
+		c.Render(statusCode, CustomFhirRenderer{oo, c})
 		return
 	}
 
@@ -297,6 +447,8 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 		}
 	}
 
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
+
 	// Perform update
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
 	resourceId, createdNew, err := session.ConditionalPut(query, conditionalVersionId, resource)
@@ -311,16 +463,110 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 	}
 
 	c.Set("Resource", rc.Name)
+	if createdNew {
+		c.Set("Action", "create")
+	} else {
+		c.Set("Action", "update")
+	}
+
+	if recordProvenance {
+		targets := []models.Reference{rc.Config.provenanceTarget(rc.Name, resourceId, resource.VersionId())}
+		rc.recordProvenance(c, session, provenanceHeader, targets)
+	}
 
 	err = setHeaders(c, rc, true, resource, resourceId)
 
 	if createdNew {
-		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		renderWriteResponse(c, http.StatusCreated, resource)
 	} else {
-		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		renderWriteResponse(c, http.StatusOK, resource)
+	}
+}
+
+// PatchHandler handles requests to patch a resource having a given ID with a JSON Patch
+// (application/json-patch+json) or a FHIRPath Patch (a Parameters resource).
+func (rc *ResourceController) PatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	rc.patch(c, session, c.Param("id"))
+}
+
+// ConditionalPatchHandler handles requests to patch the single resource matching search criteria.
+// Criteria resulting in no matches or in more than one match are considered errors.
+func (rc *ResourceController) ConditionalPatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
+	IDs, err := session.FindIDs(query)
+	if err != nil {
+		panic(errors.Wrap(err, "ConditionalPatchHandler FindIDs failed"))
+	}
+	switch len(IDs) {
+	case 0:
+		c.Status(http.StatusNotFound)
+	case 1:
+		rc.patch(c, session, IDs[0])
+	default:
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+	}
+}
+
+func (rc *ResourceController) patch(c *gin.Context, session DataAccessSession, resourceId string) {
+	patch, err := bindPatch(c, rc.Config.ValidatorURL)
+	if err != nil {
+		if _, isInvalidPatch := err.(ErrInvalidPatch); isInvalidPatch {
+			panic(err)
+		}
+		statusCode, oo := bindFailure(err)
+		c.Render(statusCode, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	conditionalVersionId := ""
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" {
+		conditionalVersionId, err = utils.ETagToVersionId(ifMatch)
+		if err != nil {
+			oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+			return
+		}
+	}
+
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
+
+	whatToEncrypt := models2.WhatToEncrypt{PatientDetails: shouldEncryptPatientDetails(c)}
+	resource, err := patchResource(session, rc.Name, resourceId, conditionalVersionId, patch, whatToEncrypt)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "patchResource failed"))
+	}
+
+	c.Set(rc.Name, resource)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "update")
+
+	if recordProvenance {
+		targets := []models.Reference{rc.Config.provenanceTarget(rc.Name, resourceId, resource.VersionId())}
+		rc.recordProvenance(c, session, provenanceHeader, targets)
+	}
+
+	err = setHeaders(c, rc, false, resource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "PatchHandler setHeaders failed"))
 	}
+	renderWriteResponse(c, http.StatusOK, resource)
 }
 
 // DeleteHandler handles requests to delete a resource instance identified by its ID.
@@ -330,6 +576,7 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 	defer session.Finish()
 
 	id := c.Param("id")
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
 
 	newVersionId, err := session.Delete(id, rc.Name)
 	if err != nil && err != ErrNotFound {
@@ -340,6 +587,11 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "delete")
 
+	if recordProvenance && err == nil {
+		targets := []models.Reference{rc.Config.provenanceTarget(rc.Name, id, newVersionId)}
+		rc.recordProvenance(c, session, provenanceHeader, targets)
+	}
+
 	if newVersionId != "" {
 		c.Header("ETag", "W/\""+newVersionId+"\"")
 	}
@@ -354,14 +606,36 @@ func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	defer session.Finish()
 
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
-	_, err := session.ConditionalDelete(query)
-	if err != nil {
-		panic(errors.Wrap(err, "ConditionalDelete failed"))
+	provenanceHeader, recordProvenance := rc.startProvenance(c, session)
+	if !recordProvenance {
+		_, err := session.ConditionalDelete(query)
+		if err != nil {
+			panic(errors.Wrap(err, "ConditionalDelete failed"))
+		}
 	}
 
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "delete")
 
+	if recordProvenance {
+		// delete the matches one by one to find out which versions to target
+		IDs, err := session.FindIDs(query)
+		if err != nil {
+			panic(errors.Wrap(err, "ConditionalDeleteHandler FindIDs failed"))
+		}
+		var targets []models.Reference
+		for _, id := range IDs {
+			newVersionId, err := session.Delete(id, rc.Name)
+			if err != nil {
+				panic(errors.Wrap(err, "Delete failed"))
+			}
+			targets = append(targets, rc.Config.provenanceTarget(rc.Name, id, newVersionId))
+		}
+		if len(targets) > 0 {
+			rc.recordProvenance(c, session, provenanceHeader, targets)
+		}
+	}
+
 	c.Status(http.StatusNoContent)
 }
 
@@ -5,19 +5,28 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/search"
 	"github.com/mitre/heart"
 	"golang.org/x/oauth2"
 )
 
 // RegisterController registers the CRUD routes (and middleware) for a FHIR resource
-func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal DataAccessLayer, config Config) {
+// The export controller is nil if Bulk Data $export is disabled, and the audit logger if AuditEvents are.
+func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal DataAccessLayer, config Config, export *BulkExportController, validator *ResourceValidator, audit *AuditLogger) {
 	rc := NewResourceController(name, dal, config)
+	rc.Validator = validator
 	rcBase := e.Group("/" + name)
 
+	if audit != nil {
+		// first so that requests rejected by the other handlers are audited too
+		// (the authentication middleware runs before it, see AuditLogger.Rejected)
+		rcBase.Use(audit.Handler)
+	}
 	if len(m) > 0 {
 		rcBase.Use(m...)
 	}
@@ -29,31 +38,118 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 		rcBase.Use(auth.HEARTScopesHandler(name))
 	case auth.AuthTypeHEART:
 		rcBase.Use(auth.HEARTScopesHandler(name))
+	case auth.AuthTypeSMART:
+		rcBase.Use(auth.SMARTScopesHandler(name), PatientCompartmentHandler, SMARTReadAccessHandler)
 	}
 
 	rcBase.GET("", rc.IndexHandler)
-	rcBase.POST("/_search", rc.IndexHandler)
 	rcBase.POST("", rc.CreateHandler)
 	rcBase.PUT("", rc.ConditionalUpdateHandler)
+	rcBase.PATCH("", rc.ConditionalPatchHandler)
 	rcBase.DELETE("", rc.ConditionalDeleteHandler)
 
 	rcItem := rcBase.Group("/:id")
-	rcItem.GET("", rc.ShowHandler)
-	if config.EnableHistory {
-		rcItem.GET("/_history/:vid", rc.ShowHandler)
-		rcItem.GET("/_history", rc.HistoryHandler)
+	// gin doesn't allow /_history or /$export routes next to /:id
+	rcItem.GET("", func(c *gin.Context) {
+		switch {
+		case c.Param("id") == "_history" && config.EnableHistory:
+			rc.TypeHistoryHandler(c)
+		case c.Param("id") == "$export" && name == "Patient" && export != nil:
+			export.PatientExportHandler(c)
+		case c.Param("id") == "$expand" && name == "ValueSet":
+			rc.ExpandHandler(c)
+		case c.Param("id") == "$validate-code" && (name == "ValueSet" || name == "CodeSystem"):
+			rc.ValidateCodeHandler(c)
+		case c.Param("id") == "$lookup" && name == "CodeSystem":
+			rc.LookupHandler(c)
+		default:
+			rc.ShowHandler(c)
+		}
+	})
+	if _, hasCompartments := search.Compartments[name]; hasCompartments {
+		// compartment searches (e.g. /Patient/123/Observation) can't be routed next to /_history or /$everything
+		rcItem.GET("/:type", func(c *gin.Context) {
+			switch {
+			case c.Param("type") == "_history" && config.EnableHistory:
+				rc.HistoryHandler(c)
+			case c.Param("type") == "$fhirpath":
+				rc.FHIRPathInstanceHandler(c)
+			case c.Param("type") == "$everything" && (name == "Patient" || name == "Encounter"):
+				rc.EverythingHandler(c)
+			default:
+				rc.CompartmentSearchHandler(c)
+			}
+		})
+		rcItem.GET("/:type/:vid", func(c *gin.Context) {
+			if c.Param("type") == "_history" && config.EnableHistory {
+				rc.ShowHandler(c)
+			} else {
+				c.Status(http.StatusNotFound)
+			}
+		})
+	} else {
+		if config.EnableHistory {
+			rcItem.GET("/_history/:vid", rc.ShowHandler)
+			rcItem.GET("/_history", rc.HistoryHandler)
+		}
+		rcItem.GET("/$fhirpath", rc.FHIRPathInstanceHandler)
 	}
+	// likewise for /_search, /$validate and the terminology operations
+	rcItem.POST("", func(c *gin.Context) {
+		switch {
+		case c.Param("id") == "_search":
+			rc.IndexHandler(c)
+		case c.Param("id") == "$validate":
+			rc.ValidateHandler(c)
+		case c.Param("id") == "$expand" && name == "ValueSet":
+			rc.ExpandHandler(c)
+		case c.Param("id") == "$validate-code" && (name == "ValueSet" || name == "CodeSystem"):
+			rc.ValidateCodeHandler(c)
+		case c.Param("id") == "$lookup" && name == "CodeSystem":
+			rc.LookupHandler(c)
+		default:
+			c.Status(http.StatusNotFound)
+		}
+	})
+	rcItem.POST("/$validate", rc.ValidateInstanceHandler)
 	rcItem.PUT("", rc.UpdateHandler)
+	rcItem.PATCH("", rc.PatchHandler)
 	rcItem.DELETE("", rc.DeleteHandler)
 
-	if name == "Patient" || name == "Encounter" {
-		everythingItem := rcItem.Group("/$everything")
-		everythingItem.GET("", rc.EverythingHandler)
+	if name == "Group" && export != nil {
+		rcItem.GET("/$export", export.GroupExportHandler)
+	}
+	if name == "ValueSet" {
+		rcItem.GET("/$expand", rc.ExpandHandler)
+		rcItem.POST("/$expand", rc.ExpandHandler)
+	}
+	if name == "ValueSet" || name == "CodeSystem" {
+		rcItem.GET("/$validate-code", rc.ValidateCodeHandler)
+		rcItem.POST("/$validate-code", rc.ValidateCodeHandler)
 	}
 }
 
+// systemHandlers returns the handlers configured for a system-level endpoint, after any authorization handlers
+func systemHandlers(config map[string][]gin.HandlerFunc, key string, authorization []gin.HandlerFunc) []gin.HandlerFunc {
+	handlers := make([]gin.HandlerFunc, 0, len(authorization)+len(config[key]))
+	handlers = append(handlers, authorization...)
+	return append(handlers, config[key]...)
+}
+
 // RegisterRoutes registers the routes for each of the FHIR resources
 func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal DataAccessLayer, serverConfig Config) {
+	var systemAuth []gin.HandlerFunc
+
+	// set up below, and used to audit the requests rejected by the authentication middleware
+	var audit *AuditLogger
+	authentication := func(authenticate gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			authenticate(c)
+			if c.IsAborted() && audit != nil {
+				audit.Rejected(c)
+			}
+		}
+	}
 
 	switch serverConfig.Auth.Method {
 	case auth.AuthTypeNone:
@@ -73,13 +169,13 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 		oidcHandler := auth.OIDCAuthenticationHandler(oauthConfig)
 		oauthHandler := auth.OAuthIntrospectionHandler(serverConfig.Auth.ClientID,
 			serverConfig.Auth.ClientSecret, serverConfig.Auth.IntrospectionURL)
-		e.Use(func(c *gin.Context) {
+		e.Use(authentication(func(c *gin.Context) {
 			if c.Request.Header.Get("Authorization") != "" {
 				oauthHandler(c)
 			} else {
 				oidcHandler(c)
 			}
-		})
+		}))
 		// This handler is to take the redirect from the OP when the user logs in. It will
 		// then fetch information about the user by hitting the user info endpoint and put
 		// that in the session. Lastly, this handler is set up to redirect the user back
@@ -92,6 +188,19 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 		heart.SetUpRoutes(serverConfig.Auth.JWKPath, serverConfig.Auth.ClientID, serverConfig.Auth.OPURL,
 			serverConfig.ServerURL, serverConfig.Auth.SessionSecret, e)
 
+	case auth.AuthTypeSMART:
+		smartHandler := auth.SMARTAuthenticationHandler(auth.NewJWKS(serverConfig.Auth.JWKSURL),
+			serverConfig.Auth.Issuer, serverConfig.Auth.Audience)
+		e.Use(authentication(func(c *gin.Context) {
+			// the capability statement and the SMART configuration are public
+			if strings.HasSuffix(c.Request.URL.Path, "/metadata") || c.Request.URL.Path == "/.well-known/smart-configuration" {
+				return
+			}
+			smartHandler(c)
+		}))
+		e.GET("/.well-known/smart-configuration", auth.SMARTConfigurationHandler(serverConfig.Auth))
+		// system-level endpoints need scopes for all resource types
+		systemAuth = []gin.HandlerFunc{auth.SMARTScopesHandler("*"), PatientCompartmentHandler}
 	}
 
 	// Custom MongoDB database support (e.g. http://fhir-server/db/customer123_fhir/Patient?name=alex)
@@ -121,13 +230,67 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 		})
 	}
 
+	// Validation
+	validator := NewResourceValidator(serverConfig)
+	if serverConfig.ValidateWrites {
+		dal = newValidatingDataAccessLayer(dal, validator)
+	}
+
+	// Subscriptions
+	if serverConfig.EnableSubscriptions {
+		subscriptions := NewSubscriptionEngine(dal, serverConfig)
+		dal = newSubscriptionDataAccessLayer(dal, subscriptions)
+		websocketHandlers := systemHandlers(config, "Websocket", systemAuth)
+		e.GET("/websocket", append(websocketHandlers, subscriptions.WebsocketHandler)...)
+	}
+
+	// Audit trail
+	if serverConfig.EnableAuditEvents {
+		audit = NewAuditLogger(dal, serverConfig)
+	}
+
+	// Sessions limited to a patient's compartment (see LimitToPatientCompartment)
+	dal = newCompartmentDataAccessLayer(dal)
+
 	// Batch Support
 	batch := NewBatchController(dal, serverConfig)
-	batchHandlers := make([]gin.HandlerFunc, len(config["Batch"]))
-	copy(batchHandlers, config["Batch"])
+	batch.Audit = audit
+	batchHandlers := systemHandlers(config, "Batch", systemAuth)
 	batchHandlers = append(batchHandlers, batch.Post)
 	e.POST("/", batchHandlers...)
 
+	// System-level history
+	if serverConfig.EnableHistory {
+		historyHandlers := systemHandlers(config, "History", systemAuth)
+		historyHandlers = append(historyHandlers, SystemHistoryHandler(dal, serverConfig))
+		e.GET("/_history", historyHandlers...)
+	}
+
+	// Bulk Data $export
+	var export *BulkExportController
+	if serverConfig.BulkExportDirectory != "" {
+		export = NewBulkExportController(dal, serverConfig)
+		exportHandlers := systemHandlers(config, "Export", systemAuth)
+		e.GET("/$export", append(exportHandlers, export.SystemExportHandler)...)
+		e.GET("/_export/:job", append(exportHandlers, export.StatusHandler)...)
+		e.DELETE("/_export/:job", append(exportHandlers, export.DeleteHandler)...)
+		e.GET("/_export/:job/:file", append(exportHandlers, export.FileHandler)...)
+	}
+
+	// Bulk Data $import
+	if serverConfig.BulkImportDirectory != "" {
+		importer := NewBulkImportController(dal, serverConfig)
+		importHandlers := systemHandlers(config, "Import", systemAuth)
+		e.POST("/$import", append(importHandlers, importer.ImportHandler)...)
+		e.GET("/_import/:job", append(importHandlers, importer.StatusHandler)...)
+		e.DELETE("/_import/:job", append(importHandlers, importer.DeleteHandler)...)
+		e.GET("/_import/:job/:file", append(importHandlers, importer.ErrorsHandler)...)
+	}
+
+	// FHIRPath evaluation for debugging expressions
+	fhirpathHandlers := systemHandlers(config, "FHIRPath", systemAuth)
+	e.POST("/$fhirpath", append(fhirpathHandlers, FHIRPathHandler(dal))...)
+
 	// Conformance Statement
 	e.StaticFile("metadata", "conformance/capability_statement.json")
 
@@ -137,120 +300,120 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	})
 
 	// Resources
-	RegisterController("Account", e, config["Account"], dal, serverConfig)
-	RegisterController("ActivityDefinition", e, config["ActivityDefinition"], dal, serverConfig)
-	RegisterController("AdverseEvent", e, config["AdverseEvent"], dal, serverConfig)
-	RegisterController("AllergyIntolerance", e, config["AllergyIntolerance"], dal, serverConfig)
-	RegisterController("Appointment", e, config["Appointment"], dal, serverConfig)
-	RegisterController("AppointmentResponse", e, config["AppointmentResponse"], dal, serverConfig)
-	RegisterController("AuditEvent", e, config["AuditEvent"], dal, serverConfig)
-	RegisterController("Basic", e, config["Basic"], dal, serverConfig)
-	RegisterController("Binary", e, config["Binary"], dal, serverConfig)
-	RegisterController("BodySite", e, config["BodySite"], dal, serverConfig)
-	RegisterController("Bundle", e, config["Bundle"], dal, serverConfig)
-	RegisterController("CapabilityStatement", e, config["CapabilityStatement"], dal, serverConfig)
-	RegisterController("CarePlan", e, config["CarePlan"], dal, serverConfig)
-	RegisterController("CareTeam", e, config["CareTeam"], dal, serverConfig)
-	RegisterController("ChargeItem", e, config["ChargeItem"], dal, serverConfig)
-	RegisterController("Claim", e, config["Claim"], dal, serverConfig)
-	RegisterController("ClaimResponse", e, config["ClaimResponse"], dal, serverConfig)
-	RegisterController("ClinicalImpression", e, config["ClinicalImpression"], dal, serverConfig)
-	RegisterController("CodeSystem", e, config["CodeSystem"], dal, serverConfig)
-	RegisterController("Communication", e, config["Communication"], dal, serverConfig)
-	RegisterController("CommunicationRequest", e, config["CommunicationRequest"], dal, serverConfig)
-	RegisterController("CompartmentDefinition", e, config["CompartmentDefinition"], dal, serverConfig)
-	RegisterController("Composition", e, config["Composition"], dal, serverConfig)
-	RegisterController("ConceptMap", e, config["ConceptMap"], dal, serverConfig)
-	RegisterController("Condition", e, config["Condition"], dal, serverConfig)
-	RegisterController("Consent", e, config["Consent"], dal, serverConfig)
-	RegisterController("Contract", e, config["Contract"], dal, serverConfig)
-	RegisterController("Coverage", e, config["Coverage"], dal, serverConfig)
-	RegisterController("DataElement", e, config["DataElement"], dal, serverConfig)
-	RegisterController("DetectedIssue", e, config["DetectedIssue"], dal, serverConfig)
-	RegisterController("Device", e, config["Device"], dal, serverConfig)
-	RegisterController("DeviceComponent", e, config["DeviceComponent"], dal, serverConfig)
-	RegisterController("DeviceMetric", e, config["DeviceMetric"], dal, serverConfig)
-	RegisterController("DeviceRequest", e, config["DeviceRequest"], dal, serverConfig)
-	RegisterController("DeviceUseStatement", e, config["DeviceUseStatement"], dal, serverConfig)
-	RegisterController("DiagnosticReport", e, config["DiagnosticReport"], dal, serverConfig)
-	RegisterController("DocumentManifest", e, config["DocumentManifest"], dal, serverConfig)
-	RegisterController("DocumentReference", e, config["DocumentReference"], dal, serverConfig)
-	RegisterController("EligibilityRequest", e, config["EligibilityRequest"], dal, serverConfig)
-	RegisterController("EligibilityResponse", e, config["EligibilityResponse"], dal, serverConfig)
-	RegisterController("Encounter", e, config["Encounter"], dal, serverConfig)
-	RegisterController("Endpoint", e, config["Endpoint"], dal, serverConfig)
-	RegisterController("EnrollmentRequest", e, config["EnrollmentRequest"], dal, serverConfig)
-	RegisterController("EnrollmentResponse", e, config["EnrollmentResponse"], dal, serverConfig)
-	RegisterController("EpisodeOfCare", e, config["EpisodeOfCare"], dal, serverConfig)
-	RegisterController("ExpansionProfile", e, config["ExpansionProfile"], dal, serverConfig)
-	RegisterController("ExplanationOfBenefit", e, config["ExplanationOfBenefit"], dal, serverConfig)
-	RegisterController("FamilyMemberHistory", e, config["FamilyMemberHistory"], dal, serverConfig)
-	RegisterController("Flag", e, config["Flag"], dal, serverConfig)
-	RegisterController("Goal", e, config["Goal"], dal, serverConfig)
-	RegisterController("GraphDefinition", e, config["GraphDefinition"], dal, serverConfig)
-	RegisterController("Group", e, config["Group"], dal, serverConfig)
-	RegisterController("GuidanceResponse", e, config["GuidanceResponse"], dal, serverConfig)
-	RegisterController("HealthcareService", e, config["HealthcareService"], dal, serverConfig)
-	RegisterController("ImagingManifest", e, config["ImagingManifest"], dal, serverConfig)
-	RegisterController("ImagingStudy", e, config["ImagingStudy"], dal, serverConfig)
-	RegisterController("Immunization", e, config["Immunization"], dal, serverConfig)
-	RegisterController("ImmunizationRecommendation", e, config["ImmunizationRecommendation"], dal, serverConfig)
-	RegisterController("ImplementationGuide", e, config["ImplementationGuide"], dal, serverConfig)
-	RegisterController("Library", e, config["Library"], dal, serverConfig)
-	RegisterController("Linkage", e, config["Linkage"], dal, serverConfig)
-	RegisterController("List", e, config["List"], dal, serverConfig)
-	RegisterController("Location", e, config["Location"], dal, serverConfig)
-	RegisterController("Measure", e, config["Measure"], dal, serverConfig)
-	RegisterController("MeasureReport", e, config["MeasureReport"], dal, serverConfig)
-	RegisterController("Media", e, config["Media"], dal, serverConfig)
-	RegisterController("Medication", e, config["Medication"], dal, serverConfig)
-	RegisterController("MedicationAdministration", e, config["MedicationAdministration"], dal, serverConfig)
-	RegisterController("MedicationDispense", e, config["MedicationDispense"], dal, serverConfig)
-	RegisterController("MedicationRequest", e, config["MedicationRequest"], dal, serverConfig)
-	RegisterController("MedicationStatement", e, config["MedicationStatement"], dal, serverConfig)
-	RegisterController("MessageDefinition", e, config["MessageDefinition"], dal, serverConfig)
-	RegisterController("MessageHeader", e, config["MessageHeader"], dal, serverConfig)
-	RegisterController("NamingSystem", e, config["NamingSystem"], dal, serverConfig)
-	RegisterController("NutritionOrder", e, config["NutritionOrder"], dal, serverConfig)
-	RegisterController("Observation", e, config["Observation"], dal, serverConfig)
-	RegisterController("OperationDefinition", e, config["OperationDefinition"], dal, serverConfig)
-	RegisterController("OperationOutcome", e, config["OperationOutcome"], dal, serverConfig)
-	RegisterController("Organization", e, config["Organization"], dal, serverConfig)
-	RegisterController("Patient", e, config["Patient"], dal, serverConfig)
-	RegisterController("PaymentNotice", e, config["PaymentNotice"], dal, serverConfig)
-	RegisterController("PaymentReconciliation", e, config["PaymentReconciliation"], dal, serverConfig)
-	RegisterController("Person", e, config["Person"], dal, serverConfig)
-	RegisterController("PlanDefinition", e, config["PlanDefinition"], dal, serverConfig)
-	RegisterController("Practitioner", e, config["Practitioner"], dal, serverConfig)
-	RegisterController("PractitionerRole", e, config["PractitionerRole"], dal, serverConfig)
-	RegisterController("Procedure", e, config["Procedure"], dal, serverConfig)
-	RegisterController("ProcedureRequest", e, config["ProcedureRequest"], dal, serverConfig)
-	RegisterController("ProcessRequest", e, config["ProcessRequest"], dal, serverConfig)
-	RegisterController("ProcessResponse", e, config["ProcessResponse"], dal, serverConfig)
-	RegisterController("Provenance", e, config["Provenance"], dal, serverConfig)
-	RegisterController("Questionnaire", e, config["Questionnaire"], dal, serverConfig)
-	RegisterController("QuestionnaireResponse", e, config["QuestionnaireResponse"], dal, serverConfig)
-	RegisterController("ReferralRequest", e, config["ReferralRequest"], dal, serverConfig)
-	RegisterController("RelatedPerson", e, config["RelatedPerson"], dal, serverConfig)
-	RegisterController("RequestGroup", e, config["RequestGroup"], dal, serverConfig)
-	RegisterController("ResearchStudy", e, config["ResearchStudy"], dal, serverConfig)
-	RegisterController("ResearchSubject", e, config["ResearchSubject"], dal, serverConfig)
-	RegisterController("RiskAssessment", e, config["RiskAssessment"], dal, serverConfig)
-	RegisterController("Schedule", e, config["Schedule"], dal, serverConfig)
-	RegisterController("SearchParameter", e, config["SearchParameter"], dal, serverConfig)
-	RegisterController("Sequence", e, config["Sequence"], dal, serverConfig)
-	RegisterController("ServiceDefinition", e, config["ServiceDefinition"], dal, serverConfig)
-	RegisterController("Slot", e, config["Slot"], dal, serverConfig)
-	RegisterController("Specimen", e, config["Specimen"], dal, serverConfig)
-	RegisterController("StructureDefinition", e, config["StructureDefinition"], dal, serverConfig)
-	RegisterController("StructureMap", e, config["StructureMap"], dal, serverConfig)
-	RegisterController("Subscription", e, config["Subscription"], dal, serverConfig)
-	RegisterController("Substance", e, config["Substance"], dal, serverConfig)
-	RegisterController("SupplyDelivery", e, config["SupplyDelivery"], dal, serverConfig)
-	RegisterController("SupplyRequest", e, config["SupplyRequest"], dal, serverConfig)
-	RegisterController("Task", e, config["Task"], dal, serverConfig)
-	RegisterController("TestReport", e, config["TestReport"], dal, serverConfig)
-	RegisterController("TestScript", e, config["TestScript"], dal, serverConfig)
-	RegisterController("ValueSet", e, config["ValueSet"], dal, serverConfig)
-	RegisterController("VisionPrescription", e, config["VisionPrescription"], dal, serverConfig)
+	RegisterController("Account", e, config["Account"], dal, serverConfig, export, validator, audit)
+	RegisterController("ActivityDefinition", e, config["ActivityDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("AdverseEvent", e, config["AdverseEvent"], dal, serverConfig, export, validator, audit)
+	RegisterController("AllergyIntolerance", e, config["AllergyIntolerance"], dal, serverConfig, export, validator, audit)
+	RegisterController("Appointment", e, config["Appointment"], dal, serverConfig, export, validator, audit)
+	RegisterController("AppointmentResponse", e, config["AppointmentResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("AuditEvent", e, config["AuditEvent"], dal, serverConfig, export, validator, audit)
+	RegisterController("Basic", e, config["Basic"], dal, serverConfig, export, validator, audit)
+	RegisterController("Binary", e, config["Binary"], dal, serverConfig, export, validator, audit)
+	RegisterController("BodySite", e, config["BodySite"], dal, serverConfig, export, validator, audit)
+	RegisterController("Bundle", e, config["Bundle"], dal, serverConfig, export, validator, audit)
+	RegisterController("CapabilityStatement", e, config["CapabilityStatement"], dal, serverConfig, export, validator, audit)
+	RegisterController("CarePlan", e, config["CarePlan"], dal, serverConfig, export, validator, audit)
+	RegisterController("CareTeam", e, config["CareTeam"], dal, serverConfig, export, validator, audit)
+	RegisterController("ChargeItem", e, config["ChargeItem"], dal, serverConfig, export, validator, audit)
+	RegisterController("Claim", e, config["Claim"], dal, serverConfig, export, validator, audit)
+	RegisterController("ClaimResponse", e, config["ClaimResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("ClinicalImpression", e, config["ClinicalImpression"], dal, serverConfig, export, validator, audit)
+	RegisterController("CodeSystem", e, config["CodeSystem"], dal, serverConfig, export, validator, audit)
+	RegisterController("Communication", e, config["Communication"], dal, serverConfig, export, validator, audit)
+	RegisterController("CommunicationRequest", e, config["CommunicationRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("CompartmentDefinition", e, config["CompartmentDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("Composition", e, config["Composition"], dal, serverConfig, export, validator, audit)
+	RegisterController("ConceptMap", e, config["ConceptMap"], dal, serverConfig, export, validator, audit)
+	RegisterController("Condition", e, config["Condition"], dal, serverConfig, export, validator, audit)
+	RegisterController("Consent", e, config["Consent"], dal, serverConfig, export, validator, audit)
+	RegisterController("Contract", e, config["Contract"], dal, serverConfig, export, validator, audit)
+	RegisterController("Coverage", e, config["Coverage"], dal, serverConfig, export, validator, audit)
+	RegisterController("DataElement", e, config["DataElement"], dal, serverConfig, export, validator, audit)
+	RegisterController("DetectedIssue", e, config["DetectedIssue"], dal, serverConfig, export, validator, audit)
+	RegisterController("Device", e, config["Device"], dal, serverConfig, export, validator, audit)
+	RegisterController("DeviceComponent", e, config["DeviceComponent"], dal, serverConfig, export, validator, audit)
+	RegisterController("DeviceMetric", e, config["DeviceMetric"], dal, serverConfig, export, validator, audit)
+	RegisterController("DeviceRequest", e, config["DeviceRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("DeviceUseStatement", e, config["DeviceUseStatement"], dal, serverConfig, export, validator, audit)
+	RegisterController("DiagnosticReport", e, config["DiagnosticReport"], dal, serverConfig, export, validator, audit)
+	RegisterController("DocumentManifest", e, config["DocumentManifest"], dal, serverConfig, export, validator, audit)
+	RegisterController("DocumentReference", e, config["DocumentReference"], dal, serverConfig, export, validator, audit)
+	RegisterController("EligibilityRequest", e, config["EligibilityRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("EligibilityResponse", e, config["EligibilityResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("Encounter", e, config["Encounter"], dal, serverConfig, export, validator, audit)
+	RegisterController("Endpoint", e, config["Endpoint"], dal, serverConfig, export, validator, audit)
+	RegisterController("EnrollmentRequest", e, config["EnrollmentRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("EnrollmentResponse", e, config["EnrollmentResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("EpisodeOfCare", e, config["EpisodeOfCare"], dal, serverConfig, export, validator, audit)
+	RegisterController("ExpansionProfile", e, config["ExpansionProfile"], dal, serverConfig, export, validator, audit)
+	RegisterController("ExplanationOfBenefit", e, config["ExplanationOfBenefit"], dal, serverConfig, export, validator, audit)
+	RegisterController("FamilyMemberHistory", e, config["FamilyMemberHistory"], dal, serverConfig, export, validator, audit)
+	RegisterController("Flag", e, config["Flag"], dal, serverConfig, export, validator, audit)
+	RegisterController("Goal", e, config["Goal"], dal, serverConfig, export, validator, audit)
+	RegisterController("GraphDefinition", e, config["GraphDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("Group", e, config["Group"], dal, serverConfig, export, validator, audit)
+	RegisterController("GuidanceResponse", e, config["GuidanceResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("HealthcareService", e, config["HealthcareService"], dal, serverConfig, export, validator, audit)
+	RegisterController("ImagingManifest", e, config["ImagingManifest"], dal, serverConfig, export, validator, audit)
+	RegisterController("ImagingStudy", e, config["ImagingStudy"], dal, serverConfig, export, validator, audit)
+	RegisterController("Immunization", e, config["Immunization"], dal, serverConfig, export, validator, audit)
+	RegisterController("ImmunizationRecommendation", e, config["ImmunizationRecommendation"], dal, serverConfig, export, validator, audit)
+	RegisterController("ImplementationGuide", e, config["ImplementationGuide"], dal, serverConfig, export, validator, audit)
+	RegisterController("Library", e, config["Library"], dal, serverConfig, export, validator, audit)
+	RegisterController("Linkage", e, config["Linkage"], dal, serverConfig, export, validator, audit)
+	RegisterController("List", e, config["List"], dal, serverConfig, export, validator, audit)
+	RegisterController("Location", e, config["Location"], dal, serverConfig, export, validator, audit)
+	RegisterController("Measure", e, config["Measure"], dal, serverConfig, export, validator, audit)
+	RegisterController("MeasureReport", e, config["MeasureReport"], dal, serverConfig, export, validator, audit)
+	RegisterController("Media", e, config["Media"], dal, serverConfig, export, validator, audit)
+	RegisterController("Medication", e, config["Medication"], dal, serverConfig, export, validator, audit)
+	RegisterController("MedicationAdministration", e, config["MedicationAdministration"], dal, serverConfig, export, validator, audit)
+	RegisterController("MedicationDispense", e, config["MedicationDispense"], dal, serverConfig, export, validator, audit)
+	RegisterController("MedicationRequest", e, config["MedicationRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("MedicationStatement", e, config["MedicationStatement"], dal, serverConfig, export, validator, audit)
+	RegisterController("MessageDefinition", e, config["MessageDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("MessageHeader", e, config["MessageHeader"], dal, serverConfig, export, validator, audit)
+	RegisterController("NamingSystem", e, config["NamingSystem"], dal, serverConfig, export, validator, audit)
+	RegisterController("NutritionOrder", e, config["NutritionOrder"], dal, serverConfig, export, validator, audit)
+	RegisterController("Observation", e, config["Observation"], dal, serverConfig, export, validator, audit)
+	RegisterController("OperationDefinition", e, config["OperationDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("OperationOutcome", e, config["OperationOutcome"], dal, serverConfig, export, validator, audit)
+	RegisterController("Organization", e, config["Organization"], dal, serverConfig, export, validator, audit)
+	RegisterController("Patient", e, config["Patient"], dal, serverConfig, export, validator, audit)
+	RegisterController("PaymentNotice", e, config["PaymentNotice"], dal, serverConfig, export, validator, audit)
+	RegisterController("PaymentReconciliation", e, config["PaymentReconciliation"], dal, serverConfig, export, validator, audit)
+	RegisterController("Person", e, config["Person"], dal, serverConfig, export, validator, audit)
+	RegisterController("PlanDefinition", e, config["PlanDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("Practitioner", e, config["Practitioner"], dal, serverConfig, export, validator, audit)
+	RegisterController("PractitionerRole", e, config["PractitionerRole"], dal, serverConfig, export, validator, audit)
+	RegisterController("Procedure", e, config["Procedure"], dal, serverConfig, export, validator, audit)
+	RegisterController("ProcedureRequest", e, config["ProcedureRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("ProcessRequest", e, config["ProcessRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("ProcessResponse", e, config["ProcessResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("Provenance", e, config["Provenance"], dal, serverConfig, export, validator, audit)
+	RegisterController("Questionnaire", e, config["Questionnaire"], dal, serverConfig, export, validator, audit)
+	RegisterController("QuestionnaireResponse", e, config["QuestionnaireResponse"], dal, serverConfig, export, validator, audit)
+	RegisterController("ReferralRequest", e, config["ReferralRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("RelatedPerson", e, config["RelatedPerson"], dal, serverConfig, export, validator, audit)
+	RegisterController("RequestGroup", e, config["RequestGroup"], dal, serverConfig, export, validator, audit)
+	RegisterController("ResearchStudy", e, config["ResearchStudy"], dal, serverConfig, export, validator, audit)
+	RegisterController("ResearchSubject", e, config["ResearchSubject"], dal, serverConfig, export, validator, audit)
+	RegisterController("RiskAssessment", e, config["RiskAssessment"], dal, serverConfig, export, validator, audit)
+	RegisterController("Schedule", e, config["Schedule"], dal, serverConfig, export, validator, audit)
+	RegisterController("SearchParameter", e, config["SearchParameter"], dal, serverConfig, export, validator, audit)
+	RegisterController("Sequence", e, config["Sequence"], dal, serverConfig, export, validator, audit)
+	RegisterController("ServiceDefinition", e, config["ServiceDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("Slot", e, config["Slot"], dal, serverConfig, export, validator, audit)
+	RegisterController("Specimen", e, config["Specimen"], dal, serverConfig, export, validator, audit)
+	RegisterController("StructureDefinition", e, config["StructureDefinition"], dal, serverConfig, export, validator, audit)
+	RegisterController("StructureMap", e, config["StructureMap"], dal, serverConfig, export, validator, audit)
+	RegisterController("Subscription", e, config["Subscription"], dal, serverConfig, export, validator, audit)
+	RegisterController("Substance", e, config["Substance"], dal, serverConfig, export, validator, audit)
+	RegisterController("SupplyDelivery", e, config["SupplyDelivery"], dal, serverConfig, export, validator, audit)
+	RegisterController("SupplyRequest", e, config["SupplyRequest"], dal, serverConfig, export, validator, audit)
+	RegisterController("Task", e, config["Task"], dal, serverConfig, export, validator, audit)
+	RegisterController("TestReport", e, config["TestReport"], dal, serverConfig, export, validator, audit)
+	RegisterController("TestScript", e, config["TestScript"], dal, serverConfig, export, validator, audit)
+	RegisterController("ValueSet", e, config["ValueSet"], dal, serverConfig, export, validator, audit)
+	RegisterController("VisionPrescription", e, config["VisionPrescription"], dal, serverConfig, export, validator, audit)
 }
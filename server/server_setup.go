@@ -2,12 +2,16 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
 	"github.com/gin-gonic/gin"
 	cors "github.com/itsjamie/gin-cors"
 	"github.com/pkg/errors"
@@ -65,9 +69,9 @@ func NewServer(config Config) *FHIRServer {
 
 	server.Engine.Use(cors.Middleware(cors.Config{
 		Origins:         "*",
-		Methods:         "GET, PUT, POST, DELETE",
-		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
-		ExposedHeaders:  "Location, ETag, Last-Modified",
+		Methods:         "GET, PUT, PATCH, POST, DELETE",
+		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist, Prefer, If-None-Match, If-Modified-Since",
+		ExposedHeaders:  "Location, ETag, Last-Modified, Content-Location, X-Progress",
 		MaxAge:          86400 * time.Second, // Preflight expires after 1 day
 		Credentials:     true,
 		ValidateHeaders: false,
@@ -84,10 +88,76 @@ func NewServer(config Config) *FHIRServer {
 		server.Engine.Use(ReadOnlyMiddleware)
 	}
 
+	// token searches with the terminology modifiers cache the codes of ValueSets and CodeSystems
+	for _, op := range []string{"Create", "Update", "Delete"} {
+		server.AddInterceptor(op, "ValueSet", expansionCacheInvalidator{})
+		server.AddInterceptor(op, "CodeSystem", expansionCacheInvalidator{})
+	}
+
 	return server
 }
 
+func (f *FHIRServer) initDAL() DataAccessLayer {
+	var dal DataAccessLayer
+	switch f.Config.DatabaseBackend {
+	case DatabaseBackendPostgreSQL:
+		dal = f.initPostgreSQL()
+	case DatabaseBackendMemory:
+		dal = NewMemoryDataAccessLayer(f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
+	default:
+		dal = f.initMongoDB()
+	}
+
+	if f.Config.EncryptionKeyfile != "" {
+		keyring, err := models2.LoadKeyring(f.Config.EncryptionKeyfile)
+		if err != nil {
+			panic(err)
+		}
+		models2.SetKeyring(keyring)
+	}
+	if f.Config.EncryptionPolicyFile != "" {
+		policies, err := loadEncryptionPolicies(f.Config.EncryptionPolicyFile)
+		if err != nil {
+			panic(err)
+		}
+		dal = newEncryptingDataAccessLayer(dal, policies, f.Config)
+	}
+	return dal
+}
+
 func (f *FHIRServer) InitEngine() {
+	dal := f.initDAL()
+
+	// Register all API routes
+	RegisterRoutes(f.Engine, f.MiddlewareConfig, dal, f.Config)
+
+	for _, ar := range f.AfterRoutes {
+		ar(f.Engine)
+	}
+
+	if f.Config.ReadOnly {
+		log.Println("Server: Running in read-only mode")
+	}
+}
+
+func (f *FHIRServer) initPostgreSQL() DataAccessLayer {
+	db, err := sql.Open("postgres", f.Config.DatabaseURI)
+	if err != nil {
+		panic(errors.Wrap(err, "connecting to PostgreSQL"))
+	}
+	if err = db.Ping(); err != nil {
+		panic(errors.Wrap(err, "connecting to PostgreSQL"))
+	}
+	log.Printf("PostgreSQL: Connected (default schema %s)\n", f.Config.DefaultDatabaseName)
+
+	if err = CreatePostgresSchema(context.Background(), db, f.Config.DefaultDatabaseName); err != nil {
+		panic(errors.Wrap(err, "creating PostgreSQL tables"))
+	}
+
+	return NewPostgresDataAccessLayer(db, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
+}
+
+func (f *FHIRServer) initMongoDB() DataAccessLayer {
 	var err error
 
 	// TODO: Register OpenCensus metrics
@@ -143,13 +213,6 @@ func (f *FHIRServer) InitEngine() {
 	// TODO: disabled as requires high-grade permissions. Remove completely?
 	// go killLongRunningOps(ticker, client.ConnectionString(), "admin", f.Config)
 
-	// Register all API routes
-	RegisterRoutes(f.Engine, f.MiddlewareConfig, NewMongoDataAccessLayer(client, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config), f.Config)
-
-	for _, ar := range f.AfterRoutes {
-		ar(f.Engine)
-	}
-
 	// If not in -readonly mode, clear the count cache
 	if !f.Config.ReadOnly {
 		dbNames, err := client.ListDatabaseNames(context.TODO(), bson.D{})
@@ -170,9 +233,9 @@ func (f *FHIRServer) InitEngine() {
 				}
 			}
 		}
-	} else {
-		log.Println("Server: Running in read-only mode")
 	}
+
+	return NewMongoDataAccessLayer(client, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config)
 }
 
 func (f *FHIRServer) Run(port int, localhostOnly bool) {
@@ -186,6 +249,22 @@ func (f *FHIRServer) Run(port int, localhostOnly bool) {
 }
 
 func (f *FHIRServer) InitDB(databaseName string) {
+	if f.Config.DatabaseBackend == DatabaseBackendMemory {
+		// nothing to initialise
+		return
+	}
+	if f.Config.DatabaseBackend == DatabaseBackendPostgreSQL {
+		db, err := sql.Open("postgres", f.Config.DatabaseURI)
+		if err != nil {
+			panic(errors.Wrap(err, "connecting to PostgreSQL"))
+		}
+		defer db.Close()
+		if err = CreatePostgresSchema(context.Background(), db, databaseName); err != nil {
+			panic(errors.Wrap(err, "creating PostgreSQL tables"))
+		}
+		return
+	}
+
 	// Connect
 	client, err := mongowrapper.Connect(context.Background(), options.Client().ApplyURI(f.Config.DatabaseURI))
 	if err != nil {
@@ -202,6 +281,82 @@ func (f *FHIRServer) InitDB(databaseName string) {
 	}
 }
 
+// Import stores the resources in NDJSON files (see ImportInputsFromPaths) in the default database,
+// printing its progress. The OperationOutcomes of lines that fail are written to errors.ndjson in
+// workDir, where the progress is also saved so that an interrupted import can be resumed by running
+// it again with the same inputs and workDir.
+func (f *FHIRServer) Import(inputs []ImportInput, workDir string) error {
+	dal := f.initDAL()
+	if f.Config.ValidateWrites {
+		dal = newValidatingDataAccessLayer(dal, NewResourceValidator(f.Config))
+	}
+	imp := newBulkImport(dal, "", workDir, f.Config.BulkImportConcurrency, inputs)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				imported, failed := imp.progress()
+				fmt.Printf("Import: %d resources imported, %d failed\n", imported, failed)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := imp.run(context.Background())
+	close(done)
+	imported, failed := imp.progress()
+	fmt.Printf("Import: %d resources imported, %d failed\n", imported, failed)
+	if failed > 0 {
+		fmt.Printf("Import: errors are in %s\n", filepath.Join(workDir, importErrorsFile))
+	}
+	return err
+}
+
+// Rekey re-encrypts the resources in the given databases (the default database if none are given)
+// that were encrypted with older keys, printing its progress. Servers using the same databases can
+// keep running as long as their keyrings include the current key.
+func (f *FHIRServer) Rekey(databaseNames []string, batchSize int) error {
+	if batchSize < 1 {
+		return errors.Errorf("Rekey: invalid batch size %d", batchSize)
+	}
+	dal := f.initDAL()
+	if len(databaseNames) == 0 {
+		databaseNames = []string{""}
+	}
+	resourceTypes := make([]string, 0, len(search.SearchParameterDictionary))
+	for resourceType := range search.SearchParameterDictionary {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+
+	for _, databaseName := range databaseNames {
+		session := dal.StartSession(context.Background(), databaseName)
+		total := 0
+		for _, resourceType := range resourceTypes {
+			count, err := session.Rekey(resourceType, batchSize)
+			total += count
+			if count > 0 {
+				fmt.Printf("Rekey: %d versions of %s resources re-encrypted\n", count, resourceType)
+			}
+			if err != nil {
+				session.Finish()
+				return errors.Wrapf(err, "failed to rekey %s resources", resourceType)
+			}
+		}
+		session.Finish()
+		if databaseName == "" {
+			databaseName = f.Config.DefaultDatabaseName
+		}
+		fmt.Printf("Rekey: %d versions re-encrypted in database %s\n", total, databaseName)
+	}
+	return nil
+}
+
 func CreateCollections(db *mongowrapper.WrappedDatabase) {
 	// MongoDB transactions require that collections be pre-created
 	for _, name := range models2.AllFhirResourceCollectionNames() {
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// PatientCompartmentHandler limits the requests that are only allowed by SMART on FHIR patient/ scopes
+// (see auth.SMARTScopesHandler) to the compartment of the patient in the token's launch context
+// (see LimitToPatientCompartment): searches are restricted to the patient, and reads and writes of
+// resources in other compartments are forbidden. Resource types outside the Patient compartment
+// (e.g. Medication) can only be read.
+func PatientCompartmentHandler(c *gin.Context) {
+	if value, restricted := c.Get(auth.PatientCompartmentKey); restricted {
+		patientID, _ := value.(string)
+		LimitToPatientCompartment(c, patientID)
+	}
+}
+
+type readAccessKey struct{}
+
+// readAccessFunc returns whether resources of a type may be read and, if only in the compartment
+// of a patient, the patient's id
+type readAccessFunc func(resourceType string) (allowed bool, patientID string)
+
+// SMARTReadAccessHandler limits the resources of other types that requests can read, e.g. ones
+// included by _include and _revinclude, to those that the SMART on FHIR scopes allow reading
+// (see auth.SMARTReadAccess). Other resources are left out of search results.
+func SMARTReadAccessHandler(c *gin.Context) {
+	scoped := c.Copy()
+	access := readAccessFunc(func(resourceType string) (bool, string) {
+		return auth.SMARTReadAccess(scoped, resourceType)
+	})
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), readAccessKey{}, access))
+}
+
+// readAccess returns the access set by SMARTReadAccessHandler for a context
+func readAccess(ctx context.Context) (access readAccessFunc, scoped bool) {
+	access, scoped = ctx.Value(readAccessKey{}).(readAccessFunc)
+	return
+}
+
+// scopedDataAccessSession leaves the resources that a SMARTReadAccessHandler context may not read
+// out of search results
+type scopedDataAccessSession struct {
+	DataAccessSession
+	access readAccessFunc
+}
+
+// readable returns whether the scopes allow reading a resource
+func (s *scopedDataAccessSession) readable(resource *models2.Resource) (bool, error) {
+	allowed, patientID := s.access(resource.ResourceType())
+	if !allowed {
+		return false, nil
+	}
+	if patientID == "" || !search.InCompartment("Patient", resource.ResourceType()) {
+		return true, nil
+	}
+	return inPatientCompartment(resource, patientID)
+}
+
+func (s *scopedDataAccessSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+	bundle, err := s.DataAccessSession.Search(baseURL, searchQuery)
+	if err != nil {
+		return nil, err
+	}
+	entries := bundle.Entry[:0]
+	for _, entry := range bundle.Entry {
+		if entry.Resource != nil {
+			readable, err := s.readable(entry.Resource)
+			if err != nil {
+				return nil, err
+			}
+			if !readable {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	bundle.Entry = entries
+	return bundle, nil
+}
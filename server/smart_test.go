@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/square/go-jose.v1"
+
+	"github.com/eug48/fhir/auth"
+)
+
+type SMARTSuite struct {
+	key    *rsa.PrivateKey
+	jwks   string
+	server *FHIRServer
+}
+
+var _ = Suite(&SMARTSuite{})
+
+func (s *SMARTSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	jwks, err := json.Marshal(jose.JsonWebKeySet{Keys: []jose.JsonWebKey{{Key: &s.key.PublicKey, KeyID: "key1", Algorithm: "RS256", Use: "sig"}}})
+	c.Assert(err, IsNil)
+	s.jwks = filepath.Join(c.MkDir(), "jwks.json")
+	c.Assert(ioutil.WriteFile(s.jwks, jwks, os.ModePerm), IsNil)
+}
+
+func (s *SMARTSuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(func(config *Config) {
+		config.Auth = auth.SMART(s.jwks, "https://auth.example.org", "", "https://auth.example.org/authorize", "https://auth.example.org/token")
+	})
+
+	admin := s.token(c, "system/*.*", "")
+	for _, resource := range []string{
+		`{"resourceType": "Patient", "id": "p1"}`,
+		`{"resourceType": "Patient", "id": "p2"}`,
+		`{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p2"}}`,
+		`{"resourceType": "Medication", "id": "m1"}`,
+	} {
+		var header struct{ ResourceType, ID string }
+		c.Assert(json.Unmarshal([]byte(resource), &header), IsNil)
+		w := s.request("PUT", "/"+header.ResourceType+"/"+header.ID, resource, admin)
+		c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	}
+}
+
+func (s *SMARTSuite) token(c *C, scope string, patient string) string {
+	claims := map[string]interface{}{
+		"iss":   "https://auth.example.org",
+		"sub":   "user1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": scope,
+	}
+	if patient != "" {
+		claims["patient"] = patient
+	}
+	signer, err := jose.NewSigner(jose.RS256, &jose.JsonWebKey{Key: s.key, KeyID: "key1"})
+	c.Assert(err, IsNil)
+	payload, err := json.Marshal(claims)
+	c.Assert(err, IsNil)
+	signed, err := signer.Sign(payload)
+	c.Assert(err, IsNil)
+	token, err := signed.CompactSerialize()
+	c.Assert(err, IsNil)
+	return token
+}
+
+func (s *SMARTSuite) request(method string, path string, body string, token string) *httptest.ResponseRecorder {
+	if token == "" {
+		return serve(s.server, method, path, body)
+	}
+	return serve(s.server, method, path, body, "Authorization", "Bearer "+token)
+}
+
+func (s *SMARTSuite) searchIDs(c *C, path string, token string) []string {
+	w := s.request("GET", path, "", token)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var bundle struct {
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+	var ids []string
+	for _, entry := range bundle.Entry {
+		ids = append(ids, entry.Resource.ID)
+	}
+	return ids
+}
+
+func (s *SMARTSuite) TestPublicEndpoints(c *C) {
+	w := s.request("GET", "/Patient/p1", "", "")
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	w = s.request("GET", "/.well-known/smart-configuration", "", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var configuration struct {
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		Capabilities          []string `json:"capabilities"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &configuration), IsNil)
+	c.Assert(configuration.AuthorizationEndpoint, Equals, "https://auth.example.org/authorize")
+	c.Assert(configuration.TokenEndpoint, Equals, "https://auth.example.org/token")
+	c.Assert(configuration.Capabilities, Not(HasLen), 0)
+}
+
+func (s *SMARTSuite) TestUserScopes(c *C) {
+	token := s.token(c, "user/Observation.read", "")
+	c.Assert(s.searchIDs(c, "/Observation", token), DeepEquals, []string{"o1", "o2"})
+	w := s.request("GET", "/Patient/p1", "", token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("DELETE", "/Observation/o1", "", token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("POST", "/", `{"resourceType": "Bundle", "type": "batch"}`, token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+}
+
+func (s *SMARTSuite) TestPatientScopes(c *C) {
+	token := s.token(c, "launch/patient patient/*.read patient/Observation.write", "p1")
+
+	c.Assert(s.searchIDs(c, "/Observation", token), DeepEquals, []string{"o1"})
+	c.Assert(s.searchIDs(c, "/Observation?subject=Patient/p2", token), HasLen, 0)
+	c.Assert(s.searchIDs(c, "/Patient", token), DeepEquals, []string{"p1"})
+
+	w := s.request("GET", "/Observation/o1", "", token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.request("GET", "/Observation/o2", "", token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("GET", "/Patient/p2", "", token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	// resources outside the compartment can be read
+	w = s.request("GET", "/Medication/m1", "", token)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	w = s.request("POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p1"}}`, token)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = s.request("POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "height"}, "subject": {"reference": "Patient/p2"}}`, token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	// moving an observation to another patient
+	w = s.request("PUT", "/Observation/o1", `{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "weight"}, "subject": {"reference": "Patient/p2"}}`, token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("DELETE", "/Observation/o2", "", token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.request("DELETE", "/Observation/o1", "", token)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	// the patient can't be written with these scopes
+	w = s.request("PUT", "/Patient/p1", `{"resourceType": "Patient", "id": "p1"}`, token)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+}
+
+func (s *SMARTSuite) TestIncludedResourcesNeedScopes(c *C) {
+	token := s.token(c, "user/Patient.read", "")
+	c.Assert(s.searchIDs(c, "/Patient?_revinclude=Observation:subject", token), DeepEquals, []string{"p1", "p2"})
+	c.Assert(s.searchIDs(c, "/Patient?_id=p1&_revinclude=Observation:subject", token), DeepEquals, []string{"p1"})
+
+	token = s.token(c, "user/Patient.read user/Observation.read", "")
+	c.Assert(s.searchIDs(c, "/Patient?_id=p1&_revinclude=Observation:subject", token), DeepEquals, []string{"p1", "o1"})
+
+	// patient/ scopes allow including resources in the patient's compartment
+	token = s.token(c, "launch/patient user/Observation.read patient/Patient.read", "p1")
+	c.Assert(s.searchIDs(c, "/Observation?_include=Observation:subject", token), DeepEquals, []string{"o1", "o2", "p1"})
+}
+
+func (s *SMARTSuite) TestEverythingNeedsScopes(c *C) {
+	token := s.token(c, "user/Patient.read", "")
+	c.Assert(s.searchIDs(c, "/Patient/p1/$everything", token), DeepEquals, []string{"p1"})
+
+	token = s.token(c, "user/Patient.read user/Observation.read", "")
+	c.Assert(s.searchIDs(c, "/Patient/p1/$everything", token), DeepEquals, []string{"p1", "o1"})
+}
+
+func (s *SMARTSuite) TestAuthenticationFailuresAreAudited(c *C) {
+	previous := s.server.Config
+	s.server = newMemoryTestServer(func(config *Config) {
+		*config = previous
+		config.EnableAuditEvents = true
+	})
+
+	w := s.request("GET", "/Patient/p1", "", "")
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	admin := s.token(c, "system/*.*", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w = s.request("GET", "/AuditEvent?outcome=4", "", admin)
+		c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+		var bundle struct {
+			Entry []struct {
+				Resource auditEventJSON `json:"resource"`
+			} `json:"entry"`
+		}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+		if len(bundle.Entry) > 0 {
+			c.Assert(bundle.Entry, HasLen, 1)
+			event := bundle.Entry[0].Resource
+			c.Assert(event.Subtype[0].Code, Equals, "read")
+			c.Assert(event.OutcomeDesc, Equals, "HTTP 401 Unauthorized")
+			c.Assert(event.references(), DeepEquals, []string{"Patient/p1"})
+			break
+		}
+		c.Assert(time.Now().Before(deadline), Equals, true, Commentf("the AuditEvent wasn't written"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,750 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// SubscriptionEngine sends the notifications of active Subscriptions
+// (https://hl7.org/fhir/STU3/subscription.html) with rest-hook and websocket channels.
+//
+// Created, updated and deleted resources are matched against the criteria of the Subscriptions by the session
+// that changes them (see subscriptionDataAccessSession), so that the criteria are evaluated against the
+// resources as they were written, and the notifications are only sent once the changes have been committed.
+// Subscriptions whose status is requested are activated (or set to error if they can't be) when they're written.
+//
+// rest-hook notifications are POSTed to the channel's endpoint, with the resource if the channel has a payload,
+// and retried with exponential backoff. A Subscription whose notifications can't be delivered has its status
+// set to error. Websocket clients connect to /websocket, send "bind [id]" and are sent "ping [id]" for each
+// notification of that Subscription.
+type SubscriptionEngine struct {
+	dal    DataAccessLayer // for the engine's own changes to Subscriptions, which don't cause notifications
+	config Config
+	client *http.Client
+
+	lock          sync.Mutex
+	subscriptions map[string]*activeSubscriptions // by database name
+	hooks         map[string]*restHookQueue       // by database name and Subscription id
+	sockets       map[string][]*websocketBinding  // by database name and Subscription id
+}
+
+// how long the active Subscriptions of a database are kept, in case they're changed by another server
+const subscriptionRefreshInterval = time.Minute
+
+// activeSubscriptions are the active Subscriptions of a database by the resource type of their criteria
+type activeSubscriptions struct {
+	byType   map[string][]*subscription
+	loadedAt time.Time
+}
+
+type subscription struct {
+	id           string
+	resourceType string
+	criteria     string // the query of the criteria
+	end          time.Time
+	channelType  string
+	endpoint     string
+	payload      string
+	headers      []string
+}
+
+// notification is a change to a resource matching a Subscription's criteria
+type notification struct {
+	db           string
+	subscription *subscription
+	resource     []byte // nil for deletions
+}
+
+// NewSubscriptionEngine creates a SubscriptionEngine that uses a DAL (that doesn't cause notifications)
+// to update the status of Subscriptions
+func NewSubscriptionEngine(dal DataAccessLayer, config Config) *SubscriptionEngine {
+	return &SubscriptionEngine{
+		dal:           dal,
+		config:        config,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		subscriptions: make(map[string]*activeSubscriptions),
+		hooks:         make(map[string]*restHookQueue),
+		sockets:       make(map[string][]*websocketBinding),
+	}
+}
+
+// database returns the name of the database that sessions started with a custom database name use,
+// with "" being the default database
+func (e *SubscriptionEngine) database(customDbName string) string {
+	if !e.config.EnableMultiDB || customDbName == e.config.DefaultDatabaseName {
+		return ""
+	}
+	return customDbName
+}
+
+// parseSubscription reads the parts of a Subscription that the engine uses
+func parseSubscription(resourceJSON []byte) (sub *subscription, status string, err error) {
+	var resource struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		Criteria string `json:"criteria"`
+		End      string `json:"end"`
+		Channel  struct {
+			Type     string          `json:"type"`
+			Endpoint string          `json:"endpoint"`
+			Payload  string          `json:"payload"`
+			Header   json.RawMessage `json:"header"`
+		} `json:"channel"`
+	}
+	if err = json.Unmarshal(resourceJSON, &resource); err != nil {
+		return nil, "", errors.Wrap(err, "invalid Subscription")
+	}
+
+	sub = &subscription{
+		id:          resource.ID,
+		channelType: resource.Channel.Type,
+		endpoint:    resource.Channel.Endpoint,
+		payload:     resource.Channel.Payload,
+	}
+	sub.resourceType = resource.Criteria
+	if question := strings.Index(resource.Criteria, "?"); question >= 0 {
+		sub.resourceType = resource.Criteria[:question]
+		sub.criteria = resource.Criteria[question+1:]
+	}
+	if resource.End != "" {
+		if sub.end, err = time.Parse(time.RFC3339Nano, resource.End); err != nil {
+			return nil, "", errors.Errorf("invalid end: %s", resource.End)
+		}
+	}
+	// the header is a string in DSTU2 and an array of them in STU3
+	if len(resource.Channel.Header) > 0 && json.Unmarshal(resource.Channel.Header, &sub.headers) != nil {
+		var header string
+		if err = json.Unmarshal(resource.Channel.Header, &header); err != nil {
+			return nil, "", errors.Wrap(err, "invalid channel.header")
+		}
+		sub.headers = []string{header}
+	}
+	return sub, resource.Status, nil
+}
+
+// check returns why a Subscription can't be activated
+func (sub *subscription) check() (problem string) {
+	if sub.resourceType == "" {
+		return "The criteria must start with a resource type"
+	}
+	if _, known := search.SearchParameterDictionary[sub.resourceType]; !known {
+		return fmt.Sprintf("The criteria's resource type %s isn't known", sub.resourceType)
+	}
+	switch sub.channelType {
+	case "rest-hook":
+		endpoint, err := url.Parse(sub.endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return fmt.Sprintf("The endpoint %s isn't an http(s) URL", sub.endpoint)
+		}
+		for _, header := range sub.headers {
+			if !strings.Contains(header, ":") {
+				return fmt.Sprintf("The header %s isn't of the form name: value", header)
+			}
+		}
+	case "websocket":
+	default:
+		return fmt.Sprintf("The channel type %s isn't supported", sub.channelType)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			problem = fmt.Sprintf("The criteria are invalid: %v", r)
+		}
+	}()
+	query := search.Query{Resource: sub.resourceType, Query: sub.criteria}
+	query.Params()
+	query.Options()
+	return ""
+}
+
+// active returns the active Subscriptions of a database whose criteria are for a resource type
+func (e *SubscriptionEngine) active(session DataAccessSession, db string, resourceType string) ([]*subscription, error) {
+	e.lock.Lock()
+	active := e.subscriptions[db]
+	e.lock.Unlock()
+
+	if active == nil || time.Since(active.loadedAt) > subscriptionRefreshInterval {
+		active = &activeSubscriptions{byType: make(map[string][]*subscription), loadedAt: time.Now()}
+		err := session.Export("Subscription", time.Time{}, func(resource *models2.Resource) error {
+			sub, status, err := parseSubscription(resource.JsonBytes())
+			if err != nil {
+				glog.Warningf("ignoring Subscription %s: %+v", resource.Id(), err)
+				return nil
+			}
+			sub.id = resource.Id()
+			if status == "active" {
+				active.byType[sub.resourceType] = append(active.byType[sub.resourceType], sub)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the active Subscriptions")
+		}
+		e.lock.Lock()
+		e.subscriptions[db] = active
+		e.lock.Unlock()
+	}
+
+	var subscriptions []*subscription
+	for _, sub := range active.byType[resourceType] {
+		if sub.end.IsZero() || time.Now().Before(sub.end) {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	return subscriptions, nil
+}
+
+// forget makes the engine load the active Subscriptions of a database again
+func (e *SubscriptionEngine) forget(db string) {
+	e.lock.Lock()
+	delete(e.subscriptions, db)
+	e.lock.Unlock()
+}
+
+// matching returns the Subscriptions whose criteria a resource matches, with the session that wrote it
+func (e *SubscriptionEngine) matching(session DataAccessSession, db string, resourceType string, id string) ([]*subscription, error) {
+	subscriptions, err := e.active(session, db, resourceType)
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+
+	var matches []*subscription
+	for _, sub := range subscriptions {
+		query := "_id=" + url.QueryEscape(id)
+		if sub.criteria != "" {
+			query = sub.criteria + "&" + query
+		}
+		ids, err := findIDs(session, search.Query{Resource: resourceType, Query: query})
+		if err != nil {
+			glog.Warningf("failed to evaluate the criteria of Subscription %s: %+v", sub.id, err)
+			continue
+		}
+		if len(ids) > 0 {
+			matches = append(matches, sub)
+		}
+	}
+	return matches, nil
+}
+
+// findIDs calls FindIDs, returning the errors of searches that the searchers panic with
+func findIDs(session DataAccessSession, query search.Query) (ids []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("search failed: %v", r)
+		}
+	}()
+	return session.FindIDs(query)
+}
+
+// send delivers committed notifications
+func (e *SubscriptionEngine) send(notifications []notification) {
+	for _, n := range notifications {
+		switch n.subscription.channelType {
+		case "rest-hook":
+			e.restHookQueue(n.db, n.subscription.id).add(n)
+		case "websocket":
+			e.lock.Lock()
+			bindings := e.sockets[n.db+" "+n.subscription.id]
+			e.lock.Unlock()
+			for _, binding := range bindings {
+				binding.ping(n.subscription.id)
+			}
+		}
+	}
+}
+
+// activate sets the status of requested Subscriptions that have been committed to active, or to error
+func (e *SubscriptionEngine) activate(db string, ids []string) {
+	for _, id := range ids {
+		err := e.updateStatus(db, id, func(sub *subscription, status string) (string, string) {
+			if status != "requested" {
+				return "", ""
+			}
+			if problem := sub.check(); problem != "" {
+				return "error", problem
+			}
+			return "active", ""
+		})
+		if err != nil {
+			glog.Errorf("failed to activate Subscription %s: %+v", id, err)
+		}
+	}
+}
+
+// updateStatus changes the status and error of a Subscription to the ones returned by change,
+// unless it returns an empty status
+func (e *SubscriptionEngine) updateStatus(db string, id string, change func(sub *subscription, status string) (newStatus string, problem string)) error {
+	session := e.dal.StartSession(context.Background(), db)
+	defer session.Finish()
+
+	stored, err := session.Get(id, "Subscription")
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get the Subscription")
+	}
+	sub, status, err := parseSubscription(stored.JsonBytes())
+	if err != nil {
+		return err
+	}
+	newStatus, problem := change(sub, status)
+	if newStatus == "" {
+		return nil
+	}
+
+	var resource map[string]interface{}
+	if err = decodeJSONWithNumbers(stored.JsonBytes(), &resource); err != nil {
+		return errors.Wrap(err, "invalid Subscription")
+	}
+	resource["status"] = newStatus
+	if problem != "" {
+		resource["error"] = problem
+	} else {
+		delete(resource, "error")
+	}
+	resourceJSON, err := json.Marshal(resource)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the Subscription")
+	}
+	updated, err := models2.NewResourceFromJsonBytes(resourceJSON)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the Subscription")
+	}
+	if _, err = session.Put(id, "", updated); err != nil {
+		return errors.Wrap(err, "failed to update the Subscription")
+	}
+	e.forget(db)
+	return nil
+}
+
+// restHookQueue delivers the notifications of a rest-hook Subscription in order
+type restHookQueue struct {
+	engine  *SubscriptionEngine
+	db      string
+	id      string
+	lock    sync.Mutex
+	pending []notification
+	running bool
+	failed  bool
+}
+
+func (e *SubscriptionEngine) restHookQueue(db string, id string) *restHookQueue {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	queue := e.hooks[db+" "+id]
+	if queue == nil {
+		queue = &restHookQueue{engine: e, db: db, id: id}
+		e.hooks[db+" "+id] = queue
+	}
+	return queue
+}
+
+func (q *restHookQueue) add(n notification) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pending = append(q.pending, n)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *restHookQueue) run() {
+	for {
+		q.lock.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		n := q.pending[0]
+		q.pending = q.pending[1:]
+		failed := q.failed
+		q.lock.Unlock()
+
+		if failed {
+			// the Subscription's status is error so it's no longer sent notifications
+			continue
+		}
+		if err := q.engine.postWithRetries(n); err != nil {
+			glog.Warningf("failed to deliver a notification of Subscription %s: %+v", q.id, err)
+			q.lock.Lock()
+			q.failed = true
+			q.lock.Unlock()
+			err = q.engine.updateStatus(q.db, q.id, func(sub *subscription, status string) (string, string) {
+				return "error", err.Error()
+			})
+			if err != nil {
+				glog.Errorf("failed to set the status of Subscription %s to error: %+v", q.id, err)
+			}
+		}
+	}
+}
+
+// postWithRetries POSTs a notification to a rest-hook endpoint, retrying failures
+func (e *SubscriptionEngine) postWithRetries(n notification) (err error) {
+	backoff := e.config.SubscriptionRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err = e.post(n); err == nil {
+			return nil
+		}
+		if attempt >= e.config.SubscriptionRetries {
+			return errors.Wrapf(err, "notification failed after %d attempts", attempt+1)
+		}
+		glog.V(2).Infof("retrying a notification of Subscription %s in %s: %v", n.subscription.id, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (e *SubscriptionEngine) post(n notification) error {
+	sub := n.subscription
+	var body []byte
+	if sub.payload != "" && n.resource != nil {
+		body = n.resource
+		if strings.Contains(sub.payload, "xml") {
+			xml, err := NewFhirFormatConverter().JsonToXml(string(n.resource))
+			if err != nil {
+				return errors.Wrap(err, "failed to convert the resource to XML")
+			}
+			body = []byte(xml)
+		}
+	}
+
+	req, err := http.NewRequest("POST", sub.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid endpoint")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", sub.payload)
+	}
+	for _, header := range sub.headers {
+		if colon := strings.Index(header, ":"); colon > 0 {
+			req.Header.Set(strings.TrimSpace(header[:colon]), strings.TrimSpace(header[colon+1:]))
+		}
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("the endpoint %s responded with HTTP %d", sub.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// websocketBinding is a websocket connection bound to a Subscription
+type websocketBinding struct {
+	lock sync.Mutex
+	conn *websocket.Conn
+}
+
+func (b *websocketBinding) ping(id string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := websocket.Message.Send(b.conn, "ping "+id); err != nil {
+		glog.V(2).Infof("failed to send a websocket notification of Subscription %s: %v", id, err)
+	}
+}
+
+func (b *websocketBinding) send(message string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return websocket.Message.Send(b.conn, message)
+}
+
+// WebsocketHandler handles the connections of clients of Subscriptions with websocket channels.
+// Clients send "bind [id]" messages (to which the reply is "bound [id]") and receive "ping [id]" messages.
+func (e *SubscriptionEngine) WebsocketHandler(c *gin.Context) {
+	db := e.database(c.GetHeader("Db"))
+	server := websocket.Server{
+		// like the CORS middleware, allow any origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			e.serveWebsocket(db, conn)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+func (e *SubscriptionEngine) serveWebsocket(db string, conn *websocket.Conn) {
+	binding := &websocketBinding{conn: conn}
+	var bound []string
+	defer func() {
+		e.lock.Lock()
+		for _, key := range bound {
+			bindings := e.sockets[key]
+			for i, b := range bindings {
+				if b == binding {
+					e.sockets[key] = append(bindings[:i:i], bindings[i+1:]...)
+					break
+				}
+			}
+			if len(e.sockets[key]) == 0 {
+				delete(e.sockets, key)
+			}
+		}
+		e.lock.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var message string
+		if err := websocket.Message.Receive(conn, &message); err != nil {
+			return
+		}
+		fields := strings.Fields(message)
+		if len(fields) != 2 || fields[0] != "bind" {
+			if binding.send("error unknown message: "+message) != nil {
+				return
+			}
+			continue
+		}
+		id := fields[1]
+		if problem := e.checkWebsocketSubscription(db, id); problem != "" {
+			if binding.send("error "+id+" "+problem) != nil {
+				return
+			}
+			continue
+		}
+
+		key := db + " " + id
+		e.lock.Lock()
+		e.sockets[key] = append(e.sockets[key], binding)
+		e.lock.Unlock()
+		bound = append(bound, key)
+		if binding.send("bound "+id) != nil {
+			return
+		}
+	}
+}
+
+// checkWebsocketSubscription returns why a websocket can't be bound to a Subscription
+func (e *SubscriptionEngine) checkWebsocketSubscription(db string, id string) string {
+	session := e.dal.StartSession(context.Background(), db)
+	defer session.Finish()
+	stored, err := session.Get(id, "Subscription")
+	if err != nil {
+		return "Subscription not found"
+	}
+	sub, _, err := parseSubscription(stored.JsonBytes())
+	if err != nil {
+		return err.Error()
+	}
+	if sub.channelType != "websocket" {
+		return "the Subscription's channel type isn't websocket"
+	}
+	return ""
+}
+
+// subscriptionDataAccessLayer evaluates the criteria of Subscriptions for the changes made by its sessions
+// and has the engine send the notifications once they're committed
+type subscriptionDataAccessLayer struct {
+	DataAccessLayer
+	engine *SubscriptionEngine
+}
+
+func newSubscriptionDataAccessLayer(dal DataAccessLayer, engine *SubscriptionEngine) DataAccessLayer {
+	return &subscriptionDataAccessLayer{DataAccessLayer: dal, engine: engine}
+}
+
+func (dal *subscriptionDataAccessLayer) StartSession(ctx context.Context, dbname string) DataAccessSession {
+	return &subscriptionDataAccessSession{
+		DataAccessSession: dal.DataAccessLayer.StartSession(ctx, dbname),
+		engine:            dal.engine,
+		db:                dal.engine.database(dbname),
+	}
+}
+
+type subscriptionDataAccessSession struct {
+	DataAccessSession
+	engine *SubscriptionEngine
+	db     string
+
+	inTransaction bool
+	// changes waiting for the transaction to be committed
+	notifications          []notification
+	requestedSubscriptions []string
+	subscriptionsChanged   bool
+}
+
+func (s *subscriptionDataAccessSession) StartTransaction() error {
+	err := s.DataAccessSession.StartTransaction()
+	if err == nil {
+		s.inTransaction = true
+	}
+	return err
+}
+
+func (s *subscriptionDataAccessSession) CommmitIfTransaction() error {
+	err := s.DataAccessSession.CommmitIfTransaction()
+	if err != nil {
+		return err
+	}
+	s.inTransaction = false
+	s.flush()
+	return nil
+}
+
+func (s *subscriptionDataAccessSession) Finish() {
+	// anything not committed has been rolled back
+	s.notifications = nil
+	s.requestedSubscriptions = nil
+	s.subscriptionsChanged = false
+	s.inTransaction = false
+	s.DataAccessSession.Finish()
+}
+
+// flush sends the notifications of committed changes
+func (s *subscriptionDataAccessSession) flush() {
+	if s.inTransaction {
+		return
+	}
+	if s.subscriptionsChanged {
+		s.engine.forget(s.db)
+	}
+	notifications, requested := s.notifications, s.requestedSubscriptions
+	s.notifications, s.requestedSubscriptions, s.subscriptionsChanged = nil, nil, false
+	s.engine.send(notifications)
+	if len(requested) > 0 {
+		s.engine.activate(s.db, requested)
+	}
+}
+
+// written records the notifications of a created or updated resource
+func (s *subscriptionDataAccessSession) written(resource *models2.Resource) {
+	resourceType := resource.ResourceType()
+	if resourceType == "Subscription" {
+		s.subscriptionsChanged = true
+		if _, status, err := parseSubscription(resource.JsonBytes()); err == nil && status == "requested" {
+			s.requestedSubscriptions = append(s.requestedSubscriptions, resource.Id())
+		}
+	}
+	matches, err := s.engine.matching(s.DataAccessSession, s.db, resourceType, resource.Id())
+	if err != nil {
+		glog.Errorf("failed to find the Subscriptions for %s/%s: %+v", resourceType, resource.Id(), err)
+	}
+	if len(matches) == 0 {
+		return
+	}
+	// unlike JsonBytes, this has the id and meta set by the DAL
+	resourceJSON, err := resource.MarshalJSON()
+	if err != nil {
+		glog.Errorf("failed to encode %s/%s for notifications: %+v", resourceType, resource.Id(), err)
+		return
+	}
+	for _, sub := range matches {
+		s.notifications = append(s.notifications, notification{db: s.db, subscription: sub, resource: resourceJSON})
+	}
+}
+
+// deleting finds the Subscriptions that a resource matches before it's deleted
+func (s *subscriptionDataAccessSession) deleting(resourceType string, id string) []notification {
+	if resourceType == "Subscription" {
+		s.subscriptionsChanged = true
+	}
+	matches, err := s.engine.matching(s.DataAccessSession, s.db, resourceType, id)
+	if err != nil {
+		glog.Errorf("failed to find the Subscriptions for %s/%s: %+v", resourceType, id, err)
+	}
+	var notifications []notification
+	for _, sub := range matches {
+		notifications = append(notifications, notification{db: s.db, subscription: sub})
+	}
+	return notifications
+}
+
+func (s *subscriptionDataAccessSession) Post(resource *models2.Resource) (id string, err error) {
+	id, err = s.DataAccessSession.Post(resource)
+	if err == nil {
+		s.written(resource)
+		s.flush()
+	}
+	return id, err
+}
+
+func (s *subscriptionDataAccessSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	httpStatus, id, outputResource, err = s.DataAccessSession.ConditionalPost(query, resource)
+	if err == nil && httpStatus == http.StatusCreated {
+		s.written(resource)
+		s.flush()
+	}
+	return httpStatus, id, outputResource, err
+}
+
+func (s *subscriptionDataAccessSession) PostWithID(id string, resource *models2.Resource) error {
+	err := s.DataAccessSession.PostWithID(id, resource)
+	if err == nil {
+		s.written(resource)
+		s.flush()
+	}
+	return err
+}
+
+func (s *subscriptionDataAccessSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	createdNew, err = s.DataAccessSession.Put(id, conditionalVersionId, resource)
+	if err == nil {
+		s.written(resource)
+		s.flush()
+	}
+	return createdNew, err
+}
+
+func (s *subscriptionDataAccessSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	id, createdNew, err = s.DataAccessSession.ConditionalPut(query, conditionalVersionId, resource)
+	if err == nil {
+		s.written(resource)
+		s.flush()
+	}
+	return id, createdNew, err
+}
+
+func (s *subscriptionDataAccessSession) Delete(id, resourceType string) (newVersionId string, err error) {
+	notifications := s.deleting(resourceType, id)
+	newVersionId, err = s.DataAccessSession.Delete(id, resourceType)
+	if err == nil {
+		s.notifications = append(s.notifications, notifications...)
+		s.flush()
+	}
+	return newVersionId, err
+}
+
+func (s *subscriptionDataAccessSession) ConditionalDelete(query search.Query) (count int64, err error) {
+	var notifications []notification
+	active, err := s.engine.active(s.DataAccessSession, s.db, query.Resource)
+	if err != nil {
+		glog.Errorf("failed to find the Subscriptions for %s: %+v", query.Resource, err)
+	}
+	if len(active) > 0 || query.Resource == "Subscription" {
+		ids, err := s.DataAccessSession.FindIDs(query)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range ids {
+			notifications = append(notifications, s.deleting(query.Resource, id)...)
+		}
+	}
+	count, err = s.DataAccessSession.ConditionalDelete(query)
+	if err == nil {
+		s.notifications = append(s.notifications, notifications...)
+		s.flush()
+	}
+	return count, err
+}
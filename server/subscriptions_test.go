@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+	. "gopkg.in/check.v1"
+)
+
+type SubscriptionSuite struct {
+	server        *FHIRServer
+	endpoint      *httptest.Server
+	endpointFails bool
+	notifications chan receivedNotification
+}
+
+type receivedNotification struct {
+	path          string
+	authorization string
+	body          string
+}
+
+var _ = Suite(&SubscriptionSuite{})
+
+func (s *SubscriptionSuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(func(config *Config) {
+		config.SubscriptionRetries = 2
+		config.SubscriptionRetryBackoff = time.Millisecond
+	})
+
+	s.endpointFails = false
+	s.notifications = make(chan receivedNotification, 10)
+	s.endpoint = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.endpointFails {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.notifications <- receivedNotification{r.URL.Path, r.Header.Get("Authorization"), string(body)}
+	}))
+}
+
+func (s *SubscriptionSuite) TearDownTest(c *C) {
+	s.endpoint.Close()
+}
+
+func (s *SubscriptionSuite) subscribe(c *C, id string, channelType string, endpoint string) {
+	w := serve(s.server, "PUT", "/Subscription/"+id, `{
+		"resourceType": "Subscription",
+		"status": "requested",
+		"reason": "testing",
+		"criteria": "Observation?code=http://loinc.org|1234-5",
+		"channel": {
+			"type": "`+channelType+`",
+			"endpoint": "`+endpoint+`",
+			"payload": "application/fhir+json",
+			"header": [ "Authorization: Bearer secret" ]
+		}
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+}
+
+func (s *SubscriptionSuite) subscriptionStatus(c *C, id string) (status string, problem string) {
+	w := serve(s.server, "GET", "/Subscription/"+id, "")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var subscription struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &subscription), IsNil)
+	return subscription.Status, subscription.Error
+}
+
+func observation(code string) string {
+	return `{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": { "coding": [ { "system": "http://loinc.org", "code": "` + code + `" } ] }
+	}`
+}
+
+func (s *SubscriptionSuite) expectNotification(c *C) receivedNotification {
+	select {
+	case n := <-s.notifications:
+		return n
+	case <-time.After(5 * time.Second):
+		c.Fatal("no notification received")
+	}
+	return receivedNotification{}
+}
+
+func (s *SubscriptionSuite) expectNoNotification(c *C) {
+	select {
+	case n := <-s.notifications:
+		c.Fatalf("unexpected notification: %+v", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (s *SubscriptionSuite) TestRestHook(c *C) {
+	s.subscribe(c, "sub1", "rest-hook", s.endpoint.URL+"/notify")
+	status, problem := s.subscriptionStatus(c, "sub1")
+	c.Assert(status, Equals, "active")
+	c.Assert(problem, Equals, "")
+
+	w := serve(s.server, "POST", "/Observation", observation("1234-5"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	n := s.expectNotification(c)
+	c.Assert(n.path, Equals, "/notify")
+	c.Assert(n.authorization, Equals, "Bearer secret")
+	var notified struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id"`
+	}
+	c.Assert(json.Unmarshal([]byte(n.body), &notified), IsNil)
+	c.Assert(notified.ResourceType, Equals, "Observation")
+	c.Assert(w.Header().Get("Location"), Matches, ".*/Observation/"+notified.ID+"/.*")
+
+	// resources not matching the criteria
+	w = serve(s.server, "POST", "/Observation", observation("9999-9"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	s.expectNoNotification(c)
+
+	// deletions are notified without a payload
+	w = serve(s.server, "DELETE", "/Observation/"+notified.ID, "")
+	c.Assert(w.Code, Equals, http.StatusNoContent, Commentf("%s", w.Body.String()))
+	n = s.expectNotification(c)
+	c.Assert(n.body, Equals, "")
+
+	// once the Subscription is off, it's not notified
+	w = serve(s.server, "GET", "/Subscription/sub1", "")
+	off := strings.Replace(w.Body.String(), `"active"`, `"off"`, 1)
+	w = serve(s.server, "PUT", "/Subscription/sub1", off)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "POST", "/Observation", observation("1234-5"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	s.expectNoNotification(c)
+}
+
+func (s *SubscriptionSuite) TestInvalidSubscriptions(c *C) {
+	s.subscribe(c, "email", "email", "mailto:someone@example.org")
+	status, problem := s.subscriptionStatus(c, "email")
+	c.Assert(status, Equals, "error")
+	c.Assert(problem, Matches, ".*channel type email.*")
+
+	w := serve(s.server, "PUT", "/Subscription/criteria", `{
+		"resourceType": "Subscription",
+		"status": "requested",
+		"reason": "testing",
+		"criteria": "Observation?unknown-parameter=1",
+		"channel": { "type": "rest-hook", "endpoint": "`+s.endpoint.URL+`" }
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	status, problem = s.subscriptionStatus(c, "criteria")
+	c.Assert(status, Equals, "error")
+	c.Assert(problem, Matches, ".*criteria.*")
+}
+
+func (s *SubscriptionSuite) TestTransactionsNotifyOnceCommitted(c *C) {
+	s.subscribe(c, "sub1", "rest-hook", s.endpoint.URL)
+	w := serve(s.server, "PUT", "/Patient/p1", `{"resourceType": "Patient"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+
+	// the Observation is created before the failing update, so is rolled back
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{ "resource": `+observation("1234-5")+`, "request": { "method": "POST", "url": "Observation" } },
+			{ "resource": { "resourceType": "Patient", "id": "p1" }, "request": { "method": "PUT", "url": "Patient/p1", "ifMatch": "W/\"5\"" } }
+		]
+	}`)
+	c.Assert(w.Code, Not(Equals), http.StatusOK, Commentf("%s", w.Body.String()))
+	s.expectNoNotification(c)
+
+	w = serve(s.server, "POST", "/", `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{ "resource": `+observation("1234-5")+`, "request": { "method": "POST", "url": "Observation" } },
+			{ "resource": `+observation("9999-9")+`, "request": { "method": "POST", "url": "Observation" } }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	n := s.expectNotification(c)
+	c.Assert(n.body, Matches, `(?s).*"1234-5".*`)
+	s.expectNoNotification(c)
+}
+
+func (s *SubscriptionSuite) TestFailedDelivery(c *C) {
+	s.subscribe(c, "sub1", "rest-hook", s.endpoint.URL)
+	s.endpointFails = true
+
+	w := serve(s.server, "POST", "/Observation", observation("1234-5"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, problem := s.subscriptionStatus(c, "sub1")
+		if status == "error" {
+			c.Assert(problem, Matches, ".*HTTP 500.*")
+			break
+		}
+		c.Assert(time.Now().Before(deadline), Equals, true, Commentf("status is still %s", status))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a Subscription in error isn't notified
+	s.endpointFails = false
+	w = serve(s.server, "POST", "/Observation", observation("1234-5"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	s.expectNoNotification(c)
+}
+
+func (s *SubscriptionSuite) TestWebsocket(c *C) {
+	s.subscribe(c, "ws1", "websocket", "")
+	s.subscribe(c, "rest", "rest-hook", s.endpoint.URL)
+
+	server := httptest.NewServer(s.server.Engine)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/websocket"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var message string
+	c.Assert(websocket.Message.Send(conn, "bind rest"), IsNil)
+	c.Assert(websocket.Message.Receive(conn, &message), IsNil)
+	c.Assert(message, Matches, "error rest .*websocket.*")
+
+	c.Assert(websocket.Message.Send(conn, "bind ws1"), IsNil)
+	c.Assert(websocket.Message.Receive(conn, &message), IsNil)
+	c.Assert(message, Equals, "bound ws1")
+
+	w := serve(s.server, "POST", "/Observation", observation("1234-5"))
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	c.Assert(websocket.Message.Receive(conn, &message), IsNil)
+	c.Assert(message, Equals, "ping ws1")
+	s.expectNotification(c)
+}
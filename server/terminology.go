@@ -0,0 +1,347 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/terminology"
+)
+
+// The terminology operations use the CodeSystems and ValueSets stored in the server (see the terminology package).
+
+// ExpandHandler handles ValueSet $expand (GET or POST /ValueSet/$expand and /ValueSet/:id/$expand)
+// with the url, valueSet, filter, offset and count parameters
+func (rc *ResourceController) ExpandHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	params, ok := bindTerminologyParameters(c)
+	if !ok {
+		return
+	}
+	service := terminology.NewService(sessionSource{session})
+	valueSet := params.valueSetFor(c, session, service)
+	if valueSet == nil {
+		return
+	}
+
+	var options terminology.ExpandOptions
+	options.Filter = params.values["filter"]
+	for name, value := range map[string]*int{"offset": &options.Offset, "count": &options.Count} {
+		if text := params.values[name]; text != "" {
+			number, err := strconv.Atoi(text)
+			if err != nil || number < 0 {
+				badTerminologyRequest(c, fmt.Sprintf("invalid %s: %s", name, text))
+				return
+			}
+			*value = number
+		}
+	}
+
+	expansion, err := service.Expand(valueSet, options)
+	if err != nil {
+		panic(err)
+	}
+
+	contains := make([]interface{}, 0, len(expansion.Contains))
+	for _, concept := range expansion.Contains {
+		contains = append(contains, conceptJSON(concept))
+	}
+	var parameters []interface{}
+	if options.Filter != "" {
+		parameters = append(parameters, map[string]interface{}{"name": "filter", "valueString": options.Filter})
+	}
+	if options.Count > 0 {
+		parameters = append(parameters, map[string]interface{}{"name": "count", "valueInteger": options.Count})
+	}
+
+	// the expanded value set has the metadata of the original but not its compose
+	expanded := make(map[string]interface{})
+	for key, value := range valueSet {
+		switch key {
+		case "compose", "expansion", "text":
+		default:
+			expanded[key] = value
+		}
+	}
+	expansionJSON := map[string]interface{}{
+		"identifier": "urn:uuid:" + uuid.New().String(),
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+		"total":      expansion.Total,
+		"offset":     expansion.Offset,
+		"contains":   contains,
+	}
+	if len(parameters) > 0 {
+		expansionJSON["parameter"] = parameters
+	}
+	expanded["expansion"] = expansionJSON
+	c.Render(http.StatusOK, CustomFhirRenderer{expanded, c})
+}
+
+// ValidateCodeHandler handles $validate-code for ValueSets (GET or POST /ValueSet/$validate-code and /ValueSet/:id/$validate-code,
+// with the url, valueSet, code, system, display, coding and codeableConcept parameters) and CodeSystems
+// (/CodeSystem/$validate-code and /CodeSystem/:id/$validate-code, with the url, code, display and coding parameters)
+func (rc *ResourceController) ValidateCodeHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	params, ok := bindTerminologyParameters(c)
+	if !ok {
+		return
+	}
+	service := terminology.NewService(sessionSource{session})
+	if len(params.codings) == 0 {
+		badTerminologyRequest(c, "$validate-code requires a code, coding or codeableConcept")
+		return
+	}
+
+	var result *terminology.CodeValidation
+	var err error
+	if rc.Name == "CodeSystem" {
+		system := params.values["url"]
+		if id := c.Param("id"); id != "$validate-code" {
+			system = storedResourceURL(session, "CodeSystem", id)
+		} else if system == "" {
+			system = params.codings[0].System
+		}
+		if system == "" {
+			badTerminologyRequest(c, "$validate-code requires the url of a code system")
+			return
+		}
+		result, err = service.ValidateCodeInCodeSystem(system, params.codings[0])
+	} else {
+		valueSet := params.valueSetFor(c, session, service)
+		if valueSet == nil {
+			return
+		}
+		result, err = service.ValidateCode(valueSet, params.codings)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	parameters := []interface{}{
+		map[string]interface{}{"name": "result", "valueBoolean": result.Result},
+	}
+	if result.Message != "" {
+		parameters = append(parameters, map[string]interface{}{"name": "message", "valueString": result.Message})
+	}
+	if result.Display != "" {
+		parameters = append(parameters, map[string]interface{}{"name": "display", "valueString": result.Display})
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{map[string]interface{}{"resourceType": "Parameters", "parameter": parameters}, c})
+}
+
+// LookupHandler handles CodeSystem $lookup (GET or POST /CodeSystem/$lookup) with the system, code and coding parameters
+func (rc *ResourceController) LookupHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	params, ok := bindTerminologyParameters(c)
+	if !ok {
+		return
+	}
+	if len(params.codings) == 0 || params.codings[0].System == "" {
+		badTerminologyRequest(c, "$lookup requires a system and a code, or a coding")
+		return
+	}
+	coding := params.codings[0]
+
+	result, err := terminology.NewService(sessionSource{session}).Lookup(coding.System, coding.Code)
+	if err != nil {
+		panic(err)
+	}
+
+	parameters := []interface{}{
+		map[string]interface{}{"name": "name", "valueString": result.Name},
+	}
+	if result.Version != "" {
+		parameters = append(parameters, map[string]interface{}{"name": "version", "valueString": result.Version})
+	}
+	parameters = append(parameters, map[string]interface{}{"name": "display", "valueString": result.Display})
+	for _, designation := range result.Designations {
+		var parts []interface{}
+		if designation.Language != "" {
+			parts = append(parts, map[string]interface{}{"name": "language", "valueCode": designation.Language})
+		}
+		if designation.Use != nil {
+			parts = append(parts, map[string]interface{}{"name": "use", "valueCoding": designation.Use})
+		}
+		parts = append(parts, map[string]interface{}{"name": "value", "valueString": designation.Value})
+		parameters = append(parameters, map[string]interface{}{"name": "designation", "part": parts})
+	}
+	for _, property := range result.Properties {
+		parameters = append(parameters, map[string]interface{}{"name": "property", "part": []interface{}{
+			map[string]interface{}{"name": "code", "valueCode": property.Code},
+			map[string]interface{}{"name": "value", property.ValueName: property.Value},
+		}})
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{map[string]interface{}{"resourceType": "Parameters", "parameter": parameters}, c})
+}
+
+func conceptJSON(concept terminology.Concept) map[string]interface{} {
+	object := map[string]interface{}{"system": concept.System, "code": concept.Code}
+	if concept.Version != "" {
+		object["version"] = concept.Version
+	}
+	if concept.Display != "" {
+		object["display"] = concept.Display
+	}
+	return object
+}
+
+func badTerminologyRequest(c *gin.Context, message string) {
+	oo := models.NewOperationOutcome("error", "invalid", message)
+	c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+}
+
+// terminologyParameters are the parameters of a terminology operation, from the query string
+// or from a Parameters resource
+type terminologyParameters struct {
+	values   map[string]string // the simple ones, e.g. url and filter
+	valueSet map[string]interface{}
+	codings  []terminology.Coding // from code, system and display or from coding or codeableConcept
+}
+
+// bindTerminologyParameters reads the parameters of a request, responding with an error if they're invalid
+func bindTerminologyParameters(c *gin.Context) (*terminologyParameters, bool) {
+	params := &terminologyParameters{values: make(map[string]string)}
+	for name, values := range c.Request.URL.Query() {
+		params.values[name] = values[0]
+	}
+
+	if c.Request.Method == http.MethodPost && c.Request.ContentLength != 0 {
+		body, err := FHIRBind(c, "")
+		if err != nil {
+			statusCode, oo := bindFailure(err)
+			c.Render(statusCode, CustomFhirRenderer{oo, c})
+			return nil, false
+		}
+		if body.ResourceType() != "Parameters" {
+			badTerminologyRequest(c, "expected a Parameters resource but got "+body.ResourceType())
+			return nil, false
+		}
+		var parameters struct {
+			Parameter []map[string]interface{} `json:"parameter"`
+		}
+		if err = decodeJSONWithNumbers(body.JsonBytes(), &parameters); err != nil {
+			badTerminologyRequest(c, "invalid Parameters: "+err.Error())
+			return nil, false
+		}
+		for _, parameter := range parameters.Parameter {
+			name, _ := parameter["name"].(string)
+			switch name {
+			case "valueSet":
+				params.valueSet, _ = parameter["resource"].(map[string]interface{})
+			case "coding":
+				coding, _ := parameter["valueCoding"].(map[string]interface{})
+				params.codings = append(params.codings, codingOf(coding))
+			case "codeableConcept":
+				concept, _ := parameter["valueCodeableConcept"].(map[string]interface{})
+				codings, _ := concept["coding"].([]interface{})
+				for _, coding := range codings {
+					coding, _ := coding.(map[string]interface{})
+					params.codings = append(params.codings, codingOf(coding))
+				}
+			default:
+				for key, value := range parameter {
+					if len(key) > len("value") && key[:len("value")] == "value" {
+						switch value := value.(type) {
+						case string:
+							params.values[name] = value
+						case json.Number:
+							params.values[name] = value.String()
+						case bool:
+							params.values[name] = strconv.FormatBool(value)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if code := params.values["code"]; code != "" {
+		system := params.values["system"]
+		if system == "" && c.Param("id") == "$lookup" {
+			system = params.values["url"]
+		}
+		params.codings = append([]terminology.Coding{{System: system, Code: code, Display: params.values["display"]}}, params.codings...)
+	}
+	return params, true
+}
+
+func codingOf(coding map[string]interface{}) terminology.Coding {
+	system, _ := coding["system"].(string)
+	code, _ := coding["code"].(string)
+	display, _ := coding["display"].(string)
+	return terminology.Coding{System: system, Code: code, Display: display}
+}
+
+// valueSetFor returns the ValueSet of an operation: the stored one for instance-level operations, the one
+// passed in the valueSet parameter or the one with the canonical URL in the url parameter.
+// It responds with an error if there isn't one.
+func (params *terminologyParameters) valueSetFor(c *gin.Context, session DataAccessSession, service *terminology.Service) map[string]interface{} {
+	if id := c.Param("id"); id != "$expand" && id != "$validate-code" {
+		stored, err := session.Get(id, "ValueSet")
+		if err != nil {
+			panic(errors.Wrap(err, "terminology: Get failed"))
+		}
+		valueSet, err := terminology.DecodeResource(stored.JsonBytes())
+		if err != nil {
+			panic(err)
+		}
+		return valueSet
+	}
+	if params.valueSet != nil {
+		return params.valueSet
+	}
+	url := params.values["url"]
+	if url == "" {
+		badTerminologyRequest(c, "a ValueSet is required in the url or valueSet parameter")
+		return nil
+	}
+	valueSet, err := service.FindValueSet(url)
+	if err != nil {
+		panic(err)
+	}
+	return valueSet
+}
+
+// storedResourceURL returns the canonical URL of a stored resource
+func storedResourceURL(session DataAccessSession, resourceType string, id string) string {
+	stored, err := session.Get(id, resourceType)
+	if err != nil {
+		panic(errors.Wrap(err, "terminology: Get failed"))
+	}
+	var header struct {
+		URL string `json:"url"`
+	}
+	if err = json.Unmarshal(stored.JsonBytes(), &header); err != nil {
+		panic(errors.Wrap(err, "terminology: invalid stored resource"))
+	}
+	return header.URL
+}
+
+// expansionCacheInvalidator is an InterceptorHandler that clears the codes cached by token searches
+// with the :in, :not-in, :above and :below modifiers when ValueSets and CodeSystems change
+type expansionCacheInvalidator struct{}
+
+func (expansionCacheInvalidator) Before(resource interface{}) {}
+
+func (expansionCacheInvalidator) After(resource interface{}) {
+	search.InvalidateExpansionCache()
+}
+
+func (expansionCacheInvalidator) OnError(err error, resource interface{}) {}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type TerminologySuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&TerminologySuite{})
+
+func (s *TerminologySuite) SetUpTest(c *C) {
+	s.server = newMemoryTestServer(nil)
+
+	w := serve(s.server, "PUT", "/CodeSystem/animals", `{
+		"resourceType": "CodeSystem",
+		"url": "http://example.org/animals",
+		"name": "Animals",
+		"version": "1.0",
+		"status": "active",
+		"content": "complete",
+		"concept": [
+			{ "code": "mammal", "display": "Mammal", "concept": [
+				{ "code": "dog", "display": "Dog",
+				  "designation": [ { "language": "fr", "value": "Chien" } ] },
+				{ "code": "cat", "display": "Cat" },
+				{ "code": "whale", "display": "Blue whale" }
+			] },
+			{ "code": "bird", "display": "Bird", "concept": [
+				{ "code": "parrot", "display": "Parrot" }
+			] }
+		]
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	w = serve(s.server, "PUT", "/ValueSet/pets", `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/pets",
+		"name": "Pets",
+		"status": "active",
+		"compose": {
+			"include": [
+				{ "system": "http://example.org/animals", "filter": [ { "property": "concept", "op": "is-a", "value": "mammal" } ] },
+				{ "system": "http://example.org/animals", "concept": [ { "code": "parrot" } ] }
+			],
+			"exclude": [
+				{ "system": "http://example.org/animals", "concept": [ { "code": "whale" }, { "code": "mammal" } ] }
+			]
+		}
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+}
+
+type expandedValueSet struct {
+	ResourceType string                 `json:"resourceType"`
+	URL          string                 `json:"url"`
+	Compose      map[string]interface{} `json:"compose"`
+	Expansion    struct {
+		Identifier string `json:"identifier"`
+		Timestamp  string `json:"timestamp"`
+		Total      int    `json:"total"`
+		Offset     int    `json:"offset"`
+		Contains   []struct {
+			System  string `json:"system"`
+			Version string `json:"version"`
+			Code    string `json:"code"`
+			Display string `json:"display"`
+		} `json:"contains"`
+	} `json:"expansion"`
+}
+
+func expandedCodes(c *C, w *httptest.ResponseRecorder) (*expandedValueSet, []string) {
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var valueSet expandedValueSet
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &valueSet), IsNil)
+	c.Assert(valueSet.ResourceType, Equals, "ValueSet")
+	var codes []string
+	for _, concept := range valueSet.Expansion.Contains {
+		codes = append(codes, concept.Code)
+	}
+	return &valueSet, codes
+}
+
+// parametersOf returns the values of a Parameters response by name
+func parametersOf(c *C, w *httptest.ResponseRecorder) map[string][]map[string]interface{} {
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var parameters struct {
+		ResourceType string                   `json:"resourceType"`
+		Parameter    []map[string]interface{} `json:"parameter"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &parameters), IsNil)
+	c.Assert(parameters.ResourceType, Equals, "Parameters")
+	byName := make(map[string][]map[string]interface{})
+	for _, parameter := range parameters.Parameter {
+		name := parameter["name"].(string)
+		byName[name] = append(byName[name], parameter)
+	}
+	return byName
+}
+
+func (s *TerminologySuite) TestExpand(c *C) {
+	valueSet, codes := expandedCodes(c, serve(s.server, "GET", "/ValueSet/$expand?url=http://example.org/pets", ""))
+	c.Assert(codes, DeepEquals, []string{"dog", "cat", "parrot"})
+	c.Assert(valueSet.URL, Equals, "http://example.org/pets")
+	c.Assert(valueSet.Compose, IsNil)
+	c.Assert(valueSet.Expansion.Total, Equals, 3)
+	c.Assert(strings.HasPrefix(valueSet.Expansion.Identifier, "urn:uuid:"), Equals, true)
+	c.Assert(valueSet.Expansion.Timestamp, Not(Equals), "")
+	c.Assert(valueSet.Expansion.Contains[0].System, Equals, "http://example.org/animals")
+	c.Assert(valueSet.Expansion.Contains[0].Version, Equals, "1.0")
+	c.Assert(valueSet.Expansion.Contains[0].Display, Equals, "Dog")
+
+	_, codes = expandedCodes(c, serve(s.server, "GET", "/ValueSet/pets/$expand", ""))
+	c.Assert(codes, DeepEquals, []string{"dog", "cat", "parrot"})
+}
+
+func (s *TerminologySuite) TestExpandFilterAndPaging(c *C) {
+	valueSet, codes := expandedCodes(c, serve(s.server, "GET", "/ValueSet/pets/$expand?filter=ca", ""))
+	c.Assert(codes, DeepEquals, []string{"cat"})
+	c.Assert(valueSet.Expansion.Total, Equals, 1)
+
+	valueSet, codes = expandedCodes(c, serve(s.server, "GET", "/ValueSet/$expand?url=http://example.org/pets&offset=1&count=1", ""))
+	c.Assert(codes, DeepEquals, []string{"cat"})
+	c.Assert(valueSet.Expansion.Total, Equals, 3)
+	c.Assert(valueSet.Expansion.Offset, Equals, 1)
+
+	w := serve(s.server, "GET", "/ValueSet/pets/$expand?count=lots", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(outcomeOf(c, w).Issue[0].Diagnostics, Equals, "invalid count: lots")
+}
+
+func (s *TerminologySuite) TestExpandPost(c *C) {
+	_, codes := expandedCodes(c, serve(s.server, "POST", "/ValueSet/$expand", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{ "name": "valueSet", "resource": {
+				"resourceType": "ValueSet",
+				"status": "draft",
+				"compose": { "include": [
+					{ "system": "http://example.org/animals", "filter": [ { "property": "concept", "op": "is-a", "value": "bird" } ] }
+				] }
+			} },
+			{ "name": "count", "valueInteger": 5 }
+		]
+	}`))
+	c.Assert(codes, DeepEquals, []string{"bird", "parrot"})
+}
+
+func (s *TerminologySuite) TestExpandErrors(c *C) {
+	w := serve(s.server, "GET", "/ValueSet/$expand?url=http://example.org/nothing", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(outcomeOf(c, w).Issue[0].Code, Equals, "not-found")
+
+	w = serve(s.server, "GET", "/ValueSet/missing/$expand", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	w = serve(s.server, "GET", "/ValueSet/$expand", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	w = serve(s.server, "PUT", "/ValueSet/bad-filter", `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/bad-filter",
+		"status": "draft",
+		"compose": { "include": [
+			{ "system": "http://example.org/animals", "filter": [ { "property": "concept", "op": "fuzzy", "value": "dog" } ] }
+		] }
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	w = serve(s.server, "GET", "/ValueSet/bad-filter/$expand", "")
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(outcomeOf(c, w).Issue[0].Code, Equals, "not-supported")
+}
+
+func (s *TerminologySuite) TestValidateCode(c *C) {
+	parameters := parametersOf(c, serve(s.server, "GET", "/ValueSet/$validate-code?url=http://example.org/pets&system=http://example.org/animals&code=dog", ""))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, true)
+	c.Assert(parameters["display"][0]["valueString"], Equals, "Dog")
+
+	parameters = parametersOf(c, serve(s.server, "GET", "/ValueSet/pets/$validate-code?system=http://example.org/animals&code=whale", ""))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, false)
+	c.Assert(parameters["message"][0]["valueString"], Equals, "The code http://example.org/animals|whale isn't in http://example.org/pets")
+
+	parameters = parametersOf(c, serve(s.server, "POST", "/ValueSet/pets/$validate-code", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{ "name": "codeableConcept", "valueCodeableConcept": { "coding": [
+				{ "system": "http://example.org/animals", "code": "whale" },
+				{ "system": "http://example.org/animals", "code": "cat", "display": "Cat" }
+			] } }
+		]
+	}`))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, true)
+
+	parameters = parametersOf(c, serve(s.server, "POST", "/ValueSet/$validate-code", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{ "name": "url", "valueUri": "http://example.org/pets" },
+			{ "name": "coding", "valueCoding": { "system": "http://example.org/animals", "code": "dog", "display": "Wolf" } }
+		]
+	}`))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, false)
+	c.Assert(parameters["message"][0]["valueString"], Equals, "The display 'Wolf' for http://example.org/animals|dog should be 'Dog'")
+
+	w := serve(s.server, "GET", "/ValueSet/pets/$validate-code", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *TerminologySuite) TestValidateCodeInCodeSystem(c *C) {
+	parameters := parametersOf(c, serve(s.server, "GET", "/CodeSystem/$validate-code?url=http://example.org/animals&code=whale", ""))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, true)
+	c.Assert(parameters["display"][0]["valueString"], Equals, "Blue whale")
+
+	parameters = parametersOf(c, serve(s.server, "GET", "/CodeSystem/animals/$validate-code?code=unicorn", ""))
+	c.Assert(parameters["result"][0]["valueBoolean"], Equals, false)
+	c.Assert(parameters["message"][0]["valueString"], Equals, "The code unicorn isn't in the code system http://example.org/animals")
+}
+
+func (s *TerminologySuite) TestLookup(c *C) {
+	parameters := parametersOf(c, serve(s.server, "GET", "/CodeSystem/$lookup?system=http://example.org/animals&code=dog", ""))
+	c.Assert(parameters["name"][0]["valueString"], Equals, "Animals")
+	c.Assert(parameters["version"][0]["valueString"], Equals, "1.0")
+	c.Assert(parameters["display"][0]["valueString"], Equals, "Dog")
+	c.Assert(parameters["designation"], HasLen, 1)
+	c.Assert(parameters["designation"][0]["part"], DeepEquals, []interface{}{
+		map[string]interface{}{"name": "language", "valueCode": "fr"},
+		map[string]interface{}{"name": "value", "valueString": "Chien"},
+	})
+	c.Assert(parameters["property"], HasLen, 1)
+	c.Assert(parameters["property"][0]["part"], DeepEquals, []interface{}{
+		map[string]interface{}{"name": "code", "valueCode": "parent"},
+		map[string]interface{}{"name": "value", "valueCode": "mammal"},
+	})
+
+	parameters = parametersOf(c, serve(s.server, "POST", "/CodeSystem/$lookup", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{ "name": "coding", "valueCoding": { "system": "http://example.org/animals", "code": "bird" } }
+		]
+	}`))
+	c.Assert(parameters["display"][0]["valueString"], Equals, "Bird")
+	c.Assert(parameters["property"], HasLen, 1)
+
+	w := serve(s.server, "GET", "/CodeSystem/$lookup?system=http://example.org/animals&code=unicorn", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(outcomeOf(c, w).Issue[0].Diagnostics, Equals, "The code unicorn isn't in the code system http://example.org/animals")
+
+	w = serve(s.server, "GET", "/CodeSystem/$lookup?code=dog", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *TerminologySuite) searchIDs(c *C, query string) []string {
+	w := serve(s.server, "GET", query, "")
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	var bundle struct {
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &bundle), IsNil)
+	ids := []string{}
+	for _, entry := range bundle.Entry {
+		ids = append(ids, entry.Resource.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *TerminologySuite) TestTokenSearchModifiers(c *C) {
+	for id, code := range map[string]string{"o-dog": "dog", "o-whale": "whale", "o-parrot": "parrot", "o-bird": "bird"} {
+		w := serve(s.server, "PUT", "/Observation/"+id, `{
+			"resourceType": "Observation",
+			"status": "final",
+			"code": { "coding": [ { "system": "http://example.org/animals", "code": "`+code+`" } ] }
+		}`)
+		c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+	}
+	w := serve(s.server, "PUT", "/Observation/o-other", `{
+		"resourceType": "Observation",
+		"status": "final",
+		"code": { "coding": [ { "system": "http://example.org/other", "code": "dog" } ] }
+	}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	c.Assert(s.searchIDs(c, "/Observation?code:in=http://example.org/pets"), DeepEquals, []string{"o-dog", "o-parrot"})
+	c.Assert(s.searchIDs(c, "/Observation?code:not-in=http://example.org/pets"), DeepEquals, []string{"o-bird", "o-other", "o-whale"})
+	c.Assert(s.searchIDs(c, "/Observation?code:below=http://example.org/animals|bird"), DeepEquals, []string{"o-bird", "o-parrot"})
+	c.Assert(s.searchIDs(c, "/Observation?code:above=http://example.org/animals|parrot"), DeepEquals, []string{"o-bird", "o-parrot"})
+	c.Assert(s.searchIDs(c, "/Observation?code:in=http://example.org/pets&code:below=http://example.org/animals|bird"), DeepEquals, []string{"o-parrot"})
+
+	// the cached expansion is forgotten when the value set changes
+	w = serve(s.server, "PUT", "/ValueSet/pets", `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/pets",
+		"status": "active",
+		"compose": { "include": [ { "system": "http://example.org/animals", "concept": [ { "code": "whale" } ] } ] }
+	}`)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	c.Assert(s.searchIDs(c, "/Observation?code:in=http://example.org/pets"), DeepEquals, []string{"o-whale"})
+}
+
+func (s *TerminologySuite) TestTokenSearchModifierErrors(c *C) {
+	w := serve(s.server, "GET", "/Observation?code:in=http://example.org/nothing", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(outcomeOf(c, w).Issue[0].Details.Text, Equals, "Parameter \"code\": The value set http://example.org/nothing wasn't found")
+
+	w = serve(s.server, "GET", "/Observation?code:below=dog", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	w = serve(s.server, "GET", "/Observation?code:below=http://snomed.info/sct|73211009", "")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(outcomeOf(c, w).Issue[0].Details.Text, Equals, "Parameter \"code\": The code system http://snomed.info/sct wasn't found")
+
+	w = serve(s.server, "GET", "/Observation?identifier:in=http://example.org/pets", "")
+	c.Assert(w.Code, Equals, http.StatusNotImplemented)
+}
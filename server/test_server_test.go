@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newMemoryTestServer creates a server that stores resources in memory, for testing its routes.
+// configure can change the default configuration (e.g. to enable a feature) and the middleware
+// runs before the routes' handlers (e.g. to set what the auth middleware would).
+func newMemoryTestServer(configure func(config *Config), middleware ...gin.HandlerFunc) *FHIRServer {
+	gin.SetMode(gin.ReleaseMode)
+	config := DefaultConfig
+	config.DatabaseBackend = DatabaseBackendMemory
+	config.DefaultDatabaseName = "fhir"
+	if configure != nil {
+		configure(&config)
+	}
+	server := NewServer(config)
+	server.Engine.Use(middleware...)
+	server.InitEngine()
+	return server
+}
+
+// serve handles a request with a FHIR JSON body and the headers given as pairs of names and values
+func serve(server *FHIRServer, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/fhir+json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	server.Engine.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/eug48/fhir/validation"
+)
+
+// ErrValidationFailed indicates that a resource has errors found by the built-in or the external validator (HTTP 422)
+type ErrValidationFailed struct {
+	Outcome *models.OperationOutcome
+}
+
+func (e ErrValidationFailed) Error() string {
+	return e.Outcome.Error()
+}
+
+// ResourceValidator validates resources against the StructureDefinitions in Config.ValidationDefinitions
+// and the profiles, value sets and code systems stored in the server.
+type ResourceValidator struct {
+	validator *validation.Validator
+}
+
+// NewResourceValidator loads the definitions in the server's configuration, panicking if they can't be loaded.
+// Without any definitions resources are checked against the base definitions built into the models2 package.
+func NewResourceValidator(config Config) *ResourceValidator {
+	definitions := validation.NewDefinitions()
+	for _, path := range config.ValidationDefinitions {
+		if err := definitions.Load(path); err != nil {
+			panic(errors.Wrap(err, "NewResourceValidator"))
+		}
+	}
+	if len(config.ValidationDefinitions) > 0 {
+		glog.Infof("validation: loaded %d StructureDefinitions", definitions.Count())
+	}
+	return &ResourceValidator{validator: validation.NewValidator(definitions)}
+}
+
+// Validate checks a resource against its base definition, the profiles in its meta.profile and the ones passed in,
+// looking up other conformance resources in the session. The outcome has an issue for each problem found,
+// or a single informational one if there weren't any.
+func (v *ResourceValidator) Validate(session DataAccessSession, resourceJSON []byte, profiles []string) (outcome *models.OperationOutcome, valid bool, err error) {
+	issues, err := v.validator.Validate(resourceJSON, profiles, sessionSource{session})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Validate")
+	}
+
+	outcome = &models.OperationOutcome{}
+	valid = true
+	for _, issue := range issues {
+		component := models.OperationOutcomeIssueComponent{
+			Severity:    issue.Severity,
+			Code:        issue.Code,
+			Diagnostics: issue.Message,
+		}
+		if issue.Location != "" {
+			component.Location = []string{issue.Location}
+			component.Expression = []string{issue.Location}
+		}
+		outcome.Issue = append(outcome.Issue, component)
+		if issue.Severity == "error" || issue.Severity == "fatal" {
+			valid = false
+		}
+	}
+	if len(outcome.Issue) == 0 {
+		outcome.Issue = append(outcome.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "information",
+			Code:        "informational",
+			Diagnostics: "No issues detected during validation",
+		})
+	}
+	return outcome, valid, nil
+}
+
+// sessionSource finds the conformance resources stored in the server by their canonical URLs
+type sessionSource struct {
+	session DataAccessSession
+}
+
+func (s sessionSource) Find(resourceType string, canonicalURL string) ([]byte, error) {
+	ids, err := s.session.FindIDs(search.Query{Resource: resourceType, Query: "url=" + url.QueryEscape(canonicalURL)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to search for %s %s", resourceType, canonicalURL)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	resource, err := s.session.Get(ids[0], resourceType)
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s", resourceType, canonicalURL)
+	}
+	return resource.JsonBytes(), nil
+}
+
+// validatingDataAccessLayer rejects resources with validation errors before they're stored
+type validatingDataAccessLayer struct {
+	DataAccessLayer
+	validator *ResourceValidator
+}
+
+func newValidatingDataAccessLayer(dal DataAccessLayer, validator *ResourceValidator) DataAccessLayer {
+	return &validatingDataAccessLayer{DataAccessLayer: dal, validator: validator}
+}
+
+func (dal *validatingDataAccessLayer) StartSession(ctx context.Context, dbname string) DataAccessSession {
+	return &validatingDataAccessSession{
+		DataAccessSession: dal.DataAccessLayer.StartSession(ctx, dbname),
+		validator:         dal.validator,
+	}
+}
+
+type validatingDataAccessSession struct {
+	DataAccessSession
+	validator *ResourceValidator
+}
+
+func (s *validatingDataAccessSession) validate(resource *models2.Resource) error {
+	outcome, valid, err := s.validator.Validate(s.DataAccessSession, resource.JsonBytes(), nil)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrValidationFailed{Outcome: outcome}
+	}
+	return nil
+}
+
+func (s *validatingDataAccessSession) Post(resource *models2.Resource) (id string, err error) {
+	if err = s.validate(resource); err != nil {
+		return "", err
+	}
+	return s.DataAccessSession.Post(resource)
+}
+
+func (s *validatingDataAccessSession) ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error) {
+	if err = s.validate(resource); err != nil {
+		return 0, "", nil, err
+	}
+	return s.DataAccessSession.ConditionalPost(query, resource)
+}
+
+func (s *validatingDataAccessSession) PostWithID(id string, resource *models2.Resource) error {
+	if err := s.validate(resource); err != nil {
+		return err
+	}
+	return s.DataAccessSession.PostWithID(id, resource)
+}
+
+func (s *validatingDataAccessSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
+	if err = s.validate(resource); err != nil {
+		return false, err
+	}
+	return s.DataAccessSession.Put(id, conditionalVersionId, resource)
+}
+
+func (s *validatingDataAccessSession) ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error) {
+	if err = s.validate(resource); err != nil {
+		return "", false, err
+	}
+	return s.DataAccessSession.ConditionalPut(query, conditionalVersionId, resource)
+}
+
+// ValidateHandler handles the type-level $validate operation (POST [type]/$validate)
+func (rc *ResourceController) ValidateHandler(c *gin.Context) {
+	rc.validate(c, "")
+}
+
+// ValidateInstanceHandler handles $validate for an existing resource (POST [type]/[id]/$validate),
+// which validates the stored resource if no resource is sent
+func (rc *ResourceController) ValidateInstanceHandler(c *gin.Context) {
+	rc.validate(c, c.Param("id"))
+}
+
+func (rc *ResourceController) validate(c *gin.Context, id string) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	var resourceJSON []byte
+	mode := c.Query("mode")
+	profiles := c.QueryArray("profile")
+
+	if c.Request.ContentLength != 0 {
+		// any external validator is used when writing resources, not by this operation
+		body, err := FHIRBind(c, "")
+		if err != nil {
+			statusCode, oo := bindFailure(err)
+			c.Render(statusCode, CustomFhirRenderer{oo, c})
+			return
+		}
+		if body.ResourceType() == "Parameters" && rc.Name != "Parameters" {
+			var parameters validateParameters
+			if err = json.Unmarshal(body.JsonBytes(), &parameters); err != nil {
+				oo := models.NewOperationOutcome("fatal", "structure", "invalid Parameters: "+err.Error())
+				c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+				return
+			}
+			for _, parameter := range parameters.Parameter {
+				switch parameter.Name {
+				case "resource":
+					resourceJSON = parameter.Resource
+				case "profile":
+					profiles = append(profiles, parameter.ValueURI)
+				case "mode":
+					mode = parameter.ValueCode
+				}
+			}
+		} else {
+			resourceJSON = body.JsonBytes()
+		}
+	}
+
+	if id != "" && (resourceJSON == nil || mode == "delete") {
+		stored, err := session.Get(id, rc.Name)
+		if err != nil {
+			panic(errors.Wrap(err, "validate: Get failed"))
+		}
+		if mode == "delete" {
+			// nothing prevents deleting resources
+			c.Render(http.StatusOK, CustomFhirRenderer{models.NewOperationOutcome("information", "informational", "No issues detected during validation"), c})
+			return
+		}
+		resourceJSON = stored.JsonBytes()
+	}
+	if resourceJSON == nil {
+		oo := models.NewOperationOutcome("error", "required", "No resource to validate")
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(resourceJSON, &header); err == nil && header.ResourceType != rc.Name {
+		oo := models.NewOperationOutcome("error", "invalid", "Expected a "+rc.Name+" resource but got "+header.ResourceType)
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	outcome, _, err := rc.Validator.Validate(session, resourceJSON, profiles)
+	if err != nil {
+		panic(err)
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{outcome, c})
+}
+
+// validateParameters are the parameters of the $validate operation
+type validateParameters struct {
+	Parameter []struct {
+		Name      string          `json:"name"`
+		Resource  json.RawMessage `json:"resource"`
+		ValueURI  string          `json:"valueUri"`
+		ValueCode string          `json:"valueCode"`
+	} `json:"parameter"`
+}
+
+// validatorResponseFailure checks the OperationOutcome returned by an external validator
+func validatorResponseFailure(statusCode int, body []byte) error {
+	var outcome models.OperationOutcome
+	if err := json.Unmarshal(body, &outcome); err != nil || len(outcome.Issue) == 0 {
+		if statusCode >= 200 && statusCode < 300 {
+			return nil
+		}
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(statusCode)
+		}
+		return ErrValidationFailed{Outcome: models.NewOperationOutcome("error", "invalid", "the validator rejected the resource: "+message)}
+	}
+
+	for _, issue := range outcome.Issue {
+		if issue.Severity == "error" || issue.Severity == "fatal" {
+			return ErrValidationFailed{Outcome: &outcome}
+		}
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return ErrValidationFailed{Outcome: &outcome}
+	}
+	return nil
+}
+
+// bindFailure returns the response to a request whose resource couldn't be read or is invalid
+func bindFailure(err error) (statusCode int, outcome *models.OperationOutcome) {
+	if failed, isValidationFailure := errors.Cause(err).(ErrValidationFailed); isValidationFailure {
+		return http.StatusUnprocessableEntity, failed.Outcome
+	}
+	return http.StatusBadRequest, models.NewOperationOutcome("fatal", "structure", err.Error())
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/eug48/fhir/models"
+)
+
+type ValidationSuite struct {
+	server *FHIRServer
+}
+
+var _ = Suite(&ValidationSuite{})
+
+func (s *ValidationSuite) startServer(configure func(config *Config)) {
+	s.server = newMemoryTestServer(configure)
+}
+
+func outcomeOf(c *C, w *httptest.ResponseRecorder) *models.OperationOutcome {
+	var outcome models.OperationOutcome
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &outcome), IsNil, Commentf("%s", w.Body.String()))
+	return &outcome
+}
+
+const activePatientProfile = `{
+	"resourceType": "StructureDefinition",
+	"url": "http://example.org/active-patient",
+	"name": "ActivePatient",
+	"status": "active",
+	"kind": "resource",
+	"abstract": false,
+	"type": "Patient",
+	"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Patient",
+	"derivation": "constraint",
+	"snapshot": { "element": [
+		{ "id": "Patient", "path": "Patient", "min": 0, "max": "*" },
+		{ "id": "Patient.active", "path": "Patient.active", "min": 1, "max": "1", "type": [{ "code": "boolean" }] }
+	] }
+}`
+
+func (s *ValidationSuite) TestValidate(c *C) {
+	s.startServer(nil)
+
+	w := serve(s.server, "POST", "/Patient/$validate", `{"resourceType": "Patient", "active": true}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	outcome := outcomeOf(c, w)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+
+	w = serve(s.server, "POST", "/Patient/$validate", `{"resourceType": "Patient", "active": "yes", "birthDate": "1999-02-30T"}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	outcome = outcomeOf(c, w)
+	c.Assert(outcome.Issue, HasLen, 2)
+	c.Assert(outcome.Issue[0].Severity, Equals, "error")
+	c.Assert(outcome.Issue[0].Location, DeepEquals, []string{"Patient.active"})
+	c.Assert(outcome.Issue[0].Expression, DeepEquals, []string{"Patient.active"})
+	c.Assert(outcome.Issue[1].Location, DeepEquals, []string{"Patient.birthDate"})
+
+	// the resource in Parameters
+	w = serve(s.server, "POST", "/Patient/$validate", `{"resourceType": "Parameters", "parameter": [
+		{ "name": "resource", "resource": {"resourceType": "Patient", "active": 1} }
+	]}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(outcomeOf(c, w).Issue[0].Location, DeepEquals, []string{"Patient.active"})
+
+	w = serve(s.server, "POST", "/Patient/$validate", `{"resourceType": "Observation", "status": "final"}`)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	// _search still works
+	w = serve(s.server, "POST", "/Patient/_search", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+}
+
+func (s *ValidationSuite) TestValidateInstance(c *C) {
+	s.startServer(nil)
+
+	w := serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "active": true}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	w = serve(s.server, "POST", "/Patient/123/$validate", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(outcomeOf(c, w).Issue[0].Severity, Equals, "information")
+
+	w = serve(s.server, "POST", "/Patient/123/$validate", `{"resourceType": "Patient", "active": "no"}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(outcomeOf(c, w).Issue[0].Severity, Equals, "error")
+
+	w = serve(s.server, "POST", "/Patient/456/$validate", "")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ValidationSuite) TestValidateStoredProfile(c *C) {
+	s.startServer(nil)
+
+	w := serve(s.server, "POST", "/StructureDefinition", activePatientProfile)
+	c.Assert(w.Code, Equals, http.StatusCreated, Commentf("%s", w.Body.String()))
+
+	w = serve(s.server, "POST", "/Patient/$validate?profile=http://example.org/active-patient", `{"resourceType": "Patient"}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	outcome := outcomeOf(c, w)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "required")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Patient.active: minimum required = 1, but only found 0")
+
+	w = serve(s.server, "POST", "/Patient/$validate", `{"resourceType": "Parameters", "parameter": [
+		{ "name": "resource", "resource": {"resourceType": "Patient", "active": false} },
+		{ "name": "profile", "valueUri": "http://example.org/active-patient" }
+	]}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(outcomeOf(c, w).Issue[0].Severity, Equals, "information")
+}
+
+func (s *ValidationSuite) TestValidateWrites(c *C) {
+	s.startServer(func(config *Config) {
+		config.ValidateWrites = true
+	})
+
+	w := serve(s.server, "POST", "/Patient", `{"resourceType": "Patient", "active": "yes"}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(outcomeOf(c, w).Issue[0].Location, DeepEquals, []string{"Patient.active"})
+
+	w = serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "active": "yes"}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	w = serve(s.server, "PUT", "/Patient/123", `{"resourceType": "Patient", "active": true}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	// the minimum cardinalities and required bindings of the specification are checked without loading it
+	w = serve(s.server, "POST", "/Observation", `{"resourceType": "Observation", "code": {"text": "Body weight"}}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(outcomeOf(c, w).Issue[0].Code, Equals, "required")
+	w = serve(s.server, "POST", "/Observation", `{"resourceType": "Observation", "status": "bogus", "code": {"text": "Body weight"}}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(outcomeOf(c, w).Issue[0].Location, DeepEquals, []string{"Observation.status"})
+	w = serve(s.server, "POST", "/Observation", `{"resourceType": "Observation", "status": "final", "code": {"text": "Body weight"}}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+
+	w = serve(s.server, "POST", "/", `{"resourceType": "Bundle", "type": "batch", "entry": [
+		{ "resource": {"resourceType": "Patient", "active": 1}, "request": { "method": "POST", "url": "Patient" } }
+	]}`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), `"status":"422"`), Equals, true, Commentf("%s", w.Body.String()))
+}
+
+func (s *ValidationSuite) TestExternalValidator(c *C) {
+	var received string
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/fhir+json")
+		if strings.Contains(received, "female") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "invalid", "diagnostics": "no"}]}`))
+		} else {
+			w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "information", "code": "informational"}]}`))
+		}
+	}))
+	defer validator.Close()
+
+	s.startServer(func(config *Config) {
+		config.ValidatorURL = validator.URL
+	})
+
+	w := serve(s.server, "POST", "/Patient", `{"resourceType": "Patient", "gender": "male"}`)
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(strings.Contains(received, "male"), Equals, true)
+
+	w = serve(s.server, "POST", "/Patient", `{"resourceType": "Patient", "gender": "female"}`)
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(outcomeOf(c, w).Issue[0].Diagnostics, Equals, "no")
+}
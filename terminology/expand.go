@@ -0,0 +1,376 @@
+package terminology
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// ExpandOptions are the optional parameters of $expand
+type ExpandOptions struct {
+	// Filter restricts the codes to those whose code or display contains each of its words, ignoring case
+	Filter string
+
+	// Offset and Count select a page of the codes, with a Count of 0 meaning all of the remaining ones
+	Offset int
+	Count  int
+}
+
+// Expansion is the result of $expand
+type Expansion struct {
+	// the number of codes that matched the filter, including the ones outside the page
+	Total    int
+	Offset   int
+	Contains []Concept
+}
+
+// Expand lists the codes in a value set
+func (s *Service) Expand(valueSet map[string]interface{}, options ExpandOptions) (*Expansion, error) {
+	concepts, err := s.concepts(valueSet)
+	if err != nil {
+		return nil, err
+	}
+
+	if words := strings.Fields(strings.ToLower(options.Filter)); len(words) > 0 {
+		var filtered []Concept
+		for _, c := range concepts {
+			if matchesWords(c, words) {
+				filtered = append(filtered, c)
+			}
+		}
+		concepts = filtered
+	}
+
+	expansion := &Expansion{Total: len(concepts), Offset: options.Offset}
+	if options.Offset < len(concepts) {
+		concepts = concepts[options.Offset:]
+		if options.Count > 0 && options.Count < len(concepts) {
+			concepts = concepts[:options.Count]
+		}
+		expansion.Contains = concepts
+	}
+	return expansion, nil
+}
+
+func matchesWords(c Concept, words []string) bool {
+	code := strings.ToLower(c.Code)
+	display := strings.ToLower(c.Display)
+	for _, word := range words {
+		if !strings.Contains(display, word) && !strings.Contains(code, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// conceptSet is an ordered set of concepts
+type conceptSet struct {
+	concepts []Concept
+	index    map[string]int
+}
+
+func conceptKey(system string, code string) string {
+	return system + "|" + code
+}
+
+func (set *conceptSet) add(c Concept) {
+	if set.index == nil {
+		set.index = make(map[string]int)
+	}
+	if _, exists := set.index[conceptKey(c.System, c.Code)]; !exists {
+		set.index[conceptKey(c.System, c.Code)] = len(set.concepts)
+		set.concepts = append(set.concepts, c)
+	}
+}
+
+func (set *conceptSet) contains(c Concept) bool {
+	_, exists := set.index[conceptKey(c.System, c.Code)]
+	return exists
+}
+
+// concepts returns all the codes in a value set
+func (s *Service) concepts(valueSet map[string]interface{}) ([]Concept, error) {
+	url := stringAt(valueSet, "url")
+	if url != "" {
+		if s.expanding[url] {
+			return nil, newError("not-supported", "The value set %s includes itself", url)
+		}
+		s.expanding[url] = true
+		defer delete(s.expanding, url)
+	}
+	name := url
+	if name == "" {
+		name = "the value set"
+	}
+
+	if expansion, isObject := valueSet["expansion"].(map[string]interface{}); isObject {
+		var set conceptSet
+		var addContains func(contains []interface{})
+		addContains = func(contains []interface{}) {
+			for _, c := range contains {
+				c, _ := c.(map[string]interface{})
+				if code := stringAt(c, "code"); code != "" {
+					set.add(Concept{System: stringAt(c, "system"), Version: stringAt(c, "version"), Code: code, Display: stringAt(c, "display")})
+				}
+				addContains(arrayAt(c, "contains"))
+			}
+		}
+		addContains(arrayAt(expansion, "contains"))
+		return set.concepts, nil
+	}
+
+	compose, isObject := valueSet["compose"].(map[string]interface{})
+	if !isObject {
+		return nil, newError("not-supported", "%s has neither a compose nor an expansion", name)
+	}
+	var included conceptSet
+	for _, include := range arrayAt(compose, "include") {
+		include, _ := include.(map[string]interface{})
+		concepts, err := s.component(include)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range concepts {
+			included.add(c)
+		}
+	}
+	var excluded conceptSet
+	for _, exclude := range arrayAt(compose, "exclude") {
+		exclude, _ := exclude.(map[string]interface{})
+		concepts, err := s.component(exclude)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range concepts {
+			excluded.add(c)
+		}
+	}
+
+	var concepts []Concept
+	for _, c := range included.concepts {
+		if !excluded.contains(c) {
+			concepts = append(concepts, c)
+		}
+	}
+	return concepts, nil
+}
+
+// component returns the codes of an include or exclude of a value set's compose: those from its system
+// (which may be restricted by concepts and filters) that are also in all of its value sets
+func (s *Service) component(component map[string]interface{}) ([]Concept, error) {
+	var concepts []Concept
+	hasConcepts := false
+
+	if system := stringAt(component, "system"); system != "" {
+		var err error
+		concepts, err = s.systemConcepts(system, component)
+		if err != nil {
+			return nil, err
+		}
+		hasConcepts = true
+	}
+
+	var valueSets []string
+	switch valueSet := component["valueSet"].(type) {
+	case string:
+		valueSets = append(valueSets, valueSet)
+	case []interface{}:
+		for _, v := range valueSet {
+			if v, isString := v.(string); isString {
+				valueSets = append(valueSets, v)
+			}
+		}
+	}
+	for _, url := range valueSets {
+		valueSet, err := s.FindValueSet(url)
+		if err != nil {
+			return nil, err
+		}
+		included, err := s.concepts(valueSet)
+		if err != nil {
+			return nil, err
+		}
+		if !hasConcepts {
+			concepts, hasConcepts = included, true
+			continue
+		}
+		var set conceptSet
+		for _, c := range included {
+			set.add(c)
+		}
+		var intersection []Concept
+		for _, c := range concepts {
+			if set.contains(c) {
+				intersection = append(intersection, c)
+			}
+		}
+		concepts = intersection
+	}
+
+	if !hasConcepts {
+		return nil, newError("invalid", "Value set includes and excludes need a system or a valueSet")
+	}
+	return concepts, nil
+}
+
+// systemConcepts returns the concepts of a code system that are listed in an include or exclude
+// or match its filters, or all of them
+func (s *Service) systemConcepts(system string, component map[string]interface{}) ([]Concept, error) {
+	cs, err := s.codeSystem(system)
+	if err != nil {
+		return nil, err
+	}
+	version := stringAt(component, "version")
+	if version == "" && cs != nil {
+		version = cs.version
+	}
+
+	listed := arrayAt(component, "concept")
+	filters := arrayAt(component, "filter")
+
+	var candidates []*concept
+	displays := make(map[string]string)
+	if len(listed) > 0 {
+		// the codes don't need to be in the CodeSystem (or for there to be one) unless there are filters too
+		for _, c := range listed {
+			c, _ := c.(map[string]interface{})
+			code := stringAt(c, "code")
+			if code == "" {
+				continue
+			}
+			displays[code] = stringAt(c, "display")
+			if cs != nil && cs.byCode[code] != nil {
+				candidates = append(candidates, cs.byCode[code])
+			} else {
+				candidates = append(candidates, &concept{code: code})
+			}
+		}
+	} else {
+		if cs == nil {
+			return nil, newError("not-found", "The code system %s wasn't found", system)
+		}
+		if !cs.complete {
+			return nil, newError("not-supported", "The code system %s can't be expanded as its CodeSystem resource doesn't have all of its concepts", system)
+		}
+		candidates = cs.concepts
+	}
+
+	if len(filters) > 0 && cs == nil {
+		return nil, newError("not-found", "The code system %s wasn't found", system)
+	}
+	for _, f := range filters {
+		f, _ := f.(map[string]interface{})
+		candidates, err = cs.filter(candidates, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var concepts []Concept
+	for _, c := range candidates {
+		display := displays[c.code]
+		if display == "" {
+			display = c.display
+		}
+		concepts = append(concepts, Concept{System: system, Version: version, Code: c.code, Display: display})
+	}
+	return concepts, nil
+}
+
+// filter returns the concepts that match a filter of a value set's include or exclude
+func (cs *codeSystem) filter(candidates []*concept, f map[string]interface{}) ([]*concept, error) {
+	property, op, value := stringAt(f, "property"), stringAt(f, "op"), stringAt(f, "value")
+
+	var match func(c *concept) bool
+	switch op {
+	case "is-a", "descendent-of", "is-not-a":
+		descendants := cs.descendants(value)
+		match = func(c *concept) bool {
+			isA := descendants[c.code] || (op != "descendent-of" && c.code == value)
+			return isA != (op == "is-not-a")
+		}
+	case "generalizes":
+		ancestors := cs.ancestors(value)
+		match = func(c *concept) bool {
+			return c.code == value || ancestors[c.code]
+		}
+	case "=", "in":
+		values := []string{value}
+		if op == "in" {
+			values = strings.Split(value, ",")
+		}
+		match = func(c *concept) bool {
+			for _, v := range c.propertyValues(property) {
+				for _, wanted := range values {
+					if v == strings.TrimSpace(wanted) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	case "regex":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, newError("invalid", "Invalid regex filter %s: %s", value, err)
+		}
+		match = func(c *concept) bool {
+			for _, v := range c.propertyValues(property) {
+				if re.MatchString(v) {
+					return true
+				}
+			}
+			return false
+		}
+	case "exists":
+		match = func(c *concept) bool {
+			return (len(c.propertyValues(property)) > 0) == (value == "true")
+		}
+	default:
+		return nil, newError("not-supported", "The filter operator %s isn't supported", op)
+	}
+
+	var matches []*concept
+	for _, c := range candidates {
+		if match(c) {
+			matches = append(matches, c)
+		}
+	}
+	return matches, nil
+}
+
+// propertyValues returns the values of a concept's property as strings, where code (or concept) and display
+// are the concept's own
+func (c *concept) propertyValues(code string) []string {
+	switch code {
+	case "code", "concept":
+		return []string{c.code}
+	case "display":
+		if c.display == "" {
+			return nil
+		}
+		return []string{c.display}
+	}
+	var values []string
+	for _, p := range c.properties {
+		if p.code != code {
+			continue
+		}
+		switch value := p.value.(type) {
+		case string:
+			values = append(values, value)
+		case bool:
+			if value {
+				values = append(values, "true")
+			} else {
+				values = append(values, "false")
+			}
+		case json.Number:
+			values = append(values, value.String())
+		case map[string]interface{}:
+			// a Coding
+			values = append(values, stringAt(value, "code"))
+		}
+	}
+	return values
+}
@@ -0,0 +1,152 @@
+package terminology
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Coding is a code to validate, whose system and display are optional
+type Coding struct {
+	System  string
+	Code    string
+	Display string
+}
+
+func (c Coding) String() string {
+	if c.System == "" {
+		return c.Code
+	}
+	return c.System + "|" + c.Code
+}
+
+// CodeValidation is the result of $validate-code
+type CodeValidation struct {
+	Result bool
+
+	// why the code isn't valid
+	Message string
+
+	// the display of the code that was found
+	Display string
+}
+
+// ValidateCode checks whether any of the codings (e.g. of a CodeableConcept) is in a value set. Codings without
+// a system match codes from any system. A coding with a display that doesn't match its code's isn't valid.
+func (s *Service) ValidateCode(valueSet map[string]interface{}, codings []Coding) (*CodeValidation, error) {
+	concepts, err := s.concepts(valueSet)
+	if err != nil {
+		return nil, err
+	}
+	name := stringAt(valueSet, "url")
+	if name == "" {
+		name = "the value set"
+	}
+
+	var messages []string
+	for _, coding := range codings {
+		found := false
+		for _, c := range concepts {
+			if c.Code != coding.Code || (coding.System != "" && c.System != coding.System) {
+				continue
+			}
+			found = true
+			if coding.Display == "" || c.Display == "" || strings.EqualFold(coding.Display, c.Display) {
+				return &CodeValidation{Result: true, Display: c.Display}, nil
+			}
+			messages = append(messages, fmt.Sprintf("The display '%s' for %s should be '%s'", coding.Display, coding, c.Display))
+			break
+		}
+		if !found {
+			messages = append(messages, fmt.Sprintf("The code %s isn't in %s", coding, name))
+		}
+	}
+	if len(codings) == 0 {
+		messages = append(messages, "No code to validate")
+	}
+	return &CodeValidation{Result: false, Message: strings.Join(messages, "; ")}, nil
+}
+
+// ValidateCodeInCodeSystem checks whether a code is defined by a code system
+func (s *Service) ValidateCodeInCodeSystem(system string, coding Coding) (*CodeValidation, error) {
+	cs, err := s.codeSystem(system)
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return nil, newError("not-found", "The code system %s wasn't found", system)
+	}
+	c := cs.byCode[coding.Code]
+	if c == nil {
+		if !cs.complete {
+			return nil, newError("not-supported", "The code system %s can't be checked as its CodeSystem resource doesn't have all of its concepts", system)
+		}
+		return &CodeValidation{Result: false, Message: fmt.Sprintf("The code %s isn't in the code system %s", coding.Code, system)}, nil
+	}
+	if coding.Display != "" && c.display != "" && !strings.EqualFold(coding.Display, c.display) {
+		return &CodeValidation{Result: false, Display: c.display,
+			Message: fmt.Sprintf("The display '%s' for %s|%s should be '%s'", coding.Display, system, coding.Code, c.display)}, nil
+	}
+	return &CodeValidation{Result: true, Display: c.display}, nil
+}
+
+// LookupResult is the result of $lookup
+type LookupResult struct {
+	// the name and version of the code system
+	Name    string
+	Version string
+
+	Display      string
+	Definition   string
+	Designations []Designation
+
+	// the concept's properties, including its parents and children in the hierarchy
+	Properties []Property
+}
+
+// Property is a property of a concept, whose value is a JSON value for the element named ValueName (e.g. valueCode)
+type Property struct {
+	Code      string
+	ValueName string
+	Value     interface{}
+}
+
+// Lookup returns the details of a code in a code system
+func (s *Service) Lookup(system string, code string) (*LookupResult, error) {
+	cs, err := s.codeSystem(system)
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return nil, newError("not-found", "The code system %s wasn't found", system)
+	}
+	c := cs.byCode[code]
+	if c == nil {
+		return nil, newError("not-found", "The code %s isn't in the code system %s", code, system)
+	}
+
+	result := &LookupResult{
+		Name:         cs.name,
+		Version:      cs.version,
+		Display:      c.display,
+		Definition:   c.definition,
+		Designations: c.designations,
+	}
+	hasProperty := make(map[string]bool)
+	for _, p := range c.properties {
+		result.Properties = append(result.Properties, Property{Code: p.code, ValueName: p.name, Value: p.value})
+		if value, isString := p.value.(string); isString {
+			hasProperty[p.code+"|"+value] = true
+		}
+	}
+	for _, parent := range c.parents {
+		if !hasProperty["parent|"+parent] {
+			result.Properties = append(result.Properties, Property{Code: "parent", ValueName: "valueCode", Value: parent})
+		}
+	}
+	for _, child := range c.children {
+		if !hasProperty["child|"+child] {
+			result.Properties = append(result.Properties, Property{Code: "child", ValueName: "valueCode", Value: child})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,284 @@
+// Package terminology implements the terminology operations ValueSet $expand, $validate-code and
+// CodeSystem $lookup over CodeSystem and ValueSet resources, such as the ones stored in the server.
+//
+// Value sets are expanded from their compose (include and exclude, with explicit concepts, whole code systems,
+// other value sets and the hierarchical filters is-a, descendent-of, is-not-a and generalizes as well as =, in,
+// regex and exists on properties) or from an expansion they already contain. Code systems whose concepts aren't
+// all in their CodeSystem resource (e.g. SNOMED CT) can only be used with explicit lists of concepts.
+package terminology
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Source provides the CodeSystems and ValueSets used by the operations
+type Source interface {
+	// Find returns the JSON of the ValueSet or CodeSystem with a canonical URL, or nil if there isn't one
+	Find(resourceType string, url string) (resourceJSON []byte, err error)
+}
+
+// Error is a problem with the parameters of an operation or the resources it uses,
+// as opposed to failures of the Source
+type Error struct {
+	// the code of an OperationOutcome issue: not-found, not-supported, invalid or too-costly
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code string, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Concept is a code from a code system
+type Concept struct {
+	System  string
+	Version string
+	Code    string
+	Display string
+}
+
+// Service performs terminology operations with the resources of a Source. It keeps the resources it has found,
+// so a Service should only be used for a single request (and by one goroutine).
+type Service struct {
+	source      Source
+	resources   map[string]map[string]interface{} // by resource type and URL
+	codeSystems map[string]*codeSystem
+	expanding   map[string]bool // for detecting value sets that include themselves
+}
+
+// NewService creates a Service for a Source
+func NewService(source Source) *Service {
+	return &Service{
+		source:      source,
+		resources:   make(map[string]map[string]interface{}),
+		codeSystems: make(map[string]*codeSystem),
+		expanding:   make(map[string]bool),
+	}
+}
+
+// find returns the ValueSet or CodeSystem with a canonical URL (optionally followed by |version), or nil
+func (s *Service) find(resourceType string, url string) (map[string]interface{}, error) {
+	if bar := strings.Index(url, "|"); bar >= 0 {
+		url = url[:bar]
+	}
+	key := resourceType + " " + url
+	if resource, found := s.resources[key]; found {
+		return resource, nil
+	}
+	resourceJSON, err := s.source.Find(resourceType, url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find %s %s", resourceType, url)
+	}
+	var resource map[string]interface{}
+	if resourceJSON != nil {
+		if resource, err = DecodeResource(resourceJSON); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %s", resourceType, url)
+		}
+	}
+	s.resources[key] = resource
+	return resource, nil
+}
+
+// DecodeResource decodes the JSON of a ValueSet or CodeSystem for Expand and ValidateCode
+func DecodeResource(resourceJSON []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(resourceJSON))
+	decoder.UseNumber()
+	var resource map[string]interface{}
+	if err := decoder.Decode(&resource); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JSON")
+	}
+	return resource, nil
+}
+
+// FindValueSet returns the ValueSet with a canonical URL, or an *Error if there isn't one
+func (s *Service) FindValueSet(url string) (map[string]interface{}, error) {
+	valueSet, err := s.find("ValueSet", url)
+	if err != nil {
+		return nil, err
+	}
+	if valueSet == nil {
+		return nil, newError("not-found", "The value set %s wasn't found", url)
+	}
+	return valueSet, nil
+}
+
+// codeSystem is a CodeSystem with its concepts indexed by code
+type codeSystem struct {
+	url      string
+	name     string
+	version  string
+	complete bool // whether all its concepts are in the resource
+	concepts []*concept
+	byCode   map[string]*concept
+}
+
+type concept struct {
+	code         string
+	display      string
+	definition   string
+	parents      []string
+	children     []string
+	properties   []property
+	designations []Designation
+}
+
+type property struct {
+	code  string
+	name  string // the name of the value[x] element, e.g. valueCode
+	value interface{}
+}
+
+// Designation is an additional representation of a concept, e.g. in another language
+type Designation struct {
+	Language string
+	Use      map[string]interface{} // a Coding
+	Value    string
+}
+
+// codeSystem returns the indexed CodeSystem with a URL, or nil if there isn't one
+func (s *Service) codeSystem(url string) (*codeSystem, error) {
+	if cs, found := s.codeSystems[url]; found {
+		return cs, nil
+	}
+	resource, err := s.find("CodeSystem", url)
+	if err != nil || resource == nil {
+		s.codeSystems[url] = nil
+		return nil, err
+	}
+
+	cs := &codeSystem{
+		url:      url,
+		name:     stringAt(resource, "name"),
+		version:  stringAt(resource, "version"),
+		complete: stringAt(resource, "content") == "" || stringAt(resource, "content") == "complete",
+		byCode:   make(map[string]*concept),
+	}
+	var addConcepts func(concepts []interface{}, parent string)
+	addConcepts = func(concepts []interface{}, parent string) {
+		for _, c := range concepts {
+			object, _ := c.(map[string]interface{})
+			code := stringAt(object, "code")
+			if code == "" {
+				continue
+			}
+			con := cs.byCode[code]
+			if con == nil {
+				con = &concept{code: code, display: stringAt(object, "display"), definition: stringAt(object, "definition")}
+				cs.byCode[code] = con
+				cs.concepts = append(cs.concepts, con)
+				for _, p := range arrayAt(object, "property") {
+					p, _ := p.(map[string]interface{})
+					for key, value := range p {
+						if strings.HasPrefix(key, "value") {
+							con.properties = append(con.properties, property{code: stringAt(p, "code"), name: key, value: value})
+						}
+					}
+				}
+				for _, d := range arrayAt(object, "designation") {
+					d, _ := d.(map[string]interface{})
+					use, _ := d["use"].(map[string]interface{})
+					con.designations = append(con.designations, Designation{Language: stringAt(d, "language"), Use: use, Value: stringAt(d, "value")})
+				}
+			}
+			if parent != "" {
+				con.parents = appendUnique(con.parents, parent)
+			}
+			addConcepts(arrayAt(object, "concept"), code)
+		}
+	}
+	addConcepts(arrayAt(resource, "concept"), "")
+
+	// the hierarchy can also be given by parent and child properties
+	for _, con := range cs.concepts {
+		for _, p := range con.properties {
+			if code, isString := p.value.(string); isString {
+				switch p.code {
+				case "parent", "subsumedBy":
+					con.parents = appendUnique(con.parents, code)
+				case "child":
+					if child := cs.byCode[code]; child != nil {
+						child.parents = appendUnique(child.parents, con.code)
+					}
+				}
+			}
+		}
+	}
+	for _, con := range cs.concepts {
+		for _, parent := range con.parents {
+			if p := cs.byCode[parent]; p != nil {
+				p.children = appendUnique(p.children, con.code)
+			}
+		}
+	}
+
+	s.codeSystems[url] = cs
+	return cs, nil
+}
+
+// descendants returns the codes below a concept in the hierarchy
+func (cs *codeSystem) descendants(code string) map[string]bool {
+	found := make(map[string]bool)
+	var visit func(code string)
+	visit = func(code string) {
+		c := cs.byCode[code]
+		if c == nil {
+			return
+		}
+		for _, child := range c.children {
+			if !found[child] {
+				found[child] = true
+				visit(child)
+			}
+		}
+	}
+	visit(code)
+	return found
+}
+
+// ancestors returns the codes above a concept in the hierarchy
+func (cs *codeSystem) ancestors(code string) map[string]bool {
+	found := make(map[string]bool)
+	var visit func(code string)
+	visit = func(code string) {
+		c := cs.byCode[code]
+		if c == nil {
+			return
+		}
+		for _, parent := range c.parents {
+			if !found[parent] {
+				found[parent] = true
+				visit(parent)
+			}
+		}
+	}
+	visit(code)
+	return found
+}
+
+func stringAt(object map[string]interface{}, key string) string {
+	value, _ := object[key].(string)
+	return value
+}
+
+func arrayAt(object map[string]interface{}, key string) []interface{} {
+	array, _ := object[key].([]interface{})
+	return array
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,277 @@
+package terminology
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSource is a Source of resources by type and canonical URL
+type testSource map[string]string
+
+func (s testSource) Find(resourceType string, url string) ([]byte, error) {
+	if resourceJSON, found := s[resourceType+" "+url]; found {
+		return []byte(resourceJSON), nil
+	}
+	return nil, nil
+}
+
+type failingSource struct{}
+
+func (failingSource) Find(resourceType string, url string) ([]byte, error) {
+	return nil, errors.New("database is down")
+}
+
+var source = testSource{
+	"CodeSystem http://example.org/animals": `{
+		"resourceType": "CodeSystem",
+		"url": "http://example.org/animals",
+		"name": "Animals",
+		"version": "2",
+		"status": "active",
+		"content": "complete",
+		"hierarchyMeaning": "is-a",
+		"concept": [
+			{ "code": "animal", "display": "Animal", "concept": [
+				{ "code": "mammal", "display": "Mammal", "concept": [
+					{ "code": "dog", "display": "Dog", "property": [{ "code": "legs", "valueInteger": 4 }],
+						"designation": [{ "language": "de", "value": "Hund" }] },
+					{ "code": "cat", "display": "Cat", "property": [{ "code": "legs", "valueInteger": 4 }] },
+					{ "code": "human", "display": "Human", "property": [{ "code": "legs", "valueInteger": 2 }] }
+				] },
+				{ "code": "bird", "display": "Bird", "concept": [
+					{ "code": "sparrow", "display": "House sparrow", "property": [{ "code": "legs", "valueInteger": 2 }] }
+				] }
+			] },
+			{ "code": "platypus", "display": "Platypus", "property": [{ "code": "parent", "valueCode": "mammal" }] }
+		]
+	}`,
+	"CodeSystem http://snomed.info/sct": `{
+		"resourceType": "CodeSystem",
+		"url": "http://snomed.info/sct",
+		"status": "active",
+		"content": "not-present"
+	}`,
+	"ValueSet http://example.org/mammals": `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/mammals",
+		"status": "active",
+		"compose": {
+			"include": [{ "system": "http://example.org/animals", "filter": [{ "property": "concept", "op": "is-a", "value": "mammal" }] }],
+			"exclude": [{ "system": "http://example.org/animals", "concept": [{ "code": "human" }] }]
+		}
+	}`,
+	"ValueSet http://example.org/pets": `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/pets",
+		"status": "active",
+		"compose": {
+			"include": [
+				{ "system": "http://example.org/animals", "concept": [{ "code": "dog" }, { "code": "sparrow", "display": "Pet sparrow" }] },
+				{ "system": "http://snomed.info/sct", "concept": [{ "code": "387458008", "display": "Aspirin" }] }
+			]
+		}
+	}`,
+	"ValueSet http://example.org/mammal-pets": `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/mammal-pets",
+		"status": "active",
+		"compose": {
+			"include": [{ "valueSet": ["http://example.org/pets", "http://example.org/mammals"] }]
+		}
+	}`,
+	"ValueSet http://example.org/recursive": `{
+		"resourceType": "ValueSet",
+		"url": "http://example.org/recursive",
+		"status": "active",
+		"compose": { "include": [{ "valueSet": ["http://example.org/recursive"] }] }
+	}`,
+}
+
+func codesOf(concepts []Concept) []string {
+	var codes []string
+	for _, c := range concepts {
+		codes = append(codes, c.Code)
+	}
+	return codes
+}
+
+func expandURL(t *testing.T, url string, options ExpandOptions) *Expansion {
+	service := NewService(source)
+	valueSet, err := service.FindValueSet(url)
+	require.NoError(t, err)
+	expansion, err := service.Expand(valueSet, options)
+	require.NoError(t, err)
+	return expansion
+}
+
+func TestExpand(t *testing.T) {
+	expansion := expandURL(t, "http://example.org/mammals", ExpandOptions{})
+	assert.Equal(t, []string{"mammal", "dog", "cat", "platypus"}, codesOf(expansion.Contains))
+	assert.Equal(t, 4, expansion.Total)
+	assert.Equal(t, Concept{System: "http://example.org/animals", Version: "2", Code: "dog", Display: "Dog"}, expansion.Contains[1])
+
+	// displays in the include override the code system's
+	expansion = expandURL(t, "http://example.org/pets", ExpandOptions{})
+	assert.Equal(t, []string{"dog", "sparrow", "387458008"}, codesOf(expansion.Contains))
+	assert.Equal(t, "Pet sparrow", expansion.Contains[1].Display)
+	assert.Equal(t, "Aspirin", expansion.Contains[2].Display)
+
+	// value sets are intersected
+	expansion = expandURL(t, "http://example.org/mammal-pets", ExpandOptions{})
+	assert.Equal(t, []string{"dog"}, codesOf(expansion.Contains))
+
+	// the version of a canonical URL is ignored
+	expansion = expandURL(t, "http://example.org/pets|1.0", ExpandOptions{})
+	assert.Equal(t, 3, expansion.Total)
+}
+
+func TestExpandFilterAndPaging(t *testing.T) {
+	expansion := expandURL(t, "http://example.org/mammals", ExpandOptions{Filter: "a"})
+	assert.Equal(t, []string{"mammal", "cat", "platypus"}, codesOf(expansion.Contains))
+
+	expansion = expandURL(t, "http://example.org/pets", ExpandOptions{Filter: "PET spa"})
+	assert.Equal(t, []string{"sparrow"}, codesOf(expansion.Contains))
+
+	expansion = expandURL(t, "http://example.org/mammals", ExpandOptions{Offset: 1, Count: 2})
+	assert.Equal(t, []string{"dog", "cat"}, codesOf(expansion.Contains))
+	assert.Equal(t, 4, expansion.Total)
+	assert.Equal(t, 1, expansion.Offset)
+
+	expansion = expandURL(t, "http://example.org/mammals", ExpandOptions{Offset: 10})
+	assert.Empty(t, expansion.Contains)
+	assert.Equal(t, 4, expansion.Total)
+}
+
+func TestExpandFilters(t *testing.T) {
+	expand := func(filters string) []string {
+		valueSet, err := DecodeResource([]byte(`{
+			"resourceType": "ValueSet",
+			"compose": { "include": [{ "system": "http://example.org/animals", "filter": [` + filters + `] }] }
+		}`))
+		require.NoError(t, err)
+		expansion, err := NewService(source).Expand(valueSet, ExpandOptions{})
+		require.NoError(t, err)
+		return codesOf(expansion.Contains)
+	}
+
+	assert.Equal(t, []string{"dog", "cat", "human", "platypus"}, expand(`{ "property": "concept", "op": "descendent-of", "value": "mammal" }`))
+	assert.Equal(t, []string{"animal", "bird", "sparrow"}, expand(`{ "property": "concept", "op": "is-not-a", "value": "mammal" }`))
+	assert.Equal(t, []string{"animal", "mammal", "dog"}, expand(`{ "property": "concept", "op": "generalizes", "value": "dog" }`))
+	assert.Equal(t, []string{"human", "sparrow"}, expand(`{ "property": "legs", "op": "=", "value": "2" }`))
+	assert.Equal(t, []string{"human"}, expand(`{ "property": "legs", "op": "=", "value": "2" }, { "property": "concept", "op": "is-a", "value": "mammal" }`))
+	assert.Equal(t, []string{"dog", "cat"}, expand(`{ "property": "code", "op": "in", "value": "dog, cat, fish" }`))
+	assert.Equal(t, []string{"mammal", "cat", "platypus"}, expand(`{ "property": "code", "op": "regex", "value": "[a-z]*a[mt][a-z]*" }`))
+	assert.Equal(t, []string{"animal", "mammal", "bird", "platypus"}, expand(`{ "property": "legs", "op": "exists", "value": "false" }`))
+}
+
+func TestExpandErrors(t *testing.T) {
+	expandError := func(valueSetJSON string) *Error {
+		valueSet, err := DecodeResource([]byte(valueSetJSON))
+		require.NoError(t, err)
+		_, err = NewService(source).Expand(valueSet, ExpandOptions{})
+		require.Error(t, err)
+		terminologyError, isError := err.(*Error)
+		require.True(t, isError, "%v", err)
+		return terminologyError
+	}
+
+	assert.Equal(t, "not-found", expandError(`{ "compose": { "include": [{ "system": "http://example.org/unknown" }] } }`).Code)
+	assert.Equal(t, "not-found", expandError(`{ "compose": { "include": [{ "valueSet": ["http://example.org/unknown"] }] } }`).Code)
+	assert.Equal(t, "not-supported", expandError(`{ "compose": { "include": [{ "system": "http://snomed.info/sct" }] } }`).Code)
+	assert.Equal(t, "not-supported", expandError(`{ "url": "http://example.org/recursive", "compose": { "include": [{ "valueSet": ["http://example.org/recursive"] }] } }`).Code)
+	assert.Equal(t, "not-supported", expandError(`{ "compose": { "include": [{ "system": "http://example.org/animals", "filter": [{ "property": "concept", "op": "subsumes", "value": "dog" }] }] } }`).Code)
+	assert.Equal(t, "invalid", expandError(`{ "compose": { "include": [{ "concept": [{ "code": "dog" }] }] } }`).Code)
+	assert.Equal(t, "not-supported", expandError(`{ "resourceType": "ValueSet" }`).Code)
+
+	_, err := NewService(failingSource{}).FindValueSet("http://example.org/mammals")
+	assert.Error(t, err)
+	_, isError := err.(*Error)
+	assert.False(t, isError)
+}
+
+func TestExpandExistingExpansion(t *testing.T) {
+	valueSet, err := DecodeResource([]byte(`{
+		"resourceType": "ValueSet",
+		"expansion": { "contains": [
+			{ "system": "http://example.org/animals", "code": "animal", "display": "Animal", "contains": [
+				{ "system": "http://example.org/animals", "code": "dog" }
+			] }
+		] }
+	}`))
+	require.NoError(t, err)
+	expansion, err := NewService(source).Expand(valueSet, ExpandOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"animal", "dog"}, codesOf(expansion.Contains))
+}
+
+func TestValidateCode(t *testing.T) {
+	service := NewService(source)
+	mammals, err := service.FindValueSet("http://example.org/mammals")
+	require.NoError(t, err)
+
+	result, err := service.ValidateCode(mammals, []Coding{{System: "http://example.org/animals", Code: "cat"}})
+	require.NoError(t, err)
+	assert.Equal(t, &CodeValidation{Result: true, Display: "Cat"}, result)
+
+	result, err = service.ValidateCode(mammals, []Coding{{Code: "cat", Display: "cat"}})
+	require.NoError(t, err)
+	assert.True(t, result.Result)
+
+	result, err = service.ValidateCode(mammals, []Coding{{System: "http://example.org/animals", Code: "cat", Display: "Dog"}})
+	require.NoError(t, err)
+	assert.False(t, result.Result)
+	assert.Equal(t, "The display 'Dog' for http://example.org/animals|cat should be 'Cat'", result.Message)
+
+	result, err = service.ValidateCode(mammals, []Coding{{System: "http://example.org/animals", Code: "human"}})
+	require.NoError(t, err)
+	assert.False(t, result.Result)
+	assert.Equal(t, "The code http://example.org/animals|human isn't in http://example.org/mammals", result.Message)
+
+	// any of the codings of a CodeableConcept can be in the value set
+	result, err = service.ValidateCode(mammals, []Coding{{System: "http://snomed.info/sct", Code: "448169003"}, {System: "http://example.org/animals", Code: "dog"}})
+	require.NoError(t, err)
+	assert.True(t, result.Result)
+	assert.Equal(t, "Dog", result.Display)
+
+	result, err = service.ValidateCodeInCodeSystem("http://example.org/animals", Coding{Code: "sparrow"})
+	require.NoError(t, err)
+	assert.Equal(t, &CodeValidation{Result: true, Display: "House sparrow"}, result)
+	result, err = service.ValidateCodeInCodeSystem("http://example.org/animals", Coding{Code: "fish"})
+	require.NoError(t, err)
+	assert.False(t, result.Result)
+	_, err = service.ValidateCodeInCodeSystem("http://snomed.info/sct", Coding{Code: "448169003"})
+	assert.Error(t, err)
+}
+
+func TestLookup(t *testing.T) {
+	service := NewService(source)
+	result, err := service.Lookup("http://example.org/animals", "dog")
+	require.NoError(t, err)
+	assert.Equal(t, "Animals", result.Name)
+	assert.Equal(t, "2", result.Version)
+	assert.Equal(t, "Dog", result.Display)
+	assert.Equal(t, []Designation{{Language: "de", Value: "Hund"}}, result.Designations)
+	require.Len(t, result.Properties, 2)
+	assert.Equal(t, "legs", result.Properties[0].Code)
+	assert.Equal(t, "valueInteger", result.Properties[0].ValueName)
+	assert.Equal(t, Property{Code: "parent", ValueName: "valueCode", Value: "mammal"}, result.Properties[1])
+
+	// the hierarchy can be given by properties
+	result, err = service.Lookup("http://example.org/animals", "mammal")
+	require.NoError(t, err)
+	assert.Equal(t, []Property{
+		{Code: "parent", ValueName: "valueCode", Value: "animal"},
+		{Code: "child", ValueName: "valueCode", Value: "dog"},
+		{Code: "child", ValueName: "valueCode", Value: "cat"},
+		{Code: "child", ValueName: "valueCode", Value: "human"},
+		{Code: "child", ValueName: "valueCode", Value: "platypus"},
+	}, result.Properties)
+
+	_, err = service.Lookup("http://example.org/animals", "fish")
+	assert.Equal(t, "not-found", err.(*Error).Code)
+	_, err = service.Lookup("http://example.org/plants", "rose")
+	assert.Equal(t, "not-found", err.(*Error).Code)
+}
@@ -0,0 +1,389 @@
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StructureDefinition is the part of a StructureDefinition resource needed to validate resources against
+// its snapshot. The snapshot's elements are arranged into a tree of children and slices.
+type StructureDefinition struct {
+	URL            string
+	Name           string
+	Type           string
+	BaseDefinition string
+
+	// the first element of the snapshot, e.g. Patient
+	Root *ElementDefinition
+
+	// elements by id and by path (without slices), e.g. to resolve content references
+	elementsByID   map[string]*ElementDefinition
+	elementsByPath map[string]*ElementDefinition
+
+	// made from the models package rather than loaded
+	isFallback bool
+}
+
+// ElementDefinition is an element in the snapshot of a StructureDefinition
+type ElementDefinition struct {
+	ID        string
+	Path      string
+	SliceName string
+	Min       int
+	Max       string
+
+	// the maximum cardinality of the element in the base resource, which determines whether it's an array in JSON
+	BaseMax string
+
+	// type codes and, for each of them, the profiles the value has to conform to
+	Types    []string
+	Profiles map[string][]string
+
+	ContentReference string
+
+	// fixed[x] and pattern[x] values decoded from JSON
+	Fixed   interface{}
+	Pattern interface{}
+
+	BindingStrength string
+	BindingValueSet string
+
+	Slicing *Slicing
+
+	Children []*ElementDefinition
+	Slices   []*ElementDefinition
+
+	// for definitions made from the models package, the path of a backbone element's children
+	modelPath string
+}
+
+// Slicing describes how the items of a sliced element are assigned to its slices
+type Slicing struct {
+	Discriminators []Discriminator
+	Rules          string
+}
+
+// Discriminator is used to find the slice of an item, e.g. by the value at a path
+type Discriminator struct {
+	Type string
+	Path string
+}
+
+// Name returns the name of the element, e.g. given for HumanName.given or value[x] for Observation.value[x]
+func (e *ElementDefinition) Name() string {
+	return e.Path[strings.LastIndex(e.Path, ".")+1:]
+}
+
+// IsRepeating reports whether the element is an array in JSON
+func (e *ElementDefinition) IsRepeating() bool {
+	return e.BaseMax != "0" && e.BaseMax != "1"
+}
+
+// ParseStructureDefinition reads a StructureDefinition resource, which must have a snapshot
+func ParseStructureDefinition(resourceJSON []byte) (*StructureDefinition, error) {
+	var resource struct {
+		ResourceType   string `json:"resourceType"`
+		URL            string `json:"url"`
+		Name           string `json:"name"`
+		Type           string `json:"type"`
+		BaseDefinition string `json:"baseDefinition"`
+		Snapshot       *struct {
+			Element []map[string]interface{} `json:"element"`
+		} `json:"snapshot"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(resourceJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&resource); err != nil {
+		return nil, errors.Wrap(err, "failed to parse StructureDefinition")
+	}
+	if resource.ResourceType != "StructureDefinition" {
+		return nil, errors.Errorf("expected a StructureDefinition but got a %s", resource.ResourceType)
+	}
+	if resource.Snapshot == nil || len(resource.Snapshot.Element) == 0 {
+		return nil, errors.Errorf("StructureDefinition %s has no snapshot", resource.URL)
+	}
+
+	sd := &StructureDefinition{
+		URL:            resource.URL,
+		Name:           resource.Name,
+		Type:           resource.Type,
+		BaseDefinition: resource.BaseDefinition,
+		elementsByID:   make(map[string]*ElementDefinition),
+		elementsByPath: make(map[string]*ElementDefinition),
+	}
+	var elements []*ElementDefinition
+	for _, element := range resource.Snapshot.Element {
+		elements = append(elements, parseElementDefinition(element))
+	}
+	if err := sd.buildTree(elements); err != nil {
+		return nil, errors.Wrapf(err, "invalid snapshot in StructureDefinition %s", resource.URL)
+	}
+	if sd.Type == "" {
+		sd.Type = sd.Root.Path
+	}
+	return sd, nil
+}
+
+func parseElementDefinition(element map[string]interface{}) *ElementDefinition {
+	e := &ElementDefinition{
+		ID:               stringAt(element, "id"),
+		Path:             stringAt(element, "path"),
+		SliceName:        stringAt(element, "sliceName"),
+		Max:              stringAt(element, "max"),
+		ContentReference: stringAt(element, "contentReference"),
+		Profiles:         make(map[string][]string),
+	}
+	if min, isNumber := element["min"].(json.Number); isNumber {
+		if value, err := min.Int64(); err == nil {
+			e.Min = int(value)
+		}
+	}
+	e.BaseMax = e.Max
+	if base, isObject := element["base"].(map[string]interface{}); isObject && stringAt(base, "max") != "" {
+		e.BaseMax = stringAt(base, "max")
+	}
+
+	types, _ := element["type"].([]interface{})
+	for _, t := range types {
+		t, _ := t.(map[string]interface{})
+		code := stringAt(t, "code")
+		if code == "" {
+			continue
+		}
+		if !containsString(e.Types, code) {
+			e.Types = append(e.Types, code)
+		}
+		// a uri in STU3 and a list of canonicals in R4
+		switch profile := t["profile"].(type) {
+		case string:
+			e.Profiles[code] = append(e.Profiles[code], profile)
+		case []interface{}:
+			for _, p := range profile {
+				if p, isString := p.(string); isString {
+					e.Profiles[code] = append(e.Profiles[code], p)
+				}
+			}
+		}
+	}
+
+	for key, value := range element {
+		if strings.HasPrefix(key, "fixed") {
+			e.Fixed = value
+		} else if strings.HasPrefix(key, "pattern") {
+			e.Pattern = value
+		}
+	}
+
+	if binding, isObject := element["binding"].(map[string]interface{}); isObject {
+		e.BindingStrength = stringAt(binding, "strength")
+		// STU3 has valueSetUri or valueSetReference, R4 has valueSet
+		e.BindingValueSet = stringAt(binding, "valueSet")
+		if uri := stringAt(binding, "valueSetUri"); uri != "" {
+			e.BindingValueSet = uri
+		}
+		if reference, isObject := binding["valueSetReference"].(map[string]interface{}); isObject {
+			e.BindingValueSet = stringAt(reference, "reference")
+		}
+	}
+
+	if slicing, isObject := element["slicing"].(map[string]interface{}); isObject {
+		e.Slicing = &Slicing{Rules: stringAt(slicing, "rules")}
+		discriminators, _ := slicing["discriminator"].([]interface{})
+		for _, discriminator := range discriminators {
+			switch discriminator := discriminator.(type) {
+			case map[string]interface{}:
+				e.Slicing.Discriminators = append(e.Slicing.Discriminators, Discriminator{
+					Type: stringAt(discriminator, "type"),
+					Path: stringAt(discriminator, "path"),
+				})
+			case string:
+				// before STU3 discriminators were only paths
+				e.Slicing.Discriminators = append(e.Slicing.Discriminators, Discriminator{Type: "value", Path: discriminator})
+			}
+		}
+	}
+	return e
+}
+
+// buildTree adds the elements of a snapshot to the children and slices of the elements they follow
+func (sd *StructureDefinition) buildTree(elements []*ElementDefinition) error {
+	sd.Root = elements[0]
+	stack := []*ElementDefinition{sd.Root}
+	for _, element := range elements[1:] {
+		// the slices of an element follow it (and its children), though some
+		// snapshots in the specification have slices without the sliced element
+		sliced := -1
+		if element.SliceName != "" {
+			for i := len(stack) - 1; i >= 0 && sliced < 0; i-- {
+				if stack[i].Path == element.Path && stack[i].SliceName == "" {
+					sliced = i
+				}
+			}
+		}
+		if sliced >= 0 {
+			stack = stack[:sliced+1]
+			stack[sliced].Slices = append(stack[sliced].Slices, element)
+		} else {
+			parentPath := ""
+			if dot := strings.LastIndex(element.Path, "."); dot >= 0 {
+				parentPath = element.Path[:dot]
+			}
+			for len(stack) > 0 && stack[len(stack)-1].Path != parentPath {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				return errors.Errorf("element %s doesn't follow its parent", element.Path)
+			}
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, element)
+		}
+		stack = append(stack, element)
+	}
+
+	for _, element := range elements {
+		if element.ID != "" {
+			sd.elementsByID[element.ID] = element
+		}
+		if _, found := sd.elementsByPath[element.Path]; !found && element.SliceName == "" {
+			sd.elementsByPath[element.Path] = element
+		}
+	}
+	return nil
+}
+
+// element returns the element referred to by a content reference such as #Observation.referenceRange
+func (sd *StructureDefinition) element(contentReference string) *ElementDefinition {
+	reference := contentReference[strings.Index(contentReference, "#")+1:]
+	if element, found := sd.elementsByID[reference]; found {
+		return element
+	}
+	return sd.elementsByPath[reference]
+}
+
+// Definitions are the StructureDefinitions, ValueSets and CodeSystems that resources are validated with,
+// keyed by their canonical URLs
+type Definitions struct {
+	structureDefinitions map[string]*StructureDefinition
+	valueSets            map[string]map[string]interface{}
+	codeSystems          map[string]map[string]interface{}
+}
+
+// NewDefinitions creates an empty set of definitions
+func NewDefinitions() *Definitions {
+	return &Definitions{
+		structureDefinitions: make(map[string]*StructureDefinition),
+		valueSets:            make(map[string]map[string]interface{}),
+		codeSystems:          make(map[string]map[string]interface{}),
+	}
+}
+
+// Load adds the definitions in a JSON file, or in all the JSON files in a directory. A file can contain
+// a single resource or a Bundle of them, like the profiles-resources.json, profiles-types.json and
+// valuesets.json files of the FHIR specification. Resources of other types are ignored.
+func (d *Definitions) Load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to load definitions")
+	}
+
+	paths := []string{path}
+	if info.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return errors.Wrap(err, "failed to list definitions")
+		}
+	}
+
+	for _, path := range paths {
+		fileBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to load definitions")
+		}
+		if err = d.Add(fileBytes); err != nil {
+			return errors.Wrapf(err, "failed to load definitions from %s", path)
+		}
+	}
+	return nil
+}
+
+// Add adds a StructureDefinition, ValueSet or CodeSystem, or those in a Bundle
+func (d *Definitions) Add(resourceJSON []byte) error {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+		Entry        []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(resourceJSON, &resource); err != nil {
+		return errors.Wrap(err, "failed to parse definition")
+	}
+
+	switch resource.ResourceType {
+	case "Bundle":
+		for _, entry := range resource.Entry {
+			if len(entry.Resource) > 0 {
+				if err := d.Add(entry.Resource); err != nil {
+					return err
+				}
+			}
+		}
+	case "StructureDefinition":
+		sd, err := ParseStructureDefinition(resourceJSON)
+		if err != nil {
+			return err
+		}
+		d.structureDefinitions[sd.URL] = sd
+	case "ValueSet", "CodeSystem":
+		parsed, err := decodeJSON(resourceJSON)
+		if err != nil {
+			return err
+		}
+		object, _ := parsed.(map[string]interface{})
+		if resource.ResourceType == "ValueSet" {
+			d.valueSets[stringAt(object, "url")] = object
+		} else {
+			d.codeSystems[stringAt(object, "url")] = object
+		}
+	}
+	return nil
+}
+
+// StructureDefinition returns the StructureDefinition with a canonical URL, or nil if there isn't one
+func (d *Definitions) StructureDefinition(url string) *StructureDefinition {
+	return d.structureDefinitions[url]
+}
+
+// Count returns the number of StructureDefinitions, ValueSets and CodeSystems
+func (d *Definitions) Count() int {
+	return len(d.structureDefinitions) + len(d.valueSets) + len(d.codeSystems)
+}
+
+func decodeJSON(jsonBytes []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JSON")
+	}
+	return value, nil
+}
+
+func stringAt(object map[string]interface{}, key string) string {
+	value, _ := object[key].(string)
+	return value
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package validation
+
+import (
+	"sync"
+
+	"github.com/eug48/fhir/models2"
+)
+
+// fallbackDefinitions caches the definitions made by fallbackDefinition (nil for unknown paths)
+var fallbackDefinitions sync.Map
+
+// fallbackDefinition makes a StructureDefinition for a resource, a data type or a backbone element
+// (e.g. Patient, HumanName or Patient.contact) from the types generated from the specification,
+// for when the definitions of the specification haven't been loaded. Its elements have the minimum
+// cardinalities of the specification, and the code elements its required bindings to the value sets
+// built into models2 (see models2.ValueSetCodes). Backbone elements are only defined one level at a time,
+// as their children may refer to the definitions of their ancestors (e.g. Questionnaire.item.item).
+func fallbackDefinition(path string) *StructureDefinition {
+	if cached, found := fallbackDefinitions.Load(path); found {
+		return cached.(*StructureDefinition)
+	}
+
+	var sd *StructureDefinition
+	if children, found := models2.ChildElements(path); found {
+		sd = &StructureDefinition{
+			URL:            coreStructureDefinitionPrefix + path,
+			Name:           path,
+			Type:           path,
+			elementsByID:   make(map[string]*ElementDefinition),
+			elementsByPath: make(map[string]*ElementDefinition),
+			isFallback:     true,
+		}
+		elements := []*ElementDefinition{{ID: path, Path: path, Max: "*", BaseMax: "*"}}
+		choices := make(map[string]*ElementDefinition)
+		for _, child := range children {
+			if choice := choices[child.Choice]; choice != nil {
+				// another type of a choice element, e.g. valueString after valueQuantity
+				choice.Types = append(choice.Types, child.Type)
+				continue
+			}
+
+			name := child.Name
+			if child.Choice != "" {
+				name = child.Choice
+			}
+			max := "1"
+			if child.Repeating {
+				max = "*"
+			}
+			element := &ElementDefinition{
+				ID:        path + "." + name,
+				Path:      path + "." + name,
+				Min:       child.Min,
+				Max:       max,
+				BaseMax:   max,
+				Types:     []string{child.Type},
+				Profiles:  map[string][]string{},
+				modelPath: child.Path,
+			}
+			if child.ValueSet != "" {
+				element.BindingStrength = "required"
+				element.BindingValueSet = child.ValueSet
+			}
+			if child.Choice != "" {
+				choices[child.Choice] = element
+			}
+			elements = append(elements, element)
+		}
+		sd.buildTree(elements)
+	}
+
+	fallbackDefinitions.Store(path, sd)
+	return sd
+}
@@ -0,0 +1,69 @@
+package validation
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// the regular expressions of the primitive types in the STU3 specification (http://hl7.org/fhir/STU3/datatypes.html)
+var primitiveTypeRegexes = map[string]*regexp.Regexp{
+	"base64Binary": regexp.MustCompile(`^(\s*([0-9a-zA-Z+/=]){4}\s*)+$`),
+	"code":         regexp.MustCompile(`^[^\s]+( [^\s]+)*$`),
+	"date":         regexp.MustCompile(`^-?([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)(-(0[1-9]|1[0-2])(-(0[1-9]|[1-2][0-9]|3[0-1]))?)?$`),
+	"dateTime":     regexp.MustCompile(`^-?([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)(-(0[1-9]|1[0-2])(-(0[1-9]|[1-2][0-9]|3[0-1])(T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00)))?)?)?$`),
+	"decimal":      regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`),
+	"id":           regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`),
+	"instant":      regexp.MustCompile(`^([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)-(0[1-9]|1[0-2])-(0[1-9]|[1-2][0-9]|3[0-1])T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00))$`),
+	"integer":      regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`),
+	"oid":          regexp.MustCompile(`^urn:oid:[0-2](\.(0|[1-9][0-9]*))+$`),
+	"positiveInt":  regexp.MustCompile(`^[1-9][0-9]*$`),
+	"time":         regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?$`),
+	"unsignedInt":  regexp.MustCompile(`^(0|[1-9][0-9]*)$`),
+	"uri":          regexp.MustCompile(`^\S*$`),
+	"uuid":         regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+}
+
+// validatePrimitive checks the JSON type and the format of a primitive value
+func (r *run) validatePrimitive(typeCode string, value interface{}, location string) {
+	var text string
+	switch typeCode {
+	case "boolean":
+		if _, isBoolean := value.(bool); !isBoolean {
+			r.issue("error", "value", location, "%s is not a valid boolean", jsonText(value))
+		}
+		return
+	case "decimal", "integer", "positiveInt", "unsignedInt":
+		number, isNumber := value.(json.Number)
+		if !isNumber {
+			r.issue("error", "value", location, "%s is not a valid %s (it must be a JSON number)", jsonText(value), typeCode)
+			return
+		}
+		text = number.String()
+	default:
+		var isString bool
+		text, isString = value.(string)
+		if !isString {
+			r.issue("error", "value", location, "%s is not a valid %s (it must be a JSON string)", jsonText(value), typeCode)
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			r.issue("error", "value", location, "A %s must not be empty", typeCode)
+			return
+		}
+	}
+
+	if regex, found := primitiveTypeRegexes[typeCode]; found && !regex.MatchString(text) {
+		r.issue("error", "value", location, "%s is not a valid %s", jsonText(value), typeCode)
+		return
+	}
+	if typeCode == "integer" || typeCode == "positiveInt" || typeCode == "unsignedInt" {
+		if number, err := value.(json.Number).Int64(); err != nil || number > math.MaxInt32 || number < math.MinInt32 {
+			r.issue("error", "value", location, "%s is out of the range of a %s", jsonText(value), typeCode)
+		}
+	}
+	if typeCode == "xhtml" && !strings.HasPrefix(strings.TrimSpace(text), "<div") {
+		r.issue("error", "value", location, "The narrative must be in a div element")
+	}
+}
@@ -0,0 +1,671 @@
+// Package validation checks resources against the snapshots of StructureDefinitions: the cardinality and
+// types of their elements, fixed and pattern values, required bindings to value sets and the slices of
+// profiles that are identified by values. Invariants (constraints written in FHIRPath) aren't checked.
+//
+// The StructureDefinitions of the base resources and data types are loaded from the files of the FHIR
+// specification. When one isn't available, a definition made from the types generated from the specification
+// (see models2.ChildElements) is used instead, so that the types, cardinalities and required bindings of codes
+// are still checked. The value sets of those bindings are built in too.
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// the canonical URLs of the StructureDefinitions of the base resources and data types start with this
+const coreStructureDefinitionPrefix = "http://hl7.org/fhir/StructureDefinition/"
+
+// Issue is a problem found in a resource, as in an OperationOutcome
+type Issue struct {
+	// fatal, error, warning or information
+	Severity string
+
+	// from http://hl7.org/fhir/issue-type, e.g. required, structure, value or code-invalid
+	Code string
+
+	Message string
+
+	// FHIRPath expression of the element with the problem, e.g. Patient.name[0].given[1]
+	Location string
+}
+
+// Source provides conformance resources that aren't in the validator's Definitions, such as profiles stored in the server
+type Source interface {
+	// Find returns the JSON of the StructureDefinition, ValueSet or CodeSystem with a canonical URL,
+	// or nil if there isn't one
+	Find(resourceType string, url string) (resourceJSON []byte, err error)
+}
+
+// Validator validates resources using a set of Definitions
+type Validator struct {
+	definitions *Definitions
+}
+
+// NewValidator creates a Validator, which doesn't change the definitions so they must not be changed while it's used
+func NewValidator(definitions *Definitions) *Validator {
+	return &Validator{definitions: definitions}
+}
+
+// Validate checks a resource (in JSON) against the definition of its type, any profiles in its meta.profile
+// and the ones passed in. The profiles and value sets that aren't in the validator's definitions are looked up
+// in the source, which can be nil. An error is only returned if the source fails.
+func (v *Validator) Validate(resourceJSON []byte, profiles []string, source Source) ([]Issue, error) {
+	r := &run{
+		validator:            v,
+		source:               source,
+		structureDefinitions: make(map[string]*StructureDefinition),
+		valueSets:            make(map[string]codeSet),
+		codeSystems:          make(map[string]map[string]interface{}),
+		seen:                 make(map[Issue]bool),
+		unavailableValueSets: make(map[string]bool),
+	}
+
+	resource, err := decodeJSON(resourceJSON)
+	if err != nil {
+		r.issue("fatal", "structure", "", "The resource isn't valid JSON: %s", errors.Cause(err))
+		return r.issues, nil
+	}
+	object, isObject := resource.(map[string]interface{})
+	if !isObject {
+		r.issue("fatal", "structure", "", "The resource must be a JSON object")
+		return r.issues, nil
+	}
+
+	r.validateResource(object, "", profiles)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.issues, nil
+}
+
+// run is the state of a single validation
+type run struct {
+	validator *Validator
+	source    Source
+
+	// definitions found in the source or made from the models (nil if not found)
+	structureDefinitions map[string]*StructureDefinition
+	valueSets            map[string]codeSet
+	codeSystems          map[string]map[string]interface{}
+
+	issues               []Issue
+	seen                 map[Issue]bool
+	unavailableValueSets map[string]bool
+
+	// the first error from the source
+	err error
+}
+
+func (r *run) issue(severity string, code string, location string, format string, args ...interface{}) {
+	issue := Issue{
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Location: location,
+	}
+	// the same problem can be found by both a resource's base definition and its profiles
+	if !r.seen[issue] {
+		r.seen[issue] = true
+		r.issues = append(r.issues, issue)
+	}
+}
+
+// find looks up a conformance resource in the source
+func (r *run) find(resourceType string, url string) interface{} {
+	if r.source == nil || r.err != nil {
+		return nil
+	}
+	resourceJSON, err := r.source.Find(resourceType, url)
+	if err != nil {
+		r.err = errors.Wrapf(err, "failed to find %s %s", resourceType, url)
+		return nil
+	}
+	if resourceJSON == nil {
+		return nil
+	}
+	resource, err := decodeJSON(resourceJSON)
+	if err != nil {
+		return nil
+	}
+	return resource
+}
+
+// structureDefinition returns the StructureDefinition with a canonical URL, or nil if it isn't available
+func (r *run) structureDefinition(url string) *StructureDefinition {
+	if url == "" {
+		return nil
+	}
+	if sd := r.validator.definitions.StructureDefinition(url); sd != nil {
+		return sd
+	}
+	if sd, found := r.structureDefinitions[url]; found {
+		return sd
+	}
+
+	var sd *StructureDefinition
+	if strings.HasPrefix(url, coreStructureDefinitionPrefix) {
+		sd = fallbackDefinition(strings.TrimPrefix(url, coreStructureDefinitionPrefix))
+	}
+	if sd == nil && r.source != nil && r.err == nil {
+		resourceJSON, err := r.source.Find("StructureDefinition", url)
+		if err != nil {
+			r.err = errors.Wrapf(err, "failed to find StructureDefinition %s", url)
+		} else if resourceJSON != nil {
+			sd, err = ParseStructureDefinition(resourceJSON)
+			if err != nil {
+				r.issue("warning", "processing", "", "StructureDefinition %s can't be used: %s", url, errors.Cause(err))
+			}
+		}
+	}
+	r.structureDefinitions[url] = sd
+	return sd
+}
+
+// typeDefinition returns the StructureDefinition of a resource or data type
+func (r *run) typeDefinition(typeCode string) *StructureDefinition {
+	return r.structureDefinition(coreStructureDefinitionPrefix + typeCode)
+}
+
+func (r *run) validateResource(object map[string]interface{}, location string, profiles []string) {
+	resourceType := stringAt(object, "resourceType")
+	if resourceType == "" {
+		r.issue("error", "structure", location, "The resource has no resourceType")
+		return
+	}
+	sd := r.typeDefinition(resourceType)
+	if sd == nil {
+		r.issue("error", "structure", location, "Unknown resource type %s", resourceType)
+		return
+	}
+	if location == "" {
+		location = resourceType
+	}
+	r.validateComplex(sd, sd.Root, "", object, location)
+
+	checked := make(map[string]bool)
+	for _, url := range profiles {
+		r.validateProfile(object, resourceType, url, location, true)
+		checked[url] = true
+	}
+	if meta, isObject := object["meta"].(map[string]interface{}); isObject {
+		metaProfiles, _ := meta["profile"].([]interface{})
+		for _, url := range metaProfiles {
+			if url, isString := url.(string); isString && !checked[url] {
+				r.validateProfile(object, resourceType, url, location, false)
+				checked[url] = true
+			}
+		}
+	}
+}
+
+// validateProfile checks a resource against a profile, which has to be available if it was requested explicitly
+func (r *run) validateProfile(object map[string]interface{}, resourceType string, url string, location string, requested bool) {
+	sd := r.structureDefinition(url)
+	if sd == nil {
+		severity := "warning"
+		if requested {
+			severity = "error"
+		}
+		r.issue(severity, "not-found", location, "Profile %s isn't available", url)
+		return
+	}
+	if sd.Type != resourceType {
+		r.issue("error", "invalid", location, "Profile %s is for %s resources, not %s", url, sd.Type, resourceType)
+		return
+	}
+	r.validateComplex(sd, sd.Root, "", object, location)
+}
+
+// childrenOf returns the definitions of the children of an element, which are in the element's StructureDefinition
+// if it constrains them or otherwise in the definitions of the element's type or of the base resource.
+func (r *run) childrenOf(sd *StructureDefinition, element *ElementDefinition, typeCode string) (*StructureDefinition, []*ElementDefinition) {
+	if len(element.Children) > 0 {
+		return sd, element.Children
+	}
+	if element.modelPath != "" {
+		if fallback := fallbackDefinition(element.modelPath); fallback != nil {
+			return fallback, fallback.Root.Children
+		}
+		return nil, nil
+	}
+	if element.ContentReference != "" {
+		if target := sd.element(element.ContentReference); target != nil && target != element {
+			return r.childrenOf(sd, target, typeCode)
+		}
+		return nil, nil
+	}
+
+	switch typeCode {
+	case "", "BackboneElement", "Element":
+		// the unconstrained children of a backbone element are in the definition this one is based on
+		if base := r.structureDefinition(sd.BaseDefinition); base != nil && !base.isFallback {
+			if baseElement := base.elementsByPath[element.Path]; baseElement != nil {
+				return r.childrenOf(base, baseElement, typeCode)
+			}
+		}
+		if fallback := fallbackDefinition(element.Path); fallback != nil {
+			return fallback, fallback.Root.Children
+		}
+		return nil, nil
+	default:
+		for _, profile := range element.Profiles[typeCode] {
+			if profileSD := r.structureDefinition(profile); profileSD != nil {
+				return r.childrenOf(profileSD, profileSD.Root, "")
+			}
+		}
+		if typeSD := r.typeDefinition(typeCode); typeSD != nil {
+			return r.childrenOf(typeSD, typeSD.Root, "")
+		}
+		return nil, nil
+	}
+}
+
+// item is an occurrence of an element in a JSON object
+type item struct {
+	typeCode string
+	value    interface{}
+	// the "_" property of a primitive element with its id and extensions
+	primitiveElement interface{}
+	location         string
+}
+
+// validateComplex checks the properties of a JSON object against the children of its element
+func (r *run) validateComplex(sd *StructureDefinition, element *ElementDefinition, typeCode string, object map[string]interface{}, location string) {
+	childSD, children := r.childrenOf(sd, element, typeCode)
+	if childSD == nil {
+		r.issue("information", "not-supported", location, "The definition of %s isn't available so its contents weren't checked", element.Path)
+		return
+	}
+
+	matched := make(map[string]bool)
+	if element == sd.Root && stringAt(object, "resourceType") == sd.Type {
+		matched["resourceType"] = true
+	}
+
+	for _, child := range children {
+		if r.err != nil {
+			return
+		}
+		var items []item
+		for _, key := range jsonKeys(child) {
+			value, hasValue := object[key.name]
+			primitiveElement, hasPrimitiveElement := object["_"+key.name]
+			if !isPrimitiveType(key.typeCode) {
+				// left to be reported as unknown
+				hasPrimitiveElement = false
+			}
+			if hasValue {
+				matched[key.name] = true
+			}
+			if hasPrimitiveElement {
+				matched["_"+key.name] = true
+			}
+			if hasValue || hasPrimitiveElement {
+				items = append(items, r.items(child, key, value, hasValue, primitiveElement, hasPrimitiveElement, location)...)
+			}
+		}
+		r.validateItems(childSD, child, items, location)
+	}
+
+	var unknown []string
+	for key := range object {
+		if !matched[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		r.issue("error", "structure", location, "Unrecognised property '%s'", key)
+	}
+}
+
+type jsonKey struct {
+	name     string
+	typeCode string
+}
+
+// jsonKeys returns the names of the properties that an element can have in JSON,
+// e.g. valueQuantity and valueString for Observation.value[x]
+func jsonKeys(element *ElementDefinition) []jsonKey {
+	name := element.Name()
+	if strings.HasSuffix(name, "[x]") {
+		var keys []jsonKey
+		for _, typeCode := range element.Types {
+			keys = append(keys, jsonKey{strings.TrimSuffix(name, "[x]") + upperFirst(typeCode), typeCode})
+		}
+		return keys
+	}
+
+	typeCode := ""
+	if len(element.Types) > 0 {
+		typeCode = element.Types[0]
+	}
+	return []jsonKey{{name, typeCode}}
+}
+
+// items returns the occurrences of an element, which is an array in JSON if it repeats
+func (r *run) items(element *ElementDefinition, key jsonKey, value interface{}, hasValue bool, primitiveElement interface{}, hasPrimitiveElement bool, location string) []item {
+	location = location + "." + key.name
+
+	if !element.IsRepeating() {
+		_, valueIsArray := value.([]interface{})
+		_, primitiveElementIsArray := primitiveElement.([]interface{})
+		if valueIsArray || primitiveElementIsArray {
+			r.issue("error", "structure", location, "%s must not be an array", key.name)
+			return nil
+		}
+		if (hasValue && value == nil) || (hasPrimitiveElement && primitiveElement == nil) {
+			r.issue("error", "structure", location, "%s must not be null", key.name)
+			return nil
+		}
+		return []item{{typeCode: key.typeCode, value: value, primitiveElement: primitiveElement, location: location}}
+	}
+
+	values, valueIsArray := value.([]interface{})
+	primitiveElements, primitiveElementIsArray := primitiveElement.([]interface{})
+	if (hasValue && !valueIsArray) || (hasPrimitiveElement && !primitiveElementIsArray) {
+		r.issue("error", "structure", location, "%s must be an array", key.name)
+		return nil
+	}
+	if (hasValue && len(values) == 0) || (hasPrimitiveElement && len(primitiveElements) == 0) {
+		r.issue("error", "structure", location, "%s must not be an empty array", key.name)
+		return nil
+	}
+
+	count := len(values)
+	if len(primitiveElements) > count {
+		count = len(primitiveElements)
+	}
+	var items []item
+	for i := 0; i < count; i++ {
+		itemLocation := location + "[" + strconv.Itoa(i) + "]"
+		item := item{typeCode: key.typeCode, location: itemLocation}
+		if i < len(values) {
+			item.value = values[i]
+		}
+		if i < len(primitiveElements) {
+			item.primitiveElement = primitiveElements[i]
+		}
+		if item.value == nil && item.primitiveElement == nil {
+			r.issue("error", "structure", itemLocation, "%s must not contain nulls", key.name)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// validateItems checks the number of occurrences of an element and of its slices, and then each occurrence
+func (r *run) validateItems(sd *StructureDefinition, element *ElementDefinition, items []item, location string) {
+	r.checkCardinality(element, element.Path, len(items), location)
+
+	if !r.canSlice(element) {
+		for _, item := range items {
+			r.validateItem(sd, element, item)
+		}
+		return
+	}
+
+	counts := make([]int, len(element.Slices))
+	for _, item := range items {
+		slice := r.sliceOf(sd, element, item.value)
+		if slice < 0 {
+			if element.Slicing.Rules == "closed" {
+				r.issue("error", "structure", item.location, "The value doesn't match any of the slices of %s, which is closed", element.Path)
+			}
+			r.validateItem(sd, element, item)
+		} else {
+			counts[slice]++
+			r.validateItem(sd, element.Slices[slice], item)
+		}
+	}
+	for i, slice := range element.Slices {
+		r.checkCardinality(slice, element.Path+":"+slice.SliceName, counts[i], location)
+	}
+}
+
+func (r *run) checkCardinality(element *ElementDefinition, name string, count int, location string) {
+	if count < element.Min {
+		r.issue("error", "required", location, "%s: minimum required = %d, but only found %d", name, element.Min, count)
+	}
+	if element.Max == "" || element.Max == "*" {
+		return
+	}
+	max, err := strconv.Atoi(element.Max)
+	if err == nil && count > max {
+		if max == 0 {
+			r.issue("error", "structure", location, "%s: not allowed, but found %d", name, count)
+		} else {
+			r.issue("error", "structure", location, "%s: max allowed = %d, but found %d", name, max, count)
+		}
+	}
+}
+
+// validateItem checks an occurrence of an element
+func (r *run) validateItem(sd *StructureDefinition, element *ElementDefinition, item item) {
+	if item.primitiveElement != nil {
+		if object, isObject := item.primitiveElement.(map[string]interface{}); !isObject {
+			r.issue("error", "structure", item.location, "The id and extensions of a primitive value must be in an object")
+		} else if elementSD := r.typeDefinition("Element"); elementSD != nil {
+			r.validateComplex(elementSD, elementSD.Root, "", object, item.location)
+		}
+	}
+	if item.value == nil {
+		return
+	}
+
+	typeCode := item.typeCode
+	if typeCode == "" && element.ContentReference != "" {
+		typeCode = "BackboneElement"
+	}
+
+	switch {
+	case typeCode == "Resource" || typeCode == "DomainResource":
+		object, isObject := item.value.(map[string]interface{})
+		if !isObject {
+			r.issue("error", "structure", item.location, "A resource must be a JSON object")
+			return
+		}
+		r.validateResource(object, item.location, nil)
+	case isPrimitiveType(typeCode):
+		r.validatePrimitive(typeCode, item.value, item.location)
+	default:
+		object, isObject := item.value.(map[string]interface{})
+		if !isObject {
+			r.issue("error", "structure", item.location, "A %s must be a JSON object", typeCode)
+			return
+		}
+		r.validateComplex(sd, element, typeCode, object, item.location)
+	}
+
+	r.checkFixedAndPattern(element, item.value, item.location)
+	r.checkBinding(element, typeCode, item.value, item.location)
+}
+
+func (r *run) checkFixedAndPattern(element *ElementDefinition, value interface{}, location string) {
+	if element.Fixed != nil && !equalJSON(element.Fixed, value) {
+		r.issue("error", "value", location, "Value is %s but must be %s", jsonText(value), jsonText(element.Fixed))
+	}
+	if element.Pattern != nil && !matchesPattern(element.Pattern, value) {
+		r.issue("error", "value", location, "Value %s doesn't match the pattern %s", jsonText(value), jsonText(element.Pattern))
+	}
+}
+
+// canSlice reports whether the slices of an element can be told apart by their discriminators
+func (r *run) canSlice(element *ElementDefinition) bool {
+	if len(element.Slices) == 0 || element.Slicing == nil || len(element.Slicing.Discriminators) == 0 {
+		return false
+	}
+	for _, discriminator := range element.Slicing.Discriminators {
+		if discriminator.Type != "value" && discriminator.Type != "pattern" {
+			return false
+		}
+	}
+	return true
+}
+
+// sliceOf returns the index of the first slice that a value matches, or -1
+func (r *run) sliceOf(sd *StructureDefinition, element *ElementDefinition, value interface{}) int {
+	for i, slice := range element.Slices {
+		matches := true
+		for _, discriminator := range element.Slicing.Discriminators {
+			allowed := r.discriminatorValues(sd, slice, discriminator.Path)
+			if len(allowed) == 0 || !anyMatches(allowed, valuesAtPath(value, discriminator.Path)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return i
+		}
+	}
+	return -1
+}
+
+// discriminatorValues returns the fixed and pattern values at a discriminator's path in a slice's definition
+func (r *run) discriminatorValues(sd *StructureDefinition, element *ElementDefinition, path string) []interface{} {
+	var values []interface{}
+	if path == "" || path == "$this" {
+		if element.Fixed != nil {
+			values = append(values, element.Fixed)
+		}
+		if element.Pattern != nil {
+			values = append(values, element.Pattern)
+		}
+		for _, slice := range element.Slices {
+			values = append(values, r.discriminatorValues(sd, slice, "")...)
+		}
+		return values
+	}
+
+	name, rest := path, ""
+	if dot := strings.Index(path, "."); dot >= 0 {
+		name, rest = path[:dot], path[dot+1:]
+	}
+	// the values can also be in re-sliced children, e.g. in a slice of Observation.code.coding
+	for _, candidate := range append([]*ElementDefinition{element}, element.Slices...) {
+		typeCode := ""
+		if len(candidate.Types) == 1 {
+			typeCode = candidate.Types[0]
+		}
+		childSD, children := r.childrenOf(sd, candidate, typeCode)
+		for _, child := range children {
+			if child.Name() == name {
+				values = append(values, r.discriminatorValues(childSD, child, rest)...)
+			}
+		}
+	}
+	// extensions are sliced by their url, which is in the definitions of the extensions
+	if len(values) == 0 && path == "url" {
+		for _, url := range element.Profiles["Extension"] {
+			values = append(values, url)
+		}
+	}
+	return values
+}
+
+// valuesAtPath returns the values at a path of property names in a JSON value, going into arrays
+func valuesAtPath(value interface{}, path string) []interface{} {
+	values := []interface{}{value}
+	if path == "" || path == "$this" {
+		return values
+	}
+	for _, name := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, value := range values {
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				continue
+			}
+			switch child := object[name].(type) {
+			case nil:
+			case []interface{}:
+				next = append(next, child...)
+			default:
+				next = append(next, child)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func anyMatches(patterns []interface{}, values []interface{}) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matchesPattern(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesPattern reports whether a value has all the properties of a pattern, with arrays in the
+// pattern matching arrays that have matching items
+func matchesPattern(pattern interface{}, value interface{}) bool {
+	switch pattern := pattern.(type) {
+	case map[string]interface{}:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return false
+		}
+		for key, patternValue := range pattern {
+			if !matchesPattern(patternValue, object[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return false
+		}
+		for _, patternItem := range pattern {
+			found := false
+			for _, item := range array {
+				if matchesPattern(patternItem, item) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return equalJSON(pattern, value)
+	}
+}
+
+func equalJSON(a interface{}, b interface{}) bool {
+	return jsonText(a) == jsonText(b)
+}
+
+// jsonText returns a value in JSON, with object keys sorted
+func jsonText(value interface{}) string {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(text)
+}
+
+func isPrimitiveType(typeCode string) bool {
+	return typeCode != "" && unicode.IsLower(rune(typeCode[0]))
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
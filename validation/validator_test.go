@@ -0,0 +1,293 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const specificationDir = "../fsharp-fhir-tools/PathsByType/STU3/"
+
+// testSource is a Source of conformance resources by type and canonical URL
+type testSource map[string]string
+
+func (s testSource) Find(resourceType string, url string) ([]byte, error) {
+	if resourceJSON, found := s[resourceType+" "+url]; found {
+		return []byte(resourceJSON), nil
+	}
+	return nil, nil
+}
+
+type failingSource struct{}
+
+func (failingSource) Find(resourceType string, url string) ([]byte, error) {
+	return nil, errors.New("database is down")
+}
+
+func specificationValidator(t *testing.T) *Validator {
+	definitions := NewDefinitions()
+	require.NoError(t, definitions.Load(specificationDir+"profiles-types.json"))
+	require.NoError(t, definitions.Load(specificationDir+"profiles-others.json"))
+	return NewValidator(definitions)
+}
+
+func issueAt(issues []Issue, location string) *Issue {
+	for i := range issues {
+		if issues[i].Location == location {
+			return &issues[i]
+		}
+	}
+	return nil
+}
+
+func errorCount(issues []Issue) int {
+	count := 0
+	for _, issue := range issues {
+		if issue.Severity == "error" || issue.Severity == "fatal" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestValidateValidResource(t *testing.T) {
+	validator := NewValidator(NewDefinitions())
+	issues, err := validator.Validate([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"active": true,
+		"name": [{ "family": "Duck", "given": ["Donald"] }],
+		"gender": "male",
+		"_gender": { "extension": [{ "url": "http://example.org/ext", "valueString": "x" }] },
+		"birthDate": "1934-06-09",
+		"contact": [{ "name": { "family": "Duck" }, "telecom": [{ "system": "phone", "value": "555" }] }]
+	}`), nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestValidateStructure(t *testing.T) {
+	validator := NewValidator(NewDefinitions())
+	issues, err := validator.Validate([]byte(`{
+		"resourceType": "Patient",
+		"active": "yes",
+		"birthDate": "2019-13-01",
+		"name": [{ "family": ["Duck"], "given": ["Donald", ""] }],
+		"telecom": { "system": "phone" },
+		"foo": 1,
+		"contained": [{ "resourceType": "Organization", "name": 3 }]
+	}`), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, errorCount(issues))
+
+	for _, location := range []string{
+		"Patient.active",
+		"Patient.birthDate",
+		"Patient.name[0].family",
+		"Patient.name[0].given[1]",
+		"Patient.telecom",
+		"Patient.contained[0].name",
+	} {
+		assert.NotNil(t, issueAt(issues, location), location)
+	}
+	assert.Contains(t, issueAt(issues, "Patient").Message, "Unrecognised property 'foo'")
+}
+
+func TestValidateBaseCardinalitiesAndBindings(t *testing.T) {
+	// the minimum cardinalities and required bindings of the specification are built in,
+	// also when only the data types are loaded
+	for _, validator := range []*Validator{NewValidator(NewDefinitions()), specificationValidator(t)} {
+		issues, err := validator.Validate([]byte(`{
+			"resourceType": "Observation",
+			"code": { "text": "Body weight" },
+			"valueQuantity": { "value": 90, "comparator": "about" }
+		}`), nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, errorCount(issues))
+		require.NotNil(t, issueAt(issues, "Observation"))
+		assert.Equal(t, "required", issueAt(issues, "Observation").Code)
+		assert.Contains(t, issueAt(issues, "Observation").Message, "status")
+		require.NotNil(t, issueAt(issues, "Observation.valueQuantity.comparator"))
+		assert.Equal(t, "code-invalid", issueAt(issues, "Observation.valueQuantity.comparator").Code)
+
+		issues, err = validator.Validate([]byte(`{
+			"resourceType": "Observation",
+			"status": "bogus",
+			"code": { "text": "Body weight" }
+		}`), nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, errorCount(issues))
+		require.NotNil(t, issueAt(issues, "Observation.status"))
+		assert.Equal(t, "code-invalid", issueAt(issues, "Observation.status").Code)
+
+		issues, err = validator.Validate([]byte(`{
+			"resourceType": "Observation",
+			"status": "final",
+			"code": { "text": "Body weight" },
+			"valueQuantity": { "value": 90, "comparator": ">=" }
+		}`), nil, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, issues)
+	}
+}
+
+func TestValidateNotAResource(t *testing.T) {
+	validator := NewValidator(NewDefinitions())
+
+	issues, err := validator.Validate([]byte(`{ "resourceType": "Patient", `), nil, nil)
+	assert.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "fatal", issues[0].Severity)
+
+	issues, err = validator.Validate([]byte(`{ "resourceType": "Nonsense" }`), nil, nil)
+	assert.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "Unknown resource type Nonsense", issues[0].Message)
+}
+
+func TestLoadSpecificationDefinitions(t *testing.T) {
+	definitions := NewDefinitions()
+	require.NoError(t, definitions.Load(specificationDir+"profiles-types.json"))
+	require.NoError(t, definitions.Load(specificationDir+"profiles-others.json"))
+
+	bp := definitions.StructureDefinition("http://hl7.org/fhir/StructureDefinition/bp")
+	require.NotNil(t, bp)
+	assert.Equal(t, "Observation", bp.Type)
+	assert.Nil(t, definitions.StructureDefinition("http://example.org/nothing"))
+
+	assert.Error(t, definitions.Load(specificationDir+"missing.json"))
+}
+
+const bloodPressure = `{
+	"resourceType": "Observation",
+	"meta": { "profile": ["http://hl7.org/fhir/StructureDefinition/bp"] },
+	"status": "final",
+	"category": [{ "coding": [{ "system": "http://hl7.org/fhir/observation-category", "code": "vital-signs" }] }],
+	"code": { "coding": [{ "system": "http://loinc.org", "code": "85354-9" }] },
+	"subject": { "reference": "Patient/123" },
+	"effectiveDateTime": "2019-01-01",
+	"component": [
+		{
+			"code": { "coding": [{ "system": "http://loinc.org", "code": "8480-6" }] },
+			"valueQuantity": { "value": 120, "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mm[Hg]" }
+		},
+		{
+			"code": { "coding": [{ "system": "http://loinc.org", "code": "8462-4" }] },
+			"valueQuantity": { "value": 80, "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mm[Hg]" }
+		}
+	]
+}`
+
+func TestValidateProfile(t *testing.T) {
+	validator := specificationValidator(t)
+
+	issues, err := validator.Validate([]byte(bloodPressure), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, errorCount(issues), "%+v", issues)
+
+	// no subject and the wrong units
+	invalid := []byte(`{
+		"resourceType": "Observation",
+		"meta": { "profile": ["http://hl7.org/fhir/StructureDefinition/bp"] },
+		"status": "final",
+		"category": [{ "coding": [{ "system": "http://hl7.org/fhir/observation-category", "code": "vital-signs" }] }],
+		"code": { "coding": [{ "system": "http://loinc.org", "code": "85354-9" }] },
+		"effectiveDateTime": "2019-01-01",
+		"component": [
+			{
+				"code": { "coding": [{ "system": "http://loinc.org", "code": "8480-6" }] },
+				"valueQuantity": { "value": 120, "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mmHg" }
+			},
+			{
+				"code": { "coding": [{ "system": "http://loinc.org", "code": "8462-4" }] },
+				"valueQuantity": { "value": 80, "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mm[Hg]" }
+			}
+		]
+	}`)
+	issues, err = validator.Validate(invalid, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, errorCount(issues), "%+v", issues)
+	if issue := issueAt(issues, "Observation"); assert.NotNil(t, issue) {
+		assert.Equal(t, "required", issue.Code)
+		assert.Equal(t, "Observation.subject: minimum required = 1, but only found 0", issue.Message)
+	}
+	if issue := issueAt(issues, "Observation.component[0].valueQuantity.code"); assert.NotNil(t, issue) {
+		assert.Equal(t, `Value is "mmHg" but must be "mm[Hg]"`, issue.Message)
+	}
+}
+
+func TestValidateRequestedProfiles(t *testing.T) {
+	validator := NewValidator(NewDefinitions())
+	patient := []byte(`{ "resourceType": "Patient", "meta": { "profile": ["http://example.org/meta-profile"] } }`)
+
+	issues, err := validator.Validate(patient, []string{"http://example.org/requested-profile"}, nil)
+	assert.NoError(t, err)
+	require.Len(t, issues, 2)
+	assert.Equal(t, "error", issues[0].Severity)
+	assert.Equal(t, "Profile http://example.org/requested-profile isn't available", issues[0].Message)
+	assert.Equal(t, "warning", issues[1].Severity)
+	assert.Equal(t, "Profile http://example.org/meta-profile isn't available", issues[1].Message)
+
+	// profiles of other types
+	issues, err = specificationValidator(t).Validate(patient, []string{"http://hl7.org/fhir/StructureDefinition/bp"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Profile http://hl7.org/fhir/StructureDefinition/bp is for Observation resources, not Patient", issues[0].Message)
+}
+
+func TestValidateProfileFromSource(t *testing.T) {
+	validator := specificationValidator(t)
+	source := testSource{
+		"StructureDefinition http://example.org/active-patient": `{
+			"resourceType": "StructureDefinition",
+			"url": "http://example.org/active-patient",
+			"name": "ActivePatient",
+			"type": "Patient",
+			"baseDefinition": "http://hl7.org/fhir/StructureDefinition/Patient",
+			"snapshot": { "element": [
+				{ "id": "Patient", "path": "Patient", "min": 0, "max": "*", "base": { "path": "Patient", "min": 0, "max": "*" } },
+				{ "id": "Patient.active", "path": "Patient.active", "min": 1, "max": "1",
+				  "base": { "path": "Patient.active", "min": 0, "max": "1" }, "type": [{ "code": "boolean" }],
+				  "fixedBoolean": true },
+				{ "id": "Patient.gender", "path": "Patient.gender", "min": 0, "max": "1",
+				  "base": { "path": "Patient.gender", "min": 0, "max": "1" }, "type": [{ "code": "code" }],
+				  "binding": { "strength": "required", "valueSetReference": { "reference": "http://example.org/genders" } } }
+			] }
+		}`,
+		"ValueSet http://example.org/genders": `{
+			"resourceType": "ValueSet",
+			"url": "http://example.org/genders",
+			"compose": { "include": [{ "system": "http://hl7.org/fhir/administrative-gender", "concept": [{ "code": "male" }, { "code": "female" }] }] }
+		}`,
+	}
+	profiles := []string{"http://example.org/active-patient"}
+
+	issues, err := validator.Validate([]byte(`{ "resourceType": "Patient", "active": true, "gender": "male" }`), profiles, source)
+	assert.NoError(t, err)
+	assert.Empty(t, issues)
+
+	issues, err = validator.Validate([]byte(`{ "resourceType": "Patient", "gender": "other" }`), profiles, source)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, errorCount(issues), "%+v", issues)
+	assert.Equal(t, "Patient.active: minimum required = 1, but only found 0", issueAt(issues, "Patient").Message)
+	assert.Equal(t, "The value provided ('other') is not in the value set http://example.org/genders", issueAt(issues, "Patient.gender").Message)
+
+	_, err = validator.Validate([]byte(`{ "resourceType": "Patient" }`), profiles, failingSource{})
+	assert.Error(t, err)
+}
+
+func TestValidateBundleEntries(t *testing.T) {
+	validator := NewValidator(NewDefinitions())
+	issues, err := validator.Validate([]byte(`{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{ "resource": { "resourceType": "Patient", "active": true }, "request": { "method": "POST", "url": "Patient" } },
+			{ "resource": { "resourceType": "Patient", "active": 1 }, "request": { "method": "POST", "url": "Patient" } }
+		]
+	}`), nil, nil)
+	assert.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "Bundle.entry[1].resource.active", issues[0].Location)
+}
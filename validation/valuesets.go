@@ -0,0 +1,263 @@
+package validation
+
+import (
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+)
+
+// codeSet is the expansion of a value set: its codes by code system
+type codeSet map[string]map[string]bool
+
+func (s codeSet) add(system string, code string) {
+	if s[system] == nil {
+		s[system] = make(map[string]bool)
+	}
+	s[system][code] = true
+}
+
+// contains reports whether a code is in the set, in any code system if system is empty
+func (s codeSet) contains(system string, code string) bool {
+	if system != "" {
+		return s[system][code]
+	}
+	for _, codes := range s {
+		if codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBinding checks that a coded value is in the value set of a required binding
+func (r *run) checkBinding(element *ElementDefinition, typeCode string, value interface{}, location string) {
+	if element.BindingStrength != "required" || element.BindingValueSet == "" {
+		return
+	}
+	url := element.BindingValueSet
+	if bar := strings.Index(url, "|"); bar >= 0 {
+		url = url[:bar]
+	}
+
+	type coding struct{ system, code string }
+	var codings []coding
+	switch typeCode {
+	case "code", "string", "uri":
+		code, _ := value.(string)
+		codings = append(codings, coding{"", code})
+	case "Coding", "Quantity", "Age", "Count", "Distance", "Duration", "Money", "SimpleQuantity":
+		object, _ := value.(map[string]interface{})
+		if stringAt(object, "code") == "" {
+			// quantities don't need to be coded
+			if typeCode != "Coding" {
+				return
+			}
+		}
+		codings = append(codings, coding{stringAt(object, "system"), stringAt(object, "code")})
+	case "CodeableConcept":
+		object, _ := value.(map[string]interface{})
+		array, _ := object["coding"].([]interface{})
+		for _, c := range array {
+			c, _ := c.(map[string]interface{})
+			if stringAt(c, "code") != "" {
+				codings = append(codings, coding{stringAt(c, "system"), stringAt(c, "code")})
+			}
+		}
+		if len(codings) == 0 {
+			r.issue("error", "code-invalid", location, "No code provided, and a code from the value set %s is required", url)
+			return
+		}
+	default:
+		return
+	}
+
+	codes := r.valueSet(url)
+	if codes == nil {
+		if !r.unavailableValueSets[url] {
+			r.unavailableValueSets[url] = true
+			r.issue("information", "not-supported", location, "The value set %s isn't available or can't be expanded so codes from it weren't checked", url)
+		}
+		return
+	}
+	for _, c := range codings {
+		if c.code != "" && codes.contains(c.system, c.code) {
+			return
+		}
+	}
+	if len(codings) == 1 {
+		r.issue("error", "code-invalid", location, "The value provided ('%s') is not in the value set %s", codings[0].code, url)
+	} else {
+		r.issue("error", "code-invalid", location, "None of the codes provided are in the value set %s", url)
+	}
+}
+
+// valueSet returns the codes in a value set, or nil if it's unavailable or can't be expanded
+// (e.g. because it includes codes using filters). The value sets of the required bindings of the
+// specification's code elements are built in, for when they haven't been loaded.
+func (r *run) valueSet(url string) codeSet {
+	if codes, found := r.valueSets[url]; found {
+		return codes
+	}
+	// value sets including themselves can't be expanded
+	r.valueSets[url] = nil
+
+	valueSet := r.validator.definitions.valueSets[url]
+	if valueSet == nil {
+		valueSet, _ = r.find("ValueSet", url).(map[string]interface{})
+	}
+	if valueSet == nil {
+		builtIn := models2.ValueSetCodes(url)
+		if builtIn == nil {
+			return nil
+		}
+		codes := make(codeSet)
+		for _, code := range builtIn {
+			// they're only bound to code elements, which have no system
+			codes.add("", code)
+		}
+		r.valueSets[url] = codes
+		return codes
+	}
+	codes := r.expand(valueSet)
+	r.valueSets[url] = codes
+	return codes
+}
+
+func (r *run) expand(valueSet map[string]interface{}) codeSet {
+	codes := make(codeSet)
+
+	if expansion, isObject := valueSet["expansion"].(map[string]interface{}); isObject {
+		var addContains func(contains []interface{})
+		addContains = func(contains []interface{}) {
+			for _, c := range contains {
+				c, _ := c.(map[string]interface{})
+				if code := stringAt(c, "code"); code != "" {
+					codes.add(stringAt(c, "system"), code)
+				}
+				nested, _ := c["contains"].([]interface{})
+				addContains(nested)
+			}
+		}
+		contains, _ := expansion["contains"].([]interface{})
+		addContains(contains)
+		return codes
+	}
+
+	compose, isObject := valueSet["compose"].(map[string]interface{})
+	if !isObject {
+		return nil
+	}
+	includes, _ := compose["include"].([]interface{})
+	for _, include := range includes {
+		include, _ := include.(map[string]interface{})
+		included := r.expandComponent(include)
+		if included == nil {
+			return nil
+		}
+		for system, systemCodes := range included {
+			for code := range systemCodes {
+				codes.add(system, code)
+			}
+		}
+	}
+	excludes, _ := compose["exclude"].([]interface{})
+	for _, exclude := range excludes {
+		exclude, _ := exclude.(map[string]interface{})
+		excluded := r.expandComponent(exclude)
+		if excluded == nil {
+			return nil
+		}
+		for system, systemCodes := range excluded {
+			for code := range systemCodes {
+				delete(codes[system], code)
+			}
+		}
+	}
+	return codes
+}
+
+// expandComponent returns the codes of an include or exclude of a value set's compose
+func (r *run) expandComponent(component map[string]interface{}) codeSet {
+	if filters, _ := component["filter"].([]interface{}); len(filters) > 0 {
+		return nil
+	}
+
+	system := stringAt(component, "system")
+	var valueSets []string
+	switch valueSet := component["valueSet"].(type) {
+	case string:
+		valueSets = append(valueSets, valueSet)
+	case []interface{}:
+		for _, v := range valueSet {
+			if v, isString := v.(string); isString {
+				valueSets = append(valueSets, v)
+			}
+		}
+	}
+
+	codes := make(codeSet)
+	if len(valueSets) > 0 {
+		if system != "" {
+			// the intersection of value sets and a code system isn't supported
+			return nil
+		}
+		for _, url := range valueSets {
+			included := r.valueSet(url)
+			if included == nil {
+				return nil
+			}
+			for system, systemCodes := range included {
+				for code := range systemCodes {
+					codes.add(system, code)
+				}
+			}
+		}
+		return codes
+	}
+
+	concepts, _ := component["concept"].([]interface{})
+	if len(concepts) > 0 {
+		for _, concept := range concepts {
+			concept, _ := concept.(map[string]interface{})
+			codes.add(system, stringAt(concept, "code"))
+		}
+		return codes
+	}
+
+	// all the codes of a code system
+	codeSystem := r.codeSystem(system)
+	if codeSystem == nil {
+		return nil
+	}
+	if content := stringAt(codeSystem, "content"); content != "" && content != "complete" {
+		// e.g. SNOMED CT, whose concepts aren't in its CodeSystem resource
+		return nil
+	}
+	var addConcepts func(concepts []interface{})
+	addConcepts = func(concepts []interface{}) {
+		for _, concept := range concepts {
+			concept, _ := concept.(map[string]interface{})
+			codes.add(system, stringAt(concept, "code"))
+			nested, _ := concept["concept"].([]interface{})
+			addConcepts(nested)
+		}
+	}
+	concepts, _ = codeSystem["concept"].([]interface{})
+	addConcepts(concepts)
+	return codes
+}
+
+func (r *run) codeSystem(url string) map[string]interface{} {
+	if url == "" {
+		return nil
+	}
+	if codeSystem := r.validator.definitions.codeSystems[url]; codeSystem != nil {
+		return codeSystem
+	}
+	if codeSystem, found := r.codeSystems[url]; found {
+		return codeSystem
+	}
+	codeSystem, _ := r.find("CodeSystem", url).(map[string]interface{})
+	r.codeSystems[url] = codeSystem
+	return codeSystem
+}